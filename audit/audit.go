@@ -0,0 +1,135 @@
+// Package audit keeps an append-only log of the operations box does on images
+// and registries: pulls, pushes, tags, deletions, signatures and their
+// verification. Each is written as a line of JSON, with who did it, the
+// image, its digest and whether it succeeded, so build farms can trace what
+// each build took and published.
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// The operations which are recorded.
+const (
+	Pull   = "pull"
+	Push   = "push"
+	Tag    = "tag"
+	Delete = "delete"
+	Sign   = "sign"
+	Verify = "verify"
+)
+
+// The outcomes of operations.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is an operation recorded in the log.
+type Event struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	Operation string    `json:"operation"`
+	Image     string    `json:"image"`
+	Digest    string    `json:"digest,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	file     *os.File
+	username string
+	hostname string
+	mutex    sync.Mutex
+)
+
+// Open starts recording operations to the log file, which is created if it
+// does not exist and only ever appended to.
+func Open(fn string) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if file != nil {
+		file.Close()
+	}
+
+	file = f
+	username = currentUser()
+	hostname, _ = os.Hostname()
+
+	return nil
+}
+
+// Close stops recording operations.
+func Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if file == nil {
+		return nil
+	}
+
+	err := file.Close()
+	file = nil
+	return err
+}
+
+// currentUser returns the name of the user running box, and of the user who
+// ran sudo if it was run with sudo.
+func currentUser() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	if sudo := os.Getenv("SUDO_USER"); sudo != "" && sudo != name {
+		name += " (sudo by " + sudo + ")"
+	}
+
+	return name
+}
+
+// Record records the operation on the image, of the digest if it is known, and
+// whether it failed with the error. Nothing is recorded if the log is not
+// open. The log failing to be written does not fail the operation.
+func Record(operation, image, digest string, err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if file == nil {
+		return
+	}
+
+	event := Event{
+		Time:      time.Now().UTC(),
+		User:      username,
+		Host:      hostname,
+		Operation: operation,
+		Image:     image,
+		Digest:    digest,
+		Outcome:   Success,
+	}
+
+	if err != nil {
+		event.Outcome = Failure
+		event.Error = err.Error()
+	}
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// a single write, so lines of processes sharing the log are not mixed.
+	file.Write(append(content, '\n'))
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type auditSuite struct{}
+
+var _ = Suite(&auditSuite{})
+
+func TestAudit(t *T) {
+	TestingT(t)
+}
+
+func readEvents(c *C, fn string) []Event {
+	f, err := os.Open(fn)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := Event{}
+		c.Assert(json.Unmarshal(scanner.Bytes(), &event), IsNil)
+		events = append(events, event)
+	}
+	c.Assert(scanner.Err(), IsNil)
+
+	return events
+}
+
+func (as *auditSuite) TestRecord(c *C) {
+	fn := filepath.Join(c.MkDir(), "audit.log")
+
+	// nothing is recorded before the log is opened.
+	Record(Pull, "debian:latest", "", nil)
+
+	c.Assert(Open(fn), IsNil)
+	Record(Pull, "debian:latest", "sha256:abc", nil)
+	Record(Push, "registry.example.com/app:1.0", "", errors.New("unauthorized"))
+	c.Assert(Close(), IsNil)
+
+	Record(Tag, "app:1.0", "", nil)
+
+	// the log is appended to.
+	c.Assert(Open(fn), IsNil)
+	Record(Delete, "sha256:def", "sha256:def", nil)
+	c.Assert(Close(), IsNil)
+
+	events := readEvents(c, fn)
+	c.Assert(events, HasLen, 3)
+
+	c.Assert(events[0].Operation, Equals, Pull)
+	c.Assert(events[0].Image, Equals, "debian:latest")
+	c.Assert(events[0].Digest, Equals, "sha256:abc")
+	c.Assert(events[0].Outcome, Equals, Success)
+	c.Assert(events[0].Error, Equals, "")
+	c.Assert(events[0].User, Not(Equals), "")
+	c.Assert(events[0].Time.IsZero(), Equals, false)
+
+	c.Assert(events[1].Operation, Equals, Push)
+	c.Assert(events[1].Outcome, Equals, Failure)
+	c.Assert(events[1].Error, Equals, "unauthorized")
+
+	c.Assert(events[2].Operation, Equals, Delete)
+}
@@ -0,0 +1,409 @@
+// Package bake builds the images a bake file declares, with one command:
+// each from its plan, in its context, for each of its platforms, after the
+// images it needs. Each build is run by box as another process, as builds
+// run in their contexts.
+package bake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/box-builder/box/sched"
+	"github.com/ghodss/yaml"
+)
+
+// Image is an image of a bake file.
+type Image struct {
+	Plan      string   `json:"plan"`    // the path of the plan, from the bake file
+	Context   string   `json:"context"` // the directory the plan is built in, from the bake file; the plan's if empty
+	Tags      []string `json:"tags"`
+	Platforms []string `json:"platforms"` // each is built on its own; the host's if empty
+	Profiles  []string `json:"profiles"`
+	Output    string   `json:"output"` // as --output
+	Needs     []string `json:"needs"`  // the images built before this one
+}
+
+// File is a bake file.
+type File struct {
+	Images map[string]*Image `json:"images"`
+
+	dir string
+}
+
+// Build is a build of an image, for one of its platforms.
+type Build struct {
+	Image    string
+	Platform string
+	Plan     string   // the absolute path of the plan
+	Context  string   // the absolute path of the context
+	Tags     []string // with the platform added, if the image has several
+	Profiles []string
+	Output   string
+	Needs    []int // the builds, by index, this one waits for
+}
+
+// Name returns the name of the build: the image, and its platform if it has
+// one.
+func (b Build) Name() string {
+	if b.Platform == "" {
+		return b.Image
+	}
+
+	return b.Image + " " + b.Platform
+}
+
+// Parse parses the bake file, as YAML or JSON.
+func Parse(fn string) (*File, error) {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{}
+	if err := yaml.Unmarshal(content, f); err != nil {
+		return nil, fmt.Errorf("invalid bake file %s: %v", fn, err)
+	}
+
+	if f.dir, err = filepath.Abs(filepath.Dir(fn)); err != nil {
+		return nil, err
+	}
+
+	if len(f.Images) == 0 {
+		return nil, fmt.Errorf("invalid bake file %s: it has no images", fn)
+	}
+
+	for name, image := range f.Images {
+		if image == nil || image.Plan == "" {
+			return nil, fmt.Errorf("invalid bake file %s: image %s has no plan", fn, name)
+		}
+
+		for _, need := range image.Needs {
+			if _, ok := f.Images[need]; !ok {
+				return nil, fmt.Errorf("invalid bake file %s: image %s needs %s, which it does not have", fn, name, need)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// Builds returns the builds of the images given, and of the images they
+// need, or of every image if none are given. The builds are in the order of
+// the images' names, then of their platforms. An error is returned if images
+// need each other.
+func (f *File) Builds(targets []string) ([]Build, error) {
+	names, err := f.selectImages(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	builds := []Build{}
+	indexes := map[string][]int{}
+
+	for _, name := range names {
+		for _, b := range f.imageBuilds(name) {
+			indexes[name] = append(indexes[name], len(builds))
+			builds = append(builds, b)
+		}
+	}
+
+	for i, b := range builds {
+		for _, need := range f.Images[b.Image].Needs {
+			builds[i].Needs = append(builds[i].Needs, indexes[need]...)
+		}
+	}
+
+	tasks := make([]sched.Task, len(builds))
+	for i, b := range builds {
+		tasks[i] = sched.Task{Weight: 1, Needs: b.Needs}
+	}
+
+	if _, err := sched.Priorities(tasks); err != nil {
+		return nil, fmt.Errorf("images of the bake file need each other")
+	}
+
+	return builds, nil
+}
+
+// selectImages returns the names of the images of the targets and of those
+// they need, sorted; all of them if there are no targets.
+func (f *File) selectImages(targets []string) ([]string, error) {
+	selected := map[string]bool{}
+
+	var selectImage func(name string) error
+	selectImage = func(name string) error {
+		image, ok := f.Images[name]
+		if !ok {
+			return fmt.Errorf("the bake file has no image %s", name)
+		}
+
+		if selected[name] {
+			return nil
+		}
+		selected[name] = true
+
+		for _, need := range image.Needs {
+			if err := selectImage(need); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if len(targets) == 0 {
+		for name := range f.Images {
+			targets = append(targets, name)
+		}
+	}
+
+	for _, name := range targets {
+		if err := selectImage(name); err != nil {
+			return nil, err
+		}
+	}
+
+	names := []string{}
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// imageBuilds returns the builds of the image, one per platform, without
+// their needs.
+func (f *File) imageBuilds(name string) []Build {
+	image := f.Images[name]
+
+	plan := filepath.Join(f.dir, image.Plan)
+	dir := filepath.Dir(plan)
+	if image.Context != "" {
+		dir = filepath.Join(f.dir, image.Context)
+	}
+
+	platforms := image.Platforms
+	if len(platforms) == 0 {
+		platforms = []string{""}
+	}
+
+	builds := []Build{}
+	for _, platform := range platforms {
+		b := Build{
+			Image:    name,
+			Platform: platform,
+			Plan:     plan,
+			Context:  dir,
+			Profiles: image.Profiles,
+			Output:   image.Output,
+		}
+
+		for _, tag := range image.Tags {
+			if len(platforms) > 1 {
+				tag += "-" + strings.Replace(platform, "/", "-", -1)
+			}
+			b.Tags = append(b.Tags, tag)
+		}
+
+		if b.Output != "" && len(platforms) > 1 {
+			b.Output += "-" + strings.Replace(platform, "/", "-", -1)
+		}
+
+		builds = append(builds, b)
+	}
+
+	return builds
+}
+
+// Outcome is the outcome of a build.
+type Outcome struct {
+	Image string // the ID of the image built
+	Err   error
+}
+
+// Runner runs builds with Command: box and the global flags of the builds.
+type Runner struct {
+	Command  []string
+	Parallel int       // how many builds run at once
+	Output   io.Writer // what the builds output is written to, each line prefixed with the name of its build
+
+	// Tag, if set, tags the image with the tags of a build after its first,
+	// as --tag gives a build only one. Builds may call it at once.
+	Tag func(image, tag string) error
+
+	mutex sync.Mutex
+}
+
+// Run runs the builds, each once the builds it needs succeeded, up to
+// Parallel at once, the builds at the start of the longest chains first.
+// Builds whose needs failed are not run.
+func (r *Runner) Run(ctx context.Context, builds []Build) []Outcome {
+	tasks := make([]sched.Task, len(builds))
+	for i, b := range builds {
+		tasks[i] = sched.Task{Weight: 1, Needs: b.Needs}
+	}
+
+	priorities, err := sched.Priorities(tasks)
+	results := make([]Outcome, len(builds))
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	parallel := r.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	s, _ := sched.New(parallel, 0)
+
+	done := make([]chan struct{}, len(builds))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	for i, b := range builds {
+		go func(i int, b Build) {
+			defer close(done[i])
+
+			for _, need := range b.Needs {
+				<-done[need]
+
+				if results[need].Err != nil {
+					results[i].Err = fmt.Errorf("not built, as %s, which it needs, failed", builds[need].Name())
+					return
+				}
+			}
+
+			release, err := s.Acquire(ctx, 1, priorities[i])
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			defer release()
+
+			results[i] = r.build(ctx, b)
+		}(i, b)
+	}
+
+	for i := range done {
+		<-done[i]
+	}
+
+	return results
+}
+
+// build runs box for the build, and reads the ID of its image.
+func (r *Runner) build(ctx context.Context, b Build) Outcome {
+	iidfile, err := ioutil.TempFile("", "box-bake-iid")
+	if err != nil {
+		return Outcome{Err: err}
+	}
+	iidfile.Close()
+	defer os.Remove(iidfile.Name())
+
+	args := append(append([]string{}, r.Command[1:]...), "--iidfile", iidfile.Name())
+	if len(b.Tags) > 0 {
+		args = append(args, "--tag", b.Tags[0])
+	}
+
+	if b.Platform != "" {
+		args = append(args, "--platform", b.Platform)
+	}
+
+	if b.Output != "" {
+		args = append(args, "--output", b.Output)
+	}
+
+	for _, profile := range b.Profiles {
+		args = append(args, "--profile", profile)
+	}
+
+	plan := b.Plan
+	if rel, err := filepath.Rel(b.Context, b.Plan); err == nil && !strings.HasPrefix(rel, "..") {
+		plan = rel
+	}
+
+	out := &prefixWriter{prefix: "[" + b.Name() + "] ", out: r.Output, mutex: &r.mutex}
+	defer out.Flush()
+
+	cmd := exec.CommandContext(ctx, r.Command[0], append(args, plan)...)
+	cmd.Dir = b.Context
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return Outcome{Err: fmt.Errorf("the build failed: %v", err)}
+	}
+
+	content, err := ioutil.ReadFile(iidfile.Name())
+	if err != nil {
+		return Outcome{Err: fmt.Errorf("could not read the image built: %v", err)}
+	}
+	id := strings.TrimSpace(string(content))
+
+	for i, tag := range b.Tags {
+		if i == 0 {
+			continue
+		}
+
+		if r.Tag == nil {
+			return Outcome{Image: id, Err: fmt.Errorf("could not tag with %s: images are given more than one tag only with docker or podman", tag)}
+		}
+
+		if err := r.Tag(id, tag); err != nil {
+			return Outcome{Image: id, Err: fmt.Errorf("could not tag with %s: %v", tag, err)}
+		}
+	}
+
+	return Outcome{Image: id}
+}
+
+// prefixWriter writes each line written to it to out, with the prefix.
+// Lines of writers sharing the mutex are not mixed.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mutex  *sync.Mutex
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		pw.writeLine(pw.buf[:i+1])
+		pw.buf = pw.buf[i+1:]
+	}
+}
+
+// Flush writes what is left of the last line.
+func (pw *prefixWriter) Flush() {
+	if len(pw.buf) > 0 {
+		pw.writeLine(append(pw.buf, '\n'))
+		pw.buf = nil
+	}
+}
+
+func (pw *prefixWriter) writeLine(line []byte) {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	pw.out.Write(append([]byte(pw.prefix), line...))
+}
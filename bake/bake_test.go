@@ -0,0 +1,208 @@
+package bake
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type bakeSuite struct{}
+
+var _ = Suite(&bakeSuite{})
+
+func TestBake(t *T) {
+	TestingT(t)
+}
+
+// script stands in for box: it writes its arguments, and the name of its
+// directory as the image ID to the --iidfile, or fails for plans which say
+// so.
+const script = `echo "$@"; for plan; do :; done; grep -q fail "$plan" && exit 3; echo "sha256:$(basename "$PWD")" > "$2"`
+
+const bakeFile = `
+images:
+  base:
+    plan: base/box.rb
+    tags: ["base:latest"]
+  app:
+    plan: app/box.rb
+    context: .
+    tags: ["app:latest", "app:1.0"]
+    platforms: [linux/amd64, linux/arm64]
+    needs: [base]
+  tools:
+    plan: tools/box.rb
+    needs: [base]
+  broken:
+    plan: broken/box.rb
+  after-broken:
+    plan: tools/box.rb
+    needs: [broken]
+`
+
+func writeFiles(c *C, files map[string]string) string {
+	dir := c.MkDir()
+	for name, content := range files {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	return dir
+}
+
+func (bs *bakeSuite) TestParse(c *C) {
+	dir := writeFiles(c, map[string]string{
+		"box-bake.yml": bakeFile,
+		"unknown.yml":  "images:\n  app:\n    plan: box.rb\n    needs: [base]\n",
+		"noplan.yml":   "images:\n  app:\n    tags: [app]\n",
+		"empty.yml":    "images: {}\n",
+		"cycle.yml":    "images:\n  a:\n    plan: a.rb\n    needs: [b]\n  b:\n    plan: b.rb\n    needs: [a]\n",
+	})
+
+	f, err := Parse(filepath.Join(dir, "box-bake.yml"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Images, HasLen, 5)
+	c.Assert(f.Images["app"].Needs, DeepEquals, []string{"base"})
+
+	_, err = Parse(filepath.Join(dir, "unknown.yml"))
+	c.Assert(err, ErrorMatches, ".*image app needs base, which it does not have")
+	_, err = Parse(filepath.Join(dir, "noplan.yml"))
+	c.Assert(err, ErrorMatches, ".*image app has no plan")
+	_, err = Parse(filepath.Join(dir, "empty.yml"))
+	c.Assert(err, ErrorMatches, ".*it has no images")
+
+	f, err = Parse(filepath.Join(dir, "cycle.yml"))
+	c.Assert(err, IsNil)
+	_, err = f.Builds(nil)
+	c.Assert(err, ErrorMatches, "images of the bake file need each other")
+}
+
+func (bs *bakeSuite) TestBuilds(c *C) {
+	dir := writeFiles(c, map[string]string{"box-bake.yml": bakeFile})
+
+	f, err := Parse(filepath.Join(dir, "box-bake.yml"))
+	c.Assert(err, IsNil)
+
+	builds, err := f.Builds([]string{"app"})
+	c.Assert(err, IsNil)
+	c.Assert(builds, DeepEquals, []Build{
+		{
+			Image:    "app",
+			Platform: "linux/amd64",
+			Plan:     filepath.Join(dir, "app/box.rb"),
+			Context:  dir,
+			Tags:     []string{"app:latest-linux-amd64", "app:1.0-linux-amd64"},
+			Needs:    []int{2},
+		},
+		{
+			Image:    "app",
+			Platform: "linux/arm64",
+			Plan:     filepath.Join(dir, "app/box.rb"),
+			Context:  dir,
+			Tags:     []string{"app:latest-linux-arm64", "app:1.0-linux-arm64"},
+			Needs:    []int{2},
+		},
+		{
+			Image:   "base",
+			Plan:    filepath.Join(dir, "base/box.rb"),
+			Context: filepath.Join(dir, "base"),
+			Tags:    []string{"base:latest"},
+		},
+	})
+	c.Assert(builds[0].Name(), Equals, "app linux/amd64")
+	c.Assert(builds[2].Name(), Equals, "base")
+
+	builds, err = f.Builds(nil)
+	c.Assert(err, IsNil)
+	c.Assert(builds, HasLen, 6)
+
+	_, err = f.Builds([]string{"missing"})
+	c.Assert(err, ErrorMatches, "the bake file has no image missing")
+}
+
+func (bs *bakeSuite) TestRun(c *C) {
+	dir := writeFiles(c, map[string]string{
+		"box-bake.yml":  bakeFile,
+		"base/box.rb":   "from 'debian'",
+		"app/box.rb":    "from 'base:latest'",
+		"tools/box.rb":  "from 'base:latest'",
+		"broken/box.rb": "fail",
+	})
+
+	f, err := Parse(filepath.Join(dir, "box-bake.yml"))
+	c.Assert(err, IsNil)
+
+	builds, err := f.Builds(nil)
+	c.Assert(err, IsNil)
+
+	out := bytes.NewBuffer(nil)
+	tagged := []string{}
+	var mutex sync.Mutex
+
+	r := &Runner{
+		Command:  []string{"sh", "-c", script, "box"},
+		Parallel: 2,
+		Output:   out,
+		Tag: func(image, tag string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			tagged = append(tagged, image+" "+tag)
+			return nil
+		},
+	}
+
+	results := r.Run(context.Background(), builds)
+	c.Assert(results, HasLen, len(builds))
+
+	for i, b := range builds {
+		switch b.Image {
+		case "broken":
+			c.Assert(results[i].Err, ErrorMatches, "the build failed: exit status 3")
+		case "after-broken":
+			c.Assert(results[i].Err, ErrorMatches, "not built, as broken, which it needs, failed")
+		case "app":
+			c.Assert(results[i].Err, IsNil)
+			c.Assert(results[i].Image, Equals, "sha256:"+filepath.Base(dir))
+		default:
+			c.Assert(results[i].Err, IsNil)
+			c.Assert(results[i].Image, Equals, "sha256:"+b.Image)
+		}
+	}
+
+	sort.Strings(tagged)
+	c.Assert(tagged, DeepEquals, []string{
+		"sha256:" + filepath.Base(dir) + " app:1.0-linux-amd64",
+		"sha256:" + filepath.Base(dir) + " app:1.0-linux-arm64",
+	})
+
+	// base is built before the images which need it.
+	var base, app bool
+	for _, line := range strings.Split(out.String(), "\n") {
+		switch {
+		case strings.HasPrefix(line, "[base] --iidfile "):
+			c.Assert(app, Equals, false)
+			base = true
+		case strings.HasPrefix(line, "[app linux/arm64] --iidfile "):
+			c.Assert(strings.HasSuffix(line, " --tag app:latest-linux-arm64 --platform linux/arm64 app/box.rb"), Equals, true)
+			app = true
+		}
+	}
+	c.Assert(base, Equals, true)
+	c.Assert(app, Equals, true)
+
+	builds, err = f.Builds([]string{"app"})
+	c.Assert(err, IsNil)
+
+	r.Tag = nil
+	results = r.Run(context.Background(), builds)
+	c.Assert(results[0].Err, ErrorMatches, "could not tag with app:1.0-linux-amd64: .*")
+	c.Assert(results[2].Err, IsNil)
+}
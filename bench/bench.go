@@ -0,0 +1,279 @@
+// Package bench runs the workloads a build spends its time in — compressing
+// layers, pulling, committing and pushing them — and measures their
+// throughput, to compare storage drivers, compression settings and
+// concurrency options on the same hardware.
+package bench
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/box-builder/box/registry"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/spill"
+	"github.com/box-builder/box/tar"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+)
+
+// Measure is how long a workload took, and how many bytes it went through.
+type Measure struct {
+	Workload string        `json:"workload"`
+	Detail   string        `json:"detail"`   // the settings the workload ran with
+	Bytes    int64         `json:"bytes"`    // the bytes the workload went through
+	Duration time.Duration `json:"duration"` // in nanoseconds
+}
+
+// Throughput returns the bytes the workload went through each second.
+func (m Measure) Throughput() float64 {
+	if m.Duration <= 0 {
+		return 0
+	}
+
+	return float64(m.Bytes) / m.Duration.Seconds()
+}
+
+// Write writes the measures as a table.
+func Write(w io.Writer, measures []Measure) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKLOAD\tDETAIL\tSIZE\tTIME\tTHROUGHPUT")
+
+	for _, m := range measures {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s/s\n", m.Workload, m.Detail, units.HumanSize(float64(m.Bytes)), m.Duration.Round(time.Millisecond), units.HumanSize(m.Throughput()))
+	}
+
+	return tw.Flush()
+}
+
+// dataBlockSize is the size of the blocks of the data workloads go through.
+const dataBlockSize = 64 << 10
+
+// Data returns size bytes which compress about as well as the files of a
+// typical layer: blocks of text alternate with blocks of random bytes, as of
+// binaries and compressed files. The same size always gives the same bytes.
+func Data(size int64) io.Reader {
+	return &data{random: rand.New(rand.NewSource(size)), block: make([]byte, dataBlockSize), offset: dataBlockSize, left: size}
+}
+
+var dataText = []byte("box builds images with mruby plans, layer by layer, on a docker host.\n")
+
+type data struct {
+	random *rand.Rand
+	block  []byte
+	offset int
+	blocks int
+	left   int64
+}
+
+func (d *data) Read(p []byte) (int, error) {
+	if d.left == 0 {
+		return 0, io.EOF
+	}
+
+	if d.offset == len(d.block) {
+		if d.blocks%2 == 0 {
+			for i := range d.block {
+				d.block[i] = dataText[i%len(dataText)]
+			}
+		} else {
+			d.random.Read(d.block)
+		}
+
+		d.blocks++
+		d.offset = 0
+	}
+
+	n := copy(p, d.block[d.offset:])
+	if int64(n) > d.left {
+		n = int(d.left)
+	}
+
+	d.offset += n
+	d.left -= int64(n)
+	return n, nil
+}
+
+// Compress compresses size bytes of data with the compression, with the
+// gzip workers for gzip: one for each CPU if zero.
+func Compress(size int64, compression string, workers int) (Measure, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	detail := compression
+	if compression == tar.Gzip {
+		detail = fmt.Sprintf("gzip, %d workers", workers)
+	}
+
+	counter := &countingWriter{w: ioutil.Discard}
+
+	start := time.Now()
+
+	cw, err := tar.Compress(counter, compression, workers)
+	if err != nil {
+		return Measure{}, err
+	}
+
+	if _, err := io.Copy(cw, Data(size)); err != nil {
+		return Measure{}, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return Measure{}, err
+	}
+
+	measure := Measure{Workload: "compress", Bytes: size, Duration: time.Since(start)}
+	measure.Detail = fmt.Sprintf("%s, to %.0f%%", detail, 100*float64(counter.n)/float64(size))
+	return measure, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Pull fetches the layers of the image for this machine from its registry,
+// and discards them.
+func Pull(ctx context.Context, client *registry.Client, image string) (Measure, error) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return Measure{}, err
+	}
+
+	start := time.Now()
+
+	inspection, err := client.Inspect(ctx, ref, registry.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH})
+	if err != nil {
+		return Measure{}, err
+	}
+
+	if inspection.Image == nil {
+		return Measure{}, fmt.Errorf("%s is not available for %s/%s", image, runtime.GOOS, runtime.GOARCH)
+	}
+
+	measure := Measure{Workload: "pull", Detail: fmt.Sprintf("%s, %d layers", image, len(inspection.Image.Layers))}
+
+	for _, layer := range inspection.Image.Layers {
+		rc, _, err := client.GetBlob(ctx, ref.Domain, ref.Repository, layer.Digest)
+		if err != nil {
+			return Measure{}, err
+		}
+
+		n, err := io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return Measure{}, err
+		}
+
+		measure.Bytes += n
+	}
+
+	measure.Duration = time.Since(start)
+	return measure, nil
+}
+
+// Push uploads a blob of size bytes of data, unique to the run, to the
+// repository. The blob is not referenced by any manifest; the repository
+// should be one kept for benchmarks. The blob is buffered on disk if it is
+// larger than the threshold.
+func Push(ctx context.Context, client *registry.Client, repo string, size, threshold int64) (Measure, error) {
+	ref, err := registry.ParseReference(repo)
+	if err != nil {
+		return Measure{}, err
+	}
+
+	buf := spill.New("bench-", threshold, signal.Handler)
+	defer buf.Close()
+
+	// a blob the registry has is not uploaded again by most clients; this one
+	// is new.
+	hash := sha256.New()
+	fmt.Fprintf(io.MultiWriter(buf, hash), "%d\n", time.Now().UnixNano())
+	if _, err := io.Copy(io.MultiWriter(buf, hash), Data(size)); err != nil {
+		return Measure{}, err
+	}
+
+	if _, err := buf.Seek(0, io.SeekStart); err != nil {
+		return Measure{}, err
+	}
+
+	start := time.Now()
+
+	if err := client.PutBlob(ctx, ref.Domain, ref.Repository, "", fmt.Sprintf("sha256:%x", hash.Sum(nil)), buf.Size(), buf); err != nil {
+		return Measure{}, err
+	}
+
+	return Measure{Workload: "push", Detail: ref.Domain + "/" + ref.Repository, Bytes: buf.Size(), Duration: time.Since(start)}, nil
+}
+
+// Commit runs a container of the image which writes size bytes, and commits
+// it, measuring the commit. The image is pulled if docker does not have it;
+// the container and the image committed are removed.
+func Commit(ctx context.Context, docker *client.Client, image string, size int64) (Measure, error) {
+	if _, _, err := docker.ImageInspectWithRaw(ctx, image); err != nil {
+		reader, err := docker.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			return Measure{}, err
+		}
+
+		_, err = io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return Measure{}, err
+		}
+	}
+
+	info, err := docker.Info(ctx)
+	if err != nil {
+		return Measure{}, err
+	}
+
+	cont, err := docker.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Entrypoint: []string{"/bin/sh", "-c", fmt.Sprintf("head -c %d /dev/urandom > /bench", size)},
+	}, nil, nil, "")
+	if err != nil {
+		return Measure{}, err
+	}
+	defer docker.ContainerRemove(context.Background(), cont.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := docker.ContainerStart(ctx, cont.ID, types.ContainerStartOptions{}); err != nil {
+		return Measure{}, err
+	}
+
+	status, err := docker.ContainerWait(ctx, cont.ID)
+	if err != nil {
+		return Measure{}, err
+	}
+
+	if status != 0 {
+		return Measure{}, fmt.Errorf("the container writing the data exited %d", status)
+	}
+
+	start := time.Now()
+
+	commit, err := docker.ContainerCommit(ctx, cont.ID, types.ContainerCommitOptions{})
+	if err != nil {
+		return Measure{}, err
+	}
+
+	duration := time.Since(start)
+	docker.ImageRemove(context.Background(), commit.ID, types.ImageRemoveOptions{PruneChildren: true})
+
+	return Measure{Workload: "commit", Detail: fmt.Sprintf("%s driver", info.Driver), Bytes: size, Duration: duration}, nil
+}
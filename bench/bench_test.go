@@ -0,0 +1,62 @@
+package bench
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/tar"
+	. "gopkg.in/check.v1"
+)
+
+type benchSuite struct{}
+
+var _ = Suite(&benchSuite{})
+
+func TestBench(t *T) {
+	TestingT(t)
+}
+
+func (bs *benchSuite) TestData(c *C) {
+	for _, size := range []int64{0, 1, dataBlockSize, 3*dataBlockSize + 17} {
+		first, err := ioutil.ReadAll(Data(size))
+		c.Assert(err, IsNil)
+		c.Assert(int64(len(first)), Equals, size)
+
+		second, err := ioutil.ReadAll(Data(size))
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(first, second), Equals, true)
+	}
+}
+
+func (bs *benchSuite) TestCompress(c *C) {
+	for _, compression := range []string{tar.Gzip, tar.Zstd} {
+		measure, err := Compress(1<<20, compression, 2)
+		c.Assert(err, IsNil)
+		c.Assert(measure.Workload, Equals, "compress")
+		c.Assert(measure.Bytes, Equals, int64(1<<20))
+		c.Assert(measure.Duration > 0, Equals, true)
+		// half the data is text, which compresses to next to nothing.
+		c.Assert(measure.Detail, Matches, compression+`.*, to (4|5)\d%`)
+	}
+
+	measure, err := Compress(1<<20, tar.Gzip, 2)
+	c.Assert(err, IsNil)
+	c.Assert(measure.Detail, Matches, `gzip, 2 workers, .*`)
+}
+
+func (bs *benchSuite) TestWrite(c *C) {
+	buf := &bytes.Buffer{}
+	c.Assert(Write(buf, []Measure{
+		{Workload: "compress", Detail: "zstd, to 50%", Bytes: 100 << 20, Duration: 2 * time.Second},
+		{Workload: "push", Detail: "registry.example.com/bench", Bytes: 10 << 20},
+	}), IsNil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0], Matches, `WORKLOAD\s+DETAIL\s+SIZE\s+TIME\s+THROUGHPUT`)
+	c.Assert(lines[1], Matches, `compress\s+zstd, to 50%\s+104.9 MB\s+2s\s+52.43 MB/s`)
+	c.Assert(lines[2], Matches, `push\s+registry.example.com/bench\s+10.49 MB\s+0s\s+0 B/s`)
+}
@@ -0,0 +1,1186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/box-builder/box/builder"
+	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/buildreport"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/dockerfile"
+	"github.com/box-builder/box/gitcontext"
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/notify"
+	"github.com/box-builder/box/ocicrypt"
+	"github.com/box-builder/box/provenance"
+	"github.com/box-builder/box/registry"
+	"github.com/box-builder/box/sbom"
+	"github.com/box-builder/box/scan"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/tarcontext"
+	"github.com/box-builder/box/timing"
+	"github.com/box-builder/box/tracing"
+	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
+	"github.com/box-builder/box/watch"
+	"github.com/box-builder/box/webhook"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/term"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+// slowestSteps is the number of steps in the timing summary of a build.
+const slowestSteps = 10
+
+// webhookLogLines is the number of lines of the log of a build webhooks are
+// sent.
+const webhookLogLines = 50
+
+// runBuild builds the plan given as the argument, or the Dockerfile given
+// with --dockerfile, in the context if one is given.
+func runBuild(ctx *cli.Context) {
+	log := logger.New("main", ctx.Bool("no-trim"))
+
+	if ctx.Bool("help") {
+		cli.ShowAppHelp(ctx)
+		os.Exit(0)
+	}
+
+	spec, args, err := planArgs(ctx)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if len(args) < 1 && spec == "" {
+		cli.ShowAppHelp(ctx)
+		log.Error("Please provide a filename to process!")
+		os.Exit(1)
+	}
+
+	tty := !ctx.Bool("no-tty")
+
+	if !term.IsTerminal(0) {
+		tty = ctx.Bool("force-tty")
+	}
+
+	if spec != "" {
+		if ctx.Bool("watch") {
+			log.Error("--watch can't be used with --context or a git repository")
+			os.Exit(1)
+		}
+
+		filename := "box.rb"
+		if len(args) > 0 {
+			filename = args[0]
+		}
+
+		if err := buildIn(ctx, log, spec, filename, tty); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if ctx.Bool("watch") {
+		watchBuild(ctx, log, args[0], tty)
+		return
+	}
+
+	if err := build(ctx, log, args[0], tty, nil); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// planArgs returns the context to build in given with the arguments, if any,
+// and the plan or Dockerfile to build.
+func planArgs(ctx *cli.Context) (string, []string, error) {
+	args := ctx.Args()
+
+	// a git repository may be given in place of the plan, which follows it.
+	spec := ctx.String("context")
+	if len(args) > 0 {
+		_, ok, err := gitcontext.Parse(args[0])
+		if err != nil {
+			return "", nil, err
+		}
+
+		if ok {
+			if spec != "" {
+				return "", nil, fmt.Errorf("--context can't be used with a git repository as the context")
+			}
+
+			spec, args = args[0], args[1:]
+		}
+	}
+
+	// with a Dockerfile, the argument is the context it is built in.
+	dockerfile := ctx.String("dockerfile")
+	if dockerfile != "" && len(args) > 0 {
+		if spec != "" || len(args) > 1 {
+			return "", nil, fmt.Errorf("--dockerfile takes one context: give it as the argument, or with --context")
+		}
+
+		spec, args = args[0], nil
+	}
+
+	if dockerfile == "" && (len(ctx.StringSlice("build-arg")) > 0 || ctx.String("target") != "") {
+		return "", nil, fmt.Errorf("--build-arg and --target need --dockerfile")
+	}
+
+	if dockerfile != "" {
+		args = []string{dockerfile}
+	}
+
+	return spec, args, nil
+}
+
+// getBuildArgs returns the values of the ARGs of the Dockerfile given with
+// --build-arg. Those given by name alone are taken from the environment, and
+// left out if it doesn't have them, as with docker.
+func getBuildArgs(ctx *cli.Context) (map[string]string, error) {
+	args := map[string]string{}
+
+	for _, arg := range ctx.GlobalStringSlice("build-arg") {
+		parts := strings.SplitN(arg, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid --build-arg %q: must be NAME=value or NAME", arg)
+		}
+
+		if len(parts) == 2 {
+			args[parts[0]] = parts[1]
+		} else if value, ok := os.LookupEnv(parts[0]); ok {
+			args[parts[0]] = value
+		}
+	}
+
+	return args, nil
+}
+
+// translateDockerfile translates the Dockerfile into a plan, logging what it
+// leaves out, which is also recorded in the warnings of the build.
+func translateDockerfile(log *logger.Logger, filename string, args map[string]string, target string, warnings *buildreport.Warnings) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	plan, left, err := dockerfile.Translate(f, dockerfile.Options{BuildArgs: args, Target: target})
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if len(left) > 0 {
+		log.Print(log.Notice(fmt.Sprintf("Left out of the Dockerfile: %d\n", len(left))))
+		for _, warning := range left {
+			fmt.Fprintf(log.Output(), "  %s\n", warning)
+			warnings.Add(warning)
+		}
+	}
+
+	return plan, nil
+}
+
+// buildContext is a context a plan is built in other than the working
+// directory: a directory, a checkout of a git repository or an extracted
+// tarball.
+type buildContext struct {
+	dir        string                         // the directory the plan is run in
+	labels     map[string]string              // if set, the image is labeled with them
+	dependency *provenance.ResourceDescriptor // if set, the context among the dependencies of the provenance
+}
+
+// buildIn builds the plan, relative to the context, in it. The context is a
+// directory, a git repository as URL#ref:subdir, which is shallow-cloned, the
+// URL of a tarball, which is fetched, or - for a tarball read from stdin.
+func buildIn(ctx *cli.Context, log *logger.Logger, spec, filename string, tty bool) error {
+	bc := &buildContext{}
+
+	source, ok, err := gitcontext.Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ok, spec == "-", tarcontext.IsURL(spec):
+		if bc.dir, err = ioutil.TempDir("", "box-context"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(bc.dir)
+	}
+
+	switch {
+	case ok:
+		token := ctx.GlobalString("git-token")
+		logger.AddSecret(token)
+
+		log.Print(log.Notice(fmt.Sprintf("Cloning %s\n", source)))
+
+		checkout, err := gitcontext.Clone(context.Background(), source, bc.dir, token)
+		if err != nil {
+			return err
+		}
+
+		log.Print(log.Notice(fmt.Sprintf("Building commit %s\n", checkout.Commit)))
+
+		bc.dir = checkout.Context()
+		bc.labels = checkout.Labels()
+		bc.dependency = &provenance.ResourceDescriptor{
+			URI:    source.URI(),
+			Digest: map[string]string{"gitCommit": checkout.Commit},
+		}
+	case spec == "-":
+		digest, err := tarcontext.Extract(os.Stdin, bc.dir)
+		if err != nil {
+			return err
+		}
+
+		bc.dependency = &provenance.ResourceDescriptor{Name: "stdin", Digest: map[string]string{"sha256": digest}}
+	case tarcontext.IsURL(spec):
+		log.Print(log.Notice(fmt.Sprintf("Fetching %s\n", tarcontext.Redact(spec))))
+
+		digest, err := tarcontext.Fetch(context.Background(), spec, bc.dir)
+		if err != nil {
+			return err
+		}
+
+		bc.dependency = &provenance.ResourceDescriptor{URI: tarcontext.Redact(spec), Digest: map[string]string{"sha256": digest}}
+	default:
+		if bc.dir, err = filepath.Abs(spec); err != nil {
+			return err
+		}
+
+		if fi, err := os.Stat(bc.dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("the context %s is not a directory", spec)
+		}
+	}
+
+	return build(ctx, log, filepath.Join(bc.dir, filename), tty, bc)
+}
+
+// build builds the plan, tagging the result and writing it to --output if
+// requested. The plan is run in the context, if it is given one.
+//
+// The build runs in phases: the flags are checked and the builder is set up,
+// the plan is run, the reports of the steps are written and then the outputs
+// of the image.
+func build(ctx *cli.Context, log *logger.Logger, filename string, tty bool, bc *buildContext) (err error) {
+	if err := checkBuildFlags(ctx, log); err != nil {
+		return err
+	}
+
+	hook, err := globalWebhook(ctx)
+	if err != nil {
+		return err
+	}
+
+	config, err := notify.Load(util.BoxDir("config"))
+	if err != nil {
+		return fmt.Errorf("Can't read the configuration: %v", err)
+	}
+
+	interruptCtx, done := signalContext()
+	defer done()
+
+	traceCtx, span := tracing.Start(interruptCtx, "build", tracing.KindInternal)
+	span.Set("box.plan", filename)
+	span.Set("box.executor", ctx.GlobalString("executor"))
+	defer func() {
+		span.End(err)
+		if err := tracing.Flush(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	// the registry transfers of the build are counted for its profile.
+	transfer := &registry.Transfer{}
+	cancelCtx, cancel := context.WithCancel(registry.WithTransfer(traceCtx, transfer))
+	s := &buildState{
+		ctx:      ctx,
+		log:      log,
+		filename: filename,
+		bc:       bc,
+		context:  cancelCtx,
+		transfer: transfer,
+		report:   &cache.Report{},
+		timings:  &timing.Report{},
+		warnings: &buildreport.Warnings{},
+		started:  time.Now(),
+		pushed:   []string{},
+	}
+
+	if hook != nil || !config.Notify.Empty() {
+		defer func() {
+			notifyBuild(log, hook, &config.Notify, filename, ctx.GlobalString("tag"), s.image, s.pushed, s.started, err)
+		}()
+	}
+
+	if ctx.GlobalString("report") != "" || ctx.GlobalString("report-junit") != "" {
+		defer func() {
+			r := &buildreport.Report{Plan: filename, Image: s.image, Started: s.started, Warnings: s.warnings.List()}
+			r.SetSteps(s.timings, s.report, s.runFailed)
+			if rerr := writeReport(ctx, r, s.pushed, err); rerr != nil {
+				log.Error(rerr)
+			}
+		}()
+	}
+
+	buildConfig, err := s.setup(tty)
+	if err != nil {
+		return err
+	}
+
+	b, err := s.run(cancel, buildConfig)
+	if b != nil {
+		defer b.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.reports(); err != nil {
+		return err
+	}
+
+	return s.outputs(b)
+}
+
+// buildState is the state of a build its phases share.
+type buildState struct {
+	ctx      *cli.Context
+	log      *logger.Logger
+	filename string
+	bc       *buildContext
+	context  context.Context    // canceled as the build is interrupted
+	transfer *registry.Transfer // counts the registry transfers of the build
+
+	recorder *provenance.Recorder // if --provenance is set
+	report   *cache.Report
+	timings  *timing.Report
+	warnings *buildreport.Warnings
+
+	started   time.Time
+	finished  time.Time // once the plan ran
+	image     string    // the image built
+	pushed    []string  // the names the image was pushed to
+	runFailed bool      // if the plan failed, rather than what followed it
+}
+
+// checkBuildFlags checks the flags of a build before anything is built, and
+// that there is the disk space it needs.
+func checkBuildFlags(ctx *cli.Context, log *logger.Logger) error {
+	if err := checkOutputFlags(ctx); err != nil {
+		return err
+	}
+
+	if err := checkScanFlags(ctx); err != nil {
+		return err
+	}
+
+	if err := checkExecutorFlags(ctx); err != nil {
+		return err
+	}
+
+	if err := checkDisk(ctx, log); err != nil {
+		return err
+	}
+
+	if platform := ctx.GlobalString("platform"); platform != "" {
+		if _, err := registry.ParsePlatform(platform); err != nil {
+			return err
+		}
+	}
+
+	if err := tar.ValidCompression(ctx.GlobalString("compression")); err != nil {
+		return err
+	}
+
+	if _, _, err := util.SourceDateEpoch(); err != nil {
+		return err
+	}
+
+	if err := tar.ValidExclude(ctx.GlobalStringSlice("exclude")); err != nil {
+		return err
+	}
+
+	return globalSecurity(ctx).Validate()
+}
+
+// checkOutputFlags checks the flags of what is made of the image: where it
+// is written, signed, encrypted and attested.
+func checkOutputFlags(ctx *cli.Context) error {
+	kind := ""
+	if output := ctx.GlobalString("output"); output != "" {
+		var err error
+		if kind, _, err = builder.ParseOutput(output); err != nil {
+			return err
+		}
+	}
+
+	if output := ctx.GlobalString("sbom"); output != "" {
+		if _, _, err := sbom.ParseOutput(output); err != nil {
+			return err
+		}
+	}
+
+	if policy := ctx.GlobalString("signature-policy"); policy != "" {
+		if err := layers.ValidPolicy(policy); err != nil {
+			return fmt.Errorf("invalid signature policy %s: %v", policy, err)
+		}
+	}
+
+	if ctx.GlobalString("sign-by") != "" && kind != "docker" {
+		return fmt.Errorf("--sign-by needs --output docker://name: only images pushed to a registry can be signed")
+	}
+
+	if ctx.GlobalString("provenance") != "" && kind != "docker" {
+		return fmt.Errorf("--provenance needs --output docker://name: attestations are attached to images pushed to a registry")
+	}
+
+	return checkCryptFlags(ctx)
+}
+
+// checkCryptFlags checks the keys the layers of images are encrypted and
+// decrypted with.
+func checkCryptFlags(ctx *cli.Context) error {
+	if recipients := ctx.GlobalStringSlice("encrypt-recipient"); len(recipients) > 0 {
+		if ctx.GlobalString("sign-by") != "" {
+			return fmt.Errorf("--sign-by can't be used with --encrypt-recipient: GPG signatures of encrypted images are not supported")
+		}
+
+		if _, err := ocicrypt.LoadRecipients(recipients); err != nil {
+			return err
+		}
+	}
+
+	if keys := ctx.GlobalStringSlice("decrypt-key"); len(keys) > 0 {
+		if _, err := ocicrypt.LoadKeys(keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkScanFlags checks the flags of the scans of the image and its layers.
+func checkScanFlags(ctx *cli.Context) error {
+	if scanner := ctx.GlobalString("scan"); scanner != "" {
+		if _, _, err := scan.ParseScanner(scanner); err != nil {
+			return err
+		}
+
+		if err := scan.ValidSeverity(ctx.GlobalString("scan-severity")); err != nil {
+			return err
+		}
+	}
+
+	switch ctx.GlobalString("scan-secrets") {
+	case "", builder.ScanSecretsWarn, builder.ScanSecretsFail:
+		return nil
+	default:
+		return fmt.Errorf("invalid --scan-secrets %q: must be warn or fail", ctx.GlobalString("scan-secrets"))
+	}
+}
+
+// checkExecutorFlags checks the executor, and that the flags which need
+// docker are not given to the others.
+func checkExecutorFlags(ctx *cli.Context) error {
+	switch executor := ctx.GlobalString("executor"); executor {
+	case "", "docker", "podman":
+	case "runc", "containerd", "kubernetes":
+		// these read images from docker, or write them to it.
+		for _, flag := range []string{"scan", "sbom", "cache-to"} {
+			if ctx.GlobalString(flag) != "" {
+				return fmt.Errorf("--%s needs docker: it can't be used with --executor %s", flag, executor)
+			}
+		}
+
+		for _, flag := range []string{"cache-from", "cache-from-image"} {
+			if len(ctx.GlobalStringSlice(flag)) > 0 {
+				return fmt.Errorf("--%s needs docker: it can't be used with --executor %s", flag, executor)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid --executor %q: must be docker, podman, runc, containerd or kubernetes", executor)
+	}
+
+	return nil
+}
+
+// setup returns the configuration of the builder, from the flags and the
+// context, and starts recording the provenance of the build if it is
+// attested.
+func (s *buildState) setup(tty bool) (builder.BuildConfig, error) {
+	ctx := s.ctx
+
+	if ctx.GlobalString("provenance") != "" {
+		s.recorder = provenance.NewRecorder()
+	}
+
+	buildConfig := builder.BuildConfig{
+		Globals: &types.Global{
+			ShowRun:           true,
+			TTY:               tty,
+			OmitFuncs:         ctx.GlobalStringSlice("omit"),
+			Profiles:          ctx.GlobalStringSlice("profile"),
+			Platform:          ctx.GlobalString("platform"),
+			Compression:       ctx.GlobalString("compression"),
+			Reproducible:      ctx.GlobalBool("reproducible"),
+			Exclude:           ctx.GlobalStringSlice("exclude"),
+			SignBy:            ctx.GlobalString("sign-by"),
+			EncryptRecipients: ctx.GlobalStringSlice("encrypt-recipient"),
+			DecryptKeys:       ctx.GlobalStringSlice("decrypt-key"),
+			EagerPull:         ctx.GlobalBool("eager-pull"),
+			Executor:          ctx.GlobalString("executor"),
+			Runtime:           ctx.GlobalString("runtime"),
+			Snapshotter:       ctx.GlobalString("snapshotter"),
+			KubeRegistry:      ctx.GlobalString("kube-registry"),
+			SignaturePolicy:   ctx.GlobalString("signature-policy"),
+			ScanSecrets:       ctx.GlobalString("scan-secrets"),
+			Scheduler:         scheduler,
+			Policy:            registryPolicy,
+			GzipWorkers:       gzipWorkers,
+			SpillThreshold:    spillThreshold,
+			Signals:           signal.Handler,
+			Security:          globalSecurity(ctx),
+			Provenance:        s.recorder,
+			Cache:             getCache(ctx),
+			CacheFrom:         ctx.GlobalStringSlice("cache-from"),
+			CacheFromImages:   ctx.GlobalStringSlice("cache-from-image"),
+			CacheTo:           ctx.GlobalString("cache-to"),
+			Report:            s.report,
+			Timing:            s.timings,
+			Warnings:          s.warnings,
+			Logger:            logger.New(s.filename, ctx.GlobalBool("no-trim")),
+			Context:           s.context,
+		},
+		Runner:    make(chan struct{}),
+		FileName:  s.filename,
+		HoldHooks: true, // run once the image is scanned, in outputs
+	}
+
+	buildArgs, err := getBuildArgs(ctx)
+	if err != nil {
+		return buildConfig, err
+	}
+
+	if ctx.GlobalString("dockerfile") != "" {
+		if buildConfig.Script, err = translateDockerfile(s.log, s.filename, buildArgs, ctx.GlobalString("target"), s.warnings); err != nil {
+			return buildConfig, err
+		}
+	}
+
+	if s.bc == nil {
+		return buildConfig, nil
+	}
+
+	// the plan runs in the context, so the paths given with the flags are
+	// made absolute.
+	globals := buildConfig.Globals
+	globals.Labels = s.bc.labels
+	if globals.Security.Seccomp != "" && globals.Security.Seccomp != "unconfined" {
+		if globals.Security.Seccomp, err = filepath.Abs(globals.Security.Seccomp); err != nil {
+			return buildConfig, err
+		}
+	}
+	if globals.EncryptRecipients, err = absPaths(globals.EncryptRecipients); err != nil {
+		return buildConfig, err
+	}
+	if globals.DecryptKeys, err = absPaths(globals.DecryptKeys); err != nil {
+		return buildConfig, err
+	}
+
+	return buildConfig, nil
+}
+
+// run runs the plan, in the context if there is one, and returns the builder,
+// to be closed once the outputs of the image are written. The paths given with
+// the flags are relative to where box was run, so it is back there once the
+// plan ran.
+func (s *buildState) run(cancel context.CancelFunc, buildConfig builder.BuildConfig) (*builder.Builder, error) {
+	if s.bc != nil {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.Chdir(s.bc.dir); err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err := os.Chdir(wd); err != nil {
+				s.log.Error(err)
+			}
+		}()
+	}
+
+	b, err := mkBuilder(cancel, buildConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	result := b.Run()
+	if result.Err != nil {
+		s.runFailed = true
+		return b, result.Err
+	}
+
+	s.finished = time.Now()
+	s.image = result.Value
+
+	if result.Value != "" {
+		s.log.EvalResponse(result.Value)
+	}
+
+	return b, nil
+}
+
+// reports writes the cache report and the slowest steps of the build, and its
+// profile to --profile-out.
+func (s *buildState) reports() error {
+	log := s.log
+
+	if len(s.report.Steps) > 0 {
+		if err := cache.UpdateStats(func(stats *cache.Stats) { stats.Record(s.report) }); err != nil {
+			log.Error(fmt.Sprintf("Could not record cache statistics: %v", err))
+			s.warnings.Add(fmt.Sprintf("could not record cache statistics: %v", err))
+		}
+
+		log.Print(log.Notice("Cache report:"))
+		s.report.Write(log.Output())
+	}
+
+	if len(s.timings.Steps) > 0 {
+		log.Print(log.Notice("Slowest steps:"))
+		s.timings.Write(log.Output(), slowestSteps)
+	}
+
+	if fn := s.ctx.GlobalString("profile-out"); fn != "" {
+		s.timings.Received, s.timings.Sent = s.transfer.Bytes()
+		if err := s.timings.WriteFile(fn); err != nil {
+			return fmt.Errorf("Can't write the profile to %q: %v", fn, err)
+		}
+	}
+
+	return nil
+}
+
+// outputs scans the image, runs the after_build hooks and then tags the image,
+// writes it to --output with its SBOM and provenance, and its ID to --iidfile.
+func (s *buildState) outputs(b *builder.Builder) error {
+	ctx := s.ctx
+
+	if scanner := ctx.GlobalString("scan"); scanner != "" {
+		if err := scanImage(ctx, s.context, s.log, scanner, s.image); err != nil {
+			return err
+		}
+	}
+
+	if result := b.RunHooks(); result.Err != nil {
+		return result.Err
+	}
+
+	if tag := ctx.GlobalString("tag"); tag != "" {
+		if err := b.Tag(tag); err != nil {
+			return fmt.Errorf("Can't tag with tag %q: %v", tag, err)
+		}
+		s.log.Tag(tag)
+	}
+
+	if output := ctx.GlobalString("output"); output != "" {
+		if err := b.Output(output); err != nil {
+			return fmt.Errorf("Can't write the image to %q: %v", output, err)
+		}
+
+		if kind, name, _ := builder.ParseOutput(output); kind == "docker" {
+			s.pushed = append(s.pushed, name)
+		}
+	}
+
+	if output := ctx.GlobalString("sbom"); output != "" {
+		if err := writeSBOM(ctx, s.context, s.log, s.image, output); err != nil {
+			return fmt.Errorf("Can't write the SBOM to %q: %v", output, err)
+		}
+	}
+
+	if err := s.attest(); err != nil {
+		return err
+	}
+
+	if fn := ctx.GlobalString("iidfile"); fn != "" {
+		if err := ioutil.WriteFile(fn, []byte(s.image), 0644); err != nil {
+			return fmt.Errorf("Can't write the image ID to %q: %v", fn, err)
+		}
+	}
+
+	id := s.image
+	if strings.Contains(id, ":") {
+		id = strings.SplitN(id, ":", 2)[1]
+	}
+
+	s.log.Finish(id)
+	return nil
+}
+
+// attest attaches the provenance of the image to it, if --provenance is set.
+func (s *buildState) attest() error {
+	if s.recorder == nil {
+		return nil
+	}
+
+	build := &provenance.Build{
+		Plan:     s.filename,
+		Profiles: s.ctx.GlobalStringSlice("profile"),
+		Omit:     s.ctx.GlobalStringSlice("omit"),
+		Platform: s.ctx.GlobalString("platform"),
+		Version:  Version,
+		Started:  s.started,
+		Finished: s.finished,
+		Recorder: s.recorder,
+	}
+
+	if s.bc != nil {
+		build.Context = s.bc.dependency
+	}
+
+	if err := attestProvenance(s.ctx, s.context, s.log, build); err != nil {
+		return fmt.Errorf("Can't attest the provenance of the image: %v", err)
+	}
+
+	return nil
+}
+
+// absPaths returns the paths, made absolute.
+func absPaths(paths []string) ([]string, error) {
+	abs := make([]string, len(paths))
+	for i, p := range paths {
+		var err error
+		if abs[i], err = filepath.Abs(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return abs, nil
+}
+
+// globalWebhook returns the webhook builds notify as they finish, from the
+// global flags, or nil if there are no URLs to notify.
+func globalWebhook(ctx *cli.Context) (*webhook.Hook, error) {
+	urls := ctx.GlobalStringSlice("webhook")
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	hook := &webhook.Hook{URLs: urls, Secret: ctx.GlobalString("webhook-secret")}
+
+	if fn := ctx.GlobalString("webhook-template"); fn != "" {
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read --webhook-template: %v", err)
+		}
+
+		if hook.Template, err = webhook.ParseTemplate(fn, string(content)); err != nil {
+			return nil, fmt.Errorf("Invalid --webhook-template: %v", err)
+		}
+	}
+
+	return hook, nil
+}
+
+// notifyBuild notifies the webhook, if there is one, and the notifiers of the
+// configuration that the build finished. Those which could not be notified
+// are reported, but do not fail the build.
+func notifyBuild(log *logger.Logger, hook *webhook.Hook, notifiers *notify.Notifiers, filename, tag, image string, pushed []string, started time.Time, buildErr error) {
+	finished := time.Now()
+	host, _ := os.Hostname()
+
+	e := webhook.Event{
+		Event:    webhook.Succeeded,
+		Plan:     filename,
+		Image:    image,
+		Tag:      tag,
+		Started:  started.UTC(),
+		Finished: finished.UTC(),
+		Duration: finished.Sub(started).Seconds(),
+		Host:     host,
+		Build:    os.Getenv("BOX_BUILD_ID"),
+		Log:      logger.Tail(webhookLogLines),
+	}
+
+	if buildErr != nil {
+		e.Event, e.Image, e.Tag, e.Error = webhook.Failed, "", "", buildErr.Error()
+	} else {
+		for _, p := range pushedDigests(pushed) {
+			e.Pushed = append(e.Pushed, webhook.Pushed{Name: p.Name, Digest: p.Digest})
+		}
+	}
+
+	errs := notifiers.Notify(context.Background(), e)
+	if hook != nil {
+		errs = append(errs, hook.Notify(context.Background(), e)...)
+	}
+
+	for _, err := range errs {
+		log.Error(err)
+	}
+}
+
+// writeReport writes the report of the build to --report as JSON, and to
+// --report-junit as JUnit XML. The digests of the images pushed are looked
+// up in their registries.
+func writeReport(ctx *cli.Context, r *buildreport.Report, pushed []string, buildErr error) error {
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started)
+	r.Status = buildreport.Succeeded
+
+	if buildErr != nil {
+		r.Status, r.Image, r.Error = buildreport.Failed, "", buildErr.Error()
+	}
+
+	if tag := ctx.GlobalString("tag"); tag != "" && buildErr == nil {
+		r.Tags = []string{tag}
+	}
+
+	r.Pushed = pushedDigests(pushed)
+
+	if fn := ctx.GlobalString("report"); fn != "" {
+		if err := r.WriteJSON(fn); err != nil {
+			return fmt.Errorf("Can't write the report to %q: %v", fn, err)
+		}
+	}
+
+	if fn := ctx.GlobalString("report-junit"); fn != "" {
+		if err := r.WriteJUnit(fn); err != nil {
+			return fmt.Errorf("Can't write the JUnit report to %q: %v", fn, err)
+		}
+	}
+
+	return nil
+}
+
+// pushedDigests looks up the digests of the images pushed in their
+// registries. Those which can't be looked up have none.
+func pushedDigests(names []string) []buildreport.Pushed {
+	pushed := []buildreport.Pushed{}
+
+	for _, name := range names {
+		p := buildreport.Pushed{Name: name}
+
+		if ref, err := registry.ParseReference(name); err == nil {
+			if m, err := registry.NewClient(registryPolicy).GetManifest(context.Background(), ref); err == nil {
+				p.Digest = m.Digest
+			}
+		}
+
+		pushed = append(pushed, p)
+	}
+
+	return pushed
+}
+
+// globalSecurity returns how the containers of run steps are confined, from
+// the global flags.
+func globalSecurity(ctx *cli.Context) types.Security {
+	return types.Security{
+		Seccomp:  ctx.GlobalString("seccomp-profile"),
+		AppArmor: ctx.GlobalString("apparmor-profile"),
+		SELinux:  ctx.GlobalStringSlice("selinux-label"),
+		CapAdd:   ctx.GlobalStringSlice("cap-add"),
+		CapDrop:  ctx.GlobalStringSlice("cap-drop"),
+		Network:  ctx.GlobalString("network"),
+	}
+}
+
+// writeSBOM writes an SBOM of the image built to the --sbom location, and
+// attaches it to the image pushed with --output, if it was.
+func writeSBOM(ctx *cli.Context, cancelCtx context.Context, log *logger.Logger, image, output string) error {
+	format, file, err := sbom.ParseOutput(output)
+	if err != nil {
+		return err
+	}
+
+	doc, err := layers.ScanImage(cancelCtx, image)
+	if err != nil {
+		return err
+	}
+
+	kind, pushed, _ := builder.ParseOutput(ctx.GlobalString("output"))
+	if kind == "docker" {
+		doc.Image = pushed
+	} else if tag := ctx.GlobalString("tag"); tag != "" {
+		doc.Image = tag
+	}
+
+	buf := &bytes.Buffer{}
+	if err := doc.Write(buf, format, util.BuildTime()); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	log.Print(log.Notice(fmt.Sprintf("Wrote an SBOM of %d packages to %s", len(doc.Packages), file)))
+
+	if kind != "docker" {
+		return nil
+	}
+
+	ref, err := registry.ParseReference(pushed)
+	if err != nil {
+		return err
+	}
+
+	if _, err := registry.NewClient(registryPolicy).Attach(cancelCtx, ref, sbom.MediaType(format), buf.Bytes()); err != nil {
+		return err
+	}
+
+	log.Print(log.Notice(fmt.Sprintf("Attached the SBOM to %s", pushed)))
+	return nil
+}
+
+// scanImage scans the image built with the scanner, writing the --scan-report,
+// and returns an error if it has vulnerabilities at or above --scan-severity.
+func scanImage(ctx *cli.Context, cancelCtx context.Context, log *logger.Logger, scanner, image string) error {
+	log.Print(log.Notice(fmt.Sprintf("Scanning %s with %s", image, scanner)))
+
+	threshold := ctx.GlobalString("scan-severity")
+	report, err := scan.Image(cancelCtx, scanner, image, threshold, log.Output())
+	if err != nil {
+		return err
+	}
+
+	if file := ctx.GlobalString("scan-report"); file != "" {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(file, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(report.Failed) == 0 {
+		log.Print(log.Notice(fmt.Sprintf("No vulnerabilities at or above %s of %d found", threshold, len(report.Findings))))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(log.Output(), 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VULNERABILITY\tSEVERITY\tPACKAGE\tVERSION\tFIXED IN")
+	for _, finding := range report.Failed {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", finding.ID, finding.Severity, finding.Package, finding.Version, finding.FixedIn)
+	}
+	w.Flush()
+
+	return fmt.Errorf("%s found %d vulnerabilities at or above %s", scanner, len(report.Failed), threshold)
+}
+
+// attestProvenance signs the provenance of the build with the --provenance
+// key, and attaches it to the image pushed with --output.
+func attestProvenance(ctx *cli.Context, cancelCtx context.Context, log *logger.Logger, build *provenance.Build) error {
+	signer, err := registry.LoadSigner(ctx.GlobalString("provenance"))
+	if err != nil {
+		return err
+	}
+
+	build.Images, err = layers.ResolveImages(cancelCtx, build.Recorder.Images())
+	if err != nil {
+		return err
+	}
+
+	predicate, err := build.Predicate()
+	if err != nil {
+		return err
+	}
+
+	_, pushed, _ := builder.ParseOutput(ctx.GlobalString("output"))
+	ref, err := registry.ParseReference(pushed)
+	if err != nil {
+		return err
+	}
+
+	digest, err := registry.NewClient(registryPolicy).Attest(cancelCtx, ref, signer, provenance.PredicateType, predicate)
+	if err != nil {
+		return err
+	}
+
+	log.Print(log.Notice(fmt.Sprintf("Attached the provenance of %s (%s)", pushed, digest)))
+	return nil
+}
+
+// watchBuild builds the plan, then rebuilds it every time the plan or
+// anything in the build context changes. The build cache is what keeps the
+// rebuilds to just the steps whose inputs changed.
+func watchBuild(ctx *cli.Context, log *logger.Logger, filename string, tty bool) {
+	ignore, err := util.ReadLines(".dockerignore")
+	if os.IsNotExist(err) {
+		ignore = []string{}
+	} else if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	w, err := watch.New(ctx.GlobalDuration("watch-interval"), ignore, ".", filename)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	for {
+		command.ResetPulls()
+
+		if err := build(ctx, log, filename, tty, nil); err != nil {
+			log.Error(err)
+		}
+
+		log.Print(log.Notice("Watching for changes...\n"))
+
+		paths, err := w.Wait(context.Background())
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		log.Print(log.Notice(fmt.Sprintf("%d file(s) changed, including %q; rebuilding\n", len(paths), paths[0])))
+	}
+}
+
+// checkDisk makes room for a build, and fails before it starts without
+// enough: with --disk-budget, the oldest cached steps are removed until the
+// build cache and the copy cache fit in the budget, and until --min-free is
+// free for the docker host and the box directory. The build fails if less is
+// free then. The docker host is only checked if it is on this machine, and
+// builds run without docker only check the box directory.
+func checkDisk(ctx *cli.Context, log *logger.Logger) error {
+	budget, err := diskSize(ctx, "disk-budget")
+	if err != nil {
+		return err
+	}
+
+	minFree, err := diskSize(ctx, "min-free")
+	if err != nil {
+		return err
+	}
+
+	if budget == 0 && minFree == 0 {
+		return nil
+	}
+
+	dirs := []string{util.BoxDir()}
+
+	if executor := ctx.GlobalString("executor"); executor == "runc" || executor == "containerd" || executor == "kubernetes" {
+		if budget > 0 {
+			return fmt.Errorf("--disk-budget needs docker: it can't be used with --executor %s", executor)
+		}
+
+		return checkFree(dirs, minFree)
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	if host := os.Getenv("DOCKER_HOST"); host == "" || strings.HasPrefix(host, "unix://") {
+		if info, err := client.Info(context.Background()); err == nil {
+			dirs = append(dirs, info.DockerRootDir)
+		}
+	}
+
+	if budget > 0 {
+		if err := keepBudget(log, client, dirs, budget, minFree); err != nil {
+			return err
+		}
+	}
+
+	return checkFree(dirs, minFree)
+}
+
+// diskSize returns the size given with the flag, or 0 if it is not.
+func diskSize(ctx *cli.Context, flag string) (int64, error) {
+	if ctx.GlobalString(flag) == "" {
+		return 0, nil
+	}
+
+	size, err := units.FromHumanSize(ctx.GlobalString(flag))
+	if err != nil {
+		return 0, fmt.Errorf("invalid --%s: %v", flag, err)
+	}
+
+	return size, nil
+}
+
+// keepBudget removes the oldest cached steps until the build cache and the
+// copy cache are within the budget, and the directories have minFree bytes
+// free.
+func keepBudget(log *logger.Logger, client *client.Client, dirs []string, budget, minFree int64) error {
+	// what interrupted copies left behind goes first.
+	if _, _, err := tar.CollectCopyCache(false); err != nil {
+		return err
+	}
+
+	entries, err := cache.Entries(context.Background(), client)
+	if err != nil {
+		return err
+	}
+
+	total, err := tar.CopyCacheSize()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	reclaim := total - budget
+	for _, dir := range dirs {
+		if free, err := cache.FreeSpace(dir); err == nil && minFree-free > reclaim {
+			reclaim = minFree - free
+		}
+	}
+
+	if reclaim <= 0 {
+		return nil
+	}
+
+	removed, reclaimed, err := pruneCache(log, client, cache.SelectEvict(entries, reclaim))
+	if len(removed) > 0 {
+		log.Print(log.Notice(fmt.Sprintf("Removed the %d oldest cached steps to keep within the disk budget of %s, reclaiming %s\n", len(removed), units.HumanSize(float64(budget)), units.HumanSize(float64(reclaimed)))))
+	}
+
+	return err
+}
+
+// checkFree returns an error if less than minFree is free in any of the
+// directories.
+func checkFree(dirs []string, minFree int64) error {
+	for _, dir := range dirs {
+		free, err := cache.FreeSpace(dir)
+		if err != nil {
+			continue
+		}
+
+		if free < minFree {
+			return fmt.Errorf("need %s free in %s to build, but only %s is: remove cached steps with box cache prune, or let box remove the oldest with --disk-budget", units.HumanSize(float64(minFree)), dir, units.HumanSize(float64(free)))
+		}
+	}
+
+	return nil
+}
@@ -2,7 +2,7 @@ from "debian"
 
 after { tag "box-builder/box:master" }
 DOCKER_VERSION = "1.13.1"
-GOLANG_VERSION = "1.7.5"
+GOLANG_VERSION = "1.24.6"
 LVM2_VERSION = "2.02.103"
 GPGME_VERSION = "1.8.0"
 
@@ -62,7 +62,7 @@ skip do
 
   run "pip -q install mkdocs mkdocs-bootswatch"
 
-  env "PATH" => "/bin:/sbin:/usr/bin:/usr/sbin:/usr/local/bin:/usr/local/sbin:/usr/local/go/bin:/go/bin", "GOPATH" => "/go"
+  env "PATH" => "/bin:/sbin:/usr/bin:/usr/sbin:/usr/local/bin:/usr/local/sbin:/usr/local/go/bin:/go/bin", "GOPATH" => "/go", "GO111MODULE" => "off"
   copy ".", "/go/src/github.com/box-builder/box"
   run "cd /go/src/github.com/box-builder/box && VERSION=#{getenv("VERSION")} make clean install-static"
 
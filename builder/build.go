@@ -0,0 +1,166 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/box-builder/box/buildreport"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/registry"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/timing"
+	"github.com/box-builder/box/types"
+)
+
+// Plan is a plan to build: the name of its file, and its script, which is
+// read from the file if it is empty. Paths in the plan are relative to the
+// working directory, as they are to where box is run.
+type Plan struct {
+	FileName string
+	Script   string
+}
+
+// Options are how a plan is built, as the global flags of box give them. The
+// zero value builds with docker and the build cache, and keeps the image
+// built in docker.
+type Options struct {
+	Executor     string            // docker if empty, podman, runc, containerd or kubernetes
+	Runtime      string            // the OCI runtime the runc executor runs steps with
+	Snapshotter  string            // how the runc executor makes the root filesystems of steps: auto if empty, copy, overlayfs, btrfs or zfs
+	Profiles     []string          // profiles selected for the build
+	Omit         []string          // functions omitted from the plan
+	Vars         map[string]string // variables exposed to the plan with getvar
+	Labels       map[string]string // if set, the image built is labeled with these
+	Platform     string            // if set, the os/arch[/variant] to build for
+	Compression  string            // gzip if empty, zstd or estargz
+	Reproducible bool
+	NoCache      bool
+	CacheFrom    []string
+	CacheTo      string
+	Tag          string         // if set, the image built is tagged with it
+	Output       string         // if set, where the image built is written: oci:path, or docker://name to push it
+	Log          io.Writer      // where the output of the build is written; it is discarded if nil
+	LogHandler   logger.Handler // if set, the output of the build is handed to it as records instead of written to Log
+
+	Policy         *policy.Policy      // if set, the registries and base images the build may use
+	GzipWorkers    int                 // the goroutines layers are gzipped with; one for each CPU if zero
+	SpillThreshold int64               // the size above which layers are buffered on disk; spill.DefaultThreshold if zero
+	Secrets        []string            // values redacted from the output of the build, as well as the secrets of its plan
+	Signals        *signal.Cancellable // if set, the temporary files of the build are removed by it on interrupt
+	Transfer       *registry.Transfer  // if set, the bytes the build transfers to and from registries are counted into it
+}
+
+// Result is what a build did.
+type Result struct {
+	Image    string         // the ID of the image built
+	Pushed   string         // the image pushed with Output, if it was
+	Cache    *cache.Report  // the steps found in the build cache, and those which were not
+	Timing   *timing.Report // how long each step took
+	Warnings []string
+}
+
+// Build builds the plan; the build is interrupted as ctx is canceled. Unlike
+// NewBuilder, it leaves the colors and progress meters of the process alone,
+// and takes its settings from opts alone, so builds may run at once, each
+// with its own log, secrets, cache report and timing. Paths in plans are
+// relative to the working directory of the process.
+func Build(ctx context.Context, plan Plan, opts Options) (Result, error) {
+	if plan.FileName == "" {
+		return Result{}, errors.New("the plan has no file name")
+	}
+
+	kind, name := "", ""
+	if opts.Output != "" {
+		var err error
+		if kind, name, err = ParseOutput(opts.Output); err != nil {
+			return Result{}, err
+		}
+	}
+
+	out := opts.Log
+	if out == nil {
+		out = ioutil.Discard
+	}
+
+	log := logger.NewWriter(plan.FileName, out, false)
+	if opts.LogHandler != nil {
+		log = logger.NewHandler(plan.FileName, opts.LogHandler)
+	}
+
+	for _, secret := range opts.Secrets {
+		log.AddSecret(secret)
+	}
+
+	if opts.Transfer != nil {
+		ctx = registry.WithTransfer(ctx, opts.Transfer)
+	}
+
+	r := Result{Cache: &cache.Report{}, Timing: &timing.Report{}}
+	warnings := &buildreport.Warnings{}
+
+	b, err := newBuilder(BuildConfig{
+		Globals: &types.Global{
+			Cache:          !opts.NoCache,
+			CacheFrom:      opts.CacheFrom,
+			CacheTo:        opts.CacheTo,
+			Report:         r.Cache,
+			Timing:         r.Timing,
+			Warnings:       warnings,
+			ShowRun:        true,
+			OmitFuncs:      opts.Omit,
+			Vars:           opts.Vars,
+			Labels:         opts.Labels,
+			Profiles:       opts.Profiles,
+			Platform:       opts.Platform,
+			Compression:    opts.Compression,
+			Reproducible:   opts.Reproducible,
+			Executor:       opts.Executor,
+			Runtime:        opts.Runtime,
+			Snapshotter:    opts.Snapshotter,
+			Policy:         opts.Policy,
+			GzipWorkers:    opts.GzipWorkers,
+			SpillThreshold: opts.SpillThreshold,
+			Signals:        opts.Signals,
+			Logger:         log,
+			Context:        ctx,
+		},
+		Runner:   make(chan struct{}),
+		FileName: plan.FileName,
+		Script:   plan.Script,
+	})
+	if err != nil {
+		return r, err
+	}
+	defer b.Close()
+
+	result := b.Run()
+	r.Warnings = warnings.List()
+	if result.Err != nil {
+		return r, result.Err
+	}
+
+	r.Image = result.Value
+
+	if opts.Tag != "" {
+		if err := b.Tag(opts.Tag); err != nil {
+			return r, fmt.Errorf("could not tag the image with %q: %v", opts.Tag, err)
+		}
+	}
+
+	if opts.Output != "" {
+		if err := b.Output(opts.Output); err != nil {
+			return r, fmt.Errorf("could not write the image to %q: %v", opts.Output, err)
+		}
+
+		if kind == "docker" {
+			r.Pushed = name
+		}
+	}
+
+	return r, nil
+}
@@ -3,13 +3,18 @@ package builder
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"strings"
 
 	"github.com/box-builder/box/builder/command"
 	"github.com/box-builder/box/builder/evaluator"
 	"github.com/box-builder/box/builder/evaluator/mruby"
 	"github.com/box-builder/box/builder/executor"
+	"github.com/box-builder/box/builder/executor/containerd"
 	"github.com/box-builder/box/builder/executor/docker"
+	"github.com/box-builder/box/builder/executor/kube"
+	"github.com/box-builder/box/builder/executor/runc"
 	"github.com/box-builder/box/copy"
 	"github.com/box-builder/box/logger"
 	"github.com/box-builder/box/types"
@@ -21,6 +26,11 @@ type BuildConfig struct {
 	Globals  *types.Global
 	Runner   chan struct{}
 	FileName string
+	Script   string // if set, the plan run in place of the file's, such as a Dockerfile translated
+
+	// HoldHooks leaves the after_build hooks of the plan to RunHooks, for
+	// callers with checks of their own to pass first.
+	HoldHooks bool
 }
 
 // Builder implements the builder core.
@@ -31,6 +41,7 @@ type Builder struct {
 }
 
 // NewBuilder creates a new builder. Returns error on docker or mruby issues.
+// Without a TTY, it turns colors and progress meters off for the process.
 func NewBuilder(bc BuildConfig) (*Builder, error) {
 	if bc.Globals == nil {
 		bc.Globals = &types.Global{Context: context.Background()}
@@ -41,11 +52,21 @@ func NewBuilder(bc BuildConfig) (*Builder, error) {
 		copy.NoTTY = true
 	}
 
+	return newBuilder(bc)
+}
+
+// newBuilder creates a new builder, leaving the state of the process alone.
+func newBuilder(bc BuildConfig) (*Builder, error) {
 	if bc.Globals.Logger == nil {
 		bc.Globals.Logger = logger.New(bc.FileName, true)
 	}
 
-	exec, err := NewExecutor("docker", bc.Globals)
+	name := bc.Globals.Executor
+	if name == "" {
+		name = "docker"
+	}
+
+	exec, err := NewExecutor(name, bc.Globals)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +78,9 @@ func NewBuilder(bc BuildConfig) (*Builder, error) {
 		Interp:   command.NewInterpreter(bc.Globals, exec),
 	})
 	if err != nil {
+		if closer, ok := exec.(io.Closer); ok {
+			closer.Close()
+		}
 		return nil, err
 	}
 
@@ -83,18 +107,105 @@ func (b *Builder) Result() types.BuildResult {
 func (b *Builder) Run() types.BuildResult {
 	defer close(b.config.Runner)
 
-	script, err := ioutil.ReadFile(b.config.FileName)
-	if err != nil {
+	script := b.config.Script
+	if script == "" {
+		content, err := ioutil.ReadFile(b.config.FileName)
+		if err != nil {
+			return types.BuildResult{
+				FileName: b.config.FileName,
+				Err:      err,
+			}
+		}
+		script = string(content)
+	}
+
+	if err := b.eval.RunScript(script); err != nil {
+		return b.Result()
+	}
+
+	if err := b.checkPolicy(); err != nil {
 		return types.BuildResult{
 			FileName: b.config.FileName,
 			Err:      err,
 		}
 	}
 
-	b.eval.RunScript(string(script))
+	if err := b.findLeaks(); err != nil {
+		return types.BuildResult{
+			FileName: b.config.FileName,
+			Err:      err,
+		}
+	}
+
+	if !b.config.HoldHooks {
+		if result := b.RunHooks(); result.Err != nil {
+			return result
+		}
+	}
+
+	if b.config.Globals.CacheTo != "" {
+		if err := b.exec.Layers().ExportCache(b.config.Globals.CacheTo); err != nil {
+			return types.BuildResult{
+				FileName: b.config.FileName,
+				Err:      err,
+			}
+		}
+	}
+
+	return b.Result()
+}
+
+// RunHooks runs the after_build hooks of the plan. Run runs them once the
+// image built has passed the policy and the secret scan, unless the hooks are
+// held.
+func (b *Builder) RunHooks() types.BuildResult {
+	// the result of the hooks, or their error, is the evaluator's.
+	b.eval.RunHooks()
 	return b.Result()
 }
 
+// checkPolicy checks the image built follows the rules of the policy, if
+// there is one.
+func (b *Builder) checkPolicy() error {
+	config := b.exec.Config()
+	if b.config.Globals.Policy == nil || config.Image == "" {
+		return nil
+	}
+
+	return b.config.Globals.Policy.CheckImage(config.User.Image, config.Labels)
+}
+
+// findLeaks shows the secrets found in the layers the build added, and fails
+// the build if there are any and it is to.
+func (b *Builder) findLeaks() error {
+	mode := b.config.Globals.ScanSecrets
+	if mode == "" || b.exec.Config().Image == "" {
+		return nil
+	}
+
+	findings, err := b.exec.Image().FindLeaks(b.config.Globals.Logger.Secrets())
+	if err != nil {
+		return fmt.Errorf("scanning the layers built for secrets: %v", err)
+	}
+
+	if len(findings) == 0 {
+		return nil
+	}
+
+	log := b.config.Globals.Logger
+	log.Print(log.Notice(fmt.Sprintf("Secrets found in the layers built: %d\n", len(findings))))
+	for _, finding := range findings {
+		fmt.Fprintf(log.Output(), "  layer %d: %s:%d: %s %s\n", finding.Layer, finding.Path, finding.Line, finding.Rule, finding.Match)
+		b.config.Globals.Warnings.Add(fmt.Sprintf("secret found in layer %d: %s:%d: %s", finding.Layer, finding.Path, finding.Line, finding.Rule))
+	}
+
+	if mode == ScanSecretsFail {
+		return fmt.Errorf("%d secrets were found in the layers built", len(findings))
+	}
+
+	return nil
+}
+
 // Wait waits for the build to complete.
 func (b *Builder) Wait() types.BuildResult {
 	<-b.config.Runner
@@ -106,16 +217,74 @@ func (b *Builder) Tag(tag string) error {
 	return b.exec.Image().Tag(tag)
 }
 
+// What builds do when secrets are found in the layers built.
+const (
+	ScanSecretsWarn = "warn"
+	ScanSecretsFail = "fail"
+)
+
+// ParseOutput parses an --output location, kind:path, returning the kind and
+// the path. The kinds are oci, an OCI image layout directory, and docker, a
+// registry to push to given as docker://name.
+func ParseOutput(output string) (string, string, error) {
+	parts := strings.SplitN(output, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid output %q: must be kind:path", output)
+	}
+
+	switch parts[0] {
+	case "oci":
+		return parts[0], parts[1], nil
+	case "docker":
+		if !strings.HasPrefix(parts[1], "//") || len(parts[1]) == 2 {
+			return "", "", fmt.Errorf("invalid output %q: must be docker://name", output)
+		}
+
+		return parts[0], parts[1][2:], nil
+	default:
+		return "", "", fmt.Errorf("invalid output %q: %q is not a valid kind", output, parts[0])
+	}
+}
+
+// Output writes the image built to an --output location.
+func (b *Builder) Output(output string) error {
+	kind, path, err := ParseOutput(output)
+	if err != nil {
+		return err
+	}
+
+	if kind == "docker" {
+		return b.exec.Image().Push(path)
+	}
+
+	return b.exec.Image().SaveLayout(path)
+}
+
 // Close tears down all functions of the builder, preparing it for exit.
 func (b *Builder) Close() error {
-	return b.eval.Close()
+	err := b.eval.Close()
+
+	if closer, ok := b.exec.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
 }
 
 // NewExecutor returns a valid executor for the given name, or error.
 func NewExecutor(name string, globals *types.Global) (executor.Executor, error) {
 	switch name {
-	case "docker":
+	case "docker", "podman":
+		// podman serves the API of docker, which the client was pointed at.
 		return docker.NewDocker(globals)
+	case "runc":
+		return runc.NewRunc(globals)
+	case "containerd":
+		return containerd.NewContainerd(globals)
+	case "kubernetes":
+		return kube.NewKubernetes(globals)
 	}
 
 	return nil, fmt.Errorf("Executor %q not found", name)
@@ -4,24 +4,31 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	. "testing"
 	"time"
 
 	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/graph"
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/policy"
 	btypes "github.com/box-builder/box/types"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
 
-	. "gopkg.in/check.v1"
+	"gopkg.in/check.v1"
 )
 
 type builderSuite struct{}
@@ -32,40 +39,40 @@ const copyPath = "testdata/copy"
 
 var dockerClient *client.Client
 
-var _ = Suite(&builderSuite{})
+var _ = check.Suite(&builderSuite{})
 
 func TestBuilder(t *T) {
-	TestingT(t)
+	check.TestingT(t)
 }
 
-func (bs *builderSuite) SetUpSuite(c *C) {
+func (bs *builderSuite) SetUpSuite(c *check.C) {
 	var err error
 
 	dockerClient, err = client.NewEnvClient()
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	b, err := runBuilder(`from "debian"`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 }
 
-func (bs *builderSuite) SetUpTest(c *C) {
+func (bs *builderSuite) SetUpTest(c *check.C) {
 	os.Setenv("NO_CACHE", "1")
 	command.ResetPulls()
 }
 
-func (bs *builderSuite) TearDownTest(c *C) {
+func (bs *builderSuite) TearDownTest(c *check.C) {
 	if os.Getenv("DIND") != "" {
 		containers, err := dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
-		c.Assert(err, IsNil)
+		c.Assert(err, check.IsNil)
 
 		for _, container := range containers {
 			err := dockerClient.ContainerRemove(context.Background(), container.ID, types.ContainerRemoveOptions{Force: true})
-			c.Assert(err, IsNil)
+			c.Assert(err, check.IsNil)
 		}
 
 		images, err := dockerClient.ImageList(context.Background(), types.ImageListOptions{})
-		c.Assert(err, IsNil)
+		c.Assert(err, check.IsNil)
 
 		for i := 0; i < 2; i++ {
 			for _, image := range images {
@@ -75,39 +82,144 @@ func (bs *builderSuite) TearDownTest(c *C) {
 	}
 }
 
-func (bs *builderSuite) TestFrom(c *C) {
+func (bs *builderSuite) TestFrom(c *check.C) {
 	b, err := runBuilder(`
 		from "alpine"
 	`)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
 		from "quezacoatl"
 	`)
 
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestAfter(c *C) {
+func (bs *builderSuite) TestFromArchive(c *check.C) {
+	b, err := runBuilder(`
+		from "alpine"
+		tag "box-archive-test"
+		save file: "box-archive-test.tar", tag: "box-archive-test"
+	`)
+	c.Assert(err, check.IsNil)
+	b.Close()
+	defer os.Remove("box-archive-test.tar")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "box-archive-test")
+	c.Assert(err, check.IsNil)
+
+	b, err = runBuilder(`
+		from archive: "box-archive-test.tar", image: "box-archive-test:latest"
+	`)
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Config().Image, check.Equals, inspect.ID)
+	b.Close()
+
+	b, err = runBuilder(`
+		from archive: "box-archive-test.tar", image: "quezacoatl"
+	`)
+	c.Assert(err, check.NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestFromTar(c *check.C) {
+	b, err := runBuilder(`from "alpine"`)
+	c.Assert(err, check.IsNil)
+	b.Close()
+
+	f, err := ioutil.TempFile("", "box-rootfs")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+
+	c.Assert(layers.ExportImage(context.Background(), "alpine", f), check.IsNil)
+	f.Close()
+
+	b, err = runBuilder(fmt.Sprintf(`
+		from tar: %q
+		run "test -f /etc/alpine-release"
+	`, f.Name()))
+	c.Assert(err, check.IsNil)
+	b.Close()
+
+	// the tarball was imported once, and is found again.
+	b, err = runBuilder(fmt.Sprintf(`from tar: %q`, f.Name()))
+	c.Assert(err, check.IsNil)
+	id := b.exec.Config().Image
+	b.Close()
+
+	b, err = runBuilder(fmt.Sprintf(`from tar: %q`, f.Name()))
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Config().Image, check.Equals, id)
+	b.Close()
+
+	b, err = runBuilder(fmt.Sprintf(`from tar: %q, archive: "image.tar"`, f.Name()))
+	c.Assert(err, check.NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestAfter(c *check.C) {
 	b, err := runBuilder(`
 		from "alpine"
 		after { tag "test" }
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "test")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 }
 
-func (bs *builderSuite) TestContext(c *C) {
+func (bs *builderSuite) TestAfterBuild(c *check.C) {
+	b, err := runBuilder(`
+		from "alpine"
+		after_build do |id|
+			tag "after-build-test"
+			raise "no image id" if id.empty?
+		end
+	`)
+	c.Assert(err, check.IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "after-build-test")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.ID, check.Equals, b.exec.Image().ImageID())
+	b.Close()
+
+	b, err = runBuilder(`
+		from "alpine"
+		after_build { tag "after-build-fail-test" }
+		run "exit 1"
+	`)
+	c.Assert(err, check.NotNil)
+	b.Close()
+
+	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "after-build-fail-test")
+	c.Assert(err, check.NotNil)
+
+	// an image the policy refuses fails the build before the hooks run.
+	for user, allowed := range map[string]bool{"root": false, "nobody": true} {
+		tag := "after-build-policy-" + user
+		b, err = NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Context: context.Background(), Policy: &policy.Policy{Image: policy.Image{NonRoot: true}}},
+			Runner:  make(chan struct{}),
+			Script:  fmt.Sprintf("from \"alpine\"\nuser %q\nafter_build { tag %q }", user, tag),
+		})
+		c.Assert(err, check.IsNil)
+		c.Assert(b.Run().Err == nil, check.Equals, allowed, check.Commentf("%s", user))
+		b.Close()
+
+		_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), tag)
+		c.Assert(err == nil, check.Equals, allowed, check.Commentf("%s", user))
+	}
+}
+
+func (bs *builderSuite) TestContext(c *check.C) {
 	toCtx, cancel := context.WithTimeout(context.Background(), time.Second)
 
 	b, err := NewBuilder(BuildConfig{Globals: &btypes.Global{Context: toCtx}, Runner: make(chan struct{})})
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	errChan := make(chan error)
 
@@ -119,12 +231,12 @@ func (bs *builderSuite) TestContext(c *C) {
 		`)
 	}()
 
-	c.Assert(<-errChan, NotNil)
+	c.Assert(<-errChan, check.NotNil)
 	b.Close()
 
 	cancelCtx, cancel := context.WithCancel(context.Background())
 	b, err = NewBuilder(BuildConfig{Globals: &btypes.Global{Context: cancelCtx}, Runner: make(chan struct{})})
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	command.ResetPulls() // manually reset so the download starts again
 
@@ -141,13 +253,74 @@ func (bs *builderSuite) TestContext(c *C) {
 		cancel()
 	}()
 
-	c.Assert(<-errChan, NotNil)
+	c.Assert(<-errChan, check.NotNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestImport(c *C) {
+func (bs *builderSuite) TestGraph(c *check.C) {
+	g := graph.New()
+	b, err := NewBuilder(BuildConfig{Globals: &btypes.Global{Context: context.Background(), Graph: g}, Runner: make(chan struct{})})
+	c.Assert(err, check.IsNil)
+
+	c.Assert(b.eval.RunScript(`
+		from "debian"
+		with_user "nobody" do
+			run "ls"
+		end
+		run "echo #{read("/etc/passwd")}"
+		tag "graph-test"
+		from "graph-test"
+	`), check.IsNil)
+	b.Close()
+
+	verbs := []string{}
+	for _, step := range g.Steps {
+		verbs = append(verbs, step.Verb)
+	}
+
+	c.Assert(verbs, check.DeepEquals, []string{"from", "run", "run", "tag", "from"})
+	c.Assert(g.Steps[2].Args, check.DeepEquals, []string{"echo "})
+	c.Assert(g.Stages(), check.Equals, 2)
+
+	// nothing was built or tagged.
+	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "graph-test")
+	c.Assert(err, check.NotNil)
+}
+
+func (bs *builderSuite) TestProfile(c *check.C) {
+	b, err := NewBuilder(BuildConfig{Globals: &btypes.Global{Context: context.Background(), Profiles: []string{"dev"}}, Runner: make(chan struct{})})
+	c.Assert(err, check.IsNil)
+
+	c.Assert(b.eval.RunScript(`
+		from "debian"
+		profile :dev do
+			env "DEV" => "1"
+		end
+		profile :debug do
+			env "DEBUG" => "1"
+		end
+	`), check.IsNil)
+	defer b.Close()
+
+	env := strings.Join(b.exec.Config().Env, " ")
+	c.Assert(strings.Contains(env, "DEV=1"), check.Equals, true)
+	c.Assert(strings.Contains(env, "DEBUG=1"), check.Equals, false)
+
+	b2, err := runBuilder(`
+		from "debian"
+		profile :dev do
+			env "DEV" => "1"
+		end
+	`)
+	c.Assert(err, check.IsNil)
+	defer b2.Close()
+
+	c.Assert(strings.Contains(strings.Join(b2.exec.Config().Env, " "), "DEV=1"), check.Equals, false)
+}
+
+func (bs *builderSuite) TestImport(c *check.C) {
 	f, err := ioutil.TempFile("", "import-tmp")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	defer f.Close()
 
@@ -155,24 +328,24 @@ func (bs *builderSuite) TestImport(c *C) {
     from "debian"
   `))
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	b, err := runBuilder(fmt.Sprintf(`
     import "%s"
   `, f.Name()))
-	c.Assert(err, IsNil)
-	c.Assert(b.exec.Image().ImageID(), Not(Equals), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Image().ImageID(), check.Not(check.Equals), "")
 	b.Close()
 
 	b, err = runBuilder(`
     import "/nonexistent"
   `)
-	c.Assert(err, NotNil)
-	c.Assert(b.exec.Image().ImageID(), Equals, "")
+	c.Assert(err, check.NotNil)
+	c.Assert(b.exec.Image().ImageID(), check.Equals, "")
 	b.Close()
 }
 
-func (bs *builderSuite) TestCopyToRelativePathWithWorkdir(c *C) {
+func (bs *builderSuite) TestCopyToRelativePathWithWorkdir(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "mkdir /test"
@@ -180,7 +353,7 @@ func (bs *builderSuite) TestCopyToRelativePathWithWorkdir(c *C) {
     copy ".", "builder"
     run "test -f /test/builder/builder.go"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -190,11 +363,11 @@ func (bs *builderSuite) TestCopyToRelativePathWithWorkdir(c *C) {
     copy "config", "."
     run "test -f /test/config/config.go"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestCopyWithGlob(c *C) {
+func (bs *builderSuite) TestCopyWithGlob(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "mkdir /test"
@@ -203,7 +376,7 @@ func (bs *builderSuite) TestCopyWithGlob(c *C) {
     run "test -f /test/config/config.go"
 		run "test -f /test/builder.go"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -213,25 +386,25 @@ func (bs *builderSuite) TestCopyWithGlob(c *C) {
     copy "*", "."
 		run "test -f /test/\\*"
 	`)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestCopyWithIgnore(c *C) {
+func (bs *builderSuite) TestCopyWithIgnore(c *check.C) {
 	b, err := runBuilder(`
 		from "debian"
 		copy ".", "builder", ignore_list: ["builder.go"]
 		run "ls /builder"
 		run "test -f /builder/builder.go"
 	`)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	f, err := os.Create("filelist")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = f.Write([]byte("builder.go\nutil.go\n"))
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	f.Close()
 
 	b, err = runBuilder(`
@@ -239,16 +412,16 @@ func (bs *builderSuite) TestCopyWithIgnore(c *C) {
 		copy ".", "builder", ignore_file: "filelist"
 		run "test -f /builder/builder.go || test -f /builder/util.go"
 	`)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	os.Remove(f.Name())
 
 	f, err = os.Create(".dockerignore")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = f.Write([]byte("builder.go\nutil.go\n"))
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	f.Close()
 
 	b, err = runBuilder(`
@@ -256,58 +429,58 @@ func (bs *builderSuite) TestCopyWithIgnore(c *C) {
 		copy ".", "builder"
 		run "test -f /builder/builder.go || test -f /builder/util.go"
 	`)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	os.Remove(f.Name())
 }
 
-func (bs *builderSuite) TestCopyOverDir(c *C) {
+func (bs *builderSuite) TestCopyOverDir(c *check.C) {
 	testpath := filepath.Join(dockerfilePath, "test1.rb")
 
 	_, err := runBuilder(fmt.Sprintf(`
     from "debian"
     copy "%s", "/tmp"
   `, testpath))
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 
 	_, err = runBuilder(fmt.Sprintf(`
     from "debian"
     copy "%s", "/tmp/"
     run "test -f /tmp/test1.rb"
   `, testpath))
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 }
 
-func (bs *builderSuite) TestCopyOverVolume(c *C) {
+func (bs *builderSuite) TestCopyOverVolume(c *check.C) {
 	// box deliberately does not support image volumes, so we must build from docker first.
 	cmd := exec.Command("docker", "build", "-t", "volumes", "-f", "testdata/dockerfiles/Dockerfile.volumes", ".")
 	out, err := cmd.CombinedOutput()
-	c.Assert(err, IsNil, Commentf("%v", string(out)))
+	c.Assert(err, check.IsNil, check.Commentf("%v", string(out)))
 
 	_, err = runBuilder(`
   from "volumes"
   copy ".", "/tmp/"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 }
 
-func (bs *builderSuite) TestCopy(c *C) {
+func (bs *builderSuite) TestCopy(c *check.C) {
 	testpath := filepath.Join(dockerfilePath, "test1.rb")
 
 	b, err := runBuilder(fmt.Sprintf(`
     from "debian"
     copy "%s", "/test1.rb"
   `, testpath))
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	result := readContainerFile(c, b, "/test1.rb")
 
 	content, err := ioutil.ReadFile(testpath)
-	c.Assert(err, IsNil)
-	c.Assert(string(content), Not(Equals), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Not(check.Equals), "")
 
-	c.Assert(bytes.Equal(result, content), Equals, true)
+	c.Assert(bytes.Equal(result, content), check.Equals, true)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -315,13 +488,13 @@ func (bs *builderSuite) TestCopy(c *C) {
     copy "builder.go", "/"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/builder.go")
 	content, err = ioutil.ReadFile("builder.go")
-	c.Assert(err, IsNil)
-	c.Assert(string(content), Not(Equals), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Not(check.Equals), "")
 
-	c.Assert(content, DeepEquals, result)
+	c.Assert(content, check.DeepEquals, result)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -329,10 +502,10 @@ func (bs *builderSuite) TestCopy(c *C) {
     copy ".", "test"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	result = readContainerFile(c, b, "/test/builder.go")
-	c.Assert(content, DeepEquals, result)
+	c.Assert(content, check.DeepEquals, result)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -341,10 +514,10 @@ func (bs *builderSuite) TestCopy(c *C) {
     copy ".", "test/"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	result = readContainerFile(c, b, "/test/test/builder.go")
-	c.Assert(content, DeepEquals, result)
+	c.Assert(content, check.DeepEquals, result)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -355,10 +528,10 @@ func (bs *builderSuite) TestCopy(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	result = readContainerFile(c, b, "/test/test/builder.go")
-	c.Assert(content, DeepEquals, result)
+	c.Assert(content, check.DeepEquals, result)
 
 	b.Close()
 
@@ -369,7 +542,7 @@ func (bs *builderSuite) TestCopy(c *C) {
     end
   `)
 
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -379,7 +552,7 @@ func (bs *builderSuite) TestCopy(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -389,7 +562,7 @@ func (bs *builderSuite) TestCopy(c *C) {
     end
   `)
 
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -399,37 +572,37 @@ func (bs *builderSuite) TestCopy(c *C) {
     end
   `)
 
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestTag(c *C) {
+func (bs *builderSuite) TestTag(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     tag "test"
   `)
 
-	c.Assert(err, IsNil)
-	c.Assert(b.exec.Config().Image, Not(Equals), "test")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Config().Image, check.Not(check.Equals), "test")
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
-	c.Assert(inspect.RepoTags, DeepEquals, []string{"debian:latest", "test:latest"})
+	c.Assert(inspect.RepoTags, check.DeepEquals, []string{"debian:latest", "test:latest"})
 	b.Close()
 }
 
-func (bs *builderSuite) TestSave(c *C) {
+func (bs *builderSuite) TestSave(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
 		save tag: "test"
   `)
 
-	c.Assert(err, IsNil)
-	c.Assert(b.exec.Config().Image, Not(Equals), "test")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Config().Image, check.Not(check.Equals), "test")
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	var found bool
 
@@ -439,7 +612,7 @@ func (bs *builderSuite) TestSave(c *C) {
 		}
 	}
 
-	c.Assert(found, Equals, true)
+	c.Assert(found, check.Equals, true)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -447,29 +620,29 @@ func (bs *builderSuite) TestSave(c *C) {
 		run "apt-get update -qq"
 		save file: "test.tar"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	defer os.Remove("test.tar")
 	f, err := os.Open("test.tar")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	r, err := dockerClient.ImageLoad(context.Background(), f, true)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	io.Copy(ioutil.Discard, r.Body)
 
 	b, err = runBuilder(`
     from "debian"
 		save file: "../test.tar"
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
 		save file: "/test.tar"
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -477,18 +650,18 @@ func (bs *builderSuite) TestSave(c *C) {
 		run "apt-get update -qq"
 		save file: "oci.tar", kind: "oci"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	defer os.Remove("oci.tar")
 	f, err = os.Open("oci.tar")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	tr := tar.NewReader(f)
 	found = false
 	for {
 		header, err := tr.Next()
-		c.Assert(err, IsNil)
+		c.Assert(err, check.IsNil)
 
 		if path.Base(header.Name) == "oci" {
 			found = true
@@ -496,10 +669,39 @@ func (bs *builderSuite) TestSave(c *C) {
 		}
 	}
 
-	c.Assert(found, Equals, true)
+	c.Assert(found, check.Equals, true)
 }
 
-func (bs *builderSuite) TestFlatten(c *C) {
+func (bs *builderSuite) TestOutput(c *check.C) {
+	for _, output := range []string{"", "oci", "oci:", "docker:/tmp/image", "docker://"} {
+		_, _, err := ParseOutput(output)
+		c.Assert(err, check.NotNil, check.Commentf("%q", output))
+	}
+
+	kind, name, err := ParseOutput("docker://localhost:5000/myapp:1.0")
+	c.Assert(err, check.IsNil)
+	c.Assert(kind, check.Equals, "docker")
+	c.Assert(name, check.Equals, "localhost:5000/myapp:1.0")
+
+	dir := c.MkDir()
+
+	b, err := runBuilder(`
+    from "alpine"
+  `)
+	c.Assert(err, check.IsNil)
+	defer b.Close()
+
+	c.Assert(b.Output("oci:"+dir+"/layout:1.0"), check.IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "layout", "index.json"))
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(string(content), `"org.opencontainers.image.ref.name":"1.0"`), check.Equals, true, check.Commentf("%s", content))
+
+	_, err = os.Stat(filepath.Join(dir, "layout", "blobs", "sha256"))
+	c.Assert(err, check.IsNil)
+}
+
+func (bs *builderSuite) TestFlatten(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "echo foo >bar"
@@ -510,24 +712,77 @@ func (bs *builderSuite) TestFlatten(c *C) {
     tag "flattened"
   `)
 
-	c.Assert(err, IsNil)
-	c.Assert(b.exec.Config().Image, Not(Equals), "flattened")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Config().Image, check.Not(check.Equals), "flattened")
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
-	c.Assert(len(inspect.RootFS.Layers), Equals, 1)
+	c.Assert(len(inspect.RootFS.Layers), check.Equals, 1)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "notflattened")
-	c.Assert(err, IsNil)
-	c.Assert(len(inspect.RootFS.Layers), Not(Equals), 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(inspect.RootFS.Layers), check.Not(check.Equals), 1)
 	b.Close()
 
 	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "/usr/bin/stat -c %U a_file"})
-	c.Assert(string(result), Equals, "nobody\n")
+	c.Assert(string(result), check.Equals, "nobody\n")
+}
+
+func (bs *builderSuite) TestFlattenFrom(c *check.C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "echo foo >bar"
+    tag "stage-start"
+    run "echo here is another layer >a_file"
+    run "chown -R nobody:nogroup a_file"
+    flatten from: "stage-start"
+  `)
+
+	c.Assert(err, check.IsNil)
+	defer b.Close()
+
+	base, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "stage-start")
+	c.Assert(err, check.IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(len(inspect.RootFS.Layers), check.Equals, len(base.RootFS.Layers)+1)
+	c.Assert(inspect.RootFS.Layers[:len(base.RootFS.Layers)], check.DeepEquals, base.RootFS.Layers)
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "/usr/bin/stat -c %U a_file && cat bar"})
+	c.Assert(string(result), check.Equals, "nobody\nfoo\n")
+
+	_, err = runBuilder(`
+    from "debian"
+    flatten from: "stage-start"
+  `)
+	c.Assert(err, check.NotNil)
+}
+
+func (bs *builderSuite) TestStrip(c *check.C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "mkdir -p /docs && echo doc >/docs/a && echo keep >/docs/keep && echo app >/app"
+    strip "/docs", "!docs/keep"
+    flatten
+  `)
+
+	c.Assert(err, check.IsNil)
+	defer b.Close()
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "ls /docs && cat /app"})
+	c.Assert(string(result), check.Equals, "keep\napp\n")
+
+	_, err = runBuilder(`
+    from "debian"
+    strip "[docs"
+  `)
+	c.Assert(err, check.NotNil)
 }
 
-func (bs *builderSuite) TestEntrypointCmd(c *C) {
+func (bs *builderSuite) TestEntrypointCmd(c *check.C) {
 	// the echo hi is to trigger a specific interaction problem with entrypoint
 	// and run where the entrypoint/cmd would not be overridden during commit
 	// time for run.
@@ -537,11 +792,11 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
     run "echo hi"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/cat"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/bash"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/cat"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"/bin/bash"})
 	b.Close()
 
 	// if cmd is set earlier than entrypoint, it should not change
@@ -551,11 +806,11 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
     entrypoint "/bin/echo"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/echo"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"hi"})
 	b.Close()
 
 	// likewise for entrypoint.
@@ -565,11 +820,11 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
     cmd "hi"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/echo"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"hi"})
 	b.Close()
 
 	// normal cmd usage.
@@ -578,11 +833,11 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
     cmd "hi"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, IsNil)
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.IsNil)
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"hi"})
 	b.Close()
 
 	b, err = runBuilder(`
@@ -590,13 +845,13 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
 		entrypoint []
 		cmd []
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/sh"})
-	c.Assert(inspect.Config.Entrypoint, IsNil)
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"/bin/sh"})
+	c.Assert(inspect.Config.Entrypoint, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -604,12 +859,12 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
 		entrypoint []
 		cmd ["/bin/bash"]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/bash"})
-	c.Assert(inspect.Config.Entrypoint, IsNil)
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"/bin/bash"})
+	c.Assert(inspect.Config.Entrypoint, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -617,23 +872,54 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
 		entrypoint %w[/bin/echo -e]
 		cmd %w[foo bar quux baz]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo", "-e"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"foo", "bar", "quux", "baz"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/echo", "-e"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"foo", "bar", "quux", "baz"})
 	b.Close()
 }
 
-func (bs *builderSuite) TestRun(c *C) {
+func (bs *builderSuite) TestEntrypointScript(c *check.C) {
+	b, err := runBuilder(`
+    from "debian"
+    entrypoint_script "/entrypoint.sh", <<-EOS
+#!/bin/sh
+echo -n "entrypoint:$@"
+EOS
+    cmd "hi"
+  `)
+	c.Assert(err, check.IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/entrypoint.sh"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"hi"})
+	c.Assert(string(runContainerCommand(c, b, []string{"stat", "-c", "%a", "/entrypoint.sh"})), check.Equals, "755\n")
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    workdir "/app"
+    entrypoint_script "start.sh", "#!/bin/sh\nexec true\n"
+  `)
+	c.Assert(err, check.IsNil)
+
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/app/start.sh"})
+	b.Close()
+}
+
+func (bs *builderSuite) TestRun(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "echo -n foo >/bar"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result := readContainerFile(c, b, "/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -643,10 +929,10 @@ func (bs *builderSuite) TestRun(c *C) {
       run "echo -n foo >/test/bar"
     end
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	result = runContainerCommand(c, b, []string{"/bin/sh", "-c", "/usr/bin/stat -c %U /test/bar"})
-	c.Assert(string(result), Equals, "nobody\n")
+	c.Assert(string(result), check.Equals, "nobody\n")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -655,10 +941,10 @@ func (bs *builderSuite) TestRun(c *C) {
     user "nobody"
     run "echo -n foo >/test/bar"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	result = runContainerCommand(c, b, []string{"/bin/sh", "-c", "/usr/bin/stat -c %U /test/bar"})
-	c.Assert(string(result), Equals, "nobody\n")
+	c.Assert(string(result), check.Equals, "nobody\n")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -669,9 +955,9 @@ func (bs *builderSuite) TestRun(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/test/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -681,19 +967,19 @@ func (bs *builderSuite) TestRun(c *C) {
     run "echo -n foo >bar"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/test/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 	b.Close()
 }
 
-func (bs *builderSuite) TestWorkDirInside(c *C) {
+func (bs *builderSuite) TestWorkDirInside(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     workdir "."
   `)
 
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -703,7 +989,7 @@ func (bs *builderSuite) TestWorkDirInside(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -713,13 +999,13 @@ func (bs *builderSuite) TestWorkDirInside(c *C) {
     run "echo -n foo >bar"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result := readContainerFile(c, b, "/test/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.WorkingDir, Equals, "/test")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.WorkingDir, check.Equals, "/test")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -730,17 +1016,17 @@ func (bs *builderSuite) TestWorkDirInside(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/test/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.WorkingDir, Equals, "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.WorkingDir, check.Equals, "/")
 
 	// this file is used in the copy comparisons
 	content, err := ioutil.ReadFile("builder.go")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -750,13 +1036,13 @@ func (bs *builderSuite) TestWorkDirInside(c *C) {
     copy ".", "."
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/test/builder.go")
-	c.Assert(result, DeepEquals, content)
+	c.Assert(result, check.DeepEquals, content)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.WorkingDir, Equals, "/test")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.WorkingDir, check.Equals, "/test")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -767,18 +1053,18 @@ func (bs *builderSuite) TestWorkDirInside(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/test/builder.go")
 
-	c.Assert(result, DeepEquals, content)
+	c.Assert(result, check.DeepEquals, content)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.WorkingDir, Equals, "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.WorkingDir, check.Equals, "/")
 	b.Close()
 }
 
-func (bs *builderSuite) TestUser(c *C) {
+func (bs *builderSuite) TestUser(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "mkdir /test && chown nobody:nogroup /test"
@@ -786,13 +1072,13 @@ func (bs *builderSuite) TestUser(c *C) {
     run "echo -n foo >/test/bar"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result := readContainerFile(c, b, "/test/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.User, Equals, "nobody")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.User, check.Equals, "nobody")
 	b.Close()
 
 	b, err = runBuilder(`
@@ -803,17 +1089,125 @@ func (bs *builderSuite) TestUser(c *C) {
     end
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	result = readContainerFile(c, b, "/test/bar")
-	c.Assert(string(result), Equals, "foo")
+	c.Assert(string(result), check.Equals, "foo")
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.User, Equals, "root")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.User, check.Equals, "root")
+	b.Close()
+}
+
+func (bs *builderSuite) TestCreateUser(c *check.C) {
+	for _, image := range []string{"debian", "alpine", "centos"} {
+		b, err := runBuilder(fmt.Sprintf(`
+      from %q
+      create_user "app", uid: 1001, home: "/app"
+      run "touch /app/owned"
+    `, image))
+		c.Assert(err, check.IsNil, check.Commentf("%s", image))
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+		c.Assert(err, check.IsNil)
+		c.Assert(inspect.Config.User, check.Equals, "app")
+
+		result := runContainerCommand(c, b, []string{"stat", "-c", "%u:%U", "/app/owned"})
+		c.Assert(string(result), check.Equals, "1001:app\n", check.Commentf("%s", image))
+		b.Close()
+	}
+
+	b, err := runBuilder(`
+    from "debian"
+    create_user "not a user"
+  `)
+	c.Assert(err, check.NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestPackages(c *check.C) {
+	for _, image := range []string{"debian", "alpine", "fedora"} {
+		b, err := runBuilder(fmt.Sprintf(`
+      from %q
+      packages ["curl", "file"], manager: :auto
+    `, image))
+		c.Assert(err, check.IsNil, check.Commentf("%s", image))
+		runContainerCommand(c, b, []string{"which", "curl"})
+		b.Close()
+	}
+
+	b, err := runBuilder(`
+    from "debian"
+    packages "curl", manager: :apt
+  `)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(runContainerCommand(c, b, []string{"sh", "-c", "ls /var/lib/apt/lists | wc -l"})), check.Equals, "0\n")
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    packages "curl; rm -rf /"
+  `)
+	c.Assert(err, check.NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    packages "curl", manager: :pacman
+  `)
+	c.Assert(err, check.NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    with_user "nobody" do
+      packages "file"
+      run "whoami > /tmp/after"
+    end
+  `)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(readContainerFile(c, b, "/tmp/after")), check.Equals, "nobody\n")
+	runContainerCommand(c, b, []string{"which", "file"})
+	b.Close()
+}
+
+func (bs *builderSuite) TestFetch(c *check.C) {
+	content := []byte("#!/bin/sh\necho -n fetched\n")
+	sum := sha256.Sum256(content)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	b, err := runBuilder(fmt.Sprintf(`
+    from "debian"
+    fetch "%s/tool", sha256: "%x", dest: "/usr/local/bin/", mode: 0755
+    run "tool"
+  `, srv.URL, sum))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(runContainerCommand(c, b, []string{"/usr/local/bin/tool"})), check.Equals, "fetched")
+	b.Close()
+
+	for _, mode := range []string{`"755"`, `"0755"`, "0755"} {
+		b, err = runBuilder(fmt.Sprintf(`
+      from "debian"
+      fetch "%s/tool", sha256: "%x", dest: "/usr/local/bin/", mode: %s
+    `, srv.URL, sum, mode))
+		c.Assert(err, check.IsNil, check.Commentf("%s", mode))
+		c.Assert(string(runContainerCommand(c, b, []string{"stat", "-c", "%a", "/usr/local/bin/tool"})), check.Equals, "755\n", check.Commentf("%s", mode))
+		b.Close()
+	}
+
+	b, err = runBuilder(fmt.Sprintf(`
+    from "debian"
+    fetch "%s/tool", sha256: "%x", dest: "/usr/local/bin/tool"
+  `, srv.URL, sha256.Sum256([]byte("something else"))))
+	c.Assert(err, check.NotNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestBuildCache(c *C) {
+func (bs *builderSuite) TestBuildCache(c *check.C) {
 	// enable cache; will reset on next test run
 	os.Setenv("NO_CACHE", "")
 
@@ -821,7 +1215,7 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     from "debian"
   `)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	imageID := b.exec.Config().Image
 	b.Close()
@@ -831,7 +1225,7 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     run "true"
   `, imageID))
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	cached := b.exec.Config().Image
 	b.Close()
@@ -841,8 +1235,8 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     run "true"
   `, imageID))
 
-	c.Assert(err, IsNil)
-	c.Assert(cached, Equals, b.exec.Config().Image)
+	c.Assert(err, check.IsNil)
+	c.Assert(cached, check.Equals, b.exec.Config().Image)
 	b.Close()
 
 	b, err = runBuilder(fmt.Sprintf(`
@@ -850,8 +1244,8 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     run "exit 0"
   `, imageID))
 
-	c.Assert(err, IsNil)
-	c.Assert(cached, Not(Equals), b.exec.Config().Image)
+	c.Assert(err, check.IsNil)
+	c.Assert(cached, check.Not(check.Equals), b.exec.Config().Image)
 	b.Close()
 
 	b, err = runBuilder(fmt.Sprintf(`
@@ -859,7 +1253,7 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     copy ".", "."
   `, imageID))
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	cached = b.exec.Config().Image
 	b.Close()
@@ -868,12 +1262,12 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     from "%s"
     copy ".", "."
   `, imageID))
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
-	c.Assert(cached, Equals, b.exec.Config().Image)
+	c.Assert(cached, check.Equals, b.exec.Config().Image)
 
 	f, err := os.Create("test")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	defer os.Remove("test")
 	f.Close()
 	b.Close()
@@ -883,53 +1277,262 @@ func (bs *builderSuite) TestBuildCache(c *C) {
     copy ".", "."
   `, imageID))
 
-	c.Assert(err, IsNil)
-	c.Assert(cached, Not(Equals), b.exec.Config().Image)
+	c.Assert(err, check.IsNil)
+	c.Assert(cached, check.Not(check.Equals), b.exec.Config().Image)
+	cached = b.exec.Config().Image
+	b.Close()
+
+	// touching a file without changing it does not invalidate the copy.
+	past := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes("test", past, past), check.IsNil)
+
+	b, err = runBuilder(fmt.Sprintf(`
+    from "%s"
+    copy ".", "."
+  `, imageID))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(cached, check.Equals, b.exec.Config().Image)
+	b.Close()
+
+	// the same command run in a different directory or as a different user is
+	// not the same step.
+	b, err = runBuilder(fmt.Sprintf(`
+    from "%s"
+    inside "/tmp" do
+      run "touch file"
+    end
+  `, imageID))
+
+	c.Assert(err, check.IsNil)
+	cached = b.exec.Config().Image
 	b.Close()
+
+	for _, script := range []string{`inside "/var/tmp" do run "touch file" end`, `with_user "nobody" do inside "/tmp" do run "touch file" end end`} {
+		b, err = runBuilder(fmt.Sprintf("from %q\n%s", imageID, script))
+		c.Assert(err, check.IsNil)
+		c.Assert(cached, check.Not(check.Equals), b.exec.Config().Image)
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestRunCacheOptions(c *check.C) {
+	os.Setenv("NO_CACHE", "")
+
+	build := func(options string) string {
+		b, err := runBuilder(fmt.Sprintf(`
+			from "debian"
+			run "date +%%s%%N > /built"%s
+		`, options))
+		c.Assert(err, check.IsNil)
+		defer b.Close()
+		return b.exec.Config().Image
+	}
+
+	first := build(`, cache_key: "1"`)
+	c.Assert(build(`, cache_key: "1"`), check.Equals, first)
+	second := build(`, cache_key: "2"`)
+	c.Assert(second, check.Not(check.Equals), first)
+
+	noCache := build(`, cache_key: "2", no_cache: true`)
+	c.Assert(noCache, check.Not(check.Equals), second)
+	c.Assert(build(`, cache_key: "2", no_cache: true`), check.Not(check.Equals), noCache)
+
+	// the steps after a no_cache step are re-run on the layer it built.
+	after := func() string {
+		b, err := runBuilder(`
+			from "debian"
+			run "date +%s%N > /built", no_cache: true
+			run "cat /built > /copied"
+		`)
+		c.Assert(err, check.IsNil)
+		defer b.Close()
+		c.Assert(string(runContainerCommand(c, b, []string{"/bin/sh", "-c", "cmp /built /copied && echo same"})), check.Equals, "same\n")
+		return b.exec.Config().Image
+	}
+
+	c.Assert(after(), check.Not(check.Equals), after())
 }
 
-func (bs *builderSuite) TestSetExec(c *C) {
+func (bs *builderSuite) TestRunSecurity(c *check.C) {
+	profile := filepath.Join(c.MkDir(), "seccomp.json")
+	err := ioutil.WriteFile(profile, []byte(`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdir", "mkdirat"], "action": "SCMP_ACT_ERRNO"}]}`), 0644)
+	c.Assert(err, check.IsNil)
+
+	b, err := runBuilder(fmt.Sprintf(`
+    from "debian"
+    run "mkdir /before"
+    run "mkdir /denied || touch /confined", seccomp: %q
+    run "mkdir /after"
+  `, profile))
+	c.Assert(err, check.IsNil)
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -d /before && test -d /after && test -f /confined && test ! -e /denied && echo ok"})
+	c.Assert(string(result), check.Equals, "ok\n")
+	b.Close()
+
+	// a step lifts the profile of the build with unconfined.
+	b, err = NewBuilder(BuildConfig{
+		Globals: &btypes.Global{
+			ShowRun:  true,
+			Context:  context.Background(),
+			Security: btypes.Security{Seccomp: profile},
+		},
+		Runner: make(chan struct{}),
+	})
+	c.Assert(err, check.IsNil)
+
+	err = b.eval.RunScript(`
+    from "debian"
+    run "mkdir /denied || touch /confined"
+    run "mkdir /allowed", seccomp: "unconfined"
+  `)
+	c.Assert(err, check.IsNil)
+
+	result = runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -f /confined && test ! -e /denied && test -d /allowed && echo ok"})
+	c.Assert(string(result), check.Equals, "ok\n")
+	b.Close()
+
+	for _, option := range []string{`seccomp: 1`, `seccomp: "/nonexistent"`, `apparmor: ""`, `selinux: "bogus"`, `selinux: ["type:spc_t", 1]`} {
+		b, err := runBuilder(fmt.Sprintf(`
+      from "debian"
+      run "true", %s
+    `, option))
+		c.Assert(err, check.NotNil, check.Commentf("%s", option))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestRunNetwork(c *check.C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "ls /sys/class/net > /none", network: "none"
+    run "ls /sys/class/net > /default"
+  `)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/none")), check.Equals, "lo\n")
+	c.Assert(string(readContainerFile(c, b, "/default")), check.Not(check.Equals), "lo\n")
+	b.Close()
+
+	// a step joins another network than the one of the build.
+	b, err = NewBuilder(BuildConfig{
+		Globals: &btypes.Global{
+			ShowRun:  true,
+			Context:  context.Background(),
+			Security: btypes.Security{Network: "none"},
+		},
+		Runner: make(chan struct{}),
+	})
+	c.Assert(err, check.IsNil)
+
+	err = b.eval.RunScript(`
+    from "debian"
+    run "ls /sys/class/net > /none"
+    run "ls /sys/class/net > /bridge", network: "bridge"
+  `)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/none")), check.Equals, "lo\n")
+	c.Assert(string(readContainerFile(c, b, "/bridge")), check.Not(check.Equals), "lo\n")
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run "true", network: "not a network"
+  `)
+	c.Assert(err, check.NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestSecurityCache(c *check.C) {
+	os.Setenv("NO_CACHE", "")
+
+	build := func(security btypes.Security) string {
+		b, err := NewBuilder(BuildConfig{Globals: &btypes.Global{Cache: true, Context: context.Background(), Security: security}, Runner: make(chan struct{})})
+		c.Assert(err, check.IsNil)
+		defer b.Close()
+
+		c.Assert(b.eval.RunScript(`
+			from "debian"
+			run "date +%s%N > /built"
+		`), check.IsNil)
+		return b.exec.Config().Image
+	}
+
+	first := build(btypes.Security{})
+	c.Assert(build(btypes.Security{}), check.Equals, first)
+
+	profile, err := ioutil.TempFile("", "box-seccomp")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(profile.Name())
+	_, err = profile.WriteString(`{"defaultAction": "SCMP_ACT_ALLOW"}`)
+	c.Assert(err, check.IsNil)
+	profile.Close()
+
+	images := map[string]bool{first: true}
+
+	for _, security := range []btypes.Security{
+		{Network: "none"},
+		{CapAdd: []string{"NET_ADMIN"}},
+		{CapDrop: []string{"ALL"}},
+		{Seccomp: btypes.Unconfined},
+		{Seccomp: profile.Name()},
+		{AppArmor: btypes.Unconfined},
+	} {
+		image := build(security)
+		c.Assert(images[image], check.Equals, false, check.Commentf("%+v", security))
+		c.Assert(build(security), check.Equals, image, check.Commentf("%+v", security))
+		images[image] = true
+	}
+
+	// the profile is keyed on its content.
+	c.Assert(ioutil.WriteFile(profile.Name(), []byte(`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": []}`), 0644), check.IsNil)
+	c.Assert(images[build(btypes.Security{Seccomp: profile.Name()})], check.Equals, false)
+}
+
+func (bs *builderSuite) TestSetExec(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     set_exec cmd: "quux"
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     set_exec entrypoint: "quux"
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     set_exec test: ["quux"]
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     set_exec entrypoint: ["/bin/bash"]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/bash"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/bash"})
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     set_exec cmd: ["/bin/bash"]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/bash"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"/bin/bash"})
 	b.Close()
 
 	b, err = runBuilder(`
@@ -937,12 +1540,12 @@ func (bs *builderSuite) TestSetExec(c *C) {
     cmd "exit 0"
     set_exec entrypoint: ["/bin/bash", "-c"]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/bash", "-c"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"exit 0"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/bash", "-c"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"exit 0"})
 	b.Close()
 
 	b, err = runBuilder(`
@@ -950,24 +1553,24 @@ func (bs *builderSuite) TestSetExec(c *C) {
     entrypoint "/bin/bash", "-c"
     set_exec cmd: ["exit 0"]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/bash", "-c"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"exit 0"})
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Entrypoint, check.DeepEquals, strslice.StrSlice{"/bin/bash", "-c"})
+	c.Assert(inspect.Config.Cmd, check.DeepEquals, strslice.StrSlice{"exit 0"})
 	b.Close()
 }
 
-func (bs *builderSuite) TestEnv(c *C) {
+func (bs *builderSuite) TestEnv(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     env GOPATH: "/go"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	found := false
 
@@ -977,17 +1580,17 @@ func (bs *builderSuite) TestEnv(c *C) {
 		}
 	}
 
-	c.Assert(found, Equals, true)
+	c.Assert(found, check.Equals, true)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     env "GOPATH" => "/go", "PATH" => "/usr/local"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	count := 0
 
@@ -1001,7 +1604,7 @@ func (bs *builderSuite) TestEnv(c *C) {
 		}
 	}
 
-	c.Assert(count, Equals, 2)
+	c.Assert(count, check.Equals, 2)
 	b.Close()
 
 	b, err = runBuilder(`
@@ -1009,17 +1612,17 @@ func (bs *builderSuite) TestEnv(c *C) {
     env "TERM" => "myterm", "PATH" => "/test"
     tag "builder-env-base"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "builder-env-base"
     tag "builder-env"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "builder-env")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	found = false
 
@@ -1030,7 +1633,7 @@ func (bs *builderSuite) TestEnv(c *C) {
 		}
 	}
 
-	c.Assert(found, Equals, true)
+	c.Assert(found, check.Equals, true)
 
 	count = 0
 
@@ -1040,59 +1643,98 @@ func (bs *builderSuite) TestEnv(c *C) {
 		}
 	}
 
-	c.Assert(count, Equals, 1)
+	c.Assert(count, check.Equals, 1)
 	b.Close()
 }
 
-func (bs *builderSuite) TestReaderFuncs(c *C) {
+func (bs *builderSuite) TestExposeVolume(c *check.C) {
+	b, err := runBuilder(`
+		from "debian"
+		expose 8080, "53/udp"
+		expose [8080]
+		volume "/data", "/var/log/"
+		tag "builder-expose"
+	`)
+	c.Assert(err, check.IsNil)
+	b.Close()
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "builder-expose")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(len(inspect.Config.ExposedPorts), check.Equals, 2)
+	_, ok := inspect.Config.ExposedPorts["8080/tcp"]
+	c.Assert(ok, check.Equals, true)
+	_, ok = inspect.Config.ExposedPorts["53/udp"]
+	c.Assert(ok, check.Equals, true)
+
+	c.Assert(inspect.Config.Volumes, check.DeepEquals, map[string]struct{}{"/data": {}, "/var/log": {}})
+
+	// the ports and volumes are kept when building on top of the image.
+	b, err = runBuilder(`
+		from "builder-expose"
+		expose 9000
+	`)
+	c.Assert(err, check.IsNil)
+	c.Assert(b.exec.Config().ExposedPorts, check.DeepEquals, []string{"53/udp", "8080/tcp", "9000/tcp"})
+	c.Assert(b.exec.Config().Volumes, check.DeepEquals, []string{"/data", "/var/log"})
+	b.Close()
+
+	for _, script := range []string{`expose "80:8080"`, `expose "notaport"`, `volume "data"`, `volume []`} {
+		b, err = runBuilder("from \"debian\"\n" + script)
+		c.Assert(err, check.NotNil, check.Commentf("%s", script))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestReaderFuncs(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "echo -n #{getuid("root")} > /uid"
     run "echo -n #{getgid("nogroup")} > /gid"
     run "echo -n '#{read("/etc/passwd")}' > /passwd"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	b.Close()
 
 	content, err := b.exec.CopyOneFileFromContainer("/uid")
-	c.Assert(err, IsNil)
-	c.Assert(string(content), Equals, "0")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "0")
 
 	content, err = b.exec.CopyOneFileFromContainer("/gid")
-	c.Assert(err, IsNil)
-	c.Assert(string(content), Equals, "65534")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "65534")
 
 	content, err = b.exec.CopyOneFileFromContainer("/passwd")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	origContent, err := b.exec.CopyOneFileFromContainer("/etc/passwd")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
-	c.Assert(content, DeepEquals, origContent)
+	c.Assert(content, check.DeepEquals, origContent)
 
 	b, err = runBuilder(`
     from "debian"
     puts read("/nonexistent")
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     puts getuid("quux")
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
     puts getgid("quux")
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 	b.Close()
 }
 
-func (bs *builderSuite) TestExecPropagation(c *C) {
+func (bs *builderSuite) TestExecPropagation(c *check.C) {
 	b, err := runBuilder(`
     from "debian"
     run "useradd -s /bin/bash -m -d /home/test test"
@@ -1101,53 +1743,53 @@ func (bs *builderSuite) TestExecPropagation(c *C) {
     user "test"
     tag "test"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
-	c.Assert(b.exec.Config().Entrypoint.Image, IsNil)
-	c.Assert(b.exec.Config().Cmd.Image, DeepEquals, []string{"/bin/bash"})
+	c.Assert(b.exec.Config().Entrypoint.Image, check.IsNil)
+	c.Assert(b.exec.Config().Cmd.Image, check.DeepEquals, []string{"/bin/bash"})
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
-	c.Assert(err, IsNil)
-	c.Assert(strslice.StrSlice(b.exec.Config().Cmd.Image), DeepEquals, inspect.Config.Cmd)
+	c.Assert(err, check.IsNil)
+	c.Assert(strslice.StrSlice(b.exec.Config().Cmd.Image), check.DeepEquals, inspect.Config.Cmd)
 
 	// Docker rewrites a nil as the array below.
-	c.Assert(strslice.StrSlice{"/bin/sh", "-c"}, DeepEquals, inspect.Config.Entrypoint)
+	c.Assert(strslice.StrSlice{"/bin/sh", "-c"}, check.DeepEquals, inspect.Config.Entrypoint)
 
 	b.Close()
 }
 
-func (bs *builderSuite) TestLabels(c *C) {
+func (bs *builderSuite) TestLabels(c *check.C) {
 	_, err := runBuilder(`
 		from "debian"
 		label
 		tag "failed"
 	`)
-	c.Assert(err, NotNil)
+	c.Assert(err, check.NotNil)
 
 	_, err = runBuilder(`
 		from "debian"
 		label "foo" => "bar"
 		tag "labeled"
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "labeled")
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Labels["foo"], Equals, "bar")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Labels["foo"], check.Equals, "bar")
 
 	_, err = runBuilder(`
 		from "debian"
 		label foo2: "bar"
 		tag "labeled"
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "labeled")
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Labels["foo2"], Equals, "bar")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.Config.Labels["foo2"], check.Equals, "bar")
 }
 
-func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
+func (bs *builderSuite) TestInsideRelativeWorkDir(c *check.C) {
 	_, err := runBuilder(`
 		from "debian"
 		workdir "/etc"
@@ -1156,7 +1798,7 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 		end
 	`)
 
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
@@ -1166,7 +1808,7 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 			end
 		end
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	// work dir is the default for debian here which is `/`. This should pass.
 	_, err = runBuilder(`
@@ -1177,7 +1819,7 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 			end
 		end
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
@@ -1186,7 +1828,7 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 			run "cd tmp"
 		end
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
@@ -1195,27 +1837,27 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 			run "cd tmp"
 		end
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
 		workdir "/home/box-builder"
 		copy ".", "box/"
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
 		workdir "/home/box-builder"
 		copy ".", "box"
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	path, err := filepath.Abs("..")
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	defer os.Remove("test")
-	c.Assert(os.Symlink(path, "test"), IsNil)
+	c.Assert(os.Symlink(path, "test"), check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
@@ -1223,7 +1865,7 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 		copy ".", "box"
 		run "stat /home/box-builder/box/test", output: false
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	os.Remove("test")
 
@@ -1232,12 +1874,81 @@ func (bs *builderSuite) TestInsideRelativeWorkDir(c *C) {
 		workdir "/home/box-builder"
 		copy "builder.go", "/builder.go"
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	_, err = runBuilder(`
 		from "debian"
 		copy ".", "/go/src/github.com/box-builder/box/builder/"
 		run "ls /go/src/github.com/box-builder/box/builder/"
 	`)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
+}
+
+func (bs *builderSuite) TestBuild(c *check.C) {
+	log := &bytes.Buffer{}
+	layout := filepath.Join(c.MkDir(), "layout")
+
+	result, err := Build(context.Background(), Plan{FileName: "embedded.rb", Script: `
+		from "debian"
+		run "echo embedded"
+	`}, Options{NoCache: true, Tag: "box-embedded", Output: "oci:" + layout, Log: log})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Image, check.Matches, "sha256:[0-9a-f]{64}")
+	c.Assert(result.Pushed, check.Equals, "")
+	c.Assert(log.String(), check.Matches, `(?s).*\[embedded\.rb\].*embedded.*`)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "box-embedded")
+	c.Assert(err, check.IsNil)
+	c.Assert(inspect.ID, check.Equals, result.Image)
+
+	_, err = os.Stat(filepath.Join(layout, "index.json"))
+	c.Assert(err, check.IsNil)
+
+	_, err = Build(context.Background(), Plan{FileName: "failing.rb", Script: `from "debian"; run "exit 1"`}, Options{})
+	c.Assert(err, check.NotNil)
+
+	_, err = Build(context.Background(), Plan{FileName: "box.rb"}, Options{Output: "nowhere"})
+	c.Assert(err, check.ErrorMatches, `invalid output "nowhere".*`)
+}
+
+func (bs *builderSuite) TestBuildConcurrent(c *check.C) {
+	names := []string{"one", "two"}
+	results := make([]Result, len(names))
+	errs := make([]error, len(names))
+	logs := make([]*bytes.Buffer, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		logs[i] = &bytes.Buffer{}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], errs[i] = Build(context.Background(), Plan{FileName: name + ".rb", Script: fmt.Sprintf(`
+				from "debian"
+				run "echo %s > /built"
+				run "echo secret-one secret-two"
+			`, name)}, Options{NoCache: true, Tag: "box-concurrent-" + name, Log: logs[i], Secrets: []string{"secret-" + name}})
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		c.Assert(errs[i], check.IsNil)
+		c.Assert(results[i].Image, check.Matches, "sha256:[0-9a-f]{64}")
+		c.Assert(logs[i].String(), check.Matches, fmt.Sprintf(`(?s).*\[%s\.rb\].*`, name))
+		c.Assert(logs[i].String(), check.Not(check.Matches), fmt.Sprintf(`(?s).*\[%s\.rb\].*`, names[1-i]))
+		// each build redacts its own secrets only.
+		c.Assert(logs[i].String(), check.Not(check.Matches), fmt.Sprintf(`(?s).*secret-%s.*`, name))
+		c.Assert(logs[i].String(), check.Matches, fmt.Sprintf(`(?s).*secret-%s.*`, names[1-i]))
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "box-concurrent-"+name)
+		c.Assert(err, check.IsNil)
+		c.Assert(inspect.ID, check.Equals, results[i].Image)
+
+		content, err := exec.Command("docker", "run", "--rm", results[i].Image, "cat", "/built").Output()
+		c.Assert(err, check.IsNil)
+		c.Assert(string(content), check.Equals, name+"\n")
+	}
+
+	c.Assert(results[0].Image, check.Not(check.Equals), results[1].Image)
 }
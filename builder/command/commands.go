@@ -12,7 +12,11 @@ flatten
 */
 
 import (
+	"sort"
+	"strings"
+
 	"github.com/box-builder/box/builder/executor"
+	"github.com/box-builder/box/cache"
 	"github.com/box-builder/box/types"
 )
 
@@ -22,6 +26,8 @@ type Interpreter struct {
 	CacheKey string // if set to "", does not consider cache next step
 	globals  *types.Global
 	exec     executor.Executor
+	strip    []string          // patterns of the files left out of flattened layers
+	secrets  map[string][]byte // secrets given with the secret verb, by ID
 }
 
 // NewInterpreter contypes a new *Interpreter.
@@ -32,6 +38,63 @@ func NewInterpreter(globals *types.Global, exec executor.Executor) *Interpreter
 	}
 }
 
+// StepKey computes the cache key for a step run on the current image. inputs
+// are the sums of any content the step reads from outside the image.
+//
+// If the current image was built by a step, the key of that step stands in
+// for the image, so keys only depend on the image the build started from and
+// the steps since. This lets a step be found in the history of an image built
+// elsewhere, see --cache-from-image.
+func (i *Interpreter) StepKey(verb string, args []string, inputs ...string) (string, error) {
+	parent := i.exec.Config().Image
+	if built := i.exec.Config().BuiltBy; built.Image == parent && built.Key != "" {
+		parent = built.Key
+	}
+
+	state := map[string]string{
+		"user":    i.exec.Config().User.Temporary,
+		"workdir": i.exec.Config().WorkDir.Temporary,
+	}
+
+	// steps are keyed on how their containers are confined by the flags box was
+	// run with; what a step sets itself is part of its arguments.
+	if !i.globals.Security.Empty() {
+		state["security"] = i.globals.Security.Key()
+	}
+
+	// steps run with secrets are keyed on their IDs, never their values.
+	if len(i.secrets) > 0 {
+		ids := []string{}
+		for id := range i.secrets {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		state["secrets"] = strings.Join(ids, ",")
+	}
+
+	return cache.Key{
+		Verb:   verb,
+		Args:   args,
+		Parent: parent,
+		State:  state,
+		Inputs: inputs,
+	}.Sum()
+}
+
+// ReportStep records the result of looking a step up in the cache, if the
+// build is keeping a cache report.
+func (i *Interpreter) ReportStep(step cache.Step) {
+	if i.globals.Report == nil {
+		return
+	}
+
+	if !step.Hit && step.Reason == "" && !i.globals.Cache {
+		step.Reason = cache.ReasonDisabled
+	}
+
+	i.globals.Report.Add(step)
+}
+
 func (i *Interpreter) makeLayer(useHook bool) error {
 	hook := i.exec.RunHook
 	if !useHook {
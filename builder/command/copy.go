@@ -3,9 +3,15 @@ package command
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/layers"
 	"github.com/box-builder/box/tar"
 	"github.com/box-builder/box/util"
 	"github.com/pkg/errors"
@@ -22,20 +28,69 @@ func (i *Interpreter) Copy(source, target string, ignoreList []string) error {
 
 	ignoreList = append(ignoreList, list...)
 
-	// XXX for if we ever add volume support back
+	return i.copy(source, target, ignoreList, fmt.Sprintf("copy %s, %s", source, target))
+}
+
+// CopyFrom implements `copy` with from:, copying the file or directory at
+// source in the image, which docker has, into target.
+func (i *Interpreter) CopyFrom(image, source, target string) error {
+	switch i.globals.Executor {
+	case "", "docker", "podman":
+	default:
+		return errors.Errorf("copy from an image needs docker or podman: it can't be used with --executor %s", i.globals.Executor)
+	}
+
+	dir, err := ioutil.TempDir("", "box-copy-from")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := layers.ExtractPath(i.globals.Context, image, source, dir); err != nil {
+		return errors.Wrapf(err, "could not copy %s from %s", source, image)
+	}
+
+	// the content of a directory is extracted, and a file by its name.
+	extracted := dir
+	if infos, err := ioutil.ReadDir(dir); err != nil {
+		return err
+	} else if len(infos) == 1 && infos[0].Name() == path.Base(source) && !infos[0].IsDir() {
+		extracted = filepath.Join(dir, infos[0].Name())
+	}
+
+	return i.copy(extracted, target, nil, fmt.Sprintf("copy %s, %s, from: %s", source, target, image))
+}
+
+// copy copies source, on the host, into target as a step, reported as step.
+func (i *Interpreter) copy(source, target string, ignoreList []string, step string) error {
+	// files copied beneath a volume are not committed with the container.
 	for _, volume := range i.exec.Config().Volumes {
 		if strings.HasPrefix(target, volume) {
 			return errors.Errorf("Volume %q cannot be copied into (you tried %q). This is caused by a bug in docker. We are working with docker on a fix.", volume, target)
 		}
 	}
 
-	fn, cacheKey, err := tar.Archive(i.globals.Context, source, target, ignoreList, i.globals.Logger)
+	fn, sum, err := tar.Archive(i.globals.Context, source, target, ignoreList, i.globals.Signals, i.globals.Logger)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(fn)
 
-	cacheKey = fmt.Sprintf("box:copy %s", cacheKey)
+	// the source is not part of the key; only the content copied from it is.
+	cacheKey, err := i.StepKey("copy", []string{target}, sum)
+	if err != nil {
+		return err
+	}
+
+	if i.globals.Cache {
+		lock, err := cache.Acquire(i.globals.Context, cacheKey)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	report := cache.Step{Step: step, Key: cacheKey}
 
 	cached, err := i.exec.Image().CheckCache(cacheKey)
 	if err != nil {
@@ -43,9 +98,13 @@ func (i *Interpreter) Copy(source, target string, ignoreList []string) error {
 	}
 
 	if cached {
+		report.Hit = true
+		i.ReportStep(report)
 		return nil
 	}
 
+	start := time.Now()
+
 	f, err := os.Open(fn)
 	if err != nil {
 		return err
@@ -57,5 +116,12 @@ func (i *Interpreter) Copy(source, target string, ignoreList []string) error {
 		return "", i.exec.CopyToContainer(id, f)
 	}
 
-	return i.exec.Commit(cacheKey, hook)
+	if err := i.exec.Commit(cacheKey, hook); err != nil {
+		return err
+	}
+
+	report.Duration = time.Since(start)
+	i.ReportStep(report)
+
+	return nil
 }
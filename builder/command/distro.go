@@ -0,0 +1,83 @@
+package command
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Distribution families we know how to generate commands for.
+const (
+	distroDebian = "debian"
+	distroAlpine = "alpine"
+	distroRHEL   = "rhel"
+)
+
+// osReleaseFiles are consulted in order; /etc/os-release is frequently a
+// symlink, which copying out of the container will not follow.
+var osReleaseFiles = []string{"/usr/lib/os-release", "/etc/os-release"}
+
+// fallbackReleaseFiles identify a family by their presence alone.
+var fallbackReleaseFiles = []struct {
+	filename string
+	distro   string
+}{
+	{"/etc/alpine-release", distroAlpine},
+	{"/etc/debian_version", distroDebian},
+	{"/etc/redhat-release", distroRHEL},
+}
+
+// parseOSRelease returns the family of distribution described by the
+// contents of an os-release file, or "" if it is unknown.
+func parseOSRelease(content string) string {
+	ids := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "ID", "ID_LIKE":
+			ids = append(ids, strings.Fields(strings.Trim(parts[1], `"'`))...)
+		}
+	}
+
+	for _, id := range ids {
+		switch id {
+		case "debian", "ubuntu":
+			return distroDebian
+		case "alpine":
+			return distroAlpine
+		case "rhel", "fedora", "centos", "amzn":
+			return distroRHEL
+		}
+	}
+
+	return ""
+}
+
+// detectDistro detects the family of distribution in the current image.
+func (i *Interpreter) detectDistro() (string, error) {
+	for _, fn := range osReleaseFiles {
+		content, err := i.exec.CopyOneFileFromContainer(fn)
+		if err != nil {
+			continue
+		}
+
+		if distro := parseOSRelease(string(content)); distro != "" {
+			return distro, nil
+		}
+	}
+
+	for _, ent := range fallbackReleaseFiles {
+		if _, err := i.exec.CopyOneFileFromContainer(ent.filename); err == nil {
+			return ent.distro, nil
+		}
+	}
+
+	return "", errors.New("could not detect the distribution of the image; is it debian, alpine or rhel based?")
+}
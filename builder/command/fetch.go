@@ -0,0 +1,60 @@
+package command
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/box-builder/box/download"
+	"github.com/box-builder/box/tar"
+	"github.com/pkg/errors"
+)
+
+// Fetch is the `fetch` verb. The url is downloaded on the host and verified
+// against the sha256 digest before it is written to dest in the image.
+func (i *Interpreter) Fetch(rawurl, digest, dest string, mode int64) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("fetch only supports http and https urls, not %q", rawurl)
+	}
+
+	if dest == "" || strings.HasSuffix(dest, "/") {
+		dest = path.Join(dest, path.Base(u.Path))
+	}
+
+	if !path.IsAbs(dest) {
+		workdir := i.exec.Config().WorkDir.Temporary
+		if workdir == "" {
+			workdir = i.exec.Config().WorkDir.Image
+		}
+
+		dest = path.Join(workdir, dest)
+	}
+
+	fn, err := download.Fetch(i.globals.Context, rawurl, digest, i.globals.Signals, i.globals.Logger)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	r, err := tar.File(dest, mode, content)
+	if err != nil {
+		return err
+	}
+
+	hook := func(ctx context.Context, id string) (string, error) {
+		return "", i.exec.CopyToContainer(id, r)
+	}
+
+	return i.exec.Commit(i.CacheKey, hook)
+}
@@ -1,49 +1,64 @@
 package command
 
 import (
-	"io"
 	"io/ioutil"
 	"os"
 
-	"github.com/box-builder/box/copy"
-	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/tar"
 )
 
-// Flatten implements `flatten`
-func (i *Interpreter) Flatten() error {
-	id, err := i.exec.Create()
-	if err != nil {
+// Strip implements `strip`. The files matching the patterns are left out of
+// the layers flattened after it.
+func (i *Interpreter) Strip(patterns []string) error {
+	if err := tar.ValidExclude(patterns); err != nil {
 		return err
 	}
 
-	defer i.exec.Destroy(id)
+	i.strip = append(i.strip, patterns...)
+	return nil
+}
+
+// Flatten implements `flatten`. If from is given, only the layers added on
+// top of the image named from are flattened. The files matching --exclude or
+// the patterns given to `strip` are left out of the layer flattened.
+func (i *Interpreter) Flatten(from string) error {
+	exclude := append(append([]string{}, i.globals.Exclude...), i.strip...)
+
+	if from != "" {
+		return i.exec.Image().Squash(from, exclude)
+	}
 
-	rc, size, err := i.exec.CopyFromContainer(id, "/")
+	id, err := i.exec.Create()
 	if err != nil {
 		return err
 	}
 
-	f, err := ioutil.TempFile("", "box-flatten.")
+	defer i.exec.Destroy(id)
+
+	rc, _, err := i.exec.CopyFromContainer(id, "/")
 	if err != nil {
 		return err
 	}
 
-	signal.Handler.AddFile(f.Name())
-	defer signal.Handler.RemoveFile(f.Name())
-	defer os.Remove(f.Name())
-
-	if err := copy.WithProgress(f, rc, i.globals.Logger, "Downloading image contents to host"); err != nil && err != io.EOF {
-		f.Close()
+	dir, err := ioutil.TempDir("", "box-flatten.")
+	if err != nil {
 		return err
 	}
-	f.Close()
+	defer os.RemoveAll(dir)
 
-	f, err = os.Open(f.Name())
+	// the layer is summed as it is downloaded, and written into the image
+	// docker loads as it is read, so it is only kept on disk once.
+	layer, err := image.ReadLayer(dir, rc, i.globals.Logger, "Downloading image contents to host")
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	if len(exclude) > 0 {
+		if layer, err = image.Exclude(dir, layer, exclude); err != nil {
+			return err
+		}
+	}
 
-	return i.exec.Image().Flatten(id, size, f)
+	return i.exec.Image().Flatten(layer)
 }
@@ -18,18 +18,91 @@ func (i *Interpreter) From(image string) error {
 		return i.makeLayer(false)
 	}
 
+	fetch := func() (string, error) {
+		return i.exec.Layers().Fetch(i.exec.Config(), image)
+	}
+
+	var err error
+
+	// the name may be of an image for another platform in docker; fetching
+	// finds the one for the platform, pulled for another plan or not.
+	if i.globals.Platform != "" {
+		err = i.from(image, fetch, fetch)
+	} else {
+		err = i.from(image, func() (string, error) {
+			// an image only read from its registry is not in docker until a
+			// step of the plan which read it needs it.
+			if id, err := i.exec.Layers().Lookup(image); err == nil {
+				return id, nil
+			}
+
+			return fetch()
+		}, fetch)
+	}
+
+	if err == nil && i.globals.Provenance != nil {
+		i.globals.Provenance.RecordImage(image, i.exec.Config().Image)
+	}
+
+	return err
+}
+
+// FromArchive corresponds to the `from` verb with an archive: an image file
+// saved by docker save or box save. name selects the image by tag if the file
+// holds several.
+func (i *Interpreter) FromArchive(file, name string) error {
+	fetch := func() (string, error) {
+		return i.exec.Layers().FetchArchive(i.exec.Config(), file, name)
+	}
+
+	// the image is only loaded once; fetching it again finds it in docker.
+	if err := i.from("archive:"+file+"#"+name, fetch, fetch); err != nil {
+		return err
+	}
+
+	return i.recordFile(file)
+}
+
+// FromTar corresponds to the `from` verb with a tar: a filesystem tarball,
+// imported as an image with one layer.
+func (i *Interpreter) FromTar(file string) error {
+	fetch := func() (string, error) {
+		return i.exec.Layers().FetchTar(i.exec.Config(), file)
+	}
+
+	// the tarball is only imported once; fetching it again finds it in docker.
+	if err := i.from("tar:"+file, fetch, fetch); err != nil {
+		return err
+	}
+
+	return i.recordFile(file)
+}
+
+// recordFile records the file used with from for the provenance of the image,
+// if it is recorded.
+func (i *Interpreter) recordFile(file string) error {
+	if i.globals.Provenance == nil {
+		return nil
+	}
+
+	return i.globals.Provenance.RecordFile(file)
+}
+
+// from fetches an image once for all the plans built at the same time, which
+// wait for the one fetching it and then look it up.
+func (i *Interpreter) from(key string, lookup, fetch func() (string, error)) error {
 	var (
 		pullChan chan struct{}
 		pulling  bool
 	)
 
 	pullMutex.Lock()
-	if pulls[image] == nil {
+	if pulls[key] == nil {
 		pullChan = make(chan struct{})
-		pulls[image] = pullChan
+		pulls[key] = pullChan
 	} else {
 		pulling = true
-		pullChan = pulls[image]
+		pullChan = pulls[key]
 	}
 	pullMutex.Unlock()
 
@@ -40,12 +113,12 @@ func (i *Interpreter) From(image string) error {
 
 	if pulling {
 		<-pullChan
-		id, err = i.exec.Layers().Lookup(image)
+		id, err = lookup()
 		if err != nil {
 			return err
 		}
 	} else {
-		id, err = i.exec.Layers().Fetch(i.exec.Config(), image)
+		id, err = fetch()
 		close(pullChan)
 		if err != nil {
 			return err
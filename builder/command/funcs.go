@@ -34,9 +34,31 @@ func (i *Interpreter) Save(file, kind, tag string) error {
 
 // GetEnv gets a value from the local environment.
 func (i *Interpreter) GetEnv(arg string) string {
+	if i.globals.Provenance != nil {
+		i.globals.Provenance.RecordEnv(arg)
+	}
+
 	return os.Getenv(arg)
 }
 
+// GetVar gets a variable provided to the build, such as a matrix variable.
+func (i *Interpreter) GetVar(name string) string {
+	return i.globals.Vars[name]
+}
+
+// GetImageEnv gets a value from the environment of the image, as set by env
+// or by the image it is built from. It is empty if it is not set.
+func (i *Interpreter) GetImageEnv(name string) string {
+	env := i.exec.Config().Env
+	for j := len(env) - 1; j >= 0; j-- {
+		if strings.HasPrefix(env[j], name+"=") {
+			return strings.TrimPrefix(env[j], name+"=")
+		}
+	}
+
+	return ""
+}
+
 // Read reads a file from inside the container, and returns its contents.
 func (i *Interpreter) Read(filename string) (string, error) {
 	content, err := i.exec.CopyOneFileFromContainer(filename)
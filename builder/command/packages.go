@@ -0,0 +1,98 @@
+package command
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var packageRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._:=~/-]*$`)
+
+// packageManagers are the install commands for each manager. Each one skips
+// recommended/weak dependencies and removes the package caches in the same
+// command, so they never land in the layer.
+var packageManagers = map[string]func(pkgs string) string{
+	"apt": func(pkgs string) string {
+		return "apt-get update -qq && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " + pkgs +
+			" && apt-get clean && rm -rf /var/lib/apt/lists/*"
+	},
+	"apk": func(pkgs string) string {
+		return "apk add --no-cache " + pkgs
+	},
+	"dnf": func(pkgs string) string {
+		return "dnf install -y --setopt=install_weak_deps=False " + pkgs + " && dnf clean all && rm -rf /var/cache/dnf"
+	},
+	"yum": func(pkgs string) string {
+		return "yum install -y " + pkgs + " && yum clean all && rm -rf /var/cache/yum"
+	},
+}
+
+// distroManagers maps a distribution family to its package manager.
+var distroManagers = map[string]string{
+	distroDebian: "apt",
+	distroAlpine: "apk",
+	distroRHEL:   "dnf",
+}
+
+// packagesCommand generates the command to install the packages with the
+// manager.
+func packagesCommand(manager string, pkgs []string) (string, error) {
+	if len(pkgs) == 0 {
+		return "", errors.New("no packages to install")
+	}
+
+	for _, pkg := range pkgs {
+		if !packageRegexp.MatchString(pkg) {
+			return "", errors.Errorf("invalid package name %q", pkg)
+		}
+	}
+
+	fn, ok := packageManagers[manager]
+	if !ok {
+		return "", errors.Errorf("unknown package manager %q", manager)
+	}
+
+	cmd := fn(strings.Join(pkgs, " "))
+
+	// older rhel-likes only ship yum.
+	if manager == "dnf" {
+		cmd = "if command -v dnf >/dev/null; then " + cmd + "; else " + packageManagers["yum"](strings.Join(pkgs, " ")) + "; fi"
+	}
+
+	return cmd, nil
+}
+
+// PackagesCommand returns the command `packages` runs to install the packages
+// with the manager on the distribution family: debian, alpine or rhel. If
+// manager is "auto" or empty, it is that of the distribution.
+func PackagesCommand(distro, manager string, pkgs []string) (string, error) {
+	if manager == "" || manager == "auto" {
+		var ok bool
+		if manager, ok = distroManagers[distro]; !ok {
+			return "", errors.Errorf("unsupported distribution %q", distro)
+		}
+	}
+
+	return packagesCommand(manager, pkgs)
+}
+
+// Packages is the `packages` verb. If manager is "auto" or empty, the
+// package manager is chosen based on the image's distribution.
+func (i *Interpreter) Packages(pkgs []string, manager string) error {
+	if manager == "" || manager == "auto" {
+		distro, err := i.detectDistro()
+		if err != nil {
+			return err
+		}
+
+		manager = distroManagers[distro]
+	}
+
+	cmd, err := packagesCommand(manager, pkgs)
+	if err != nil {
+		return err
+	}
+
+	return i.runAsRoot(cmd)
+}
@@ -1,9 +1,17 @@
 package command
 
-// Run corresponds to the `run` verb
-func (i *Interpreter) Run(command string, showRun bool) error {
+import "github.com/box-builder/box/types"
+
+// Run corresponds to the `run` verb. security, if it is not nil, confines the
+// container of the step in place of the global security options.
+func (i *Interpreter) Run(command string, showRun bool, security *types.Security) error {
 	i.exec.Config().TemporaryCommand([]string{"/bin/sh", "-c"}, []string{command})
 
+	if security != nil {
+		i.exec.SetSecurity(security)
+		defer i.exec.SetSecurity(nil)
+	}
+
 	if i.globals.ShowRun == true && !showRun {
 		state := i.globals.ShowRun
 		i.globals.ShowRun = showRun
@@ -12,3 +20,16 @@ func (i *Interpreter) Run(command string, showRun bool) error {
 
 	return i.makeLayer(true)
 }
+
+// runAsRoot runs a command as root regardless of the configured user, and
+// saves the layer. It is used by verbs which manage the system. The user of
+// an enclosing with_user is restored once it has run.
+func (i *Interpreter) runAsRoot(command string) error {
+	user := i.exec.Config().User.Temporary
+	i.exec.Config().User.Temporary = "root"
+	defer func() { i.exec.Config().User.Temporary = user }()
+
+	i.exec.Config().TemporaryCommand([]string{"/bin/sh", "-c"}, []string{command})
+
+	return i.makeLayer(true)
+}
@@ -0,0 +1,127 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+	idRegexp       = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// UserOptions are the options that may be supplied to `create_user`. Empty
+// values are left to the defaults of the distribution's tooling, except for
+// Home and Shell.
+type UserOptions struct {
+	UID   string
+	GID   string
+	Home  string
+	Shell string
+}
+
+// shellQuote quotes a string for use as a single argument to /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (opts *UserOptions) validate(name string) error {
+	if !userNameRegexp.MatchString(name) {
+		return errors.Errorf("invalid user name %q", name)
+	}
+
+	if opts.UID != "" && !idRegexp.MatchString(opts.UID) {
+		return errors.Errorf("invalid uid %q for user %q", opts.UID, name)
+	}
+
+	if opts.GID != "" && !idRegexp.MatchString(opts.GID) {
+		return errors.Errorf("invalid gid %q for user %q", opts.GID, name)
+	}
+
+	if opts.Home == "" {
+		opts.Home = "/home/" + name
+	}
+
+	if opts.Shell == "" {
+		opts.Shell = "/bin/sh"
+	}
+
+	return nil
+}
+
+// userCommand generates the shell command to create the user and its group
+// for the distribution family.
+func userCommand(distro, name string, opts UserOptions) (string, error) {
+	var groupCmd, userCmd []string
+
+	switch distro {
+	case distroDebian, distroRHEL:
+		groupCmd = []string{"groupadd"}
+		if opts.GID != "" {
+			groupCmd = append(groupCmd, "-g", opts.GID)
+		}
+
+		userCmd = []string{"useradd", "-m", "-d", shellQuote(opts.Home), "-s", shellQuote(opts.Shell), "-g", name}
+		if opts.UID != "" {
+			userCmd = append(userCmd, "-u", opts.UID)
+		}
+	case distroAlpine:
+		groupCmd = []string{"addgroup"}
+		if opts.GID != "" {
+			groupCmd = append(groupCmd, "-g", opts.GID)
+		}
+
+		userCmd = []string{"adduser", "-D", "-h", shellQuote(opts.Home), "-s", shellQuote(opts.Shell), "-G", name}
+		if opts.UID != "" {
+			userCmd = append(userCmd, "-u", opts.UID)
+		}
+	default:
+		return "", errors.Errorf("unsupported distribution %q", distro)
+	}
+
+	groupCmd = append(groupCmd, name)
+	userCmd = append(userCmd, name)
+
+	return fmt.Sprintf(
+		"{ getent group %s >/dev/null || %s; } && %s",
+		name,
+		strings.Join(groupCmd, " "),
+		strings.Join(userCmd, " "),
+	), nil
+}
+
+// CreateUserCommand returns the command `create_user` runs to create the user
+// and its group on the distribution family: debian, alpine or rhel.
+func CreateUserCommand(distro, name string, opts UserOptions) (string, error) {
+	if err := opts.validate(name); err != nil {
+		return "", err
+	}
+
+	return userCommand(distro, name, opts)
+}
+
+// CreateUser is the `create_user` verb. It creates the user and a group of
+// the same name with the distribution's tools, then sets it as the image's
+// user.
+func (i *Interpreter) CreateUser(name string, opts UserOptions) error {
+	if err := opts.validate(name); err != nil {
+		return err
+	}
+
+	distro, err := i.detectDistro()
+	if err != nil {
+		return err
+	}
+
+	cmd, err := userCommand(distro, name, opts)
+	if err != nil {
+		return err
+	}
+
+	i.exec.Config().User.Image = name
+
+	return i.runAsRoot(cmd)
+}
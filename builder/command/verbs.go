@@ -1,11 +1,16 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/box-builder/box/secrets"
+	"github.com/box-builder/box/tar"
+	"github.com/docker/go-connections/nat"
 	"github.com/pkg/errors"
 )
 
@@ -72,6 +77,32 @@ func (i *Interpreter) Entrypoint(stringArgs []string) error {
 	return i.makeLayer(false)
 }
 
+// EntrypointScript is the `entrypoint_script` verb. It writes the script to
+// the path as an executable and sets it as the entrypoint in one layer.
+func (i *Interpreter) EntrypointScript(p, script string) error {
+	if !path.IsAbs(p) {
+		workdir := i.exec.Config().WorkDir.Temporary
+		if workdir == "" {
+			workdir = i.exec.Config().WorkDir.Image
+		}
+
+		p = path.Join(workdir, p)
+	}
+
+	r, err := tar.File(p, 0755, []byte(script))
+	if err != nil {
+		return err
+	}
+
+	i.exec.Config().Entrypoint.Image = []string{p}
+
+	hook := func(ctx context.Context, id string) (string, error) {
+		return "", i.exec.CopyToContainer(id, r)
+	}
+
+	return i.exec.Commit(i.CacheKey, hook)
+}
+
 // WithUser is the `with_user` verb.
 func (i *Interpreter) WithUser(username string, run func() error) error {
 	i.exec.Config().User.Temporary = username
@@ -111,6 +142,18 @@ func (i *Interpreter) Inside(p string, run func() error) error {
 	return run()
 }
 
+// Profile is the `profile` verb. run is only called if the profile was
+// selected for the build.
+func (i *Interpreter) Profile(name string, run func() error) error {
+	for _, profile := range i.globals.Profiles {
+		if profile == name {
+			return run()
+		}
+	}
+
+	return nil
+}
+
 // Env corresponds to the `env` verb.
 func (i *Interpreter) Env(env map[string]string) error {
 	newEnv := map[string]string{}
@@ -140,3 +183,80 @@ func (i *Interpreter) Cmd(cmds []string) error {
 	i.exec.Config().Cmd.Image = cmds
 	return i.makeLayer(false)
 }
+
+// Expose corresponds to the `expose` verb.
+func (i *Interpreter) Expose(ports []string) error {
+	for _, port := range ports {
+		if strings.Contains(port, ":") {
+			return errors.Errorf("port %q may not publish to the host; only expose it", port)
+		}
+	}
+
+	exposed, _, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return err
+	}
+
+	for port := range exposed {
+		if !hasString(i.exec.Config().ExposedPorts, string(port)) {
+			i.exec.Config().ExposedPorts = append(i.exec.Config().ExposedPorts, string(port))
+		}
+	}
+
+	sort.Strings(i.exec.Config().ExposedPorts)
+
+	return i.makeLayer(false)
+}
+
+// Volume corresponds to the `volume` verb.
+func (i *Interpreter) Volume(volumes []string) error {
+	for _, volume := range volumes {
+		if !path.IsAbs(volume) {
+			return errors.Errorf("path %q is not absolute in volume", volume)
+		}
+
+		volume = path.Clean(volume)
+
+		if !hasString(i.exec.Config().Volumes, volume) {
+			i.exec.Config().Volumes = append(i.exec.Config().Volumes, volume)
+		}
+	}
+
+	sort.Strings(i.exec.Config().Volumes)
+
+	return i.makeLayer(false)
+}
+
+// Secret corresponds to the `secret` verb. The secret is resolved from the
+// provider now, and the run statements after it read it from
+// /run/secrets/<id>.
+func (i *Interpreter) Secret(id, provider, ref string) error {
+	if err := secrets.ValidID(id); err != nil {
+		return err
+	}
+
+	value, err := secrets.Resolve(i.globals.Context, provider, ref)
+	if err != nil {
+		return err
+	}
+
+	if i.secrets == nil {
+		i.secrets = map[string][]byte{}
+	}
+
+	i.secrets[id] = value
+	i.exec.SetSecrets(i.secrets)
+	i.globals.Logger.AddSecret(string(value))
+
+	return nil
+}
+
+func hasString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,9 +2,11 @@ package config
 
 import (
 	"fmt"
-	"time"
+	"sort"
 
+	"github.com/box-builder/box/util"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
 )
 
 // StringSliceState is a state tracker for two types of states: image-level and
@@ -20,29 +22,41 @@ type StringState struct {
 	Image     string
 }
 
+// BuiltBy records the cache key of the step which built an image.
+type BuiltBy struct {
+	Image string
+	Key   string
+}
+
 // Config is a basic configuration of an image at each step. It is kept in sync
 // by commit routines in the executor. Setting properties here will propagate
 // them to various image-manipulating command when needed.
 type Config struct {
-	Image      string            // Image Identifier, may be different across executors.
-	User       StringState       // the currently configured user for this image.
-	WorkDir    StringState       // the current working directory on entering a container
-	Cmd        StringSliceState  // the secondary execution form, it is provided to images if given to docker run, otherwise this is used.
-	Entrypoint StringSliceState  // the primary execution form, the first arguments and the exec() jumping-off point.
-	Env        []string          // Environment variables
-	Volumes    []string          // Volume paths
-	Labels     map[string]string // Image Labels
+	Image        string            // Image Identifier, may be different across executors.
+	BuiltBy      BuiltBy           // the step which built Image, if it was built by one
+	User         StringState       // the currently configured user for this image.
+	WorkDir      StringState       // the current working directory on entering a container
+	Cmd          StringSliceState  // the secondary execution form, it is provided to images if given to docker run, otherwise this is used.
+	Entrypoint   StringSliceState  // the primary execution form, the first arguments and the exec() jumping-off point.
+	Env          []string          // Environment variables
+	Volumes      []string          // Volume paths
+	ExposedPorts []string          // Exposed ports, in port/proto form
+	Labels       map[string]string // Image Labels
+	Architecture string            // the architecture of the image, amd64 if empty
+	OS           string            // the operating system of the image, linux if empty
+	Variant      string            // the variant of the architecture, if any
 }
 
 // NewConfig initializes a new configuration.
 func NewConfig() *Config {
 	return &Config{
-		Labels:  map[string]string{},
-		Env:     []string{},
-		Volumes: []string{},
-		User:    StringState{"", "root"},
-		WorkDir: StringState{"", "/"},
-		Image:   "",
+		Labels:       map[string]string{},
+		Env:          []string{},
+		Volumes:      []string{},
+		ExposedPorts: []string{},
+		User:         StringState{"", "root"},
+		WorkDir:      StringState{"", "/"},
+		Image:        "",
 	}
 }
 
@@ -74,6 +88,22 @@ func (c *Config) ToDocker(temporary, tty, stdin bool) *container.Config {
 		cmd = []string{"/bin/sh"}
 	}
 
+	var volumes map[string]struct{}
+	if len(c.Volumes) > 0 {
+		volumes = map[string]struct{}{}
+		for _, volume := range c.Volumes {
+			volumes[volume] = struct{}{}
+		}
+	}
+
+	var ports nat.PortSet
+	if len(c.ExposedPorts) > 0 {
+		ports = nat.PortSet{}
+		for _, port := range c.ExposedPorts {
+			ports[nat.Port(port)] = struct{}{}
+		}
+	}
+
 	return &container.Config{
 		Tty:          tty,
 		AttachStderr: true,
@@ -87,6 +117,8 @@ func (c *Config) ToDocker(temporary, tty, stdin bool) *container.Config {
 		User:         user,
 		WorkingDir:   workdir,
 		Labels:       c.Labels,
+		Volumes:      volumes,
+		ExposedPorts: ports,
 	}
 }
 
@@ -99,9 +131,17 @@ func (c *Config) FromDocker(cont *container.Config) {
 	c.User.Image = cont.User
 	c.WorkDir.Image = cont.WorkingDir
 
+	c.Volumes = []string{}
 	for volume := range cont.Volumes {
 		c.Volumes = append(c.Volumes, volume)
 	}
+	sort.Strings(c.Volumes)
+
+	c.ExposedPorts = []string{}
+	for port := range cont.ExposedPorts {
+		c.ExposedPorts = append(c.ExposedPorts, string(port))
+	}
+	sort.Strings(c.ExposedPorts)
 
 	if c.User.Image == "" {
 		c.User.Image = "root"
@@ -112,7 +152,6 @@ func (c *Config) FromDocker(cont *container.Config) {
 	}
 
 	c.Labels = cont.Labels
-	c.Volumes = []string{}
 }
 
 // ToImage returns the config as an image manifest.
@@ -124,9 +163,18 @@ func (c *Config) ToImage(layers []string) map[string]interface{} {
 
 	fields := map[string]interface{}{}
 	fields["config"] = c.ToDocker(false, false, false)
-	fields["created"] = time.Now().Format("2006-01-02T15:04:05Z07:00")
+	fields["created"] = util.BuildTime().Format("2006-01-02T15:04:05Z07:00")
 	fields["architecture"] = "amd64"
 	fields["os"] = "linux"
+	if c.Architecture != "" {
+		fields["architecture"] = c.Architecture
+	}
+	if c.OS != "" {
+		fields["os"] = c.OS
+	}
+	if c.Variant != "" {
+		fields["variant"] = c.Variant
+	}
 	fields["history"] = []map[string]interface{}{{}}
 	fields["rootfs"] = map[string]interface{}{
 		"diff_ids": shaLayers,
@@ -9,5 +9,6 @@ type Evaluator interface {
 	Result() types.BuildResult
 	RunCode(string, int) (int, error)
 	RunScript(string) error
+	RunHooks() error
 	Close() error
 }
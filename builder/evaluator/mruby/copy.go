@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -110,7 +111,67 @@ func checkCopyArgs(workdir config.StringState, args []*mruby.MrbValue) (string,
 	return filepath.Clean(rel), target, ignoreList, nil
 }
 
+// copyFrom returns the image given to copy with from:, if it was.
+func copyFrom(args []*mruby.MrbValue) (string, bool, error) {
+	for _, arg := range args {
+		if arg.Type() != mruby.TypeHash {
+			continue
+		}
+
+		hash, err := coerceHash(arg.Hash())
+		if err != nil {
+			return "", false, err
+		}
+
+		if from, ok := hash["from"]; ok {
+			image, ok := from.(string)
+			if !ok || image == "" {
+				return "", false, errors.New("from in copy must be the name of an image")
+			}
+
+			return image, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// copyFromTarget returns the target of a copy from an image: relative to the
+// workdir, with the trailing / it may have, which copies a file into it.
+func copyFromTarget(workdir config.StringState, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return target
+	}
+
+	targetWd := workdir.Temporary
+	if targetWd == "" {
+		targetWd = workdir.Image
+	}
+
+	joined := filepath.Join(targetWd, target)
+	if strings.HasSuffix(target, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+
+	return joined
+}
+
 func (m *MRuby) doCopy(args []*mruby.MrbValue, self *mruby.MrbValue) error {
+	image, ok, err := copyFrom(args)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		source, target, _, err := parseCopyArgs(args)
+		if err != nil {
+			return err
+		}
+
+		// paths in the image are from its root.
+		return m.Interp.CopyFrom(image, path.Join("/", source), copyFromTarget(m.Exec.Config().WorkDir, target))
+	}
+
 	source, target, ignores, err := checkCopyArgs(m.Exec.Config().WorkDir, args)
 	if err != nil {
 		return err
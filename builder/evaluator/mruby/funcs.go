@@ -16,13 +16,15 @@ type funcFunc func(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value)
 
 func (m *MRuby) funcJumpTable() map[string]*funcDefinition {
 	return map[string]*funcDefinition{
-		"import": {m.importFunc, gm.ArgsReq(1)},
-		"save":   {m.saveFunc, gm.ArgsReq(1)},
-		"getenv": {m.getenv, gm.ArgsReq(1)},
-		"getuid": {m.getuid, gm.ArgsReq(1)},
-		"getgid": {m.getgid, gm.ArgsReq(1)},
-		"read":   {m.read, gm.ArgsReq(1)},
-		"skip":   {m.skip, gm.ArgsNone() | gm.ArgsBlock()},
+		"import":      {m.importFunc, gm.ArgsReq(1)},
+		"save":        {m.saveFunc, gm.ArgsReq(1)},
+		"getenv":      {m.getenv, gm.ArgsReq(1)},
+		"getvar":      {m.getvar, gm.ArgsReq(1)},
+		"getimageenv": {m.getimageenv, gm.ArgsReq(1)},
+		"getuid":      {m.getuid, gm.ArgsReq(1)},
+		"getgid":      {m.getgid, gm.ArgsReq(1)},
+		"read":        {m.read, gm.ArgsReq(1)},
+		"skip":        {m.skip, gm.ArgsNone() | gm.ArgsBlock()},
 	}
 }
 
@@ -36,6 +38,9 @@ func (m *MRuby) importFunc(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm
 		return nil, m.createException(err)
 	}
 
+	m.importDepth++
+	defer func() { m.importDepth-- }()
+
 	if err := m.RunScript(string(content)); err != nil {
 		return nil, m.createException(err)
 	}
@@ -83,6 +88,22 @@ func (m *MRuby) getenv(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Val
 	return gm.String(m.Interp.GetEnv(args[0].String())), nil
 }
 
+func (m *MRuby) getvar(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	return gm.String(m.Interp.GetVar(args[0].String())), nil
+}
+
+func (m *MRuby) getimageenv(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	return gm.String(m.Interp.GetImageEnv(args[0].String())), nil
+}
+
 func (m *MRuby) getuid(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
 	if err := checkArgs(args, 1); err != nil {
 		return nil, m.createException(err)
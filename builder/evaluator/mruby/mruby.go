@@ -1,22 +1,67 @@
 package mruby
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/builder/executor"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/timing"
+	"github.com/box-builder/box/tracing"
 	"github.com/box-builder/box/types"
 	gm "github.com/mitchellh/go-mruby"
 )
 
+// scopingVerbs only adjust how the verbs within their blocks run, so they are
+// still evaluated when graphing a plan.
+var scopingVerbs = map[string]bool{
+	"after":       true,
+	"after_build": true,
+	"inside":      true,
+	"profile":     true,
+	"with_user":   true,
+}
+
+// cacheOptionVerbs take the cache_key and no_cache options. The options are
+// part of the arguments, so a cache_key is part of the cache key.
+var cacheOptionVerbs = map[string]bool{
+	"run": true,
+}
+
+// uncachedVerbs change the image without building a layer of their own for
+// the cache report.
+var uncachedVerbs = map[string]bool{
+	"from": true,
+	"copy": true,
+}
+
+// containerFuncs read from the image, which does not exist when graphing a
+// plan; they return empty strings instead.
+var containerFuncs = map[string]bool{
+	"getgid":      true,
+	"getimageenv": true,
+	"getuid":      true,
+	"read":        true,
+}
+
+// inputFuncs return what the host gives the build; when graphing a plan, the
+// steps record that they may depend on them.
+var inputFuncs = map[string]bool{
+	"getenv": true,
+	"getvar": true,
+}
+
 // MRuby is an Evaluator that can handle mruby interpreters.
 type MRuby struct {
 	mrb            *gm.Mrb
 	afterFunc      *gm.MrbValue
+	afterBuild     []*gm.MrbValue
+	importDepth    int
 	parser         *gm.Parser
 	compileContext *gm.CompileContext
 	result         types.BuildResult
@@ -45,20 +90,20 @@ func NewMRuby(config *Config) (*MRuby, error) {
 
 func (m *MRuby) wrapVerbFunc(name string, vd *verbDefinition) gm.Func {
 	return func(mrb *gm.Mrb, self *gm.MrbValue) (gm.Value, gm.Value) {
-		select {
-		case <-m.Globals.Context.Done():
-			if m.Globals.Context.Err() != nil {
-				return nil, m.createException(m.Globals.Context.Err())
-			}
-
-			return nil, nil
-		default:
+		if err := m.Globals.Context.Err(); err != nil {
+			return nil, m.createException(err)
 		}
 
 		args := mrb.GetArgs()
 		strArgs := extractStringArgs(args)
-		cacheKey := strings.Join(append([]string{name}, strArgs...), ", ")
-		cacheKey = base64.StdEncoding.EncodeToString([]byte(cacheKey))
+		cacheKey, err := m.Interp.StepKey(name, strArgs)
+		if err != nil {
+			return nil, m.createException(err)
+		}
+
+		if m.Globals.Graph != nil {
+			return nil, m.graphVerb(name, vd, args, self, cacheKey)
+		}
 
 		m.Globals.Logger.BuildStep(name, strings.Join(strArgs, ", "))
 
@@ -67,25 +112,146 @@ func (m *MRuby) wrapVerbFunc(name string, vd *verbDefinition) gm.Func {
 			fmt.Println(string(content))
 		}
 
-		cached, err := m.Exec.Image().CheckCache(cacheKey)
-		if err != nil {
-			return nil, m.createException(err)
+		// scoping verbs hold no layer of their own, and the steps in their blocks
+		// take their own locks.
+		if m.Globals.Cache && !scopingVerbs[name] {
+			lock, err := cache.Acquire(m.Globals.Context, cacheKey)
+			if err != nil {
+				return nil, m.createException(err)
+			}
+			defer lock.Release()
+		}
+
+		var cached bool
+		var reason string
+		var stepErr error
+
+		if m.Globals.Timing != nil && !scopingVerbs[name] {
+			defer m.timeStep(name, strArgs, &cached)()
+		}
+
+		if !scopingVerbs[name] {
+			_, span := tracing.Start(m.Globals.Context, "step "+name, tracing.KindInternal)
+			span.Set("box.step", strings.TrimSpace(name+" "+strings.Join(strArgs, ", ")))
+			span.Set("box.cache_key", cacheKey)
+			defer func() {
+				span.Set("box.cached", cached)
+				span.End(stepErr)
+			}()
+		}
+
+		cached, reason, stepErr = m.checkCache(name, args, cacheKey)
+		if stepErr != nil {
+			return nil, m.createException(stepErr)
 		}
 
 		m.Interp.CacheKey = cacheKey
+		step := cache.Step{Step: strings.TrimSpace(name + " " + strings.Join(strArgs, ", ")), Key: cacheKey}
 
 		// if we don't do this for debug, we will step past it on successive runs
 		if !cached || name == "debug" {
-			return nil, m.createException(vd.verbFunc(args, self))
+			step.Reason = reason
+			stepErr = m.runVerb(name, vd, args, self, step)
+			return nil, m.createException(stepErr)
 		}
 
+		step.Hit = true
+		m.Interp.ReportStep(step)
+
 		return nil, nil
 	}
 }
 
+// runVerb runs the step, reporting it if it built a layer.
+func (m *MRuby) runVerb(name string, vd *verbDefinition, args []*gm.MrbValue, self *gm.MrbValue, step cache.Step) error {
+	start := time.Now()
+	parent := m.Exec.Config().Image
+
+	err := vd.verbFunc(args, self)
+
+	// a step re-run with no_cache builds a new layer under the key of the old
+	// one, so the steps after it are keyed on the new image and re-run too.
+	if step.Reason == cache.ReasonNoCache {
+		m.Exec.Config().BuiltBy = config.BuiltBy{}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// only the steps which built a layer are reported; copy reports its own
+	// steps, as it is keyed on what it copies.
+	if !uncachedVerbs[name] && !scopingVerbs[name] && m.Exec.Config().Image != parent {
+		step.Duration = time.Since(start)
+		m.Interp.ReportStep(step)
+	}
+
+	return nil
+}
+
+// graphVerb adds the step to the graph being planned. The steps in the blocks
+// of scoping verbs are run, to be added under them.
+func (m *MRuby) graphVerb(name string, vd *verbDefinition, args []*gm.MrbValue, self *gm.MrbValue, cacheKey string) gm.Value {
+	strArgs := extractStringArgs(args)
+
+	if scopingVerbs[name] {
+		m.Globals.Graph.Enter(name, strArgs)
+		defer m.Globals.Graph.Leave()
+		return m.createException(vd.verbFunc(args, self))
+	}
+
+	m.Globals.Graph.Add(name, strArgs, cacheKey).Values = coerceArgs(args)
+	return nil
+}
+
+// checkCache returns whether the step is cached, or the reason it is not
+// looked up: a step run with no_cache is re-run.
+func (m *MRuby) checkCache(name string, args []*gm.MrbValue, cacheKey string) (bool, string, error) {
+	if cacheOptionVerbs[name] && noCache(args) {
+		return false, cache.ReasonNoCache, nil
+	}
+
+	cached, err := m.Exec.Image().CheckCache(cacheKey)
+	return cached, "", err
+}
+
+// timeStep starts timing the step, and returns the function which records its
+// timing once it is done, as cached or not.
+func (m *MRuby) timeStep(name string, args []string, cached *bool) func() {
+	// what the steps before this one used is not counted.
+	m.Exec.Usage()
+	start, cpu := time.Now(), timing.CPUTime()
+
+	return func() {
+		used, written := m.Exec.Usage()
+		m.Globals.Timing.Add(timing.Step{
+			Step:    strings.TrimSpace(name + " " + strings.Join(args, ", ")),
+			Cached:  *cached,
+			Wall:    time.Since(start),
+			CPU:     timing.CPUTime() - cpu + used,
+			Written: written,
+		})
+	}
+}
+
 func (m *MRuby) wrapFuncFunc(name string, jump *funcDefinition) func(m *gm.Mrb, self *gm.MrbValue) (gm.Value, gm.Value) {
 	return func(mrb *gm.Mrb, self *gm.MrbValue) (gm.Value, gm.Value) {
-		return jump.fun(mrb.GetArgs(), self)
+		args := mrb.GetArgs()
+
+		if m.Globals.Graph != nil {
+			switch {
+			case containerFuncs[name]:
+				m.Globals.Graph.Input(name, extractStringArgs(args))
+				return gm.String(""), nil
+			case inputFuncs[name]:
+				m.Globals.Graph.Input(name, extractStringArgs(args))
+			case name == "save":
+				m.Globals.Graph.Add(name, extractStringArgs(args), "").Values = coerceArgs(args)
+				return nil, nil
+			}
+		}
+
+		return jump.fun(args, self)
 	}
 }
 
@@ -184,12 +350,28 @@ func (m *MRuby) RunScript(script string) error {
 		return m.makeError(err)
 	}
 
+	// the labels of the build, such as the commit of a git context, are
+	// the last step of the outermost plan.
+	if m.importDepth == 0 && len(m.Globals.Labels) > 0 && m.Globals.Graph == nil && m.Exec.Config().Image != "" {
+		m.Interp.CacheKey = ""
+		if err := m.Interp.Label(m.Globals.Labels); err != nil {
+			return m.makeError(err)
+		}
+	}
+
 	if _, err := m.Exec.Layers().MakeImage(m.Exec.Config()); err != nil {
 		return m.makeError(err)
 	}
 
 	if m.afterFunc != nil {
+		if m.Globals.Graph != nil {
+			m.Globals.Graph.Enter("after", nil)
+		}
+
 		_, err := m.mrb.Yield(m.afterFunc)
+		if m.Globals.Graph != nil {
+			m.Globals.Graph.Leave()
+		}
 		if err != nil {
 			return m.makeError(err)
 		}
@@ -198,6 +380,23 @@ func (m *MRuby) RunScript(script string) error {
 	return m.makeResult(m.Exec.Image().ImageID())
 }
 
+// RunHooks runs the after_build blocks of the plan with the ID of the image it
+// built, once the image has passed the checks of the build.
+func (m *MRuby) RunHooks() error {
+	if m.Globals.Graph != nil && len(m.afterBuild) > 0 {
+		m.Globals.Graph.Enter("after_build", nil)
+		defer m.Globals.Graph.Leave()
+	}
+
+	for _, hook := range m.afterBuild {
+		if _, err := m.mrb.Yield(hook, gm.String(m.Exec.Image().ImageID())); err != nil {
+			return m.makeError(err)
+		}
+	}
+
+	return m.makeResult(m.Exec.Image().ImageID())
+}
+
 // Close the interpreter.
 func (m *MRuby) Close() error {
 	m.mrb.EnableGC()
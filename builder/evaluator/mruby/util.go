@@ -87,6 +87,57 @@ func extractStringArgs(args []*gm.MrbValue) []string {
 	return strArgs
 }
 
+// coerceArgs converts the arguments of a verb, with their arrays and hashes,
+// as coerceArray and coerceHash do. nil is left as nil, and blocks are left
+// out.
+func coerceArgs(args []*gm.MrbValue) []interface{} {
+	values := []interface{}{}
+
+	for _, arg := range args {
+		if arg == nil || arg.Type() == gm.TypeProc {
+			continue
+		}
+
+		switch arg.Type() {
+		case gm.TypeNil:
+			values = append(values, nil)
+		case gm.TypeArray:
+			ary, err := coerceArray(arg.Array())
+			if err != nil {
+				ary = arg.String()
+			}
+			values = append(values, ary)
+		case gm.TypeHash:
+			hash, err := coerceHash(arg.Hash())
+			if err != nil {
+				values = append(values, arg.String())
+				continue
+			}
+			values = append(values, hash)
+		default:
+			values = append(values, arg.String())
+		}
+	}
+
+	return values
+}
+
+// noCache is true if the options given to a verb, as a hash in its last
+// argument, set no_cache.
+func noCache(args []*gm.MrbValue) bool {
+	if len(args) == 0 || args[len(args)-1].Type() != gm.TypeHash {
+		return false
+	}
+
+	hash, err := coerceHash(args[len(args)-1].Hash())
+	if err != nil {
+		return false
+	}
+
+	value, ok := hash["no_cache"].(string)
+	return ok && value == "true"
+}
+
 // coerceHash converts a mruby hash into map[string]interface{}. The caller is
 // expected to be responsible for coercing sub-types of the map out. Note that
 // this will attempt to unwind arrays and hashes that are stored within it.
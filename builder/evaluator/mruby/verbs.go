@@ -2,7 +2,10 @@ package mruby
 
 import (
 	"fmt"
+	"strconv"
 
+	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/types"
 	gm "github.com/mitchellh/go-mruby"
 	"github.com/pkg/errors"
 )
@@ -20,22 +23,32 @@ type verbFunc func(args []*gm.MrbValue, self *gm.MrbValue) error
 // verbJumpTable is the dispatch instructions sent to the builder at preparation time.
 func (m *MRuby) verbJumpTable() map[string]*verbDefinition {
 	return map[string]*verbDefinition{
-		"after":      {m.after, gm.ArgsBlock()},
-		"label":      {m.label, gm.ArgsReq(1)},
-		"debug":      {m.debug, gm.ArgsNone()},
-		"set_exec":   {m.setExec, gm.ArgsReq(1)},
-		"workdir":    {m.workdir, gm.ArgsReq(1)},
-		"user":       {m.user, gm.ArgsReq(1)},
-		"flatten":    {m.flatten, gm.ArgsNone()},
-		"tag":        {m.tag, gm.ArgsReq(1)},
-		"entrypoint": {m.entrypoint, gm.ArgsAny()},
-		"from":       {m.from, gm.ArgsReq(1)},
-		"with_user":  {m.withUser, gm.ArgsBlock() | gm.ArgsReq(2)},
-		"inside":     {m.inside, gm.ArgsBlock() | gm.ArgsReq(2)},
-		"env":        {m.env, gm.ArgsAny()},
-		"cmd":        {m.cmd, gm.ArgsAny()},
-		"run":        {m.run, gm.ArgsAny()},
-		"copy":       {m.doCopy, gm.ArgsReq(2)}, // see builder/copy.go
+		"after":             {m.after, gm.ArgsBlock()},
+		"after_build":       {m.afterBuildHook, gm.ArgsBlock()},
+		"label":             {m.label, gm.ArgsReq(1)},
+		"debug":             {m.debug, gm.ArgsNone()},
+		"set_exec":          {m.setExec, gm.ArgsReq(1)},
+		"workdir":           {m.workdir, gm.ArgsReq(1)},
+		"user":              {m.user, gm.ArgsReq(1)},
+		"create_user":       {m.createUser, gm.ArgsAny()},
+		"flatten":           {m.flatten, gm.ArgsOpt(1)},
+		"strip":             {m.strip, gm.ArgsAny()},
+		"tag":               {m.tag, gm.ArgsReq(1)},
+		"entrypoint":        {m.entrypoint, gm.ArgsAny()},
+		"entrypoint_script": {m.entrypointScript, gm.ArgsReq(2)},
+		"from":              {m.from, gm.ArgsReq(1)},
+		"with_user":         {m.withUser, gm.ArgsBlock() | gm.ArgsReq(2)},
+		"inside":            {m.inside, gm.ArgsBlock() | gm.ArgsReq(2)},
+		"profile":           {m.profile, gm.ArgsBlock() | gm.ArgsReq(2)},
+		"env":               {m.env, gm.ArgsAny()},
+		"secret":            {m.secret, gm.ArgsReq(1)},
+		"cmd":               {m.cmd, gm.ArgsAny()},
+		"expose":            {m.expose, gm.ArgsAny()},
+		"volume":            {m.volume, gm.ArgsAny()},
+		"run":               {m.run, gm.ArgsAny()},
+		"packages":          {m.packages, gm.ArgsAny()},
+		"fetch":             {m.fetch, gm.ArgsAny()},
+		"copy":              {m.doCopy, gm.ArgsReq(2)}, // see builder/copy.go
 	}
 }
 
@@ -49,6 +62,17 @@ func (m *MRuby) after(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return nil
 }
 
+func (m *MRuby) afterBuildHook(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 || args[0].Type() != gm.TypeProc {
+		return errors.New("invalid args to after_build")
+	}
+
+	args[0].GCProtect()
+	m.afterBuild = append(m.afterBuild, args[0])
+
+	return nil
+}
+
 func (m *MRuby) label(args []*gm.MrbValue, self *gm.MrbValue) error {
 	if len(args) != 1 {
 		return errors.New("label error: please supply a hash for the labels")
@@ -126,8 +150,80 @@ func (m *MRuby) user(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return m.Interp.User(args[0].String())
 }
 
+func (m *MRuby) createUser(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) < 1 || args[0].Type() != gm.TypeString {
+		return errors.New("create_user requires a user name")
+	}
+
+	opts := command.UserOptions{}
+
+	if len(args) > 1 {
+		if args[1].Type() != gm.TypeHash {
+			return errors.Errorf("invalid argument %q for create_user", args[1].String())
+		}
+
+		err := iterateRubyHash(args[1], func(key, value *gm.MrbValue) error {
+			switch key.String() {
+			case "uid":
+				opts.UID = value.String()
+			case "gid":
+				opts.GID = value.String()
+			case "home":
+				opts.Home = value.String()
+			case "shell":
+				opts.Shell = value.String()
+			default:
+				return errors.Errorf("%q is not a valid option to create_user", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.Interp.CreateUser(args[0].String(), opts)
+}
+
 func (m *MRuby) flatten(args []*gm.MrbValue, self *gm.MrbValue) error {
-	return m.Interp.Flatten()
+	var from string
+
+	if len(args) > 0 {
+		if args[0].Type() != gm.TypeHash {
+			return errors.Errorf("invalid argument %q for flatten", args[0].String())
+		}
+
+		err := iterateRubyHash(args[0], func(key, value *gm.MrbValue) error {
+			switch key.String() {
+			case "from":
+				from = value.String()
+			default:
+				return errors.Errorf("%q is not a valid option to flatten", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.Interp.Flatten(from)
+}
+
+func (m *MRuby) strip(args []*gm.MrbValue, self *gm.MrbValue) error {
+	values, err := extractStringOrArray(m.mrb, args)
+	if err != nil {
+		return err
+	}
+
+	stringArgs := extractStringArgs(values)
+	if len(stringArgs) == 0 {
+		return errors.New("strip requires at least one pattern")
+	}
+
+	return m.Interp.Strip(stringArgs)
 }
 
 func (m *MRuby) tag(args []*gm.MrbValue, self *gm.MrbValue) error {
@@ -152,12 +248,60 @@ func (m *MRuby) entrypoint(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return m.Interp.Entrypoint(stringArgs)
 }
 
+func (m *MRuby) entrypointScript(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if err := checkArgs(args, 2); err != nil {
+		return err
+	}
+
+	if args[0].Type() != gm.TypeString || args[1].Type() != gm.TypeString {
+		return errors.New("entrypoint_script takes a path and a script as strings")
+	}
+
+	return m.Interp.EntrypointScript(args[0].String(), args[1].String())
+}
+
 func (m *MRuby) from(args []*gm.MrbValue, self *gm.MrbValue) error {
 	if err := checkArgs(args, 1); err != nil {
 		return err
 	}
 
-	return m.Interp.From(args[0].String())
+	if args[0].Type() != gm.TypeHash {
+		return m.Interp.From(args[0].String())
+	}
+
+	var archive, image, tar string
+
+	err := iterateRubyHash(args[0], func(key, value *gm.MrbValue) error {
+		switch key.String() {
+		case "archive":
+			archive = value.String()
+		case "image":
+			image = value.String()
+		case "tar":
+			tar = value.String()
+		default:
+			return errors.Errorf("%q is not a valid option to from", key.String())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if tar != "" {
+		if archive != "" || image != "" {
+			return errors.New("from takes either a tar or an archive")
+		}
+
+		return m.Interp.FromTar(tar)
+	}
+
+	if archive == "" {
+		return errors.New("from requires an image name, an archive or a tar")
+	}
+
+	return m.Interp.FromArchive(archive, image)
 }
 
 func (m *MRuby) withUser(args []*gm.MrbValue, self *gm.MrbValue) error {
@@ -190,6 +334,21 @@ func (m *MRuby) inside(args []*gm.MrbValue, self *gm.MrbValue) error {
 	})
 }
 
+func (m *MRuby) profile(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if err := checkArgs(args, 2); err != nil {
+		return err
+	}
+
+	if args[1].Type() != gm.TypeProc {
+		return errors.Errorf("Arg %q was not block!", args[1].String())
+	}
+
+	return m.Interp.Profile(args[0].String(), func() error {
+		_, err := m.mrb.Yield(args[1], args[0])
+		return err
+	})
+}
+
 func (m *MRuby) env(args []*gm.MrbValue, self *gm.MrbValue) error {
 	if err := checkArgs(args, 1); err != nil {
 		return err
@@ -208,6 +367,37 @@ func (m *MRuby) env(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return m.Interp.Env(newEnv)
 }
 
+func (m *MRuby) secret(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 || args[0].Type() != gm.TypeHash {
+		return errors.New("secret requires a hash of the id and where the secret is kept, e.g. id: \"db-pass\", vault: \"kv/data/ci#password\"")
+	}
+
+	var id, provider, ref string
+
+	err := iterateRubyHash(args[0], func(key, value *gm.MrbValue) error {
+		if key.String() == "id" {
+			id = value.String()
+			return nil
+		}
+
+		if provider != "" {
+			return errors.Errorf("a secret can only be kept in one place, not in %s and %s", provider, key.String())
+		}
+
+		provider, ref = key.String(), value.String()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if id == "" || provider == "" {
+		return errors.New("secret requires an id and where the secret is kept")
+	}
+
+	return m.Interp.Secret(id, provider, ref)
+}
+
 func (m *MRuby) cmd(args []*gm.MrbValue, self *gm.MrbValue) error {
 	values, err := extractStringOrArray(m.mrb, args)
 	if err != nil {
@@ -222,6 +412,34 @@ func (m *MRuby) cmd(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return m.Interp.Cmd(stringArgs)
 }
 
+func (m *MRuby) expose(args []*gm.MrbValue, self *gm.MrbValue) error {
+	values, err := extractStringOrArray(m.mrb, args)
+	if err != nil {
+		return err
+	}
+
+	stringArgs := extractStringArgs(values)
+	if len(stringArgs) == 0 {
+		return errors.New("expose requires at least one port")
+	}
+
+	return m.Interp.Expose(stringArgs)
+}
+
+func (m *MRuby) volume(args []*gm.MrbValue, self *gm.MrbValue) error {
+	values, err := extractStringOrArray(m.mrb, args)
+	if err != nil {
+		return err
+	}
+
+	stringArgs := extractStringArgs(values)
+	if len(stringArgs) == 0 {
+		return errors.New("volume requires at least one path")
+	}
+
+	return m.Interp.Volume(stringArgs)
+}
+
 func (m *MRuby) run(args []*gm.MrbValue, self *gm.MrbValue) error {
 	if len(args) < 1 {
 		return errors.New("no command to run in run statement")
@@ -230,6 +448,7 @@ func (m *MRuby) run(args []*gm.MrbValue, self *gm.MrbValue) error {
 	}
 
 	output := true
+	var security *types.Security
 
 	if len(args) > 1 {
 		if args[1].Type() == gm.TypeHash {
@@ -242,10 +461,171 @@ func (m *MRuby) run(args []*gm.MrbValue, self *gm.MrbValue) error {
 			if ok && outstr == "false" {
 				output = false
 			}
+
+			// cache_key and no_cache are handled with the cache in wrapVerbFunc.
+			if key, ok := hash["cache_key"]; ok {
+				if _, ok := key.(string); !ok {
+					return errors.New("cache_key must be a string")
+				}
+			}
+
+			security, err = runSecurity(hash)
+			if err != nil {
+				return err
+			}
 		} else {
 			return errors.Errorf("invalid argument %q for run statement", args[1].String())
 		}
 	}
 
-	return m.Interp.Run(args[0].String(), output)
+	return m.Interp.Run(args[0].String(), output, security)
+}
+
+// runSecurity returns the security options of a run statement, or nil if it
+// has none. selinux, cap_add and cap_drop are a string or an array of them.
+func runSecurity(hash map[string]interface{}) (*types.Security, error) {
+	security := &types.Security{}
+
+	for _, option := range []struct {
+		key   string
+		value *string
+	}{{"seccomp", &security.Seccomp}, {"apparmor", &security.AppArmor}, {"network", &security.Network}} {
+		value, ok := hash[option.key]
+		if !ok {
+			continue
+		}
+
+		str, ok := value.(string)
+		if !ok || str == "" {
+			return nil, errors.Errorf("%s must be a string", option.key)
+		}
+
+		*option.value = str
+	}
+
+	for _, option := range []struct {
+		key    string
+		values *[]string
+	}{{"selinux", &security.SELinux}, {"cap_add", &security.CapAdd}, {"cap_drop", &security.CapDrop}} {
+		values, err := stringOrStrings(hash, option.key)
+		if err != nil {
+			return nil, err
+		}
+
+		*option.values = values
+	}
+
+	if security.Empty() {
+		return nil, nil
+	}
+
+	// the options are checked now, rather than when the step runs.
+	if err := security.Validate(); err != nil {
+		return nil, err
+	}
+
+	return security, nil
+}
+
+// stringOrStrings returns the option of the hash, a string or an array of
+// them, as a list.
+func stringOrStrings(hash map[string]interface{}, key string) ([]string, error) {
+	switch value := hash[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		strs := []string{}
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return nil, errors.Errorf("%s must be a string or an array of strings", key)
+			}
+			strs = append(strs, str)
+		}
+
+		return strs, nil
+	default:
+		return nil, errors.Errorf("%s must be a string or an array of strings", key)
+	}
+}
+
+func (m *MRuby) packages(args []*gm.MrbValue, self *gm.MrbValue) error {
+	var manager string
+
+	if len(args) > 0 && args[len(args)-1].Type() == gm.TypeHash {
+		err := iterateRubyHash(args[len(args)-1], func(key, value *gm.MrbValue) error {
+			switch key.String() {
+			case "manager":
+				manager = value.String()
+			default:
+				return errors.Errorf("%q is not a valid option to packages", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		args = args[:len(args)-1]
+	}
+
+	values, err := extractStringOrArray(m.mrb, args)
+	if err != nil {
+		return err
+	}
+
+	return m.Interp.Packages(extractStringArgs(values), manager)
+}
+
+// parseMode parses a file mode. Ruby octal literals such as 0755 arrive as
+// integers and are taken as they are, while strings such as "0755" or "755"
+// are always taken as octal.
+func parseMode(mode *gm.MrbValue) (int64, error) {
+	if mode.Type() == gm.TypeFixnum {
+		return int64(mode.Fixnum()), nil
+	}
+
+	return strconv.ParseInt(mode.String(), 8, 32)
+}
+
+func (m *MRuby) fetch(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 2 || args[0].Type() != gm.TypeString || args[1].Type() != gm.TypeHash {
+		return errors.New("fetch takes a url and a hash of options")
+	}
+
+	var (
+		digest, dest string
+		mode         int64 = 0644
+	)
+
+	err := iterateRubyHash(args[1], func(key, value *gm.MrbValue) error {
+		switch key.String() {
+		case "sha256":
+			digest = value.String()
+		case "dest":
+			dest = value.String()
+		case "mode":
+			var err error
+			mode, err = parseMode(value)
+			if err != nil {
+				return errors.Errorf("invalid mode %q for fetch", value.String())
+			}
+		default:
+			return errors.Errorf("%q is not a valid option to fetch", key.String())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if digest == "" {
+		return errors.New("fetch requires a sha256 digest to verify the download")
+	}
+
+	return m.Interp.Fetch(args[0].String(), digest, dest, mode)
 }
@@ -0,0 +1,350 @@
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/box-builder/box/builder/executor/runc"
+	"github.com/box-builder/box/types"
+)
+
+// diffMediaType is the media type of the diffs of snapshots: uncompressed,
+// so their digests are the diff IDs of the layers.
+const diffMediaType = "application/vnd.oci.image.layer.v1.tar"
+
+// ctr runs the steps of a runc executor as tasks of containerd, over its
+// snapshots, through ctr in the namespace of the snapshots and containers of
+// box.
+type ctr struct {
+	globals   *types.Global
+	runc      *runc.Runc
+	path      string
+	namespace string
+	mounted   bool // if set, the snapshot of the container is mounted on the root filesystem
+}
+
+// NewContainerd makes a runc executor which uses containerd: the root
+// filesystems of the steps are its snapshots, and the steps are run as its
+// tasks. The images are kept in the store as they are by the runc executor;
+// the snapshots of their layers are named by chain ID, as containerd names
+// those of the images it unpacks. containerd is used through ctr, which must
+// be in PATH, at $CONTAINERD_ADDRESS and with the snapshotter of
+// $CONTAINERD_SNAPSHOTTER, as ctr uses them, in the namespace of
+// $CONTAINERD_NAMESPACE, or box.
+func NewContainerd(globals *types.Global) (*runc.Runc, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("the containerd executor runs on linux, not %s", runtime.GOOS)
+	}
+
+	if globals.Reproducible {
+		return nil, errors.New("reproducible builds need docker: they can't be run with the containerd executor")
+	}
+
+	if os.Geteuid() != 0 {
+		return nil, errors.New("the containerd executor must be run by root, as it mounts the snapshots of containerd")
+	}
+
+	path, err := exec.LookPath("ctr")
+	if err != nil {
+		return nil, fmt.Errorf("could not find ctr: %v", err)
+	}
+
+	namespace := os.Getenv("CONTAINERD_NAMESPACE")
+	if namespace == "" {
+		namespace = "box"
+	}
+
+	c := &ctr{globals: globals, path: path, namespace: namespace}
+
+	if _, err := c.output(globals.Context, "version"); err != nil {
+		return nil, fmt.Errorf("could not reach containerd: %v", err)
+	}
+
+	r, err := runc.New(globals, c)
+	if err != nil {
+		return nil, err
+	}
+
+	c.runc = r
+	return r, nil
+}
+
+func (c *ctr) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, c.path, append([]string{"--namespace", c.namespace}, args...)...)
+}
+
+// output runs ctr with the arguments, and returns what it wrote, trimmed.
+func (c *ctr) output(ctx context.Context, args ...string) (string, error) {
+	cmd := c.command(ctx, args...)
+
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if len(args) > 2 {
+			args = args[:2]
+		}
+		return "", fmt.Errorf("ctr %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runArgs returns the arguments of ctr which run the container of the bundle
+// as a task, and remove it when it exits.
+func runArgs(bundle, id string, tty bool) []string {
+	args := []string{"run", "--rm", "--config", filepath.Join(bundle, "config.json")}
+	if tty {
+		args = append(args, "--tty")
+	}
+
+	return append(args, id)
+}
+
+// prepare makes the active snapshot of the key on top of the parent, or
+// empty if there is none.
+func (c *ctr) prepare(ctx context.Context, key, parent string) error {
+	args := []string{"snapshots", "prepare", key}
+	if parent != "" {
+		args = append(args, parent)
+	}
+
+	_, err := c.output(ctx, args...)
+	return err
+}
+
+// commit commits the active snapshot of the key as the snapshot of the
+// name. Another build may have committed the name first, in which case the
+// key is removed.
+func (c *ctr) commit(ctx context.Context, name, key string) error {
+	_, err := c.output(ctx, "snapshots", "commit", name, key)
+	if err != nil {
+		if _, ierr := c.output(ctx, "snapshots", "info", name); ierr == nil {
+			c.output(context.Background(), "snapshots", "rm", key)
+			return nil
+		}
+	}
+
+	return err
+}
+
+// mount mounts the snapshot of the key on the directory, with the mounts ctr
+// writes for it. They are run as mount, without a shell.
+func (c *ctr) mount(ctx context.Context, dir, key string) error {
+	out, err := c.output(ctx, "snapshots", "mounts", dir, key)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		args, err := mountArgs(line, dir)
+		if err != nil {
+			return fmt.Errorf("could not mount snapshot %s: %v", key, err)
+		}
+
+		if out, err := exec.CommandContext(ctx, "mount", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("could not mount snapshot %s: %v: %s", key, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+// mountArgs returns the arguments of mount of a mount ctr wrote, as
+// "mount -t <type> <source> <target> -o <options>", whose target must be
+// the directory. Anything else is an error, rather than being run.
+func mountArgs(line, dir string) ([]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 6 {
+		// the options are empty.
+		fields = append(fields, "")
+	}
+
+	if len(fields) != 7 || fields[0] != "mount" || fields[1] != "-t" || fields[5] != "-o" {
+		return nil, fmt.Errorf("unexpected mount from ctr: %q", line)
+	}
+
+	typ, source, target, options := fields[2], fields[3], fields[4], fields[6]
+	if filepath.Clean(target) != filepath.Clean(dir) {
+		return nil, fmt.Errorf("unexpected mount from ctr: %q is not on %s", line, dir)
+	}
+
+	args := []string{"-t", typ}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+
+	return append(args, source, dir), nil
+}
+
+// snapshot makes the snapshots of the layers of the image containerd does
+// not have yet, and returns the name of that of the image, or nothing if it
+// has no layers.
+func (c *ctr) snapshot(image string) (string, error) {
+	diffIDs, err := c.runc.Store().DiffIDs(image)
+	if err != nil {
+		return "", err
+	}
+
+	files, err := c.runc.Store().LayerFiles(image)
+	if err != nil {
+		return "", err
+	}
+
+	parent := ""
+	for i := range diffIDs {
+		name := runc.ChainID(diffIDs[:i+1])
+
+		if _, err := c.output(c.globals.Context, "snapshots", "info", name); err != nil {
+			if err := c.applySnapshot(name, parent, files[i]); err != nil {
+				return "", err
+			}
+		}
+
+		parent = name
+	}
+
+	return parent, nil
+}
+
+// applySnapshot makes the snapshot of the name, of the layer in the file
+// applied on top of the parent.
+func (c *ctr) applySnapshot(name, parent, file string) error {
+	key, err := runc.RandomID("box-unpack-")
+	if err != nil {
+		return err
+	}
+
+	if err := c.prepare(c.globals.Context, key, parent); err != nil {
+		return err
+	}
+
+	rootfs := c.runc.Rootfs()
+
+	err = c.mount(c.globals.Context, rootfs, key)
+	if err == nil {
+		err = runc.UnpackLayer(rootfs, file, false)
+
+		if uerr := runc.Unmount(rootfs); err == nil {
+			err = uerr
+		}
+	}
+
+	if err == nil {
+		err = c.commit(c.globals.Context, name, key)
+	}
+
+	if err != nil {
+		c.output(context.Background(), "snapshots", "rm", key)
+	}
+
+	return err
+}
+
+// Create makes the snapshot of the container on top of that of the current
+// image, and mounts it on the root filesystem.
+func (c *ctr) Create(container *runc.Container) (bool, error) {
+	parent, err := c.snapshot(c.runc.Config().Image)
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.prepare(c.globals.Context, container.ID, parent); err != nil {
+		return false, err
+	}
+
+	if err := c.mount(c.globals.Context, c.runc.Rootfs(), container.ID); err != nil {
+		c.output(context.Background(), "snapshots", "rm", container.ID)
+		return false, err
+	}
+
+	c.mounted = true
+	return true, nil
+}
+
+// Run runs the container of the bundle the runc executor wrote for the step
+// as a task of containerd.
+func (c *ctr) Run(ctx context.Context, container *runc.Container) error {
+	return c.runc.RunBundle(ctx, container, func(bundle string, tty bool) *exec.Cmd {
+		return c.command(ctx, runArgs(bundle, container.ID, tty)...)
+	})
+}
+
+// Destroy removes the task and the snapshot of the container. The snapshot
+// of the image committed is made from its layer by the next container, so it
+// has none of the files made for the mounts of this one.
+func (c *ctr) Destroy(container *runc.Container) error {
+	ctx := context.Background()
+
+	if container.Started {
+		// ctr removes the task and the container as it exits, but for a run
+		// which was interrupted.
+		c.output(ctx, "tasks", "delete", "--force", container.ID)
+		c.output(ctx, "containers", "delete", container.ID)
+	}
+
+	if c.mounted {
+		if err := runc.Unmount(c.runc.Rootfs()); err != nil {
+			return err
+		}
+		c.mounted = false
+	}
+
+	_, err := c.output(ctx, "snapshots", "rm", container.ID)
+	return err
+}
+
+// Layer returns the layer tarball of the changes made to the snapshot of the
+// container, which containerd writes to its content store, without the files
+// made for the mounts of the container.
+func (c *ctr) Layer(container *runc.Container) (io.ReadCloser, error) {
+	if err := runc.Unmount(c.runc.Rootfs()); err != nil {
+		return nil, err
+	}
+	c.mounted = false
+
+	dgst, err := c.output(c.globals.Context, "snapshots", "diff", "--keep", "--media-type", diffMediaType, container.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := c.command(c.globals.Context, "content", "get", dgst)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &diffReader{Reader: runc.WithoutMounts(stdout, container.Mounts), cmd: cmd, ctr: c, digest: dgst}, nil
+}
+
+// diffReader reads a diff from the content store, and removes it once it is
+// read.
+type diffReader struct {
+	io.Reader
+	cmd    *exec.Cmd
+	ctr    *ctr
+	digest string
+}
+
+func (d *diffReader) Close() error {
+	err := d.cmd.Wait()
+	d.ctr.output(context.Background(), "content", "rm", d.digest)
+	return err
+}
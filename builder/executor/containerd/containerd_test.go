@@ -0,0 +1,31 @@
+package containerd
+
+import (
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type containerdSuite struct{}
+
+var _ = Suite(&containerdSuite{})
+
+func TestContainerd(t *T) {
+	TestingT(t)
+}
+
+func (cs *containerdSuite) TestMountArgs(c *C) {
+	args, err := mountArgs("mount -t overlay overlay /box/rootfs -o index=off,workdir=/w,upperdir=/u,lowerdir=/l", "/box/rootfs")
+	c.Assert(err, IsNil)
+	c.Assert(args, DeepEquals, []string{"-t", "overlay", "-o", "index=off,workdir=/w,upperdir=/u,lowerdir=/l", "overlay", "/box/rootfs"})
+
+	args, err = mountArgs("mount -t bind /snapshots/1/fs /box/rootfs -o ", "/box/rootfs/")
+	c.Assert(err, IsNil)
+	c.Assert(args, DeepEquals, []string{"-t", "bind", "/snapshots/1/fs", "/box/rootfs/"})
+
+	_, err = mountArgs("mount -t overlay overlay /etc -o ro", "/box/rootfs")
+	c.Assert(err, ErrorMatches, `unexpected mount from ctr: .* is not on /box/rootfs`)
+
+	_, err = mountArgs("mount -t overlay overlay /box/rootfs -o ro; rm -rf /", "/box/rootfs")
+	c.Assert(err, ErrorMatches, `unexpected mount from ctr: .*`)
+}
@@ -7,6 +7,9 @@ import (
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/builder/executor"
@@ -14,17 +17,22 @@ import (
 	btypes "github.com/box-builder/box/types"
 	"github.com/box-builder/box/util"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 )
 
 // Docker implements an executor that talks to docker to achieve its goals.
 type Docker struct {
-	globals *btypes.Global
-	client  *client.Client
-	config  *config.Config
-	stdin   bool
-	layers  layers.Layers
-	image   layers.Image
+	globals  *btypes.Global
+	client   *client.Client
+	config   *config.Config
+	stdin    bool
+	secrets  map[string][]byte
+	security *btypes.Security
+	layers   layers.Layers
+	image    layers.Image
+	cpu      time.Duration // the CPU time of run invocations, for Usage
+	written  int64         // the bytes committed to layers, for Usage
 }
 
 // NewDocker contypes a new docker instance, for executing against docker
@@ -35,6 +43,14 @@ func NewDocker(globals *btypes.Global) (*Docker, error) {
 		return nil, err
 	}
 
+	if globals.Platform != "" {
+		if err := checkPlatform(globals.Context, client, globals.Platform); err != nil {
+			return nil, err
+		}
+	}
+
+	checkStorage(globals.Context, client, globals.Logger)
+
 	config := config.NewConfig()
 
 	l, err := layers.NewDocker(globals)
@@ -66,6 +82,52 @@ func (d *Docker) SetStdin(on bool) {
 	d.stdin = on
 }
 
+// SetSecrets sets the secrets run invocations read from /run/secrets. The
+// directory is a tmpfs, and the secrets are written to it through the stdin
+// of the container before the command runs, so they are never on disk. They
+// are not mounted when debugging, as stdin is the terminal's then.
+func (d *Docker) SetSecrets(secrets map[string][]byte) {
+	d.secrets = secrets
+}
+
+// SetSecurity sets how the containers of a run step are confined, over the
+// security of the build.
+func (d *Docker) SetSecurity(security *btypes.Security) {
+	d.security = security
+}
+
+// mountSecrets is true if the containers made have the secrets mounted.
+func (d *Docker) mountSecrets() bool {
+	return len(d.secrets) > 0 && !d.stdin
+}
+
+// tty is true if the containers made have a TTY. Containers with secrets have
+// none, so the secrets written to them are not echoed.
+func (d *Docker) tty() bool {
+	return d.globals.TTY && !d.mountSecrets()
+}
+
+// secretIDs returns the IDs of the secrets, sorted, which is the order they are
+// written to the container in.
+func (d *Docker) secretIDs() []string {
+	ids := []string{}
+	for id := range d.secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Usage returns the CPU time the containers of run invocations used, and the
+// bytes committed to layers, since it was last called.
+func (d *Docker) Usage() (time.Duration, int64) {
+	cpu, written := d.cpu, d.written
+	d.cpu, d.written = 0, 0
+
+	return cpu, written
+}
+
 // Image returns the layers.Image interface for working with Docker
 func (d *Docker) Image() layers.Image {
 	return d.image
@@ -93,6 +155,12 @@ func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
 		return err
 	}
 
+	// a cache image may already have the layers of this step.
+	reused, err := d.image.ReuseCache(cacheKey)
+	if err != nil || reused {
+		return err
+	}
+
 	id, err := d.Create()
 	if err != nil {
 		return err
@@ -112,18 +180,14 @@ func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
 		}
 	}
 
-	select {
-	case <-d.globals.Context.Done():
-		if d.globals.Context.Err() == context.Canceled {
-			return d.globals.Context.Err()
-		}
-	default:
-	}
-
 	if err := util.CheckContext(d.globals.Context); err != nil {
 		return err
 	}
 
+	if d.globals.Timing != nil {
+		d.addWritten(id)
+	}
+
 	commitResp, err := d.client.ContainerCommit(d.globals.Context, id, types.ContainerCommitOptions{Config: d.config.ToDocker(false, d.globals.TTY, d.stdin), Comment: cacheKey})
 	if err != nil {
 		return fmt.Errorf("Error during commit: %v", err)
@@ -136,9 +200,18 @@ func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
 	}
 
 	d.config.Image = commitResp.ID
+	d.config.BuiltBy = config.BuiltBy{Image: commitResp.ID, Key: cacheKey}
 	return d.Layers().AddImage(commitResp.ID)
 }
 
+// addWritten counts the size of what the container wrote, which the layer
+// committed from it holds, in the bytes committed.
+func (d *Docker) addWritten(id string) {
+	if info, _, err := d.client.ContainerInspectWithRaw(d.globals.Context, id, true); err == nil && info.SizeRw != nil {
+		d.written += *info.SizeRw
+	}
+}
+
 // CopyOneFileFromContainer copies a file from the container and returns its content.
 // An error is returned, if any.
 func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
@@ -183,10 +256,65 @@ func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
 
 // Create creates a new container based on the existing configuration.
 func (d *Docker) Create() (string, error) {
+	if err := d.layers.Materialize(d.config.Image); err != nil {
+		return "", err
+	}
+
+	config := d.config.ToDocker(true, d.tty(), d.stdin)
+
+	security := d.globals.Security
+	if d.security != nil {
+		security = security.Merge(*d.security)
+	}
+
+	opts, err := security.Options()
+	if err != nil {
+		return "", err
+	}
+
+	caps, err := security.Capabilities()
+	if err != nil {
+		return "", err
+	}
+
+	hostConfig := &container.HostConfig{
+		SecurityOpt: opts,
+		NetworkMode: container.NetworkMode(security.Network),
+	}
+
+	// the daemon's default capabilities are left alone unless some are added
+	// or dropped; then every capability is dropped, and those the step has
+	// are added back.
+	if !security.DefaultCapabilities() {
+		hostConfig.CapDrop = []string{"ALL"}
+		hostConfig.CapAdd = caps
+	}
+
+	if d.globals.Scheduler != nil {
+		hostConfig.Memory = d.globals.Scheduler.Memory(d.globals.Weight)
+	}
+
+	if d.mountSecrets() {
+		// the command reads the secrets from stdin into the tmpfs, each the
+		// size of the secret, then runs the command it was given.
+		script := []string{"umask 077"}
+		for _, id := range d.secretIDs() {
+			script = append(script, fmt.Sprintf("dd bs=1 count=%d of=/run/secrets/%s 2>/dev/null", len(d.secrets[id]), id))
+		}
+		script = append(script, `exec "$@"`)
+
+		config.Entrypoint = append([]string{"/bin/sh", "-c", strings.Join(script, " && "), "sh"}, config.Entrypoint...)
+		config.AttachStdin = true
+		config.OpenStdin = true
+		config.StdinOnce = true
+
+		hostConfig.Tmpfs = map[string]string{"/run/secrets": "mode=1777"}
+	}
+
 	cont, err := d.client.ContainerCreate(
 		d.globals.Context,
-		d.config.ToDocker(true, d.globals.TTY, d.stdin),
-		nil,
+		config,
+		hostConfig,
 		nil,
 		"",
 	)
@@ -12,6 +12,7 @@ import (
 	bt "github.com/box-builder/box/tar"
 	btypes "github.com/box-builder/box/types"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/term"
 
@@ -76,6 +77,83 @@ func (ds *dockerSuite) TestCreate(c *C) {
 	c.Assert(id, Not(Equals), "")
 }
 
+func (ds *dockerSuite) TestCapabilities(c *C) {
+	hostConfig := func(global, step *btypes.Security) *container.HostConfig {
+		globals := &btypes.Global{
+			Context: context.Background(),
+			Logger:  logger.New("", false),
+			TTY:     ds.tty,
+		}
+		if global != nil {
+			globals.Security = *global
+		}
+
+		d, err := NewDocker(globals)
+		c.Assert(err, IsNil)
+		_, err = d.Layers().Fetch(d.config, "debian:latest")
+		c.Assert(err, IsNil)
+		d.SetSecurity(step)
+
+		id, err := d.Create()
+		c.Assert(err, IsNil)
+		defer d.Destroy(id)
+
+		inspect, err := dockerClient.ContainerInspect(context.Background(), id)
+		c.Assert(err, IsNil)
+		return inspect.HostConfig
+	}
+
+	// the daemon's defaults are left alone.
+	hc := hostConfig(nil, nil)
+	c.Assert(hc.CapAdd, HasLen, 0)
+	c.Assert(hc.CapDrop, HasLen, 0)
+
+	hc = hostConfig(&btypes.Security{CapAdd: []string{"NET_ADMIN"}}, nil)
+	c.Assert([]string(hc.CapDrop), DeepEquals, []string{"ALL"})
+	c.Assert(strings.Join(hc.CapAdd, ","), Matches, ".*CHOWN.*NET_ADMIN.*")
+
+	hc = hostConfig(&btypes.Security{CapDrop: []string{"ALL"}, CapAdd: []string{"chown"}}, nil)
+	c.Assert([]string(hc.CapDrop), DeepEquals, []string{"ALL"})
+	c.Assert([]string(hc.CapAdd), DeepEquals, []string{"CHOWN"})
+
+	// a step's cap_drop drops what the build adds, then its cap_add adds.
+	hc = hostConfig(&btypes.Security{CapAdd: []string{"NET_ADMIN"}}, &btypes.Security{CapDrop: []string{"ALL"}, CapAdd: []string{"CAP_SETUID"}})
+	c.Assert([]string(hc.CapDrop), DeepEquals, []string{"ALL"})
+	c.Assert([]string(hc.CapAdd), DeepEquals, []string{"SETUID"})
+
+	hc = hostConfig(nil, &btypes.Security{CapDrop: []string{"NET_RAW"}})
+	c.Assert([]string(hc.CapDrop), DeepEquals, []string{"ALL"})
+	c.Assert(strings.Join(hc.CapAdd, ","), Not(Matches), ".*NET_RAW.*")
+	c.Assert(strings.Join(hc.CapAdd, ","), Matches, ".*CHOWN.*")
+}
+
+func (ds *dockerSuite) TestCheckPlatform(c *C) {
+	info, err := dockerClient.Info(context.Background())
+	c.Assert(err, IsNil)
+
+	c.Assert(checkPlatform(context.Background(), dockerClient, info.OSType+"/"+info.Architecture), IsNil)
+	c.Assert(checkPlatform(context.Background(), dockerClient, "plan9/"+info.Architecture), NotNil)
+	c.Assert(checkPlatform(context.Background(), dockerClient, "linux"), NotNil)
+
+	_, err = NewDocker(&btypes.Global{
+		Context:  context.Background(),
+		Logger:   logger.New("", false),
+		Platform: "linux/",
+	})
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestStorageNotice(c *C) {
+	for _, driver := range []string{"overlay2", "btrfs", "zfs"} {
+		c.Assert(storageNotice(driver, "/var/lib/docker", ""), Equals, "")
+	}
+
+	c.Assert(storageNotice("vfs", "/var/lib/docker", ""), Matches, "(?s).*vfs driver.*overlay2 driver.*")
+	c.Assert(storageNotice("vfs", "/var/lib/docker", "ext4"), Matches, "(?s).*vfs driver.*overlay2 driver.*")
+	c.Assert(storageNotice("vfs", "/var/lib/docker", "btrfs"), Matches, "(?s).*/var/lib/docker is on btrfs: with the btrfs driver.*")
+	c.Assert(storageNotice("vfs", "/var/lib/docker", "zfs"), Matches, "(?s).*/var/lib/docker is on zfs: with the zfs driver.*")
+}
+
 func (ds *dockerSuite) TestCopy(c *C) {
 	d, err := NewDocker(&btypes.Global{
 		Context: context.Background(),
@@ -88,7 +166,7 @@ func (ds *dockerSuite) TestCopy(c *C) {
 	_, err = d.Layers().Fetch(d.config, "debian:latest")
 	c.Assert(err, IsNil)
 
-	file, _, err := bt.Archive(context.Background(), ".", ".", []string{}, d.globals.Logger)
+	file, _, err := bt.Archive(context.Background(), ".", ".", []string{}, nil, d.globals.Logger)
 	c.Assert(err, IsNil)
 
 	f, err := os.Open(file)
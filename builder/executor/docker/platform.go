@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/box-builder/box/registry"
+	"github.com/docker/docker/client"
+)
+
+// binfmtDir is where the kernel lists the interpreters registered for the
+// binaries of other architectures.
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArch is the name qemu-user-static registers its interpreters under for
+// the architectures which differ from the image names.
+var qemuArch = map[string]string{
+	"amd64":    "x86_64",
+	"arm64":    "aarch64",
+	"386":      "i386",
+	"mips64le": "mips64el",
+}
+
+// checkPlatform checks the docker host can run the steps of images for the
+// platform: it must be the host's own, or the host must be able to emulate it
+// with qemu-user-static registered in binfmt_misc. The registration is only
+// checked for a docker host on this machine.
+func checkPlatform(ctx context.Context, client *client.Client, platform string) error {
+	p, err := registry.ParsePlatform(platform)
+	if err != nil {
+		return err
+	}
+
+	info, err := client.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	if p.OS != info.OSType {
+		return fmt.Errorf("cannot build for %s on a %s docker host", p, info.OSType)
+	}
+
+	if p.Architecture == registry.NormalizeArch(info.Architecture) {
+		return nil
+	}
+
+	if host := os.Getenv("DOCKER_HOST"); host != "" && !strings.HasPrefix(host, "unix://") {
+		return nil
+	}
+
+	arch := p.Architecture
+	if name, ok := qemuArch[arch]; ok {
+		arch = name
+	}
+
+	if _, err := os.Stat(filepath.Join(binfmtDir, "qemu-"+arch)); err != nil {
+		return fmt.Errorf("cannot run the steps for %s on this %s docker host: qemu-user-static is not registered for %s. To register it, run: docker run --rm --privileged multiarch/qemu-user-static --reset -p yes", p, registry.NormalizeArch(info.Architecture), arch)
+	}
+
+	return nil
+}
@@ -3,10 +3,13 @@ package docker
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/pkg/stdcopy"
@@ -26,6 +29,23 @@ func (d *Docker) stdinCopy(conn net.Conn, errChan chan error, stopChan chan stru
 	}
 }
 
+// writeSecrets writes the secrets to the stdin of the container, in the order
+// its command reads them, and closes it.
+func (d *Docker) writeSecrets(resp types.HijackedResponse, errChan chan error, stopChan chan struct{}) {
+	for _, id := range d.secretIDs() {
+		if _, err := resp.Conn.Write(d.secrets[id]); err != nil {
+			select {
+			case <-stopChan:
+			case errChan <- fmt.Errorf("Could not write secret %s to container: %v", id, err):
+			default:
+			}
+			return
+		}
+	}
+
+	resp.CloseWrite()
+}
+
 func (d *Docker) handleRunError(ctx context.Context, id string, errChan chan error) {
 	select {
 	case <-ctx.Done():
@@ -43,21 +63,38 @@ func (d *Docker) handleRunError(ctx context.Context, id string, errChan chan err
 
 // RunHook is the run hook for docker agents.
 func (d *Docker) RunHook(ctx context.Context, id string) (string, error) {
+	if d.globals.Scheduler != nil {
+		release, err := d.globals.Scheduler.Acquire(ctx, d.globals.Weight, d.globals.Priority)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+
 	stopChan := make(chan struct{})
 	errChan := make(chan error, 1)
 	defer close(errChan)
 
 	go d.handleRunError(ctx, id, errChan)
 
-	cearesp, err := d.client.ContainerAttach(ctx, id, types.ContainerAttachOptions{Stream: true, Stdin: d.stdin, Stdout: true, Stderr: true})
+	cearesp, err := d.client.ContainerAttach(ctx, id, types.ContainerAttachOptions{Stream: true, Stdin: d.stdin || d.mountSecrets(), Stdout: true, Stderr: true})
 	if err != nil {
 		return "", fmt.Errorf("Could not attach to container: %v", err)
 	}
 
-	go d.stdinCopy(cearesp.Conn, errChan, stopChan)
+	if d.mountSecrets() {
+		go d.writeSecrets(cearesp, errChan, stopChan)
+	} else {
+		go d.stdinCopy(cearesp.Conn, errChan, stopChan)
+	}
 
 	defer cearesp.Close()
 
+	if d.globals.Timing != nil {
+		stop := d.sampleCPU(ctx, id)
+		defer func() { d.cpu += stop() }()
+	}
+
 	stat, err := d.startAndWait(ctx, id, cearesp.Reader, errChan, stopChan)
 	if err != nil {
 		return "", err
@@ -70,6 +107,45 @@ func (d *Docker) RunHook(ctx context.Context, id string) (string, error) {
 	return "", nil
 }
 
+// sampleCPU follows the CPU time the container uses, which docker samples
+// about once a second. It returns a function which stops following it, and
+// returns the CPU time of the last sample: the container's process is gone
+// once it exits, with the CPU time it used.
+func (d *Docker) sampleCPU(ctx context.Context, id string) func() time.Duration {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	var used uint64
+
+	go func() {
+		defer close(done)
+
+		resp, err := d.client.ContainerStats(ctx, id, true)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			stats := types.StatsJSON{}
+			if err := dec.Decode(&stats); err != nil {
+				return
+			}
+
+			if usage := stats.CPUStats.CPUUsage.TotalUsage; usage > 0 {
+				atomic.StoreUint64(&used, usage)
+			}
+		}
+	}()
+
+	return func() time.Duration {
+		cancel()
+		<-done
+		return time.Duration(atomic.LoadUint64(&used))
+	}
+}
+
 func doCopy(wtr io.Writer, rdr io.Reader, errChan chan error, stopChan chan struct{}) {
 	// repeat copy until error is returned. if error is not io.EOF, forward
 	// to channel. Return on any error.
@@ -104,7 +180,8 @@ func (d *Docker) startAndWait(ctx context.Context, id string, reader io.Reader,
 		return -1, fmt.Errorf("Could not start container: %v", err)
 	}
 
-	var writer io.Writer = os.Stdout
+	// the output of the command is redacted, as the log is.
+	var writer io.Writer = d.globals.Logger.RedactWriter(os.Stdout)
 
 	if !d.stdin && d.globals.ShowRun {
 		d.globals.Logger.BeginOutput()
@@ -115,7 +192,7 @@ func (d *Docker) startAndWait(ctx context.Context, id string, reader io.Reader,
 		writer = bytes.NewBuffer([]byte{})
 	}
 
-	if !d.globals.TTY {
+	if !d.tty() {
 		go func() {
 			// docker mux's the streams, and requires this stdcopy library to unpack them.
 			_, err = stdcopy.StdCopy(writer, writer, reader)
@@ -134,7 +211,7 @@ func (d *Docker) startAndWait(ctx context.Context, id string, reader io.Reader,
 	stat, err := d.client.ContainerWait(ctx, id)
 	if err != nil {
 		if wbuf, ok := writer.(*bytes.Buffer); ok {
-			fmt.Print(wbuf)
+			fmt.Print(d.globals.Logger.Redact(wbuf.String()))
 		}
 		return -1, err
 	}
@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/client"
+)
+
+// copyingDrivers are the storage drivers of docker which copy the whole
+// filesystem of an image to make a container of it, instead of stacking a
+// snapshot for its changes on the layers of the image.
+var copyingDrivers = map[string]bool{
+	"vfs": true,
+}
+
+// snapshotDrivers are the storage drivers of docker which commit layers and
+// make containers as copy-on-write snapshots of the filesystem they are on,
+// by that filesystem.
+var snapshotDrivers = map[string]string{
+	"btrfs": "https://docs.docker.com/storage/storagedriver/btrfs-driver/",
+	"zfs":   "https://docs.docker.com/storage/storagedriver/zfs-driver/",
+}
+
+// checkStorage warns if the docker host makes the containers of steps by
+// copying the filesystem of their image. The time to start each step then
+// grows with the size of the image, not with what the steps before changed.
+// It is checked for each build, whose log gets the warning.
+func checkStorage(ctx context.Context, client *client.Client, log *logger.Logger) {
+	info, err := client.Info(ctx)
+	if err != nil {
+		return
+	}
+
+	fs := ""
+	if host := os.Getenv("DOCKER_HOST"); host == "" || strings.HasPrefix(host, "unix://") {
+		fs = util.Filesystem(info.DockerRootDir)
+	}
+
+	if notice := storageNotice(info.Driver, info.DockerRootDir, fs); notice != "" {
+		log.Print(log.Notice(notice))
+	}
+}
+
+// storageNotice returns the warning for the storage driver of docker, which
+// keeps its images in root, on the filesystem fs if it is known: nothing if
+// the driver makes snapshots. If the filesystem has a snapshot driver of its
+// own, it is suggested, and overlay2 otherwise.
+func storageNotice(driver, root, fs string) string {
+	if !copyingDrivers[driver] {
+		return ""
+	}
+
+	suggestion := "With the overlay2 driver, the time to start a step grows with the changes of the steps before it instead; see https://docs.docker.com/storage/storagedriver/select-storage-driver/"
+	if snapshotDrivers[fs] != "" {
+		suggestion = fmt.Sprintf("%s is on %s: with the %s driver, steps are committed and started as snapshots instead; see %s", root, fs, fs, snapshotDrivers[fs])
+	}
+
+	return fmt.Sprintf("The docker host stores images with the %s driver, which copies the whole image for each step. %s\n", driver, suggestion)
+}
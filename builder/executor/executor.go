@@ -3,9 +3,11 @@ package executor
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/types"
 )
 
 // Hook is a hook used in commit calls
@@ -48,6 +50,19 @@ type Executor interface {
 	// facilitate debugging.
 	SetStdin(bool)
 
+	// SetSecrets sets the secrets, by ID, which run invocations read from
+	// /run/secrets. They are kept in memory, and are not in the image.
+	SetSecrets(map[string][]byte)
+
+	// SetSecurity sets how the containers of a run step are confined, over
+	// the security of the build. nil returns to the security of the build.
+	SetSecurity(*types.Security)
+
+	// Usage returns the CPU time the containers of run invocations used, and
+	// the bytes committed to layers, since it was last called. They are only
+	// kept when the build records its timing.
+	Usage() (time.Duration, int64)
+
 	// Layers returns the layer handler for this executor.
 	Layers() layers.Layers
 
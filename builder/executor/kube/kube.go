@@ -0,0 +1,565 @@
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/builder/executor/runc"
+	"github.com/box-builder/box/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// podMounts are the files of the step containers of pods which are mounts,
+// or are not in the tarballs of their root filesystems.
+var podMounts = []string{
+	"/proc", "/sys", "/dev", "/.box",
+	"/etc/hosts", "/etc/hostname", "/etc/resolv.conf",
+}
+
+// exportScript writes the tarball of the root filesystem of the step
+// container to stdout from the export container, through /proc: the shell
+// which ran the step wrote its PID to /.box/pid.
+const exportScript = `read pid < /.box/pid && cd /proc/$pid/root && exec tar -cf - --exclude=./proc --exclude=./sys --exclude=./dev --exclude=./.box .`
+
+// cluster runs the run steps of a runc executor as pods of a kubernetes
+// cluster, through kubectl, in the namespace of its context.
+type cluster struct {
+	globals  *types.Global
+	runc     *runc.Runc
+	path     string
+	registry string
+	pushed   map[string]string // the references the images were pushed to, by ID
+	export   string            // if set, the tarball of the root filesystem of the pod the container ran in
+}
+
+// NewKubernetes makes a runc executor which runs the run steps as pods of a
+// kubernetes cluster, so builds are not bound to the capacity of the host
+// running box. The images are kept in the store as they are by the runc
+// executor; the image of each run step is pushed to the repository of
+// globals.KubeRegistry, the artifacts store the pods pull it from, and the
+// root filesystem of its pod is read back as a tarball to commit its layer.
+// Copies are made on the host. The cluster is used through kubectl, which
+// must be in PATH, in the namespace of its context.
+func NewKubernetes(globals *types.Global) (*runc.Runc, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("the kubernetes executor runs on linux, not %s", runtime.GOOS)
+	}
+
+	if globals.Reproducible {
+		return nil, errors.New("reproducible builds need docker: they can't be run with the kubernetes executor")
+	}
+
+	if globals.KubeRegistry == "" {
+		return nil, errors.New("the kubernetes executor needs a repository to push the images of the steps to")
+	}
+
+	path, err := exec.LookPath("kubectl")
+	if err != nil {
+		return nil, fmt.Errorf("could not find kubectl: %v", err)
+	}
+
+	k := &cluster{globals: globals, path: path, registry: globals.KubeRegistry, pushed: map[string]string{}}
+
+	out, err := k.output(globals.Context, "auth", "can-i", "create", "pods")
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the kubernetes cluster: %v", err)
+	} else if out != "yes" {
+		return nil, errors.New("pods can't be created in the namespace of the kubernetes cluster of kubectl")
+	}
+
+	r, err := runc.New(globals, k)
+	if err != nil {
+		return nil, err
+	}
+
+	k.runc = r
+	return r, nil
+}
+
+func (k *cluster) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, k.path, args...)
+}
+
+// output runs kubectl with the arguments, and returns what it wrote, trimmed.
+func (k *cluster) output(ctx context.Context, args ...string) (string, error) {
+	cmd := k.command(ctx, args...)
+
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if len(args) > 2 {
+			args = args[:2]
+		}
+		return "", fmt.Errorf("kubectl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pod is the manifest of the pod of a run step, with what box sets of it.
+type pod struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Metadata   podMetadata `json:"metadata"`
+	Spec       podSpec     `json:"spec"`
+}
+
+type podMetadata struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+}
+
+type podSpec struct {
+	RestartPolicy                string             `json:"restartPolicy"`
+	AutomountServiceAccountToken bool               `json:"automountServiceAccountToken"`
+	ShareProcessNamespace        bool               `json:"shareProcessNamespace"`
+	HostNetwork                  bool               `json:"hostNetwork,omitempty"`
+	SecurityContext              podSecurityContext `json:"securityContext"`
+	Containers                   []podContainer     `json:"containers"`
+	Volumes                      []podVolume        `json:"volumes"`
+}
+
+type podSecurityContext struct {
+	SupplementalGroups []int `json:"supplementalGroups,omitempty"`
+}
+
+type podContainer struct {
+	Name            string               `json:"name"`
+	Image           string               `json:"image"`
+	Command         []string             `json:"command"`
+	Env             []podEnv             `json:"env,omitempty"`
+	WorkingDir      string               `json:"workingDir,omitempty"`
+	SecurityContext podContainerSecurity `json:"securityContext"`
+	Resources       *podResources        `json:"resources,omitempty"`
+	VolumeMounts    []podVolumeMount     `json:"volumeMounts"`
+}
+
+type podEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type podContainerSecurity struct {
+	RunAsUser      int                `json:"runAsUser"`
+	RunAsGroup     int                `json:"runAsGroup"`
+	Capabilities   podCapabilities    `json:"capabilities"`
+	SeccompProfile *podSeccompProfile `json:"seccompProfile,omitempty"`
+}
+
+type podCapabilities struct {
+	Drop []string `json:"drop"`
+	Add  []string `json:"add"`
+}
+
+type podSeccompProfile struct {
+	Type string `json:"type"`
+}
+
+type podResources struct {
+	Limits map[string]string `json:"limits"`
+}
+
+type podVolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+type podVolume struct {
+	Name     string   `json:"name"`
+	EmptyDir struct{} `json:"emptyDir"`
+}
+
+// podStatus is what box reads of the status of a pod.
+type podStatus struct {
+	Status struct {
+		Phase             string `json:"phase"`
+		Message           string `json:"message"`
+		ContainerStatuses []struct {
+			Name  string `json:"name"`
+			State struct {
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Running    *struct{} `json:"running"`
+				Terminated *struct{} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// podErrors are the reasons a container waits for which it will not start
+// without the pod being made again.
+var podErrors = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Create leaves the root filesystem of the container to the runc executor,
+// which the user of the step is looked up in, and its layer diffed from.
+func (k *cluster) Create(c *runc.Container) (bool, error) {
+	return false, nil
+}
+
+// Run runs the run step in a pod of the container, and writes the tarball of
+// the root filesystem of its step container to the bundle.
+func (k *cluster) Run(ctx context.Context, c *runc.Container) error {
+	process, err := k.runc.Process()
+	if err != nil {
+		return err
+	}
+
+	if process.Stdin {
+		return errors.New("the steps of the kubernetes executor can't be interactive")
+	}
+
+	if len(process.Secrets) > 0 {
+		return errors.New("secrets can't be passed to the steps of the kubernetes executor")
+	}
+
+	if err := checkSecurity(process.Security); err != nil {
+		return err
+	}
+
+	ref, err := k.pushImage()
+	if err != nil {
+		return err
+	}
+
+	marker := "box-exit-" + c.ID
+
+	content, err := json.Marshal(k.pod(c.ID, ref, marker, process))
+	if err != nil {
+		return err
+	}
+
+	cmd := k.command(ctx, "create", "-f", "-")
+	cmd.Stdin = bytes.NewReader(content)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Could not start container: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	c.Started = true
+	c.Mounts = podMounts
+
+	if err := k.waitRunning(ctx, c.ID); err != nil {
+		return err
+	}
+
+	status, err := k.podOutput(ctx, c.ID, marker)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		return fmt.Errorf("Command exited with status %d for container %q", status, c.ID)
+	}
+
+	return k.exportPod(ctx, c.ID)
+}
+
+// pushImage pushes the current image to the repository of the artifacts
+// store, if it was not yet, and returns the reference of it the pods pull.
+func (k *cluster) pushImage() (string, error) {
+	id := k.runc.Config().Image
+	if id == "" {
+		return "", errors.New("the steps of the kubernetes executor need an image with /bin/sh: this one has no layers")
+	}
+
+	if ref, ok := k.pushed[id]; ok {
+		return ref, nil
+	}
+
+	dgst, err := k.runc.StoreImage().PushArtifact(k.registry + ":box-" + digest.Digest(id).Hex())
+	if err != nil {
+		return "", fmt.Errorf("could not push the image of the step to %s: %v", k.registry, err)
+	}
+
+	ref := k.registry + "@" + dgst
+	k.pushed[id] = ref
+	return ref, nil
+}
+
+// pod returns the pod of the container, which runs the process of the step
+// from the image of ref. Its step container runs the command, writes the
+// marker and its status, and stops, so it is kept for its root filesystem to
+// be read by the export container, which runs as root.
+func (k *cluster) pod(id, ref, marker string, process *runc.Process) *pod {
+	u, caps := process.User, process.Capabilities
+
+	script := fmt.Sprintf(`echo $$ > /.box/pid; "$@"; echo "%s $?"; kill -STOP $$`, marker)
+	command := append([]string{"/bin/sh", "-c", script, "sh"}, process.Args...)
+
+	step := podContainer{
+		Name:       "step",
+		Image:      ref,
+		Command:    kubeEscape(command),
+		WorkingDir: kubeEscape([]string{process.Cwd})[0],
+		SecurityContext: podContainerSecurity{
+			RunAsUser:    u.Uid,
+			RunAsGroup:   u.Gid,
+			Capabilities: podCapabilities{Drop: []string{"ALL"}, Add: caps},
+		},
+		VolumeMounts: []podVolumeMount{{Name: "box", MountPath: "/.box"}},
+	}
+
+	for _, e := range process.Env {
+		step.Env = append(step.Env, newPodEnv(e))
+	}
+
+	if process.Security.Seccomp == types.Unconfined {
+		step.SecurityContext.SeccompProfile = &podSeccompProfile{Type: "Unconfined"}
+	}
+
+	if k.globals.Scheduler != nil {
+		if memory := k.globals.Scheduler.Memory(k.globals.Weight); memory > 0 {
+			step.Resources = &podResources{Limits: map[string]string{"memory": strconv.FormatInt(memory, 10)}}
+		}
+	}
+
+	// the export container reads all the files of the step container, through
+	// its process if it is another user's.
+	exportCaps := append([]string{"DAC_OVERRIDE"}, caps...)
+	if u.Uid != 0 || u.Gid != 0 {
+		exportCaps = append(exportCaps, "SYS_PTRACE")
+	}
+
+	export := podContainer{
+		Name:            "export",
+		Image:           ref,
+		Command:         []string{"/bin/sh", "-c", "kill -STOP $$"},
+		SecurityContext: podContainerSecurity{Capabilities: podCapabilities{Drop: []string{"ALL"}, Add: exportCaps}},
+		VolumeMounts:    []podVolumeMount{{Name: "box", MountPath: "/.box"}},
+	}
+
+	return &pod{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Metadata: podMetadata{
+			Name:   id,
+			Labels: map[string]string{"app.kubernetes.io/managed-by": "box"},
+		},
+		Spec: podSpec{
+			RestartPolicy:         "Never",
+			ShareProcessNamespace: true,
+			HostNetwork:           process.Security.Network == "host",
+			SecurityContext:       podSecurityContext{SupplementalGroups: u.Sgids},
+			Containers:            []podContainer{step, export},
+			Volumes:               []podVolume{{Name: "box"}},
+		},
+	}
+}
+
+// checkSecurity returns an error for the security options of the step which
+// the pods of the kubernetes executor do not support, over those the runc
+// executor does not.
+func checkSecurity(security types.Security) error {
+	if security.AppArmor != "" && security.AppArmor != types.Unconfined {
+		return errors.New("AppArmor profiles need docker: they can't be used in builds run without it")
+	}
+
+	if security.Network == "none" {
+		return errors.New("the steps of the kubernetes executor can't run without a network")
+	}
+
+	return nil
+}
+
+// newPodEnv returns the variable of the container, as KEY=value or KEY.
+func newPodEnv(e string) podEnv {
+	parts := strings.SplitN(e, "=", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+
+	return podEnv{Name: parts[0], Value: kubeEscape(parts[1:])[0]}
+}
+
+// kubeEscape escapes the references to variables kubernetes expands in the
+// commands and environment of containers.
+func kubeEscape(strs []string) []string {
+	escaped := []string{}
+	for _, str := range strs {
+		escaped = append(escaped, strings.Replace(str, "$(", "$$(", -1))
+	}
+
+	return escaped
+}
+
+// waitRunning waits for the step container of the pod to start, and returns
+// an error if it can't.
+func (k *cluster) waitRunning(ctx context.Context, id string) error {
+	for {
+		out, err := k.output(ctx, "get", "pod", id, "-o", "json")
+		if err != nil {
+			return err
+		}
+
+		status := podStatus{}
+		if err := json.Unmarshal([]byte(out), &status); err != nil {
+			return err
+		}
+
+		if status.Status.Phase == "Failed" {
+			return fmt.Errorf("pod %s failed: %s", id, status.Status.Message)
+		}
+
+		for _, cs := range status.Status.ContainerStatuses {
+			if cs.Name != "step" {
+				continue
+			}
+
+			switch {
+			case cs.State.Running != nil, cs.State.Terminated != nil:
+				return nil
+			case cs.State.Waiting != nil && podErrors[cs.State.Waiting.Reason]:
+				return fmt.Errorf("pod %s: %s: %s", id, cs.State.Waiting.Reason, cs.State.Waiting.Message)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// podOutput writes the output of the step container of the pod until the
+// marker, and returns the status of the command written after it.
+func (k *cluster) podOutput(ctx context.Context, id, marker string) (int, error) {
+	writer, done := k.runc.OutputWriter()
+	defer done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := k.command(ctx, "logs", "--follow", "pod/"+id, "--container", "step")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	status, err := copyOutput(writer, stdout, marker)
+
+	// the step container is kept once the command exits, so its log is not
+	// over.
+	cancel()
+	cmd.Wait()
+
+	if err != nil {
+		if wbuf, ok := writer.(*bytes.Buffer); ok {
+			fmt.Print(k.globals.Logger.Redact(wbuf.String()))
+		}
+		return 0, fmt.Errorf("Could not run container %q: %v", id, err)
+	}
+
+	return status, nil
+}
+
+// copyOutput copies the output read from rdr to w until the marker, and
+// returns the status written after it.
+func copyOutput(w io.Writer, rdr io.Reader, marker string) (int, error) {
+	br := bufio.NewReader(rdr)
+
+	for {
+		line, err := br.ReadString('\n')
+
+		if i := strings.Index(line, marker+" "); i >= 0 {
+			if _, err := io.WriteString(w, line[:i]); err != nil {
+				return 0, err
+			}
+
+			return strconv.Atoi(strings.TrimSpace(line[i+len(marker)+1:]))
+		}
+
+		if _, werr := io.WriteString(w, line); werr != nil {
+			return 0, werr
+		}
+
+		if err == io.EOF {
+			return 0, errors.New("the step ended without its status: its image needs /bin/sh")
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// exportPod writes the tarball of the root filesystem of the step container
+// of the pod to the bundle.
+func (k *cluster) exportPod(ctx context.Context, id string) error {
+	fn := filepath.Join(k.runc.Bundle(), "export.tar")
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	k.export = fn
+
+	cmd := k.command(ctx, "exec", id, "--container", "export", "--", "/bin/sh", "-c", exportScript)
+	cmd.Stdout = f
+
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not read the root filesystem of container %q: %v: %s", id, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return f.Close()
+}
+
+// Layer returns the layer tarball of the changes the step made to the root
+// filesystem of the pod of the container, or nil if it was not run.
+func (k *cluster) Layer(c *runc.Container) (io.ReadCloser, error) {
+	if k.export == "" {
+		return nil, nil
+	}
+
+	return k.runc.ExportLayer(k.export)
+}
+
+// Destroy deletes the pod of the container, and the tarball of its root
+// filesystem.
+func (k *cluster) Destroy(c *runc.Container) error {
+	if k.export != "" {
+		os.Remove(k.export)
+		k.export = ""
+	}
+
+	if !c.Started {
+		return nil
+	}
+
+	// XXX do not use the stored context because it may already be canceled when we arrive at this code.
+	if _, err := k.output(context.Background(), "delete", "pod", c.ID, "--now", "--wait=false", "--ignore-not-found"); err != nil {
+		return fmt.Errorf("Could not remove container %q: %v", c.ID, err)
+	}
+
+	return nil
+}
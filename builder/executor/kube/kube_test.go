@@ -0,0 +1,34 @@
+package kube
+
+import (
+	"bytes"
+	"strings"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type kubeSuite struct{}
+
+var _ = Suite(&kubeSuite{})
+
+func TestKube(t *T) {
+	TestingT(t)
+}
+
+func (ks *kubeSuite) TestCopyOutput(c *C) {
+	buf := bytes.NewBuffer(nil)
+	status, err := copyOutput(buf, strings.NewReader("one\ntwobox-exit-box-1 3\nmore\n"), "box-exit-box-1")
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 3)
+	c.Assert(buf.String(), Equals, "one\ntwo")
+
+	buf.Reset()
+	_, err = copyOutput(buf, strings.NewReader("sh: not found\n"), "box-exit-box-1")
+	c.Assert(err, NotNil)
+	c.Assert(buf.String(), Equals, "sh: not found\n")
+}
+
+func (ks *kubeSuite) TestKubeEscape(c *C) {
+	c.Assert(kubeEscape([]string{"echo $(pwd)", "$HOME", ""}), DeepEquals, []string{"echo $$(pwd)", "$HOME", ""})
+}
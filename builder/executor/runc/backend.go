@@ -0,0 +1,190 @@
+package runc
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/types"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Backend runs the run steps of the runc executor in place of its runtime,
+// as the kubernetes executor runs them in pods, and may make the root
+// filesystems of the containers, as the containerd executor makes them of
+// its snapshots. The containers are copied into, and their layers are
+// committed, as they are without one.
+type Backend interface {
+	// Create makes the root filesystem of the container, or returns false
+	// for it to be made as it is without a backend.
+	Create(c *Container) (bool, error)
+	// Run runs the command of the step in the container, as Process
+	// returns it.
+	Run(ctx context.Context, c *Container) error
+	// Layer returns the layer tarball of the changes the step run made to
+	// the container, or nil for the changes made to its root filesystem.
+	Layer(c *Container) (io.ReadCloser, error)
+	// Destroy removes what running the container made. It may not have been
+	// started.
+	Destroy(c *Container) error
+}
+
+// New makes a runc executor whose run steps are run by the backend, in a
+// directory of the box directory removed by Close.
+func New(globals *types.Global, backend Backend) (*Runc, error) {
+	r, err := newRunc(globals, "")
+	if err != nil {
+		return nil, err
+	}
+
+	r.backend = backend
+	return r, nil
+}
+
+// Store returns the store the images are kept in.
+func (r *Runc) Store() *layers.Store {
+	return r.store
+}
+
+// StoreImage returns the image of the store the steps are committed to.
+func (r *Runc) StoreImage() *layers.StoreImage {
+	return r.image
+}
+
+// Rootfs returns the root filesystem the containers run in.
+func (r *Runc) Rootfs() string {
+	return r.rootfs
+}
+
+// Bundle returns the directory of the bundle of the containers, which the
+// backend can keep the files of the container in until it is destroyed.
+func (r *Runc) Bundle() string {
+	return r.dir
+}
+
+// ExportLayer returns the layer tarball of the changes made to the root
+// filesystem of the container, from the tarball of it in the file, which the
+// backend exported of where the step ran.
+func (r *Runc) ExportLayer(fn string) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	c := r.container
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer f.Close()
+		// the owners of the files unpacked by box run without root are not
+		// those in the image.
+		pw.CloseWithError(writeExportLayer(pw, f, c.snapshot, c.Mounts, !r.rootless()))
+	}()
+
+	return pr, nil
+}
+
+// writeExportLayer writes the layer of the changes of the tarball of the root
+// filesystem in f from the snapshot to w. f is read twice: for the changes,
+// and for the files of those added or modified.
+func writeExportLayer(w io.Writer, f io.ReadSeeker, snapshot map[string]fileState, mounts []string, owners bool) error {
+	old := map[string]fileState{}
+	for path, state := range snapshot {
+		old[path] = state.tarred(owners)
+	}
+
+	states, err := tarStates(f, owners)
+	if err != nil {
+		return err
+	}
+
+	changes := diff(old, states, mounts)
+
+	changed := map[string]bool{}
+	tw := tar.NewWriter(w)
+
+	for _, change := range changes {
+		if change.Kind != archive.ChangeDelete {
+			changed[change.Path] = true
+			continue
+		}
+
+		dir, base := filepath.Split(change.Path)
+		if err := tw.WriteHeader(&tar.Header{Name: filepath.Join(dir, archive.WhiteoutPrefix+base)[1:], Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := writeChanged(tw, f, changed); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// tarStates returns the states of the files of the tarball of a root
+// filesystem, by path.
+func tarStates(r io.Reader, owners bool) (map[string]fileState, error) {
+	states := map[string]fileState{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return states, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Clean("/" + hdr.Name)
+		states[path] = tarState(hdr, owners)
+
+		// the files hard linked have the state of the first.
+		if hdr.Typeflag == tar.TypeLink {
+			if state, ok := states[filepath.Clean("/"+hdr.Linkname)]; ok {
+				states[path] = state
+			}
+		}
+	}
+}
+
+// writeChanged writes the files of the tarball of a root filesystem which
+// changed to the layer.
+func writeChanged(tw *tar.Writer, r io.Reader, changed map[string]bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		path := filepath.Clean("/" + hdr.Name)
+		if !changed[path] {
+			continue
+		}
+
+		hdr.Name = path[1:]
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		} else if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = filepath.Clean("/" + hdr.Linkname)[1:]
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package runc
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// btrfs makes the root filesystems of containers as btrfs snapshots. The
+// snapshot of each layer is a subvolume, a snapshot of that of the layer
+// below it with the layer unpacked on top, and the root filesystem of a
+// container is a snapshot of that of the top layer of its image, which is
+// deleted to roll the container back.
+type btrfs struct {
+	walked
+	bin string // the path of the btrfs command
+	dir string // where the subvolumes of the layers are, by snapshotName
+}
+
+func newBtrfs(bin, dir string) *btrfs {
+	return &btrfs{bin: bin, dir: dir}
+}
+
+func (b *btrfs) path(name string) string {
+	return filepath.Join(b.dir, snapshotName(name))
+}
+
+func (b *btrfs) has(name string) bool {
+	_, err := os.Stat(b.path(name))
+	return err == nil
+}
+
+// subvolume makes dir the snapshot of parent, or an empty subvolume.
+func (b *btrfs) subvolume(dir, parent string) error {
+	if parent == "" {
+		_, err := run(b.bin, "subvolume", "create", dir)
+		return err
+	}
+
+	_, err := run(b.bin, "subvolume", "snapshot", b.path(parent), dir)
+	return err
+}
+
+// apply unpacks the layer to a snapshot of the parent, which is renamed once
+// it is, so other builds see all of it or none.
+func (b *btrfs) apply(name, parent, file string) error {
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return err
+	}
+
+	id, err := RandomID("unpack-")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(b.dir, id)
+	if err := b.subvolume(tmp, parent); err != nil {
+		return err
+	}
+
+	err = UnpackLayer(tmp, file, false)
+	if err == nil {
+		err = os.Rename(tmp, b.path(name))
+	}
+
+	if err != nil {
+		run(b.bin, "subvolume", "delete", tmp)
+
+		// another build may have unpacked it first.
+		if b.has(name) {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// mount makes dir a snapshot of the top layer of the chain. It must be
+// empty, and is replaced by the snapshot, on the same filesystem.
+func (b *btrfs) mount(dir string, chain []string) error {
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+
+	parent := ""
+	if len(chain) > 0 {
+		parent = chain[len(chain)-1]
+	}
+
+	if err := b.subvolume(dir, parent); err != nil {
+		os.Mkdir(dir, 0755)
+		return err
+	}
+
+	if err := b.snapshot(dir); err != nil {
+		b.unmount(dir)
+		return err
+	}
+
+	return nil
+}
+
+func (b *btrfs) unmount(dir string) error {
+	if _, err := run(b.bin, "subvolume", "delete", dir); err != nil {
+		return err
+	}
+
+	b.states = nil
+	return os.Mkdir(dir, 0755)
+}
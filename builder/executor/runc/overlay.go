@@ -0,0 +1,215 @@
+package runc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// overlay makes the root filesystems of containers as overlayfs mounts. Each
+// layer is unpacked once, to a directory of its own with the whiteouts of
+// overlayfs; those of the layers of an image are the lower directories of the
+// mount, under an upper directory which gets the changes of the step, and is
+// the layer committed.
+type overlay struct {
+	dir   string   // where the layers are unpacked, by snapshotName
+	lower []string // the lower directories of the overlayfs mounted, the top one first
+}
+
+func newOverlay(dir string) *overlay {
+	return &overlay{dir: dir}
+}
+
+// check mounts an overlayfs in the directory of the layers, to find out if
+// the kernel has it and it can be mounted there: not on an overlayfs, for
+// instance.
+func (o *overlay) check() error {
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(o.dir, "check-")
+	if err != nil {
+		return err
+	}
+	defer removeAll(tmp)
+
+	for _, sub := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(tmp, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	merged := filepath.Join(tmp, "merged")
+	if err := mountOverlay(merged, []string{filepath.Join(tmp, "lower")}, filepath.Join(tmp, "upper"), filepath.Join(tmp, "work")); err != nil {
+		return err
+	}
+
+	return Unmount(merged)
+}
+
+func (o *overlay) path(name string) string {
+	return filepath.Join(o.dir, snapshotName(name))
+}
+
+func (o *overlay) has(name string) bool {
+	_, err := os.Stat(o.path(name))
+	return err == nil
+}
+
+// apply unpacks the layer to a directory, converting its whiteouts to those
+// of overlayfs; the layers below it are not needed. The layer is unpacked to
+// a temporary directory renamed once it is, so other builds see all of it or
+// none.
+func (o *overlay) apply(name, _, file string) error {
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(o.dir, "unpack-")
+	if err != nil {
+		return err
+	}
+
+	// the top directory of the layers is the root of the root filesystem,
+	// if the layer has no entry of its own for it.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		removeAll(tmp)
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		removeAll(tmp)
+		return err
+	}
+	defer f.Close()
+
+	if err := archive.Unpack(checkTar(tmp, f, false), tmp, &archive.TarOptions{WhiteoutFormat: archive.OverlayWhiteoutFormat}); err != nil {
+		removeAll(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, o.path(name)); err != nil {
+		removeAll(tmp)
+
+		// another build may have unpacked it first.
+		if o.has(name) {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// upperDir and workDir are the upper and work directories of the overlayfs mounted
+// on dir, next to it.
+func upperDir(dir string) string { return filepath.Join(filepath.Dir(dir), "upper") }
+func workDir(dir string) string  { return filepath.Join(filepath.Dir(dir), "work") }
+
+func (o *overlay) mount(dir string, chain []string) error {
+	lower := []string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		lower = append(lower, o.path(chain[i]))
+	}
+
+	if len(lower) == 0 {
+		// overlayfs needs a lower directory, even if it is empty.
+		empty := filepath.Join(o.dir, "empty")
+		if err := os.MkdirAll(empty, 0755); err != nil {
+			return err
+		}
+
+		lower = append(lower, empty)
+	}
+
+	for _, sub := range []string{upperDir(dir), workDir(dir)} {
+		if err := os.Mkdir(sub, 0700); err != nil {
+			return err
+		}
+	}
+
+	if err := mountOverlay(dir, lower, upperDir(dir), workDir(dir)); err != nil {
+		removeAll(upperDir(dir))
+		removeAll(workDir(dir))
+		return err
+	}
+
+	o.lower = lower
+	return nil
+}
+
+// diff tars the upper directory, converting the whiteouts of overlayfs to
+// those of layers. The container has exited, so it is not written to. The
+// directories made for mounts which the image does not have are not changes.
+func (o *overlay) diff(dir string, mounts []string) (io.ReadCloser, error) {
+	rc, err := archive.TarWithOptions(upperDir(dir), &archive.TarOptions{WhiteoutFormat: archive.OverlayWhiteoutFormat})
+	if err != nil {
+		return nil, err
+	}
+
+	keep := func(path string) bool {
+		if inMount(path, mounts) {
+			return false
+		}
+
+		return !madeForMount(path, mounts) || o.inLower(path)
+	}
+
+	return &layerReader{Reader: filterTar(rc, keep), Closer: rc}, nil
+}
+
+// inLower is true if one of the layers mounted has the path.
+func (o *overlay) inLower(path string) bool {
+	for _, dir := range o.lower {
+		if _, err := os.Lstat(filepath.Join(dir, path)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *overlay) unmount(dir string) error {
+	if err := Unmount(dir); err != nil {
+		return err
+	}
+	o.lower = nil
+
+	if err := removeAll(upperDir(dir)); err != nil {
+		return err
+	}
+
+	return removeAll(workDir(dir))
+}
+
+// layerReader reads a layer tarball made of another, closing that one as it
+// is closed.
+type layerReader struct {
+	io.Reader
+	io.Closer
+}
+
+// mountOverlay mounts an overlayfs of the lower directories, the top one
+// first, on dir.
+func mountOverlay(dir string, lower []string, upper, work string) error {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lower, ":"), upper, work)
+	if len(options) >= os.Getpagesize() {
+		return errors.New("the image has too many layers to be mounted with overlayfs")
+	}
+
+	if out, err := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not mount overlayfs on %s: %v: %s", dir, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,414 @@
+package runc
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// maxLinks is the number of symlinks followed resolving a path before it is
+// given up on, as linux does.
+const maxLinks = 40
+
+// prepare makes the root filesystem that of the current image, unpacking
+// the layers it does not have yet.
+func (r *Runc) prepare() error {
+	image := r.config.Image
+	if r.unpacked && r.rootfsImage == image {
+		return nil
+	}
+
+	files := []string{}
+	if image != "" {
+		var err error
+		if files, err = r.store.LayerFiles(image); err != nil {
+			return err
+		}
+	}
+
+	// an image committed on top of the one unpacked, such as one found in
+	// the cache, only needs its own layers unpacked.
+	unpacked := []string{}
+	if r.unpacked && r.rootfsImage != "" {
+		var err error
+		if unpacked, err = r.store.LayerFiles(r.rootfsImage); err != nil {
+			return err
+		}
+	}
+
+	if !r.unpacked || !hasPrefix(files, unpacked) {
+		if err := removeAll(r.rootfs); err != nil {
+			return err
+		}
+
+		if err := os.Mkdir(r.rootfs, 0755); err != nil {
+			return err
+		}
+
+		unpacked = []string{}
+	}
+
+	r.unpacked = false
+
+	for _, file := range files[len(unpacked):] {
+		if err := r.unpack(file); err != nil {
+			return err
+		}
+	}
+
+	r.rootfsImage = image
+	r.unpacked = true
+
+	return nil
+}
+
+// hasPrefix is true if the layers start with those of prefix.
+func hasPrefix(layers, prefix []string) bool {
+	if len(prefix) > len(layers) {
+		return false
+	}
+
+	for i := range prefix {
+		if layers[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unpack applies the layer in the file to the root filesystem.
+func (r *Runc) unpack(file string) error {
+	return UnpackLayer(r.rootfs, file, r.rootless())
+}
+
+// UnpackLayer applies the layer in the file to the directory, as root of the
+// user namespace box is in if rootless is set.
+func UnpackLayer(dir, file string, rootless bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = archive.UnpackLayer(dir, checkTar(dir, f, false), &archive.TarOptions{
+		NoLchown: rootless,
+		InUserNS: rootless,
+	})
+
+	return err
+}
+
+// removeAll removes the directory and everything in it, making the
+// directories in it writable first so the files in those which are not can
+// be removed by users other than root.
+func removeAll(dir string) error {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && fi.Mode().Perm()&0700 != 0700 {
+			os.Chmod(path, fi.Mode().Perm()|0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(dir)
+}
+
+// checkTar returns the tarball read from rdr, checked as it is read: the
+// files in it, and the targets of its hard links, must not be in directories
+// which are symlinks, so they are not written outside of the root filesystem
+// through one. If follow is set, the symlinks on disk are followed within the
+// root filesystem instead, as they are by docker copying into a container.
+func checkTar(root string, rdr io.Reader, follow bool) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(copyChecked(root, tar.NewReader(rdr), tar.NewWriter(pw), follow))
+	}()
+
+	return pr
+}
+
+func copyChecked(root string, tr *tar.Reader, tw *tar.Writer, follow bool) error {
+	// whether the files of the tarball are symlinks: the symlinks and files
+	// it has are not on disk yet as they are checked.
+	seen := map[string]bool{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		} else if err != nil {
+			return err
+		}
+
+		name, err := checkPath(root, hdr.Name, seen, follow)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			if hdr.Linkname, err = checkPath(root, hdr.Linkname, seen, follow); err != nil {
+				return err
+			}
+		}
+
+		base := filepath.Base(name)
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			seen[filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, archive.WhiteoutPrefix))] = false
+		default:
+			seen[name] = hdr.Typeflag == tar.TypeSymlink
+		}
+
+		if name != "/" {
+			hdr.Name = name[1:]
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkPath returns the path of the file of a tarball in the root
+// filesystem, or an error if a directory it is in is a symlink. If follow is
+// set, those on disk are resolved within the root filesystem instead.
+func checkPath(root, name string, seen map[string]bool, follow bool) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return name, nil
+	}
+
+	dirs := []string{}
+	for dir := filepath.Dir(name); dir != "/"; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	for _, dir := range dirs {
+		link, ok := seen[dir]
+		if !ok {
+			if follow {
+				continue
+			}
+
+			fi, err := os.Lstat(filepath.Join(root, dir))
+			if os.IsNotExist(err) {
+				break
+			} else if err != nil {
+				return "", err
+			}
+
+			link = fi.Mode()&os.ModeSymlink != 0
+		}
+
+		if link {
+			return "", fmt.Errorf("%s is in %s, which is a symlink", name, dir)
+		}
+	}
+
+	if !follow {
+		return name, nil
+	}
+
+	dir, err := resolve(root, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join("/", dir[len(root):], filepath.Base(name)), nil
+}
+
+// resolve returns the file of the path in the root filesystem, with the
+// symlinks in it followed as if root was /.
+func resolve(root, path string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(filepath.Clean("/"+path), "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s", path)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// walk returns the state of each file in the root filesystem, by its path in
+// it.
+func walk(root string) (map[string]fileState, error) {
+	states := map[string]fileState{}
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		states[filepath.Join("/", path[len(root):])] = stateOf(fi)
+		return nil
+	})
+
+	return states, err
+}
+
+// changes returns the changes made to the root filesystem of the container.
+func (r *Runc) changes() ([]archive.Change, error) {
+	states, err := walk(r.rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff(r.container.snapshot, states, r.container.Mounts), nil
+}
+
+// diff returns the changes between the states of the files, sorted by path.
+// The files which are mounts, or in them, and the directories made for them
+// are not changes of the image.
+func diff(old, new map[string]fileState, mounts []string) []archive.Change {
+	changes := []archive.Change{}
+
+	for path, state := range new {
+		if path == "/" || inMount(path, mounts) {
+			continue
+		}
+
+		prev, ok := old[path]
+		switch {
+		case !ok && !madeForMount(path, mounts):
+			changes = append(changes, archive.Change{Path: path, Kind: archive.ChangeAdd})
+		case ok && prev != state:
+			changes = append(changes, archive.Change{Path: path, Kind: archive.ChangeModify})
+		}
+	}
+
+	for path := range old {
+		// the files hidden by mounts are not removed.
+		if _, ok := new[path]; ok || inMount(path, mounts) {
+			continue
+		}
+
+		// the files in a directory removed are removed with it.
+		if _, ok := new[filepath.Dir(path)]; !ok {
+			continue
+		}
+
+		changes = append(changes, archive.Change{Path: path, Kind: archive.ChangeDelete})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	return changes
+}
+
+func inMount(path string, mounts []string) bool {
+	for _, mount := range mounts {
+		if path == mount || strings.HasPrefix(path, mount+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func madeForMount(path string, mounts []string) bool {
+	for _, mount := range mounts {
+		if strings.HasPrefix(mount, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithoutMounts returns the tarball read from rdr without the files which are
+// mounts, or in them. All of rdr is read.
+func WithoutMounts(rdr io.Reader, mounts []string) io.Reader {
+	return filterTar(rdr, func(path string) bool { return !inMount(path, mounts) })
+}
+
+// filterTar returns the tarball read from rdr with the files keep is true of,
+// by their path from /. All of rdr is read.
+func filterTar(rdr io.Reader, keep func(path string) bool) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tr := tar.NewReader(rdr)
+		tw := tar.NewWriter(pw)
+
+		err := func() error {
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return tw.Close()
+				} else if err != nil {
+					return err
+				}
+
+				if !keep(filepath.Clean("/" + hdr.Name)) {
+					continue
+				}
+
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+		}()
+
+		// the padding after the end of the tarball is read, so what writes
+		// it is not left waiting.
+		io.Copy(ioutil.Discard, rdr)
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
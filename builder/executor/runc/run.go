@@ -0,0 +1,489 @@
+package runc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/box-builder/box/types"
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+// defaultPath is the PATH of the commands run, if the image sets none.
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// hosts is the /etc/hosts of the containers.
+const hosts = `127.0.0.1	localhost box
+::1	localhost ip6-localhost ip6-loopback
+`
+
+// maskedPaths and readonlyPaths are the files in /proc and /sys hidden from
+// the containers, and those they can't write, as in docker.
+var (
+	maskedPaths = []string{
+		"/proc/asound", "/proc/acpi", "/proc/kcore", "/proc/keys",
+		"/proc/latency_stats", "/proc/timer_list", "/proc/timer_stats",
+		"/proc/sched_debug", "/proc/scsi", "/sys/firmware",
+	}
+
+	readonlyPaths = []string{
+		"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+	}
+)
+
+// spec is the config.json of an OCI runtime bundle, with what the containers
+// of run steps set of it.
+type spec struct {
+	OCIVersion string      `json:"ociVersion"`
+	Process    specProcess `json:"process"`
+	Root       specRoot    `json:"root"`
+	Hostname   string      `json:"hostname"`
+	Mounts     []specMount `json:"mounts"`
+	Linux      specLinux   `json:"linux"`
+}
+
+type specProcess struct {
+	Terminal        bool             `json:"terminal"`
+	User            specUser         `json:"user"`
+	Args            []string         `json:"args"`
+	Env             []string         `json:"env"`
+	Cwd             string           `json:"cwd"`
+	Capabilities    specCapabilities `json:"capabilities"`
+	Rlimits         []specRlimit     `json:"rlimits"`
+	ApparmorProfile string           `json:"apparmorProfile,omitempty"`
+}
+
+type specUser struct {
+	UID            int   `json:"uid"`
+	GID            int   `json:"gid"`
+	AdditionalGids []int `json:"additionalGids,omitempty"`
+}
+
+type specCapabilities struct {
+	Bounding  []string `json:"bounding"`
+	Effective []string `json:"effective"`
+	Permitted []string `json:"permitted"`
+}
+
+type specRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type specRoot struct {
+	Path string `json:"path"`
+}
+
+type specMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type specLinux struct {
+	UIDMappings   []specIDMapping `json:"uidMappings,omitempty"`
+	GIDMappings   []specIDMapping `json:"gidMappings,omitempty"`
+	Namespaces    []specNamespace `json:"namespaces"`
+	Resources     *specResources  `json:"resources,omitempty"`
+	MaskedPaths   []string        `json:"maskedPaths"`
+	ReadonlyPaths []string        `json:"readonlyPaths"`
+}
+
+type specIDMapping struct {
+	ContainerID int `json:"containerID"`
+	HostID      int `json:"hostID"`
+	Size        int `json:"size"`
+}
+
+type specNamespace struct {
+	Type string `json:"type"`
+}
+
+type specResources struct {
+	Memory struct {
+		Limit int64 `json:"limit"`
+	} `json:"memory"`
+}
+
+// RunHook is the run hook for runc agents.
+func (r *Runc) RunHook(ctx context.Context, id string) (string, error) {
+	if err := r.checkContainer(id); err != nil {
+		return "", err
+	}
+
+	if r.globals.Scheduler != nil {
+		release, err := r.globals.Scheduler.Acquire(ctx, r.globals.Weight, r.globals.Priority)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+
+	if r.backend != nil {
+		return "", r.backend.Run(ctx, r.container)
+	}
+
+	var cmd *exec.Cmd
+	err := r.RunBundle(ctx, r.container, func(bundle string, tty bool) *exec.Cmd {
+		cmd = exec.CommandContext(ctx, r.runtime, "--root", r.stateDir(), "run", "--bundle", bundle, id)
+		return cmd
+	})
+
+	if r.globals.Timing != nil && cmd != nil && cmd.ProcessState != nil {
+		// the runtime waits for the process of the container, so the CPU
+		// time it used is the runtime's.
+		r.cpu += cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+
+	return "", err
+}
+
+// RunBundle runs the step in the container with the command of the bundle
+// written for it, as the runtime runs it, or as a backend which runs OCI
+// bundles does: containerd's tasks are, but the CPU time they use is not
+// known, as their shim waits for them.
+func (r *Runc) RunBundle(ctx context.Context, c *Container, command func(bundle string, tty bool) *exec.Cmd) error {
+	s, err := r.spec()
+	if err != nil {
+		return err
+	}
+
+	if len(r.secrets) > 0 {
+		secrets, err := r.writeSecrets(s.Process.User)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(secrets)
+
+		s.Mounts = append(s.Mounts, specMount{Destination: "/run/secrets", Type: "bind", Source: secrets, Options: []string{"rbind", "ro"}})
+	}
+
+	if err := r.writeBundle(s); err != nil {
+		return err
+	}
+
+	writer, done := r.OutputWriter()
+	defer done()
+
+	cmd := command(r.dir, s.Process.Terminal)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if r.stdin {
+		cmd.Stdin = os.Stdin
+	}
+
+	c.Started = true
+	c.changed = true
+
+	return r.runError(ctx, c.ID, cmd.Run(), writer)
+}
+
+// writeBundle writes the configuration of the container to its bundle, and
+// records the mounts it has.
+func (r *Runc) writeBundle(s *spec) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "config.json"), content, 0600); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "hosts"), []byte(hosts), 0644); err != nil {
+		return err
+	}
+
+	for _, mount := range s.Mounts {
+		r.container.Mounts = append(r.container.Mounts, mount.Destination)
+	}
+
+	return nil
+}
+
+// runError returns the error of the command of the container, which wrote to
+// writer. The output of a command which could not start is shown, if it was
+// kept.
+func (r *Runc) runError(ctx context.Context, id string, err error, writer io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return fmt.Errorf("Command exited with status %d for container %q", exitErr.ExitCode(), id)
+	} else if err != nil {
+		if wbuf, ok := writer.(*bytes.Buffer); ok {
+			fmt.Print(r.globals.Logger.Redact(wbuf.String()))
+		}
+		return fmt.Errorf("Could not start container: %v", err)
+	}
+
+	return nil
+}
+
+// OutputWriter returns the writer of the output of the command of a run
+// step, and what to call once it has exited. The output is redacted, as the
+// log is, and kept in a buffer if it is not shown.
+func (r *Runc) OutputWriter() (io.Writer, func()) {
+	if !r.globals.ShowRun {
+		return bytes.NewBuffer([]byte{}), func() {}
+	}
+
+	if r.stdin {
+		return r.globals.Logger.RedactWriter(os.Stdout), func() {}
+	}
+
+	r.globals.Logger.BeginOutput()
+	return r.globals.Logger.RedactWriter(os.Stdout), r.globals.Logger.EndOutput
+}
+
+// writeSecrets writes the secrets to a directory in /dev/shm, which is in
+// memory, and returns it. They are the user's the command runs as, as they
+// are in docker.
+func (r *Runc) writeSecrets(u specUser) (string, error) {
+	dir, err := ioutil.TempDir("/dev/shm", "box-secrets-")
+	if err != nil {
+		return "", fmt.Errorf("Could not write secrets: %v", err)
+	}
+
+	files := []string{dir}
+	for id, content := range r.secrets {
+		fn := filepath.Join(dir, id)
+		if err := ioutil.WriteFile(fn, content, 0400); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("Could not write secret %s: %v", id, err)
+		}
+		files = append(files, fn)
+	}
+
+	if !r.rootless() {
+		for _, fn := range files {
+			if err := os.Chown(fn, u.UID, u.GID); err != nil {
+				os.RemoveAll(dir)
+				return "", fmt.Errorf("Could not write secrets: %v", err)
+			}
+		}
+	}
+
+	return dir, nil
+}
+
+// Process is the process of the command of a run step, as the image and the
+// step configure it.
+type Process struct {
+	User         *user.ExecUser
+	Args         []string
+	Env          []string
+	Cwd          string
+	Terminal     bool
+	Stdin        bool
+	Secrets      map[string][]byte // the secrets it reads from /run/secrets, by ID
+	Security     types.Security    // the security of the step, over that of the build
+	Capabilities []string          // the capabilities it has, without CAP_
+}
+
+// Process returns the process of the command of the run step in the root
+// filesystem of the container. An error is returned for the security it
+// can't be confined with without docker.
+func (r *Runc) Process() (*Process, error) {
+	security := r.globals.Security
+	if r.security != nil {
+		security = security.Merge(*r.security)
+	}
+
+	if err := checkSecurity(security); err != nil {
+		return nil, err
+	}
+
+	caps, err := security.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+
+	config := r.config.ToDocker(true, r.globals.TTY, r.stdin)
+
+	u, err := r.user(config.User)
+	if err != nil {
+		return nil, err
+	}
+
+	env := append([]string{}, config.Env...)
+	if !hasEnv(env, "PATH") {
+		env = append(env, defaultPath)
+	}
+
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+u.Home)
+	}
+
+	cwd := config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	return &Process{
+		User:         u,
+		Args:         append(append([]string{}, config.Entrypoint...), config.Cmd...),
+		Env:          env,
+		Cwd:          cwd,
+		Terminal:     r.stdin && r.globals.TTY,
+		Stdin:        r.stdin,
+		Secrets:      r.secrets,
+		Security:     security,
+		Capabilities: caps,
+	}, nil
+}
+
+// spec returns the runtime's configuration of the container of a run step.
+func (r *Runc) spec() (*spec, error) {
+	p, err := r.Process()
+	if err != nil {
+		return nil, err
+	}
+
+	caps := []string{}
+	for _, name := range p.Capabilities {
+		caps = append(caps, "CAP_"+name)
+	}
+
+	s := &spec{
+		OCIVersion: "1.0.2",
+		Process: specProcess{
+			Terminal:        p.Terminal,
+			User:            specUser{UID: p.User.Uid, GID: p.User.Gid, AdditionalGids: p.User.Sgids},
+			Args:            p.Args,
+			Env:             p.Env,
+			Cwd:             p.Cwd,
+			Capabilities:    specCapabilities{Bounding: caps, Effective: caps, Permitted: caps},
+			Rlimits:         []specRlimit{{Type: "RLIMIT_NOFILE", Hard: 1048576, Soft: 1048576}},
+			ApparmorProfile: p.Security.AppArmor,
+		},
+		Root:     specRoot{Path: r.rootfs},
+		Hostname: "box",
+		Mounts:   r.mounts(),
+		Linux: specLinux{
+			Namespaces:    []specNamespace{{"pid"}, {"ipc"}, {"uts"}, {"mount"}},
+			MaskedPaths:   maskedPaths,
+			ReadonlyPaths: readonlyPaths,
+		},
+	}
+
+	if s.Process.ApparmorProfile == types.Unconfined {
+		s.Process.ApparmorProfile = ""
+	}
+
+	// the steps have the network of the host, but for those which have none.
+	if p.Security.Network == "none" {
+		s.Linux.Namespaces = append(s.Linux.Namespaces, specNamespace{"network"})
+	}
+
+	if r.rootless() {
+		s.Linux.Namespaces = append(s.Linux.Namespaces, specNamespace{"user"})
+		s.Linux.UIDMappings = []specIDMapping{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}}
+		s.Linux.GIDMappings = []specIDMapping{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+	} else if r.globals.Scheduler != nil {
+		if memory := r.globals.Scheduler.Memory(r.globals.Weight); memory > 0 {
+			s.Linux.Resources = &specResources{}
+			s.Linux.Resources.Memory.Limit = memory
+		}
+	}
+
+	return s, nil
+}
+
+// checkSecurity returns an error for what the containers can't be confined
+// with without docker.
+func checkSecurity(security types.Security) error {
+	if security.Seccomp != "" && security.Seccomp != types.Unconfined {
+		return errors.New("seccomp profiles need docker: they can't be used in builds run without it")
+	}
+
+	for _, label := range security.SELinux {
+		if label != "disable" {
+			return errors.New("SELinux labels need docker: they can't be used in builds run without it")
+		}
+	}
+
+	switch security.Network {
+	case "", "none", "host", "bridge":
+	default:
+		return fmt.Errorf("network %q needs docker: it can't be used in builds run without it", security.Network)
+	}
+
+	return nil
+}
+
+// user returns the user the command of the container runs as, from the
+// /etc/passwd and /etc/group of the root filesystem.
+func (r *Runc) user(name string) (*user.ExecUser, error) {
+	if name == "" {
+		name = "root"
+	}
+
+	passwd, err := resolve(r.rootfs, "/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := resolve(r.rootfs, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := user.GetExecUserPath(name, &user.ExecUser{Home: "/"}, passwd, group)
+	if err != nil {
+		return nil, fmt.Errorf("user %q: %v", name, err)
+	}
+
+	if r.rootless() && (u.Uid != 0 || u.Gid != 0 || len(u.Sgids) > 0) {
+		return nil, fmt.Errorf("user %q: steps run without root can only run as root", name)
+	}
+
+	return u, nil
+}
+
+// mounts returns the mounts of the container: those of the kernel's
+// filesystems, and the hosts and resolv.conf.
+func (r *Runc) mounts() []specMount {
+	devpts := []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}
+	sys := specMount{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}}
+
+	if r.rootless() {
+		// sysfs can't be mounted in a user namespace without a network
+		// namespace, and the tty group is not in it.
+		sys = specMount{Destination: "/sys", Type: "none", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}}
+	} else {
+		devpts = append(devpts, "gid=5")
+	}
+
+	return []specMount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+		{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: devpts},
+		{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+		{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+		sys,
+		{Destination: "/etc/resolv.conf", Type: "bind", Source: "/etc/resolv.conf", Options: []string{"rbind", "ro"}},
+		{Destination: "/etc/hosts", Type: "bind", Source: filepath.Join(r.dir, "hosts"), Options: []string{"rbind", "ro"}},
+	}
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,484 @@
+package runc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/builder/executor"
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+)
+
+// Runc implements an executor which runs the steps with an OCI runtime, runc
+// by default, without docker. The images are kept in a layers.Store, and the
+// steps run in a root filesystem unpacked from the current image, which is
+// diffed in place to commit a layer, or, with a snapshotter, in a snapshot of
+// the layers of the image, whose changes are the layer. With a backend, the
+// run steps are run by it rather than by the runtime, and the root
+// filesystems may be made by it: the containerd and kubernetes executors are
+// the runc executor with theirs.
+type Runc struct {
+	globals     *types.Global
+	runtime     string
+	config      *config.Config
+	stdin       bool
+	secrets     map[string][]byte
+	security    *types.Security
+	store       *layers.Store
+	image       *layers.StoreImage
+	dir         string      // the bundle of the containers: the config.json, the rootfs and the state of the runtime
+	rootfs      string      // the root filesystem the containers run in
+	rootfsImage string      // the image rootfs was unpacked from, and has the files of if unpacked is set
+	unpacked    bool        // if set, rootfs has the files of rootfsImage
+	container   *Container  // the container made by Create, if it was not destroyed since
+	snap        snapshotter // if set, the root filesystems are its snapshots
+	backend     Backend     // if set, the run steps are run by it
+	cpu         time.Duration
+	written     int64
+}
+
+// Container is the container made by Create: the root filesystem as it was
+// made, which is diffed to commit it.
+type Container struct {
+	ID        string
+	Mounts    []string // the destinations of the mounts of the container
+	Started   bool     // if set, the runtime or the backend was run with the container
+	snapshot  map[string]fileState
+	changed   bool // if set, the root filesystem may have changed since it was made
+	committed bool // if set, the root filesystem is that of the image committed
+	mounted   bool // if set, the snapshot of the container is mounted on the root filesystem
+	exported  bool // if set, its layer was made by the backend, not diffed from the root filesystem
+}
+
+// NewRunc makes a new runc executor, which runs the steps with the runtime of
+// the globals, in a directory of the box directory removed by Close.
+func NewRunc(globals *types.Global) (*Runc, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("the runc executor runs on linux, not %s", runtime.GOOS)
+	}
+
+	if globals.Reproducible {
+		return nil, errors.New("reproducible builds need docker: they can't be run with the runc executor")
+	}
+
+	name := globals.Runtime
+	if name == "" {
+		name = "runc"
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the runtime %q: %v", name, err)
+	}
+
+	r, err := newRunc(globals, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.snap, err = newSnapshotter(globals.Snapshotter); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newRunc makes the executor, with its store and its bundle.
+func newRunc(globals *types.Global, path string) (*Runc, error) {
+	store, err := layers.NewStore(globals)
+	if err != nil {
+		return nil, err
+	}
+
+	config := config.NewConfig()
+
+	i, err := layers.NewStoreImage(&layers.ImageConfig{
+		Config:  config,
+		Layers:  store,
+		Globals: globals,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(util.BoxDir("runc"), 0700); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(util.BoxDir("runc"), "bundle-")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range []string{"rootfs", "state"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	return &Runc{
+		globals: globals,
+		runtime: path,
+		config:  config,
+		store:   store,
+		image:   i,
+		dir:     dir,
+		rootfs:  filepath.Join(dir, "rootfs"),
+	}, nil
+}
+
+// Close removes the root filesystem and the bundle of the containers.
+func (r *Runc) Close() error {
+	if r.container != nil {
+		// the snapshot of the container may still be mounted on the root
+		// filesystem, which would be removed with it.
+		if err := r.Destroy(r.container.ID); err != nil && (r.backend != nil || r.snap != nil) {
+			return err
+		}
+	}
+
+	return removeAll(r.dir)
+}
+
+// rootless is true if the containers run in a user namespace, as box is not
+// run by root: the user running box is root in them, and no one else is.
+func (r *Runc) rootless() bool {
+	return os.Geteuid() != 0
+}
+
+// SetStdin turns on the stdin features during run invocations. It is used to
+// facilitate debugging.
+func (r *Runc) SetStdin(on bool) {
+	r.stdin = on
+}
+
+// SetSecrets sets the secrets run invocations read from /run/secrets. They
+// are written to a directory in /dev/shm, which is mounted read-only, so they
+// are never on disk.
+func (r *Runc) SetSecrets(secrets map[string][]byte) {
+	r.secrets = secrets
+}
+
+// SetSecurity sets how the containers of a run step are confined, over the
+// security of the build.
+func (r *Runc) SetSecurity(security *types.Security) {
+	r.security = security
+}
+
+// Usage returns the CPU time the containers of run invocations used, and the
+// bytes committed to layers, since it was last called.
+func (r *Runc) Usage() (time.Duration, int64) {
+	cpu, written := r.cpu, r.written
+	r.cpu, r.written = 0, 0
+
+	return cpu, written
+}
+
+// Image returns the layers.Image interface for working with the store.
+func (r *Runc) Image() layers.Image {
+	return r.image
+}
+
+// Layers returns the layers.Layers interface for working with the store.
+func (r *Runc) Layers() layers.Layers {
+	return r.store
+}
+
+// LoadConfig loads the configuration into the executor.
+func (r *Runc) LoadConfig(c *config.Config) error {
+	r.config = c
+	return nil
+}
+
+// Config returns the current *Config for the executor.
+func (r *Runc) Config() *config.Config {
+	return r.config
+}
+
+// Commit commits an entry to the layer list: the files the hook changed in
+// the root filesystem, as a layer on top of the current image.
+func (r *Runc) Commit(cacheKey string, hook executor.Hook) error {
+	if err := util.CheckContext(r.globals.Context); err != nil {
+		return err
+	}
+
+	reused, err := r.image.ReuseCache(cacheKey)
+	if err != nil || reused {
+		return err
+	}
+
+	id, err := r.Create()
+	if err != nil {
+		return err
+	}
+
+	defer r.Destroy(id)
+
+	if hook != nil {
+		tmp, err := hook(r.globals.Context, id)
+		if err != nil {
+			return err
+		}
+
+		if tmp != "" {
+			cacheKey = tmp
+		}
+	}
+
+	select {
+	case <-r.globals.Context.Done():
+		if r.globals.Context.Err() == context.Canceled {
+			return r.globals.Context.Err()
+		}
+	default:
+	}
+
+	if err := util.CheckContext(r.globals.Context); err != nil {
+		return err
+	}
+
+	rc, err := r.layer()
+	if err != nil {
+		return fmt.Errorf("Error during commit: %v", err)
+	}
+	defer rc.Close()
+
+	image, size, err := r.store.Commit(r.config, rc, cacheKey)
+	if err != nil {
+		return fmt.Errorf("Error during commit: %v", err)
+	}
+
+	// the root filesystem is not changed by steps run by the backend, and has
+	// the layers of the image below that committed.
+	if !r.container.exported {
+		r.container.committed = true
+		r.rootfsImage = image
+	}
+
+	if r.globals.Timing != nil {
+		r.written += size
+	}
+
+	r.config.Image = image
+	r.config.BuiltBy = config.BuiltBy{Image: image, Key: cacheKey}
+	return r.Layers().AddImage(image)
+}
+
+// CopyOneFileFromContainer copies a file from the container and returns its content.
+// An error is returned, if any.
+func (r *Runc) CopyOneFileFromContainer(fn string) ([]byte, error) {
+	id, err := r.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Destroy(id)
+
+	path, err := resolve(r.rootfs, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not find %q in container", fn)
+	}
+
+	return content, err
+}
+
+// Create makes the root filesystem of the current image, and returns the ID
+// of the container which runs in it. There is one container at a time.
+func (r *Runc) Create() (string, error) {
+	if r.container != nil {
+		return "", fmt.Errorf("container %q was not destroyed", r.container.ID)
+	}
+
+	id, err := RandomID("box-")
+	if err != nil {
+		return "", err
+	}
+
+	if r.backend != nil {
+		c := &Container{ID: id}
+		if made, err := r.backend.Create(c); err != nil {
+			return "", err
+		} else if made {
+			r.container = c
+			return id, nil
+		}
+	}
+
+	if r.snap != nil {
+		if err := r.mountSnapshot(); err != nil {
+			return "", err
+		}
+
+		r.container = &Container{ID: id, mounted: true}
+		return id, nil
+	}
+
+	if err := r.prepare(); err != nil {
+		return "", err
+	}
+
+	snapshot, err := walk(r.rootfs)
+	if err != nil {
+		return "", err
+	}
+
+	r.container = &Container{
+		ID:       id,
+		snapshot: snapshot,
+	}
+
+	return id, nil
+}
+
+// RandomID returns a random ID with the prefix.
+func RandomID(prefix string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return prefix + hex.EncodeToString(buf), nil
+}
+
+// Destroy destroys a container for the given id. The root filesystem is made
+// again by the next container if this one changed it and was not committed.
+func (r *Runc) Destroy(id string) error {
+	if r.container == nil || r.container.ID != id {
+		return fmt.Errorf("no such container: %s", id)
+	}
+
+	c := r.container
+	r.container = nil
+
+	if c.changed && !c.committed {
+		r.unpacked = false
+	}
+
+	if r.backend != nil {
+		return r.backend.Destroy(c)
+	}
+
+	if !c.Started {
+		return r.unmountSnapshot(c)
+	}
+
+	// XXX do not use the stored context because it may already be canceled when we arrive at this code.
+	out, err := exec.CommandContext(context.Background(), r.runtime, "--root", r.stateDir(), "delete", "--force", id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Could not remove container %q: %v: %s", id, err, out)
+	}
+
+	return r.unmountSnapshot(c)
+}
+
+// CopyFromContainer copies a series of files in a similar fashion to
+// CopyToContainer, just in reverse.
+func (r *Runc) CopyFromContainer(id, path string) (io.Reader, int64, error) {
+	if err := r.checkContainer(id); err != nil {
+		return nil, 0, err
+	}
+
+	if filepath.Clean("/"+path) == "/" {
+		rc, err := archive.TarWithOptions(r.rootfs, &archive.TarOptions{})
+		return rc, 0, err
+	}
+
+	// the last element of the path is not followed if it is a symlink, as
+	// in docker.
+	dir, err := resolve(r.rootfs, filepath.Dir(path))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	base := filepath.Base(path)
+
+	fi, err := os.Lstat(filepath.Join(dir, base))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rc, err := archive.TarWithOptions(dir, &archive.TarOptions{IncludeFiles: []string{base}})
+	return rc, fi.Size(), err
+}
+
+// CopyToContainer copies files from the tarfile specified in reader to the
+// container so it can then be committed. It does not close the reader. The
+// symlinks in the directories of the files are followed within the root
+// filesystem, as in docker.
+func (r *Runc) CopyToContainer(id string, rdr io.Reader) error {
+	if err := r.checkContainer(id); err != nil {
+		return err
+	}
+
+	r.container.changed = true
+
+	return archive.Untar(checkTar(r.rootfs, rdr, true), r.rootfs, &archive.TarOptions{
+		NoLchown: r.rootless(),
+		InUserNS: r.rootless(),
+	})
+}
+
+// layer returns the layer tarball of the changes made to the root filesystem
+// of the container.
+func (r *Runc) layer() (io.ReadCloser, error) {
+	if r.backend != nil {
+		if rc, err := r.backend.Layer(r.container); rc != nil || err != nil {
+			r.container.exported = true
+			return rc, err
+		}
+	}
+
+	if r.snap != nil {
+		return r.snap.diff(r.rootfs, r.container.Mounts)
+	}
+
+	changes, err := r.changes()
+	if err != nil {
+		return nil, err
+	}
+
+	var uidMaps, gidMaps []idtools.IDMap
+	if r.rootless() {
+		// the files the containers write are the user's on the host, and
+		// root's in the layer.
+		uidMaps = []idtools.IDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}}
+		gidMaps = []idtools.IDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+	}
+
+	return archive.ExportChanges(r.rootfs, changes, uidMaps, gidMaps)
+}
+
+// checkContainer returns an error if the container is not the one made.
+func (r *Runc) checkContainer(id string) error {
+	if r.container == nil || r.container.ID != id {
+		return fmt.Errorf("no such container: %s", id)
+	}
+
+	return nil
+}
+
+// stateDir is the directory the runtime keeps the state of the containers in.
+func (r *Runc) stateDir() string {
+	return filepath.Join(r.dir, "state")
+}
@@ -0,0 +1,416 @@
+package runc
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+
+	. "gopkg.in/check.v1"
+)
+
+type runcSuite struct{}
+
+var _ = Suite(&runcSuite{})
+
+func TestRunc(t *T) {
+	TestingT(t)
+}
+
+func (rs *runcSuite) TestDiff(c *C) {
+	dir := c.MkDir()
+
+	for _, d := range []string{"etc", "usr/bin", "var/cache/apt"} {
+		c.Assert(os.MkdirAll(filepath.Join(dir, d), 0755), IsNil)
+	}
+
+	for _, fn := range []string{"etc/passwd", "usr/bin/true", "var/cache/apt/pkgcache.bin"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, fn), []byte("old"), 0644), IsNil)
+	}
+
+	old, err := walk(dir)
+	c.Assert(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("changed"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "usr/bin/false"), []byte("new"), 0755), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(dir, "var/cache")), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "run/secrets"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/hosts"), nil, 0644), IsNil)
+
+	new, err := walk(dir)
+	c.Assert(err, IsNil)
+
+	// the directories made for mounts, and the files in them, are not
+	// changes; the files of directories removed are removed with them.
+	changes := diff(old, new, []string{"/etc/hosts", "/run/secrets"})
+
+	c.Assert(changes, DeepEquals, []archive.Change{
+		{Path: "/etc", Kind: archive.ChangeModify},
+		{Path: "/etc/passwd", Kind: archive.ChangeModify},
+		{Path: "/usr/bin", Kind: archive.ChangeModify},
+		{Path: "/usr/bin/false", Kind: archive.ChangeAdd},
+		{Path: "/var", Kind: archive.ChangeModify},
+		{Path: "/var/cache", Kind: archive.ChangeDelete},
+	})
+
+	c.Assert(diff(new, new, nil), HasLen, 0)
+}
+
+func (rs *runcSuite) TestResolve(c *C) {
+	dir := c.MkDir()
+
+	c.Assert(os.MkdirAll(filepath.Join(dir, "usr/bin"), 0755), IsNil)
+	c.Assert(os.Symlink("usr/bin", filepath.Join(dir, "bin")), IsNil)
+	c.Assert(os.Symlink("/etc", filepath.Join(dir, "usr/etc")), IsNil)
+	c.Assert(os.Symlink("../../../../..", filepath.Join(dir, "usr/up")), IsNil)
+	c.Assert(os.Symlink("loop", filepath.Join(dir, "loop")), IsNil)
+
+	for path, resolved := range map[string]string{
+		"/bin/sh":         "/usr/bin/sh",
+		"bin/../etc":      "/etc",
+		"/usr/etc/passwd": "/etc/passwd",
+		"/usr/up/etc":     "/etc",
+		"/../../etc":      "/etc",
+		"/":               "/",
+	} {
+		fn, err := resolve(dir, path)
+		c.Assert(err, IsNil, Commentf("%s", path))
+		c.Assert(fn, Equals, filepath.Join(dir, resolved), Commentf("%s", path))
+	}
+
+	_, err := resolve(dir, "/loop/file")
+	c.Assert(err, NotNil)
+}
+
+func testTar(c *C, headers ...*tar.Header) io.Reader {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		c.Assert(tw.WriteHeader(hdr), IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+
+	return buf
+}
+
+func (rs *runcSuite) TestCheckTar(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "usr/bin"), 0755), IsNil)
+	c.Assert(os.Symlink("/tmp", filepath.Join(dir, "tmp")), IsNil)
+	c.Assert(os.Symlink("usr/bin", filepath.Join(dir, "bin")), IsNil)
+
+	for _, headers := range [][]*tar.Header{
+		{{Name: "tmp/file", Typeflag: tar.TypeReg}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/"}, {Name: "link/file", Typeflag: tar.TypeReg}},
+		{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "tmp/file"}},
+	} {
+		_, err := io.Copy(ioutil.Discard, checkTar(dir, testTar(c, headers...), false))
+		c.Assert(err, NotNil)
+	}
+
+	// a symlink removed is not followed.
+	_, err := io.Copy(ioutil.Discard, checkTar(dir, testTar(c,
+		&tar.Header{Name: ".wh.tmp", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "tmp/file", Typeflag: tar.TypeReg},
+	), false))
+	c.Assert(err, IsNil)
+
+	// copies follow the symlinks on disk.
+	tr := tar.NewReader(checkTar(dir, testTar(c, &tar.Header{Name: "bin/sh", Typeflag: tar.TypeReg}), true))
+	hdr, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(hdr.Name, Equals, "usr/bin/sh")
+}
+
+func (rs *runcSuite) TestCheckSecurity(c *C) {
+	c.Assert(checkSecurity(types.Security{}), IsNil)
+	c.Assert(checkSecurity(types.Security{Seccomp: types.Unconfined, SELinux: []string{"disable"}, Network: "none"}), IsNil)
+	c.Assert(checkSecurity(types.Security{Seccomp: "profile.json"}), NotNil)
+	c.Assert(checkSecurity(types.Security{SELinux: []string{"type:container_t"}}), NotNil)
+	c.Assert(checkSecurity(types.Security{Network: "mynet"}), NotNil)
+}
+
+func (rs *runcSuite) TestChainID(c *C) {
+	a := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	b := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+	c.Assert(ChainID(nil), Equals, "")
+	c.Assert(ChainID([]string{a}), Equals, a)
+	c.Assert(ChainID([]string{a, b}), Equals, digest.FromString(a+" "+b).String())
+	c.Assert(ChainID([]string{a, b, a}), Equals, digest.FromString(digest.FromString(a+" "+b).String()+" "+a).String())
+}
+
+func (rs *runcSuite) TestWithoutMounts(c *C) {
+	tr := tar.NewReader(WithoutMounts(testTar(c,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "run/secrets/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "run/secrets/token", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "usr/bin/app", Typeflag: tar.TypeReg},
+	), []string{"/etc/hosts", "/run/secrets"}))
+
+	names := []string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+	}
+
+	c.Assert(names, DeepEquals, []string{"etc/", "usr/bin/app"})
+}
+
+func (rs *runcSuite) TestExportLayer(c *C) {
+	dir := c.MkDir()
+
+	for _, d := range []string{"etc", "proc", "usr/bin", "var/cache/apt"} {
+		c.Assert(os.MkdirAll(filepath.Join(dir, d), 0755), IsNil)
+	}
+
+	for _, fn := range []string{"etc/passwd", "etc/group", "usr/bin/true", "var/cache/apt/pkgcache.bin"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, fn), []byte("old"), 0644), IsNil)
+	}
+
+	// the files are older than a second, so the tarball keeps their changes,
+	// and in whole seconds, as tar rounds them in go but truncates them.
+	old := time.Unix(time.Now().Add(-time.Hour).Unix(), 0)
+	c.Assert(filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		c.Assert(err, IsNil)
+		return os.Chtimes(path, old, old)
+	}), IsNil)
+
+	snapshot, err := walk(dir)
+	c.Assert(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("changed"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "usr/bin/false"), []byte("new"), 0755), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(dir, "var/cache")), IsNil)
+	c.Assert(os.Remove(filepath.Join(dir, "proc")), IsNil)
+
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	c.Assert(err, IsNil)
+	content, err := ioutil.ReadAll(rc)
+	c.Assert(err, IsNil)
+	rc.Close()
+
+	buf := bytes.NewBuffer(nil)
+	c.Assert(writeExportLayer(buf, bytes.NewReader(content), snapshot, []string{"/proc"}, true), IsNil)
+
+	names := []string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+
+	// the files hidden by mounts are not removed.
+	c.Assert(names, DeepEquals, []string{"etc/passwd", "usr/bin/", "usr/bin/false", "var/", "var/.wh.cache"})
+}
+
+func (rs *runcSuite) TestSnapshotName(c *C) {
+	name := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	c.Assert(snapshotName(name), Equals, "0123456789ab")
+}
+
+func (rs *runcSuite) TestNewSnapshotter(c *C) {
+	snap, err := newSnapshotter("copy")
+	c.Assert(err, IsNil)
+	c.Assert(snap, IsNil)
+
+	_, err = newSnapshotter("aufs")
+	c.Assert(err, ErrorMatches, `invalid snapshotter "aufs".*`)
+
+	if os.Geteuid() != 0 {
+		_, err = newSnapshotter("overlayfs")
+		c.Assert(err, ErrorMatches, ".*must be run by root.*")
+
+		snap, err = newSnapshotter("auto")
+		c.Assert(err, IsNil)
+		c.Assert(snap, IsNil)
+	}
+}
+
+// writeLayer writes a layer tarball of the headers to the file.
+func writeLayer(c *C, fn string, headers ...*tar.Header) {
+	content, err := ioutil.ReadAll(testTar(c, headers...))
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(fn, content, 0644), IsNil)
+}
+
+func (rs *runcSuite) TestOverlay(c *C) {
+	o := newOverlay(filepath.Join(c.MkDir(), "snapshots"))
+	if err := o.check(); err != nil {
+		c.Skip(fmt.Sprintf("overlayfs can't be mounted: %v", err))
+	}
+
+	// the directories the files changed are in are copied up.
+	testSnapshotter(c, o, c.MkDir(), []string{"etc/", "etc/passwd", "usr/", "usr/bin/", "usr/bin/.wh.true", "usr/bin/false"})
+}
+
+func (rs *runcSuite) TestBtrfs(c *C) {
+	dir := c.MkDir()
+	bin, err := exec.LookPath("btrfs")
+	if os.Geteuid() != 0 || err != nil || util.Filesystem(dir) != "btrfs" {
+		c.Skip("btrfs snapshots can't be made")
+	}
+
+	testSnapshotter(c, newBtrfs(bin, filepath.Join(dir, "snapshots")), dir, walkedChanges)
+}
+
+func (rs *runcSuite) TestZfs(c *C) {
+	dir := c.MkDir()
+	bin, err := exec.LookPath("zfs")
+	if os.Geteuid() != 0 || err != nil || util.Filesystem(dir) != "zfs" {
+		c.Skip("ZFS snapshots can't be made")
+	}
+
+	z, err := newZfs(bin, filepath.Join(dir, "snapshots"))
+	c.Assert(err, IsNil)
+
+	testSnapshotter(c, z, dir, walkedChanges)
+}
+
+// walkedChanges are the files of the layer testSnapshotter commits, with the
+// snapshots diffed by walking them: the directories of the files changed are
+// not, unless files were added to them or removed.
+var walkedChanges = []string{"etc/passwd", "usr/bin/", "usr/bin/.wh.true", "usr/bin/false"}
+
+// testSnapshotter makes snapshots of two layers with the snapshotter, mounts
+// them in dir, and checks the layer of the changes made to them is that of
+// the names.
+func testSnapshotter(c *C, snap snapshotter, dir string, names []string) {
+	files := []string{filepath.Join(dir, "base.tar"), filepath.Join(dir, "top.tar")}
+
+	writeLayer(c, files[0],
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "usr/bin/true", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "var/cache/apt/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "var/cache/apt/pkgcache.bin", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+
+	writeLayer(c, files[1],
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "var/.wh.cache", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+
+	diffIDs := []string{digest.FromString("base").String(), digest.FromString("top").String()}
+	chain := []string{ChainID(diffIDs[:1]), ChainID(diffIDs)}
+
+	parent := ""
+	for i, name := range chain {
+		c.Assert(snap.has(name), Equals, false)
+		c.Assert(snap.apply(name, parent, files[i]), IsNil)
+		c.Assert(snap.has(name), Equals, true)
+		parent = name
+	}
+
+	// another build may unpack a layer at once.
+	c.Assert(snap.apply(chain[1], chain[0], files[1]), IsNil)
+
+	rootfs := filepath.Join(dir, "bundle", "rootfs")
+	c.Assert(os.MkdirAll(rootfs, 0700), IsNil)
+	c.Assert(snap.mount(rootfs, chain), IsNil)
+
+	for fn, exists := range map[string]bool{"etc/passwd": true, "etc/hosts": true, "usr/bin/true": true, "var": true, "var/cache": false} {
+		_, err := os.Lstat(filepath.Join(rootfs, fn))
+		c.Assert(err == nil, Equals, exists, Commentf("%s", fn))
+	}
+
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "etc/passwd"), []byte("changed"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "usr/bin/false"), []byte("new"), 0755), IsNil)
+	c.Assert(os.Remove(filepath.Join(rootfs, "usr/bin/true")), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(rootfs, "run/secrets"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(rootfs, "run/secrets/token"), []byte("secret"), 0600), IsNil)
+
+	rc, err := snap.diff(rootfs, []string{"/run/secrets"})
+	c.Assert(err, IsNil)
+
+	changes := []string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		changes = append(changes, hdr.Name)
+	}
+	c.Assert(rc.Close(), IsNil)
+	sort.Strings(changes)
+
+	// the directories made for mounts, and the files in them, are not
+	// changes; the files removed are whiteouts.
+	c.Assert(changes, DeepEquals, names)
+
+	c.Assert(snap.unmount(rootfs), IsNil)
+
+	entries, err := ioutil.ReadDir(rootfs)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	// an image without layers is mounted on an empty directory.
+	c.Assert(snap.mount(rootfs, nil), IsNil)
+	entries, err = ioutil.ReadDir(rootfs)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+	c.Assert(snap.unmount(rootfs), IsNil)
+}
+
+func (rs *runcSuite) TestWalked(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "etc"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("old"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/group"), []byte("old"), 0644), IsNil)
+
+	w := &walked{}
+	c.Assert(w.snapshot(dir), IsNil)
+
+	c.Assert(os.Remove(filepath.Join(dir, "etc/group")), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/hosts"), nil, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc/shadow"), []byte("new"), 0600), IsNil)
+
+	rc, err := w.diff(dir, []string{"/etc/hosts"})
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	names := []string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+
+	c.Assert(names, DeepEquals, []string{"etc/", "etc/.wh.group", "etc/shadow"})
+}
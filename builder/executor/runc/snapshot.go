@@ -0,0 +1,247 @@
+package runc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// snapshotter makes the root filesystems of the containers of the runc
+// executor as snapshots of the layers of their image, which are made once
+// each, by chain ID, so making a container costs what its step changes
+// rather than the size of its image.
+type snapshotter interface {
+	// has is true if the snapshot of the name was made.
+	has(name string) bool
+	// apply makes the snapshot of the name, of the layer in the file applied
+	// on top of the snapshot of parent, or of nothing if it is empty.
+	apply(name, parent, file string) error
+	// mount makes dir a snapshot of the chain, the names of the snapshots of
+	// the layers of the image, which the container writes to.
+	mount(dir string, chain []string) error
+	// diff returns the layer tarball of the changes made to dir since it was
+	// mounted, without the files which are mounts, or in them.
+	diff(dir string, mounts []string) (io.ReadCloser, error)
+	// unmount removes the snapshot mounted on dir, leaving it empty.
+	unmount(dir string) error
+}
+
+// snapshotters are the ways the runc executor can make the root filesystems
+// of steps: copy unpacks the image to one, as it was before snapshotters, and
+// auto picks the best one the host has.
+var snapshotters = []string{"auto", "copy", "overlayfs", "btrfs", "zfs"}
+
+// newSnapshotter returns the snapshotter of the name, one of snapshotters;
+// auto if it is empty. It is nil for copy.
+func newSnapshotter(name string) (snapshotter, error) {
+	switch name {
+	case "", "auto":
+		return detectSnapshotter(), nil
+	case "copy":
+		return nil, nil
+	case "overlayfs", "btrfs", "zfs":
+	default:
+		return nil, fmt.Errorf("invalid snapshotter %q: must be %s", name, strings.Join(snapshotters, ", "))
+	}
+
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("the %s snapshotter must be run by root, as it mounts the snapshots", name)
+	}
+
+	dir := util.BoxDir("snapshots", name)
+
+	if name == "overlayfs" {
+		o := newOverlay(dir)
+		if err := o.check(); err != nil {
+			return nil, fmt.Errorf("overlayfs can't be mounted in %s: %v", dir, err)
+		}
+
+		return o, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if fs := util.Filesystem(dir); fs != name {
+		return nil, fmt.Errorf("the %s snapshotter needs the box directory on %s: %s is not", name, name, dir)
+	}
+
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s: %v", name, err)
+	}
+
+	if name == "btrfs" {
+		return newBtrfs(bin, dir), nil
+	}
+
+	return newZfs(bin, dir)
+}
+
+// detectSnapshotter returns the snapshotter of the filesystem of the box
+// directory if it is btrfs or ZFS, overlayfs if it can be mounted there, and
+// nil, to copy, if not, or if box is not run by root.
+func detectSnapshotter() snapshotter {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(util.BoxDir("snapshots"), 0700); err != nil {
+		return nil
+	}
+
+	if fs := util.Filesystem(util.BoxDir("snapshots")); fs != "" {
+		if snap, err := newSnapshotter(fs); err == nil {
+			return snap
+		}
+	}
+
+	if o := newOverlay(util.BoxDir("snapshots", "overlayfs")); o.check() == nil {
+		return o
+	}
+
+	return nil
+}
+
+// snapshotName returns the name of the directory of the snapshot of the chain
+// ID: short, as the directories of all the layers of an image are given to
+// mount overlayfs, whose options are limited to a page.
+func snapshotName(chain string) string {
+	hex := digest.Digest(chain).Hex()
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+
+	return hex
+}
+
+// snapshotChain makes the snapshots of the layers of the image the
+// snapshotter does not have yet, and returns their names, from the bottom
+// layer up.
+func (r *Runc) snapshotChain(image string) ([]string, error) {
+	if image == "" {
+		return nil, nil
+	}
+
+	diffIDs, err := r.store.DiffIDs(image)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := r.store.LayerFiles(image)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []string{}
+	parent := ""
+	for i := range diffIDs {
+		name := ChainID(diffIDs[:i+1])
+
+		if !r.snap.has(name) {
+			if err := r.snap.apply(name, parent, files[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		chain = append(chain, name)
+		parent = name
+	}
+
+	return chain, nil
+}
+
+// ChainID returns the chain ID of the layers, by diff ID.
+func ChainID(diffIDs []string) string {
+	if len(diffIDs) == 0 {
+		return ""
+	}
+
+	chain := diffIDs[0]
+	for _, diffID := range diffIDs[1:] {
+		chain = digest.FromString(chain + " " + diffID).String()
+	}
+
+	return chain
+}
+
+// mountSnapshot mounts the snapshot of the current image the container
+// writes to on the root filesystem.
+func (r *Runc) mountSnapshot() error {
+	chain, err := r.snapshotChain(r.config.Image)
+	if err != nil {
+		return err
+	}
+
+	return r.snap.mount(r.rootfs, chain)
+}
+
+// unmountSnapshot removes the snapshot of the container, if it has one.
+func (r *Runc) unmountSnapshot(c *Container) error {
+	if r.snap == nil || !c.mounted {
+		return nil
+	}
+
+	return r.snap.unmount(r.rootfs)
+}
+
+// walked diffs the snapshots of filesystems which keep the state of the files
+// they snapshot, as btrfs and ZFS do, by walking them as they are mounted and
+// as they are committed.
+type walked struct {
+	states map[string]fileState // of the snapshot mounted, as it was made
+}
+
+func (w *walked) snapshot(dir string) error {
+	states, err := walk(dir)
+	if err != nil {
+		return err
+	}
+
+	w.states = states
+	return nil
+}
+
+func (w *walked) diff(dir string, mounts []string) (io.ReadCloser, error) {
+	states, err := walk(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return archive.ExportChanges(dir, diff(w.states, states, mounts), nil, nil)
+}
+
+// run runs the command of a snapshotter, and returns what it wrote, trimmed.
+func run(bin string, args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if len(args) > 2 {
+			args = args[:2]
+		}
+		return "", fmt.Errorf("%s %s: %v: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Unmount unmounts what is mounted on the directory.
+func Unmount(dir string) error {
+	if out, err := exec.Command("umount", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not unmount %s: %v: %s", dir, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
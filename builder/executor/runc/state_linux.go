@@ -0,0 +1,71 @@
+package runc
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+
+	"github.com/docker/docker/pkg/system"
+)
+
+// fileState is what changes when a file is written, removed and made again,
+// or has its mode or owner changed.
+type fileState struct {
+	mode     os.FileMode
+	size     int64
+	mtime    int64
+	ctime    int64
+	uid, gid uint32
+	ino      uint64
+	rdev     uint64
+}
+
+func stateOf(fi os.FileInfo) fileState {
+	state := fileState{mode: fi.Mode(), size: fi.Size(), mtime: fi.ModTime().UnixNano()}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		state.ctime = st.Ctim.Nano()
+		state.uid, state.gid = st.Uid, st.Gid
+		state.ino, state.rdev = uint64(st.Ino), uint64(st.Rdev)
+	}
+
+	return state
+}
+
+// tarred returns what a tarball keeps of the state: not the ctime, the inode
+// or the size of directories, and the mtime in seconds. Without owners, the
+// files are all root's.
+func (s fileState) tarred(owners bool) fileState {
+	state := fileState{mode: s.mode, size: s.size, mtime: s.mtime / 1e9 * 1e9, rdev: s.rdev}
+	if owners {
+		state.uid, state.gid = s.uid, s.gid
+	}
+
+	if s.mode.IsDir() {
+		state.size = 0
+	}
+
+	return state
+}
+
+// tarState returns the state of the file of the header, as tarred returns
+// it of the file once written.
+func tarState(hdr *tar.Header, owners bool) fileState {
+	fi := hdr.FileInfo()
+
+	state := fileState{mode: fi.Mode(), size: hdr.Size, mtime: hdr.ModTime.Unix() * 1e9}
+	if owners {
+		state.uid, state.gid = uint32(hdr.Uid), uint32(hdr.Gid)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		state.size = 0
+	case tar.TypeSymlink:
+		state.size = int64(len(hdr.Linkname))
+	case tar.TypeChar, tar.TypeBlock:
+		state.rdev = uint64(system.Mkdev(hdr.Devmajor, hdr.Devminor))
+	}
+
+	return state
+}
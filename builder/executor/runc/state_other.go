@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+package runc
+
+import (
+	"archive/tar"
+	"os"
+)
+
+// fileState is what changes when a file is written, or has its mode changed.
+type fileState struct {
+	mode  os.FileMode
+	size  int64
+	mtime int64
+}
+
+func stateOf(fi os.FileInfo) fileState {
+	return fileState{mode: fi.Mode(), size: fi.Size(), mtime: fi.ModTime().UnixNano()}
+}
+
+// tarred returns what a tarball keeps of the state: not the size of
+// directories, and the mtime in seconds.
+func (s fileState) tarred(bool) fileState {
+	state := fileState{mode: s.mode, size: s.size, mtime: s.mtime / 1e9 * 1e9}
+	if s.mode.IsDir() {
+		state.size = 0
+	}
+
+	return state
+}
+
+// tarState returns the state of the file of the header, as tarred returns
+// it of the file once written.
+func tarState(hdr *tar.Header, _ bool) fileState {
+	state := fileState{mode: hdr.FileInfo().Mode(), size: hdr.Size, mtime: hdr.ModTime.Unix() * 1e9}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		state.size = 0
+	case tar.TypeSymlink:
+		state.size = int64(len(hdr.Linkname))
+	}
+
+	return state
+}
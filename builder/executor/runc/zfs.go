@@ -0,0 +1,136 @@
+package runc
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// zfs makes the root filesystems of containers as ZFS clones. The snapshot
+// of each layer is a dataset, a clone of the snapshot of that of the layer
+// below it with the layer unpacked on top, and the root filesystem of a
+// container is a clone of that of the top layer of its image, mounted on it,
+// which is destroyed to roll the container back.
+type zfs struct {
+	walked
+	bin     string // the path of the zfs command
+	dataset string // the dataset of dir, which those of the layers are children of, by snapshotName
+	dir     string // where the datasets of the layers are mounted as they are unpacked
+	mounted string // the dataset of the container mounted, if there is one
+}
+
+// newZfs returns the snapshotter of the ZFS dataset dir is in.
+func newZfs(bin, dir string) (*zfs, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	dataset, err := run(bin, "list", "-H", "-o", "name", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zfs{bin: bin, dataset: dataset, dir: dir}, nil
+}
+
+func (z *zfs) name(name string) string {
+	return z.dataset + "/" + snapshotName(name)
+}
+
+// has is true if the dataset of the layer has its snapshot, which it is given
+// once it is unpacked.
+func (z *zfs) has(name string) bool {
+	_, err := run(z.bin, "list", "-H", "-o", "name", z.name(name)+"@layer")
+	return err == nil
+}
+
+// create makes the dataset mounted on dir, a clone of the snapshot of parent,
+// or empty.
+func (z *zfs) create(dataset, dir, parent string) error {
+	if parent == "" {
+		_, err := run(z.bin, "create", "-o", "mountpoint="+dir, dataset)
+		return err
+	}
+
+	_, err := run(z.bin, "clone", "-o", "mountpoint="+dir, z.name(parent)+"@layer", dataset)
+	return err
+}
+
+// apply unpacks the layer to a clone of the parent, which is snapshotted
+// and renamed once it is, so other builds see all of it or none.
+func (z *zfs) apply(name, parent, file string) error {
+	id, err := RandomID("unpack-")
+	if err != nil {
+		return err
+	}
+
+	tmp := z.dataset + "/" + id
+	dir := filepath.Join(z.dir, id)
+
+	if err := z.create(tmp, dir, parent); err != nil {
+		return err
+	}
+
+	err = UnpackLayer(dir, file, false)
+	if err == nil {
+		_, err = run(z.bin, "snapshot", tmp+"@layer")
+	}
+
+	if err == nil {
+		_, err = run(z.bin, "set", "mountpoint=none", tmp)
+	}
+
+	if err == nil {
+		_, err = run(z.bin, "rename", tmp, z.name(name))
+	}
+
+	os.Remove(dir)
+
+	if err != nil {
+		run(z.bin, "destroy", "-r", tmp)
+
+		// another build may have unpacked it first.
+		if z.has(name) {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// mount mounts a clone of the top layer of the chain on dir.
+func (z *zfs) mount(dir string, chain []string) error {
+	id, err := RandomID("box-")
+	if err != nil {
+		return err
+	}
+
+	parent := ""
+	if len(chain) > 0 {
+		parent = chain[len(chain)-1]
+	}
+
+	dataset := z.dataset + "/" + id
+	if err := z.create(dataset, dir, parent); err != nil {
+		return err
+	}
+	z.mounted = dataset
+
+	if err := z.snapshot(dir); err != nil {
+		z.unmount(dir)
+		return err
+	}
+
+	return nil
+}
+
+func (z *zfs) unmount(dir string) error {
+	if _, err := run(z.bin, "destroy", z.mounted); err != nil {
+		return err
+	}
+
+	z.mounted = ""
+	z.states = nil
+	return nil
+}
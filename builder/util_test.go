@@ -7,7 +7,7 @@ import (
 	"io"
 	"os"
 
-	. "gopkg.in/check.v1"
+	"gopkg.in/check.v1"
 
 	btypes "github.com/box-builder/box/types"
 	"github.com/docker/docker/api/types"
@@ -28,23 +28,27 @@ func runBuilder(script string) (*Builder, error) {
 		return nil, err
 	}
 
-	return b, b.eval.RunScript(script)
+	if err := b.eval.RunScript(script); err != nil {
+		return b, err
+	}
+
+	return b, b.eval.RunHooks()
 }
 
-func readContainerFile(c *C, b *Builder, fn string) []byte {
+func readContainerFile(c *check.C, b *Builder, fn string) []byte {
 	return runContainerCommand(c, b, []string{"cat", fn})
 }
 
-func runContainerCommand(c *C, b *Builder, cmd []string) []byte {
+func runContainerCommand(c *check.C, b *Builder, cmd []string) []byte {
 	b.exec.Config().Entrypoint.Temporary = []string{}
 	b.exec.Config().Cmd.Temporary = cmd
 	id, err := b.exec.Create()
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 	resp, err := dockerClient.ContainerAttach(context.Background(), id, types.ContainerAttachOptions{Stream: true, Stdout: true, Stdin: true})
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	err = dockerClient.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	buf := new(bytes.Buffer)
 
@@ -56,8 +60,8 @@ func runContainerCommand(c *C, b *Builder, cmd []string) []byte {
 		n, err = stdcopy.StdCopy(buf, buf, resp.Reader)
 	}
 
-	c.Assert(err, IsNil, Commentf("%v", err))
-	c.Assert(n, Not(Equals), 0)
+	c.Assert(err, check.IsNil, check.Commentf("%v", err))
+	c.Assert(n, check.Not(check.Equals), 0)
 
 	nr := bufio.NewReader(buf)
 	result := []byte{}
@@ -73,8 +77,8 @@ func runContainerCommand(c *C, b *Builder, cmd []string) []byte {
 	}
 
 	status, err := dockerClient.ContainerWait(context.Background(), id)
-	c.Assert(err, IsNil)
-	c.Assert(status, Equals, int64(0), Commentf("%v", result))
+	c.Assert(err, check.IsNil)
+	c.Assert(status, check.Equals, int64(0), check.Commentf("%v", result))
 
 	return result
 }
@@ -0,0 +1,222 @@
+// Package buildreport writes what a build did for machines to read: each of
+// its steps, whether it was found in the cache and how long it took, the
+// image built and where it was pushed, and its warnings. Reports are written
+// as JSON, or as JUnit XML, so CI systems show the result of each step.
+package buildreport
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/timing"
+)
+
+// The statuses of builds.
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// Report is the report of a build.
+type Report struct {
+	Plan     string        `json:"plan"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Duration time.Duration `json:"duration"`        // in nanoseconds
+	Image    string        `json:"image,omitempty"` // the ID of the image built
+	Tags     []string      `json:"tags,omitempty"`
+	Pushed   []Pushed      `json:"pushed,omitempty"`
+	Cache    Cache         `json:"cache"`
+	Steps    []Step        `json:"steps"`
+	Warnings []string      `json:"warnings"`
+}
+
+// Pushed is an image pushed, and the digest of its manifest if it is known.
+type Pushed struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Cache counts the steps found in the cache.
+type Cache struct {
+	Hits   int           `json:"hits"`
+	Misses int           `json:"misses"`
+	Saved  time.Duration `json:"saved"` // in nanoseconds
+}
+
+// Step is the report of a step.
+type Step struct {
+	Step    string        `json:"step"`
+	Key     string        `json:"key,omitempty"` // the cache key, for steps which built a layer
+	Cached  bool          `json:"cached"`
+	Reason  string        `json:"reason,omitempty"` // why the step missed the cache
+	Wall    time.Duration `json:"wall"`             // in nanoseconds
+	CPU     time.Duration `json:"cpu"`              // in nanoseconds
+	Written int64         `json:"written"`
+	Failed  bool          `json:"failed,omitempty"`
+}
+
+// Warnings are the warnings of a build. The methods of nil warnings do
+// nothing.
+type Warnings struct {
+	list  []string
+	mutex sync.Mutex
+}
+
+// Add adds a warning.
+func (w *Warnings) Add(warning string) {
+	if w == nil {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.list = append(w.list, warning)
+}
+
+// List returns the warnings, in the order they were added.
+func (w *Warnings) List() []string {
+	if w == nil {
+		return []string{}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string{}, w.list...)
+}
+
+// SetSteps sets the steps of the report from the timing of the steps run,
+// and their cache keys and misses from the cache report. With failed set,
+// the last step run is the one which failed.
+func (r *Report) SetSteps(timings *timing.Report, cached *cache.Report, failed bool) {
+	r.Steps = []Step{}
+	used := map[int]bool{}
+
+	for _, t := range timings.Steps {
+		step := Step{Step: t.Step, Cached: t.Cached, Wall: t.Wall, CPU: t.CPU, Written: t.Written}
+
+		// the cache report only has the steps which built a layer, or were
+		// found in the cache.
+		for i, c := range cached.Steps {
+			if !used[i] && c.Step == t.Step {
+				used[i] = true
+				step.Key, step.Reason = c.Key, c.Reason
+				break
+			}
+		}
+
+		r.Steps = append(r.Steps, step)
+	}
+
+	if failed && len(r.Steps) > 0 {
+		r.Steps[len(r.Steps)-1].Failed = true
+	}
+
+	r.Cache.Hits, r.Cache.Misses, r.Cache.Saved = cached.Counts()
+}
+
+// WriteJSON writes the report to the file as JSON.
+func (r *Report) WriteJSON(fn string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, append(content, '\n'), 0644)
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+	SystemErr string      `xml:"system-err,omitempty"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the report to the file as JUnit XML: the build is a test
+// suite, and each step a test case, which fails if the step did. A build
+// which failed after its steps has a test case of its own, which fails.
+func (r *Report) WriteJUnit(fn string) error {
+	suite := junitSuite{
+		Name:      r.Plan,
+		Time:      seconds(r.Duration),
+		Timestamp: r.Started.UTC().Format("2006-01-02T15:04:05"),
+		Cases:     []junitCase{},
+	}
+
+	failed := false
+	for _, step := range r.Steps {
+		c := junitCase{Name: step.Step, ClassName: r.Plan, Time: seconds(step.Wall)}
+
+		if step.Cached {
+			c.SystemOut = "cached"
+		} else if step.Reason != "" {
+			c.SystemOut = "rebuilt: " + step.Reason
+		}
+
+		if step.Failed {
+			c.Failure = &junitFailure{Message: r.Error, Text: r.Error}
+			failed = true
+		}
+
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if r.Status == Failed && !failed {
+		suite.Cases = append(suite.Cases, junitCase{
+			Name:      "build",
+			ClassName: r.Plan,
+			Time:      seconds(r.Duration),
+			Failure:   &junitFailure{Message: r.Error, Text: r.Error},
+		})
+	}
+
+	for _, c := range suite.Cases {
+		if c.Failure != nil {
+			suite.Failures++
+		}
+	}
+	suite.Tests = len(suite.Cases)
+
+	for _, warning := range r.Warnings {
+		suite.SystemErr += "warning: " + warning + "\n"
+	}
+
+	content, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, append([]byte(xml.Header), append(content, '\n')...), 0644)
+}
@@ -0,0 +1,90 @@
+package buildreport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/timing"
+	. "gopkg.in/check.v1"
+)
+
+type reportSuite struct{}
+
+var _ = Suite(&reportSuite{})
+
+func TestBuildReport(t *T) {
+	TestingT(t)
+}
+
+func (rs *reportSuite) TestReport(c *C) {
+	timings := &timing.Report{}
+	timings.Add(timing.Step{Step: "from debian", Cached: true, Wall: time.Second})
+	timings.Add(timing.Step{Step: "env FOO=bar", Wall: time.Millisecond})
+	timings.Add(timing.Step{Step: "run make", Wall: 3 * time.Second, Written: 1024})
+
+	cached := &cache.Report{}
+	cached.Add(cache.Step{Step: "from debian", Key: "k1", Hit: true})
+	cached.Add(cache.Step{Step: "run make", Key: "k2", Reason: cache.ReasonNew})
+
+	warnings := &Warnings{}
+	warnings.Add("secret found in layer 1: etc/key:1: private-key")
+
+	started := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	r := &Report{
+		Plan:     "box.rb",
+		Status:   Failed,
+		Error:    "exit status 2",
+		Started:  started,
+		Finished: started.Add(4 * time.Second),
+		Duration: 4 * time.Second,
+		Warnings: warnings.List(),
+	}
+	r.SetSteps(timings, cached, true)
+
+	c.Assert(r.Steps, HasLen, 3)
+	c.Assert(r.Steps[0], DeepEquals, Step{Step: "from debian", Key: "k1", Cached: true, Wall: time.Second})
+	c.Assert(r.Steps[1].Key, Equals, "")
+	c.Assert(r.Steps[2].Reason, Equals, cache.ReasonNew)
+	c.Assert(r.Steps[2].Failed, Equals, true)
+	c.Assert(r.Cache.Hits, Equals, 1)
+	c.Assert(r.Cache.Misses, Equals, 1)
+
+	dir := c.MkDir()
+	c.Assert(r.WriteJSON(filepath.Join(dir, "report.json")), IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "report.json"))
+	c.Assert(err, IsNil)
+
+	read := &Report{}
+	c.Assert(json.Unmarshal(content, read), IsNil)
+	c.Assert(read.Steps, DeepEquals, r.Steps)
+	c.Assert(read.Warnings, DeepEquals, r.Warnings)
+
+	c.Assert(r.WriteJUnit(filepath.Join(dir, "report.xml")), IsNil)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "report.xml"))
+	c.Assert(err, IsNil)
+
+	xml := string(content)
+	for _, s := range []string{
+		`<testsuite name="box.rb" tests="3" failures="1" time="4.000" timestamp="2026-10-15T12:00:00">`,
+		`<testcase name="from debian" classname="box.rb" time="1.000">`,
+		`<system-out>cached</system-out>`,
+		`<system-out>rebuilt: not in cache</system-out>`,
+		`<failure message="exit status 2">exit status 2</failure>`,
+		`<system-err>warning: secret found in layer 1: etc/key:1: private-key&#xA;</system-err>`,
+	} {
+		c.Assert(strings.Contains(xml, s), Equals, true, Commentf("%s not in %s", s, xml))
+	}
+
+	// a build which failed after its steps has a test case which fails.
+	r.SetSteps(timings, cached, false)
+	c.Assert(r.WriteJUnit(filepath.Join(dir, "report.xml")), IsNil)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "report.xml"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Matches, `(?s).*tests="4" failures="1".*<testcase name="build" classname="box.rb" time="4.000">\s*<failure.*`)
+}
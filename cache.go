@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/tar"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+func runCacheList(ctx *cli.Context) {
+	log := logger.New("cache", ctx.GlobalBool("no-trim"))
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	entries, err := cache.Entries(context.Background(), client)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE ID\tCREATED\tSIZE\tTAGS\tKEY")
+
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s ago\t%s\t%s\t%s\n",
+			strings.TrimPrefix(entry.ID, "sha256:")[:12],
+			units.HumanDuration(time.Since(entry.Created)),
+			units.HumanSize(float64(entry.Size)),
+			strings.Join(entry.Tags, ","),
+			strings.TrimPrefix(entry.Key, cache.Prefix)[:12],
+		)
+	}
+
+	w.Flush()
+}
+
+func runCacheStats(ctx *cli.Context) {
+	log := logger.New("cache", ctx.GlobalBool("no-trim"))
+
+	stats, err := cache.LoadStats()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	var rate float64
+	if stats.Hits+stats.Misses > 0 {
+		rate = 100 * float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+
+	fmt.Printf("Builds:     %d\n", stats.Builds)
+	fmt.Printf("Hits:       %d (%.1f%%)\n", stats.Hits, rate)
+	fmt.Printf("Misses:     %d\n", stats.Misses)
+	fmt.Printf("Time saved: %s\n", stats.Saved)
+
+	if rebuilt := stats.MostRebuilt(10); len(rebuilt) > 0 {
+		fmt.Println("\nMost rebuilt steps:")
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, step := range rebuilt {
+			fmt.Fprintf(w, "%d\t%s\n", stats.Rebuilt[step], step)
+		}
+		w.Flush()
+	}
+}
+
+func runCachePrune(ctx *cli.Context) {
+	log := logger.New("cache", ctx.GlobalBool("no-trim"))
+
+	opts := cache.PruneOptions{
+		KeepLast:  ctx.Int("keep-last"),
+		OlderThan: ctx.Duration("older-than"),
+	}
+
+	if ctx.String("max-size") != "" {
+		size, err := units.FromHumanSize(ctx.String("max-size"))
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		opts.MaxSize = size
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	entries, err := cache.Entries(context.Background(), client)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	removed, reclaimed, err := pruneCache(log, client, cache.SelectPrune(entries, opts, time.Now()))
+
+	log.Finish(fmt.Sprintf("Removed %d of %d cached steps, reclaiming %s", len(removed), len(entries), units.HumanSize(float64(reclaimed))))
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// pruneCache removes the cached steps and their statistics, and returns the
+// steps removed and the bytes reclaimed.
+func pruneCache(log *logger.Logger, client *client.Client, entries []cache.Entry) ([]cache.Entry, int64, error) {
+	removed, err := cache.Remove(context.Background(), client, entries)
+
+	var reclaimed int64
+	for _, entry := range removed {
+		reclaimed += entry.Size
+	}
+
+	statsErr := cache.UpdateStats(func(stats *cache.Stats) {
+		for _, entry := range removed {
+			delete(stats.Durations, entry.Key)
+		}
+	})
+	if statsErr != nil {
+		log.Error(fmt.Sprintf("Could not update cache statistics: %v", statsErr))
+	}
+
+	return removed, reclaimed, err
+}
+
+func runGC(ctx *cli.Context) {
+	log := logger.New("gc", ctx.GlobalBool("no-trim"))
+	dryRun := ctx.Bool("dry-run")
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	garbage, err := cache.Garbage(context.Background(), client)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	removed := garbage
+	if !dryRun {
+		removed, err = cache.RemoveImages(context.Background(), client, garbage, false)
+	}
+
+	var reclaimed int64
+	for _, img := range removed {
+		reclaimed += img.Size
+		if dryRun {
+			fmt.Printf("%s\t%s\n", strings.TrimPrefix(img.ID, "sha256:")[:12], units.HumanSize(float64(img.Size)))
+		}
+	}
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	files, size, err := tar.CollectCopyCache(dryRun)
+	reclaimed += size
+	if dryRun {
+		for _, fn := range files {
+			fmt.Println(fn)
+		}
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+
+	log.Finish(fmt.Sprintf("%s %d unreferenced images and %d copy cache files, reclaiming %s", verb, len(removed), len(files), units.HumanSize(float64(reclaimed))))
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func runPrune(ctx *cli.Context) {
+	log := logger.New("prune", ctx.GlobalBool("no-trim"))
+	dryRun := ctx.Bool("dry-run")
+
+	opts := cache.DanglingOptions{All: ctx.Bool("all")}
+	for _, filter := range ctx.StringSlice("filter") {
+		if err := cache.ParseDanglingFilter(filter, &opts, time.Now()); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	dangling, err := cache.Dangling(context.Background(), client, opts)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	removed := dangling
+	if !dryRun {
+		removed, err = cache.RemoveImages(context.Background(), client, dangling, opts.All)
+	}
+
+	var reclaimed int64
+	for _, img := range removed {
+		reclaimed += img.Size
+		if dryRun {
+			fmt.Printf("%s\t%s\n", strings.TrimPrefix(img.ID, "sha256:")[:12], units.HumanSize(float64(img.Size)))
+		}
+	}
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+
+	log.Finish(fmt.Sprintf("%s %d images, reclaiming %s", verb, len(removed), units.HumanSize(float64(reclaimed))))
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const azureVersion = "2020-10-02"
+
+// azureBlob authorizes its requests with the storage account's shared key,
+// or with a SAS token.
+type azureBlob struct {
+	account string
+	key     []byte
+	sas     url.Values
+	now     func() time.Time
+}
+
+// newAzureBlob opens azblob://container/prefix in the storage account named
+// by AZURE_STORAGE_ACCOUNT. AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN
+// authorizes it. ?endpoint= selects another blob endpoint, like azurite.
+func newAzureBlob(u *url.URL) (Backend, error) {
+	a := &azureBlob{
+		account: os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		now:     time.Now,
+	}
+
+	if a.account == "" {
+		return nil, errors.New("AZURE_STORAGE_ACCOUNT must be set to use an azblob cache")
+	}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		var err error
+		a.key, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY is invalid: %v", err)
+		}
+	} else if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		var err error
+		a.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN is invalid: %v", err)
+		}
+	} else {
+		return nil, errors.New("AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN must be set to use an azblob cache")
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", a.account)
+	}
+
+	container, prefix := u.Host, u.Path
+
+	return &httpBackend{
+		client: http.DefaultClient,
+		url: func(name string) string {
+			return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), container, objectPath(prefix, name))
+		},
+		sign: a.sign,
+	}, nil
+}
+
+func (a *azureBlob) sign(req *http.Request) error {
+	req.Header.Set("x-ms-date", a.now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+	if req.Method == "PUT" {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+
+	if a.sas != nil {
+		query := req.URL.Query()
+		for name, values := range a.sas {
+			query[name] = values
+		}
+		req.URL.RawQuery = query.Encode()
+		return nil
+	}
+
+	var length string
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	headers := []string{}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			headers = append(headers, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + a.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; x-ms-date is used instead.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(headers, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+
+	return nil
+}
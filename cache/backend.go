@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrNotFound is returned by a backend which does not have an object.
+var ErrNotFound = errors.New("object not found")
+
+// Backend stores the build cache outside of docker, so build farms can share
+// a cache without running a registry for it. Objects are named with slash
+// separated paths.
+type Backend interface {
+	// Exists is true if the backend has the object.
+	Exists(ctx context.Context, name string) (bool, error)
+
+	// Get returns the content of the object, or ErrNotFound.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Put stores the content as the object, replacing it if it exists.
+	Put(ctx context.Context, name string, content io.ReadSeeker) error
+}
+
+var backends = map[string]func(*url.URL) (Backend, error){
+	"s3":     newS3,
+	"gs":     newGCS,
+	"azblob": newAzureBlob,
+	"gha":    newGHA,
+	"http":   newHTTP,
+	"https":  newHTTP,
+}
+
+// IsBackend is true if the location names a backend, rather than a registry
+// repository.
+func IsBackend(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+
+	_, ok := backends[u.Scheme]
+	return ok
+}
+
+// OpenBackend opens the backend at the location, which is one of
+// s3://bucket/prefix, gs://bucket/prefix, azblob://container/prefix,
+// gha://scope/prefix for the cache of GitHub Actions, or the http:// or
+// https:// URL of a cache server. Credentials are taken from the environment,
+// as each provider's own tools take them.
+func OpenBackend(location string) (Backend, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	open, ok := backends[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("%q is not a cache backend; use s3://, gs://, azblob://, gha://, http:// or https://", location)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("cache backend %q has no bucket, container, scope or host", location)
+	}
+
+	return open(u)
+}
+
+// httpBackend is a backend which keeps objects at URLs, and authorizes its
+// requests by signing them.
+type httpBackend struct {
+	client *http.Client
+	url    func(name string) string
+	sign   func(*http.Request) error
+}
+
+// objectPath joins the prefix and name of an object.
+func objectPath(prefix, name string) string {
+	return strings.TrimPrefix(path.Join(prefix, name), "/")
+}
+
+func (h *httpBackend) do(ctx context.Context, method, name string, content io.ReadSeeker) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.url(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if content != nil {
+		size, err := content.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		req.Body = ioutil.NopCloser(content)
+		req.ContentLength = size
+	}
+
+	if err := h.sign(req); err != nil {
+		return nil, err
+	}
+
+	return h.client.Do(req.WithContext(ctx))
+}
+
+// statusError returns an error for an unexpected response, with what the
+// server said about it.
+func statusError(method, name string, resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s %s", method, name, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (h *httpBackend) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := h.do(ctx, "HEAD", name, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, statusError("HEAD", name, resp)
+	}
+}
+
+func (h *httpBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := h.do(ctx, "GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, statusError("GET", name, resp)
+	}
+}
+
+func (h *httpBackend) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	resp, err := h.do(ctx, "PUT", name, content)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return statusError("PUT", name, resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FreeSpace returns the bytes free to unprivileged users on the filesystem of
+// the directory, or of its nearest parent which exists.
+func FreeSpace(dir string) (int64, error) {
+	for {
+		stat := unix.Statfs_t{}
+		err := unix.Statfs(dir, &stat)
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), nil
+		}
+
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return 0, err
+		}
+
+		dir = parent
+	}
+}
+
+// SelectEvict returns the oldest entries, which reclaim the bytes given when
+// they are removed, newest first as SelectPrune returns them. entries must be
+// sorted newest first. Referenced entries are never selected, so fewer bytes
+// may be reclaimed.
+func SelectEvict(entries []Entry, reclaim int64) []Entry {
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	maxSize := total - reclaim
+	if maxSize < 1 {
+		// a MaxSize of 0 is no limit.
+		maxSize = 1
+	}
+
+	return SelectPrune(entries, PruneOptions{MaxSize: maxSize}, time.Now())
+}
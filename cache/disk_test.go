@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (cs *cacheSuite) TestSelectEvict(c *C) {
+	now := time.Now()
+
+	entries := []Entry{}
+	for i := 0; i < 5; i++ {
+		entries = append(entries, Entry{
+			ID:      string('a' + byte(i)),
+			Created: now.Add(-time.Duration(i) * 24 * time.Hour),
+			Size:    10,
+		})
+	}
+	entries[3].Tags = []string{"myapp:latest"}
+
+	ids := func(entries []Entry) string {
+		var str string
+		for _, entry := range entries {
+			str += entry.ID
+		}
+		return str
+	}
+
+	c.Assert(ids(SelectEvict(entries, 0)), Equals, "")
+	c.Assert(ids(SelectEvict(entries, 5)), Equals, "e")
+	c.Assert(ids(SelectEvict(entries, 15)), Equals, "ce")
+	// the tagged entry is never evicted, so the rest is less than asked for.
+	c.Assert(ids(SelectEvict(entries, 100)), Equals, "abce")
+}
+
+func (cs *cacheSuite) TestFreeSpace(c *C) {
+	dir := c.MkDir()
+
+	free, err := FreeSpace(dir)
+	c.Assert(err, IsNil)
+	c.Assert(free > 0, Equals, true)
+
+	// a directory not made yet is on the filesystem of its parent.
+	missing, err := FreeSpace(filepath.Join(dir, "not", "made"))
+	c.Assert(err, IsNil)
+	c.Assert(missing > 0, Equals, true)
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/audit"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Image is an image in the docker daemon, as garbage collection sees it.
+type Image struct {
+	ID      string
+	Parent  string
+	Size    int64 // the size of the layer the image added to its parent
+	Created time.Time
+	Root    bool // kept, with its parents: see Garbage and Dangling
+}
+
+// Unreachable returns the images which are neither roots nor the parent of
+// another reachable image, children before their parents so they can be
+// removed in order.
+func Unreachable(images []Image) []Image {
+	byID := map[string]Image{}
+	for _, img := range images {
+		byID[img.ID] = img
+	}
+
+	reachable := map[string]bool{}
+	for _, img := range images {
+		if !img.Root {
+			continue
+		}
+
+		for id := img.ID; id != "" && !reachable[id]; id = byID[id].Parent {
+			reachable[id] = true
+		}
+	}
+
+	depth := func(img Image) int {
+		var d int
+		for id := img.Parent; id != ""; id = byID[id].Parent {
+			d++
+		}
+		return d
+	}
+
+	garbage := []Image{}
+	depths := map[string]int{}
+	for _, img := range images {
+		if !reachable[img.ID] {
+			garbage = append(garbage, img)
+			depths[img.ID] = depth(img)
+		}
+	}
+
+	sort.SliceStable(garbage, func(i, j int) bool { return depths[garbage[i].ID] > depths[garbage[j].ID] })
+
+	return garbage
+}
+
+// Garbage returns the images in the docker daemon which are unreachable: not
+// tagged or pulled by digest, not in the build cache, not used by a container,
+// and not the parent of an image which is any of these. Children come before
+// their parents.
+func Garbage(ctx context.Context, docker *client.Client) ([]Image, error) {
+	images, refs, err := listImages(ctx, docker)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := Entries(ctx, docker)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := map[string]bool{}
+	for _, entry := range entries {
+		cached[entry.ID] = true
+	}
+
+	for i, img := range images {
+		images[i].Root = refs.tagged[img.ID] || refs.used[img.ID] || cached[img.ID]
+	}
+
+	return Unreachable(images), nil
+}
+
+// DanglingOptions selects the images Dangling returns.
+type DanglingOptions struct {
+	All   bool      // also select tagged images no container uses
+	Until time.Time // if set, only select images created before it
+}
+
+// ParseDanglingFilter sets the option a filter of box prune gives. The only
+// filter is until=, a duration before now, such as 24h, or an RFC 3339 time.
+func ParseDanglingFilter(filter string, opts *DanglingOptions, now time.Time) error {
+	parts := strings.SplitN(filter, "=", 2)
+	if len(parts) != 2 || parts[0] != "until" {
+		return fmt.Errorf("invalid filter %q: must be until=<duration or time>", filter)
+	}
+
+	if d, err := time.ParseDuration(parts[1]); err == nil {
+		opts.Until = now.Add(-d)
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid filter %q: %q is neither a duration nor an RFC 3339 time", filter, parts[1])
+	}
+
+	opts.Until = t
+	return nil
+}
+
+// Dangling returns the images in the docker daemon which are untagged and not
+// used by a container, nor the parent of an image which is either, with the
+// options. Unlike Garbage, build cache steps are dangling unless an image
+// built on them is kept. Children come before their parents.
+func Dangling(ctx context.Context, docker *client.Client, opts DanglingOptions) ([]Image, error) {
+	images, refs, err := listImages(ctx, docker)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectDangling(images, refs, opts), nil
+}
+
+func selectDangling(images []Image, refs imageRefs, opts DanglingOptions) []Image {
+	for i, img := range images {
+		images[i].Root = refs.used[img.ID] ||
+			(refs.tagged[img.ID] && !opts.All) ||
+			(!opts.Until.IsZero() && img.Created.After(opts.Until))
+	}
+
+	return Unreachable(images)
+}
+
+// imageRefs is what refers to the images in the docker daemon, by ID.
+type imageRefs struct {
+	tagged map[string]bool // tagged or pulled by digest
+	used   map[string]bool // used by a container
+}
+
+// listImages returns the images in the docker daemon, none of them roots, and
+// what refers to them.
+func listImages(ctx context.Context, docker *client.Client) ([]Image, imageRefs, error) {
+	refs := imageRefs{tagged: map[string]bool{}, used: map[string]bool{}}
+
+	summaries, err := docker.ImageList(ctx, types.ImageListOptions{All: true})
+	if err != nil {
+		return nil, refs, err
+	}
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, refs, err
+	}
+
+	for _, container := range containers {
+		refs.used[container.ImageID] = true
+	}
+
+	sizes := map[string]int64{}
+	for _, summary := range summaries {
+		sizes[summary.ID] = summary.Size
+	}
+
+	images := []Image{}
+	for _, summary := range summaries {
+		images = append(images, Image{
+			ID:      summary.ID,
+			Parent:  summary.ParentID,
+			Size:    summary.Size - sizes[summary.ParentID],
+			Created: time.Unix(summary.Created, 0),
+		})
+
+		for _, ref := range append(summary.RepoTags, summary.RepoDigests...) {
+			if ref != "<none>:<none>" && ref != "<none>@<none>" {
+				refs.tagged[summary.ID] = true
+			}
+		}
+	}
+
+	return images, refs, nil
+}
+
+// RemoveImages removes the images, in order. Images which docker refuses to
+// remove, because they have been tagged or used since they were listed, are
+// skipped; with force, tagged images are untagged and removed. It returns the
+// images which were removed.
+func RemoveImages(ctx context.Context, docker *client.Client, images []Image, force bool) ([]Image, error) {
+	removed := []Image{}
+
+	for _, img := range images {
+		if _, err := docker.ImageRemove(ctx, img.ID, types.ImageRemoveOptions{Force: force}); err != nil {
+			if client.IsErrImageNotFound(err) || strings.Contains(err.Error(), "conflict") {
+				continue
+			}
+
+			audit.Record(audit.Delete, img.ID, img.ID, err)
+			return removed, err
+		}
+
+		audit.Record(audit.Delete, img.ID, img.ID, nil)
+
+		removed = append(removed, img)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func imageIDs(images []Image) string {
+	var str string
+	for _, img := range images {
+		str += img.ID
+	}
+	return str
+}
+
+func (cs *cacheSuite) TestUnreachable(c *C) {
+	// a <- b <- c (tagged), b <- d <- e, f <- g, h (in use)
+	images := []Image{
+		{ID: "a"},
+		{ID: "b", Parent: "a"},
+		{ID: "c", Parent: "b", Root: true},
+		{ID: "d", Parent: "b"},
+		{ID: "e", Parent: "d"},
+		{ID: "f"},
+		{ID: "g", Parent: "f"},
+		{ID: "h", Root: true},
+	}
+
+	c.Assert(imageIDs(Unreachable(images)), Equals, "edgf")
+
+	images[4].Root = true
+	c.Assert(imageIDs(Unreachable(images)), Equals, "gf")
+
+	c.Assert(imageIDs(Unreachable(nil)), Equals, "")
+}
+
+func (cs *cacheSuite) TestSelectDangling(c *C) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	// a <- b (tagged) <- c, d (in use), e (tagged), f (new)
+	images := func() []Image {
+		return []Image{
+			{ID: "a", Created: old},
+			{ID: "b", Parent: "a", Created: old},
+			{ID: "c", Parent: "b", Created: old},
+			{ID: "d", Created: old},
+			{ID: "e", Created: old},
+			{ID: "f", Created: now},
+		}
+	}
+	refs := imageRefs{
+		tagged: map[string]bool{"b": true, "e": true},
+		used:   map[string]bool{"d": true},
+	}
+
+	c.Assert(imageIDs(selectDangling(images(), refs, DanglingOptions{})), Equals, "cf")
+	c.Assert(imageIDs(selectDangling(images(), refs, DanglingOptions{All: true})), Equals, "cbaef")
+
+	opts := DanglingOptions{}
+	c.Assert(ParseDanglingFilter("until=24h", &opts, now), IsNil)
+	c.Assert(opts.Until.Equal(now.Add(-24*time.Hour)), Equals, true)
+	c.Assert(imageIDs(selectDangling(images(), refs, opts)), Equals, "c")
+
+	c.Assert(ParseDanglingFilter("until=2017-01-02T15:04:05Z", &opts, now), IsNil)
+	c.Assert(opts.Until.Equal(time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)), Equals, true)
+
+	c.Assert(ParseDanglingFilter("label=foo", &opts, now), NotNil)
+	c.Assert(ParseDanglingFilter("until=yesterday", &opts, now), NotNil)
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcs authorizes its requests with an OAuth2 access token: the one in
+// GOOGLE_OAUTH_ACCESS_TOKEN, or one obtained for the service account in
+// GOOGLE_APPLICATION_CREDENTIALS.
+type gcs struct {
+	token   string
+	expires time.Time
+	account *serviceAccount
+	mutex   sync.Mutex
+}
+
+// serviceAccount is the part of a service account key file needed to obtain
+// tokens.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// newGCS opens gs://bucket/prefix. ?endpoint= selects another endpoint for
+// the XML API.
+func newGCS(u *url.URL) (Backend, error) {
+	g := &gcs{token: os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")}
+
+	if g.token == "" {
+		fn := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		if fn == "" {
+			return nil, errors.New("GOOGLE_OAUTH_ACCESS_TOKEN or GOOGLE_APPLICATION_CREDENTIALS must be set to use a gs cache")
+		}
+
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		g.account = &serviceAccount{}
+		if err := json.Unmarshal(content, g.account); err != nil {
+			return nil, err
+		}
+
+		if g.account.TokenURI == "" {
+			g.account.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+
+	bucket, prefix := u.Host, u.Path
+
+	return &httpBackend{
+		client: http.DefaultClient,
+		url: func(name string) string {
+			return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, objectPath(prefix, name))
+		},
+		sign: g.sign,
+	}, nil
+}
+
+func (g *gcs) sign(req *http.Request) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.account != nil && time.Now().After(g.expires) {
+		if err := g.refresh(); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	return nil
+}
+
+// refresh obtains a token for the service account, by exchanging a JWT signed
+// with its key.
+func (g *gcs) refresh() error {
+	block, _ := pem.Decode([]byte(g.account.PrivateKey))
+	if block == nil {
+		return errors.New("the service account has no private key")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("the service account key is not an RSA key")
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   g.account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   g.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.PostForm(g.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError("POST", g.account.TokenURI, resp)
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	g.token = token.AccessToken
+	// renew a minute early, so a token does not expire during a request.
+	g.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return nil
+}
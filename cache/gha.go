@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ghaChunkSize is the size of the chunks uploaded to version 1 of the cache
+// service, which takes them in parts.
+const ghaChunkSize = 32 << 20
+
+// ghaVersion is the version of the entries box keeps, which the cache service
+// matches along with their keys; it keeps them apart from the caches of the
+// actions.
+var ghaVersion = fmt.Sprintf("%x", sha256.Sum256([]byte("box-builder cache 1")))
+
+// gha keeps objects in the cache of GitHub Actions, as entries named after
+// them. Entries can't be replaced, so an object stored already is left as it
+// is. It speaks version 2 of the cache service when ACTIONS_CACHE_SERVICE_V2
+// is set, as the runner sets it, and version 1 otherwise.
+type gha struct {
+	client *http.Client
+	token  string
+	url    string
+	v2     bool
+	prefix string
+}
+
+// newGHA opens gha://scope/prefix, with the token and the URL of the cache
+// service the runner gives the actions: ACTIONS_RUNTIME_TOKEN, and
+// ACTIONS_RESULTS_URL or ACTIONS_CACHE_URL.
+func newGHA(u *url.URL) (Backend, error) {
+	g := &gha{
+		client: http.DefaultClient,
+		token:  os.Getenv("ACTIONS_RUNTIME_TOKEN"),
+		prefix: objectPath(u.Host, u.Path),
+	}
+
+	g.v2, _ = strconv.ParseBool(os.Getenv("ACTIONS_CACHE_SERVICE_V2"))
+	if g.v2 {
+		g.url = os.Getenv("ACTIONS_RESULTS_URL")
+	} else {
+		g.url = os.Getenv("ACTIONS_CACHE_URL")
+	}
+
+	if g.token == "" || g.url == "" {
+		return nil, errors.New("ACTIONS_RUNTIME_TOKEN, and ACTIONS_RESULTS_URL or ACTIONS_CACHE_URL, must be set to use a gha cache")
+	}
+
+	if !strings.HasSuffix(g.url, "/") {
+		g.url += "/"
+	}
+
+	return g, nil
+}
+
+// call makes a request of the cache service, with the content as JSON, and
+// decodes what it returns into out. It returns the status of the response.
+func (g *gha) call(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, g.url+path, body)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("Content-Type", "application/json")
+	if !g.v2 {
+		req.Header.Set("Accept", "application/json;api-version=6.0-preview.1")
+	}
+
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil
+	case resp.StatusCode/100 != 2:
+		return resp.StatusCode, statusError(method, path, resp)
+	case out != nil:
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	default:
+		return resp.StatusCode, nil
+	}
+}
+
+func (g *gha) twirp(ctx context.Context, method string, in, out interface{}) error {
+	_, err := g.call(ctx, "POST", "twirp/github.actions.results.api.v1.CacheService/"+method, in, out)
+	return err
+}
+
+// lookup returns the URL the entry of the object is downloaded from, or ""
+// if there is none.
+func (g *gha) lookup(ctx context.Context, name string) (string, error) {
+	key := objectPath(g.prefix, name)
+
+	if g.v2 {
+		var entry struct {
+			OK         bool   `json:"ok"`
+			URL        string `json:"signed_download_url"`
+			MatchedKey string `json:"matched_key"`
+		}
+
+		if err := g.twirp(ctx, "GetCacheEntryDownloadURL", map[string]interface{}{"key": key, "restore_keys": []string{}, "version": ghaVersion}, &entry); err != nil {
+			return "", err
+		}
+
+		if !entry.OK || entry.MatchedKey != key {
+			return "", nil
+		}
+
+		return entry.URL, nil
+	}
+
+	var entry struct {
+		Key      string `json:"cacheKey"`
+		Location string `json:"archiveLocation"`
+	}
+
+	query := url.Values{"keys": {key}, "version": {ghaVersion}}
+	status, err := g.call(ctx, "GET", "_apis/artifactcache/cache?"+query.Encode(), nil, &entry)
+	if err != nil || status == http.StatusNoContent || entry.Key != key {
+		return "", err
+	}
+
+	return entry.Location, nil
+}
+
+func (g *gha) Exists(ctx context.Context, name string) (bool, error) {
+	location, err := g.lookup(ctx, name)
+	return location != "", err
+}
+
+func (g *gha) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	location, err := g.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if location == "" {
+		return nil, ErrNotFound
+	}
+
+	// the location is signed, so it takes no token.
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, statusError("GET", name, resp)
+	}
+
+	return resp.Body, nil
+}
+
+func (g *gha) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if g.v2 {
+		return g.putV2(ctx, objectPath(g.prefix, name), content, size)
+	}
+
+	return g.putV1(ctx, objectPath(g.prefix, name), content, size)
+}
+
+func (g *gha) putV2(ctx context.Context, key string, content io.Reader, size int64) error {
+	var entry struct {
+		OK  bool   `json:"ok"`
+		URL string `json:"signed_upload_url"`
+	}
+
+	if err := g.twirp(ctx, "CreateCacheEntry", map[string]interface{}{"key": key, "version": ghaVersion}, &entry); err != nil {
+		return err
+	}
+
+	// another build stored it first.
+	if !entry.OK {
+		return nil
+	}
+
+	// the entry is an azure blob, uploaded at once.
+	req, err := http.NewRequest("PUT", entry.URL, ioutil.NopCloser(content))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", "2020-10-02")
+
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return statusError("PUT", key, resp)
+	}
+
+	var finalized struct {
+		OK bool `json:"ok"`
+	}
+
+	if err := g.twirp(ctx, "FinalizeCacheEntryUpload", map[string]interface{}{"key": key, "version": ghaVersion, "size_bytes": strconv.FormatInt(size, 10)}, &finalized); err != nil {
+		return err
+	}
+
+	if !finalized.OK {
+		return fmt.Errorf("the cache entry %s could not be finalized", key)
+	}
+
+	return nil
+}
+
+func (g *gha) putV1(ctx context.Context, key string, content io.Reader, size int64) error {
+	var reserved struct {
+		ID int64 `json:"cacheId"`
+	}
+
+	status, err := g.call(ctx, "POST", "_apis/artifactcache/caches", map[string]interface{}{"key": key, "version": ghaVersion, "cacheSize": size}, &reserved)
+	if err != nil {
+		return err
+	}
+
+	// another build stored it, or is storing it.
+	if status == http.StatusConflict {
+		return nil
+	}
+
+	path := fmt.Sprintf("%s_apis/artifactcache/caches/%d", g.url, reserved.ID)
+
+	for offset := int64(0); offset < size; offset += ghaChunkSize {
+		n := size - offset
+		if n > ghaChunkSize {
+			n = ghaChunkSize
+		}
+
+		req, err := http.NewRequest("PATCH", path, ioutil.NopCloser(io.LimitReader(content, n)))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Header.Set("Authorization", "Bearer "+g.token)
+		req.Header.Set("Accept", "application/json;api-version=6.0-preview.1")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+n-1))
+
+		resp, err := g.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode/100 != 2 {
+			defer resp.Body.Close()
+			return statusError("PATCH", key, resp)
+		}
+		resp.Body.Close()
+	}
+
+	_, err = g.call(ctx, "POST", fmt.Sprintf("_apis/artifactcache/caches/%d", reserved.ID), map[string]interface{}{"size": size}, nil)
+	return err
+}
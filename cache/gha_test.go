@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// ghaServer is a cache service of GitHub Actions, of both versions, which
+// keeps entries in memory, and the blobs they are uploaded to and downloaded
+// from.
+type ghaServer struct {
+	url      string
+	entries  map[string][]byte // by key and version
+	pending  map[string]string // the entries being uploaded, by id or blob
+	blobs    map[string][]byte
+	versions map[string]bool
+	mutex    sync.Mutex
+}
+
+func (g *ghaServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	content, _ := ioutil.ReadAll(req.Body)
+
+	if strings.HasPrefix(req.URL.Path, "/blob/") {
+		g.serveBlob(w, req, content)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer runtime-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body := map[string]interface{}{}
+	json.Unmarshal(content, &body)
+	if version, ok := body["version"].(string); ok {
+		g.versions[version] = true
+	}
+	key := fmt.Sprint(body["key"]) + "@" + fmt.Sprint(body["version"])
+
+	if strings.HasPrefix(req.URL.Path, "/_apis/") {
+		g.serveV1(w, req, content, key)
+		return
+	}
+
+	g.serveV2(w, req.URL.Path, body, key)
+}
+
+// serveBlob stores the blobs uploaded, and serves the entries.
+func (g *ghaServer) serveBlob(w http.ResponseWriter, req *http.Request, content []byte) {
+	switch req.Method {
+	case "PUT":
+		g.blobs[req.URL.Path] = content
+	case "GET":
+		entry, ok := g.entries[strings.TrimPrefix(req.URL.Path, "/blob/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write(entry)
+	}
+}
+
+// serveV2 serves the twirp API of the version 2 of the cache service.
+func (g *ghaServer) serveV2(w http.ResponseWriter, path string, body map[string]interface{}, key string) {
+	reply := json.NewEncoder(w).Encode
+
+	switch {
+	case strings.HasSuffix(path, "/GetCacheEntryDownloadURL"):
+		if _, ok := g.entries[key]; !ok {
+			reply(map[string]interface{}{"ok": false})
+			return
+		}
+		reply(map[string]interface{}{"ok": true, "signed_download_url": g.url + "/blob/" + key, "matched_key": body["key"]})
+	case strings.HasSuffix(path, "/CreateCacheEntry"):
+		if _, ok := g.entries[key]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		g.pending["/blob/upload/"+key] = key
+		reply(map[string]interface{}{"ok": true, "signed_upload_url": g.url + "/blob/upload/" + key})
+	case strings.HasSuffix(path, "/FinalizeCacheEntryUpload"):
+		blob := g.blobs["/blob/upload/"+key]
+		if size, _ := strconv.Atoi(fmt.Sprint(body["size_bytes"])); size != len(blob) {
+			reply(map[string]interface{}{"ok": false})
+			return
+		}
+		g.entries[key] = blob
+		reply(map[string]interface{}{"ok": true, "entry_id": "1"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveV1 serves the REST API of the version 1 of the cache service.
+func (g *ghaServer) serveV1(w http.ResponseWriter, req *http.Request, content []byte, key string) {
+	reply := json.NewEncoder(w).Encode
+
+	switch path := req.URL.Path; {
+	case path == "/_apis/artifactcache/cache":
+		key = req.URL.Query().Get("keys") + "@" + req.URL.Query().Get("version")
+		g.versions[req.URL.Query().Get("version")] = true
+		if _, ok := g.entries[key]; !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		reply(map[string]interface{}{"cacheKey": req.URL.Query().Get("keys"), "archiveLocation": g.url + "/blob/" + key})
+	case path == "/_apis/artifactcache/caches":
+		if _, ok := g.entries[key]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		id := strconv.Itoa(len(g.pending) + 1)
+		g.pending[id] = key
+		reply(map[string]interface{}{"cacheId": len(g.pending)})
+	case strings.HasPrefix(path, "/_apis/artifactcache/caches/"):
+		id := strings.TrimPrefix(path, "/_apis/artifactcache/caches/")
+		if req.Method == "PATCH" {
+			g.blobs[id] = append(g.blobs[id], content...)
+			return
+		}
+		g.entries[g.pending[id]] = g.blobs[id]
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (cs *cacheSuite) TestGHABackend(c *C) {
+	for _, v2 := range []bool{false, true} {
+		server := &ghaServer{
+			entries:  map[string][]byte{},
+			pending:  map[string]string{},
+			blobs:    map[string][]byte{},
+			versions: map[string]bool{},
+		}
+		ts := httptest.NewServer(server)
+		server.url = ts.URL
+
+		env := map[string]string{"ACTIONS_RUNTIME_TOKEN": "runtime-token"}
+		if v2 {
+			env["ACTIONS_CACHE_SERVICE_V2"] = "true"
+			env["ACTIONS_RESULTS_URL"] = ts.URL
+		} else {
+			env["ACTIONS_CACHE_URL"] = ts.URL + "/"
+		}
+
+		for name, value := range env {
+			os.Setenv(name, value)
+		}
+
+		c.Assert(IsBackend("gha://myapp"), Equals, true)
+		backend, err := OpenBackend("gha://myapp")
+		c.Assert(err, IsNil)
+
+		ctx := context.Background()
+		ok, err := backend.Exists(ctx, "keys/abc.json")
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, false)
+
+		_, err = backend.Get(ctx, "keys/abc.json")
+		c.Assert(err, Equals, ErrNotFound)
+
+		c.Assert(backend.Put(ctx, "keys/abc.json", bytes.NewReader([]byte("content"))), IsNil)
+		c.Assert(server.entries["myapp/keys/abc.json@"+ghaVersion], DeepEquals, []byte("content"), Commentf("v2: %v", v2))
+
+		// entries can't be replaced; the one stored is kept.
+		c.Assert(backend.Put(ctx, "keys/abc.json", bytes.NewReader([]byte("other"))), IsNil)
+
+		ok, err = backend.Exists(ctx, "keys/abc.json")
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		rc, err := backend.Get(ctx, "keys/abc.json")
+		c.Assert(err, IsNil)
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(content), Equals, "content")
+		c.Assert(server.versions, DeepEquals, map[string]bool{ghaVersion: true})
+
+		for name := range env {
+			os.Unsetenv(name)
+		}
+		ts.Close()
+	}
+
+	_, err := OpenBackend("gha://myapp")
+	c.Assert(err, ErrorMatches, "ACTIONS_RUNTIME_TOKEN, and ACTIONS_RESULTS_URL or ACTIONS_CACHE_URL, must be set to use a gha cache")
+}
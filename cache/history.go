@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// HistoryEntry is an entry in the history of an image. Steps committed by box
+// keep their cache key in the comment.
+type HistoryEntry struct {
+	Created    time.Time `json:"created,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// History is the history of an image and the layers it was built from, oldest
+// first.
+type History struct {
+	Entries []HistoryEntry
+	Layers  []string
+}
+
+// NewHistory returns the history of an image from its entries and layers,
+// oldest first. It returns an error if the entries do not account for every
+// layer of the image, as happens when an image was edited after it was built;
+// its history can't be used to find the layers of a step.
+func NewHistory(entries []HistoryEntry, layers []string) (*History, error) {
+	var count int
+	for _, entry := range entries {
+		if !entry.EmptyLayer {
+			count++
+		}
+	}
+
+	if count != len(layers) {
+		return nil, errors.New("the image history does not match its layers")
+	}
+
+	return &History{Entries: entries, Layers: layers}, nil
+}
+
+// Find finds the step with the cache key in the history. It returns the
+// number of history entries and layers up to and including the step, or
+// false if the step is not in the history.
+func (h *History) Find(key string) (int, int, bool) {
+	var layers int
+
+	for i, entry := range h.Entries {
+		if !entry.EmptyLayer {
+			layers++
+		}
+
+		if entry.Comment == key {
+			return i + 1, layers, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Layer is an entry of the history of an image docker has, with the step of a
+// plan which built it, if box did.
+type Layer struct {
+	ID        string        `json:"id,omitempty"` // the image of the entry, if docker has it
+	Created   time.Time     `json:"created"`
+	CreatedBy string        `json:"created_by"`
+	Size      int64         `json:"size"`
+	Tags      []string      `json:"tags,omitempty"`
+	Key       string        `json:"cache_key,omitempty"`  // the cache key of the step
+	Step      string        `json:"step,omitempty"`       // the verb and arguments of the step, if it was built on this machine
+	BuildTime time.Duration `json:"build_time,omitempty"` // how long the step took, if it was built on this machine
+}
+
+// ImageHistory returns the history of an image docker has, newest first. The
+// steps box built are found by the cache key kept in the history, and
+// described with the statistics of the builds on this machine.
+func ImageHistory(ctx context.Context, docker *client.Client, name string) ([]Layer, error) {
+	history, err := docker.ImageHistory(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := LoadStats()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []Layer{}
+
+	for _, entry := range history {
+		layer := Layer{
+			Created:   time.Unix(entry.Created, 0),
+			CreatedBy: entry.CreatedBy,
+			Size:      entry.Size,
+			Tags:      entry.Tags,
+		}
+
+		if entry.ID != "<missing>" {
+			layer.ID = entry.ID
+		}
+
+		if strings.HasPrefix(entry.Comment, Prefix) {
+			layer.Key = entry.Comment
+			layer.Step = stats.Steps[entry.Comment]
+			layer.BuildTime = stats.Durations[entry.Comment]
+		}
+
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
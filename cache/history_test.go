@@ -0,0 +1,38 @@
+package cache
+
+import . "gopkg.in/check.v1"
+
+func (cs *cacheSuite) TestHistory(c *C) {
+	entries := []HistoryEntry{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:abc in / "},
+		{CreatedBy: `/bin/sh -c #(nop)  CMD ["sh"]`, EmptyLayer: true},
+		{Comment: "box:sha256:one"},
+		{Comment: "box:sha256:two", EmptyLayer: true},
+		{Comment: "box:sha256:three"},
+	}
+
+	history, err := NewHistory(entries, []string{"sha256:a", "sha256:b", "sha256:c"})
+	c.Assert(err, IsNil)
+
+	found, layers, ok := history.Find("box:sha256:one")
+	c.Assert(ok, Equals, true)
+	c.Assert(found, Equals, 3)
+	c.Assert(layers, Equals, 2)
+
+	found, layers, ok = history.Find("box:sha256:two")
+	c.Assert(ok, Equals, true)
+	c.Assert(found, Equals, 4)
+	c.Assert(layers, Equals, 2)
+
+	found, layers, ok = history.Find("box:sha256:three")
+	c.Assert(ok, Equals, true)
+	c.Assert(found, Equals, 5)
+	c.Assert(layers, Equals, 3)
+
+	_, _, ok = history.Find("box:sha256:four")
+	c.Assert(ok, Equals, false)
+
+	// a layer was removed from the image after it was built.
+	_, err = NewHistory(entries, []string{"sha256:a", "sha256:b"})
+	c.Assert(err, NotNil)
+}
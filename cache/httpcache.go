@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// newHTTP opens http://host/prefix or https://host/prefix: a server which
+// keeps objects at their URLs, with GET, HEAD and PUT, as the HTTP caches of
+// bazel and gradle do. The user and password of the URL, or the bearer token
+// in BOX_CACHE_TOKEN, authorize its requests.
+func newHTTP(u *url.URL) (Backend, error) {
+	user := u.User
+	token := os.Getenv("BOX_CACHE_TOKEN")
+
+	base := *u
+	base.User = nil
+	base.RawQuery = ""
+	prefix := strings.TrimSuffix(base.String(), "/")
+
+	return &httpBackend{
+		client: http.DefaultClient,
+		url: func(name string) string {
+			return fmt.Sprintf("%s/%s", prefix, objectPath("", name))
+		},
+		sign: func(req *http.Request) error {
+			if user != nil {
+				password, _ := user.Password()
+				req.SetBasicAuth(user.Username(), password)
+			} else if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			return nil
+		},
+	}, nil
+}
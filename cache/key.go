@@ -0,0 +1,64 @@
+// Package cache computes the keys box uses to find the result of a build step
+// in the build cache.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+)
+
+// Prefix is prepended to every key so they are distinguishable from the keys
+// of older versions of box, which are not content-addressed.
+const Prefix = "box:sha256:"
+
+// Key is the set of inputs to a build step. Steps with the same inputs yield
+// the same layer, so the layer a step committed may be re-used by any step with
+// an equal key.
+type Key struct {
+	// Verb is the name of the verb for the step.
+	Verb string
+	// Args are the arguments to the verb.
+	Args []string
+	// Parent is the image the step is run on top of.
+	Parent string
+	// State is the temporary state the step is run with, such as the user or
+	// working directory set by with_user or inside; it is not part of the
+	// parent image.
+	State map[string]string
+	// Inputs are the sums of the content the step reads from outside the
+	// image, such as files copied from the build context.
+	Inputs []string
+}
+
+// Sum returns the key as a string suitable for storing in an image.
+func (k Key) Sum() (string, error) {
+	state := []string{}
+	for key, value := range k.State {
+		if value != "" {
+			state = append(state, key+"="+value)
+		}
+	}
+
+	sort.Strings(state)
+
+	args := k.Args
+	if args == nil {
+		args = []string{}
+	}
+
+	inputs := k.Inputs
+	if inputs == nil {
+		inputs = []string{}
+	}
+
+	// json encoding is unambiguous for arbitrary strings, unlike joining them.
+	content, err := json.Marshal([]interface{}{k.Verb, args, k.Parent, state, inputs})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return Prefix + hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"strings"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type cacheSuite struct{}
+
+var _ = Suite(&cacheSuite{})
+
+func TestCache(t *T) {
+	TestingT(t)
+}
+
+// keySum returns the sum of the key, asserting it could be computed.
+func keySum(c *C, k Key) string {
+	sum, err := k.Sum()
+	c.Assert(err, IsNil)
+	return sum
+}
+
+func (cs *cacheSuite) TestKeySum(c *C) {
+	base := Key{Verb: "run", Args: []string{"ls"}, Parent: "sha256:abc"}
+
+	c.Assert(strings.HasPrefix(keySum(c, base), Prefix), Equals, true)
+	c.Assert(keySum(c, base), Equals, keySum(c, Key{Verb: "run", Args: []string{"ls"}, Parent: "sha256:abc", State: map[string]string{"user": ""}, Inputs: []string{}}))
+
+	different := []Key{
+		{Verb: "cmd", Args: []string{"ls"}, Parent: "sha256:abc"},
+		{Verb: "run", Args: []string{"ls", "-l"}, Parent: "sha256:abc"},
+		{Verb: "run", Args: []string{"ls"}, Parent: "sha256:def"},
+		{Verb: "run", Args: []string{"ls"}, Parent: "sha256:abc", State: map[string]string{"user": "nobody"}},
+		{Verb: "run", Args: []string{"ls"}, Parent: "sha256:abc", Inputs: []string{"1234"}},
+		// joining the arguments would make this equal to base.
+		{Verb: "run", Args: []string{"l", "s"}, Parent: "sha256:abc"},
+	}
+
+	seen := map[string]bool{keySum(c, base): true}
+	for _, key := range different {
+		c.Assert(seen[keySum(c, key)], Equals, false, Commentf("%+v", key))
+		seen[keySum(c, key)] = true
+	}
+
+	state := map[string]string{"user": "nobody", "workdir": "/tmp"}
+	c.Assert(keySum(c, Key{State: state}), Equals, keySum(c, Key{State: map[string]string{"workdir": "/tmp", "user": "nobody"}}))
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/util"
+	"golang.org/x/sys/unix"
+)
+
+// lockPollInterval is how often a held lock is retried.
+const lockPollInterval = 100 * time.Millisecond
+
+// Lock is an exclusive lock on a cache key, held while the step for the key is
+// built. A build of the same step in another process waits for the lock, and
+// then finds the layer the first build committed in the cache.
+type Lock struct {
+	f *os.File
+}
+
+// LockDir returns the directory the lock files are kept in.
+func LockDir() string {
+	return util.BoxDir("locks")
+}
+
+func lockFile(key string) string {
+	name := strings.TrimPrefix(key, Prefix)
+	if name == key {
+		sum := sha256.Sum256([]byte(key))
+		name = hex.EncodeToString(sum[:])
+	}
+
+	return filepath.Join(LockDir(), name)
+}
+
+func openLock(key string) (*os.File, error) {
+	if err := os.MkdirAll(LockDir(), 0700); err != nil {
+		return nil, err
+	}
+
+	// the files are never removed; removing a file another process has open
+	// would let a third lock a new file of the same name.
+	return os.OpenFile(lockFile(key), os.O_CREATE|os.O_RDWR, 0600)
+}
+
+// TryLock locks the key if it is not locked by anything else, and returns nil
+// if it is.
+func TryLock(key string) (*Lock, error) {
+	f, err := openLock(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &Lock{f: f}, nil
+}
+
+// Acquire locks the key, waiting for anything else holding it until the
+// context is done.
+func Acquire(ctx context.Context, key string) (*Lock, error) {
+	for {
+		lock, err := TryLock(key)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	defer l.f.Close()
+	return unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (cs *cacheSuite) TestLock(c *C) {
+	dir, err := ioutil.TempDir("", "box-lock")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("BOX_HOME", dir)
+	defer os.Unsetenv("BOX_HOME")
+
+	key := keySum(c, Key{Verb: "run", Args: []string{"true"}})
+
+	lock, err := Acquire(context.Background(), key)
+	c.Assert(err, IsNil)
+	c.Assert(lock, NotNil)
+
+	// flock locks are per open file, so a second lock in this process
+	// contends like another build would.
+	other, err := TryLock(key)
+	c.Assert(err, IsNil)
+	c.Assert(other, IsNil)
+
+	// other keys are not held.
+	other, err = TryLock(keySum(c, Key{Verb: "run", Args: []string{"false"}}))
+	c.Assert(err, IsNil)
+	c.Assert(other, NotNil)
+	c.Assert(other.Release(), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = Acquire(ctx, key)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	acquired := make(chan error)
+	go func() {
+		lock, err := Acquire(context.Background(), key)
+		if err == nil {
+			err = lock.Release()
+		}
+		acquired <- err
+	}()
+
+	time.Sleep(2 * lockPollInterval)
+	c.Assert(lock.Release(), IsNil)
+
+	select {
+	case err := <-acquired:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("lock was not acquired after it was released")
+	}
+}
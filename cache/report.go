@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/box-builder/box/util"
+)
+
+// Reasons a step missed the cache.
+const (
+	ReasonDisabled = "cache disabled"
+	ReasonNoCache  = "no_cache set"
+	ReasonParent   = "a previous step was rebuilt"
+	ReasonNew      = "not in cache"
+)
+
+// Step is the result of looking up a step in the cache.
+type Step struct {
+	Step     string        // the verb and its arguments
+	Key      string        // the cache key of the step
+	Hit      bool          // whether the step was found in the cache
+	Reason   string        // why the step missed the cache
+	Duration time.Duration // how long the step took to build, if it missed
+	Saved    time.Duration // how long the step took when it was built, if it hit
+}
+
+// Report is the cache report for a build.
+type Report struct {
+	Steps []Step
+
+	reused map[string]bool
+	mutex  sync.Mutex
+}
+
+// Reuse records that the step with the cache key re-used the layers of a cache
+// image once it had started. Add counts it as a hit.
+func (r *Report) Reuse(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.reused == nil {
+		r.reused = map[string]bool{}
+	}
+
+	r.reused[key] = true
+}
+
+// Add adds a step to the report. If a step missed without a reason, it is
+// given one.
+func (r *Report) Add(step Step) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.reused[step.Key] {
+		step.Hit = true
+		step.Reason = ""
+		step.Duration = 0
+	}
+
+	if !step.Hit && step.Reason == "" {
+		step.Reason = ReasonNew
+		for _, prev := range r.Steps {
+			if !prev.Hit {
+				step.Reason = ReasonParent
+				break
+			}
+		}
+	}
+
+	r.Steps = append(r.Steps, step)
+}
+
+// Counts returns the number of hits and misses in the report, and the time
+// the hits saved.
+func (r *Report) Counts() (int, int, time.Duration) {
+	var hits, misses int
+	var saved time.Duration
+
+	for _, step := range r.Steps {
+		if step.Hit {
+			hits++
+			saved += step.Saved
+		} else {
+			misses++
+		}
+	}
+
+	return hits, misses, saved
+}
+
+// Write writes the report as a table.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tRESULT\tREASON\tTIME")
+
+	for _, step := range r.Steps {
+		if step.Hit {
+			var saved string
+			if step.Saved > 0 {
+				saved = "saved " + step.Saved.String()
+			}
+
+			fmt.Fprintf(tw, "%s\thit\t\t%s\n", step.Step, saved)
+		} else {
+			fmt.Fprintf(tw, "%s\tmiss\t%s\t%s\n", step.Step, step.Reason, step.Duration)
+		}
+	}
+
+	hits, misses, saved := r.Counts()
+	fmt.Fprintf(tw, "%d steps: %d hits, %d misses, %s saved\n", len(r.Steps), hits, misses, saved)
+
+	return tw.Flush()
+}
+
+// Stats are the cache statistics of every build on this machine.
+type Stats struct {
+	Builds int
+	Hits   int
+	Misses int
+	Saved  time.Duration
+
+	// Durations are how long each step took to build, by cache key. They are
+	// used to tell how much time a cache hit saved.
+	Durations map[string]time.Duration
+	// Rebuilt counts how many times each step missed the cache.
+	Rebuilt map[string]int
+	// Steps are the steps, as the verb and its arguments, by cache key. They
+	// tell which step of a plan built a layer.
+	Steps map[string]string
+}
+
+// StatsFile returns the path of the file the statistics are kept in.
+func StatsFile() string {
+	return util.BoxDir("cache-stats.json")
+}
+
+// UpdateStats loads the statistics, calls fun with them and saves them. The
+// statistics file is locked in between, so concurrent builds do not lose
+// each other's updates.
+func UpdateStats(fun func(*Stats)) error {
+	lock, err := TryLock(StatsFile())
+	for err == nil && lock == nil {
+		time.Sleep(lockPollInterval)
+		lock, err = TryLock(StatsFile())
+	}
+
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	stats, err := LoadStats()
+	if err != nil {
+		return err
+	}
+
+	fun(stats)
+
+	content, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(StatsFile()), 0700); err != nil {
+		return err
+	}
+
+	// write and rename so readers never see a partial file.
+	f, err := ioutil.TempFile(filepath.Dir(StatsFile()), "cache-stats")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), StatsFile())
+}
+
+// LoadStats loads the statistics.
+func LoadStats() (*Stats, error) {
+	stats := &Stats{}
+
+	content, err := ioutil.ReadFile(StatsFile())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(content, stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if stats.Durations == nil {
+		stats.Durations = map[string]time.Duration{}
+	}
+
+	if stats.Rebuilt == nil {
+		stats.Rebuilt = map[string]int{}
+	}
+
+	if stats.Steps == nil {
+		stats.Steps = map[string]string{}
+	}
+
+	return stats, nil
+}
+
+// Record fills in the time each hit in the report saved, then adds the report
+// to the statistics.
+func (s *Stats) Record(r *Report) {
+	s.Builds++
+
+	for i, step := range r.Steps {
+		s.Steps[step.Key] = step.Step
+
+		if step.Hit {
+			r.Steps[i].Saved = s.Durations[step.Key]
+			s.Hits++
+			s.Saved += r.Steps[i].Saved
+		} else {
+			s.Misses++
+			s.Rebuilt[step.Step]++
+
+			if step.Duration > 0 {
+				s.Durations[step.Key] = step.Duration
+			}
+		}
+	}
+}
+
+// MostRebuilt returns up to n of the steps which missed the cache most often,
+// most often first.
+func (s *Stats) MostRebuilt(n int) []string {
+	steps := []string{}
+	for step := range s.Rebuilt {
+		steps = append(steps, step)
+	}
+
+	sort.Slice(steps, func(i, j int) bool {
+		if s.Rebuilt[steps[i]] == s.Rebuilt[steps[j]] {
+			return steps[i] < steps[j]
+		}
+
+		return s.Rebuilt[steps[i]] > s.Rebuilt[steps[j]]
+	})
+
+	if len(steps) > n {
+		steps = steps[:n]
+	}
+
+	return steps
+}
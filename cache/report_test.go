@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (cs *cacheSuite) TestReport(c *C) {
+	dir, err := ioutil.TempDir("", "box-stats")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("BOX_HOME", dir)
+	defer os.Unsetenv("BOX_HOME")
+
+	first := &Report{}
+	first.Add(Step{Step: "run apt-get update", Key: "a", Duration: 10 * time.Second})
+	first.Add(Step{Step: "run make", Key: "b", Duration: 5 * time.Second})
+	c.Assert(first.Steps[0].Reason, Equals, ReasonNew)
+	c.Assert(first.Steps[1].Reason, Equals, ReasonParent)
+
+	c.Assert(UpdateStats(func(stats *Stats) { stats.Record(first) }), IsNil)
+
+	second := &Report{}
+	second.Add(Step{Step: "run apt-get update", Key: "a", Hit: true})
+	second.Add(Step{Step: "run make", Key: "c", Reason: ReasonNoCache, Duration: 6 * time.Second})
+	c.Assert(second.Steps[1].Reason, Equals, ReasonNoCache)
+
+	c.Assert(UpdateStats(func(stats *Stats) { stats.Record(second) }), IsNil)
+	c.Assert(second.Steps[0].Saved, Equals, 10*time.Second)
+
+	hits, misses, saved := second.Counts()
+	c.Assert(hits, Equals, 1)
+	c.Assert(misses, Equals, 1)
+	c.Assert(saved, Equals, 10*time.Second)
+
+	buf := &bytes.Buffer{}
+	c.Assert(second.Write(buf), IsNil)
+	c.Assert(strings.Contains(buf.String(), "saved 10s"), Equals, true)
+	c.Assert(strings.Contains(buf.String(), ReasonNoCache), Equals, true)
+
+	stats, err := LoadStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Builds, Equals, 2)
+	c.Assert(stats.Hits, Equals, 1)
+	c.Assert(stats.Misses, Equals, 3)
+	c.Assert(stats.Saved, Equals, 10*time.Second)
+	c.Assert(stats.MostRebuilt(1), DeepEquals, []string{"run make"})
+	c.Assert(stats.Steps, DeepEquals, map[string]string{"a": "run apt-get update", "b": "run make", "c": "run make"})
+}
+
+func (cs *cacheSuite) TestReportReuse(c *C) {
+	report := &Report{}
+	report.Reuse("b")
+	report.Add(Step{Step: "run apt-get update", Key: "a", Duration: time.Second})
+	report.Add(Step{Step: "run make", Key: "b", Duration: time.Second})
+
+	c.Assert(report.Steps[0].Hit, Equals, false)
+	c.Assert(report.Steps[1].Hit, Equals, true)
+	c.Assert(report.Steps[1].Reason, Equals, "")
+	c.Assert(report.Steps[1].Duration, Equals, time.Duration(0))
+}
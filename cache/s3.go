@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3 signs its requests with AWS signature version 4. The payload is not
+// signed, so layers can be streamed.
+type s3 struct {
+	region string
+	key    string
+	secret string
+	token  string
+	now    func() time.Time
+}
+
+// newS3 opens s3://bucket/prefix. The region is taken from ?region=, or
+// AWS_REGION; ?endpoint= selects an S3 compatible service, like minio.
+func newS3(u *url.URL) (Backend, error) {
+	s := &s3{
+		region: u.Query().Get("region"),
+		key:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+		now:    time.Now,
+	}
+
+	if s.key == "" || s.secret == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use an s3 cache")
+	}
+
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if s.region == "" {
+			s.region = os.Getenv(env)
+		}
+	}
+
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+
+	bucket, prefix := u.Host, u.Path
+
+	return &httpBackend{
+		client: http.DefaultClient,
+		url: func(name string) string {
+			return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, objectPath(prefix, name))
+		},
+		sign: s.sign,
+	}, nil
+}
+
+func hmacSHA256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func (s *s3) sign(req *http.Request) error {
+	now := s.now().UTC()
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	if s.token != "" {
+		req.Header.Set("x-amz-security-token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	sum := sha256.Sum256([]byte(canonical))
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", now.Format("20060102T150405Z"), scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.key, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign)),
+	))
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/audit"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Entry is a step in the build cache: an image in the docker daemon which was
+// committed by a step, and holds its cache key.
+type Entry struct {
+	ID      string
+	Key     string
+	Parent  string
+	Created time.Time
+	Size    int64    // the size of the layer the step added
+	Tags    []string // tags other than those of an imported registry cache
+}
+
+// Referenced is true if the entry is tagged, for example as the result of a
+// build; referenced entries are never pruned.
+func (e Entry) Referenced() bool {
+	return len(e.Tags) > 0
+}
+
+// Entries returns the entries of the build cache, newest first.
+func Entries(ctx context.Context, docker *client.Client) ([]Entry, error) {
+	images, err := docker.ImageList(ctx, types.ImageListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, img := range images {
+		sizes[img.ID] = img.Size
+	}
+
+	entries := []Entry{}
+
+	for _, img := range images {
+		inspect, _, err := docker.ImageInspectWithRaw(ctx, img.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(inspect.Comment, Prefix) {
+			continue
+		}
+
+		entry := Entry{
+			ID:      img.ID,
+			Key:     inspect.Comment,
+			Parent:  img.ParentID,
+			Created: time.Unix(img.Created, 0),
+			Size:    img.Size - sizes[img.ParentID],
+			Tags:    []string{},
+		}
+
+		for _, tag := range img.RepoTags {
+			if tag != "<none>:<none>" && !isCacheTag(tag, inspect.Comment) {
+				entry.Tags = append(entry.Tags, tag)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created.After(entries[j].Created) })
+
+	return entries, nil
+}
+
+// isCacheTag is true if the tag was applied when importing the key from a
+// registry cache.
+func isCacheTag(tag, key string) bool {
+	return strings.HasSuffix(tag, ":"+strings.TrimPrefix(key, Prefix))
+}
+
+// PruneOptions are the policies for pruning the build cache. Without
+// OlderThan or MaxSize, every entry but the KeepLast newest is pruned.
+type PruneOptions struct {
+	KeepLast  int           // never prune the newest KeepLast entries
+	OlderThan time.Duration // prune entries older than this
+	MaxSize   int64         // prune the oldest entries until the cache is no larger than this
+}
+
+// SelectPrune returns the entries to prune according to the options, newest
+// first. entries must be sorted newest first, as Entries returns them. Referenced
+// entries are never selected.
+func SelectPrune(entries []Entry, opts PruneOptions, now time.Time) []Entry {
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	candidates := pruneCandidates(entries, opts.KeepLast)
+	if opts.OlderThan == 0 && opts.MaxSize == 0 {
+		return candidates
+	}
+
+	selected := map[string]bool{}
+
+	if opts.OlderThan > 0 {
+		for _, entry := range candidates {
+			if now.Sub(entry.Created) > opts.OlderThan {
+				selected[entry.ID] = true
+				total -= entry.Size
+			}
+		}
+	}
+
+	if opts.MaxSize > 0 {
+		for i := len(candidates) - 1; i >= 0 && total > opts.MaxSize; i-- {
+			if !selected[candidates[i].ID] {
+				selected[candidates[i].ID] = true
+				total -= candidates[i].Size
+			}
+		}
+	}
+
+	prune := []Entry{}
+	for _, entry := range candidates {
+		if selected[entry.ID] {
+			prune = append(prune, entry)
+		}
+	}
+
+	return prune
+}
+
+// pruneCandidates returns the entries which may be pruned: those after the
+// keepLast newest which are not referenced.
+func pruneCandidates(entries []Entry, keepLast int) []Entry {
+	candidates := []Entry{}
+	for i, entry := range entries {
+		if i >= keepLast && !entry.Referenced() {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	return candidates
+}
+
+// Remove removes the entries from the docker daemon, newest first so children
+// are removed before their parents. Entries which are still in use, by a
+// build, a container, an image built on top of them or a tag, are skipped. It
+// returns the entries which were removed.
+func Remove(ctx context.Context, docker *client.Client, entries []Entry) ([]Entry, error) {
+	removed := []Entry{}
+
+	for _, entry := range entries {
+		// a build holds the lock while it is building or re-using the step.
+		lock, err := TryLock(entry.Key)
+		if err != nil {
+			return removed, err
+		}
+
+		if lock == nil {
+			continue
+		}
+
+		ok, err := remove(ctx, docker, entry)
+		lock.Release()
+		if err != nil {
+			return removed, err
+		}
+
+		if ok {
+			removed = append(removed, entry)
+		}
+	}
+
+	return removed, nil
+}
+
+// remove removes the entry, returning false if it is gone or still in use.
+func remove(ctx context.Context, docker *client.Client, entry Entry) (bool, error) {
+	inspect, _, err := docker.ImageInspectWithRaw(ctx, entry.ID)
+	if err != nil {
+		if client.IsErrImageNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	// the tags of an imported registry cache are removed with the entry; the
+	// image itself is removed with the last of them. Any other tag means the
+	// image was tagged since it was listed.
+	refs := []string{}
+	for _, tag := range inspect.RepoTags {
+		if tag == "<none>:<none>" {
+			continue
+		}
+
+		if !isCacheTag(tag, entry.Key) {
+			return false, nil
+		}
+
+		refs = append(refs, tag)
+	}
+
+	if len(refs) == 0 {
+		refs = []string{entry.ID}
+	}
+
+	for _, ref := range refs {
+		if _, err := docker.ImageRemove(ctx, ref, types.ImageRemoveOptions{}); err != nil {
+			if client.IsErrImageNotFound(err) {
+				continue
+			}
+
+			// docker refuses to remove images which are in use.
+			if strings.Contains(err.Error(), "conflict") {
+				return false, nil
+			}
+
+			audit.Record(audit.Delete, ref, entry.ID, err)
+			return false, err
+		}
+
+		audit.Record(audit.Delete, ref, entry.ID, nil)
+	}
+
+	return true, nil
+}
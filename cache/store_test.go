@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (cs *cacheSuite) TestSelectPrune(c *C) {
+	now := time.Now()
+
+	entries := []Entry{}
+	for i := 0; i < 5; i++ {
+		entries = append(entries, Entry{
+			ID:      string('a' + byte(i)),
+			Created: now.Add(-time.Duration(i) * 24 * time.Hour),
+			Size:    10,
+		})
+	}
+	entries[1].Tags = []string{"myapp:latest"}
+
+	ids := func(entries []Entry) string {
+		var str string
+		for _, entry := range entries {
+			str += entry.ID
+		}
+		return str
+	}
+
+	c.Assert(ids(SelectPrune(entries, PruneOptions{}, now)), Equals, "acde")
+	c.Assert(ids(SelectPrune(entries, PruneOptions{KeepLast: 2}, now)), Equals, "cde")
+	c.Assert(ids(SelectPrune(entries, PruneOptions{OlderThan: 36 * time.Hour}, now)), Equals, "cde")
+	c.Assert(ids(SelectPrune(entries, PruneOptions{MaxSize: 30}, now)), Equals, "de")
+	c.Assert(ids(SelectPrune(entries, PruneOptions{MaxSize: 50}, now)), Equals, "")
+	c.Assert(ids(SelectPrune(entries, PruneOptions{KeepLast: 4, MaxSize: 10}, now)), Equals, "e")
+	c.Assert(ids(SelectPrune(entries, PruneOptions{OlderThan: 72 * time.Hour, MaxSize: 30}, now)), Equals, "de")
+}
+
+func (cs *cacheSuite) TestIsCacheTag(c *C) {
+	key := keySum(c, Key{Verb: "run"})
+	c.Assert(isCacheTag("registry.example.com/myapp/cache:"+key[len(Prefix):], key), Equals, true)
+	c.Assert(isCacheTag("myapp:latest", key), Equals, false)
+}
@@ -40,7 +40,7 @@ fi
 
 echo "Running govet..."
 set +e
-out=$(go tool vet -composites=false ${dirs} 2>&1 | grep -v vendor)
+out=$(go vet -composites=false ${dirs} 2>&1 | grep -v vendor)
 set -e
 
 if [ "`echo \"${out}\" | sed '/^$/d' | wc -l`" -gt 0 ]
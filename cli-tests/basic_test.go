@@ -1,7 +1,11 @@
 package main
 
 import (
+	"archive/tar"
+	"encoding/json"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/rendon/testcli"
@@ -79,6 +83,53 @@ func (s *cliSuite) TestTag(c *C) {
 	c.Assert(strings.Contains(cmd.Stdout(), `Tagged: tagtest`), Equals, true, Commentf("%s", cmd.Stdout()))
 }
 
+func (s *cliSuite) TestSave(c *C) {
+	cmd := testcli.Command("box", "save", "debian")
+	cmd.Run()
+	checkFailure(c, cmd)
+
+	cmd, err := build(
+		`
+    from "debian"
+    run "touch /saved"
+    `, "-t", "savetest")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	output := filepath.Join(c.MkDir(), "savetest.tar")
+	cmd = testcli.Command("box", "save", "-o", output, "savetest")
+	cmd.Run()
+	checkSuccess(c, cmd)
+
+	_, err = os.Stat(output + ".tmp")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	f, err := os.Open(output)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	tags := []string{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		if header.Name == "manifest.json" {
+			manifest := []struct{ RepoTags []string }{}
+			c.Assert(json.NewDecoder(tr).Decode(&manifest), IsNil)
+			for _, image := range manifest {
+				tags = append(tags, image.RepoTags...)
+			}
+		}
+	}
+
+	c.Assert(tags, DeepEquals, []string{"savetest:latest"})
+}
+
 func (s *cliSuite) TestHelp(c *C) {
 	cmd := testcli.Command("box", "--help")
 	cmd.Run()
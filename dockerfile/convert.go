@@ -0,0 +1,764 @@
+package dockerfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/box-builder/box/graph"
+)
+
+// Commands generate the shell commands of the verbs box runs with the tools
+// of the image's distribution family: debian, alpine or rhel.
+type Commands struct {
+	Packages   func(distro, manager string, pkgs []string) (string, error)
+	CreateUser func(distro, name string, opts map[string]string) (string, error)
+}
+
+// section is a stage of the Dockerfile: the steps from a from, or from a tag
+// a later step builds on, to the next.
+type section struct {
+	base  string // the image, or the stage, it is built from
+	image string // the image the stages it is built from start from
+	name  string // its name, if a later stage builds on it
+	lines []string
+
+	user    string // the user of the image, as user or create_user set it
+	current string // the user of the Dockerfile, which with_user changes
+	workdir string
+}
+
+type converter struct {
+	commands Commands
+	sections []*section
+	tags     map[string]int  // the sections, by the tags which name them
+	needed   map[string]bool // the tags later steps build on
+	secrets  []string
+	scope    string // the blocks of the step before, for the comments
+	split    bool   // whether the steps after are in a section of their own
+}
+
+// Convert converts the steps of the plan, as graphed, into a Dockerfile. As
+// the plan was run to graph it, its loops and conditions are as they were
+// then; what a Dockerfile can't do as box does, such as the values read from
+// the image, is left in comments.
+func Convert(g *graph.Graph, plan string, commands Commands) (string, error) {
+	c := &converter{
+		commands: commands,
+		tags:     map[string]int{},
+		needed:   map[string]bool{},
+	}
+
+	for _, step := range g.Steps {
+		values := stepValues(step)
+		switch step.Verb {
+		case "from":
+			if len(values) > 0 {
+				if image, ok := values[0].(string); ok {
+					c.needed[image] = true
+				}
+			}
+		case "copy":
+			if from := stringOption(values, "from"); from != "" {
+				c.needed[from] = true
+			}
+		}
+	}
+
+	for _, step := range g.Steps {
+		if err := c.convert(step); err != nil {
+			return "", err
+		}
+	}
+
+	out := bytes.NewBuffer(nil)
+	fmt.Fprintln(out, "# syntax=docker/dockerfile:1")
+	fmt.Fprintf(out, "# converted by box from %s. The plan was run to convert it, so its\n", path.Base(plan))
+	fmt.Fprintln(out, "# loops and conditions are as they were then.")
+
+	for _, s := range c.sections {
+		fmt.Fprintln(out)
+
+		from := "FROM " + s.base
+		if s.name != "" {
+			from += " AS " + s.name
+		}
+		fmt.Fprintln(out, from)
+
+		for _, line := range s.lines {
+			fmt.Fprintln(out, line)
+		}
+
+		// with_user changes the user of the steps in its block, not that of
+		// the image.
+		if userOrRoot(s.current) != userOrRoot(s.user) {
+			fmt.Fprintln(out, "USER "+userOrRoot(s.user))
+		}
+	}
+
+	return out.String(), nil
+}
+
+func (c *converter) emit(format string, args ...interface{}) {
+	s := c.sections[len(c.sections)-1]
+	s.lines = append(s.lines, fmt.Sprintf(format, args...))
+}
+
+func (c *converter) comment(format string, args ...interface{}) {
+	for _, line := range strings.Split(fmt.Sprintf(format, args...), "\n") {
+		c.emit("# %s", line)
+	}
+}
+
+// start starts a section built from the image or stage.
+func (c *converter) start(base, image string) *section {
+	c.split = false
+	s := &section{base: base, image: image}
+	c.sections = append(c.sections, s)
+	return s
+}
+
+func (c *converter) convert(step *graph.Step) error {
+	values := stepValues(step)
+
+	if step.Verb != "from" && len(c.sections) == 0 {
+		if step.Verb != "save" {
+			return fmt.Errorf("%s before from", step.Verb)
+		}
+		return nil
+	}
+
+	// the hooks of after_build run once the image is built, and are not
+	// part of it.
+	if afterBuild(step) {
+		c.comment("after_build: %s", strings.TrimSpace(step.Verb+" "+strings.Join(step.Args, ", ")))
+		return nil
+	}
+
+	if step.Verb == "from" {
+		if err := c.from(step, values); err != nil {
+			return err
+		}
+
+		c.describe(step)
+		return nil
+	}
+
+	if c.split && !c.namesSection(step, values) {
+		c.resume()
+	}
+
+	c.describe(step)
+
+	user, dir := stepBlocks(step)
+
+	switch step.Verb {
+	case "run":
+		return c.run(step, values, user, dir)
+	case "copy":
+		return c.copy(values, dir)
+	case "fetch":
+		return c.fetch(values, dir)
+	case "entrypoint_script":
+		return c.entrypointScript(values)
+	case "packages":
+		return c.packages(values, user)
+	case "create_user":
+		return c.createUser(values)
+	default:
+		c.configure(step, values)
+	}
+
+	return nil
+}
+
+// afterBuild is true if the step is a hook of after_build.
+func afterBuild(step *graph.Step) bool {
+	for _, scope := range step.Scope {
+		if scope == "after_build" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stepBlocks returns the user of the with_user block the step is in, and the
+// directory of its inside blocks, if it is in them.
+func stepBlocks(step *graph.Step) (string, string) {
+	user, dir := "", ""
+	for _, scope := range step.Scope {
+		verb, arg := splitScope(scope)
+		switch verb {
+		case "with_user":
+			user = arg
+		case "inside":
+			if path.IsAbs(arg) || dir == "" {
+				dir = arg
+			} else {
+				dir = path.Join(dir, arg)
+			}
+		}
+	}
+
+	return user, dir
+}
+
+// configure converts the steps which set the config of the image.
+func (c *converter) configure(step *graph.Step, values []interface{}) {
+	s := c.sections[len(c.sections)-1]
+
+	switch step.Verb {
+	case "env", "label":
+		pairs := []string{}
+		hash := hashValue(values)
+		for _, key := range sortedKeys(hash) {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", key, quote(stringValue(hash[key]))))
+		}
+		c.emit("%s %s", strings.ToUpper(step.Verb), strings.Join(pairs, " "))
+	case "workdir":
+		dir := stringValue(first(values))
+		if !path.IsAbs(dir) && s.workdir != "" {
+			dir = path.Join(s.workdir, dir)
+		}
+		s.workdir = dir
+		c.emit("WORKDIR %s", escape(dir))
+	case "user":
+		s.user = stringValue(first(values))
+		s.current = s.user
+		c.emit("USER %s", userOrRoot(s.user))
+	case "cmd", "entrypoint":
+		c.emit("%s %s", strings.ToUpper(step.Verb), execForm(listValue(values)))
+	case "set_exec":
+		hash := hashValue(values)
+		for _, key := range []string{"entrypoint", "cmd"} {
+			if value, ok := hash[key]; ok {
+				c.emit("%s %s", strings.ToUpper(key), execForm(listValue([]interface{}{value})))
+			}
+		}
+	case "expose":
+		c.emit("EXPOSE %s", strings.Join(listValue(values), " "))
+	case "volume":
+		c.emit("VOLUME %s", execForm(listValue(values)))
+	default:
+		c.annotate(step, values)
+	}
+}
+
+// annotate converts the steps a Dockerfile has no instruction of their own
+// for, which are left in comments.
+func (c *converter) annotate(step *graph.Step, values []interface{}) {
+	switch step.Verb {
+	case "secret":
+		c.secret(values)
+	case "tag":
+		c.tag(stringValue(first(values)))
+	case "flatten":
+		c.comment("flatten: box merged the layers here; docker build keeps them")
+	case "strip":
+		c.comment("strip %s: box left these files out of the layers it flattened", strings.Join(listValue(values), ", "))
+	case "debug":
+		c.comment("debug: box opened a shell here")
+	case "save":
+		c.comment("save %s: box saved the image here; use docker save once it is built", strings.Join(step.Args, ", "))
+	default:
+		c.comment("%s %s: not supported in a Dockerfile", step.Verb, strings.Join(step.Args, ", "))
+	}
+}
+
+// describe comments the blocks the step is in, once for the steps in the
+// same blocks, and what it may have read which the Dockerfile can't.
+func (c *converter) describe(step *graph.Step) {
+	scope := []string{}
+	for _, s := range step.Scope {
+		if verb, _ := splitScope(s); verb == "profile" || verb == "after" {
+			scope = append(scope, s)
+		}
+	}
+
+	if joined := strings.Join(scope, "; "); joined != c.scope {
+		c.scope = joined
+		for _, s := range scope {
+			if verb, arg := splitScope(s); verb == "profile" {
+				c.comment("in the profile %s, selected when the plan was converted", arg)
+			} else {
+				c.comment("the steps of the after block, run after the plan")
+			}
+		}
+	}
+
+	for _, input := range step.Inputs {
+		switch fun, arg := splitScope(input); fun {
+		case "getenv":
+			c.comment("the value of getenv(%q) is that of the host when the plan was converted", arg)
+		case "getvar":
+			c.comment("the value of getvar(%q) is that given when the plan was converted", arg)
+		default:
+			c.comment("%s(%q) is read from the image when box builds it, and was empty when the plan was converted", fun, arg)
+		}
+	}
+}
+
+func (c *converter) from(step *graph.Step, values []interface{}) error {
+	var image string
+
+	switch value := first(values).(type) {
+	case string:
+		image = value
+	case map[string]interface{}:
+		switch {
+		case value["tar"] != nil:
+			c.start("scratch", "scratch")
+			c.emit("ADD %s /", escape(stringValue(value["tar"])))
+			return nil
+		case value["archive"] != nil:
+			image = stringValue(value["image"])
+			if image == "" {
+				image = "scratch"
+			}
+
+			c.start(image, image)
+			c.comment("box built on an image in %s; docker load it first", stringValue(value["archive"]))
+			return nil
+		}
+	}
+
+	if image == "" {
+		return fmt.Errorf("from %s: invalid image", strings.Join(step.Args, ", "))
+	}
+
+	if i, ok := c.tags[image]; ok {
+		c.start(c.sections[i].name, c.sections[i].image)
+		return nil
+	}
+
+	c.start(image, image)
+	return nil
+}
+
+// tag names the section if a later step builds on it, in which case the
+// steps after the tag are in a section of their own.
+func (c *converter) tag(tag string) {
+	c.comment("box tags the image here as %s", tag)
+	if !c.needed[tag] {
+		return
+	}
+
+	c.tags[tag] = len(c.sections) - 1
+	if !c.split {
+		c.sections[len(c.sections)-1].name = fmt.Sprintf("stage-%d", len(c.sections)-1)
+		c.split = true
+	}
+}
+
+// namesSection is true if the step is a tag a later step builds on, which
+// names the section it is in.
+func (c *converter) namesSection(step *graph.Step, values []interface{}) bool {
+	return step.Verb == "tag" && c.needed[stringValue(first(values))]
+}
+
+// resume starts the section of the steps after a tag a later step builds
+// on, from the section it names.
+func (c *converter) resume() {
+	s := c.sections[len(c.sections)-1]
+	next := c.start(s.name, s.image)
+	next.user, next.current, next.workdir = s.user, s.user, s.workdir
+}
+
+// setUser sets the user of the Dockerfile, if it is not already.
+func (c *converter) setUser(user string) {
+	s := c.sections[len(c.sections)-1]
+	if user == "" {
+		user = s.user
+	}
+
+	if userOrRoot(user) != userOrRoot(s.current) {
+		c.emit("USER %s", userOrRoot(user))
+		s.current = user
+	}
+}
+
+func (c *converter) run(step *graph.Step, values []interface{}, user, dir string) error {
+	command := stringValue(first(values))
+	if dir != "" {
+		command = fmt.Sprintf("cd %s && %s", shellQuote(dir), command)
+	}
+
+	c.setUser(user)
+
+	flags := []string{}
+	for _, id := range c.secrets {
+		flags = append(flags, "--mount=type=secret,id="+id)
+	}
+
+	opts := hashValue(rest(values, 1))
+	for _, key := range sortedKeys(opts) {
+		value := opts[key]
+		switch key {
+		case "output":
+		case "network":
+			if network := stringValue(value); network == "none" || network == "host" {
+				flags = append(flags, "--network="+network)
+			} else {
+				c.comment("box ran it on the network %s", network)
+			}
+		case "cache_key":
+			c.comment("box runs it again when its cache_key, %s, changes", stringValue(value))
+		case "no_cache":
+			if stringValue(value) == "true" {
+				c.comment("box always runs it again")
+			}
+		default:
+			c.comment("box ran it with %s: %s", key, strings.Join(listValue([]interface{}{value}), ", "))
+		}
+	}
+
+	// commands of several lines are run as a heredoc.
+	if strings.Contains(strings.TrimRight(command, "\n"), "\n") {
+		delimiter := heredocDelimiter(command)
+		flags = append(flags, fmt.Sprintf("<<%q", delimiter))
+		c.emit("RUN %s", strings.Join(flags, " "))
+		c.emit("%s", strings.TrimRight(command, "\n"))
+		c.emit("%s", delimiter)
+		return nil
+	}
+
+	flags = append(flags, command)
+	c.emit("RUN %s", strings.Join(flags, " "))
+	return nil
+}
+
+// heredocDelimiter returns a delimiter for the heredoc of the text, which is
+// not in it.
+func heredocDelimiter(text string) string {
+	delimiter := "BOX_EOF"
+	for i := 0; strings.Contains(text, delimiter); i++ {
+		delimiter = fmt.Sprintf("BOX_EOF_%d", i)
+	}
+
+	return delimiter
+}
+
+func (c *converter) copy(values []interface{}, dir string) error {
+	if len(values) < 2 {
+		return fmt.Errorf("copy takes a source and a target")
+	}
+
+	source, target := stringValue(values[0]), stringValue(values[1])
+	if dir != "" && !path.IsAbs(target) {
+		joined := path.Join(dir, target)
+		if strings.HasSuffix(target, "/") {
+			joined += "/"
+		}
+		target = joined
+	}
+
+	flags := []string{}
+	opts := hashValue(rest(values, 2))
+	if from := stringOption(values, "from"); from != "" {
+		if i, ok := c.tags[from]; ok {
+			from = c.sections[i].name
+		}
+		flags = append(flags, "--from="+from)
+	}
+
+	for _, key := range []string{"ignore_list", "ignore_file"} {
+		if value, ok := opts[key]; ok {
+			c.comment("box left out %s, given with %s; put them in .dockerignore", strings.Join(listValue([]interface{}{value}), ", "), key)
+		}
+	}
+
+	flags = append(flags, execForm([]string{source, target}))
+	c.emit("COPY %s", strings.Join(flags, " "))
+	return nil
+}
+
+func (c *converter) fetch(values []interface{}, dir string) error {
+	url := stringValue(first(values))
+	opts := hashValue(rest(values, 1))
+
+	dest := stringValue(opts["dest"])
+	if dest == "" {
+		dest = "./"
+	}
+	if dir != "" && !path.IsAbs(dest) {
+		joined := path.Join(dir, dest)
+		if strings.HasSuffix(dest, "/") {
+			joined += "/"
+		}
+		dest = joined
+	}
+
+	flags := []string{"--checksum=sha256:" + stringValue(opts["sha256"])}
+	if mode, ok := opts["mode"]; ok {
+		base := 10
+		if strings.HasPrefix(stringValue(mode), "0") {
+			base = 8
+		}
+
+		m, err := strconv.ParseInt(stringValue(mode), base, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q for fetch", stringValue(mode))
+		}
+		flags = append(flags, fmt.Sprintf("--chmod=%o", m))
+	}
+
+	c.emit("ADD %s %s", strings.Join(flags, " "), execForm([]string{url, dest}))
+	return nil
+}
+
+func (c *converter) entrypointScript(values []interface{}) error {
+	if len(values) < 2 {
+		return fmt.Errorf("entrypoint_script takes a path and a script")
+	}
+
+	s := c.sections[len(c.sections)-1]
+	file, script := stringValue(values[0]), stringValue(values[1])
+	if !path.IsAbs(file) && s.workdir != "" {
+		file = path.Join(s.workdir, file)
+	}
+
+	delimiter := heredocDelimiter(script)
+	c.emit("COPY --chmod=755 <<%q %s", delimiter, escape(file))
+	c.emit("%s", strings.TrimSuffix(script, "\n"))
+	c.emit("%s", delimiter)
+	c.emit("ENTRYPOINT %s", execForm([]string{file}))
+	return nil
+}
+
+// distro guesses the distribution family of the image from its name, as
+// the image itself is not at hand.
+func distro(image string) (string, bool) {
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	tag := ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		name, tag = name[:i], name[i+1:]
+	}
+
+	switch {
+	case name == "alpine" || strings.Contains(tag, "alpine"):
+		return "alpine", true
+	case name == "debian" || name == "ubuntu":
+		return "debian", true
+	case name == "fedora" || name == "centos" || name == "rockylinux" || name == "almalinux" || name == "amazonlinux" || strings.HasPrefix(name, "ubi"):
+		return "rhel", true
+	}
+
+	return "debian", false
+}
+
+func (c *converter) distro() string {
+	s := c.sections[len(c.sections)-1]
+	family, ok := distro(s.image)
+	if !ok {
+		c.comment("the distribution of %s is not known, so that of debian is assumed", s.image)
+	}
+
+	return family
+}
+
+func (c *converter) packages(values []interface{}, user string) error {
+	manager := ""
+	pkgs := []string{}
+	for _, value := range values {
+		if hash, ok := value.(map[string]interface{}); ok {
+			manager = stringValue(hash["manager"])
+			continue
+		}
+		pkgs = append(pkgs, listValue([]interface{}{value})...)
+	}
+
+	family := ""
+	if manager == "" || manager == "auto" {
+		family = c.distro()
+	}
+
+	command, err := c.commands.Packages(family, manager, pkgs)
+	if err != nil {
+		return fmt.Errorf("packages: %v", err)
+	}
+
+	// packages installs as root.
+	c.setUser("root")
+	c.emit("RUN %s", command)
+	return nil
+}
+
+func (c *converter) createUser(values []interface{}) error {
+	name := stringValue(first(values))
+	opts := map[string]string{}
+	for key, value := range hashValue(rest(values, 1)) {
+		opts[key] = stringValue(value)
+	}
+
+	command, err := c.commands.CreateUser(c.distro(), name, opts)
+	if err != nil {
+		return fmt.Errorf("create_user: %v", err)
+	}
+
+	s := c.sections[len(c.sections)-1]
+	c.setUser("root")
+	c.emit("RUN %s", command)
+	c.emit("USER %s", name)
+	s.user, s.current = name, name
+	return nil
+}
+
+func (c *converter) secret(values []interface{}) {
+	hash := hashValue(values)
+	id := stringValue(hash["id"])
+	c.secrets = append(c.secrets, id)
+
+	switch {
+	case hash["env"] != nil:
+		c.comment("the secret %s: docker build --secret id=%s,env=%s", id, id, stringValue(hash["env"]))
+	case hash["file"] != nil:
+		c.comment("the secret %s: docker build --secret id=%s,src=%s", id, id, stringValue(hash["file"]))
+	default:
+		for _, key := range sortedKeys(hash) {
+			if key != "id" {
+				c.comment("the secret %s, kept in %s %s: give it to docker build with --secret id=%s", id, key, stringValue(hash[key]), id)
+			}
+		}
+	}
+}
+
+// stepValues returns the arguments of the step as values, or as strings if
+// it was not graphed with them, such as a graph read from JSON.
+func stepValues(step *graph.Step) []interface{} {
+	if step.Values != nil {
+		return step.Values
+	}
+
+	values := []interface{}{}
+	for _, arg := range step.Args {
+		values = append(values, arg)
+	}
+
+	return values
+}
+
+func first(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values[0]
+}
+
+func rest(values []interface{}, n int) []interface{} {
+	if len(values) < n {
+		return nil
+	}
+
+	return values[n:]
+}
+
+func stringValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// listValue returns the strings of the values, with the arrays among them
+// flattened; nil is left out.
+func listValue(values []interface{}) []string {
+	list := []string{}
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil, map[string]interface{}:
+		case []interface{}:
+			list = append(list, listValue(value)...)
+		default:
+			list = append(list, stringValue(value))
+		}
+	}
+
+	return list
+}
+
+// hashValue returns the last of the values, if it is a hash.
+func hashValue(values []interface{}) map[string]interface{} {
+	if len(values) > 0 {
+		if hash, ok := values[len(values)-1].(map[string]interface{}); ok {
+			return hash
+		}
+	}
+
+	return map[string]interface{}{}
+}
+
+func stringOption(values []interface{}, key string) string {
+	return stringValue(hashValue(values)[key])
+}
+
+func sortedKeys(hash map[string]interface{}) []string {
+	keys := []string{}
+	for key := range hash {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func splitScope(scope string) (string, string) {
+	parts := strings.SplitN(scope, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+func userOrRoot(user string) string {
+	if user == "" {
+		return "root"
+	}
+
+	return user
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `$`, `\$`)
+
+// escape escapes the string from the variables of the Dockerfile, which box
+// does not have.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// quote quotes the value of an ENV or a LABEL.
+func quote(s string) string {
+	return `"` + strings.Replace(escape(s), `"`, `\"`, -1) + `"`
+}
+
+// execForm returns the list in the exec form, as JSON.
+func execForm(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+
+	quoted := []string{}
+	for _, item := range list {
+		buf := bytes.NewBuffer(nil)
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(item)
+		quoted = append(quoted, strings.TrimSpace(buf.String()))
+	}
+
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,274 @@
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+	. "testing"
+
+	"github.com/box-builder/box/graph"
+	. "gopkg.in/check.v1"
+)
+
+type dockerfileSuite struct{}
+
+var _ = Suite(&dockerfileSuite{})
+
+func TestDockerfile(t *T) {
+	TestingT(t)
+}
+
+func (ds *dockerfileSuite) TestParse(c *C) {
+	df, err := Parse(strings.NewReader(`# syntax=docker/dockerfile:1
+FROM --platform=$BUILDPLATFORM golang:1.21 AS build
+# a comment
+RUN apt-get update && \
+    apt-get install -y git
+CMD ["/bin/app", "--serve"]
+COPY --from=build --chown=app:app /go/bin/app /usr/bin/
+`))
+	c.Assert(err, IsNil)
+	c.Assert(df.Escape, Equals, '\\')
+	c.Assert(df.Instructions, HasLen, 4)
+
+	from := df.Instructions[0]
+	c.Assert(from.Cmd, Equals, "from")
+	c.Assert(from.Line, Equals, 2)
+	c.Assert(from.Args, Equals, "golang:1.21 AS build")
+	platform, ok := from.Flag("platform")
+	c.Assert(ok, Equals, true)
+	c.Assert(platform, Equals, "$BUILDPLATFORM")
+
+	run := df.Instructions[1]
+	c.Assert(run.Line, Equals, 4)
+	c.Assert(run.Args, Equals, "apt-get update &&     apt-get install -y git")
+
+	c.Assert(df.Instructions[2].JSON, DeepEquals, []string{"/bin/app", "--serve"})
+
+	copy := df.Instructions[3]
+	c.Assert(copy.Flags["from"], DeepEquals, []string{"build"})
+	c.Assert(copy.Flags["chown"], DeepEquals, []string{"app:app"})
+	c.Assert(copy.Args, Equals, "/go/bin/app /usr/bin/")
+
+	df, err = Parse(strings.NewReader("# escape=`\nFROM windows\nRUN dir `\n  c:\\\n"))
+	c.Assert(err, IsNil)
+	c.Assert(df.Escape, Equals, '`')
+	c.Assert(df.Instructions[1].Args, Equals, "dir   c:\\")
+
+	_, err = Parse(strings.NewReader("FROM debian\nRUN <<EOF\necho\nEOF\n"))
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerfileSuite) TestTranslate(c *C) {
+	plan, warnings, err := Translate(strings.NewReader(`ARG GO=1.21
+FROM golang:${GO} AS build
+ARG GO
+ARG VERSION=dev
+ENV CGO_ENABLED=0 GOFLAGS="-mod=vendor"
+WORKDIR /src
+COPY . .
+RUN go build -ldflags "-X main.version=$VERSION" -o /app .
+HEALTHCHECK CMD true
+
+FROM alpine
+ENV PATH=/app/bin:$PATH
+COPY --from=build /app /usr/bin/app
+COPY --from=nginx:latest /etc/nginx/nginx.conf /etc/
+USER nobody
+ENTRYPOINT ["/usr/bin/app"]
+`), Options{BuildArgs: map[string]string{"VERSION": "1.0", "UNUSED": "x"}})
+	c.Assert(err, IsNil)
+	c.Assert(warnings, DeepEquals, []string{
+		"line 9: HEALTHCHECK is not supported by box; it is left out",
+		"the build arg UNUSED is not used",
+	})
+
+	repo := "box-dockerfile-" + strings.Split(strings.Split(plan, "tag '")[1], ":")[0][len("box-dockerfile-"):]
+	c.Assert(plan, Equals, strings.Replace(`# translated by box from a Dockerfile
+
+# stage build
+from 'golang:1.21'
+env 'CGO_ENABLED' => '0', 'GOFLAGS' => '-mod=vendor'
+workdir '/src'
+copy '.', '.'
+run 'export GO=1.21 VERSION=1.0; go build -ldflags "-X main.version=$VERSION" -o /app .'
+tag 'REPO:stage-0'
+
+# the image files are copied from, at line 14
+from 'nginx:latest'
+tag 'REPO:image-0'
+
+# stage 1
+from 'alpine'
+env 'PATH' => '/app/bin:' + getimageenv('PATH')
+copy '/app', '/usr/bin/app', from: 'REPO:stage-0'
+copy '/etc/nginx/nginx.conf', '/etc/', from: 'REPO:image-0'
+user 'nobody'
+entrypoint ['/usr/bin/app']
+cmd nil
+`, "REPO", repo, -1))
+}
+
+func (ds *dockerfileSuite) TestTranslateTarget(c *C) {
+	const dockerfile = `FROM debian AS base
+RUN apt-get update
+
+FROM base AS test
+RUN make test
+
+FROM base
+SHELL ["/bin/bash", "-o", "pipefail", "-c"]
+RUN --network=none make install
+CMD make serve
+`
+
+	plan, _, err := Translate(strings.NewReader(dockerfile), Options{Target: "test"})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(plan, "# stage base\nfrom 'debian'\nrun 'apt-get update'\ntag '"), Equals, true)
+	c.Assert(strings.Contains(plan, "# stage test\nfrom 'box-dockerfile-"), Equals, true)
+	c.Assert(strings.Contains(plan, "make install"), Equals, false)
+	c.Assert(strings.HasSuffix(plan, "run 'make test'\n"), Equals, true)
+
+	plan, _, err = Translate(strings.NewReader(dockerfile), Options{})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(plan, "make test"), Equals, false)
+	c.Assert(strings.Contains(plan, `run '/bin/bash -o pipefail -c \'make install\'', network: :none`), Equals, true)
+	c.Assert(strings.Contains(plan, `cmd ['/bin/bash', '-o', 'pipefail', '-c', 'make serve']`), Equals, true)
+
+	_, _, err = Translate(strings.NewReader(dockerfile), Options{Target: "missing"})
+	c.Assert(err, ErrorMatches, "the Dockerfile has no stage missing")
+}
+
+func (ds *dockerfileSuite) TestTranslateErrors(c *C) {
+	for dockerfile, msg := range map[string]string{
+		"":                                      "the Dockerfile has no FROM",
+		"RUN true\n":                            "line 1: RUN before the first FROM",
+		"FROM debian\nFROBNICATE\n":             "line 2: unknown instruction FROBNICATE",
+		"FROM debian\nADD https://x.org/a /a\n": "line 2: ADD of https://x.org/a needs --checksum=sha256:..., as box verifies what it fetches",
+		"FROM debian\nCOPY a b c\n":             "line 2: the destination of COPY must end with / for several sources",
+		"FROM debian\nCOPY $HOME/a /a\n":        "line 2: the sources of COPY must not refer to the environment of the image",
+		"FROM debian\nSHELL /bin/bash\n":        "line 2: SHELL must be in the exec form",
+	} {
+		_, _, err := Translate(strings.NewReader(dockerfile), Options{})
+		c.Assert(err, NotNil, Commentf("%q", dockerfile))
+		c.Assert(err.Error(), Equals, msg, Commentf("%q", dockerfile))
+	}
+}
+
+var commands = Commands{
+	Packages: func(distro, manager string, pkgs []string) (string, error) {
+		return fmt.Sprintf("install %s %s %s", distro, manager, strings.Join(pkgs, " ")), nil
+	},
+	CreateUser: func(distro, name string, opts map[string]string) (string, error) {
+		return fmt.Sprintf("adduser %s %s %s", distro, name, opts["uid"]), nil
+	},
+}
+
+func (ds *dockerfileSuite) TestConvert(c *C) {
+	g := graph.New()
+	add := func(verb string, values ...interface{}) {
+		args := []string{}
+		for _, value := range values {
+			args = append(args, fmt.Sprint(value))
+		}
+		g.Add(verb, args, "").Values = values
+	}
+
+	add("from", "golang:1.21")
+	add("workdir", "/src")
+	add("copy", ".", ".", map[string]interface{}{"ignore_list": []interface{}{".git"}})
+	g.Input("getenv", []string{"VERSION"})
+	add("run", "go build -o /app .", map[string]interface{}{"network": "none"})
+	add("tag", "builder")
+	add("from", "alpine:3.18")
+	add("packages", []interface{}{"ca-certificates"})
+	add("create_user", "app", map[string]interface{}{"uid": "1001"})
+	add("secret", map[string]interface{}{"id": "token", "env": "TOKEN"})
+	g.Enter("with_user", []string{"root"})
+	g.Enter("inside", []string{"/etc"})
+	g.Input("read", []string{"/etc/hostname"})
+	add("run", "if true; then\n  echo $HOME\nfi\n")
+	g.Leave()
+	g.Leave()
+	add("copy", "/app", "/usr/bin/app", map[string]interface{}{"from": "builder"})
+	add("fetch", "https://example.org/tool", map[string]interface{}{"sha256": "abc", "dest": "/usr/bin/", "mode": "493"})
+	add("env", map[string]interface{}{"PATH": "/bin:$PATH", "A": `"b"`})
+	add("entrypoint_script", "/entrypoint.sh", "#!/bin/sh\nexec \"$@\"\n")
+	add("cmd", []interface{}{"serve", "--port=80"})
+	add("flatten")
+	add("tag", "app:latest")
+
+	dockerfile, err := Convert(g, "/src/plan.rb", commands)
+	c.Assert(err, IsNil)
+	c.Assert(dockerfile, Equals, `# syntax=docker/dockerfile:1
+# converted by box from plan.rb. The plan was run to convert it, so its
+# loops and conditions are as they were then.
+
+FROM golang:1.21 AS stage-0
+WORKDIR /src
+# box left out .git, given with ignore_list; put them in .dockerignore
+COPY [".", "."]
+# the value of getenv("VERSION") is that of the host when the plan was converted
+RUN --network=none go build -o /app .
+# box tags the image here as builder
+
+FROM alpine:3.18
+RUN install alpine  ca-certificates
+RUN adduser alpine app 1001
+USER app
+# the secret token: docker build --secret id=token,env=TOKEN
+# read("/etc/hostname") is read from the image when box builds it, and was empty when the plan was converted
+USER root
+RUN --mount=type=secret,id=token <<"BOX_EOF"
+cd /etc && if true; then
+  echo $HOME
+fi
+BOX_EOF
+COPY --from=stage-0 ["/app", "/usr/bin/app"]
+ADD --checksum=sha256:abc --chmod=755 ["https://example.org/tool", "/usr/bin/"]
+ENV A="\"b\"" PATH="/bin:\$PATH"
+COPY --chmod=755 <<"BOX_EOF" /entrypoint.sh
+#!/bin/sh
+exec "$@"
+BOX_EOF
+ENTRYPOINT ["/entrypoint.sh"]
+CMD ["serve", "--port=80"]
+# flatten: box merged the layers here; docker build keeps them
+# box tags the image here as app:latest
+USER app
+`)
+}
+
+func (ds *dockerfileSuite) TestConvertSplit(c *C) {
+	g := graph.New()
+	g.Add("from", []string{"debian"}, "")
+	g.Add("run", []string{"apt-get update"}, "")
+	g.Add("tag", []string{"base"}, "")
+	g.Add("run", []string{"make"}, "")
+	g.Add("tag", []string{"built"}, "")
+	g.Add("from", []string{"base"}, "")
+	g.Add("copy", []string{"/out", "/out"}, "")
+	g.Add("from", []string{"built"}, "")
+	g.Add("packages", []string{"curl"}, "")
+
+	dockerfile, err := Convert(g, "plan.rb", commands)
+	c.Assert(err, IsNil)
+	c.Assert(strings.SplitN(dockerfile, "\n\n", 2)[1], Equals, `FROM debian AS stage-0
+RUN apt-get update
+# box tags the image here as base
+
+FROM stage-0 AS stage-1
+RUN make
+# box tags the image here as built
+
+FROM stage-0
+COPY ["/out", "/out"]
+
+FROM stage-1
+RUN install debian  curl
+`)
+
+	g = graph.New()
+	g.Add("run", []string{"make"}, "")
+	_, err = Convert(g, "plan.rb", commands)
+	c.Assert(err, ErrorMatches, "run before from")
+}
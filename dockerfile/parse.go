@@ -0,0 +1,183 @@
+// Package dockerfile translates Dockerfiles into plans, so images described
+// by Dockerfiles are built by box as plans are, with its cache and its
+// outputs.
+package dockerfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Instruction is an instruction of a Dockerfile.
+type Instruction struct {
+	Line  int                 // the line it starts on
+	Cmd   string              // the instruction, in lower case
+	Flags map[string][]string // the --name=value flags given before the arguments
+	Args  string              // the arguments, with the lines continued joined
+	JSON  []string            // the arguments, if they are in the exec form
+}
+
+// Flag returns the last value of the flag, and whether it was given.
+func (i Instruction) Flag(name string) (string, bool) {
+	values, ok := i.Flags[name]
+	if !ok {
+		return "", false
+	}
+
+	return values[len(values)-1], true
+}
+
+// Dockerfile is a parsed Dockerfile.
+type Dockerfile struct {
+	Instructions []Instruction
+	Escape       rune // the escape character, \ or `
+}
+
+var (
+	directiveRegexp = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+	heredocRegexp   = regexp.MustCompile(`(^|\s)<<-?["']?[a-zA-Z_]`)
+)
+
+// flagInstructions take flags before their arguments.
+var flagInstructions = map[string]bool{
+	"from":        true,
+	"run":         true,
+	"copy":        true,
+	"add":         true,
+	"healthcheck": true,
+}
+
+// Parse parses the Dockerfile read from r.
+func Parse(r io.Reader) (*Dockerfile, error) {
+	df := &Dockerfile{Escape: '\\'}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var (
+		line       int
+		start      int
+		continued  string
+		continuing bool
+		directives = true
+	)
+
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+
+		// parser directives are only read before anything else.
+		if directives {
+			if m := directiveRegexp.FindStringSubmatch(trimmed); m != nil {
+				if strings.ToLower(m[1]) == "escape" {
+					switch m[2] {
+					case "\\":
+						df.Escape = '\\'
+					case "`":
+						df.Escape = '`'
+					default:
+						return nil, fmt.Errorf("line %d: invalid escape %q: must be \\ or `", line, m[2])
+					}
+				}
+				continue
+			}
+			directives = false
+		}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if !continuing {
+			start = line
+			continued = ""
+		}
+
+		right := strings.TrimRightFunc(text, isSpace)
+		if strings.HasSuffix(right, string(df.Escape)) {
+			continued += strings.TrimSuffix(right, string(df.Escape))
+			continuing = true
+			continue
+		}
+
+		continued += text
+		continuing = false
+
+		instruction, err := parseInstruction(continued, start)
+		if err != nil {
+			return nil, err
+		}
+		df.Instructions = append(df.Instructions, instruction)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if continuing {
+		instruction, err := parseInstruction(continued, start)
+		if err != nil {
+			return nil, err
+		}
+		df.Instructions = append(df.Instructions, instruction)
+	}
+
+	return df, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+}
+
+func parseInstruction(text string, line int) (Instruction, error) {
+	text = strings.TrimSpace(text)
+
+	i := strings.IndexFunc(text, isSpace)
+	if i < 0 {
+		i = len(text)
+	}
+
+	instruction := Instruction{
+		Line: line,
+		Cmd:  strings.ToLower(text[:i]),
+		Args: strings.TrimSpace(text[i:]),
+	}
+
+	if flagInstructions[instruction.Cmd] {
+		instruction.Flags = map[string][]string{}
+
+		for strings.HasPrefix(instruction.Args, "--") {
+			end := strings.IndexFunc(instruction.Args, isSpace)
+			if end < 0 {
+				end = len(instruction.Args)
+			}
+
+			flag := instruction.Args[2:end]
+			instruction.Args = strings.TrimSpace(instruction.Args[end:])
+
+			name, value := flag, ""
+			if eq := strings.Index(flag, "="); eq >= 0 {
+				name, value = flag[:eq], flag[eq+1:]
+			}
+			instruction.Flags[name] = append(instruction.Flags[name], value)
+		}
+	}
+
+	if (instruction.Cmd == "run" || instruction.Cmd == "copy" || instruction.Cmd == "add") && heredocRegexp.MatchString(instruction.Args) {
+		return instruction, fmt.Errorf("line %d: heredocs are not supported", line)
+	}
+
+	if strings.HasPrefix(instruction.Args, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(instruction.Args), &args); err == nil {
+			instruction.JSON = args
+		}
+	}
+
+	return instruction, nil
+}
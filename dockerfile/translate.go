@@ -0,0 +1,887 @@
+package dockerfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options are the options of a translation.
+type Options struct {
+	BuildArgs map[string]string // the values of the ARGs, in place of their defaults
+	Target    string            // the stage to build; the last if empty
+}
+
+// stage is a stage of a Dockerfile, from its FROM to the next.
+type stage struct {
+	index        int
+	name         string // its name, in lower case, if it has one
+	from         Instruction
+	instructions []Instruction
+}
+
+// state is what the instructions of a stage left, which the stages built on
+// it start with.
+type state struct {
+	vars    map[string]word // the ARGs and ENVs of the stage
+	args    []string        // the ARGs, in the environment of RUNs, in order
+	env     map[string]bool // the ENVs the stage set
+	shell   []string
+	workdir string // empty if it is the image's, which is not known
+	cmd     bool   // whether the stage set a CMD, which its ENTRYPOINT keeps
+}
+
+func (st *state) copy() *state {
+	c := &state{
+		vars:    map[string]word{},
+		env:     map[string]bool{},
+		shell:   st.shell,
+		workdir: st.workdir,
+	}
+
+	for name, value := range st.vars {
+		c.vars[name] = value
+	}
+
+	for name := range st.env {
+		c.env[name] = true
+	}
+
+	return c
+}
+
+type translator struct {
+	df       *Dockerfile
+	opts     Options
+	repo     string // the repository stages are tagged in
+	stages   []*stage
+	meta     map[string]word // the ARGs before the first FROM
+	states   map[int]*state
+	images   map[string]string // the tags of the images copied from, by name
+	used     map[string]bool   // the build args used
+	out      *bytes.Buffer
+	warnings []string
+}
+
+// Translate translates the Dockerfile read from r into a plan. The stages the
+// target needs are built in the order they are in; those other than the
+// target, and the images files are copied from, are tagged in a repository
+// named after the digest of the Dockerfile and the build args, for the
+// stages after to use. What the plan can't do, and is left out, is returned
+// as warnings.
+func Translate(r io.Reader, opts Options) (string, []string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	df, err := Parse(bytes.NewReader(content))
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := sha256.New()
+	h.Write(content)
+	names := []string{}
+	for name := range opts.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s=%s", name, opts.BuildArgs[name])
+	}
+
+	t := &translator{
+		df:     df,
+		opts:   opts,
+		repo:   fmt.Sprintf("box-dockerfile-%x", h.Sum(nil)[:6]),
+		meta:   map[string]word{},
+		states: map[int]*state{},
+		images: map[string]string{},
+		used:   map[string]bool{},
+		out:    bytes.NewBuffer(nil),
+	}
+
+	if err := t.translate(); err != nil {
+		return "", nil, err
+	}
+
+	for _, name := range names {
+		if !t.used[name] {
+			t.warn(0, fmt.Sprintf("the build arg %s is not used", name))
+		}
+	}
+
+	return t.out.String(), t.warnings, nil
+}
+
+func (t *translator) warn(line int, msg string) {
+	if line > 0 {
+		msg = fmt.Sprintf("line %d: %s", line, msg)
+	}
+
+	t.warnings = append(t.warnings, msg)
+}
+
+func (t *translator) emit(format string, args ...interface{}) {
+	fmt.Fprintf(t.out, format+"\n", args...)
+}
+
+// arg returns the value of the ARG: its build arg, or its default.
+func (t *translator) arg(name string, def word, hasDefault bool) (word, bool) {
+	if value, ok := t.opts.BuildArgs[name]; ok {
+		t.used[name] = true
+		return text(value), true
+	}
+
+	return def, hasDefault
+}
+
+func (t *translator) translate() error {
+	if err := t.splitStages(); err != nil {
+		return err
+	}
+
+	target := t.stages[len(t.stages)-1]
+	if t.opts.Target != "" {
+		target = t.stage(t.opts.Target)
+		if target == nil {
+			return fmt.Errorf("the Dockerfile has no stage %s", t.opts.Target)
+		}
+	}
+
+	needed := map[int]bool{}
+	if err := t.need(target, needed, map[int]bool{}); err != nil {
+		return err
+	}
+
+	t.emit("# translated by box from a Dockerfile")
+
+	for _, s := range t.stages {
+		if !needed[s.index] {
+			continue
+		}
+
+		if err := t.translateStage(s, s == target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitStages splits the instructions of the Dockerfile into its stages,
+// declaring the meta ARGs before the first FROM.
+func (t *translator) splitStages() error {
+	metaScope := &scope{vars: t.meta, escape: t.df.Escape}
+
+	for _, instruction := range t.df.Instructions {
+		switch {
+		case instruction.Cmd == "from":
+			s := &stage{index: len(t.stages), from: instruction}
+
+			words, err := metaScope.words(instruction.Args)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", instruction.Line, err)
+			}
+
+			if len(words) == 3 {
+				name, _ := words[2].literal()
+				if as, _ := words[1].literal(); strings.ToLower(as) == "as" {
+					s.name = strings.ToLower(name)
+				}
+			}
+			t.stages = append(t.stages, s)
+		case len(t.stages) == 0 && instruction.Cmd == "arg":
+			if err := t.declare(instruction, metaScope, nil); err != nil {
+				return err
+			}
+		case len(t.stages) == 0:
+			return fmt.Errorf("line %d: %s before the first FROM", instruction.Line, strings.ToUpper(instruction.Cmd))
+		default:
+			s := t.stages[len(t.stages)-1]
+			s.instructions = append(s.instructions, instruction)
+		}
+	}
+
+	if len(t.stages) == 0 {
+		return fmt.Errorf("the Dockerfile has no FROM")
+	}
+
+	return nil
+}
+
+// stage returns the stage named, or numbered, or nil if there is none.
+func (t *translator) stage(ref string) *stage {
+	ref = strings.ToLower(ref)
+	for _, s := range t.stages {
+		if s.name != "" && s.name == ref {
+			return s
+		}
+	}
+
+	if i, err := strconv.Atoi(ref); err == nil && i >= 0 && i < len(t.stages) {
+		return t.stages[i]
+	}
+
+	return nil
+}
+
+// base returns the image the stage is built from, with the meta ARGs
+// expanded.
+func (t *translator) base(s *stage) (string, error) {
+	metaScope := &scope{vars: t.meta, escape: t.df.Escape}
+
+	words, err := metaScope.words(s.from.Args)
+	if err != nil || len(words) == 0 {
+		return "", fmt.Errorf("line %d: invalid FROM", s.from.Line)
+	}
+
+	image, _ := words[0].literal()
+	if image == "" {
+		return "", fmt.Errorf("line %d: FROM has no image", s.from.Line)
+	}
+
+	return image, nil
+}
+
+// need records the stages s needs, and s, in needed.
+func (t *translator) need(s *stage, needed, visiting map[int]bool) error {
+	if needed[s.index] {
+		return nil
+	}
+
+	if visiting[s.index] {
+		return fmt.Errorf("line %d: stages of the Dockerfile need each other", s.from.Line)
+	}
+	visiting[s.index] = true
+
+	image, err := t.base(s)
+	if err != nil {
+		return err
+	}
+
+	refs := []string{image}
+	for _, instruction := range s.instructions {
+		if from, ok := instruction.Flag("from"); ok && (instruction.Cmd == "copy" || instruction.Cmd == "add") {
+			refs = append(refs, from)
+		}
+	}
+
+	for i, ref := range refs {
+		other := t.stage(ref)
+		// only stages before are referred to by their names in FROM.
+		if other == nil || (i == 0 && (other.name == "" || other.index >= s.index)) {
+			continue
+		}
+
+		if err := t.need(other, needed, visiting); err != nil {
+			return err
+		}
+	}
+
+	needed[s.index] = true
+	return nil
+}
+
+// stageTag returns the tag of the stage.
+func (t *translator) stageTag(s *stage) string {
+	return fmt.Sprintf("%s:stage-%d", t.repo, s.index)
+}
+
+// imageTag returns the tag of the image copied from, which it is tagged
+// with once it is pulled, before the stage which copies from it.
+func (t *translator) imageTag(image string) (string, bool) {
+	tag, ok := t.images[image]
+	if !ok {
+		tag = fmt.Sprintf("%s:image-%d", t.repo, len(t.images))
+		t.images[image] = tag
+	}
+
+	return tag, !ok
+}
+
+func (t *translator) translateStage(s *stage, target bool) error {
+	image, err := t.base(s)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.from.Flag("platform"); ok {
+		t.warn(s.from.Line, "--platform of FROM is left out; give --platform to box to build for another platform")
+	}
+
+	t.pullImages(s)
+
+	t.emit("")
+	if s.name != "" {
+		t.emit("# stage %s", s.name)
+	} else {
+		t.emit("# stage %d", s.index)
+	}
+
+	st := t.from(s, image)
+
+	for _, instruction := range s.instructions {
+		if err := t.translateInstruction(instruction, st); err != nil {
+			return err
+		}
+	}
+
+	t.states[s.index] = st
+
+	if !target {
+		t.emit("tag %s", rubyQuote(t.stageTag(s)))
+	}
+
+	return nil
+}
+
+// pullImages pulls, and tags, the images the stage copies from, which are
+// first.
+func (t *translator) pullImages(s *stage) {
+	for _, instruction := range s.instructions {
+		from, ok := instruction.Flag("from")
+		if !ok || (instruction.Cmd != "copy" && instruction.Cmd != "add") || t.stage(from) != nil {
+			continue
+		}
+
+		if tag, first := t.imageTag(from); first {
+			t.emit("")
+			t.emit("# the image files are copied from, at line %d", instruction.Line)
+			t.emit("from %s", rubyQuote(from))
+			t.emit("tag %s", rubyQuote(tag))
+		}
+	}
+}
+
+// from starts the stage from its image, and returns the state it starts
+// with: that of the stage it is built on, if it is one.
+func (t *translator) from(s *stage, image string) *state {
+	if base := t.stage(image); base != nil && base.name != "" && base.index < s.index {
+		t.emit("from %s", rubyQuote(t.stageTag(base)))
+		return t.states[base.index].copy()
+	}
+
+	if strings.ToLower(image) == "scratch" {
+		t.emit("from :scratch")
+	} else {
+		t.emit("from %s", rubyQuote(image))
+	}
+
+	return &state{vars: map[string]word{}, env: map[string]bool{}, shell: []string{"/bin/sh", "-c"}}
+}
+
+// declare declares the ARGs of the instruction in the scope, and in the
+// state if it is in a stage.
+func (t *translator) declare(instruction Instruction, sc *scope, st *state) error {
+	words, err := sc.words(instruction.Args)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", instruction.Line, err)
+	}
+
+	for _, w := range words {
+		decl, _ := w.literal()
+		name, def, hasDefault := decl, word{}, false
+		if eq := strings.Index(decl, "="); eq >= 0 {
+			name, def, hasDefault = decl[:eq], text(decl[eq+1:]), true
+		} else if len(w) > 1 {
+			return fmt.Errorf("line %d: invalid ARG", instruction.Line)
+		}
+
+		// ARG VAR=$OTHER: the default is expanded as a word.
+		if hasDefault {
+			raw := strings.SplitN(instruction.Args, "=", 2)
+			if len(words) == 1 && len(raw) == 2 {
+				if def, err = sc.expand(strings.Trim(strings.TrimSpace(raw[1]), `"'`)); err != nil {
+					return fmt.Errorf("line %d: %v", instruction.Line, err)
+				}
+			}
+		}
+
+		value, ok := t.arg(name, def, hasDefault)
+		if !ok && st != nil {
+			// a meta ARG declared again in the stage has its value.
+			value, ok = t.meta[name]
+		}
+
+		if !ok {
+			continue
+		}
+
+		sc.vars[name] = value
+		if st != nil {
+			st.args = append(st.args, name)
+		}
+	}
+
+	return nil
+}
+
+var archiveRegexp = regexp.MustCompile(`\.(tar|tar\.gz|tgz|tar\.bz2|tbz2?|tar\.xz|txz|tar\.zst)$`)
+
+func (t *translator) translateInstruction(instruction Instruction, st *state) error {
+	sc := &scope{vars: st.vars, imageEnv: true, escape: t.df.Escape}
+	line := instruction.Line
+
+	switch instruction.Cmd {
+	case "arg":
+		argScope := &scope{vars: st.vars, escape: t.df.Escape}
+		return t.declare(instruction, argScope, st)
+	case "env", "label":
+		return t.set(instruction, sc, st)
+	case "maintainer":
+		t.emit("label 'maintainer' => %s", rubyQuote(instruction.Args))
+	case "run":
+		return t.run(instruction, st)
+	case "cmd", "entrypoint":
+		t.command(instruction, st)
+	case "shell":
+		if len(instruction.JSON) == 0 {
+			return fmt.Errorf("line %d: SHELL must be in the exec form", line)
+		}
+		st.shell = instruction.JSON
+	case "workdir":
+		return t.workdir(instruction, sc, st)
+	case "user", "expose", "volume":
+		return t.list(instruction, sc)
+	case "copy", "add":
+		return t.copy(instruction, sc, st)
+	case "healthcheck", "stopsignal", "onbuild":
+		t.warn(line, fmt.Sprintf("%s is not supported by box; it is left out", strings.ToUpper(instruction.Cmd)))
+	default:
+		return fmt.Errorf("line %d: unknown instruction %s", line, strings.ToUpper(instruction.Cmd))
+	}
+
+	return nil
+}
+
+// args returns the words of the arguments of the instruction, in the exec
+// form or not.
+func (sc *scope) args(instruction Instruction) ([]word, error) {
+	if instruction.JSON == nil {
+		words, err := sc.words(instruction.Args)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", instruction.Line, err)
+		}
+		return words, nil
+	}
+
+	words := []word{}
+	for _, arg := range instruction.JSON {
+		w, err := sc.expand(arg)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", instruction.Line, err)
+		}
+		words = append(words, w)
+	}
+
+	return words, nil
+}
+
+// list translates a USER, which takes one user, or an EXPOSE or a VOLUME,
+// which take a list.
+func (t *translator) list(instruction Instruction, sc *scope) error {
+	ws, err := sc.args(instruction)
+	if err != nil {
+		return err
+	}
+	if instruction.Cmd == "user" && len(ws) != 1 {
+		return fmt.Errorf("line %d: USER takes one user", instruction.Line)
+	}
+
+	args := []string{}
+	for _, w := range ws {
+		args = append(args, w.ruby())
+	}
+	t.emit("%s %s", instruction.Cmd, strings.Join(args, ", "))
+
+	return nil
+}
+
+// set translates an ENV or a LABEL; the variables an ENV sets are in the
+// scope of the instructions after it.
+func (t *translator) set(instruction Instruction, sc *scope, st *state) error {
+	pairs, err := t.pairs(instruction, sc)
+	if err != nil {
+		return err
+	}
+
+	verb := instruction.Cmd
+	hash := []string{}
+	for _, pair := range pairs {
+		hash = append(hash, fmt.Sprintf("%s => %s", rubyQuote(pair.key), pair.value.ruby()))
+		if verb == "env" {
+			st.vars[pair.key] = pair.value
+			st.env[pair.key] = true
+		}
+	}
+	t.emit("%s %s", verb, strings.Join(hash, ", "))
+
+	return nil
+}
+
+// command translates a CMD or an ENTRYPOINT, in the shell of the stage if it
+// is not in the exec form.
+func (t *translator) command(instruction Instruction, st *state) {
+	var argv []string
+	if instruction.JSON != nil {
+		argv = instruction.JSON
+	} else {
+		argv = append(append([]string{}, st.shell...), instruction.Args)
+	}
+
+	quoted := []string{}
+	for _, arg := range argv {
+		quoted = append(quoted, rubyQuote(arg))
+	}
+	t.emit("%s [%s]", instruction.Cmd, strings.Join(quoted, ", "))
+
+	// as with docker, an entrypoint clears the cmd of the image.
+	if instruction.Cmd == "entrypoint" && !st.cmd {
+		t.emit("cmd nil")
+	}
+	if instruction.Cmd == "cmd" {
+		st.cmd = true
+	}
+}
+
+// workdir translates a WORKDIR, relative to the workdir of the stage if it
+// is known.
+func (t *translator) workdir(instruction Instruction, sc *scope, st *state) error {
+	ws, err := sc.args(instruction)
+	if err != nil {
+		return err
+	}
+	if len(ws) != 1 {
+		return fmt.Errorf("line %d: WORKDIR takes one path", instruction.Line)
+	}
+
+	dir, ok := ws[0].literal()
+	if !ok {
+		t.emit("workdir %s", ws[0].ruby())
+		st.workdir = ""
+		return nil
+	}
+
+	if !path.IsAbs(dir) {
+		base := st.workdir
+		if base == "" {
+			t.warn(instruction.Line, fmt.Sprintf("the relative WORKDIR %s is taken from /, as the workdir of the image is not known", dir))
+			base = "/"
+		}
+		dir = path.Join(base, dir)
+	}
+	st.workdir = dir
+	t.emit("workdir %s", rubyQuote(dir))
+
+	return nil
+}
+
+type pair struct {
+	key   string
+	value word
+}
+
+// pairs returns the key=value pairs of an ENV or a LABEL, or its key and
+// value in the legacy form: ENV key the value.
+func (t *translator) pairs(instruction Instruction, sc *scope) ([]pair, error) {
+	ws, err := sc.words(instruction.Args)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", instruction.Line, err)
+	}
+
+	if len(ws) == 0 {
+		return nil, fmt.Errorf("line %d: %s has no arguments", instruction.Line, strings.ToUpper(instruction.Cmd))
+	}
+
+	first, _ := ws[0].literal()
+	if len(ws[0]) > 0 && ws[0][0].expr == "" && !strings.Contains(ws[0][0].text, "=") {
+		if len(ws) < 2 {
+			return nil, fmt.Errorf("line %d: %s %s has no value", instruction.Line, strings.ToUpper(instruction.Cmd), first)
+		}
+
+		value := word{}
+		for i, w := range ws[1:] {
+			if i > 0 {
+				value = value.add(" ")
+			}
+			value = value.join(w)
+		}
+
+		return []pair{{key: first, value: value}}, nil
+	}
+
+	pairs := []pair{}
+	for _, w := range ws {
+		if len(w) == 0 || w[0].expr != "" || !strings.Contains(w[0].text, "=") {
+			return nil, fmt.Errorf("line %d: %s must be key=value", instruction.Line, strings.ToUpper(instruction.Cmd))
+		}
+
+		eq := strings.Index(w[0].text, "=")
+		value := append(word{{text: w[0].text[eq+1:]}}, w[1:]...)
+		pairs = append(pairs, pair{key: w[0].text[:eq], value: value})
+	}
+
+	return pairs, nil
+}
+
+var safeShellRegexp = regexp.MustCompile(`^[a-zA-Z0-9_./:=@%+,-]+$`)
+
+// shellQuote quotes s for a shell, if it must be.
+func shellQuote(s string) string {
+	if safeShellRegexp.MatchString(s) {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellJoin(argv []string) string {
+	quoted := []string{}
+	for _, arg := range argv {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func (t *translator) run(instruction Instruction, st *state) error {
+	var command string
+	if instruction.JSON != nil {
+		command = shellJoin(instruction.JSON)
+	} else if len(st.shell) == 2 && st.shell[0] == "/bin/sh" && st.shell[1] == "-c" {
+		command = instruction.Args
+	} else {
+		command = shellJoin(append(append([]string{}, st.shell...), instruction.Args))
+	}
+
+	// the ARGs of the stage are in the environment of its RUNs, unless an
+	// ENV set them.
+	exports := []string{}
+	for _, name := range st.args {
+		if st.env[name] {
+			continue
+		}
+
+		if value, ok := st.vars[name].literal(); ok {
+			exports = append(exports, name+"="+shellQuote(value))
+		}
+	}
+
+	if len(exports) > 0 {
+		command = "export " + strings.Join(exports, " ") + "; " + command
+	}
+
+	options := t.runOptions(instruction)
+
+	if len(options) > 0 {
+		t.emit("run %s, %s", rubyQuote(command), strings.Join(options, ", "))
+	} else {
+		t.emit("run %s", rubyQuote(command))
+	}
+
+	return nil
+}
+
+// runOptions returns the options of the run verb of the flags of the RUN,
+// warning of those left out.
+func (t *translator) runOptions(instruction Instruction) []string {
+	options := []string{}
+	for name, values := range instruction.Flags {
+		switch name {
+		case "network":
+			switch values[len(values)-1] {
+			case "none", "host":
+				options = append(options, "network: :"+values[len(values)-1])
+			case "default":
+			default:
+				t.warn(instruction.Line, fmt.Sprintf("--network=%s of RUN is left out", values[len(values)-1]))
+			}
+		case "mount":
+			for _, mount := range values {
+				if strings.Contains(mount, "type=secret") {
+					t.warn(instruction.Line, fmt.Sprintf("--mount=%s of RUN is left out; give the plan's run the secret verb instead", mount))
+				} else {
+					t.warn(instruction.Line, fmt.Sprintf("--mount=%s of RUN is left out", mount))
+				}
+			}
+		default:
+			t.warn(instruction.Line, fmt.Sprintf("--%s of RUN is left out", name))
+		}
+	}
+	sort.Strings(options)
+
+	return options
+}
+
+func (t *translator) copy(instruction Instruction, sc *scope, st *state) error {
+	ws, err := sc.args(instruction)
+	if err != nil {
+		return err
+	}
+
+	name := strings.ToUpper(instruction.Cmd)
+	if len(ws) < 2 {
+		return fmt.Errorf("line %d: %s needs a source and a destination", instruction.Line, name)
+	}
+
+	sources, dest := ws[:len(ws)-1], ws[len(ws)-1]
+	destPath, destKnown := dest.literal()
+	if len(sources) > 1 && destKnown && !strings.HasSuffix(destPath, "/") {
+		return fmt.Errorf("line %d: the destination of %s must end with / for several sources", instruction.Line, name)
+	}
+
+	from := t.copyFrom(instruction)
+	checksum := t.checksum(instruction)
+
+	// the paths the sources are copied to, for --chown and --chmod.
+	targets := []string{}
+
+	for _, source := range sources {
+		src, ok := source.literal()
+		if !ok {
+			return fmt.Errorf("line %d: the sources of %s must not refer to the environment of the image", instruction.Line, name)
+		}
+
+		target, err := t.copySource(instruction, src, from, checksum, dest, st)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	}
+
+	t.own(instruction, targets)
+
+	return nil
+}
+
+// copySource translates the copy, or the fetch, of the source, and returns
+// the path it is copied to.
+func (t *translator) copySource(instruction Instruction, src, from, checksum string, dest word, st *state) (string, error) {
+	switch {
+	case instruction.Cmd == "add" && (strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")):
+		return t.fetch(instruction, src, checksum, dest)
+	case instruction.Cmd == "add" && from == "" && archiveRegexp.MatchString(src):
+		t.warn(instruction.Line, fmt.Sprintf("ADD of the archive %s copies it, without extracting it", src))
+	}
+
+	if from != "" {
+		t.emit("copy %s, %s, from: %s", rubyQuote(src), dest.ruby(), rubyQuote(from))
+	} else {
+		t.emit("copy %s, %s", rubyQuote(src), dest.ruby())
+	}
+
+	return t.copyTarget(src, dest, st), nil
+}
+
+// copyFrom returns the tag of the stage or the image the COPY or ADD copies
+// from, if it does.
+func (t *translator) copyFrom(instruction Instruction) string {
+	ref, ok := instruction.Flag("from")
+	if !ok {
+		return ""
+	}
+
+	if s := t.stage(ref); s != nil {
+		return t.stageTag(s)
+	}
+
+	tag, _ := t.imageTag(ref)
+	return tag
+}
+
+// checksum returns the --checksum of the COPY or ADD, warning of the flags
+// left out.
+func (t *translator) checksum(instruction Instruction) string {
+	var checksum string
+	for flag, values := range instruction.Flags {
+		switch flag {
+		case "from", "link":
+		case "chown", "chmod":
+		case "checksum":
+			checksum = values[len(values)-1]
+		default:
+			t.warn(instruction.Line, fmt.Sprintf("--%s of %s is left out", flag, strings.ToUpper(instruction.Cmd)))
+		}
+	}
+
+	return checksum
+}
+
+// fetch translates the ADD of the URL, and returns the path it is fetched
+// to.
+func (t *translator) fetch(instruction Instruction, src, checksum string, dest word) (string, error) {
+	if !strings.HasPrefix(checksum, "sha256:") {
+		return "", fmt.Errorf("line %d: ADD of %s needs --checksum=sha256:..., as box verifies what it fetches", instruction.Line, src)
+	}
+
+	if destPath, ok := dest.literal(); ok && strings.HasSuffix(destPath, "/") {
+		dest = text(destPath + path.Base(src))
+	}
+	t.emit("fetch %s, sha256: %s, dest: %s", rubyQuote(src), rubyQuote(strings.TrimPrefix(checksum, "sha256:")), dest.ruby())
+
+	return dest.ruby(), nil
+}
+
+// copyTarget returns the path the source is copied to.
+func (t *translator) copyTarget(src string, dest word, st *state) string {
+	destPath, ok := dest.literal()
+	base := path.Base(src)
+
+	switch {
+	case !ok:
+		return dest.ruby()
+	case strings.HasSuffix(destPath, "/") && !strings.ContainsAny(base, "*?[") && base != "." && base != "/":
+		return rubyQuote(t.inWorkdir(destPath+base, st))
+	default:
+		return rubyQuote(t.inWorkdir(destPath, st))
+	}
+}
+
+// own runs the --chown and --chmod of the COPY or ADD on the targets.
+func (t *translator) own(instruction Instruction, targets []string) {
+	for _, flag := range []string{"chown", "chmod"} {
+		value, ok := instruction.Flag(flag)
+		if !ok {
+			continue
+		}
+
+		paths := []string{}
+		for _, target := range targets {
+			paths = append(paths, fmt.Sprintf("'%s'", strings.Trim(target, "'")))
+		}
+
+		command := fmt.Sprintf("%s -R %s %s", flag, shellQuote(value), strings.Join(uniq(paths), " "))
+		t.emit("run %s", rubyQuote(command))
+	}
+}
+
+// inWorkdir returns the path, relative to the workdir if it is not absolute.
+func (t *translator) inWorkdir(p string, st *state) string {
+	if path.IsAbs(p) || st.workdir == "" {
+		return p
+	}
+
+	return path.Join(st.workdir, p)
+}
+
+func uniq(list []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, item := range list {
+		if !seen[item] {
+			seen[item] = true
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
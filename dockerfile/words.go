@@ -0,0 +1,343 @@
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// segment is a part of a word: text, or a Ruby expression of the value of
+// an environment variable of the image, which is not known until the image
+// is built.
+type segment struct {
+	text string
+	expr string
+}
+
+// word is a word of the arguments of an instruction, with its variables
+// expanded.
+type word []segment
+
+func text(s string) word {
+	return word{{text: s}}
+}
+
+func (w word) add(s string) word {
+	if n := len(w); n > 0 && w[n-1].expr == "" {
+		w[n-1].text += s
+		return w
+	}
+
+	return append(w, segment{text: s})
+}
+
+func (w word) join(other word) word {
+	for _, seg := range other {
+		if seg.expr != "" {
+			w = append(w, seg)
+		} else {
+			w = w.add(seg.text)
+		}
+	}
+
+	return w
+}
+
+// literal returns the word, if it is known before the image is built.
+func (w word) literal() (string, bool) {
+	s := ""
+	for _, seg := range w {
+		if seg.expr != "" {
+			return "", false
+		}
+		s += seg.text
+	}
+
+	return s, true
+}
+
+// ruby returns the word as a Ruby expression.
+func (w word) ruby() string {
+	parts := []string{}
+	for _, seg := range w {
+		if seg.expr != "" {
+			parts = append(parts, seg.expr)
+		} else if seg.text != "" {
+			parts = append(parts, rubyQuote(seg.text))
+		}
+	}
+
+	switch len(parts) {
+	case 0:
+		return "''"
+	case 1:
+		return parts[0]
+	default:
+		return strings.Join(parts, " + ")
+	}
+}
+
+// rubyQuote returns s as a Ruby string literal, in single quotes, so nothing
+// in it is interpolated.
+func rubyQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `'`, `\'`, -1) + "'"
+}
+
+// scope is the variables instructions are expanded with: the ARGs and ENVs
+// of the stage, and those of the image if they are not.
+type scope struct {
+	vars     map[string]word
+	imageEnv bool // if set, variables not in vars are read from the image
+	escape   rune
+}
+
+func (s *scope) lookup(name string) (word, bool) {
+	if value, ok := s.vars[name]; ok {
+		return value, true
+	}
+
+	if s.imageEnv {
+		return word{{expr: fmt.Sprintf("getimageenv(%s)", rubyQuote(name))}}, true
+	}
+
+	return nil, false
+}
+
+// words splits the arguments into words as a shell would, removing their
+// quotes, and expands the variables in them outside single quotes.
+func (s *scope) words(args string) ([]word, error) {
+	return s.lex([]rune(args), true)
+}
+
+// expand expands the variables in the argument, which is one word whose
+// quotes are kept, such as those of the exec form.
+func (s *scope) expand(arg string) (word, error) {
+	words, err := s.lex([]rune(arg), false)
+	if err != nil || len(words) == 0 {
+		return word{}, err
+	}
+
+	return words[0], nil
+}
+
+func (s *scope) lex(rs []rune, split bool) ([]word, error) {
+	l := &lexer{scope: s, rs: rs, split: split, cur: word{}}
+
+	for ; l.i < len(rs); l.i++ {
+		if err := l.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", string(rs))
+	}
+
+	l.end()
+	return l.words, nil
+}
+
+// lexer is the state of scope.lex as it reads the runes of the arguments.
+type lexer struct {
+	*scope
+	rs     []rune
+	i      int // the rune read
+	split  bool
+	words  []word
+	cur    word
+	inWord bool
+	quote  rune
+}
+
+// next reads the rune at i, and those after it it takes.
+func (l *lexer) next() error {
+	c := l.rs[l.i]
+
+	switch {
+	case l.split && l.quote == 0 && unicode.IsSpace(c):
+		l.end()
+	case c == l.escape && l.quote != '\'':
+		l.escaped()
+	case l.split && (c == '\'' || c == '"') && l.quote == 0:
+		l.quote, l.inWord = c, true
+	case l.split && c == l.quote:
+		l.quote = 0
+	case c == '$' && l.quote != '\'':
+		return l.variable()
+	default:
+		l.inWord = true
+		l.cur = l.cur.add(string(c))
+	}
+
+	return nil
+}
+
+// end ends the word read, if there is one.
+func (l *lexer) end() {
+	if l.inWord {
+		l.words = append(l.words, l.cur)
+		l.cur, l.inWord = word{}, false
+	}
+}
+
+// escaped reads the escape at i and the rune it escapes.
+func (l *lexer) escaped() {
+	c := l.rs[l.i]
+
+	l.inWord = true
+	if l.i+1 == len(l.rs) {
+		l.cur = l.cur.add(string(c))
+		return
+	}
+
+	l.i++
+	// in double quotes, only quotes, $ and the escape are escaped.
+	if next := l.rs[l.i]; l.quote == '"' && next != '"' && next != '$' && next != l.escape {
+		l.cur = l.cur.add(string(c))
+	}
+	l.cur = l.cur.add(string(l.rs[l.i]))
+}
+
+// variable reads the $ at i and expands the variable after it, if there is
+// one.
+func (l *lexer) variable() error {
+	value, n, err := l.scope.variable(l.rs[l.i+1:])
+	if err != nil {
+		return err
+	}
+
+	l.inWord = true
+	if n == 0 {
+		l.cur = l.cur.add("$")
+		return nil
+	}
+
+	l.cur = l.cur.join(value)
+	l.i += n
+	return nil
+}
+
+func isNameRune(c rune, first bool) bool {
+	return c == '_' || unicode.IsLetter(c) || (!first && unicode.IsDigit(c))
+}
+
+// variable expands the variable at the start of rs, after its $, and returns
+// how many runes it took.
+func (s *scope) variable(rs []rune) (word, int, error) {
+	if len(rs) == 0 {
+		return nil, 0, nil
+	}
+
+	if rs[0] != '{' {
+		n := 0
+		for n < len(rs) && isNameRune(rs[n], n == 0) {
+			n++
+		}
+
+		if n == 0 {
+			return nil, 0, nil
+		}
+
+		value, _ := s.lookup(string(rs[:n]))
+		return value, n, nil
+	}
+
+	end := closingBrace(rs)
+	if end < 0 {
+		return nil, 0, fmt.Errorf("unterminated variable in %q", string(rs))
+	}
+
+	value, err := s.braced(rs[1:end])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, end + 1, nil
+}
+
+// closingBrace returns the index of the brace closing the one at the start
+// of rs, or -1 if it is not closed.
+func closingBrace(rs []rune) int {
+	depth := 0
+	for i, c := range rs {
+		if c == '{' {
+			depth++
+		} else if c == '}' {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// braced expands the variable in braces, with its modifier if it has one.
+func (s *scope) braced(inner []rune) (word, error) {
+	n := 0
+	for n < len(inner) && isNameRune(inner[n], n == 0) {
+		n++
+	}
+
+	if n == 0 {
+		return nil, fmt.Errorf("invalid variable ${%s}", string(inner))
+	}
+
+	name, modifier := string(inner[:n]), string(inner[n:])
+	value, set := s.lookup(name)
+
+	if modifier == "" {
+		return value, nil
+	}
+
+	var op string
+	for _, prefix := range []string{":-", ":+", "-", "+"} {
+		if strings.HasPrefix(modifier, prefix) {
+			op = prefix
+			break
+		}
+	}
+
+	if op == "" {
+		return nil, fmt.Errorf("unsupported substitution ${%s}", string(inner))
+	}
+
+	alt, err := s.expand(modifier[len(op):])
+	if err != nil {
+		return nil, err
+	}
+
+	return substitute(value, set, op, alt), nil
+}
+
+// substitute returns the value of the variable with the substitution of the
+// operator and the word after it.
+func substitute(value word, set bool, op string, alt word) word {
+	lit, known := value.literal()
+
+	switch {
+	case !set && (op == ":-" || op == "-"):
+		value = alt
+	case !set:
+		value = word{}
+	case known && op == ":-":
+		if lit == "" {
+			value = alt
+		}
+	case known && op == ":+":
+		if lit != "" {
+			value = alt
+		}
+	case op == "+":
+		value = alt
+	case op == "-":
+	case op == ":-":
+		// the image's variables are unset or empty alike.
+		value = word{{expr: fmt.Sprintf("(%s.empty? ? %s : %s)", value.ruby(), alt.ruby(), value.ruby())}}
+	case op == ":+":
+		value = word{{expr: fmt.Sprintf("(%s.empty? ? '' : %s)", value.ruby(), alt.ruby())}}
+	}
+
+	return value
+}
@@ -0,0 +1,90 @@
+// Package download retrieves remote artifacts on the host, verifying them
+// against a known sha256 digest before they can be used in an image.
+// Verified downloads are kept in a cache keyed by digest, so each artifact is
+// only ever fetched once.
+package download
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/util"
+	"github.com/pkg/errors"
+)
+
+var sha256Regexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// Dir returns the directory downloads are cached in.
+func Dir() string {
+	return util.BoxDir("downloads")
+}
+
+// Fetch downloads the url to the cache unless it is already there, and
+// returns the filename of the verified artifact. The digest is the hex
+// encoded sha256 of the expected content, optionally prefixed with
+// `sha256:`. The partial download is removed by signals, if it is set, when
+// box is interrupted.
+func Fetch(ctx context.Context, url, digest string, signals *signal.Cancellable, log *logger.Logger) (string, error) {
+	digest = strings.ToLower(strings.TrimPrefix(digest, "sha256:"))
+	if !sha256Regexp.MatchString(digest) {
+		return "", errors.Errorf("invalid sha256 digest %q for %q", digest, url)
+	}
+
+	target := filepath.Join(Dir(), digest)
+
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("could not fetch %q: %s", url, resp.Status)
+	}
+
+	f, err := ioutil.TempFile(Dir(), "tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	signals.AddFile(f.Name())
+	defer signals.RemoveFile(f.Name())
+	defer os.Remove(f.Name()) // after a successful rename this does nothing
+
+	sum, err := tar.SumWithCopy(f, resp.Body, log, fmt.Sprintf("Fetching %s", url))
+	if err != nil {
+		return "", err
+	}
+
+	if sum != digest {
+		return "", errors.Errorf("digest mismatch for %q: expected sha256:%s, got sha256:%s", url, digest, sum)
+	}
+
+	if err := os.Rename(f.Name(), target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
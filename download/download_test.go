@@ -0,0 +1,75 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	. "testing"
+
+	"github.com/box-builder/box/logger"
+
+	. "gopkg.in/check.v1"
+)
+
+type downloadSuite struct {
+	dir string
+}
+
+var _ = Suite(&downloadSuite{})
+
+func TestDownload(t *T) {
+	TestingT(t)
+}
+
+func (ds *downloadSuite) SetUpTest(c *C) {
+	var err error
+	ds.dir, err = ioutil.TempDir("", "box-download-test")
+	c.Assert(err, IsNil)
+	os.Setenv("BOX_HOME", ds.dir)
+}
+
+func (ds *downloadSuite) TearDownTest(c *C) {
+	os.Unsetenv("BOX_HOME")
+	os.RemoveAll(ds.dir)
+}
+
+func (ds *downloadSuite) TestFetch(c *C) {
+	content := []byte("an artifact")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	log := logger.New("", false)
+
+	fn, err := Fetch(context.Background(), srv.URL, "sha256:"+digest, nil, log)
+	c.Assert(err, IsNil)
+
+	result, err := ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, content)
+
+	// the second fetch comes from the cache.
+	_, err = Fetch(context.Background(), srv.URL, digest, nil, log)
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 1)
+
+	_, err = Fetch(context.Background(), srv.URL, "0000000000000000000000000000000000000000000000000000000000000000", nil, log)
+	c.Assert(err, ErrorMatches, "digest mismatch.*")
+
+	_, err = Fetch(context.Background(), srv.URL, "deadbeef", nil, log)
+	c.Assert(err, ErrorMatches, "invalid sha256 digest.*")
+
+	files, err := ioutil.ReadDir(Dir())
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 1)
+}
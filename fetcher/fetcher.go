@@ -2,63 +2,459 @@ package fetcher
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 
+	"github.com/box-builder/box/audit"
 	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/logger"
 	"github.com/box-builder/box/pull"
+	"github.com/box-builder/box/registry"
+	bt "github.com/box-builder/box/tar"
 	btypes "github.com/box-builder/box/types"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 )
 
 // Docker does stuff
 func Docker(context context.Context, globals *btypes.Global, client *client.Client, config *config.Config, name string) (string, []string, error) {
-	inspect, _, err := client.ImageInspectWithRaw(context, name)
+	if globals.Platform != "" {
+		var err error
+		name, err = resolvePlatform(context, globals, client, name)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	inspect, raw, err := client.ImageInspectWithRaw(context, name)
 	if err != nil {
-		reader, err := client.ImagePull(context, name, types.ImagePullOptions{})
+		inspect, raw, err = pullImage(context, globals, client, name)
+		audit.Record(audit.Pull, name, inspect.ID, err)
 		if err != nil {
 			return "", nil, err
 		}
+	}
 
-		if !globals.TTY {
-			globals.Logger.Print(fmt.Sprintf("Pulling %q... ", name))
+	platform := imagePlatform(inspect, raw)
+	if err := checkPlatform(globals, name, platform); err != nil {
+		return "", nil, err
+	}
 
-			if _, err := io.Copy(ioutil.Discard, reader); err != io.EOF && err != nil {
-				return "", nil, err
-			}
+	config.FromDocker(inspect.Config)
+	config.Image = inspect.ID
+	setPlatform(config, platform)
+
+	return inspect.ID, inspect.RootFS.Layers, nil
+}
+
+// Remote reads an image from its registry without pulling its layers: its
+// manifest and configuration for the platform. It overwrites the container
+// configuration, and returns the image to pull it by, by digest, its ID and
+// its layers. The image is pulled with Pull when a step first needs it.
+func Remote(context context.Context, globals *btypes.Global, config *config.Config, name string, platform registry.Platform) (string, string, []string, error) {
+	ref, img, err := Inspect(context, globals, config, name, platform)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return ref.String(), img.ID, img.DiffIDs, nil
+}
+
+// Inspect reads an image from its registry as Remote does, and overwrites the
+// container configuration. It returns the image by digest, and the image as
+// its registry describes it, whose layers may be fetched from the registry.
+func Inspect(context context.Context, globals *btypes.Global, config *config.Config, name string, platform registry.Platform) (registry.Reference, *registry.InspectedImage, error) {
+	if err := registry.CheckPull(globals.Policy, name); err != nil {
+		return registry.Reference{}, nil, err
+	}
+
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return registry.Reference{}, nil, err
+	}
 
-			fmt.Fprintln(globals.Logger.Output(), "done.")
-		} else {
-			pull.NewProgress(globals.TTY, reader).Process()
+	inspection, err := registry.NewClient(globals.Policy).Inspect(context, ref, platform)
+	if err != nil {
+		return registry.Reference{}, nil, err
+	}
+
+	img := inspection.Image
+	if img == nil {
+		return registry.Reference{}, nil, fmt.Errorf("%s is not available for %s", name, platform)
+	}
+
+	if img.ID == "" || len(img.DiffIDs) != len(img.Layers) {
+		return registry.Reference{}, nil, fmt.Errorf("configuration of %s does not match its layers", name)
+	}
+
+	ports := nat.PortSet{}
+	for port := range img.Config.ExposedPorts {
+		ports[nat.Port(port)] = struct{}{}
+	}
+
+	config.FromDocker(&container.Config{
+		Env:          img.Config.Env,
+		Entrypoint:   strslice.StrSlice(img.Config.Entrypoint),
+		Cmd:          strslice.StrSlice(img.Config.Cmd),
+		User:         img.Config.User,
+		WorkingDir:   img.Config.WorkingDir,
+		ExposedPorts: ports,
+		Volumes:      img.Config.Volumes,
+		Labels:       img.Config.Labels,
+	})
+	config.Image = img.ID
+	setPlatform(config, img.Platform)
+
+	ref.Reference = img.Digest
+	return ref, img, nil
+}
+
+// Pull pulls an image read with Remote into docker, and returns its ID.
+func Pull(context context.Context, globals *btypes.Global, client *client.Client, name string) (string, error) {
+	inspect, _, err := pullImage(context, globals, client, name)
+	audit.Record(audit.Pull, name, inspect.ID, err)
+	return inspect.ID, err
+}
+
+// pullImage pulls the image into docker, showing its progress, and returns
+// its inspection.
+func pullImage(context context.Context, globals *btypes.Global, client *client.Client, name string) (types.ImageInspect, []byte, error) {
+	if err := registry.CheckPull(globals.Policy, name); err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+
+	reader, err := client.ImagePull(context, name, types.ImagePullOptions{})
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+
+	if !globals.TTY {
+		globals.Logger.Print(fmt.Sprintf("Pulling %q... ", name))
+
+		if _, err := io.Copy(ioutil.Discard, reader); err != io.EOF && err != nil {
+			return types.ImageInspect{}, nil, err
 		}
 
-		select {
-		case <-context.Done():
-			if context.Err() != nil {
-				return "", nil, context.Err()
-			}
-		default:
+		fmt.Fprintln(globals.Logger.Output(), "done.")
+	} else {
+		pull.NewProgress(globals.TTY, reader).Process()
+	}
+
+	select {
+	case <-context.Done():
+		if context.Err() != nil {
+			return types.ImageInspect{}, nil, context.Err()
 		}
+	default:
+	}
+
+	inspect, raw, err := client.ImageInspectWithRaw(context, name)
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+
+	select {
+	case <-context.Done():
+		if context.Err() != nil {
+			return types.ImageInspect{}, nil, context.Err()
+		}
+	default:
+	}
+
+	return inspect, raw, nil
+}
+
+// resolvePlatform returns the image to use for the platform: the image named
+// if docker has it and it is for the platform, otherwise the image for the
+// platform in its registry, by digest.
+func resolvePlatform(context context.Context, globals *btypes.Global, client *client.Client, name string) (string, error) {
+	p, err := registry.ParsePlatform(globals.Platform)
+	if err != nil {
+		return "", err
+	}
+
+	inspect, raw, err := client.ImageInspectWithRaw(context, name)
+	if err == nil && p.Matches(imagePlatform(inspect, raw)) {
+		return name, nil
+	}
+
+	return registry.NewClient(globals.Policy).Resolve(context, name, p)
+}
+
+// imagePlatform returns the platform of an image docker has. The variant is
+// only given by newer versions of docker.
+func imagePlatform(inspect types.ImageInspect, raw []byte) registry.Platform {
+	variant := struct{ Variant string }{}
+	json.Unmarshal(raw, &variant)
+
+	return registry.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: variant.Variant}
+}
+
+// checkPlatform returns an error if the image is not for the platform being
+// built for.
+func checkPlatform(globals *btypes.Global, name string, platform registry.Platform) error {
+	if globals.Platform == "" {
+		return nil
+	}
 
-		// this will fallthrough to the assignment below
-		inspect, _, err = client.ImageInspectWithRaw(context, name)
+	p, err := registry.ParsePlatform(globals.Platform)
+	if err != nil {
+		return err
+	}
+
+	if !p.Matches(platform) {
+		return fmt.Errorf("image %q is for %s, not %s", name, platform, p)
+	}
+
+	return nil
+}
+
+func setPlatform(config *config.Config, platform registry.Platform) {
+	config.Architecture = platform.Architecture
+	config.OS = platform.OS
+	config.Variant = platform.Variant
+}
+
+// Archive loads an image from an image file saved by docker save or box save,
+// overwrites the container configuration, and returns its ID and layers. name
+// selects an image by tag if the file holds several; otherwise the first is
+// used. The file is not loaded again if docker already has the image.
+func Archive(context context.Context, globals *btypes.Global, client *client.Client, config *config.Config, file, name string) (string, []string, error) {
+	images, err := image.ReadImages(file)
+	if err != nil {
+		return "", nil, err
+	}
+
+	img, err := selectImage(images, name)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	platform := registry.Platform{}
+	for key, field := range map[string]*string{"os": &platform.OS, "architecture": &platform.Architecture, "variant": &platform.Variant} {
+		*field, _ = img.Config[key].(string)
+	}
+
+	if err := checkPlatform(globals, file, platform); err != nil {
+		return "", nil, err
+	}
+
+	inspect, _, err := client.ImageInspectWithRaw(context, img.ID)
+	if err != nil {
+		if _, err := Load(context, client, file, globals.Logger); err != nil {
+			return "", nil, err
+		}
+
+		inspect, _, err = client.ImageInspectWithRaw(context, img.ID)
 		if err != nil {
 			return "", nil, err
 		}
+	}
 
-		select {
-		case <-context.Done():
-			if context.Err() != nil {
-				return "", nil, context.Err()
-			}
-		default:
+	config.FromDocker(inspect.Config)
+	config.Image = inspect.ID
+	setPlatform(config, platform)
+
+	return inspect.ID, inspect.RootFS.Layers, nil
+}
+
+// ImportRepository is the repository filesystem tarballs imported for plans
+// are tagged in, with the sha256 of the tarball as the tag, so a tarball is
+// only imported once.
+const ImportRepository = "box-import"
+
+// Tar imports a filesystem tarball, such as one written by debootstrap or box
+// export, as an image with one layer, overwrites the container configuration,
+// and returns its ID and layers. The tarball is not imported again if docker
+// already has it.
+func Tar(context context.Context, globals *btypes.Global, client *client.Client, config *config.Config, file string) (string, []string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tag := fmt.Sprintf("%s:%x", ImportRepository, hash.Sum(nil))
+
+	inspect, raw, err := client.ImageInspectWithRaw(context, tag)
+	if err != nil {
+		id, err := Import(context, client, file, nil, globals.Logger)
+		if err != nil {
+			return "", nil, err
+		}
+
+		err = client.ImageTag(context, id, tag)
+		audit.Record(audit.Tag, tag, id, err)
+		if err != nil {
+			return "", nil, err
+		}
+
+		inspect, raw, err = client.ImageInspectWithRaw(context, id)
+		if err != nil {
+			return "", nil, err
 		}
 	}
 
 	config.FromDocker(inspect.Config)
 	config.Image = inspect.ID
 
+	// the filesystem has no platform; docker gives it its own.
+	if globals.Platform != "" {
+		platform, err := registry.ParsePlatform(globals.Platform)
+		if err != nil {
+			return "", nil, err
+		}
+		setPlatform(config, platform)
+	} else {
+		setPlatform(config, imagePlatform(inspect, raw))
+	}
+
 	return inspect.ID, inspect.RootFS.Layers, nil
 }
+
+// Import imports a filesystem tarball, which may be compressed, into docker
+// as an image with one layer. changes are Dockerfile instructions applied to
+// its configuration, such as ENV or CMD. Returns the ID of the image.
+func Import(context context.Context, client *client.Client, file string, changes []string, logger *logger.Logger) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// docker decompresses gzip, bzip2 and xz itself, but not zstd.
+	compression, src, err := bt.Compression(f)
+	if err != nil {
+		return "", err
+	}
+
+	if compression == bt.Zstd {
+		dec, err := bt.Decompress(src)
+		if err != nil {
+			return "", err
+		}
+		defer dec.Close()
+		src = dec
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(copy.WithProgress(w, src, logger, fmt.Sprintf("Importing %q", file)))
+	}()
+
+	resp, err := client.ImageImport(context, types.ImageImportSource{Source: r, SourceName: "-"}, "", types.ImageImportOptions{Changes: changes})
+	if err != nil {
+		r.CloseWithError(err)
+		return "", err
+	}
+	defer resp.Close()
+
+	// docker reports the ID of the image, or a failed import, in the response.
+	var id string
+
+	dec := json.NewDecoder(resp)
+	for {
+		msg := struct{ Status, Error string }{}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if msg.Error != "" {
+			return "", fmt.Errorf("importing %s: %s", file, msg.Error)
+		}
+
+		if strings.HasPrefix(msg.Status, "sha256:") {
+			id = msg.Status
+		}
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("importing %s: docker did not return an image ID", file)
+	}
+
+	return id, nil
+}
+
+func selectImage(images []image.ArchiveImage, name string) (image.ArchiveImage, error) {
+	if len(images) == 0 {
+		return image.ArchiveImage{}, fmt.Errorf("no images in the file")
+	}
+
+	if name == "" {
+		return images[0], nil
+	}
+
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if tag == name {
+				return img, nil
+			}
+		}
+	}
+
+	return image.ArchiveImage{}, fmt.Errorf("no image tagged %q in the file", name)
+}
+
+// Load loads the images in an image file saved by docker save or box save
+// into docker. It returns the images loaded.
+func Load(context context.Context, client *client.Client, file string, logger *logger.Logger) ([]image.ArchiveImage, error) {
+	images, err := image.ReadImages(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(copy.WithProgress(w, f, logger, fmt.Sprintf("Loading %q", file)))
+	}()
+
+	resp, err := client.ImageLoad(context, r, true)
+	if err != nil {
+		r.CloseWithError(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// docker reports a failed load in the response.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := struct{ Error string }{}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if msg.Error != "" {
+			return nil, fmt.Errorf("loading %s: %s", file, msg.Error)
+		}
+	}
+
+	return images, nil
+}
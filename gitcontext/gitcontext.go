@@ -0,0 +1,198 @@
+// Package gitcontext builds from git repositories: it parses their URLs, as
+// URL#ref:subdir, and shallow-clones them to use as the context of a build.
+package gitcontext
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LabelSource and LabelRevision are the labels the images built from a
+// repository are given: the URL of the repository, and the commit built.
+const (
+	LabelSource   = "org.opencontainers.image.source"
+	LabelRevision = "org.opencontainers.image.revision"
+)
+
+// Source is a git repository to build from.
+type Source struct {
+	URL    string // the repository, as git takes it
+	Ref    string // the branch, tag or commit to build; the default branch if empty
+	Subdir string // the directory of the repository which is the context; its root if empty
+}
+
+// Parse parses a context given as a git URL, with the ref and the
+// subdirectory as its fragment: URL#ref:subdir, either of which may be left
+// out. URLs of git, ssh and scp-like user@host:path are repositories, as are
+// URLs of http, https and file whose path ends in .git. ok is false for
+// contexts which are not repositories.
+func Parse(s string) (source *Source, ok bool, err error) {
+	repo, fragment := s, ""
+	if i := strings.Index(s, "#"); i >= 0 {
+		repo, fragment = s[:i], s[i+1:]
+	}
+
+	if !isRepository(repo) {
+		return nil, false, nil
+	}
+
+	source = &Source{URL: repo}
+	source.Ref = fragment
+	if i := strings.Index(fragment, ":"); i >= 0 {
+		source.Ref, source.Subdir = fragment[:i], fragment[i+1:]
+	}
+
+	if strings.HasPrefix(source.Ref, "-") {
+		return nil, true, fmt.Errorf("invalid git context %q: invalid ref %q", s, source.Ref)
+	}
+
+	if source.Subdir != "" {
+		source.Subdir = path.Clean(source.Subdir)
+		if path.IsAbs(source.Subdir) || source.Subdir == ".." || strings.HasPrefix(source.Subdir, "../") {
+			return nil, true, fmt.Errorf("invalid git context %q: the subdirectory must be within the repository", s)
+		}
+
+		if source.Subdir == "." {
+			source.Subdir = ""
+		}
+	}
+
+	return source, true, nil
+}
+
+func isRepository(repo string) bool {
+	u, err := url.Parse(repo)
+	if err != nil || u.Scheme == "" {
+		// user@host:path, as scp takes it.
+		at, colon := strings.Index(repo, "@"), strings.Index(repo, ":")
+		return at > 0 && colon > at+1 && !strings.Contains(repo[:colon], "/")
+	}
+
+	switch u.Scheme {
+	case "git", "ssh", "git+ssh":
+		return true
+	case "http", "https", "file":
+		return strings.HasSuffix(u.Path, ".git") || strings.HasSuffix(u.Path, ".git/")
+	}
+
+	return false
+}
+
+// String returns the URL of the repository, without the password it may
+// have, so it can be logged and labeled with.
+func (s *Source) String() string {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.User == nil {
+		return s.URL
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.User(u.User.Username())
+	}
+
+	return u.String()
+}
+
+// URI returns the URL of the repository as SLSA provenance names git
+// repositories, with git+ before the scheme if it is not git's own.
+func (s *Source) URI() string {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Scheme == "" || strings.HasPrefix(u.Scheme, "git") {
+		return s.String()
+	}
+
+	return "git+" + s.String()
+}
+
+// Checkout is a repository cloned for a build.
+type Checkout struct {
+	Source *Source
+	Dir    string // the directory cloned into
+	Commit string // the SHA of the commit checked out
+}
+
+// Context returns the directory of the checkout which is the context.
+func (c *Checkout) Context() string {
+	return filepath.Join(c.Dir, filepath.FromSlash(c.Source.Subdir))
+}
+
+// Labels returns the labels of the images built from the checkout.
+func (c *Checkout) Labels() map[string]string {
+	return map[string]string{
+		LabelSource:   c.Source.String(),
+		LabelRevision: c.Commit,
+	}
+}
+
+// Clone shallow-clones the ref of the repository into dir, which must be
+// empty. Repositories over http and https are authenticated with the token if
+// one is given, and over ssh as git would on its own, through the ssh agent
+// and keys of the user. git is never prompted for credentials.
+func Clone(ctx context.Context, source *Source, dir, token string) (*Checkout, error) {
+	ref := source.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if token != "" {
+		// given as configuration in the environment, so it is not in the
+		// arguments of the processes, nor in the repository's configuration.
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = env
+
+		out := bytes.NewBuffer(nil)
+		cmd.Stdout = out
+		cmd.Stderr = out
+
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(out.String()))
+		}
+
+		return strings.TrimSpace(out.String()), nil
+	}
+
+	steps := [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", source.URL},
+		{"fetch", "-q", "--depth", "1", "origin", ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+	}
+
+	for _, args := range steps {
+		if _, err := git(args...); err != nil {
+			return nil, fmt.Errorf("could not clone %s: %v", source, err)
+		}
+	}
+
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("could not clone %s: %v", source, err)
+	}
+
+	checkout := &Checkout{Source: source, Dir: dir, Commit: commit}
+
+	if fi, err := os.Stat(checkout.Context()); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%s has no directory %s at %s", source, source.Subdir, ref)
+	}
+
+	return checkout, nil
+}
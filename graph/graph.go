@@ -0,0 +1,223 @@
+// Package graph records the steps of a build plan as a dependency graph,
+// without executing them. Steps within a stage depend on the step before
+// them; a stage depends on another stage when its `from` refers to an image
+// tagged by that stage.
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Edge kinds.
+const (
+	EdgeStep  = "step"  // a step depends on its predecessor in the stage
+	EdgeStage = "stage" // a stage's `from` depends on a tag in another stage
+)
+
+// Step is a single verb invocation in the plan.
+type Step struct {
+	ID       int      `json:"id"`
+	Stage    int      `json:"stage"`
+	Verb     string   `json:"verb"`
+	Args     []string `json:"args"`
+	CacheKey string   `json:"cache_key"`
+	Scope    []string `json:"scope,omitempty"`  // the blocks it is in, such as with_user, innermost last
+	Inputs   []string `json:"inputs,omitempty"` // the functions its arguments may come from, such as getenv
+
+	// Values are the arguments, with arrays as []interface{}, hashes as
+	// map[string]interface{} and the rest as strings.
+	Values []interface{} `json:"-"`
+}
+
+// Edge is a dependency between two steps.
+type Edge struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// Graph is the recorded plan.
+type Graph struct {
+	Steps []*Step `json:"steps"`
+	Edges []*Edge `json:"edges"`
+
+	stage  int
+	last   int
+	tags   map[string]int
+	scope  []string
+	inputs []string
+}
+
+// New constructs a new, empty *Graph.
+func New() *Graph {
+	return &Graph{
+		Steps: []*Step{},
+		Edges: []*Edge{},
+		last:  -1,
+		tags:  map[string]int{},
+	}
+}
+
+// Add records a step with its cache key, and returns it.
+func (g *Graph) Add(verb string, args []string, cacheKey string) *Step {
+	step := &Step{
+		ID:       len(g.Steps),
+		Verb:     verb,
+		Args:     args,
+		CacheKey: cacheKey,
+		Scope:    append([]string(nil), g.scope...),
+		Inputs:   g.inputs,
+	}
+	g.inputs = nil
+
+	if verb == "from" {
+		if len(g.Steps) > 0 {
+			g.stage++
+		}
+		g.last = -1
+
+		if len(args) > 0 {
+			if id, ok := g.tags[args[0]]; ok {
+				g.Edges = append(g.Edges, &Edge{From: id, To: step.ID, Kind: EdgeStage})
+			}
+		}
+	}
+
+	step.Stage = g.stage
+
+	if g.last >= 0 {
+		g.Edges = append(g.Edges, &Edge{From: g.last, To: step.ID, Kind: EdgeStep})
+	}
+
+	if verb == "tag" && len(args) > 0 {
+		g.tags[args[0]] = step.ID
+	}
+
+	g.last = step.ID
+	g.Steps = append(g.Steps, step)
+
+	return step
+}
+
+// Enter records that the steps after it are in the block of the verb, such
+// as with_user, until Leave.
+func (g *Graph) Enter(verb string, args []string) {
+	g.scope = append(g.scope, strings.TrimSpace(verb+" "+strings.Join(args, ", ")))
+}
+
+// Leave records the end of the block entered last.
+func (g *Graph) Leave() {
+	if len(g.scope) > 0 {
+		g.scope = g.scope[:len(g.scope)-1]
+	}
+}
+
+// Input records a call of a function, such as read, the next step's
+// arguments may come from.
+func (g *Graph) Input(fun string, args []string) {
+	g.inputs = append(g.inputs, strings.TrimSpace(fun+" "+strings.Join(args, ", ")))
+}
+
+// Stages returns the number of stages in the graph.
+func (g *Graph) Stages() int {
+	if len(g.Steps) == 0 {
+		return 0
+	}
+
+	return g.stage + 1
+}
+
+// Needs returns, for each graph, the graphs, by index, which tag an image its
+// stages start from, such as the plans of box multi which need the images of
+// each other.
+func Needs(graphs []*Graph) [][]int {
+	tagged := map[string]int{}
+	for i, g := range graphs {
+		for tag := range g.tags {
+			tagged[tag] = i
+		}
+	}
+
+	needs := make([][]int, len(graphs))
+
+	for i, g := range graphs {
+		seen := map[int]bool{}
+
+		for _, step := range g.Steps {
+			if step.Verb != "from" || len(step.Args) == 0 {
+				continue
+			}
+
+			if j, ok := tagged[step.Args[0]]; ok && j != i && !seen[j] {
+				seen[j] = true
+				needs[i] = append(needs[i], j)
+			}
+		}
+	}
+
+	return needs
+}
+
+// WriteJSON writes the graph as JSON.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	content, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(content))
+	return err
+}
+
+var dotReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotReplacer.Replace(s) + `"`
+}
+
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+
+	return key
+}
+
+// WriteDOT writes the graph in graphviz DOT format. Each stage is a cluster,
+// and each step is labeled with its verb, arguments and cache key.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	lines := []string{"digraph plan {", "  node [shape=box];"}
+
+	for stage := 0; stage < g.Stages(); stage++ {
+		lines = append(lines, fmt.Sprintf("  subgraph cluster_%d {", stage))
+		lines = append(lines, fmt.Sprintf("    label=%s;", dotQuote(fmt.Sprintf("stage %d", stage))))
+
+		for _, step := range g.Steps {
+			if step.Stage != stage {
+				continue
+			}
+
+			label := fmt.Sprintf("%s %s\ncache key: %s", step.Verb, strings.Join(step.Args, ", "), shortKey(step.CacheKey))
+			lines = append(lines, fmt.Sprintf("    step%d [label=%s];", step.ID, dotQuote(label)))
+		}
+
+		lines = append(lines, "  }")
+	}
+
+	for _, edge := range g.Edges {
+		attr := ""
+		if edge.Kind == EdgeStage {
+			attr = " [style=dashed]"
+		}
+
+		lines = append(lines, fmt.Sprintf("  step%d -> step%d%s;", edge.From, edge.To, attr))
+	}
+
+	lines = append(lines, "}")
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
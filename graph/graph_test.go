@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type graphSuite struct{}
+
+var _ = Suite(&graphSuite{})
+
+func TestGraph(t *T) {
+	TestingT(t)
+}
+
+func mkGraph() *Graph {
+	g := New()
+	g.Add("from", []string{"debian"}, "key0")
+	g.Add("run", []string{"make"}, "key1")
+	g.Add("tag", []string{"builder"}, "key2")
+	g.Add("from", []string{"builder"}, "key3")
+	g.Add("copy", []string{"a", "b"}, "key4")
+	return g
+}
+
+func (gs *graphSuite) TestAdd(c *C) {
+	g := mkGraph()
+
+	c.Assert(g.Stages(), Equals, 2)
+	c.Assert(g.Steps[1].Stage, Equals, 0)
+	c.Assert(g.Steps[3].Stage, Equals, 1)
+	c.Assert(g.Edges, DeepEquals, []*Edge{
+		{From: 0, To: 1, Kind: EdgeStep},
+		{From: 1, To: 2, Kind: EdgeStep},
+		{From: 2, To: 3, Kind: EdgeStage},
+		{From: 3, To: 4, Kind: EdgeStep},
+	})
+
+	c.Assert(New().Stages(), Equals, 0)
+}
+
+func (gs *graphSuite) TestScope(c *C) {
+	g := New()
+	g.Add("from", []string{"debian"}, "key0")
+	g.Enter("with_user", []string{"nobody"})
+	g.Enter("inside", []string{"/tmp"})
+	g.Input("read", []string{"/etc/hostname"})
+	g.Add("run", []string{"make"}, "key1")
+	g.Leave()
+	g.Add("run", []string{"make install"}, "key2")
+	g.Leave()
+	g.Add("cmd", []string{"make"}, "key3")
+
+	c.Assert(g.Steps[1].Scope, DeepEquals, []string{"with_user nobody", "inside /tmp"})
+	c.Assert(g.Steps[1].Inputs, DeepEquals, []string{"read /etc/hostname"})
+	c.Assert(g.Steps[2].Scope, DeepEquals, []string{"with_user nobody"})
+	c.Assert(g.Steps[2].Inputs, IsNil)
+	c.Assert(g.Steps[3].Scope, IsNil)
+}
+
+func (gs *graphSuite) TestNeeds(c *C) {
+	app := New()
+	app.Add("from", []string{"builder"}, "key0")
+	app.Add("tag", []string{"app"}, "key1")
+
+	tests := New()
+	tests.Add("from", []string{"app"}, "key0")
+	tests.Add("from", []string{"builder"}, "key1")
+
+	other := New()
+	other.Add("from", []string{"alpine"}, "key0")
+
+	c.Assert(Needs([]*Graph{mkGraph(), app, tests, other}), DeepEquals, [][]int{nil, {0}, {1, 0}, nil})
+}
+
+func (gs *graphSuite) TestWriteJSON(c *C) {
+	buf := new(bytes.Buffer)
+	c.Assert(mkGraph().WriteJSON(buf), IsNil)
+
+	g := New()
+	c.Assert(json.Unmarshal(buf.Bytes(), g), IsNil)
+	c.Assert(len(g.Steps), Equals, 5)
+	c.Assert(g.Steps[4].CacheKey, Equals, "key4")
+	c.Assert(len(g.Edges), Equals, 4)
+}
+
+func (gs *graphSuite) TestWriteDOT(c *C) {
+	buf := new(bytes.Buffer)
+	c.Assert(mkGraph().WriteDOT(buf), IsNil)
+
+	out := buf.String()
+	c.Assert(strings.HasPrefix(out, "digraph plan {"), Equals, true)
+	c.Assert(strings.Contains(out, "subgraph cluster_1 {"), Equals, true)
+	c.Assert(strings.Contains(out, `step2 -> step3 [style=dashed];`), Equals, true)
+	c.Assert(strings.Contains(out, `step4 [label="copy a, b\ncache key: key4"];`), Equals, true)
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/fetcher"
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/sbom"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+func runSave(ctx *cli.Context) {
+	log := logger.New("save", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) == 0 || ctx.String("output") == "" {
+		cli.ShowCommandHelp(ctx, "save")
+		log.Error("Please provide the images to save and a file to save them to!")
+		os.Exit(1)
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	output := ctx.String("output")
+
+	if err := saveImages(client, ctx.Args(), output, log); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Saved %s to %s", strings.Join(ctx.Args(), ", "), output))
+}
+
+// saveImages saves the images to a temporary file beside output, which is
+// renamed to output once it is complete.
+func saveImages(client *client.Client, images []string, output string, log *logger.Logger) error {
+	rc, err := client.ImageSave(context.Background(), images)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	signal.Handler.AddFile(tmp)
+	defer signal.Handler.RemoveFile(tmp)
+	defer os.Remove(tmp)
+
+	err = copy.WithProgress(f, rc, log, fmt.Sprintf("Saving %q", output))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, output)
+}
+
+func runExport(ctx *cli.Context) {
+	log := logger.New("export", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 || ctx.String("output") == "" {
+		cli.ShowCommandHelp(ctx, "export")
+		log.Error("Please provide the image to export and a file to write it to!")
+		os.Exit(1)
+	}
+
+	image, output := ctx.Args()[0], ctx.String("output")
+
+	if output == "-" {
+		if err := layers.ExportImage(context.Background(), image, os.Stdout); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	signal.Handler.AddFile(tmp)
+
+	err = layers.ExportImage(context.Background(), image, f)
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, output)
+	}
+
+	signal.Handler.RemoveFile(tmp)
+	os.Remove(tmp)
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Exported the filesystem of %s to %s", image, output))
+}
+
+// imagePath splits an argument of the form image:/path.
+func imagePath(arg string) (string, string, error) {
+	i := strings.Index(arg, ":/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("%q is not of the form image:/path", arg)
+	}
+
+	return arg[:i], arg[i+1:], nil
+}
+
+func runCat(ctx *cli.Context) {
+	log := logger.New("cat", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "cat")
+		log.Error("Please provide the image and the path of the file to print!")
+		os.Exit(1)
+	}
+
+	image, path, err := imagePath(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err := layers.CatFile(context.Background(), image, path, os.Stdout); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func runExtract(ctx *cli.Context) {
+	log := logger.New("extract", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 2 {
+		cli.ShowCommandHelp(ctx, "extract")
+		log.Error("Please provide the image and the path to extract, and a directory to extract it to!")
+		os.Exit(1)
+	}
+
+	image, path, err := imagePath(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err := layers.ExtractPath(context.Background(), image, path, ctx.Args()[1]); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Extracted %s from %s to %s", path, image, ctx.Args()[1]))
+}
+
+func runMount(ctx *cli.Context) {
+	log := logger.New("mount", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 2 {
+		cli.ShowCommandHelp(ctx, "mount")
+		log.Error("Please provide the image to mount and a directory to mount it at!")
+		os.Exit(1)
+	}
+
+	mount, err := layers.MountImage(context.Background(), ctx.Args()[0], ctx.Args()[1], log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if mount.Overlay {
+		log.Finish(fmt.Sprintf("Mounted %s at %s", mount.Image, mount.Target))
+	} else {
+		log.Finish(fmt.Sprintf("Copied %s to %s", mount.Image, mount.Target))
+	}
+}
+
+func runUnmount(ctx *cli.Context) {
+	log := logger.New("unmount", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "unmount")
+		log.Error("Please provide the directory to unmount!")
+		os.Exit(1)
+	}
+
+	mount, err := layers.UnmountImage(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Unmounted %s from %s", mount.Image, mount.Target))
+}
+
+func runImport(ctx *cli.Context) {
+	log := logger.New("import", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "import")
+		log.Error("Please provide a tarball to import!")
+		os.Exit(1)
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	id, err := fetcher.Import(context.Background(), client, ctx.Args()[0], ctx.StringSlice("change"), log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if tag := ctx.String("tag"); tag != "" {
+		err := client.ImageTag(context.Background(), id, tag)
+		audit.Record(audit.Tag, tag, id, err)
+		if err != nil {
+			log.Error(fmt.Sprintf("Can't tag with tag %q: %v", tag, err))
+			os.Exit(1)
+		}
+		log.Tag(tag)
+	}
+
+	log.Finish(id)
+}
+
+func runLoad(ctx *cli.Context) {
+	log := logger.New("load", ctx.GlobalBool("no-trim"))
+
+	if ctx.String("input") == "" {
+		cli.ShowCommandHelp(ctx, "load")
+		log.Error("Please provide a tarball to load!")
+		os.Exit(1)
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	images, err := fetcher.Load(context.Background(), client, ctx.String("input"), log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	for _, img := range images {
+		if len(img.RepoTags) > 0 {
+			log.Finish(fmt.Sprintf("Loaded %s (%s)", img.ID, strings.Join(img.RepoTags, ", ")))
+		} else {
+			log.Finish(fmt.Sprintf("Loaded %s", img.ID))
+		}
+	}
+}
+
+func runDiff(ctx *cli.Context) {
+	log := logger.New("diff", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 2 {
+		cli.ShowCommandHelp(ctx, "diff")
+		log.Error("Please provide the two images to compare!")
+		os.Exit(1)
+	}
+
+	diff, err := layers.DiffImages(context.Background(), ctx.Args()[0], ctx.Args()[1], ctx.Bool("files"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d layer(s) in common\n", diff.Common)
+	for _, layer := range diff.Removed {
+		fmt.Printf("- %s\n", layer)
+	}
+	for _, layer := range diff.Added {
+		fmt.Printf("+ %s\n", layer)
+	}
+
+	if !ctx.Bool("files") {
+		return
+	}
+
+	var growth int64
+	counts := map[string]int{}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, change := range diff.Changes {
+		counts[change.Kind]++
+
+		switch change.Kind {
+		case "A":
+			growth += change.New.Size
+			fmt.Fprintf(w, "A\t%s\t%s\n", change.Path, units.HumanSize(float64(change.New.Size)))
+		case "D":
+			growth -= change.Old.Size
+			fmt.Fprintf(w, "D\t%s\t%s\n", change.Path, units.HumanSize(float64(change.Old.Size)))
+		case "M":
+			growth += change.New.Size - change.Old.Size
+			fmt.Fprintf(w, "M\t%s\t%s -> %s\n", change.Path, units.HumanSize(float64(change.Old.Size)), units.HumanSize(float64(change.New.Size)))
+		}
+	}
+	w.Flush()
+
+	sign := "+"
+	if growth < 0 {
+		sign = "-"
+		growth = -growth
+	}
+
+	fmt.Printf("\n%d added, %d deleted, %d modified; %s%s\n", counts["A"], counts["D"], counts["M"], sign, units.HumanSize(float64(growth)))
+}
+
+func runAnalyze(ctx *cli.Context) {
+	log := logger.New("analyze", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "analyze")
+		log.Error("Please provide the image!")
+		os.Exit(1)
+	}
+
+	analysis, err := layers.AnalyzeImage(context.Background(), ctx.Args()[0], ctx.Int("top"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(analysis); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tSIZE\tFILES\tWASTED\tCREATED BY")
+
+	for i, layer := range analysis.Layers {
+		createdBy := strings.Replace(layer.CreatedBy, "\t", " ", -1)
+		if !ctx.GlobalBool("no-trim") && len(createdBy) > 60 {
+			createdBy = createdBy[:57] + "..."
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n",
+			i,
+			units.HumanSize(float64(layer.Size)),
+			layer.Files,
+			units.HumanSize(float64(layer.Wasted)),
+			createdBy,
+		)
+	}
+	w.Flush()
+
+	printLargest(analysis)
+	printWasted(analysis, ctx.Int("top"))
+
+	var wasted float64
+	if analysis.Size > 0 {
+		wasted = 100 * float64(analysis.Wasted) / float64(analysis.Size)
+	}
+
+	fmt.Printf("\n%d layer(s), %s; %s (%.1f%%) wasted\n", len(analysis.Layers), units.HumanSize(float64(analysis.Size)), units.HumanSize(float64(analysis.Wasted)), wasted)
+}
+
+// printLargest prints the largest directories and files of each layer of the
+// analysis.
+func printLargest(analysis *layers.ImageAnalysis) {
+	for i, layer := range analysis.Layers {
+		if len(layer.LargestFiles) == 0 {
+			continue
+		}
+
+		fmt.Printf("\nLayer %d:\n", i)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, dir := range layer.LargestDirs {
+			fmt.Fprintf(w, "  %s/\t%s\n", dir.Path, units.HumanSize(float64(dir.Size)))
+		}
+		for _, file := range layer.LargestFiles {
+			fmt.Fprintf(w, "  %s\t%s\n", file.Path, units.HumanSize(float64(file.Size)))
+		}
+		w.Flush()
+	}
+}
+
+// printWasted prints the top files of the analysis which are wasted.
+func printWasted(analysis *layers.ImageAnalysis, top int) {
+	if len(analysis.WastedFiles) == 0 {
+		return
+	}
+
+	fmt.Println("\nWasted:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, file := range analysis.WastedFiles {
+		if i == top {
+			fmt.Fprintf(w, "  ... %d more\n", len(analysis.WastedFiles)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %s\tlayer %d\t%s\n", file.Path, file.Layer, units.HumanSize(float64(file.Size)))
+	}
+	w.Flush()
+}
+
+func runSBOM(ctx *cli.Context) {
+	log := logger.New("sbom", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "sbom")
+		log.Error("Please provide the image to write an SBOM of!")
+		os.Exit(1)
+	}
+
+	format := ctx.String("format")
+	if sbom.MediaType(format) == "" {
+		log.Error(fmt.Sprintf("Invalid format %q: must be %s or %s", format, sbom.SPDX, sbom.CycloneDX))
+		os.Exit(1)
+	}
+
+	doc, err := layers.ScanImage(context.Background(), ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	output := ctx.String("output")
+	if output == "" {
+		if err := doc.Write(os.Stdout, format, util.BuildTime()); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	err = doc.Write(f, format, util.BuildTime())
+	f.Close()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Wrote an SBOM of %d packages to %s", len(doc.Packages), output))
+}
+
+func runHistory(ctx *cli.Context) {
+	log := logger.New("history", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "history")
+		log.Error("Please provide the image!")
+		os.Exit(1)
+	}
+
+	docker, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	history, err := cache.ImageHistory(context.Background(), docker, ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(history); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE ID\tCREATED\tSIZE\tSTEP\tCREATED BY")
+
+	for _, layer := range history {
+		id := "<missing>"
+		if layer.ID != "" {
+			id = strings.TrimPrefix(layer.ID, "sha256:")[:12]
+		}
+
+		step := "-"
+		switch {
+		case layer.Step != "":
+			step = layer.Step
+		case layer.Key != "":
+			step = "box " + strings.TrimPrefix(layer.Key, cache.Prefix)[:12]
+		}
+
+		createdBy := strings.Replace(layer.CreatedBy, "\t", " ", -1)
+		if !ctx.GlobalBool("no-trim") {
+			if len(step) > 40 {
+				step = step[:37] + "..."
+			}
+			if len(createdBy) > 45 {
+				createdBy = createdBy[:42] + "..."
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s ago\t%s\t%s\t%s\n",
+			id,
+			units.HumanDuration(time.Since(layer.Created)),
+			units.HumanSize(float64(layer.Size)),
+			step,
+			createdBy,
+		)
+	}
+
+	w.Flush()
+}
+
+func runSquash(ctx *cli.Context) {
+	log := logger.New("squash", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "squash")
+		log.Error("Please provide an image to squash!")
+		os.Exit(1)
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	name := ctx.Args()[0]
+
+	to := ctx.Int("to")
+	if to < 0 {
+		inspect, _, err := client.ImageInspectWithRaw(context.Background(), name)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		to = len(inspect.RootFS.Layers) - 1
+	}
+
+	id, err := layers.SquashImage(context.Background(), name, ctx.Int("from"), to, log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if tag := ctx.String("tag"); tag != "" {
+		err := client.ImageTag(context.Background(), id, tag)
+		audit.Record(audit.Tag, tag, id, err)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	log.Finish(fmt.Sprintf("Squashed layers %d to %d of %s into %s", ctx.Int("from"), to, name, id))
+}
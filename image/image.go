@@ -2,21 +2,25 @@ package image
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/leak"
 	"github.com/box-builder/box/logger"
-	"github.com/box-builder/box/signal"
 	bt "github.com/box-builder/box/tar"
+	"github.com/box-builder/box/util"
 )
 
 // Layer is the metadata surrounding an image layer.
@@ -26,126 +30,132 @@ type Layer struct {
 	layerFilename string
 }
 
-type imageInfo struct {
-	layerOrder []string
-	layerMap   map[string]*Layer
-}
-
 // LayerID returns the layer ID associated with this layer.
 func (l *Layer) LayerID() string {
 	return fmt.Sprintf("sha256:%s", l.layer)
 }
 
-func extractLayers(img *imageInfo, dir, file string) error {
-	f, err := os.Open(file)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// unpack extracts the layers of the image file, as saved by docker, from the
+// stream into dir as they are read, summing them on the way. It returns the
+// layers in the order of the manifest, and the JSON files of the image file
+// by name.
+func unpack(r io.Reader, dir string) ([]*Layer, map[string][]byte, error) {
+	extracted := map[string]*Layer{}
+	links := map[string]string{}
+	files := map[string][]byte{}
 
-	tr := tar.NewReader(f)
+	tr := tar.NewReader(r)
 
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		if strings.HasSuffix(header.Name, ".tar") {
-			// this renames the file to be at the root with the sha as the filename itself.
-			// this just makes traversal a lot easier and makes less of a mess out of the filesystem.
-			layerID := filepath.Base(filepath.Dir(header.Name))
-			if len(layerID) != 64 {
-				return fmt.Errorf("invalid layerID: %v", layerID)
-			}
+		name := path.Clean(header.Name)
 
-			if strings.ContainsAny(layerID, "/.") {
-				return fmt.Errorf("Layer ID contains invalid characters: %v", layerID)
+		switch {
+		case strings.HasSuffix(name, ".json"):
+			content, err := readJSON(tr, header)
+			if err != nil {
+				return nil, nil, err
 			}
 
-			l, ok := img.layerMap[layerID]
-			if !ok {
-				return errors.New("layer not found")
+			files[name] = content
+		case strings.HasSuffix(name, ".tar"):
+			// docker saves a layer found more than once in the image once, and
+			// links to it.
+			if header.Typeflag == tar.TypeSymlink {
+				links[name] = path.Join(path.Dir(name), header.Linkname)
+				continue
 			}
 
-			out, err := os.Create(filepath.Join(dir, layerID))
+			layer, err := unpackLayer(tr, name, dir)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 
-			sum, err := bt.SumWithCopy(out, tr, logger.New(layerID[:12], false), fmt.Sprintf("Unpacking Layer ID %s", layerID[:12]))
-			if err != nil {
-				return err
-			}
-
-			l.layer = sum
-			l.filename = out.Name()
+			extracted[name] = layer
 		}
 	}
 
-	return nil
-}
+	for name, target := range links {
+		layer, ok := extracted[target]
+		if !ok {
+			return nil, nil, fmt.Errorf("layer %s links to %s, which is not in the image file", name, target)
+		}
 
-func extractManifest(file string) (*imageInfo, error) {
-	img := &imageInfo{
-		layerOrder: []string{},
-		layerMap:   map[string]*Layer{},
+		extracted[name] = layer
 	}
 
-	f, err := os.Open(file)
+	layers, err := manifestLayers(files, extracted)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	defer f.Close()
+	return layers, files, nil
+}
 
-	tr := tar.NewReader(f)
+// unpackLayer extracts the layer of the entry of the name from the stream
+// into dir, summing it on the way.
+func unpackLayer(tr io.Reader, name, dir string) (*Layer, error) {
+	// this renames the file to be at the root with the sha as the filename itself.
+	// this just makes traversal a lot easier and makes less of a mess out of the filesystem.
+	layerID := path.Base(path.Dir(name))
+	if len(layerID) != 64 {
+		return nil, fmt.Errorf("invalid layerID: %v", layerID)
+	}
 
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
+	if strings.ContainsAny(layerID, "/.") {
+		return nil, fmt.Errorf("Layer ID contains invalid characters: %v", layerID)
+	}
 
-		if header.Name == "manifest.json" {
-			manifest := []map[string]interface{}{}
-			content, err := ioutil.ReadAll(tr)
-			if err != nil {
-				return nil, err
-			}
+	out, err := os.Create(filepath.Join(dir, layerID))
+	if err != nil {
+		return nil, err
+	}
 
-			if err := json.Unmarshal(content, &manifest); err != nil {
-				return nil, err
-			}
+	sum, err := bt.SumWithCopy(out, tr, logger.New(layerID[:12], false), fmt.Sprintf("Unpacking Layer ID %s", layerID[:12]))
+	if err != nil {
+		return nil, err
+	}
 
-			layers := []interface{}{}
+	return &Layer{layer: sum, filename: out.Name()}, nil
+}
 
-			for _, mf := range manifest {
-				tmp, ok := mf["Layers"].([]interface{})
-				if !ok {
-					return nil, fmt.Errorf("Manifest is broken: %#v", manifest)
-				}
+// manifestLayers returns the layers extracted, by the name of their file, in
+// the order of the manifest of the image file.
+func manifestLayers(files map[string][]byte, extracted map[string]*Layer) ([]*Layer, error) {
+	content, ok := files["manifest.json"]
+	if !ok {
+		return nil, errors.New("image file has no manifest.json")
+	}
 
-				layers = append(layers, tmp...)
-			}
+	manifest := []struct{ Layers []string }{}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+
+	layers := []*Layer{}
 
-			for _, layer := range layers {
-				layerID := strings.TrimSuffix(filepath.Base(filepath.Dir(layer.(string))), "/")
-				img.layerOrder = append(img.layerOrder, layerID)
-				img.layerMap[layerID] = &Layer{
-					layerFilename: layer.(string),
-				}
+	for _, mf := range manifest {
+		for _, name := range mf.Layers {
+			layer, ok := extracted[path.Clean(name)]
+			if !ok {
+				return nil, fmt.Errorf("Layer %v not found in the image file", name)
 			}
 
-			break
+			layers = append(layers, &Layer{
+				layer:         layer.layer,
+				filename:      layer.filename,
+				layerFilename: name,
+			})
 		}
 	}
 
-	return img, nil
+	return layers, nil
 }
 
 func writeLayer(imgwriter *tar.Writer, tarFile string, tf *os.File, logger *logger.Logger) error {
@@ -174,7 +184,7 @@ func writeLayer(imgwriter *tar.Writer, tarFile string, tf *os.File, logger *logg
 	return nil
 }
 
-func writeConfig(layers []*Layer, imgwriter *tar.Writer, config *config.Config) ([]string, error) {
+func writeConfig(layers []*Layer, imgwriter *tar.Writer, config *config.Config, fields map[string]interface{}) ([]string, error) {
 	if len(layers) < 1 {
 		return nil, fmt.Errorf("sum len (%d) is less than 1, nothing to write", len(layers))
 	}
@@ -194,7 +204,12 @@ func writeConfig(layers []*Layer, imgwriter *tar.Writer, config *config.Config)
 		"Layers": tarFiles,
 	}}
 
-	content, err := json.Marshal(config.ToImage(layerIDs))
+	img := config.ToImage(layerIDs)
+	for key, value := range fields {
+		img[key] = value
+	}
+
+	content, err := json.Marshal(img)
 	if err != nil {
 		return nil, err
 	}
@@ -251,8 +266,14 @@ func writeConfig(layers []*Layer, imgwriter *tar.Writer, config *config.Config)
 	return tarFiles, nil
 }
 
-func tmpfile() (*os.File, error) {
-	return ioutil.TempFile("", "box-temp-image")
+// unpackDir makes the temporary directory layers are unpacked into.
+func unpackDir() (string, error) {
+	dir, err := ioutil.TempDir("", "box-image-tmp")
+	if err != nil {
+		return dir, err
+	}
+
+	return filepath.EvalSymlinks(dir)
 }
 
 // Unpack unpacks an image into the temporary filesystem. Returns a list of
@@ -263,90 +284,413 @@ func tmpfile() (*os.File, error) {
 // files kept so it can be removed later. The dir will always be returned if
 // possible; even when a later operation returns an error.
 func Unpack(file string) ([]*Layer, string, error) {
-	var err error
-	file, err = filepath.EvalSymlinks(file)
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, "", err
 	}
+	defer f.Close()
 
-	dir, err := ioutil.TempDir("", "box-image-tmp")
+	dir, err := unpackDir()
 	if err != nil {
 		return nil, dir, err
 	}
 
-	dir, err = filepath.EvalSymlinks(dir)
+	layers, _, err := unpack(f, dir)
+	return layers, dir, err
+}
+
+// UnpackReader unpacks the image file, as saved by docker, from the stream in
+// one pass, as Unpack does the file, so the image file itself is never
+// written. It also returns the configuration of the image, which must be the
+// only one in the image file. The dir is returned as it is by Unpack.
+func UnpackReader(r io.Reader) ([]*Layer, map[string]interface{}, string, error) {
+	dir, err := unpackDir()
 	if err != nil {
-		return nil, dir, err
+		return nil, nil, dir, err
 	}
 
-	img, err := extractManifest(file)
+	layers, files, err := unpack(r, dir)
 	if err != nil {
-		return nil, dir, err
+		return nil, nil, dir, err
 	}
 
-	if err := extractLayers(img, dir, file); err != nil {
-		return nil, dir, err
+	images, err := readImages(files)
+	if err != nil {
+		return nil, nil, dir, err
 	}
 
-	layers := []*Layer{}
+	if len(images) != 1 {
+		return nil, nil, dir, fmt.Errorf("image file holds %d images, not 1", len(images))
+	}
 
-	for _, layerID := range img.layerOrder {
-		if layer, ok := img.layerMap[layerID]; ok {
-			layers = append(layers, layer)
-		} else {
-			return nil, dir, fmt.Errorf("Layer ID %v not found in mapping: %v", layerID, img.layerMap)
-		}
+	return layers, images[0].Config, dir, nil
+}
+
+// ReadLayer writes the layer tarball from the stream into a file in dir,
+// summing it as it is read, and returns the layer, which may be assembled into
+// an image with Assemble.
+func ReadLayer(dir string, r io.Reader, logger *logger.Logger, fileType string) (*Layer, error) {
+	out, err := ioutil.TempFile(dir, "layer")
+	if err != nil {
+		return nil, err
 	}
 
-	return layers, dir, nil
+	sum, err := bt.SumWithCopy(out, r, logger, fileType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Layer{
+		layer:         sum,
+		filename:      out.Name(),
+		layerFilename: fmt.Sprintf("%s/layer.tar", sum),
+	}, nil
 }
 
-// Flatten copies a tarred up series of files (passed in through the io.Reader
-// handle) to the image where they are untarred. Returns the filename of the
-// image created.
-func Flatten(config *config.Config, id string, size int64, tw io.Reader, logger *logger.Logger) (string, error) {
-	out, err := tmpfile()
+// Assemble writes an image file of layers unpacked by Unpack, or read by
+// ReadLayer, with the configuration to the writer, which may be the image
+// load of docker itself. fields are added to the image configuration, for
+// example to give it a history.
+func Assemble(w io.Writer, config *config.Config, layers []*Layer, fields map[string]interface{}, logger *logger.Logger) error {
+	imgwriter := tar.NewWriter(w)
+
+	tarFiles, err := writeConfig(layers, imgwriter, config, fields)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	for i, layer := range layers {
+		tf, err := os.Open(layer.filename)
+		if err != nil {
+			return err
+		}
+
+		err = writeLayer(imgwriter, tarFiles[i], tf, logger)
+		tf.Close()
+		if err != nil {
+			return err
+		}
 	}
 
-	signal.Handler.AddFile(out.Name())
-	defer signal.Handler.RemoveFile(out.Name())
+	return imgwriter.Close()
+}
+
+// Squash merges the layers, unpacked by Unpack, into one layer kept in dir.
+// See tar.Squash.
+func Squash(dir string, layers []*Layer) (*Layer, error) {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
+	}
 
+	out, err := ioutil.TempFile(dir, "squash")
+	if err != nil {
+		return nil, err
+	}
 	defer out.Close()
 
-	tf, err := tmpfile()
+	hash := sha256.New()
+	if err := bt.Squash(io.MultiWriter(out, hash), files); err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	return &Layer{
+		layer:         sum,
+		filename:      out.Name(),
+		layerFilename: fmt.Sprintf("%s/layer.tar", sum),
+	}, nil
+}
+
+// Normalize writes each of the layers, unpacked by Unpack, normalized into
+// dir. See tar.Normalize.
+func Normalize(dir string, layers []*Layer, modTime time.Time) ([]*Layer, error) {
+	return rewriteLayers(dir, layers, func(w io.Writer, fn string) error {
+		return bt.Normalize(w, fn, modTime)
+	})
+}
+
+// ClampTimes writes each of the layers, unpacked by Unpack, into dir with no
+// time later than max. See tar.ClampTimes.
+func ClampTimes(dir string, layers []*Layer, max time.Time) ([]*Layer, error) {
+	return rewriteLayers(dir, layers, func(w io.Writer, fn string) error {
+		return bt.ClampTimes(w, fn, max)
+	})
+}
+
+// Exclude writes the layer, unpacked by Unpack, into dir without the files
+// matching the patterns. See tar.Exclude.
+func Exclude(dir string, layer *Layer, patterns []string) (*Layer, error) {
+	excluded, err := rewriteLayers(dir, []*Layer{layer}, func(w io.Writer, fn string) error {
+		return bt.Exclude(w, fn, patterns)
+	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return excluded[0], nil
+}
+
+// rewriteLayers writes each of the layers into dir with rewrite, and returns
+// the layers written.
+func rewriteLayers(dir string, layers []*Layer, rewrite func(w io.Writer, fn string) error) ([]*Layer, error) {
+	rewritten := []*Layer{}
+
+	for _, layer := range layers {
+		out, err := ioutil.TempFile(dir, "rewritten")
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.New()
+		err = rewrite(io.MultiWriter(out, hash), layer.filename)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		sum := hex.EncodeToString(hash.Sum(nil))
+
+		rewritten = append(rewritten, &Layer{
+			layer:         sum,
+			filename:      out.Name(),
+			layerFilename: fmt.Sprintf("%s/layer.tar", sum),
+		})
+	}
+
+	return rewritten, nil
+}
+
+// Index returns the files of the filesystem the layers, unpacked by Unpack,
+// make up. See tar.Index.
+func Index(layers []*Layer) (map[string]*bt.Entry, error) {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
+	}
+
+	return bt.Index(files)
+}
+
+// Analyze returns what the layers, unpacked by Unpack, hold. See tar.Analyze.
+func Analyze(layers []*Layer, top int) (*bt.Analysis, error) {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
+	}
+
+	return bt.Analyze(files, top)
+}
+
+// FindLeaks returns the secrets found in the files of the layers, unpacked by
+// Unpack, but the first skip of them. See leak.Scan.
+func FindLeaks(layers []*Layer, skip int, known []string) ([]leak.Finding, error) {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
+	}
+
+	return leak.Scan(files, skip, known)
+}
+
+// Export writes the filesystem the layers, unpacked by Unpack, make up to w as
+// one tarball. See tar.Export.
+func Export(w io.Writer, layers []*Layer) error {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
+	}
+
+	return bt.Export(w, files)
+}
+
+// Cat writes the content of the file at name in the filesystem the layers,
+// unpacked by Unpack, make up to w. See tar.Cat.
+func Cat(w io.Writer, layers []*Layer, name string) error {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
 	}
 
-	signal.Handler.AddFile(tf.Name())
-	defer signal.Handler.RemoveFile(tf.Name())
+	return bt.Cat(w, files, name)
+}
 
-	defer os.Remove(tf.Name())
+// ExtractPath writes the file or directory at name in the filesystem the
+// layers, unpacked by Unpack, make up to w as a tarball. See tar.ExtractPath.
+func ExtractPath(w io.Writer, layers []*Layer, name string) error {
+	files := []string{}
+	for _, layer := range layers {
+		files = append(files, layer.filename)
+	}
+
+	return bt.ExtractPath(w, files, name)
+}
 
-	sum, err := bt.SumWithCopy(tf, tw, logger, "Processing Image for Flatten")
+// UnarchiveLayer unpacks the layer, unpacked by Unpack, into dest, with its
+// whiteouts in the form overlayfs expects. See tar.Unarchive.
+func UnarchiveLayer(layer *Layer, dest string) error {
+	f, err := os.Open(layer.filename)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer f.Close()
+
+	return bt.Unarchive(f, dest)
+}
+
+// ExtractLayer unpacks the layer into the destination directory as the user
+// running box: files are not chowned, and whiteouts are kept as .wh. files.
+func ExtractLayer(layer *Layer, dest string) error {
+	f, err := os.Open(layer.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return bt.Extract(f, dest)
+}
+
+// ArchiveImage is an image in an image file saved by docker.
+type ArchiveImage struct {
+	ID       string
+	RepoTags []string
+	Config   map[string]interface{}
+}
 
-	tf, err = os.Open(tf.Name())
+// ReadImages reads the images in the image file, as saved by docker, in the
+// order of its manifest.
+func ReadImages(file string) ([]ArchiveImage, error) {
+	f, err := os.Open(file)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	defer f.Close()
+
+	files := map[string][]byte{}
+
+	// the configurations may come before or after the manifest.
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasSuffix(header.Name, ".json") {
+			continue
+		}
+
+		content, err := readJSON(tr, header)
+		if err != nil {
+			return nil, err
+		}
+
+		files[path.Clean(header.Name)] = content
+	}
+
+	return readImages(files)
+}
+
+// maxJSONSize is the size of the largest JSON file of an image file read:
+// manifests and configurations are small, and files larger than this are not
+// read into memory.
+const maxJSONSize = 16 << 20
+
+// readJSON reads the JSON file of an image file, unless it is too large.
+func readJSON(r io.Reader, header *tar.Header) ([]byte, error) {
+	if header.Size > maxJSONSize {
+		return nil, fmt.Errorf("%s of the image file is larger than %d bytes", header.Name, maxJSONSize)
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// readImages reads the images of the JSON files of an image file, by name.
+func readImages(files map[string][]byte) ([]ArchiveImage, error) {
+	content, ok := files["manifest.json"]
+	if !ok {
+		return nil, errors.New("image file has no manifest.json")
 	}
-	defer tf.Close() // second close is fine here
 
-	imgwriter := tar.NewWriter(out)
-	defer imgwriter.Close()
+	manifest := []struct {
+		Config   string
+		RepoTags []string
+	}{}
+
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+
+	images := []ArchiveImage{}
+
+	for _, mf := range manifest {
+		content, ok := files[path.Clean(mf.Config)]
+		if !ok {
+			return nil, fmt.Errorf("image file has no configuration %q", mf.Config)
+		}
+
+		img := ArchiveImage{
+			ID:       fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+			RepoTags: mf.RepoTags,
+			Config:   map[string]interface{}{},
+		}
 
-	tarFiles, err := writeConfig([]*Layer{{layer: sum, layerFilename: fmt.Sprintf("%s/layer.tar", sum)}}, imgwriter, config)
+		if err := json.Unmarshal(content, &img.Config); err != nil {
+			return nil, err
+		}
+
+		images = append(images, img)
+	}
+
+	return images, nil
+}
+
+// ReadConfig reads the configuration of the image in the image file, as
+// saved by docker.
+func ReadConfig(file string) (map[string]interface{}, error) {
+	images, err := ReadImages(file)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if err := writeLayer(imgwriter, tarFiles[len(tarFiles)-1], tf, logger); err != nil {
-		return "", err
+	if len(images) != 1 {
+		return nil, fmt.Errorf("image file holds %d images, not 1", len(images))
+	}
+
+	return images[0].Config, nil
+}
+
+// SquashHistory returns the history of an image whose layers from through to
+// (counting from 0) were squashed: the entries of those layers, and the empty
+// ones between them, are replaced with one entry created by createdBy.
+func SquashHistory(history []interface{}, from, to int, createdBy string) []interface{} {
+	squashed := []interface{}{}
+	layer := 0
+
+	for _, item := range history {
+		entry, _ := item.(map[string]interface{})
+		if empty, _ := entry["empty_layer"].(bool); empty {
+			if layer <= from || layer > to {
+				squashed = append(squashed, item)
+			}
+			continue
+		}
+
+		switch {
+		case layer == to:
+			squashed = append(squashed, map[string]interface{}{
+				"created":    util.BuildTime().UTC().Format(time.RFC3339Nano),
+				"created_by": createdBy,
+			})
+		case layer < from || layer > to:
+			squashed = append(squashed, item)
+		}
+
+		layer++
 	}
 
-	return out.Name(), nil
+	return squashed
 }
@@ -1,12 +1,19 @@
 package image
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	. "testing"
 
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/logger"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 
@@ -68,3 +75,118 @@ func (is *imageSuite) TestUnpack(c *C) {
 		c.Assert(err, IsNil)
 	}
 }
+
+func (is *imageSuite) TestSquashHistory(c *C) {
+	entry := func(createdBy string, empty bool) map[string]interface{} {
+		e := map[string]interface{}{"created_by": createdBy}
+		if empty {
+			e["empty_layer"] = true
+		}
+		return e
+	}
+
+	history := []interface{}{
+		entry("base", false),
+		entry("env", true),
+		entry("run 1", false),
+		entry("workdir", true),
+		entry("run 2", false),
+		entry("cmd", true),
+		entry("run 3", false),
+		entry("user", true),
+	}
+
+	squashed := SquashHistory(history, 1, 2, "squash")
+	createdBy := []string{}
+	for _, item := range squashed {
+		createdBy = append(createdBy, item.(map[string]interface{})["created_by"].(string))
+	}
+
+	c.Assert(createdBy, DeepEquals, []string{"base", "env", "squash", "cmd", "run 3", "user"})
+}
+
+func (is *imageSuite) TestReadImages(c *C) {
+	fn := filepath.Join(c.MkDir(), "images.tar")
+	f, err := os.Create(fn)
+	c.Assert(err, IsNil)
+
+	configs := [][]byte{[]byte(`{"os":"linux"}`), []byte(`{"os":"windows"}`)}
+	files := map[string][]byte{
+		"manifest.json": []byte(`[{"Config":"one.json","RepoTags":["one:latest"]},{"Config":"two.json"}]`),
+		"one.json":      configs[0],
+		"two.json":      configs[1],
+	}
+
+	tw := tar.NewWriter(f)
+	// the manifest is written first, before the configurations it names.
+	for _, name := range []string{"manifest.json", "one.json", "two.json"} {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}), IsNil)
+		_, err := tw.Write(files[name])
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	f.Close()
+
+	images, err := ReadImages(fn)
+	c.Assert(err, IsNil)
+	c.Assert(len(images), Equals, 2)
+
+	c.Assert(images[0].ID, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(configs[0])))
+	c.Assert(images[0].RepoTags, DeepEquals, []string{"one:latest"})
+	c.Assert(images[0].Config["os"], Equals, "linux")
+	c.Assert(images[1].ID, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(configs[1])))
+	c.Assert(images[1].Config["os"], Equals, "windows")
+
+	_, err = ReadConfig(fn)
+	c.Assert(err, NotNil)
+}
+
+func (is *imageSuite) TestUnpackReader(c *C) {
+	layerA := []byte("layer a")
+	layerB := []byte("layer b")
+	idA := fmt.Sprintf("%064x", 1)
+	idB := fmt.Sprintf("%064x", 2)
+	idC := fmt.Sprintf("%064x", 3)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	write := func(name string, content []byte) {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}), IsNil)
+		_, err := tw.Write(content)
+		c.Assert(err, IsNil)
+	}
+
+	write(idA+"/layer.tar", layerA)
+	write(idB+"/layer.tar", layerB)
+	// the same layer again, which docker saves as a link.
+	c.Assert(tw.WriteHeader(&tar.Header{Name: idC + "/layer.tar", Linkname: "../" + idA + "/layer.tar", Typeflag: tar.TypeSymlink}), IsNil)
+	write("config.json", []byte(`{"os":"linux"}`))
+	write("manifest.json", []byte(fmt.Sprintf(`[{"Config":"config.json","Layers":["%s/layer.tar","%s/layer.tar","%s/layer.tar"]}]`, idB, idA, idC)))
+	c.Assert(tw.Close(), IsNil)
+
+	layers, cfg, dir, err := UnpackReader(buf)
+	defer os.RemoveAll(dir)
+	c.Assert(err, IsNil)
+	c.Assert(cfg["os"], Equals, "linux")
+	c.Assert(layers, HasLen, 3)
+
+	c.Assert(layers[0].LayerID(), Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(layerB)))
+	c.Assert(layers[1].LayerID(), Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(layerA)))
+	c.Assert(layers[2].LayerID(), Equals, layers[1].LayerID())
+
+	content, err := ioutil.ReadFile(layers[2].filename)
+	c.Assert(err, IsNil)
+	c.Assert(content, DeepEquals, layerA)
+
+	// the image written from the layers is loaded as docker saved it.
+	out := new(bytes.Buffer)
+	c.Assert(Assemble(out, config.NewConfig(), layers[:2], nil, logger.New("", false)), IsNil)
+
+	reassembled, _, dir2, err := UnpackReader(out)
+	defer os.RemoveAll(dir2)
+	c.Assert(err, IsNil)
+	c.Assert(reassembled, HasLen, 2)
+	c.Assert(reassembled[0].LayerID(), Equals, layers[0].LayerID())
+	c.Assert(reassembled[1].LayerID(), Equals, layers[1].LayerID())
+}
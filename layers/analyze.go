@@ -0,0 +1,84 @@
+package layers
+
+import (
+	"context"
+
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/tar"
+	"github.com/docker/docker/client"
+)
+
+// LayerAnalysis is what a layer of an image holds, and the step of its
+// history which made it.
+type LayerAnalysis struct {
+	DiffID    string `json:"diff_id"`
+	CreatedBy string `json:"created_by"`
+	tar.LayerAnalysis
+}
+
+// ImageAnalysis is what the layers of an image hold, and the space wasted in
+// them by files later layers overwrite or delete.
+type ImageAnalysis struct {
+	Image       string           `json:"image"`
+	Size        int64            `json:"size"`
+	Wasted      int64            `json:"wasted"`
+	Layers      []LayerAnalysis  `json:"layers"`
+	WastedFiles []tar.WastedFile `json:"wasted_files"`
+}
+
+// AnalyzeImage saves the image docker has and analyzes its layers, with the
+// top largest files and directories of each. See tar.Analyze.
+func AnalyzeImage(ctx context.Context, name string, top int) (*ImageAnalysis, error) {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	analysis, err := image.Analyze(saved.layers, top)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfs, _ := saved.config["rootfs"].(map[string]interface{})
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+
+	// the history has an entry for each layer, and for each step which made
+	// none; images without one have no steps to show.
+	createdBy := []string{}
+	history, _ := saved.config["history"].([]interface{})
+	for _, item := range history {
+		entry, _ := item.(map[string]interface{})
+		if empty, _ := entry["empty_layer"].(bool); !empty {
+			step, _ := entry["created_by"].(string)
+			createdBy = append(createdBy, step)
+		}
+	}
+
+	result := &ImageAnalysis{
+		Image:       name,
+		Size:        analysis.Size,
+		Wasted:      analysis.Wasted,
+		Layers:      []LayerAnalysis{},
+		WastedFiles: analysis.WastedFiles,
+	}
+
+	for i, layer := range analysis.Layers {
+		la := LayerAnalysis{LayerAnalysis: layer}
+		if i < len(diffIDs) {
+			la.DiffID, _ = diffIDs[i].(string)
+		}
+		if len(createdBy) == len(analysis.Layers) {
+			la.CreatedBy = createdBy[i]
+		}
+
+		result.Layers = append(result.Layers, la)
+	}
+
+	return result, nil
+}
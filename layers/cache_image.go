@@ -0,0 +1,147 @@
+package layers
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/fetcher"
+	"github.com/box-builder/box/image"
+)
+
+// cacheImage is an image given with --cache-from-image. The steps found in
+// its history re-use its layers.
+type cacheImage struct {
+	name    string
+	id      string
+	history *cache.History
+}
+
+// loadCacheImages pulls the cache images and reads their history. Images
+// which can't be used are skipped with a notice; like the registry cache, they
+// only speed the build up.
+func (d *DockerImage) loadCacheImages() []*cacheImage {
+	globals := d.imageConfig.Globals
+	images := []*cacheImage{}
+
+	for _, name := range globals.CacheFromImages {
+		img, err := d.loadCacheImage(name)
+		if err != nil {
+			globals.Logger.Print(globals.Logger.Notice(fmt.Sprintf("Could not use %q as a cache image: %v", name, err)))
+			continue
+		}
+
+		images = append(images, img)
+	}
+
+	return images
+}
+
+func (d *DockerImage) loadCacheImage(name string) (*cacheImage, error) {
+	// fetching overwrites the configuration it is given, which is not the one
+	// being built.
+	id, _, err := fetcher.Docker(d.imageConfig.Globals.Context, d.imageConfig.Globals, d.client, config.NewConfig(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(d.imageConfig.Globals.Context, id)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := d.client.ImageHistory(d.imageConfig.Globals.Context, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// docker lists the history newest first, and does not say which entries
+	// added a layer; those that did not have no size.
+	entries := []cache.HistoryEntry{}
+	for i := len(items) - 1; i >= 0; i-- {
+		entries = append(entries, cache.HistoryEntry{
+			Created:    time.Unix(items[i].Created, 0).UTC(),
+			CreatedBy:  items[i].CreatedBy,
+			Comment:    items[i].Comment,
+			EmptyLayer: items[i].Size == 0,
+		})
+	}
+
+	history, err := cache.NewHistory(entries, inspect.RootFS.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheImage{name: name, id: id, history: history}, nil
+}
+
+// ReuseCache looks the cache key up in the history of the cache images. If a
+// cache image has it, the current image is replaced with one of its layers up
+// to and including the step, and the current configuration. The step must
+// already have applied its changes to the configuration; the configuration at
+// each step is not kept in the history.
+func (d *DockerImage) ReuseCache(cacheKey string) (bool, error) {
+	globals := d.imageConfig.Globals
+
+	if !globals.Cache || len(globals.CacheFromImages) == 0 || !strings.HasPrefix(cacheKey, cache.Prefix) {
+		return false, nil
+	}
+
+	if d.cacheImages == nil {
+		d.cacheImages = d.loadCacheImages()
+	}
+
+	for _, img := range d.cacheImages {
+		entries, layers, ok := img.history.Find(cacheKey)
+		if !ok || layers == 0 {
+			continue
+		}
+
+		if err := d.reuse(img, entries, layers, cacheKey); err != nil {
+			return false, err
+		}
+
+		globals.Logger.CacheHit(d.imageConfig.Config.Image)
+		d.imageConfig.Config.BuiltBy = config.BuiltBy{Image: d.imageConfig.Config.Image, Key: cacheKey}
+
+		if globals.Report != nil {
+			globals.Report.Reuse(cacheKey)
+		}
+
+		return true, d.imageConfig.Layers.AddImage(d.imageConfig.Config.Image)
+	}
+
+	return false, nil
+}
+
+// reuse loads an image of the first layers of the cache image, with its first
+// entries of history, into docker.
+func (d *DockerImage) reuse(img *cacheImage, entries, layers int, cacheKey string) error {
+	saved, err := saveImage(d.imageConfig.Globals.Context, d.client, img.id)
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	unpacked := saved.layers
+
+	if len(unpacked) < layers {
+		return fmt.Errorf("cache image %q has %d layers, its history has %d", img.name, len(unpacked), len(img.history.Layers))
+	}
+
+	for i, layer := range unpacked[:layers] {
+		if layer.LayerID() != img.history.Layers[i] {
+			return fmt.Errorf("cache image %q has changed since it was inspected", img.name)
+		}
+	}
+
+	return d.load(func(w io.Writer) error {
+		return image.Assemble(w, d.imageConfig.Config, unpacked[:layers], map[string]interface{}{
+			"comment": cacheKey,
+			"history": img.history.Entries[:entries],
+		}, d.imageConfig.Globals.Logger)
+	})
+}
@@ -0,0 +1,439 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/spill"
+	bt "github.com/box-builder/box/tar"
+	btypes "github.com/box-builder/box/types"
+	"github.com/docker/docker/client"
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheStore is where the build cache is shared between machines, given with
+// --cache-from and --cache-to: a registry repository, or a cache backend.
+type cacheStore interface {
+	// Import imports the image for the cache key into the docker daemon. It
+	// returns false if the store does not have it.
+	Import(ctx context.Context, cacheKey string) (bool, error)
+
+	// Export exports the image, which was built for the cache key, to the
+	// store.
+	Export(ctx context.Context, image, cacheKey string) error
+}
+
+// openCacheStore opens the cache store at location for the build. Layers
+// exported to a cache backend are compressed with its compression.
+func openCacheStore(globals *btypes.Global, client *client.Client, location string) (cacheStore, error) {
+	if !cache.IsBackend(location) {
+		return &registryStore{repo: location, policy: globals.Policy}, nil
+	}
+
+	compression := globals.Compression
+
+	// the cache is only ever imported whole, so eStargz layers would be of no
+	// use.
+	if compression == bt.Estargz {
+		compression = bt.Gzip
+	}
+
+	backend, err := cache.OpenBackend(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backendStore{backend: backend, client: client, globals: globals, compression: compression}, nil
+}
+
+// importCache imports the image for the cache key from the cache store at
+// location into the docker daemon. It returns false if the store does not
+// have it.
+func (d *DockerImage) importCache(location, cacheKey string) (bool, error) {
+	if !strings.HasPrefix(cacheKey, cache.Prefix) {
+		return false, nil
+	}
+
+	store, err := openCacheStore(d.imageConfig.Globals, d.client, location)
+	if err != nil {
+		return false, err
+	}
+
+	return store.Import(d.imageConfig.Globals.Context, cacheKey)
+}
+
+// ExportCache exports the images committed or found in the cache during the
+// build to the cache store at location, so other builds may import them.
+func (d *Docker) ExportCache(location string) error {
+	store, err := openCacheStore(d.globals, d.client, location)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]struct{}{}
+
+	for _, image := range d.images {
+		if _, ok := seen[image]; ok {
+			continue
+		}
+		seen[image] = struct{}{}
+
+		inspect, _, err := d.client.ImageInspectWithRaw(d.globals.Context, image)
+		if err != nil {
+			return err
+		}
+
+		// images built before keys were content-addressed can't be imported.
+		if !strings.HasPrefix(inspect.Comment, cache.Prefix) {
+			continue
+		}
+
+		d.globals.Logger.Print(d.globals.Logger.Notice(fmt.Sprintf("Exporting cache for %s to %s", image, location)))
+
+		if err := store.Export(d.globals.Context, image, inspect.Comment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backendStore keeps the build cache in a cache backend. Each step is kept
+// under keys/ as its image configuration and the list of its layers. Layers
+// are kept once under layers/, named by their diff ID and compressed, as many
+// steps share them.
+type backendStore struct {
+	backend     cache.Backend
+	client      *client.Client
+	globals     *btypes.Global
+	compression string // the compression of the layers exported; gzip if empty
+}
+
+// backendEntry is the object kept for a step.
+type backendEntry struct {
+	Config      json.RawMessage `json:"config"`
+	Layers      []string        `json:"layers"`
+	Compression string          `json:"compression,omitempty"` // the compression of the layers; gzip if empty
+}
+
+func keyObject(cacheKey string) string {
+	return "keys/" + strings.TrimPrefix(cacheKey, cache.Prefix) + ".json"
+}
+
+func layerObject(diffID, compression string) string {
+	if compression == bt.Zstd {
+		return "layers/" + strings.TrimPrefix(diffID, "sha256:") + ".tar.zst"
+	}
+
+	return "layers/" + strings.TrimPrefix(diffID, "sha256:") + ".tar.gz"
+}
+
+// Import downloads the step's configuration and layers and loads them into
+// docker as an image archive. The configuration is unchanged, so the image
+// has the same ID as the one exported.
+func (b *backendStore) Import(ctx context.Context, cacheKey string) (bool, error) {
+	rc, err := b.backend.Get(ctx, keyObject(cacheKey))
+	if err == cache.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	entry := backendEntry{}
+	err = json.NewDecoder(rc).Decode(&entry)
+	rc.Close()
+	if err != nil {
+		return false, err
+	}
+
+	// the archive is streamed to docker as it is written.
+	r, w := io.Pipe()
+	defer r.Close()
+
+	go func() {
+		w.CloseWithError(b.writeArchive(ctx, w, entry))
+	}()
+
+	resp, err := b.client.ImageLoad(ctx, r, true)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// docker reports a failed load in the response.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := struct{ Error string }{}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+
+		if msg.Error != "" {
+			return false, fmt.Errorf("loading the cache for %s: %s", cacheKey, msg.Error)
+		}
+	}
+
+	return true, nil
+}
+
+// writeArchive writes the image archive of the cache entry to w, with its
+// layers downloaded.
+func (b *backendStore) writeArchive(ctx context.Context, w io.Writer, entry backendEntry) error {
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	layerFiles := []string{}
+
+	for _, diffID := range entry.Layers {
+		name := filepath.Join(strings.TrimPrefix(diffID, "sha256:"), "layer.tar")
+		layerFiles = append(layerFiles, name)
+
+		if written[name] {
+			continue
+		}
+		written[name] = true
+
+		if err := b.importLayer(ctx, tw, name, diffID, entry.Compression); err != nil {
+			return err
+		}
+	}
+
+	configFile := fmt.Sprintf("%x.json", sha256.Sum256(entry.Config))
+	if err := writeArchiveFile(tw, configFile, entry.Config); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config": configFile,
+		"Layers": layerFiles,
+	}})
+	if err != nil {
+		return err
+	}
+
+	if err := writeArchiveFile(tw, "manifest.json", manifest); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// importLayer downloads a layer into the image archive. The tar format needs
+// its size up front, so it is decompressed first, to a file if it is large.
+func (b *backendStore) importLayer(ctx context.Context, tw *tar.Writer, name, diffID, compression string) error {
+	rc, err := b.backend.Get(ctx, layerObject(diffID, compression))
+	if err != nil {
+		return fmt.Errorf("layer %s of the cache: %v", diffID, err)
+	}
+	defer rc.Close()
+
+	dec, err := bt.Decompress(rc)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	layer := spill.New("box-cache-layer", b.globals.SpillThreshold, b.globals.Signals)
+	defer layer.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(layer, digester.Hash()), dec)
+	if err != nil {
+		return err
+	}
+
+	if digester.Digest().String() != diffID {
+		return fmt.Errorf("layer %s of the cache is corrupt", diffID)
+	}
+
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, layer)
+	return err
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(content)
+	return err
+}
+
+// Export saves the image from docker, and uploads the layers the backend does
+// not have yet, then the step itself. The step is uploaded last, so an import
+// never finds a step with missing layers.
+func (b *backendStore) Export(ctx context.Context, image, cacheKey string) error {
+	if ok, err := b.backend.Exists(ctx, keyObject(cacheKey)); err != nil || ok {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "box-cache-export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	rc, err := b.client.ImageSave(ctx, []string{image})
+	if err != nil {
+		return err
+	}
+
+	err = extractArchive(rc, dir)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	manifest := []struct {
+		Config string
+		Layers []string
+	}{}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return err
+	}
+
+	if len(manifest) != 1 {
+		return fmt.Errorf("docker saved %d images for %s", len(manifest), image)
+	}
+
+	entry := backendEntry{Compression: b.compression}
+
+	entry.Config, err = ioutil.ReadFile(filepath.Join(dir, filepath.Clean("/"+manifest[0].Config)))
+	if err != nil {
+		return err
+	}
+
+	img := struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{}
+
+	if err := json.Unmarshal(entry.Config, &img); err != nil {
+		return err
+	}
+
+	entry.Layers = img.RootFS.DiffIDs
+	if len(entry.Layers) != len(manifest[0].Layers) {
+		return fmt.Errorf("image %s has %d layers, but docker saved %d", image, len(entry.Layers), len(manifest[0].Layers))
+	}
+
+	for i, diffID := range entry.Layers {
+		if err := b.exportLayer(ctx, filepath.Join(dir, filepath.Clean("/"+manifest[0].Layers[i])), diffID, entry.Compression); err != nil {
+			return err
+		}
+	}
+
+	content, err = json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return b.backend.Put(ctx, keyObject(cacheKey), bytes.NewReader(content))
+}
+
+func (b *backendStore) exportLayer(ctx context.Context, fn, diffID, compression string) error {
+	if ok, err := b.backend.Exists(ctx, layerObject(diffID, compression)); err != nil || ok {
+		return err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	compressed := spill.New("box-cache-layer", b.globals.SpillThreshold, b.globals.Signals)
+	defer compressed.Close()
+
+	if compression == "" {
+		compression = bt.Gzip
+	}
+
+	cw, err := bt.Compress(compressed, compression, b.globals.GzipWorkers)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(cw, f); err != nil {
+		return err
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	return b.backend.Put(ctx, layerObject(diffID, compression), compressed)
+}
+
+// extractArchive extracts the image archive docker saved into dir. Layers
+// docker saved once for several images are symlinked.
+func extractArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		fn := filepath.Join(dir, filepath.Clean("/"+header.Name))
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+				return err
+			}
+
+			if err := os.Symlink(header.Linkname, fn); err != nil {
+				return err
+			}
+			continue
+		default:
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			return err
+		}
+
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
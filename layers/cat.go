@@ -0,0 +1,58 @@
+package layers
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/tar"
+	"github.com/docker/docker/client"
+)
+
+// CatFile writes the content of the file at name in an image docker has to
+// w. See tar.Cat.
+func CatFile(ctx context.Context, name, file string, w io.Writer) error {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	return image.Cat(w, saved.layers, file)
+}
+
+// ExtractPath unpacks the file or directory at path in an image docker has
+// into dest, as the user running box. dest is created if it does not exist.
+// See tar.ExtractPath.
+func ExtractPath(ctx context.Context, name, path, dest string) error {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(image.ExtractPath(w, saved.layers, path))
+	}()
+
+	err = tar.Extract(r, dest)
+	r.CloseWithError(err)
+	return err
+}
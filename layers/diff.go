@@ -0,0 +1,70 @@
+package layers
+
+import (
+	"context"
+
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/tar"
+	"github.com/docker/docker/client"
+)
+
+// ImageDiff is how an image differs from another.
+type ImageDiff struct {
+	Common  int          // the number of layers, from the bottom, the images share
+	Removed []string     // the layers of the first image above the common ones
+	Added   []string     // the layers of the second image above the common ones
+	Changes []tar.Change // the changes to the files, if they were compared
+}
+
+// DiffImages compares two images docker has, by their layers. If files is
+// true, the images are also saved and their filesystems compared.
+func DiffImages(ctx context.Context, a, b string, files bool) (*ImageDiff, error) {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := [][]string{}
+	for _, name := range []string{a, b} {
+		inspect, _, err := client.ImageInspectWithRaw(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, inspect.RootFS.Layers)
+	}
+
+	diff := &ImageDiff{}
+	for diff.Common < len(layers[0]) && diff.Common < len(layers[1]) && layers[0][diff.Common] == layers[1][diff.Common] {
+		diff.Common++
+	}
+
+	diff.Removed = layers[0][diff.Common:]
+	diff.Added = layers[1][diff.Common:]
+
+	if !files {
+		return diff, nil
+	}
+
+	indexes := []map[string]*tar.Entry{}
+	for _, name := range []string{a, b} {
+		index, err := indexImage(ctx, client, name)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+
+	diff.Changes = tar.Diff(indexes[0], indexes[1])
+
+	return diff, nil
+}
+
+func indexImage(ctx context.Context, client *client.Client, name string) (map[string]*tar.Entry, error) {
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	return image.Index(saved.layers)
+}
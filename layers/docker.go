@@ -12,6 +12,7 @@ import (
 	"github.com/box-builder/box/fetcher"
 	"github.com/box-builder/box/image"
 	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
 	"github.com/containers/image/copy"
 	"github.com/containers/image/docker/daemon"
 	"github.com/containers/image/signature"
@@ -31,6 +32,16 @@ type Docker struct {
 	client       *client.Client
 	layerSet     map[string]struct{}
 	globals      *types.Global
+	base         int // the number of layers of the image the build started from
+	deferred     *deferredPull
+}
+
+// deferredPull is an image used with from which was read from its registry,
+// and is pulled when a step first needs it.
+type deferredPull struct {
+	name   string // the name used with from
+	pinned string // the image by digest
+	id     string
 }
 
 // NewDocker needs a documetnation
@@ -49,6 +60,13 @@ func NewDocker(globals *types.Global) (*Docker, error) {
 	}, nil
 }
 
+// daemonContext is the context images are copied to and from the docker daemon
+// with: that at $DOCKER_HOST, which box builds with, if it is set, as it is for
+// podman and rootless docker.
+func daemonContext() *ctypes.SystemContext {
+	return &ctypes.SystemContext{DockerDaemonHost: os.Getenv("DOCKER_HOST")}
+}
+
 // AddImage adds layers to the layer list from a provided image, in order of
 // appearance. Any existing layers are skipped over, removing them from the list.
 func (d *Docker) AddImage(image string) error {
@@ -160,7 +178,7 @@ func (d *Docker) makeImage(from string) (string, error) {
 		return "", err
 	}
 
-	img, err := ref.NewImage(nil)
+	img, err := ref.NewImage(daemonContext())
 	if err != nil {
 		return "", err
 	}
@@ -196,6 +214,8 @@ func (d *Docker) makeImage(from string) (string, error) {
 
 	img2, err := copy.Image(pc, tgt, ref, &copy.Options{
 		RemoveSignatures: true,
+		SourceCtx:        daemonContext(),
+		DestinationCtx:   daemonContext(),
 		LayerCopyHook: func(srcLayer ctypes.BlobInfo) bool {
 			var found bool
 			for _, l := range d.layers {
@@ -224,21 +244,47 @@ func (d *Docker) makeImage(from string) (string, error) {
 // MakeImage makes the final image, skipping any layers as necessary. The
 // layers must be pre-recorded within the executor. Note that if you have no
 // layers to skip, this operation will need to do nothing, so it will do
-// nothing.
+// nothing. The image is labeled with the platform built for, if one is given,
+// and made reproducible if requested.
 //
 // It returns an error condition, if any.
 func (d *Docker) MakeImage(config *config.Config) (string, error) {
+	if err := d.Materialize(config.Image); err != nil {
+		return "", err
+	}
+
 	// this is principally an optimization so we can determine later if we
 	// need to reconstruct the image.
-	if len(d.skipLayers) == 0 {
-		return config.Image, nil
+	if len(d.skipLayers) != 0 {
+		var err error
+
+		config.Image, err = d.makeImage(config.Image)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	var err error
+	if d.globals.Platform != "" && config.Image != "" {
+		if err := d.setPlatform(config); err != nil {
+			return "", err
+		}
+	}
 
-	config.Image, err = d.makeImage(config.Image)
-	if err != nil {
-		return "", err
+	if d.globals.Reproducible && config.Image != "" {
+		if err := d.makeReproducible(config); err != nil {
+			return "", err
+		}
+	} else if config.Image != "" {
+		epoch, ok, err := util.SourceDateEpoch()
+		if err != nil {
+			return "", err
+		}
+
+		if ok {
+			if err := d.clampTimes(config, epoch); err != nil {
+				return "", err
+			}
+		}
 	}
 
 	return config.Image, nil
@@ -255,18 +301,163 @@ func (d *Docker) Lookup(name string) (string, error) {
 }
 
 // Fetch retrieves a docker image, overwrites the container configuration, and
-// returns its id.
+// returns its id. With a signature policy, the image is checked against it in
+// its registry first, and pulled by digest. With a policy of bases, the image
+// must be one of them. With keys to decrypt with, an image with encrypted
+// layers is decrypted as it is pulled. An image docker does not have is only
+// read from its registry, and pulled when a step first needs it, unless
+// Globals.EagerPull is set; see Materialize.
 func (d *Docker) Fetch(config *config.Config, name string) (string, error) {
+	d.deferred = nil
+
+	if d.globals.SignaturePolicy != "" {
+		var err error
+		if name, err = checkPolicy(d.globals.Policy, d.globals.SignaturePolicy, name); err != nil {
+			return "", err
+		}
+	}
+
+	if d.globals.Policy != nil && len(d.globals.Policy.Bases) > 0 {
+		var err error
+		if name, err = checkBase(d.globals.Policy, name); err != nil {
+			return "", err
+		}
+	}
+
+	if len(d.globals.DecryptKeys) > 0 {
+		var err error
+		if name, err = d.fetchEncrypted(name); err != nil {
+			return "", err
+		}
+	}
+
+	if d.canDefer(name) {
+		platform, err := hostPlatform(d.globals)
+		if err != nil {
+			return "", err
+		}
+
+		pinned, id, layers, err := fetcher.Remote(d.globals.Context, d.globals, config, name, platform)
+		if err == nil {
+			d.deferred = &deferredPull{name: name, pinned: pinned, id: id}
+			d.setBase(layers)
+			return id, nil
+		}
+
+		// the registry could not tell; the image is pulled now, which fails
+		// the same way if the image can't be had.
+	}
+
 	location, layers, err := fetcher.Docker(d.globals.Context, d.globals, d.client, config, name)
 	if err != nil {
 		return "", err
 	}
 
-	d.SetLayers(layers)
+	d.setBase(layers)
 	return location, nil
 }
 
+// canDefer is true if the image named can be pulled when a step first needs
+// it: docker does not have it, and it is not decrypted as it is pulled.
+func (d *Docker) canDefer(name string) bool {
+	if d.globals.EagerPull || len(d.globals.DecryptKeys) > 0 {
+		return false
+	}
+
+	_, _, err := d.client.ImageInspectWithRaw(d.globals.Context, name)
+	return client.IsErrImageNotFound(err)
+}
+
+// Materialize pulls the image the build started from, if it was not pulled
+// yet and image, a name or ID, is it. A build whose steps are all found in
+// the cache never needs the layers of the image it starts from, so they are
+// only pulled once a container is made from it, or it is written out.
+func (d *Docker) Materialize(image string) error {
+	deferred := d.deferred
+	if deferred == nil || (image != deferred.id && image != deferred.name && image != deferred.pinned) {
+		return nil
+	}
+
+	id, err := fetcher.Pull(d.globals.Context, d.globals, d.client, deferred.pinned)
+	if err != nil {
+		return err
+	}
+
+	if id != deferred.id {
+		return fmt.Errorf("%s was pulled as %s, not %s as its registry had it", deferred.name, id, deferred.id)
+	}
+
+	d.deferred = nil
+	return nil
+}
+
+// FetchArchive loads an image from an image file, overwrites the container
+// configuration, and returns its id.
+func (d *Docker) FetchArchive(config *config.Config, file, name string) (string, error) {
+	if err := checkFileBase(d.globals, file); err != nil {
+		return "", err
+	}
+
+	id, layers, err := fetcher.Archive(d.globals.Context, d.globals, d.client, config, file, name)
+	if err != nil {
+		return "", err
+	}
+
+	d.setBase(layers)
+	return id, nil
+}
+
+// FetchTar imports a filesystem tarball as an image, overwrites the container
+// configuration, and returns its id.
+func (d *Docker) FetchTar(config *config.Config, file string) (string, error) {
+	if err := checkFileBase(d.globals, file); err != nil {
+		return "", err
+	}
+
+	id, layers, err := fetcher.Tar(d.globals.Context, d.globals, d.client, config, file)
+	if err != nil {
+		return "", err
+	}
+
+	d.setBase(layers)
+	return id, nil
+}
+
+// checkFileBase returns an error if a policy of bases is set, or a signature
+// policy requires images to be signed: images from files have no name or
+// digest in a registry to check, nor signatures.
+func checkFileBase(globals *types.Global, file string) error {
+	if globals.Policy != nil && len(globals.Policy.Bases) > 0 {
+		return fmt.Errorf("%s is not an allowed base image: the policy %s only allows images from registries", file, globals.Policy.File)
+	}
+
+	if globals.SignaturePolicy != "" {
+		signed, err := requiresSignatures(globals.SignaturePolicy)
+		if err != nil {
+			return err
+		}
+
+		if signed {
+			return fmt.Errorf("%s is not allowed by the signature policy %s: images from files have no signatures to check", file, globals.SignaturePolicy)
+		}
+	}
+
+	return nil
+}
+
 // SetLayers sets the layers.
 func (d *Docker) SetLayers(layers []string) {
 	d.layers = layers
 }
+
+// setBase sets the layers to those of the image the build starts from.
+func (d *Docker) setBase(layers []string) {
+	d.base = len(layers)
+	d.SetLayers(layers)
+}
+
+// BaseLayers returns the number of layers of the image the build started
+// from.
+func (d *Docker) BaseLayers() int {
+	return d.base
+}
@@ -12,10 +12,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/copy"
 	"github.com/box-builder/box/image"
-	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/registry"
+	bt "github.com/box-builder/box/tar"
+	btypes "github.com/box-builder/box/types"
 	ccopy "github.com/containers/image/copy"
+	"github.com/containers/image/docker"
 	"github.com/containers/image/docker/daemon"
 	"github.com/containers/image/oci/layout"
 	"github.com/containers/image/signature"
@@ -28,6 +33,7 @@ import (
 type DockerImage struct {
 	imageConfig *ImageConfig
 	client      *client.Client
+	cacheImages []*cacheImage // loaded on first use, see ReuseCache
 }
 
 // NewDockerImage contypes a new DockerImage
@@ -43,18 +49,14 @@ func NewDockerImage(imageConfig *ImageConfig) (*DockerImage, error) {
 	}, nil
 }
 
-func (d *DockerImage) ociSave(filename, tag string) error {
-	ref, err := daemon.ParseReference(d.imageConfig.Config.Image)
-	if err != nil {
-		return err
-	}
-
-	tmpdir, err := ioutil.TempDir("", "image-")
-	if err != nil {
+// copyImage copies the current image from docker to the reference, with a
+// signature made with the GPG key signBy if it is set.
+func (d *DockerImage) copyImage(tgt ctypes.ImageReference, signBy string) error {
+	if err := d.imageConfig.Layers.Materialize(d.imageConfig.Config.Image); err != nil {
 		return err
 	}
 
-	tgt, err := layout.NewReference(tmpdir, tag)
+	ref, err := daemon.ParseReference(d.imageConfig.Config.Image)
 	if err != nil {
 		return err
 	}
@@ -89,15 +91,89 @@ func (d *DockerImage) ociSave(filename, tag string) error {
 
 	_, err = ccopy.Image(pc, tgt, ref, &ccopy.Options{
 		RemoveSignatures: true,
+		SignBy:           signBy,
+		SourceCtx:        daemonContext(),
 		ProgressInterval: 100 * time.Millisecond,
 		Progress:         progressChan,
 	})
 
+	return err
+}
+
+// SaveLayout writes the current image to the OCI image layout directory in
+// reference, which is dir or dir:tag; the tag is latest if it is not given.
+// The directory is created if it does not exist, and other images in it are
+// kept.
+func (d *DockerImage) SaveLayout(reference string) error {
+	dir := reference
+	if i := strings.LastIndex(reference, ":"); i >= 0 {
+		dir = reference[:i]
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tgt, err := layout.ParseReference(reference)
 	if err != nil {
 		return err
 	}
 
-	file, _, err := tar.Archive(d.imageConfig.Globals.Context, tmpdir, "", nil, d.imageConfig.Globals.Logger)
+	if err := d.copyImage(tgt, ""); err != nil {
+		return err
+	}
+
+	if err := d.compressLayout(tgt); err != nil {
+		return err
+	}
+
+	return d.encryptLayout(tgt)
+}
+
+// compressLayout recompresses the layers of the image written to the OCI image
+// layout with the compression of the build, if it is not the gzip they are
+// written with.
+func (d *DockerImage) compressLayout(ref ctypes.ImageReference) error {
+	if compression := d.imageConfig.Globals.Compression; compression != bt.Zstd && compression != bt.Estargz {
+		return nil
+	}
+
+	// the reference is always dir:tag.
+	reference := ref.StringWithinTransport()
+	i := strings.LastIndex(reference, ":")
+
+	return recompressLayout(reference[:i], reference[i+1:], d.imageConfig.Globals.Compression)
+}
+
+func (d *DockerImage) ociSave(filename, tag string) error {
+	tmpdir, err := ioutil.TempDir("", "image-")
+	if err != nil {
+		return err
+	}
+
+	tgt, err := layout.NewReference(tmpdir, tag)
+	if err != nil {
+		return err
+	}
+
+	if err := d.copyImage(tgt, ""); err != nil {
+		return err
+	}
+
+	if err := d.compressLayout(tgt); err != nil {
+		return err
+	}
+
+	if err := d.encryptLayout(tgt); err != nil {
+		return err
+	}
+
+	return saveLayoutFile(d.imageConfig.Globals, tmpdir, filename)
+}
+
+// saveLayoutFile writes the OCI image layout in dir to the file as a tarball.
+func saveLayoutFile(globals *btypes.Global, dir, filename string) error {
+	file, _, err := bt.Archive(globals.Context, dir, "", nil, globals.Signals, globals.Logger)
 	if err != nil {
 		return err
 	}
@@ -115,10 +191,14 @@ func (d *DockerImage) ociSave(filename, tag string) error {
 	}
 	defer w.Close()
 
-	return copy.WithProgress(w, r, d.imageConfig.Globals.Logger, fmt.Sprintf("Saving %q", filename))
+	return copy.WithProgress(w, r, globals.Logger, fmt.Sprintf("Saving %q", filename))
 }
 
 func (d *DockerImage) dockerSave(f io.WriteCloser, filename, tag string) error {
+	if err := d.imageConfig.Layers.Materialize(d.imageConfig.Config.Image); err != nil {
+		return err
+	}
+
 	r, err := d.client.ImageSave(d.imageConfig.Globals.Context, []string{d.imageConfig.Config.Image, tag})
 	if err != nil {
 		return err
@@ -127,25 +207,36 @@ func (d *DockerImage) dockerSave(f io.WriteCloser, filename, tag string) error {
 	return copy.WithProgress(f, r, d.imageConfig.Globals.Logger, fmt.Sprintf("Saving %q to disk", filename))
 }
 
-// Save saves an image to the provided filename.
-func (d *DockerImage) Save(filename, kind, tag string) error {
+// savePath returns the path of the file an image is saved to, relative to the
+// working directory, which it must be in.
+func savePath(filename string) (string, error) {
 	wd, err := os.Getwd()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	abs, err := filepath.Abs(filename)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	rel, err := filepath.Rel(wd, abs)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if strings.HasPrefix(rel, "../") {
-		return fmt.Errorf("relative path %q for save falls below the working directory, cannot save", rel)
+		return "", fmt.Errorf("relative path %q for save falls below the working directory, cannot save", rel)
+	}
+
+	return rel, nil
+}
+
+// Save saves an image to the provided filename.
+func (d *DockerImage) Save(filename, kind, tag string) error {
+	rel, err := savePath(filename)
+	if err != nil {
+		return err
 	}
 
 	switch kind {
@@ -163,43 +254,47 @@ func (d *DockerImage) Save(filename, kind, tag string) error {
 	}
 }
 
-// Flatten copies a tarred up series of files (passed in through the
-// io.Reader handle) to the image where they are untarred.
-func (d *DockerImage) Flatten(id string, size int64, tw io.Reader) error {
-	imgName, err := image.Flatten(d.imageConfig.Config, id, size, tw, d.imageConfig.Globals.Logger)
-	if err != nil {
-		return err
-	}
+// Flatten makes an image of the layer, read with image.ReadLayer, with the
+// configuration of the build.
+func (d *DockerImage) Flatten(layer *image.Layer) error {
+	return d.load(func(w io.Writer) error {
+		return image.Assemble(w, d.imageConfig.Config, []*image.Layer{layer}, nil, d.imageConfig.Globals.Logger)
+	})
+}
 
-	out, err := os.Open(imgName)
+// load loads the image file the function writes into docker, and makes it the
+// current image.
+func (d *DockerImage) load(write func(io.Writer) error) error {
+	id, err := loadImage(d.imageConfig.Globals.Context, d.client, write)
 	if err != nil {
 		return err
 	}
 
-	defer out.Close()
-	defer os.Remove(out.Name())
+	d.imageConfig.Config.Image = id
+	return nil
+}
 
+// loadImage loads the image file the function writes, such as with
+// image.Assemble, into docker as it is written, so it is never written to
+// disk. It returns the ID of the loaded image.
+func loadImage(ctx context.Context, client *client.Client, write func(io.Writer) error) (string, error) {
 	r, w := io.Pipe()
+	defer r.Close()
 
 	go func() {
-		err := copy.WithProgress(w, out, d.imageConfig.Globals.Logger, "Loading image into docker")
-		if err != nil {
-			w.CloseWithError(err)
-		} else {
-			w.Close()
-		}
+		w.CloseWithError(write(w))
 	}()
 
-	resp, err := d.client.ImageLoad(d.imageConfig.Globals.Context, r, true)
+	resp, err := client.ImageLoad(ctx, r, true)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	defer resp.Body.Close()
 
 	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	res := map[string]string{}
@@ -207,27 +302,31 @@ func (d *DockerImage) Flatten(id string, size int64, tw io.Reader) error {
 	if err := json.Unmarshal(content, &res); err != nil {
 		parts := strings.SplitN(string(content), ":", 2)
 		if len(parts) != 2 {
-			return fmt.Errorf("Invalid value returned from docker: %s", string(content))
+			return "", fmt.Errorf("Invalid value returned from docker: %s", string(content))
 		}
 
-		d.imageConfig.Config.Image = strings.TrimSpace(parts[1])
-		return nil
+		return strings.TrimSpace(parts[1]), nil
 	}
 
 	if stream, ok := res["stream"]; ok {
 		// FIXME this is absolutely terrible
 		if strings.HasPrefix(stream, "Loaded image ID: ") {
-			d.imageConfig.Config.Image = strings.TrimSpace(strings.TrimPrefix(stream, "Loaded image ID: "))
-			return nil
+			return strings.TrimSpace(strings.TrimPrefix(stream, "Loaded image ID: ")), nil
 		}
 	}
 
-	return errors.New("invalid image ID returned")
+	return "", errors.New("invalid image ID returned")
 }
 
 // Tag an image with the provided string.
 func (d *DockerImage) Tag(tag string) error {
-	return d.client.ImageTag(d.imageConfig.Globals.Context, d.imageConfig.Config.Image, tag)
+	if err := d.imageConfig.Layers.Materialize(d.imageConfig.Config.Image); err != nil {
+		return err
+	}
+
+	err := d.client.ImageTag(d.imageConfig.Globals.Context, d.imageConfig.Config.Image, tag)
+	audit.Record(audit.Tag, tag, d.imageConfig.Config.Image, err)
+	return err
 }
 
 // CheckCache consults the cache and returns true or false depending on whether
@@ -238,6 +337,30 @@ func (d *DockerImage) CheckCache(cacheKey string) (bool, error) {
 		return false, nil
 	}
 
+	cached, err := d.lookupCache(cacheKey)
+	if err != nil || cached {
+		return cached, err
+	}
+
+	for _, repo := range d.imageConfig.Globals.CacheFrom {
+		imported, err := d.importCache(repo, cacheKey)
+		if err != nil {
+			// the registry cache only speeds the build up; a build does not fail
+			// because it can't be reached.
+			d.imageConfig.Globals.Logger.Print(d.imageConfig.Globals.Logger.Notice(fmt.Sprintf("Could not import cache from %q: %v", repo, err)))
+			continue
+		}
+
+		if imported {
+			return d.lookupCache(cacheKey)
+		}
+	}
+
+	return false, nil
+}
+
+// lookupCache finds a layer for the cache key in the docker daemon.
+func (d *DockerImage) lookupCache(cacheKey string) (bool, error) {
 	images, err := d.client.ImageList(context.Background(), types.ImageListOptions{All: true})
 	if err != nil {
 		return false, err
@@ -247,6 +370,12 @@ func (d *DockerImage) CheckCache(cacheKey string) (bool, error) {
 		if (img.ParentID != "" && img.ParentID == d.imageConfig.Config.Image) || img.ParentID == "" {
 			inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), img.ID)
 			if err != nil {
+				// the image may have been removed by a concurrent prune since it was
+				// listed.
+				if client.IsErrImageNotFound(err) {
+					continue
+				}
+
 				return false, err
 			}
 
@@ -254,6 +383,7 @@ func (d *DockerImage) CheckCache(cacheKey string) (bool, error) {
 				d.imageConfig.Globals.Logger.CacheHit(img.ID)
 				d.imageConfig.Config.FromDocker(inspect.Config)
 				d.imageConfig.Config.Image = img.ID
+				d.imageConfig.Config.BuiltBy = config.BuiltBy{Image: img.ID, Key: cacheKey}
 				return true, d.imageConfig.Layers.AddImage(img.ID)
 			}
 		}
@@ -266,3 +396,33 @@ func (d *DockerImage) CheckCache(cacheKey string) (bool, error) {
 func (d *DockerImage) ImageID() string {
 	return d.imageConfig.Config.Image
 }
+
+// Push pushes the current image to the registry under name, a docker
+// reference, signed with the GPG key of Globals.SignBy if it is set. The
+// signature is written to the lookaside storage configured for the registry
+// in registries.d, as skopeo and podman do. With Globals.EncryptRecipients,
+// its layers are encrypted for them.
+func (d *DockerImage) Push(name string) error {
+	if err := registry.CheckPush(d.imageConfig.Globals.Policy, name); err != nil {
+		audit.Record(audit.Push, name, d.imageConfig.Config.Image, err)
+		return err
+	}
+
+	if len(d.imageConfig.Globals.EncryptRecipients) > 0 {
+		// the manifest is recorded as it is pushed.
+		return d.pushEncrypted(name)
+	}
+
+	tgt, err := docker.ParseReference("//" + name)
+	if err != nil {
+		return err
+	}
+
+	err = d.copyImage(tgt, d.imageConfig.Globals.SignBy)
+	audit.Record(audit.Push, name, d.imageConfig.Config.Image, err)
+	if signBy := d.imageConfig.Globals.SignBy; signBy != "" {
+		audit.Record(audit.Sign, name, d.imageConfig.Config.Image, err)
+	}
+
+	return err
+}
@@ -5,19 +5,29 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	. "testing"
 
 	. "gopkg.in/check.v1"
 
 	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/cache"
 	"github.com/box-builder/box/image"
 	"github.com/box-builder/box/logger"
 	btypes "github.com/box-builder/box/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/term"
+	"github.com/pkg/errors"
 )
 
 var dockerClient *client.Client
@@ -174,6 +184,75 @@ func (ds *dockerSuite) TestMakeImage(c *C) {
 	c.Assert(len(layersOrig)-2, Equals, len(layers))
 }
 
+// daemonProxy serves the API of the docker daemon at a socket of its own,
+// recording the paths of the requests it is sent.
+type daemonProxy struct {
+	mutex sync.Mutex
+	paths []string
+}
+
+func (dp *daemonProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dp.mutex.Lock()
+	dp.paths = append(dp.paths, r.URL.Path)
+	dp.mutex.Unlock()
+
+	(&httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "docker"
+		},
+		Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) {
+				return net.Dial("unix", "/var/run/docker.sock")
+			},
+		},
+	}).ServeHTTP(w, r)
+}
+
+func (dp *daemonProxy) sent(suffix string) bool {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+
+	for _, path := range dp.paths {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ds *dockerSuite) TestDaemonHost(c *C) {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		c.Skip("the daemon is not at /var/run/docker.sock")
+	}
+
+	socket := filepath.Join(c.MkDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	proxy := &daemonProxy{}
+	go http.Serve(l, proxy)
+
+	os.Setenv("DOCKER_HOST", "unix://"+socket)
+	defer os.Unsetenv("DOCKER_HOST")
+
+	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
+	c.Assert(err, IsNil)
+
+	id, err := d.Fetch(ds.config, "debian:latest")
+	c.Assert(err, IsNil)
+	c.Assert(d.AddImage(id), IsNil)
+
+	_, err = d.makeImage("debian:latest")
+	c.Assert(err, IsNil)
+
+	// skip copies the image out of the daemon and back through the socket.
+	c.Assert(proxy.sent("/images/get"), Equals, true)
+	c.Assert(proxy.sent("/images/load"), Equals, true)
+}
+
 func (ds *dockerSuite) TestFetch(c *C) {
 	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
 	c.Assert(err, IsNil)
@@ -187,3 +266,101 @@ func (ds *dockerSuite) TestFetch(c *C) {
 	_, err = d.Fetch(ds.config, "quezacoatl")
 	c.Assert(err, NotNil)
 }
+
+func (ds *dockerSuite) TestMountImage(c *C) {
+	home := os.Getenv("BOX_HOME")
+	os.Setenv("BOX_HOME", c.MkDir())
+	defer os.Setenv("BOX_HOME", home)
+
+	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
+	c.Assert(err, IsNil)
+
+	_, err = d.Fetch(ds.config, "debian:latest")
+	c.Assert(err, IsNil)
+
+	target := filepath.Join(c.MkDir(), "debian")
+
+	mount, err := MountImage(context.Background(), "debian:latest", target, logger.New("", false))
+	c.Assert(err, IsNil)
+	c.Assert(mount.Image, Equals, "debian:latest")
+	c.Assert(mount.Target, Equals, target)
+
+	_, err = os.Stat(filepath.Join(target, "etc/debian_version"))
+	c.Assert(err, IsNil)
+
+	_, err = MountImage(context.Background(), "debian:latest", target, logger.New("", false))
+	c.Assert(err, ErrorMatches, ".* is already mounted")
+
+	full := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(full, "file"), []byte{}, 0644), IsNil)
+	_, err = MountImage(context.Background(), "debian:latest", full, logger.New("", false))
+	c.Assert(err, ErrorMatches, ".* is not empty")
+
+	unmounted, err := UnmountImage(target)
+	c.Assert(err, IsNil)
+	c.Assert(unmounted.Overlay, Equals, mount.Overlay)
+
+	entries, err := ioutil.ReadDir(target)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	_, err = os.Stat(MountDir(target))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = UnmountImage(target)
+	c.Assert(err, ErrorMatches, ".* is not mounted by box")
+}
+
+func (ds *dockerSuite) TestMountImageFUSE(c *C) {
+	if os.Geteuid() == 0 || !fuseOverlay() {
+		c.Skip("fuse-overlayfs mounts images for users other than root")
+	}
+
+	home := os.Getenv("BOX_HOME")
+	os.Setenv("BOX_HOME", c.MkDir())
+	defer os.Setenv("BOX_HOME", home)
+
+	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
+	c.Assert(err, IsNil)
+
+	_, err = d.Fetch(ds.config, "debian:latest")
+	c.Assert(err, IsNil)
+
+	target := filepath.Join(c.MkDir(), "debian")
+
+	mount, err := MountImage(context.Background(), "debian:latest", target, logger.New("", false))
+	c.Assert(err, IsNil)
+	c.Assert(mount.Overlay, Equals, true)
+	c.Assert(mount.FUSE, Equals, true)
+
+	_, err = os.Stat(filepath.Join(target, "etc/debian_version"))
+	c.Assert(err, IsNil)
+
+	_, err = UnmountImage(target)
+	c.Assert(err, IsNil)
+
+	entries, err := ioutil.ReadDir(target)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+}
+
+func (ds *dockerSuite) TestLowerDirs(c *C) {
+	c.Assert(lowerDirs([]string{"0", "1", "2"}), DeepEquals, []string{"2", "1", "0"})
+}
+
+func (ds *dockerSuite) TestRegistryCacheRef(c *C) {
+	key, err := cache.Key{Verb: "run", Args: []string{"true"}}.Sum()
+	c.Assert(err, IsNil)
+
+	ref, err := registryCacheRef("registry.example.com/myapp/cache", key)
+	c.Assert(err, IsNil)
+	c.Assert(ref.Tag(), Equals, strings.TrimPrefix(key, cache.Prefix))
+	c.Assert(ref.Name(), Equals, "registry.example.com/myapp/cache")
+
+	_, err = registryCacheRef("registry.example.com/myapp/cache:latest", key)
+	c.Assert(err, NotNil)
+
+	c.Assert(isNotFound(errors.Wrap(errcode.Errors{v2.ErrorCodeManifestUnknown}, "reading manifest")), Equals, true)
+	c.Assert(isNotFound(errcode.ErrorCodeUnauthorized), Equals, false)
+	c.Assert(isNotFound(errors.New("connection refused")), Equals, false)
+}
@@ -0,0 +1,641 @@
+package layers
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/ocicrypt"
+	"github.com/box-builder/box/registry"
+	"github.com/box-builder/box/types"
+	ccopy "github.com/containers/image/copy"
+	"github.com/containers/image/docker/daemon"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/oci/layout"
+	ctypes "github.com/containers/image/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// layoutTag is the tag images are kept under in the layouts made to encrypt
+// and decrypt them.
+const layoutTag = "latest"
+
+// cryptLayer encrypts or decrypts the layer blob read from r into w, and
+// returns the media type, digest and annotations of its descriptor, which it
+// is given.
+type cryptLayer func(w io.Writer, r io.Reader, mediaType, dgst string, annotations map[string]string) (string, string, map[string]string, error)
+
+// encryptLayer returns a cryptLayer which encrypts the layers which are not
+// encrypted for the recipients.
+func encryptLayer(recipients []crypto.PublicKey) cryptLayer {
+	return func(w io.Writer, r io.Reader, mediaType, dgst string, annotations map[string]string) (string, string, map[string]string, error) {
+		digester := digest.Canonical.Digester()
+
+		added, err := ocicrypt.Encrypt(io.MultiWriter(w, digester.Hash()), r, dgst, recipients)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		for key, value := range added {
+			annotations[key] = value
+		}
+
+		return mediaType + ocicrypt.MediaTypeSuffix, digester.Digest().String(), annotations, nil
+	}
+}
+
+// decryptLayer returns a cryptLayer which decrypts the encrypted layers with
+// the keys.
+func decryptLayer(keys []crypto.PrivateKey) cryptLayer {
+	return func(w io.Writer, r io.Reader, mediaType, dgst string, annotations map[string]string) (string, string, map[string]string, error) {
+		decrypted, err := ocicrypt.Decrypt(w, r, annotations, keys)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("layer %s: %v", dgst, err)
+		}
+
+		delete(annotations, ocicrypt.AnnotationKeysJWE)
+		delete(annotations, ocicrypt.AnnotationPubOpts)
+
+		return strings.TrimSuffix(mediaType, ocicrypt.MediaTypeSuffix), decrypted, annotations, nil
+	}
+}
+
+// EncryptLayout encrypts the layers of the image tagged in the OCI image
+// layout for the recipients. Layers which are encrypted already are left as
+// they are.
+func EncryptLayout(dir, tag string, recipients []crypto.PublicKey) error {
+	return cryptLayout(dir, tag, false, encryptLayer(recipients))
+}
+
+// DecryptLayout decrypts the encrypted layers of the image tagged in the OCI
+// image layout with the first of the keys each was encrypted for.
+func DecryptLayout(dir, tag string, keys []crypto.PrivateKey) error {
+	return cryptLayout(dir, tag, true, decryptLayer(keys))
+}
+
+// cryptLayout rewrites the layers of the image tagged in the layout which are
+// encrypted, if encrypted is set, or are not, with crypt. The configuration is
+// left as it is: its diff IDs are of the layers uncompressed, and unencrypted.
+func cryptLayout(dir, tag string, encrypted bool, crypt cryptLayer) error {
+	refFile := filepath.Join(dir, "refs", tag)
+
+	ref := layoutDescriptor{}
+	if err := readJSON(refFile, &ref); err != nil {
+		return err
+	}
+
+	manifestDigest, _ := ref["digest"].(string)
+	if err := digest.Digest(manifestDigest).Validate(); err != nil {
+		return err
+	}
+
+	manifest := map[string]interface{}{}
+	if err := readJSON(layoutBlob(dir, manifestDigest), &manifest); err != nil {
+		return err
+	}
+
+	replaced := []string{manifestDigest}
+
+	layers, _ := manifest["layers"].([]interface{})
+	for _, l := range layers {
+		layer, _ := l.(map[string]interface{})
+		mediaType, _ := layer["mediaType"].(string)
+
+		// foreign layers are not in the layout.
+		if ocicrypt.IsEncrypted(mediaType) != encrypted || strings.Contains(mediaType, "foreign") {
+			continue
+		}
+
+		old, _ := layer["digest"].(string)
+
+		annotations := map[string]string{}
+		if a, ok := layer["annotations"].(map[string]interface{}); ok {
+			for key, value := range a {
+				annotations[key], _ = value.(string)
+			}
+		}
+
+		mediaType, dgst, size, annotations, err := cryptBlob(dir, old, mediaType, annotations, crypt)
+		if err != nil {
+			return err
+		}
+
+		layer["mediaType"] = mediaType
+		layer["digest"] = dgst
+		layer["size"] = size
+
+		if len(annotations) > 0 {
+			layer["annotations"] = annotations
+		} else {
+			delete(layer, "annotations")
+		}
+
+		replaced = append(replaced, old)
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	dgst := digest.FromBytes(content).String()
+	if err := writeFile(layoutBlob(dir, dgst), content); err != nil {
+		return err
+	}
+
+	ref["digest"] = dgst
+	ref["size"] = len(content)
+
+	if content, err = json.Marshal(ref); err != nil {
+		return err
+	}
+
+	if err := writeFile(refFile, content); err != nil {
+		return err
+	}
+
+	return removeUnreferenced(dir, replaced)
+}
+
+// cryptBlob writes the layer blob encrypted or decrypted by crypt, and
+// returns its media type, digest, size and annotations.
+func cryptBlob(dir, dgst, mediaType string, annotations map[string]string, crypt cryptLayer) (string, string, int64, map[string]string, error) {
+	f, err := os.Open(layoutBlob(dir, dgst))
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "blobs"), "crypt-")
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	mediaType, newDigest, annotations, err := crypt(tmp, f, mediaType, dgst, annotations)
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+
+	fi, err := tmp.Stat()
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", "", 0, nil, err
+	}
+
+	return mediaType, newDigest, fi.Size(), annotations, os.Rename(tmp.Name(), layoutBlob(dir, newDigest))
+}
+
+// pullLayout writes the image from its registry to an OCI image layout,
+// tagged with tag. A manifest list is resolved to its image for the platform.
+func pullLayout(ctx context.Context, client *registry.Client, src registry.Reference, platform registry.Platform, dir, tag string, logger *logger.Logger) (err error) {
+	var (
+		name = src.String()
+		dgst string
+	)
+	defer func() { audit.Record(audit.Pull, name, dgst, err) }()
+
+	m, err := client.GetManifest(ctx, src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+
+	if m.MediaType == registry.MediaTypeDockerList || m.MediaType == registry.MediaTypeOCIIndex {
+		if src, m, err = resolveManifest(ctx, client, src, platform); err != nil {
+			return err
+		}
+	}
+
+	if m.MediaType != registry.MediaTypeOCIManifest && m.MediaType != registry.MediaTypeDockerManifest {
+		return fmt.Errorf("%s: manifests of type %q can't be pulled", src, m.MediaType)
+	}
+	dgst = m.Digest
+
+	img := struct {
+		Config struct{ Digest string }
+		Layers []struct {
+			MediaType string
+			Digest    string
+		}
+	}{}
+	if err := json.Unmarshal(m.Content, &img); err != nil {
+		return err
+	}
+
+	if err := makeLayout(dir); err != nil {
+		return err
+	}
+
+	blobs := []string{img.Config.Digest}
+	for _, layer := range img.Layers {
+		// foreign layers are not kept in registries.
+		if !strings.Contains(layer.MediaType, "foreign") {
+			blobs = append(blobs, layer.Digest)
+		}
+	}
+
+	for _, dgst := range blobs {
+		if err := pullBlob(ctx, client, src, dir, dgst, logger); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFile(layoutBlob(dir, m.Digest), m.Content); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(layoutDescriptor{"mediaType": m.MediaType, "digest": m.Digest, "size": len(m.Content)})
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, "refs", tag), content)
+}
+
+// resolveManifest returns the reference and the manifest of the image of the
+// manifest list src for the platform.
+func resolveManifest(ctx context.Context, client *registry.Client, src registry.Reference, platform registry.Platform) (registry.Reference, *registry.Manifest, error) {
+	resolved, err := client.Resolve(ctx, src.String(), platform)
+	if err != nil {
+		return src, nil, err
+	}
+
+	ref, err := registry.ParseReference(resolved)
+	if err != nil {
+		return src, nil, err
+	}
+
+	m, err := client.GetManifest(ctx, ref)
+	if err != nil {
+		return src, nil, fmt.Errorf("%s: %v", ref, err)
+	}
+
+	return ref, m, nil
+}
+
+// pullBlob writes the blob to the layout, checking its digest.
+func pullBlob(ctx context.Context, client *registry.Client, src registry.Reference, dir, dgst string, logger *logger.Logger) error {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return err
+	}
+
+	rc, _, err := client.GetBlob(ctx, src.Domain, src.Repository, dgst)
+	if err != nil {
+		return fmt.Errorf("blob %s of %s: %v", dgst, src, err)
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "blobs"), "pull-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	verifier := d.Verifier()
+	if err := copy.WithProgress(io.MultiWriter(tmp, verifier), rc, logger, fmt.Sprintf("Pulling %s", d.Hex()[:12])); err != nil {
+		return err
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s of %s does not have its digest", dgst, src)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), layoutBlob(dir, dgst))
+}
+
+// pushLayout pushes the image tagged in the OCI image layout to dst, and
+// returns the digest of its manifest. Blobs the registry has are skipped.
+func pushLayout(ctx context.Context, client *registry.Client, dir, tag string, dst registry.Reference, logger *logger.Logger) (string, error) {
+	ref := layoutDescriptor{}
+	if err := readJSON(filepath.Join(dir, "refs", tag), &ref); err != nil {
+		return "", err
+	}
+
+	manifestDigest, _ := ref["digest"].(string)
+	mediaType, _ := ref["mediaType"].(string)
+
+	content, err := ioutil.ReadFile(layoutBlob(dir, manifestDigest))
+	if err != nil {
+		return "", err
+	}
+
+	img := struct {
+		Config struct{ Digest string }
+		Layers []struct {
+			MediaType string
+			Digest    string
+		}
+	}{}
+	if err := json.Unmarshal(content, &img); err != nil {
+		return "", err
+	}
+
+	blobs := []string{img.Config.Digest}
+	for _, layer := range img.Layers {
+		if !strings.Contains(layer.MediaType, "foreign") {
+			blobs = append(blobs, layer.Digest)
+		}
+	}
+
+	// the registry is asked for all the blobs at once, before any is pushed.
+	exists, err := client.BlobsExist(ctx, dst.Domain, dst.Repository, blobs)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dgst := range blobs {
+		if exists[dgst] {
+			continue
+		}
+
+		if err := pushBlob(ctx, client, dir, dgst, dst, logger); err != nil {
+			return "", err
+		}
+		exists[dgst] = true
+	}
+
+	if mediaType == "" {
+		mediaType = registry.MediaTypeOCIManifest
+	}
+
+	return manifestDigest, client.PutManifest(ctx, dst, &registry.Manifest{MediaType: mediaType, Digest: manifestDigest, Content: content})
+}
+
+// pushBlob pushes the blob of the layout, which dst does not have.
+func pushBlob(ctx context.Context, client *registry.Client, dir, dgst string, dst registry.Reference, logger *logger.Logger) error {
+	f, err := os.Open(layoutBlob(dir, dgst))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(copy.WithProgress(w, f, logger, fmt.Sprintf("Pushing %s", digest.Digest(dgst).Hex()[:12])))
+	}()
+
+	err = client.PutBlob(ctx, dst.Domain, dst.Repository, "", dgst, fi.Size(), r)
+	r.CloseWithError(err)
+	return err
+}
+
+// CryptImage copies the image src in its registry to dst, with its layers
+// encrypted for the recipients if there are any, then decrypted with the keys
+// if there are any. A manifest list is copied as its image for the platform.
+// It returns the digest of the manifest pushed.
+func CryptImage(ctx context.Context, client *registry.Client, src, dst registry.Reference, platform registry.Platform, recipients []crypto.PublicKey, keys []crypto.PrivateKey, logger *logger.Logger) (string, error) {
+	dir, err := ioutil.TempDir("", "box-crypt-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := pullLayout(ctx, client, src, platform, dir, layoutTag, logger); err != nil {
+		return "", err
+	}
+
+	if len(keys) > 0 {
+		if err := DecryptLayout(dir, layoutTag, keys); err != nil {
+			return "", err
+		}
+	}
+
+	if len(recipients) > 0 {
+		if err := EncryptLayout(dir, layoutTag, recipients); err != nil {
+			return "", err
+		}
+	}
+
+	return pushLayout(ctx, client, dir, layoutTag, dst, logger)
+}
+
+// hostPlatform returns the platform to pull images for: the build's, or that
+// of this machine.
+func hostPlatform(globals *types.Global) (registry.Platform, error) {
+	if globals.Platform != "" {
+		return registry.ParsePlatform(globals.Platform)
+	}
+
+	return registry.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+}
+
+// fetchEncrypted loads the image named into docker decrypted, if docker does
+// not have it and its layers are encrypted, and returns the name to fetch it
+// by. Images named by digest are loaded with a tag of the digest, as docker
+// can't load them by digest.
+func (d *Docker) fetchEncrypted(name string) (string, error) {
+	ctx := d.globals.Context
+
+	if _, _, err := d.client.ImageInspectWithRaw(ctx, name); err == nil {
+		return name, nil
+	}
+
+	platform, err := hostPlatform(d.globals)
+	if err != nil {
+		return "", err
+	}
+
+	client := registry.NewClient(d.globals.Policy)
+
+	src, err := registry.ParseReference(name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := client.Resolve(ctx, name, platform)
+	if err != nil {
+		return "", err
+	}
+
+	resolvedRef, err := registry.ParseReference(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := isEncrypted(ctx, client, resolvedRef)
+	if err != nil {
+		return "", err
+	}
+
+	if !encrypted {
+		return name, nil
+	}
+
+	keys, err := ocicrypt.LoadKeys(d.globals.DecryptKeys)
+	if err != nil {
+		return "", err
+	}
+
+	named, err := decryptedName(name, src)
+	if err != nil {
+		return "", err
+	}
+
+	d.globals.Logger.Print(d.globals.Logger.Notice(fmt.Sprintf("Decrypting %s\n", name)))
+
+	dir, err := ioutil.TempDir("", "box-decrypt-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := pullLayout(ctx, client, resolvedRef, platform, dir, layoutTag, d.globals.Logger); err != nil {
+		return "", err
+	}
+
+	if err := DecryptLayout(dir, layoutTag, keys); err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+
+	if err := loadLayout(dir, named); err != nil {
+		return "", err
+	}
+
+	return named.String(), nil
+}
+
+// isEncrypted is true if any layer of the image is encrypted.
+func isEncrypted(ctx context.Context, client *registry.Client, ref registry.Reference) (bool, error) {
+	m, err := client.GetManifest(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+
+	img := struct {
+		Layers []struct{ MediaType string }
+	}{}
+	if err := json.Unmarshal(m.Content, &img); err != nil {
+		return false, err
+	}
+
+	for _, layer := range img.Layers {
+		if ocicrypt.IsEncrypted(layer.MediaType) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// decryptedName returns the name the image of the name, src, is loaded into
+// docker by once it is decrypted.
+func decryptedName(name string, src registry.Reference) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		return reference.WithTag(reference.TrimNamed(named), "decrypted-"+canonical.Digest().Hex()[:12])
+	}
+
+	return reference.WithTag(reference.TrimNamed(named), src.Reference)
+}
+
+// loadLayout loads the image tagged layoutTag in the OCI image layout in dir
+// into docker, named.
+func loadLayout(dir string, named reference.Named) error {
+	srcRef, err := layout.NewReference(dir, layoutTag)
+	if err != nil {
+		return err
+	}
+
+	tgt, err := daemon.NewReference("", named)
+	if err != nil {
+		return err
+	}
+
+	pc, err := acceptAnything()
+	if err != nil {
+		return err
+	}
+	defer pc.Destroy()
+
+	_, err = ccopy.Image(pc, tgt, srcRef, &ccopy.Options{RemoveSignatures: true, DestinationCtx: daemonContext()})
+	return err
+}
+
+// encryptLayout encrypts the layers of the image written to the OCI image
+// layout for the recipients of the build, if there are any.
+func (d *DockerImage) encryptLayout(ref ctypes.ImageReference) error {
+	if len(d.imageConfig.Globals.EncryptRecipients) == 0 {
+		return nil
+	}
+
+	recipients, err := ocicrypt.LoadRecipients(d.imageConfig.Globals.EncryptRecipients)
+	if err != nil {
+		return err
+	}
+
+	// the reference is always dir:tag.
+	reference := ref.StringWithinTransport()
+	i := strings.LastIndex(reference, ":")
+
+	return EncryptLayout(reference[:i], reference[i+1:], recipients)
+}
+
+// pushEncrypted pushes the image to its registry under name with its layers
+// encrypted for the recipients of the build. It is written to an OCI image
+// layout to encrypt it first, as docker can't push encrypted layers.
+func (d *DockerImage) pushEncrypted(name string) error {
+	dst, err := registry.ParseReference(name)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "box-encrypt-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tgt, err := layout.NewReference(dir, layoutTag)
+	if err != nil {
+		return err
+	}
+
+	if err := d.copyImage(tgt, ""); err != nil {
+		return err
+	}
+
+	if err := d.compressLayout(tgt); err != nil {
+		return err
+	}
+
+	if err := d.encryptLayout(tgt); err != nil {
+		return err
+	}
+
+	_, err = pushLayout(d.imageConfig.Globals.Context, registry.NewClient(d.imageConfig.Globals.Policy), dir, layoutTag, dst, d.imageConfig.Globals.Logger)
+	return err
+}
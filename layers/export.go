@@ -0,0 +1,27 @@
+package layers
+
+import (
+	"context"
+	"io"
+
+	"github.com/box-builder/box/image"
+	"github.com/docker/docker/client"
+)
+
+// ExportImage writes the filesystem of an image docker has to w as one
+// tarball, with every layer applied: files removed by a layer are left out,
+// and there are no whiteouts.
+func ExportImage(ctx context.Context, name string, w io.Writer) error {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	return image.Export(w, saved.layers)
+}
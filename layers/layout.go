@@ -0,0 +1,314 @@
+package layers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/box-builder/box/registry"
+	bt "github.com/box-builder/box/tar"
+	"github.com/opencontainers/go-digest"
+)
+
+// layoutDescriptor is a descriptor of an OCI image layout, kept as is but
+// for the fields recompression changes.
+type layoutDescriptor map[string]interface{}
+
+// makeLayout makes dir an OCI image layout, with no blobs or refs yet.
+func makeLayout(dir string) error {
+	for _, sub := range []string{filepath.Join("blobs", "sha256"), "refs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`))
+}
+
+// recompressLayout recompresses the layers of the image tagged in the OCI
+// image layout in dir with zstd or as eStargz, and updates their descriptors.
+// eStargz layers have other diff IDs than the layers they replace, so the
+// configuration of the image is updated with them. Blobs no other image of the
+// layout refers to are removed.
+func recompressLayout(dir, tag, compression string) error {
+	refFile := filepath.Join(dir, "refs", tag)
+
+	ref := layoutDescriptor{}
+	if err := readJSON(refFile, &ref); err != nil {
+		return err
+	}
+
+	manifestDigest, _ := ref["digest"].(string)
+	if err := digest.Digest(manifestDigest).Validate(); err != nil {
+		return err
+	}
+
+	manifest := map[string]interface{}{}
+	if err := readJSON(layoutBlob(dir, manifestDigest), &manifest); err != nil {
+		return err
+	}
+
+	config, _ := manifest["config"].(map[string]interface{})
+	configDigest, _ := config["digest"].(string)
+	if err := digest.Digest(configDigest).Validate(); err != nil {
+		return err
+	}
+
+	image := map[string]interface{}{}
+	if err := readJSON(layoutBlob(dir, configDigest), &image); err != nil {
+		return err
+	}
+
+	rootfs, _ := image["rootfs"].(map[string]interface{})
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+
+	layers, _ := manifest["layers"].([]interface{})
+	if len(layers) != len(diffIDs) {
+		return fmt.Errorf("image %s has %d layers, but %d diff IDs", tag, len(layers), len(diffIDs))
+	}
+
+	replaced := []string{manifestDigest}
+
+	for i, l := range layers {
+		layer, _ := l.(map[string]interface{})
+
+		old, diffID, err := recompressLayer(dir, layer, compression)
+		if err != nil {
+			return err
+		}
+
+		if old == "" {
+			continue
+		}
+
+		if diffID != "" {
+			diffIDs[i] = diffID
+		}
+
+		replaced = append(replaced, old)
+	}
+
+	content, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+
+	if dgst := digest.FromBytes(content).String(); dgst != configDigest {
+		if err := writeFile(layoutBlob(dir, dgst), content); err != nil {
+			return err
+		}
+
+		config["digest"] = dgst
+		config["size"] = len(content)
+		replaced = append(replaced, configDigest)
+	}
+
+	if err := writeLayoutManifest(dir, refFile, ref, manifest); err != nil {
+		return err
+	}
+
+	return removeUnreferenced(dir, replaced)
+}
+
+// writeLayoutManifest writes the manifest to the layout in dir, and points
+// the descriptor of the ref in refFile to it.
+func writeLayoutManifest(dir, refFile string, ref layoutDescriptor, manifest map[string]interface{}) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	dgst := digest.FromBytes(content).String()
+	if err := writeFile(layoutBlob(dir, dgst), content); err != nil {
+		return err
+	}
+
+	ref["digest"] = dgst
+	ref["size"] = len(content)
+
+	content, err = json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(refFile, content)
+}
+
+// recompressLayer recompresses the layer of the descriptor, and updates it.
+// It returns the digest of the blob it replaced, if any, and the diff ID of
+// the layer if it changed, as it does for eStargz.
+func recompressLayer(dir string, layer map[string]interface{}, compression string) (string, string, error) {
+	// layers are written gzipped, or uncompressed; foreign layers are left as
+	// they are.
+	if mediaType, _ := layer["mediaType"].(string); mediaType != registry.MediaTypeOCILayer && mediaType != registry.MediaTypeOCILayerUncompressed {
+		return "", "", nil
+	}
+
+	old, _ := layer["digest"].(string)
+
+	blob, err := recompressBlob(dir, old, compression)
+	if err != nil {
+		return "", "", err
+	}
+
+	layer["mediaType"] = blob.mediaType
+	layer["digest"] = blob.digest
+	layer["size"] = blob.size
+
+	if blob.stargz == nil {
+		return old, "", nil
+	}
+
+	annotations, _ := layer["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+	}
+
+	annotations[bt.StargzTOCDigestAnnotation] = blob.stargz.TOCDigest
+	annotations[bt.StargzUncompressedSizeAnnotation] = strconv.FormatInt(blob.stargz.Size, 10)
+	layer["annotations"] = annotations
+
+	return old, blob.stargz.DiffID, nil
+}
+
+// recompressedBlob is a layer blob written by recompressBlob.
+type recompressedBlob struct {
+	mediaType string
+	digest    string
+	size      int64
+	stargz    *bt.StargzLayer // set for eStargz layers
+}
+
+// recompressBlob writes the layer blob recompressed with zstd or as eStargz.
+func recompressBlob(dir, dgst, compression string) (*recompressedBlob, error) {
+	f, err := os.Open(layoutBlob(dir, dgst))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec, err := bt.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "blobs"), "box-recompress")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	blob := &recompressedBlob{}
+
+	if compression == bt.Estargz {
+		digester := digest.Canonical.Digester()
+		layer, err := bt.Stargz(io.MultiWriter(tmp, digester.Hash()), dec)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := tmp.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		blob.mediaType = registry.MediaTypeOCILayer
+		blob.stargz = &layer
+		blob.digest = digester.Digest().String()
+		blob.size = fi.Size()
+	} else {
+		// only zstd layers are recompressed this way, so the gzip workers are
+		// of no matter.
+		cw, err := bt.NewDigester(tmp, compression, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.Copy(cw, dec); err != nil {
+			return nil, err
+		}
+
+		if err := cw.Close(); err != nil {
+			return nil, err
+		}
+
+		blob.mediaType = registry.MediaTypeOCILayerZstd
+		blob.digest = cw.Digest()
+		blob.size = cw.Size()
+	}
+
+	return blob, os.Rename(tmp.Name(), layoutBlob(dir, blob.digest))
+}
+
+// removeUnreferenced removes the blobs which no image tagged in the layout
+// refers to.
+func removeUnreferenced(dir string, blobs []string) error {
+	refs, err := ioutil.ReadDir(filepath.Join(dir, "refs"))
+	if err != nil {
+		return err
+	}
+
+	referenced := map[string]bool{}
+
+	for _, fi := range refs {
+		ref := layoutDescriptor{}
+		if err := readJSON(filepath.Join(dir, "refs", fi.Name()), &ref); err != nil {
+			return err
+		}
+
+		manifestDigest, _ := ref["digest"].(string)
+		referenced[manifestDigest] = true
+
+		manifest := struct {
+			Config struct{ Digest string }
+			Layers []struct{ Digest string }
+		}{}
+
+		if err := readJSON(layoutBlob(dir, manifestDigest), &manifest); err != nil {
+			return err
+		}
+
+		referenced[manifest.Config.Digest] = true
+		for _, layer := range manifest.Layers {
+			referenced[layer.Digest] = true
+		}
+	}
+
+	for _, blob := range blobs {
+		if !referenced[blob] {
+			if err := os.Remove(layoutBlob(dir, blob)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func layoutBlob(dir, dgst string) string {
+	d := digest.Digest(dgst)
+	return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func readJSON(fn string, v interface{}) error {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, v)
+}
+
+func writeFile(fn string, content []byte) error {
+	if err := ioutil.WriteFile(fn+".tmp", content, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(fn+".tmp", fn)
+}
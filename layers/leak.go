@@ -0,0 +1,29 @@
+package layers
+
+import (
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/leak"
+)
+
+// FindLeaks saves the image built and returns the secrets found in the layers
+// the build added to the image it started from, and the known values found in
+// them. See leak.Scan. If the layers of that image were squashed with the
+// build's, all the layers are scanned.
+func (d *DockerImage) FindLeaks(known []string) ([]leak.Finding, error) {
+	if err := d.imageConfig.Layers.Materialize(d.imageConfig.Config.Image); err != nil {
+		return nil, err
+	}
+
+	saved, err := saveImage(d.imageConfig.Globals.Context, d.client, d.imageConfig.Config.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	skip := d.imageConfig.Layers.BaseLayers()
+	if skip > len(saved.layers) {
+		skip = 0
+	}
+
+	return image.FindLeaks(saved.layers, skip, known)
+}
@@ -0,0 +1,225 @@
+package layers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/client"
+)
+
+// Mount is an image mounted for inspection.
+type Mount struct {
+	Image   string `json:"image"`
+	Target  string `json:"target"`
+	Overlay bool   `json:"overlay"`        // false if the filesystem was copied to the target
+	FUSE    bool   `json:"fuse,omitempty"` // true if the overlay is mounted with fuse-overlayfs
+}
+
+// MountDir returns the directory the state of the mount at target, and the
+// layers it is made of, are kept in.
+func MountDir(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return util.BoxDir("mounts", hex.EncodeToString(sum[:]))
+}
+
+// MountImage mounts the filesystem of the image docker has at target, which
+// is created if it does not exist and must be empty otherwise. The layers are
+// unpacked and stacked with a read-only overlay mount: with overlayfs as
+// root, and with fuse-overlayfs otherwise, if it is installed. Where neither
+// can be mounted, as when not on linux, the filesystem is copied to target
+// instead; changes to the copy are lost when it is unmounted. Mounts must be
+// removed with UnmountImage.
+func MountImage(ctx context.Context, name, target string, logger *logger.Logger) (*Mount, error) {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := MountDir(target)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("%s is already mounted", target)
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", target)
+	}
+
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	mount := &Mount{Image: name, Target: target}
+
+	if os.Geteuid() == 0 {
+		err := mountLayers(dir, target, saved.layers)
+		if err == nil {
+			mount.Overlay = true
+		} else {
+			os.RemoveAll(dir)
+			logger.Print(logger.Notice(fmt.Sprintf("Can't mount overlay (%v), copying the filesystem instead", err)))
+		}
+	} else if fuseOverlay() {
+		err := mountFUSELayers(dir, target, saved.layers)
+		if err == nil {
+			mount.Overlay = true
+			mount.FUSE = true
+		} else {
+			os.RemoveAll(dir)
+			logger.Print(logger.Notice(fmt.Sprintf("Can't mount fuse-overlayfs (%v), copying the filesystem instead", err)))
+		}
+	}
+
+	if !mount.Overlay {
+		if err := copyLayers(target, saved.layers); err != nil {
+			emptyDir(target)
+			return nil, err
+		}
+	}
+
+	if err := writeMount(dir, mount); err != nil {
+		unmount(mount)
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return mount, nil
+}
+
+// UnmountImage removes the mount at target made by MountImage.
+func UnmountImage(target string) (*Mount, error) {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := MountDir(target)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "mount.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not mounted by box", target)
+	} else if err != nil {
+		return nil, err
+	}
+
+	mount := &Mount{}
+	if err := json.Unmarshal(content, mount); err != nil {
+		return nil, err
+	}
+
+	if err := unmount(mount); err != nil {
+		return nil, err
+	}
+
+	return mount, os.RemoveAll(dir)
+}
+
+// mountLayers unpacks the layers, oldest first, beneath dir and mounts them
+// at target.
+func mountLayers(dir, target string, layers []*image.Layer) error {
+	dirs := []string{}
+	for i, layer := range layers {
+		layerDir := filepath.Join(dir, "layers", strconv.Itoa(i))
+		if err := os.MkdirAll(layerDir, 0755); err != nil {
+			return err
+		}
+
+		if err := image.UnarchiveLayer(layer, layerDir); err != nil {
+			return err
+		}
+
+		dirs = append(dirs, layerDir)
+	}
+
+	return mountOverlay(lowerDirs(dirs), target)
+}
+
+// lowerDirs returns the directories the layers were unpacked to, oldest
+// first, in the order overlayfs stacks them: the top layer first.
+func lowerDirs(dirs []string) []string {
+	lower := []string{}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		lower = append(lower, dirs[i])
+	}
+
+	return lower
+}
+
+// copyLayers writes the filesystem the layers make up to target.
+func copyLayers(target string, layers []*image.Layer) error {
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(image.Export(w, layers))
+	}()
+
+	err := tar.Extract(r, target)
+	r.CloseWithError(err)
+	return err
+}
+
+func writeMount(dir string, mount *Mount) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(mount, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "mount.json"), content, 0600)
+}
+
+func unmount(mount *Mount) error {
+	if mount.FUSE {
+		return unmountFUSE(mount.Target)
+	}
+
+	if mount.Overlay {
+		return unmountOverlay(mount.Target)
+	}
+
+	return emptyDir(mount.Target)
+}
+
+// emptyDir removes what is in the directory, but not the directory.
+func emptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
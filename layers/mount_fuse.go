@@ -0,0 +1,62 @@
+package layers
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/box-builder/box/image"
+)
+
+// fuseOverlay is true if fuse-overlayfs is installed, to mount overlays as a
+// user other than root.
+func fuseOverlay() bool {
+	_, err := exec.LookPath("fuse-overlayfs")
+	return err == nil
+}
+
+// mountFUSELayers unpacks the layers, oldest first, beneath dir as the user
+// running box and mounts them at target with fuse-overlayfs. Whiteouts are
+// kept as .wh. files, which fuse-overlayfs reads as overlayfs does whiteout
+// devices; files are owned by the user.
+func mountFUSELayers(dir, target string, layers []*image.Layer) error {
+	dirs := []string{}
+	for i, layer := range layers {
+		layerDir := filepath.Join(dir, "layers", strconv.Itoa(i))
+		if err := os.MkdirAll(layerDir, 0755); err != nil {
+			return err
+		}
+
+		if err := image.ExtractLayer(layer, layerDir); err != nil {
+			return err
+		}
+
+		dirs = append(dirs, layerDir)
+	}
+
+	// without an upper directory, the mount is read-only.
+	return runFUSE("fuse-overlayfs", "-o", "lowerdir="+strings.Join(lowerDirs(dirs), ":"), target)
+}
+
+// unmountFUSE unmounts the fuse-overlayfs mount at target.
+func unmountFUSE(target string) error {
+	for _, fusermount := range []string{"fusermount3", "fusermount"} {
+		if _, err := exec.LookPath(fusermount); err == nil {
+			return runFUSE(fusermount, "-u", target)
+		}
+	}
+
+	return fmt.Errorf("can't unmount %s: fusermount is not installed", target)
+}
+
+func runFUSE(command string, args ...string) error {
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", command, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
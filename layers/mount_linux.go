@@ -0,0 +1,31 @@
+package layers
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountOverlay mounts the directories, top first, read-only at target. A
+// single directory is bind mounted, as overlayfs needs two lower directories
+// when it has no upper one.
+func mountOverlay(lower []string, target string) error {
+	if len(lower) == 1 {
+		if err := unix.Mount(lower[0], target, "", unix.MS_BIND, ""); err != nil {
+			return err
+		}
+
+		if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			unix.Unmount(target, 0)
+			return err
+		}
+
+		return nil
+	}
+
+	return unix.Mount("overlay", target, "overlay", unix.MS_RDONLY, "lowerdir="+strings.Join(lower, ":"))
+}
+
+func unmountOverlay(target string) error {
+	return unix.Unmount(target, 0)
+}
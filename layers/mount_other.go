@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package layers
+
+import "errors"
+
+var errNoOverlay = errors.New("overlay mounts are only supported on linux")
+
+func mountOverlay(lower []string, target string) error {
+	return errNoOverlay
+}
+
+func unmountOverlay(target string) error {
+	return errNoOverlay
+}
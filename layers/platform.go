@@ -0,0 +1,71 @@
+package layers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/registry"
+)
+
+// setPlatform labels the image with the platform built for. Docker labels
+// the images committed with its own platform, also when the steps were run
+// emulated for another one, so the image is rewritten with the platform in
+// that case.
+func (d *Docker) setPlatform(config *config.Config) error {
+	platform, err := registry.ParsePlatform(d.globals.Platform)
+	if err != nil {
+		return err
+	}
+
+	config.Architecture = platform.Architecture
+	config.OS = platform.OS
+	config.Variant = platform.Variant
+
+	_, raw, err := d.client.ImageInspectWithRaw(d.globals.Context, config.Image)
+	if err != nil {
+		return err
+	}
+
+	current := struct {
+		Os           string
+		Architecture string
+		Variant      string
+	}{}
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return err
+	}
+
+	if platform.Matches(registry.Platform{OS: current.Os, Architecture: current.Architecture, Variant: current.Variant}) {
+		return nil
+	}
+
+	d.globals.Logger.Print(d.globals.Logger.Notice(fmt.Sprintf("Labeling image for %s\n", platform)))
+
+	saved, err := saveImage(d.globals.Context, d.client, config.Image)
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	fields := map[string]interface{}{}
+	for key, value := range saved.config {
+		if key != "rootfs" {
+			fields[key] = value
+		}
+	}
+
+	fields["architecture"] = platform.Architecture
+	fields["os"] = platform.OS
+	delete(fields, "variant")
+	if platform.Variant != "" {
+		fields["variant"] = platform.Variant
+	}
+
+	config.Image, err = loadImage(d.globals.Context, d.client, func(w io.Writer) error {
+		return image.Assemble(w, config, saved.layers, fields, d.globals.Logger)
+	})
+	return err
+}
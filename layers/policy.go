@@ -0,0 +1,194 @@
+package layers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/registry"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/image"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ValidPolicy returns an error if the signature policy file can't be read.
+func ValidPolicy(policyFile string) error {
+	_, err := signature.NewPolicyFromFile(policyFile)
+	return err
+}
+
+// requiresSignatures is true if the signature policy file requires any image
+// to be signed, or rejects any: anything but insecureAcceptAnything, for any
+// transport or scope.
+func requiresSignatures(policyFile string) (bool, error) {
+	sigPolicy, err := signature.NewPolicyFromFile(policyFile)
+	if err != nil {
+		return false, err
+	}
+
+	reqs := append(signature.PolicyRequirements{}, sigPolicy.Default...)
+	for _, scopes := range sigPolicy.Transports {
+		for _, scope := range scopes {
+			reqs = append(reqs, scope...)
+		}
+	}
+
+	for _, req := range reqs {
+		// the types of the requirements are private, but for their JSON.
+		content, err := json.Marshal(req)
+		if err != nil {
+			return false, err
+		}
+
+		var common struct {
+			Type string `json:"type"`
+		}
+
+		if err := json.Unmarshal(content, &common); err != nil {
+			return false, err
+		}
+
+		if common.Type != "insecureAcceptAnything" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkPolicy checks the image in its registry against the signature policy
+// file, in the policy.json format of containers/image, and returns the name to
+// pull it by: its digest, so docker pulls the manifest which was checked. An
+// image which is not allowed is an error, as is one the policy of the build,
+// if it is set, does not allow to pull.
+func checkPolicy(p *policy.Policy, policyFile, name string) (string, error) {
+	sigPolicy, err := signature.NewPolicyFromFile(policyFile)
+	if err != nil {
+		return "", err
+	}
+
+	named, d, err := checkSignatures(p, sigPolicy, name)
+	if err != nil {
+		return "", fmt.Errorf("%s is not allowed by the signature policy %s: %v", name, policyFile, err)
+	}
+
+	return fmt.Sprintf("%s@%s", named.Name(), d), nil
+}
+
+// checkBase checks the image is one of the bases of the policy, and returns
+// the name to pull it by. If the base has digests or must be signed, it is its
+// digest, as for checkPolicy.
+func checkBase(p *policy.Policy, name string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+
+	base, err := p.Base(named.Name())
+	if err != nil {
+		return "", err
+	}
+
+	if len(base.Digests) == 0 && base.SignedBy == "" {
+		return name, nil
+	}
+
+	var d digest.Digest
+
+	if base.SignedBy != "" {
+		sbPolicy, err := signedByPolicy(base.SignedBy)
+		if err != nil {
+			return "", err
+		}
+
+		if named, d, err = checkSignatures(p, sbPolicy, name); err != nil {
+			return "", fmt.Errorf("%s is not an allowed base image: the policy %s requires %s to be signed by a key in %s: %v", name, p.File, base.Name, base.SignedBy, err)
+		}
+	} else if canonical, ok := named.(reference.Canonical); ok {
+		// the digest is in the name, so the registry needn't be asked for it.
+		d = canonical.Digest()
+	} else if named, d, err = checkSignatures(p, nil, name); err != nil {
+		return "", err
+	}
+
+	if err := base.CheckDigest(named.Name(), d.String()); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s@%s", named.Name(), d), nil
+}
+
+// signedByPolicy returns a signature policy which allows the images signed by
+// one of the GPG keys in the file.
+func signedByPolicy(keyPath string) (*signature.Policy, error) {
+	req, err := signature.NewPRSignedByKeyPath(signature.SBKeyTypeGPGKeys, keyPath, signature.NewPRMMatchRepoDigestOrExact())
+	if err != nil {
+		return nil, err
+	}
+
+	return &signature.Policy{Default: signature.PolicyRequirements{req}}, nil
+}
+
+// checkSignatures checks the image in its registry against the signature
+// policy, if it is not nil, and returns its name and the digest of its
+// manifest. The policy of the build must allow the image to be pulled.
+func checkSignatures(p *policy.Policy, sigPolicy *signature.Policy, name string) (reference.Named, digest.Digest, error) {
+	if err := registry.CheckPull(p, name); err != nil {
+		return nil, "", err
+	}
+
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, "", err
+	}
+	named = reference.TagNameOnly(named)
+
+	ref, err := docker.NewReference(named)
+	if err != nil {
+		return nil, "", err
+	}
+
+	src, err := ref.NewImageSource(nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	unparsed := image.UnparsedFromSource(src)
+	defer unparsed.Close()
+
+	if sigPolicy != nil {
+		pc, err := signature.NewPolicyContext(sigPolicy)
+		if err != nil {
+			return nil, "", err
+		}
+		defer pc.Destroy()
+
+		if allowed, err := pc.IsRunningImageAllowed(unparsed); !allowed {
+			if err == nil {
+				err = fmt.Errorf("not allowed")
+			}
+			audit.Record(audit.Verify, name, "", err)
+			return nil, "", err
+		}
+	}
+
+	content, _, err := unparsed.Manifest()
+	if err != nil {
+		return nil, "", err
+	}
+
+	d, err := manifest.Digest(content)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if sigPolicy != nil {
+		audit.Record(audit.Verify, name, d.String(), nil)
+	}
+
+	return named, d, nil
+}
@@ -0,0 +1,64 @@
+package layers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/box-builder/box/provenance"
+	"github.com/containers/image/docker/reference"
+	"github.com/docker/docker/client"
+)
+
+// ResolveImages returns the images used with from as resources of the
+// provenance of the image built: the digest of the manifest docker pulled each
+// one by. Images docker has no digest for, such as images built locally, are
+// given by their image ID.
+func ResolveImages(ctx context.Context, images []provenance.Image) ([]provenance.ResourceDescriptor, error) {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resources := []provenance.ResourceDescriptor{}
+
+	for _, image := range images {
+		named, err := reference.ParseNormalizedNamed(image.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		resource := provenance.ResourceDescriptor{Name: image.Name, URI: "docker://" + named.Name()}
+
+		if canonical, ok := named.(reference.Canonical); ok {
+			resource.Digest = digestSet(canonical.Digest().String())
+		} else {
+			inspect, _, err := client.ImageInspectWithRaw(ctx, image.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, repoDigest := range inspect.RepoDigests {
+				if canonical, err := reference.ParseNormalizedNamed(repoDigest); err == nil && canonical.Name() == named.Name() {
+					if canonical, ok := canonical.(reference.Canonical); ok {
+						resource.Digest = digestSet(canonical.Digest().String())
+						break
+					}
+				}
+			}
+		}
+
+		if resource.Digest == nil {
+			resource.Annotations = map[string]string{"imageID": image.ID}
+		}
+
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+// digestSet returns the digest, algorithm:hex, as in-toto digest sets are.
+func digestSet(digest string) map[string]string {
+	parts := strings.SplitN(digest, ":", 2)
+	return map[string]string{parts[0]: parts[1]}
+}
@@ -0,0 +1,141 @@
+package layers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/registry"
+	"github.com/containers/image/copy"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/docker/daemon"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/signature"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// registryCacheRef returns the reference for the cache key in the registry
+// cache repo. Each step is kept as an image tagged with its cache key.
+func registryCacheRef(repo, cacheKey string) (reference.NamedTagged, error) {
+	named, err := reference.ParseNormalizedNamed(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reference.IsNameOnly(named) {
+		return nil, errors.Errorf("cache repository %q may not have a tag or digest", repo)
+	}
+
+	return reference.WithTag(named, strings.TrimPrefix(cacheKey, cache.Prefix))
+}
+
+func acceptAnything() (*signature.PolicyContext, error) {
+	return signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+}
+
+// isNotFound is true if the registry reported it does not have the image.
+func isNotFound(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case errcode.Errors:
+		for _, e := range err {
+			if isNotFound(e) {
+				return true
+			}
+		}
+	case errcode.Error:
+		return err.Code.Descriptor().HTTPStatusCode == http.StatusNotFound
+	case errcode.ErrorCode:
+		return err.Descriptor().HTTPStatusCode == http.StatusNotFound
+	case *client.UnexpectedHTTPResponseError:
+		return err.StatusCode == http.StatusNotFound
+	}
+
+	return false
+}
+
+// registryStore keeps the build cache in a registry repository.
+type registryStore struct {
+	repo   string
+	policy *policy.Policy
+}
+
+// Import pulls the image for the cache key from the registry into the docker
+// daemon. It returns false if the registry does not have it.
+func (r *registryStore) Import(ctx context.Context, cacheKey string) (bool, error) {
+	if err := registry.CheckPull(r.policy, r.repo); err != nil {
+		return false, err
+	}
+
+	ref, err := registryCacheRef(r.repo, cacheKey)
+	if err != nil {
+		return false, err
+	}
+
+	src, err := docker.NewReference(ref)
+	if err != nil {
+		return false, err
+	}
+
+	tgt, err := daemon.NewReference("", ref)
+	if err != nil {
+		return false, err
+	}
+
+	pc, err := acceptAnything()
+	if err != nil {
+		return false, err
+	}
+	defer pc.Destroy()
+
+	if _, err := copy.Image(pc, tgt, src, &copy.Options{RemoveSignatures: true, DestinationCtx: daemonContext()}); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+
+		audit.Record(audit.Pull, ref.String(), "", err)
+		return false, err
+	}
+
+	audit.Record(audit.Pull, ref.String(), "", nil)
+	return true, nil
+}
+
+// Export pushes the image for the cache key to the registry.
+func (r *registryStore) Export(ctx context.Context, image, cacheKey string) error {
+	if err := registry.CheckPush(r.policy, r.repo); err != nil {
+		return err
+	}
+
+	ref, err := registryCacheRef(r.repo, cacheKey)
+	if err != nil {
+		return err
+	}
+
+	src, err := daemon.NewReference(digest.Digest(image), nil)
+	if err != nil {
+		return err
+	}
+
+	tgt, err := docker.NewReference(ref)
+	if err != nil {
+		return err
+	}
+
+	pc, err := acceptAnything()
+	if err != nil {
+		return err
+	}
+	defer pc.Destroy()
+
+	_, err = copy.Image(pc, tgt, src, &copy.Options{RemoveSignatures: true, SourceCtx: daemonContext()})
+	audit.Record(audit.Push, ref.String(), image, err)
+	return err
+}
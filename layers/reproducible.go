@@ -0,0 +1,108 @@
+package layers
+
+import (
+	"io"
+	"time"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/util"
+)
+
+// reproducibleTime is the time of everything in a reproducible image, unless
+// SOURCE_DATE_EPOCH gives another.
+var reproducibleTime = time.Unix(0, 0).UTC()
+
+// makeReproducible rewrites the image with what differs between two builds of
+// the same plan removed: its layers are normalized, see tar.Normalize, and
+// the times and the container it was committed from are removed from its
+// configuration, so building the same inputs gives the same image ID.
+func (d *Docker) makeReproducible(config *config.Config) error {
+	epoch, ok, err := util.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		epoch = reproducibleTime
+	}
+
+	return d.rewriteImage(config, epoch, true)
+}
+
+// clampTimes rewrites the image with no time in it later than epoch: the
+// times of the files in its layers, and those of its history entries. The
+// image is created at epoch.
+func (d *Docker) clampTimes(config *config.Config, epoch time.Time) error {
+	return d.rewriteImage(config, epoch, false)
+}
+
+// rewriteImage rewrites the image with its times set to epoch, if normalize
+// is set, or else clamped to it.
+func (d *Docker) rewriteImage(config *config.Config, epoch time.Time, normalize bool) error {
+	saved, err := saveImage(d.globals.Context, d.client, config.Image)
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	var layers []*image.Layer
+	if normalize {
+		layers, err = image.Normalize(saved.dir, saved.layers, epoch)
+	} else {
+		layers, err = image.ClampTimes(saved.dir, saved.layers, epoch)
+	}
+	if err != nil {
+		return err
+	}
+
+	fields := rewriteFields(saved.config, epoch, normalize)
+
+	config.Image, err = loadImage(d.globals.Context, d.client, func(w io.Writer) error {
+		return image.Assemble(w, config, layers, fields, d.globals.Logger)
+	})
+	return err
+}
+
+// rewriteFields returns the fields of the configuration of the saved image to
+// assemble the rewritten one with, created at epoch. Its history entries are
+// set to epoch if normalize is set, or else clamped to it.
+func rewriteFields(saved map[string]interface{}, epoch time.Time, normalize bool) map[string]interface{} {
+	created := epoch.Format(time.RFC3339)
+
+	fields := map[string]interface{}{}
+	for key, value := range saved {
+		switch key {
+		case "rootfs":
+		case "container", "container_config":
+			if !normalize {
+				fields[key] = value
+			}
+		default:
+			fields[key] = value
+		}
+	}
+
+	fields["created"] = created
+
+	history, _ := fields["history"].([]interface{})
+	for _, entry := range history {
+		entry, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		entryCreated, _ := entry["created"].(string)
+		if t, err := time.Parse(time.RFC3339Nano, entryCreated); normalize || err != nil || t.After(epoch) {
+			entry["created"] = created
+		}
+	}
+
+	// docker sets the hostname to the ID of the container the image was
+	// committed from.
+	if cfg, ok := fields["config"].(map[string]interface{}); ok && normalize {
+		delete(cfg, "Hostname")
+	}
+
+	return fields
+}
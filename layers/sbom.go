@@ -0,0 +1,35 @@
+package layers
+
+import (
+	"context"
+	"io"
+
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/sbom"
+	"github.com/docker/docker/client"
+)
+
+// ScanImage saves the image docker has and returns the packages installed in
+// its filesystem. See sbom.Scan.
+func ScanImage(ctx context.Context, name string) (*sbom.SBOM, error) {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(image.Export(w, saved.layers))
+	}()
+
+	result, err := sbom.Scan(r, name)
+	r.CloseWithError(err)
+	return result, err
+}
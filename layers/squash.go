@@ -0,0 +1,166 @@
+package layers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/logger"
+	"github.com/docker/docker/client"
+)
+
+// Squash merges the layers the current image has on top of the image named
+// from into one layer, without the files matching the exclude patterns. The
+// layers of from are left as they are, so they are still shared with it and
+// with other images built on it.
+func (d *DockerImage) Squash(from string, exclude []string) error {
+	ctx := d.imageConfig.Globals.Context
+
+	for _, image := range []string{from, d.imageConfig.Config.Image} {
+		if err := d.imageConfig.Layers.Materialize(image); err != nil {
+			return err
+		}
+	}
+
+	base, _, err := d.client.ImageInspectWithRaw(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	current, _, err := d.client.ImageInspectWithRaw(ctx, d.imageConfig.Config.Image)
+	if err != nil {
+		return err
+	}
+
+	layers := current.RootFS.Layers
+	if len(base.RootFS.Layers) > len(layers) {
+		return fmt.Errorf("image %q is not a parent of the current image", from)
+	}
+
+	for i, layer := range base.RootFS.Layers {
+		if layers[i] != layer {
+			return fmt.Errorf("image %q is not a parent of the current image", from)
+		}
+	}
+
+	// nothing was added since from.
+	if len(base.RootFS.Layers) == len(layers) {
+		return nil
+	}
+
+	id, err := squashImage(ctx, d.client, d.imageConfig.Config, d.imageConfig.Config.Image, len(base.RootFS.Layers), len(layers)-1, exclude, d.imageConfig.Globals.Logger)
+	if err != nil {
+		return err
+	}
+
+	d.imageConfig.Config.Image = id
+
+	return d.imageConfig.Layers.AddImage(d.imageConfig.Config.Image)
+}
+
+// SquashImage merges the layers from through to (counting from 0) of the
+// image into one layer, and loads the result into docker. The layers before
+// and after the range, and the image configuration, are left as they are.
+// Returns the ID of the new image.
+func SquashImage(ctx context.Context, name string, from, to int, logger *logger.Logger) (string, error) {
+	client, err := client.NewEnvClient()
+	if err != nil {
+		return "", err
+	}
+
+	return squashImage(ctx, client, nil, name, from, to, nil, logger)
+}
+
+// savedImage is an image saved from docker and unpacked.
+type savedImage struct {
+	dir    string
+	layers []*image.Layer
+	config map[string]interface{}
+}
+
+// saveImage saves the image from docker and unpacks it as docker saves it, so
+// only its layers are written. The saved image must be closed to remove it.
+func saveImage(ctx context.Context, client *client.Client, name string) (*savedImage, error) {
+	rc, err := client.ImageSave(ctx, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	saved := &savedImage{}
+	saved.layers, saved.config, saved.dir, err = image.UnpackReader(rc)
+	if err != nil {
+		saved.Close()
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+// Close removes the saved image.
+func (s *savedImage) Close() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// squashImage saves the image from docker and loads an image of it with the
+// layers from through to merged, without the files matching the exclude
+// patterns. The image gets the configuration given, or keeps its own if it is
+// nil. Returns the ID of the new image.
+func squashImage(ctx context.Context, client *client.Client, cfg *config.Config, name string, from, to int, exclude []string, logger *logger.Logger) (string, error) {
+	saved, err := saveImage(ctx, client, name)
+	if err != nil {
+		return "", err
+	}
+	defer saved.Close()
+
+	unpacked := saved.layers
+
+	if from < 0 || to < from || to >= len(unpacked) {
+		return "", fmt.Errorf("cannot squash layers %d to %d: %s has %d layers", from, to, name, len(unpacked))
+	}
+
+	squashed, err := image.Squash(saved.dir, unpacked[from:to+1])
+	if err != nil {
+		return "", err
+	}
+
+	if len(exclude) > 0 {
+		squashed, err = image.Exclude(saved.dir, squashed, exclude)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	layers := append([]*image.Layer{}, unpacked[:from]...)
+	layers = append(layers, squashed)
+	layers = append(layers, unpacked[to+1:]...)
+
+	fields := map[string]interface{}{}
+
+	if cfg == nil {
+		cfg = config.NewConfig()
+
+		for key, value := range saved.config {
+			switch key {
+			case "rootfs", "created":
+			default:
+				fields[key] = value
+			}
+		}
+	}
+
+	if history, ok := saved.config["history"].([]interface{}); ok {
+		fields["history"] = image.SquashHistory(history, from, to, fmt.Sprintf("box squash --from %d --to %d", from, to))
+	} else {
+		delete(fields, "history")
+	}
+
+	return loadImage(ctx, client, func(w io.Writer) error {
+		return image.Assemble(w, cfg, layers, fields, logger)
+	})
+}
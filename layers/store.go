@@ -0,0 +1,603 @@
+package layers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/fetcher"
+	"github.com/box-builder/box/registry"
+	bt "github.com/box-builder/box/tar"
+	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// storeMutex guards the tags of the store, which the builds run at the same
+// time share.
+var storeMutex sync.Mutex
+
+// Store is the Layers interface applied to a directory of images, which is
+// what builds run without docker keep their images in: each layer
+// uncompressed, by its diff ID, and each image configuration, by the image ID,
+// which is its digest as it is in docker.
+type Store struct {
+	dir          string
+	globals      *types.Global
+	client       *registry.Client
+	doSkipLayers bool
+	skipLayers   []string
+	layers       []string
+	layerSet     map[string]struct{}
+	base         int // the number of layers of the image the build started from
+}
+
+// storedImage is what the store reads of an image configuration.
+type storedImage struct {
+	Config *container.Config `json:"config"`
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// NewStore returns the store of images in the box directory.
+func NewStore(globals *types.Global) (*Store, error) {
+	dir := util.BoxDir("images")
+
+	for _, kind := range []string{"layers", "images", "cache"} {
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{
+		dir:        dir,
+		globals:    globals,
+		client:     registry.NewClient(globals.Policy),
+		layerSet:   map[string]struct{}{},
+		skipLayers: []string{},
+		layers:     []string{},
+	}, nil
+}
+
+// path returns the file of the layer or image with the digest given.
+func (s *Store) path(kind, id string) (string, error) {
+	d, err := digest.Parse(id)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.dir, kind, d.Hex()), nil
+}
+
+func (s *Store) readImage(id string) (*storedImage, error) {
+	fn, err := s.path("images", id)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &storedImage{}
+	if err := readJSON(fn, img); err != nil {
+		return nil, err
+	}
+
+	if img.Config == nil {
+		img.Config = &container.Config{}
+	}
+
+	return img, nil
+}
+
+// writeImage writes the configuration of an image of the layers, given by
+// diff ID, and returns its ID.
+func (s *Store) writeImage(config *config.Config, layers []string) (string, error) {
+	hexes := []string{}
+	for _, layer := range layers {
+		hexes = append(hexes, strings.TrimPrefix(layer, "sha256:"))
+	}
+
+	content, err := json.Marshal(config.ToImage(hexes))
+	if err != nil {
+		return "", err
+	}
+
+	id := digest.FromBytes(content).String()
+
+	fn, err := s.path("images", id)
+	if err != nil {
+		return "", err
+	}
+
+	return id, writeStoreFile(fn, content)
+}
+
+// writeStoreFile writes the file whole, or not at all, as the builds run at
+// the same time may write the same file.
+func writeStoreFile(fn string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), ".box-store")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
+
+// putLayer keeps the uncompressed layer tarball read from r, and returns its
+// diff ID and size.
+func (s *Store) putLayer(r io.Reader) (string, int64, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "layers"), ".box-layer")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	id := digester.Digest().String()
+
+	fn, err := s.path("layers", id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return id, size, os.Rename(tmp.Name(), fn)
+}
+
+// DiffIDs returns the diff IDs of the layers of the image, oldest first.
+func (s *Store) DiffIDs(id string) ([]string, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	img, err := s.readImage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.RootFS.DiffIDs, nil
+}
+
+// LayerFiles returns the layer tarballs of the image, oldest first.
+func (s *Store) LayerFiles(id string) ([]string, error) {
+	diffIDs, err := s.DiffIDs(id)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, layer := range diffIDs {
+		fn, err := s.path("layers", layer)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fn)
+	}
+
+	return files, nil
+}
+
+// Commit keeps the layer tarball read from r as a layer on top of the image
+// of the configuration, and makes an image of it with the configuration. The
+// image is found with the cache key by CachedImage after. It returns the ID of
+// the image, and the size of the layer.
+func (s *Store) Commit(config *config.Config, r io.Reader, cacheKey string) (string, int64, error) {
+	layer, size, err := s.putLayer(r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	layers := []string{}
+	if config.Image != "" {
+		img, err := s.readImage(config.Image)
+		if err != nil {
+			return "", 0, err
+		}
+		layers = img.RootFS.DiffIDs
+	}
+
+	id, err := s.writeImage(config, append(layers, layer))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if cacheKey != "" {
+		if err := writeStoreFile(s.cacheFile(config.Image, cacheKey), []byte(id)); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return id, size, nil
+}
+
+func (s *Store) cacheFile(parent, cacheKey string) string {
+	sum := sha256.Sum256([]byte(parent + "\n" + cacheKey))
+	return filepath.Join(s.dir, "cache", hex.EncodeToString(sum[:]))
+}
+
+// CachedImage returns the image committed with the cache key on top of the
+// parent image, if the store has it.
+func (s *Store) CachedImage(parent, cacheKey string) (string, bool, error) {
+	content, err := ioutil.ReadFile(s.cacheFile(parent, cacheKey))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	id := string(content)
+
+	// the image may have been removed since.
+	fn, err := s.path("images", id)
+	if err != nil {
+		return "", false, err
+	}
+
+	if _, err := os.Stat(fn); err != nil {
+		return "", false, nil
+	}
+
+	return id, true, nil
+}
+
+func (s *Store) tagsFile() string {
+	return filepath.Join(s.dir, "tags.json")
+}
+
+func (s *Store) readTags() (map[string]string, error) {
+	tags := map[string]string{}
+	if err := readJSON(s.tagsFile(), &tags); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// tagName returns the name images are tagged with in the store, the name as
+// docker parses it.
+func tagName(name string) (string, error) {
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.String(), nil
+}
+
+// tag tags the image with the name.
+func (s *Store) tag(name, id string) error {
+	key, err := tagName(name)
+	if err != nil {
+		return err
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	tags, err := s.readTags()
+	if err != nil {
+		return err
+	}
+
+	tags[key] = id
+
+	content, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	return writeStoreFile(s.tagsFile(), content)
+}
+
+// Lookup an image by name or ID, returning the ID.
+func (s *Store) Lookup(name string) (string, error) {
+	if strings.HasPrefix(name, "sha256:") {
+		fn, err := s.path("images", name)
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := os.Stat(fn); err != nil {
+			return "", fmt.Errorf("no such image: %s", name)
+		}
+
+		return name, nil
+	}
+
+	key, err := tagName(name)
+	if err != nil {
+		return "", err
+	}
+
+	storeMutex.Lock()
+	tags, err := s.readTags()
+	storeMutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	id, ok := tags[key]
+	if !ok {
+		return "", fmt.Errorf("no such image: %s", name)
+	}
+
+	return id, nil
+}
+
+// Fetch pulls an image from its registry into the store, overwrites the
+// container configuration, and returns its ID. Layers the store has are not
+// pulled again. Signature policies and policies of bases are checked as they
+// are with docker; images can't be decrypted as they are pulled.
+func (s *Store) Fetch(config *config.Config, name string) (string, error) {
+	if s.globals.SignaturePolicy != "" {
+		var err error
+		if name, err = checkPolicy(s.globals.Policy, s.globals.SignaturePolicy, name); err != nil {
+			return "", err
+		}
+	}
+
+	if s.globals.Policy != nil && len(s.globals.Policy.Bases) > 0 {
+		var err error
+		if name, err = checkBase(s.globals.Policy, name); err != nil {
+			return "", err
+		}
+	}
+
+	if len(s.globals.DecryptKeys) > 0 {
+		return "", fmt.Errorf("cannot pull %s: images are only decrypted as they are pulled into docker", name)
+	}
+
+	platform, err := hostPlatform(s.globals)
+	if err != nil {
+		return "", err
+	}
+
+	ref, img, err := fetcher.Inspect(s.globals.Context, s.globals, config, name, platform)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.pull(ref, img)
+	audit.Record(audit.Pull, name, img.ID, err)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.tag(name, img.ID); err != nil {
+		return "", err
+	}
+
+	s.setBase(img.DiffIDs)
+	return img.ID, nil
+}
+
+// pull fetches the configuration and layers of the image the store does not
+// have from its registry. The configuration is kept as the registry has it,
+// so the image has the ID it has in docker.
+func (s *Store) pull(ref registry.Reference, img *registry.InspectedImage) error {
+	fn, err := s.path("images", img.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(fn); err != nil {
+		rc, _, err := s.client.GetBlob(s.globals.Context, ref.Domain, ref.Repository, img.ID)
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+
+		if digest.FromBytes(content).String() != img.ID {
+			return fmt.Errorf("configuration of %s does not match its digest %s", ref, img.ID)
+		}
+
+		if err := writeStoreFile(fn, content); err != nil {
+			return err
+		}
+	}
+
+	for i, layer := range img.Layers {
+		diffID := img.DiffIDs[i]
+
+		fn, err := s.path("layers", diffID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(fn); err == nil {
+			continue
+		}
+
+		s.globals.Logger.Print(s.globals.Logger.Notice(fmt.Sprintf("Pulling layer %s (%s)\n", strings.TrimPrefix(layer.Digest, "sha256:")[:12], units.HumanSize(float64(layer.Size)))))
+
+		if err := s.pullLayer(ref, layer.Digest, diffID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pullLayer fetches the layer blob, and keeps it uncompressed if it is the
+// layer of the diff ID.
+func (s *Store) pullLayer(ref registry.Reference, dgst, diffID string) error {
+	rc, _, err := s.client.GetBlob(s.globals.Context, ref.Domain, ref.Repository, dgst)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dec, err := bt.Decompress(rc)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	id, _, err := s.putLayer(dec)
+	if err != nil {
+		return err
+	}
+
+	if id != diffID {
+		if fn, err := s.path("layers", id); err == nil {
+			os.Remove(fn)
+		}
+
+		return fmt.Errorf("layer %s of %s is %s uncompressed, not %s as its configuration has it", dgst, ref, id, diffID)
+	}
+
+	return nil
+}
+
+// Materialize does nothing: images are pulled into the store whole.
+func (s *Store) Materialize(image string) error {
+	return nil
+}
+
+// FetchArchive returns an error: image files are only loaded into docker.
+func (s *Store) FetchArchive(config *config.Config, file, name string) (string, error) {
+	return "", fmt.Errorf("cannot use the image file %s: image files are only loaded into docker", file)
+}
+
+// FetchTar imports a filesystem tarball, which may be compressed, as an image
+// with one layer, overwrites the container configuration, and returns its ID.
+func (s *Store) FetchTar(config *config.Config, file string) (string, error) {
+	if err := checkFileBase(s.globals, file); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dec, err := bt.Decompress(f)
+	if err != nil {
+		return "", err
+	}
+	defer dec.Close()
+
+	layer, _, err := s.putLayer(dec)
+	if err != nil {
+		return "", err
+	}
+
+	// the filesystem has no platform; it is given the build's.
+	platform, err := hostPlatform(s.globals)
+	if err != nil {
+		return "", err
+	}
+
+	config.FromDocker(&container.Config{})
+	config.Architecture = platform.Architecture
+	config.OS = platform.OS
+	config.Variant = platform.Variant
+
+	id, err := s.writeImage(config, []string{layer})
+	if err != nil {
+		return "", err
+	}
+
+	config.Image = id
+	s.setBase([]string{layer})
+	return id, nil
+}
+
+// AddImage adds layers to the layer list from a provided image, in order of
+// appearance. Any existing layers are skipped over, removing them from the list.
+func (s *Store) AddImage(image string) error {
+	img, err := s.readImage(image)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range img.RootFS.DiffIDs {
+		if _, ok := s.layerSet[layer]; !ok {
+			if !s.doSkipLayers {
+				s.layers = append(s.layers, layer)
+			} else {
+				s.skipLayers = append(s.skipLayers, layer)
+			}
+
+			s.layerSet[layer] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// SetSkipLayers toggles whether or not to skip layers that are being built
+// next. Toggle again to re-enable layer recording. The final image will not
+// contain the skipped layers.
+func (s *Store) SetSkipLayers(ok bool) {
+	s.doSkipLayers = ok
+}
+
+// SetLayers sets the layers.
+func (s *Store) SetLayers(layers []string) {
+	s.layers = layers
+}
+
+// setBase sets the layers to those of the image the build starts from.
+func (s *Store) setBase(layers []string) {
+	s.base = len(layers)
+	s.SetLayers(layers)
+}
+
+// BaseLayers returns the number of layers of the image the build started
+// from.
+func (s *Store) BaseLayers() int {
+	return s.base
+}
+
+// MakeImage makes the final image, without the layers skipped.
+func (s *Store) MakeImage(config *config.Config) (string, error) {
+	if len(s.skipLayers) != 0 && config.Image != "" {
+		id, err := s.writeImage(config, s.layers)
+		if err != nil {
+			return "", err
+		}
+
+		config.Image = id
+	}
+
+	return config.Image, nil
+}
+
+// ExportCache returns an error: the store's cache can't be exported.
+func (s *Store) ExportCache(string) error {
+	return fmt.Errorf("the cache of builds run without docker can't be exported")
+}
@@ -0,0 +1,428 @@
+package layers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/leak"
+	"github.com/box-builder/box/ocicrypt"
+	"github.com/box-builder/box/registry"
+	bt "github.com/box-builder/box/tar"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// StoreImage is the Image interface applied to the images of a Store.
+type StoreImage struct {
+	imageConfig *ImageConfig
+	store       *Store
+}
+
+// NewStoreImage returns the Image of the store, which must be the Layers of
+// the configuration.
+func NewStoreImage(imageConfig *ImageConfig) (*StoreImage, error) {
+	store, ok := imageConfig.Layers.(*Store)
+	if !ok {
+		return nil, errors.New("images of a store must have the store as their layers")
+	}
+
+	return &StoreImage{imageConfig: imageConfig, store: store}, nil
+}
+
+// needsDocker is the error of what can't be done without docker.
+func needsDocker(what string) error {
+	return fmt.Errorf("%s needs docker: it can't be used in builds run without it", what)
+}
+
+// Flatten returns an error: images are only flattened in docker.
+func (s *StoreImage) Flatten(*image.Layer) error {
+	return needsDocker("flatten")
+}
+
+// Squash returns an error: images are only squashed in docker.
+func (s *StoreImage) Squash(string, []string) error {
+	return needsDocker("squash")
+}
+
+// Tag the current image with the name given in the store.
+func (s *StoreImage) Tag(tag string) error {
+	id := s.imageConfig.Config.Image
+
+	err := s.store.tag(tag, id)
+	audit.Record(audit.Tag, tag, id, err)
+	return err
+}
+
+// CheckCache finds an image committed with the cache key on top of the
+// current image in the store, and makes it the current image if there is one.
+func (s *StoreImage) CheckCache(cacheKey string) (bool, error) {
+	if !s.imageConfig.Globals.Cache {
+		return false, nil
+	}
+
+	id, ok, err := s.store.CachedImage(s.imageConfig.Config.Image, cacheKey)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	img, err := s.store.readImage(id)
+	if err != nil {
+		return false, err
+	}
+
+	s.imageConfig.Globals.Logger.CacheHit(id)
+	s.imageConfig.Config.FromDocker(img.Config)
+	s.imageConfig.Config.Image = id
+	s.imageConfig.Config.BuiltBy = config.BuiltBy{Image: id, Key: cacheKey}
+	return true, s.store.AddImage(id)
+}
+
+// ReuseCache finds nothing: there are no cache images in the store.
+func (s *StoreImage) ReuseCache(string) (bool, error) {
+	return false, nil
+}
+
+// ImageID returns the image identifier of the most recent layer.
+func (s *StoreImage) ImageID() string {
+	return s.imageConfig.Config.Image
+}
+
+// Save saves the image to the file, as docker save does, or as an OCI image
+// layout in a tarball.
+func (s *StoreImage) Save(filename, kind, tag string) error {
+	rel, err := savePath(filename)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "", "docker":
+		f, err := os.Create(rel)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return s.dockerSave(f, tag)
+	case "oci":
+		tmpdir, err := ioutil.TempDir("", "image-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpdir)
+
+		if tag == "" {
+			tag = layoutTag
+		}
+
+		if err := s.SaveLayout(tmpdir + ":" + tag); err != nil {
+			return err
+		}
+
+		return saveLayoutFile(s.imageConfig.Globals, tmpdir, filename)
+	default:
+		return fmt.Errorf("image kind %q is not valid", kind)
+	}
+}
+
+// dockerSave writes the image as docker save does, tagged with the tag if it
+// is given.
+func (s *StoreImage) dockerSave(w io.Writer, tag string) error {
+	id := s.imageConfig.Config.Image
+
+	fn, err := s.store.path("images", id)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	files, err := s.store.LayerFiles(id)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	layers := []string{}
+	for _, file := range files {
+		name := filepath.Base(file) + "/layer.tar"
+		if err := writeTarFile(tw, name, file); err != nil {
+			return err
+		}
+		layers = append(layers, name)
+	}
+
+	configFile := strings.TrimPrefix(id, "sha256:") + ".json"
+	if err := writeTarContent(tw, configFile, content); err != nil {
+		return err
+	}
+
+	manifest := []map[string]interface{}{{"Config": configFile, "Layers": layers}}
+	if tag != "" {
+		manifest[0]["RepoTags"] = []string{tag}
+	}
+
+	content, err = json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := writeTarContent(tw, "manifest.json", content); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func writeTarContent(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(content)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: fi.Size(), Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// SaveLayout writes the current image to the OCI image layout directory in
+// reference, which is dir or dir:tag; the tag is latest if it is not given.
+// The directory is created if it does not exist, and other images in it are
+// kept. The layers are compressed with the compression of the build, and
+// encrypted for its recipients if it has any.
+func (s *StoreImage) SaveLayout(reference string) error {
+	dir, tag := reference, layoutTag
+	if i := strings.LastIndex(reference, ":"); i >= 0 {
+		dir, tag = reference[:i], reference[i+1:]
+	}
+
+	if err := s.writeLayout(dir, tag); err != nil {
+		return err
+	}
+
+	if compression := s.imageConfig.Globals.Compression; compression == bt.Zstd || compression == bt.Estargz {
+		if err := recompressLayout(dir, tag, compression); err != nil {
+			return err
+		}
+	}
+
+	if len(s.imageConfig.Globals.EncryptRecipients) > 0 {
+		recipients, err := ocicrypt.LoadRecipients(s.imageConfig.Globals.EncryptRecipients)
+		if err != nil {
+			return err
+		}
+
+		return EncryptLayout(dir, tag, recipients)
+	}
+
+	return nil
+}
+
+// storeDescriptor is a descriptor of a blob of an OCI image layout.
+type storeDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// writeLayout writes the current image to the layout, tagged with tag, with
+// its layers compressed with gzip.
+func (s *StoreImage) writeLayout(dir, tag string) error {
+	if err := makeLayout(dir); err != nil {
+		return err
+	}
+
+	id := s.imageConfig.Config.Image
+
+	fn, err := s.store.path("images", id)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(layoutBlob(dir, id), content); err != nil {
+		return err
+	}
+
+	files, err := s.store.LayerFiles(id)
+	if err != nil {
+		return err
+	}
+
+	manifest := struct {
+		SchemaVersion int               `json:"schemaVersion"`
+		Config        storeDescriptor   `json:"config"`
+		Layers        []storeDescriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		Config:        storeDescriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: id, Size: int64(len(content))},
+		Layers:        []storeDescriptor{},
+	}
+
+	for _, file := range files {
+		desc, err := writeLayoutLayer(dir, file, s.imageConfig.Globals.GzipWorkers)
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	content, err = json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	dgst := digest.FromBytes(content).String()
+	if err := writeFile(layoutBlob(dir, dgst), content); err != nil {
+		return err
+	}
+
+	content, err = json.Marshal(storeDescriptor{MediaType: registry.MediaTypeOCIManifest, Digest: dgst, Size: int64(len(content))})
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, "refs", tag), content)
+}
+
+// writeLayoutLayer writes the layer tarball to the layout compressed with
+// gzip by the workers, and returns its descriptor.
+func writeLayoutLayer(dir, file string, workers int) (storeDescriptor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return storeDescriptor{}, err
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "blobs"), "box-layer")
+	if err != nil {
+		return storeDescriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	cw, err := bt.NewDigester(tmp, bt.Gzip, workers)
+	if err != nil {
+		return storeDescriptor{}, err
+	}
+
+	if _, err := io.Copy(cw, f); err != nil {
+		return storeDescriptor{}, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return storeDescriptor{}, err
+	}
+
+	desc := storeDescriptor{MediaType: registry.MediaTypeOCILayer, Digest: cw.Digest(), Size: cw.Size()}
+	return desc, os.Rename(tmp.Name(), layoutBlob(dir, desc.Digest))
+}
+
+// Push pushes the image to a registry under the name given. Its layers are
+// encrypted for the recipients of the build if it has any. Images can't be
+// signed with a GPG key as they are pushed.
+func (s *StoreImage) Push(name string) error {
+	id := s.imageConfig.Config.Image
+
+	if err := registry.CheckPush(s.imageConfig.Globals.Policy, name); err != nil {
+		audit.Record(audit.Push, name, id, err)
+		return err
+	}
+
+	if s.imageConfig.Globals.SignBy != "" {
+		return needsDocker("signing with a GPG key")
+	}
+
+	dst, err := registry.ParseReference(name)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "box-push-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := s.SaveLayout(dir + ":" + layoutTag); err != nil {
+		return err
+	}
+
+	_, err = pushLayout(s.imageConfig.Globals.Context, registry.NewClient(s.imageConfig.Globals.Policy), dir, layoutTag, dst, s.imageConfig.Globals.Logger)
+	audit.Record(audit.Push, name, id, err)
+	return err
+}
+
+// PushArtifact pushes the current image to a registry under the name given,
+// as it is in the store, and returns the digest of its manifest. It is an
+// image steps run from, not one the build made: its layers are not
+// encrypted, and the push is not audited.
+func (s *StoreImage) PushArtifact(name string) (string, error) {
+	dst, err := registry.ParseReference(name)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "box-push-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := s.writeLayout(dir, layoutTag); err != nil {
+		return "", err
+	}
+
+	return pushLayout(s.imageConfig.Globals.Context, registry.NewClient(s.imageConfig.Globals.Policy), dir, layoutTag, dst, s.imageConfig.Globals.Logger)
+}
+
+// FindLeaks returns the secrets found in the layers the build added to the
+// image it started from, and the known values found in them.
+func (s *StoreImage) FindLeaks(known []string) ([]leak.Finding, error) {
+	files, err := s.store.LayerFiles(s.imageConfig.Config.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := s.store.BaseLayers()
+	if skip > len(files) {
+		skip = 0
+	}
+
+	return leak.Scan(files, skip, known)
+}
@@ -0,0 +1,138 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/logger"
+	btypes "github.com/box-builder/box/types"
+)
+
+type storeSuite struct {
+	home string
+}
+
+var _ = Suite(&storeSuite{})
+
+func (ss *storeSuite) SetUpTest(c *C) {
+	ss.home = os.Getenv("BOX_HOME")
+	os.Setenv("BOX_HOME", c.MkDir())
+}
+
+func (ss *storeSuite) TearDownTest(c *C) {
+	os.Setenv("BOX_HOME", ss.home)
+}
+
+func storeLayer(c *C, name, content string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}), IsNil)
+	_, err := tw.Write([]byte(content))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	return buf
+}
+
+func (ss *storeSuite) TestCommit(c *C) {
+	s, err := NewStore(&btypes.Global{Context: context.Background(), Logger: logger.New("", false)})
+	c.Assert(err, IsNil)
+
+	cfg := config.NewConfig()
+	cfg.Env = []string{"FOO=bar"}
+
+	base, size, err := s.Commit(cfg, storeLayer(c, "foo", "foo"), "first")
+	c.Assert(err, IsNil)
+	c.Assert(size > 0, Equals, true)
+
+	files, err := s.LayerFiles(base)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+
+	id, ok, err := s.CachedImage("", "first")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, base)
+
+	_, ok, err = s.CachedImage("", "second")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	cfg.Image = base
+	image, _, err := s.Commit(cfg, storeLayer(c, "bar", "bar"), "second")
+	c.Assert(err, IsNil)
+	c.Assert(image, Not(Equals), base)
+
+	files, err = s.LayerFiles(image)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+
+	// the cache key is found on top of the image it was committed on.
+	id, ok, err = s.CachedImage(base, "second")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, image)
+
+	_, ok, err = s.CachedImage("", "second")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	img, err := s.readImage(image)
+	c.Assert(err, IsNil)
+	c.Assert(img.Config.Env, DeepEquals, []string{"FOO=bar"})
+}
+
+func (ss *storeSuite) TestLookup(c *C) {
+	s, err := NewStore(&btypes.Global{Context: context.Background(), Logger: logger.New("", false)})
+	c.Assert(err, IsNil)
+
+	id, _, err := s.Commit(config.NewConfig(), storeLayer(c, "foo", "foo"), "")
+	c.Assert(err, IsNil)
+
+	found, err := s.Lookup(id)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, id)
+
+	_, err = s.Lookup("myimage")
+	c.Assert(err, NotNil)
+
+	c.Assert(s.tag("myimage", id), IsNil)
+
+	for _, name := range []string{"myimage", "myimage:latest", "docker.io/library/myimage:latest"} {
+		found, err = s.Lookup(name)
+		c.Assert(err, IsNil, Commentf("%s", name))
+		c.Assert(found, Equals, id)
+	}
+
+	_, err = s.Lookup("sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	c.Assert(err, NotNil)
+}
+
+func (ss *storeSuite) TestFetchTarSignaturePolicy(c *C) {
+	dir := c.MkDir()
+
+	tarball := filepath.Join(dir, "rootfs.tar")
+	c.Assert(ioutil.WriteFile(tarball, storeLayer(c, "foo", "foo").Bytes(), 0644), IsNil)
+
+	for policy, allowed := range map[string]bool{
+		`{"default": [{"type": "insecureAcceptAnything"}]}`: true,
+		`{"default": [{"type": "reject"}]}`:                 false,
+		`{"default": [{"type": "insecureAcceptAnything"}], "transports": {"docker": {"docker.io": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "/etc/pki/key.gpg"}]}}}`: false,
+	} {
+		policyFile := filepath.Join(dir, "policy.json")
+		c.Assert(ioutil.WriteFile(policyFile, []byte(policy), 0644), IsNil)
+
+		s, err := NewStore(&btypes.Global{Context: context.Background(), Logger: logger.New("", false), SignaturePolicy: policyFile})
+		c.Assert(err, IsNil)
+
+		_, err = s.FetchTar(config.NewConfig(), tarball)
+		c.Assert(err == nil, Equals, allowed, Commentf("%s: %v", policy, err))
+	}
+}
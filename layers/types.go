@@ -1,18 +1,21 @@
 package layers
 
 import (
-	"io"
-
 	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/leak"
 	"github.com/box-builder/box/types"
 )
 
 // Image needs a description
 type Image interface {
-	// Flatten copies a tarred up series of files (passed in through the
-	// io.Reader handle) to the image where they are untarred. The first argument
-	// is the parent image to use.
-	Flatten(string, int64, io.Reader) error
+	// Flatten makes an image of the layer, read with image.ReadLayer, with the
+	// configuration of the build.
+	Flatten(*image.Layer) error
+
+	// Squash merges the layers added on top of the named image into one,
+	// without the files matching the exclude patterns given.
+	Squash(string, []string) error
 
 	// Tag the current layer. Takes a tag name as argument.
 	Tag(string) error
@@ -20,11 +23,27 @@ type Image interface {
 	// CheckCache consults the cache to see if there are any items which fit it.
 	CheckCache(string) (bool, error)
 
+	// ReuseCache looks a step up in the history of the cache images. If it is
+	// found, the step's layers are re-used in place of committing it.
+	ReuseCache(string) (bool, error)
+
 	// ImageID returns the image identifier of the most recent layer.
 	ImageID() string
 
 	// Save saves an image to the provided filename.
 	Save(string, string, string) error
+
+	// SaveLayout writes the image to an OCI image layout directory, given as
+	// dir or dir:tag.
+	SaveLayout(string) error
+
+	// Push pushes the image to a registry under the name given, signed if a
+	// key to sign with is set.
+	Push(string) error
+
+	// FindLeaks returns the secrets found in the layers the build added to
+	// the image, and the values given which are found in them.
+	FindLeaks([]string) ([]leak.Finding, error)
 }
 
 // Layers needs a description
@@ -32,9 +51,24 @@ type Layers interface {
 	// Pull an image. Takes a name and returns an image ID+error.
 	Fetch(*config.Config, string) (string, error)
 
+	// Materialize pulls the image the build started from if it was read from
+	// its registry only, and the name or ID given is it.
+	Materialize(string) error
+
+	// FetchArchive loads an image from an image file, selected by tag if the
+	// file holds several. Returns its ID+error.
+	FetchArchive(*config.Config, string, string) (string, error)
+
+	// FetchTar imports a filesystem tarball as an image. Returns its ID+error.
+	FetchTar(*config.Config, string) (string, error)
+
 	// SetLayers sets the layers.
 	SetLayers([]string)
 
+	// BaseLayers returns the number of layers of the image the build started
+	// from.
+	BaseLayers() int
+
 	// AddImage adds layers to the layer list from a provided image, in order of
 	// appearance. Any existing layers are skipped over, removing them from the list.
 	AddImage(string) error
@@ -51,6 +85,10 @@ type Layers interface {
 
 	// Look up an image identifier.
 	Lookup(string) (string, error)
+
+	// ExportCache exports the layers built or found in the cache to a registry
+	// repository, tagged with their cache keys, or to a cache backend.
+	ExportCache(string) error
 }
 
 // ImageConfig sets the properties used to construct an image
@@ -0,0 +1,223 @@
+// Package leak finds secrets which leaked into the layers of an image: private
+// keys, tokens of the formats of known services, high-entropy values given to
+// keys such as password or token, and the values of the build's own secrets.
+package leak
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxFileSize is the size of the largest file read; larger files are skipped.
+const maxFileSize = 16 << 20
+
+// maxLineSize is the length of the longest line read; files with longer lines
+// are skipped, as they are not text.
+const maxLineSize = 1 << 20
+
+// minEntropy is the least Shannon entropy, in bits a character, of the values
+// of keys such as password for them to be taken for secrets rather than
+// placeholders.
+const minEntropy = 4.0
+
+// minKnownLength is the length below which known values are not looked for:
+// shorter ones are found by chance.
+const minKnownLength = 8
+
+// Rules which findings are made by.
+const (
+	PrivateKey  = "private-key"
+	AWSKey      = "aws-access-key"
+	GitHubToken = "github-token"
+	GitLabToken = "gitlab-token"
+	SlackToken  = "slack-token"
+	GoogleKey   = "google-api-key"
+	StripeKey   = "stripe-key"
+	NpmToken    = "npm-token"
+	HighEntropy = "high-entropy"
+	BuildSecret = "build-secret"
+)
+
+// Finding is a secret found in a file of a layer.
+type Finding struct {
+	Layer int    `json:"layer"` // the layer the file is in, counting from 0
+	Path  string `json:"path"`
+	Line  int    `json:"line"`
+	Rule  string `json:"rule"`
+	Match string `json:"match"` // what was found, with all but its start redacted
+}
+
+var formats = []struct {
+	rule    string
+	pattern *regexp.Regexp
+}{
+	{PrivateKey, regexp.MustCompile(`-----BEGIN ((RSA|EC|DSA|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{AWSKey, regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{GitHubToken, regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{GitLabToken, regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20}\b`)},
+	{SlackToken, regexp.MustCompile(`\bxox[baprs]-[A-Za-z0-9-]{10,}`)},
+	{GoogleKey, regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{StripeKey, regexp.MustCompile(`\b[sr]k_live_[0-9a-zA-Z]{24,}\b`)},
+	{NpmToken, regexp.MustCompile(`\bnpm_[A-Za-z0-9]{36}\b`)},
+}
+
+// assignment is a value given to a key whose name says it is secret.
+var assignment = regexp.MustCompile(`(?i)(?:secret|token|passw(?:or)?d|api_?key|access_?key|private_?key|credentials?)["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_.~-]{20,})`)
+
+// entropy returns the Shannon entropy of the string, in bits a character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	var e float64
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+// redact returns the start of what was found, enough to recognize it, and
+// hides the rest.
+func redact(match string) string {
+	if len(match) <= 8 {
+		return "***"
+	}
+
+	return match[:4] + "***"
+}
+
+// Scan returns the secrets found in the files of the layer tarballs, given
+// oldest first, skipping the first skip layers, such as those of the image
+// the build started from. known are values which are secret wherever they are
+// found, such as those given to the build with the secret verb.
+func Scan(layers []string, skip int, known []string) ([]Finding, error) {
+	findings := []Finding{}
+
+	for i := skip; i < len(layers); i++ {
+		f, err := os.Open(layers[i])
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := ScanLayer(f, i, known)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, found...)
+	}
+
+	return findings, nil
+}
+
+// ScanLayer returns the secrets found in the files of the layer tarball, which
+// is the layer'th of its image.
+func ScanLayer(r io.Reader, layer int, known []string) ([]Finding, error) {
+	findings := []Finding{}
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		if header.Size > maxFileSize || strings.HasPrefix(path.Base(header.Name), ".wh.") {
+			continue
+		}
+
+		found, err := scanFile(tr, layer, "/"+strings.TrimPrefix(path.Clean(header.Name), "/"), known)
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, found...)
+	}
+
+	return findings, nil
+}
+
+// scanFile returns the secrets found in the file, unless it is not text.
+func scanFile(r io.Reader, layer int, name string, known []string) ([]Finding, error) {
+	br := bufio.NewReader(r)
+
+	// files with NULs at their start are binaries, not text.
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	findings := []Finding{}
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64<<10), maxLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		findings = append(findings, scanLine(scanner.Text(), layer, name, line, known)...)
+	}
+
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, err
+	}
+
+	return findings, nil
+}
+
+// scanLine returns the secrets found in the line.
+func scanLine(text string, layer int, name string, line int, known []string) []Finding {
+	findings := []Finding{}
+	finding := func(rule, match string) Finding {
+		return Finding{Layer: layer, Path: name, Line: line, Rule: rule, Match: match}
+	}
+
+	for _, value := range known {
+		if len(value) >= minKnownLength && strings.Contains(text, value) {
+			findings = append(findings, finding(BuildSecret, "***"))
+		}
+	}
+
+	for _, format := range formats {
+		for _, match := range format.pattern.FindAllString(text, -1) {
+			if format.rule == PrivateKey {
+				findings = append(findings, finding(format.rule, match))
+			} else {
+				findings = append(findings, finding(format.rule, redact(match)))
+			}
+		}
+	}
+
+	// values of the known formats are not found again by their entropy.
+	if len(findings) > 0 {
+		return findings
+	}
+
+	for _, match := range assignment.FindAllStringSubmatch(text, -1) {
+		if entropy(match[1]) >= minEntropy {
+			findings = append(findings, finding(HighEntropy, redact(match[1])))
+		}
+	}
+
+	return findings
+}
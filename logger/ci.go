@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The CI systems whose markers the output may have.
+const (
+	CIGitHub = "github"
+	CIGitLab = "gitlab"
+)
+
+// CI is the CI system whose markers are written around each build step, so
+// they fold in its logs, and around failures, so they are annotated. No
+// markers are written if it is empty.
+var CI string
+
+var (
+	group      string // the name of the section open, if any
+	groups     int
+	groupMutex sync.Mutex
+)
+
+// ParseCI parses the CI system of --ci-output: github, gitlab, none, or
+// auto, which finds the system box runs in from its environment.
+func ParseCI(ci string) (string, error) {
+	switch ci {
+	case "", "none":
+		return "", nil
+	case CIGitHub, CIGitLab:
+		return ci, nil
+	case "auto":
+		switch {
+		case os.Getenv("GITHUB_ACTIONS") == "true":
+			return CIGitHub, nil
+		case os.Getenv("GITLAB_CI") != "":
+			return CIGitLab, nil
+		}
+
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid CI output %q: must be github, gitlab, auto or none", ci)
+	}
+}
+
+// beginGroup ends the group open, and begins the group of a step.
+func (l *Logger) beginGroup(title string) {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	l.endGroupLocked()
+
+	groups++
+
+	switch CI {
+	case CIGitHub:
+		group = title
+		fmt.Fprintf(l.output, "::group::%s\n", escapeGitHub(title, false))
+	case CIGitLab:
+		group = fmt.Sprintf("box_step_%d", groups)
+		fmt.Fprintf(l.output, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n", time.Now().Unix(), group, strings.Replace(title, "\n", " ", -1))
+	}
+}
+
+// endGroup ends the group open, if any.
+func (l *Logger) endGroup() {
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+
+	l.endGroupLocked()
+}
+
+func (l *Logger) endGroupLocked() {
+	if group == "" {
+		return
+	}
+
+	switch CI {
+	case CIGitHub:
+		fmt.Fprintln(l.output, "::endgroup::")
+	case CIGitLab:
+		fmt.Fprintf(l.output, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), group)
+	}
+
+	group = ""
+}
+
+// annotate annotates the error, outside of any group, for the CI systems
+// which annotate their logs.
+func (l *Logger) annotate(err interface{}) {
+	l.endGroup()
+
+	if CI == CIGitHub {
+		fmt.Fprintf(l.output, "::error title=%s::%s\n", escapeGitHub("box: "+l.plan, true), escapeGitHub(fmt.Sprint(err), false))
+	}
+}
+
+// escapeGitHub escapes the message, or the property, of a workflow command
+// of GitHub Actions.
+func escapeGitHub(s string, property bool) string {
+	s = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+	if property {
+		s = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(s)
+	}
+
+	return s
+}
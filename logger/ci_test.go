@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type ciSuite struct{}
+
+var _ = Suite(&ciSuite{})
+
+func (cs *ciSuite) TestParseCI(c *C) {
+	os.Unsetenv("GITHUB_ACTIONS")
+	os.Setenv("GITLAB_CI", "true")
+	defer os.Unsetenv("GITLAB_CI")
+
+	for in, out := range map[string]string{"": "", "none": "", "github": CIGitHub, "gitlab": CIGitLab, "auto": CIGitLab} {
+		ci, err := ParseCI(in)
+		c.Assert(err, IsNil)
+		c.Assert(ci, Equals, out)
+	}
+
+	_, err := ParseCI("jenkins")
+	c.Assert(err, NotNil)
+}
+
+func (cs *ciSuite) TestGroups(c *C) {
+	defer func() { CI = "" }()
+
+	for ci, expected := range map[string][]string{
+		CIGitHub: {
+			"::group::run make",
+			"::endgroup::",
+			"::group::run make test",
+			"::endgroup::",
+			`::error title=box%3A plan.rb::exit status 2%0Amake: \*\*\* \[test\] Error 2`,
+		},
+		CIGitLab: {
+			"\x1b\\[0Ksection_start:.*:box_step_.*\\[collapsed=true\\]\r\x1b\\[0Krun make",
+			"\x1b\\[0Ksection_end:.*:box_step_.*\r\x1b\\[0K",
+			"\x1b\\[0Ksection_start:.*:box_step_.*\\[collapsed=true\\]\r\x1b\\[0Krun make test",
+			"\x1b\\[0Ksection_end:.*:box_step_.*\r\x1b\\[0K",
+		},
+	} {
+		CI = ci
+
+		l := New("plan.rb", true)
+		l.Record()
+		l.BuildStep("run", "make")
+		l.BuildStep("run", "make test")
+		l.Error(errors.New("exit status 2\nmake: *** [test] Error 2"))
+
+		markers := []string{}
+		for _, line := range strings.Split(l.Output().(interface{ String() string }).String(), "\n") {
+			if strings.HasPrefix(line, "::") || strings.HasPrefix(line, "\x1b[0K") {
+				markers = append(markers, line)
+			}
+		}
+
+		c.Assert(markers, HasLen, len(expected), Commentf("%q", markers))
+		for i, marker := range expected {
+			c.Assert(markers[i], Matches, marker)
+		}
+	}
+}
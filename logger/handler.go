@@ -0,0 +1,223 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a record.
+type Level string
+
+// The levels of records.
+const (
+	LevelInfo  Level = "info"
+	LevelError Level = "error"
+)
+
+// Record is what a logger logs, for handlers: a message, such as Execute for
+// a build step, and its fields, such as the step and its command. Each line
+// of output, such as that of run steps, is a record of its own, with the
+// field stream set to output.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Plan    string
+	Message string
+	Fields  []Field
+}
+
+// Field is a field of a record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Handler handles the records of loggers made with NewHandler, for programs
+// which route them into their own logging. Records are redacted before they
+// are handled. Handlers may be called by several builds at once.
+type Handler interface {
+	Handle(Record)
+}
+
+// ParseFormat returns the handler of the format of --log-format: text, the
+// default, logs to the terminal and has no handler; logfmt logs key=value
+// pairs, and json a JSON object, a line each, to w.
+func ParseFormat(format string, w io.Writer) (Handler, error) {
+	switch format {
+	case "", "text":
+		return nil, nil
+	case "logfmt":
+		return NewTextHandler(w), nil
+	case "json":
+		return NewJSONHandler(w), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text, logfmt or json", format)
+	}
+}
+
+// DefaultHandler, if set, is the handler loggers made with New log to, as
+// --log-format sets it.
+var DefaultHandler Handler
+
+// NewHandler constructs a new per-plan logger which hands what it logs to h
+// as records. What it logs is redacted with a redactor of its own, as with
+// NewWriter.
+func NewHandler(plan string, h Handler) *Logger {
+	return newHandler(plan, h, NewRedactor())
+}
+
+func newHandler(plan string, h Handler, redactor *Redactor) *Logger {
+	l := &Logger{plan: plan, handler: h, redactor: redactor}
+	l.output = &recordWriter{logger: l}
+	return l
+}
+
+// log hands a record to the handler; kv are the keys and values of its
+// fields.
+func (l *Logger) log(level Level, msg string, kv ...interface{}) {
+	r := Record{Time: time.Now().UTC(), Level: level, Plan: l.plan, Message: l.Redact(msg)}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := kv[i+1]
+		if s, ok := value.(string); ok {
+			value = l.Redact(s)
+		}
+
+		r.Fields = append(r.Fields, Field{Key: fmt.Sprint(kv[i]), Value: value})
+	}
+
+	l.handler.Handle(r)
+}
+
+// recordWriter is the output of loggers with handlers: each line written to
+// it is a record.
+type recordWriter struct {
+	logger *Logger
+	buf    []byte
+	mutex  sync.Mutex
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		line := strings.TrimRight(colorRegexp.ReplaceAllString(string(w.buf[:i]), ""), "\r")
+		w.buf = w.buf[i+1:]
+
+		if strings.TrimSpace(line) != "" {
+			w.logger.log(LevelInfo, line, "stream", "output")
+		}
+	}
+}
+
+// message returns what is printed, as a message: without its colors and the
+// marks of Good and Notice.
+func message(str string) string {
+	str = strings.TrimSpace(colorRegexp.ReplaceAllString(str, ""))
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(str, "+++ "), "--- "))
+}
+
+// textHandler writes records as key=value pairs.
+type textHandler struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewTextHandler returns a handler which writes each record to w as a line of
+// key=value pairs, as logfmt does: time, level, plan, msg and its fields.
+func NewTextHandler(w io.Writer) Handler {
+	return &textHandler{w: w}
+}
+
+func (h *textHandler) Handle(r Record) {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "time=%s level=%s plan=%s msg=%s", r.Time.Format(time.RFC3339Nano), r.Level, logfmtValue(r.Plan), logfmtValue(r.Message))
+	for _, f := range r.Fields {
+		fmt.Fprintf(buf, " %s=%s", f.Key, logfmtValue(fmt.Sprint(f.Value)))
+	}
+	buf.WriteByte('\n')
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.w.Write(buf.Bytes())
+}
+
+// logfmtValue quotes the value if it is empty, or has spaces, quotes or
+// equal signs.
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+// jsonHandler writes records as JSON objects.
+type jsonHandler struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewJSONHandler returns a handler which writes each record to w as a line of
+// JSON: an object of time, level, plan, msg and its fields, in that order.
+func NewJSONHandler(w io.Writer) Handler {
+	return &jsonHandler{w: w}
+}
+
+func (h *jsonHandler) Handle(r Record) {
+	fields := append([]Field{
+		{"time", r.Time.Format(time.RFC3339Nano)},
+		{"level", r.Level},
+		{"plan", r.Plan},
+		{"msg", r.Message},
+	}, r.Fields...)
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		writeJSON(buf, f.Key)
+		buf.WriteByte(':')
+		if !writeJSON(buf, f.Value) {
+			writeJSON(buf, fmt.Sprint(f.Value))
+		}
+	}
+	buf.WriteString("}\n")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.w.Write(buf.Bytes())
+}
+
+// writeJSON writes the value as JSON, leaving characters such as & as they
+// are, as output has them; it returns false if it can't be.
+func writeJSON(buf *bytes.Buffer, v interface{}) bool {
+	content := &bytes.Buffer{}
+
+	enc := json.NewEncoder(content)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return false
+	}
+
+	buf.Write(bytes.TrimRight(content.Bytes(), "\n"))
+	return true
+}
@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type handlerSuite struct{}
+
+var _ = Suite(&handlerSuite{})
+
+// records keeps the records handed to it.
+type records []Record
+
+func (r *records) Handle(record Record) {
+	*r = append(*r, record)
+}
+
+func (hs *handlerSuite) TestHandler(c *C) {
+	handled := &records{}
+	l := NewHandler("box.rb", handled)
+	l.AddSecret("hunter2")
+
+	l.BuildStep("run", "echo hunter2")
+	fmt.Fprint(l.Output(), "\x1b[32mhello\r\n\nwor")
+	fmt.Fprint(l.Output(), "ld\n")
+	l.Print(l.Notice("Cache report:\n"))
+	l.Tag("myapp:1.0")
+	l.Error(fmt.Errorf("exit status 1"))
+
+	// the time of each record is left out.
+	plain := []Record{}
+	for _, r := range *handled {
+		c.Assert(r.Plan, Equals, "box.rb")
+		c.Assert(r.Time.IsZero(), Equals, false)
+		plain = append(plain, Record{Level: r.Level, Message: r.Message, Fields: r.Fields})
+	}
+
+	c.Assert(plain, DeepEquals, []Record{
+		{Level: LevelInfo, Message: "Execute", Fields: []Field{{"step", "run"}, {"command", "echo ***"}}},
+		{Level: LevelInfo, Message: "hello", Fields: []Field{{"stream", "output"}}},
+		{Level: LevelInfo, Message: "world", Fields: []Field{{"stream", "output"}}},
+		{Level: LevelInfo, Message: "Cache report:"},
+		{Level: LevelInfo, Message: "Tagged", Fields: []Field{{"tag", "myapp:1.0"}}},
+		{Level: LevelError, Message: "exit status 1"},
+	})
+}
+
+func (hs *handlerSuite) TestFormats(c *C) {
+	_, err := ParseFormat("xml", nil)
+	c.Assert(err, ErrorMatches, `invalid log format "xml".*`)
+
+	h, err := ParseFormat("text", nil)
+	c.Assert(err, IsNil)
+	c.Assert(h, IsNil)
+
+	buf := &bytes.Buffer{}
+	h, err = ParseFormat("logfmt", buf)
+	c.Assert(err, IsNil)
+
+	l := NewHandler("box.rb", h)
+	l.BuildStep("run", `make && echo "done"`)
+	l.CacheHit("sha256:5c4b")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Matches, `time=\S+ level=info plan=box.rb msg=Execute step=run command="make && echo \\"done\\""`)
+	c.Assert(lines[1], Matches, `time=\S+ level=info plan=box.rb msg="Cache hit" image=sha256:5c4b`)
+
+	buf.Reset()
+	h, err = ParseFormat("json", buf)
+	c.Assert(err, IsNil)
+
+	l = NewHandler("box.rb", h)
+	l.BuildStep("run", "make && make install")
+	c.Assert(buf.String(), Matches, `\{"time":"[^"]+","level":"info","plan":"box.rb","msg":"Execute","step":"run","command":"make && make install"\}\n`)
+
+	record := map[string]string{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &record), IsNil)
+	c.Assert(record["command"], Equals, "make && make install")
+}
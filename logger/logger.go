@@ -16,30 +16,78 @@ type Logger struct {
 	output io.Writer
 	// if recording, will fill this buffer with logger output instead of printing to stdio.
 	// if not yet recording, this will be nil.
-	buffer *bytes.Buffer
-	plan   string
-	notrim bool
+	buffer  *bytes.Buffer
+	plan    string
+	notrim  bool
+	handler Handler // if set, what is logged is handed to it instead of printed
+	// redacts what is logged; the process's for loggers made with New.
+	redactor *Redactor
 }
 
-// New contypes a new per-plan logger.
+// New contypes a new per-plan logger, which logs to DefaultHandler if it is
+// set. What it logs is redacted with the process's redactor, see Redact.
 func New(plan string, notrim bool) *Logger {
-	return &Logger{plan: plan, output: os.Stdout, notrim: notrim}
+	if DefaultHandler != nil {
+		return newHandler(plan, DefaultHandler, defaultRedactor)
+	}
+
+	return newWriter(plan, os.Stdout, notrim, defaultRedactor)
+}
+
+// NewWriter constructs a new per-plan logger which logs to w instead of
+// stdout. What it logs is redacted with a redactor of its own, so the values
+// added with AddSecret are not, but those added with its AddSecret method
+// are.
+func NewWriter(plan string, w io.Writer, notrim bool) *Logger {
+	return newWriter(plan, w, notrim, NewRedactor())
+}
+
+func newWriter(plan string, w io.Writer, notrim bool, redactor *Redactor) *Logger {
+	return &Logger{plan: plan, output: redactor.Writer(w), notrim: notrim, redactor: redactor}
+}
+
+// AddSecret adds a value which is redacted from what the logger logs, and
+// from the output written through its RedactWriter.
+func (l *Logger) AddSecret(value string) {
+	l.redactor.AddSecret(value)
+}
+
+// Secrets returns the values redacted from what the logger logs.
+func (l *Logger) Secrets() []string {
+	return l.redactor.Secrets()
+}
+
+// Redact returns the string redacted as what the logger logs is.
+func (l *Logger) Redact(str string) string {
+	return l.redactor.Redact(str)
+}
+
+// RedactWriter returns a writer which redacts what is written to it, as what
+// the logger logs is, before writing it to out.
+func (l *Logger) RedactWriter(out io.Writer) io.Writer {
+	return l.redactor.Writer(out)
 }
 
 // Record starts recording to the output buffer, which will be returned by the
-// Output() method.
+// Output() method. What is recorded is not redacted.
 func (l *Logger) Record() {
 	l.buffer = new(bytes.Buffer)
 	l.output, color.Output = l.buffer, l.buffer
 }
 
-// Output returns the output buffer.
+// Output returns the output buffer. Unless recording, it redacts what is
+// written to it.
 func (l *Logger) Output() io.Writer {
 	return l.output
 }
 
 // Print is a bare-bones print statement.
 func (l *Logger) Print(str string) {
+	if l.handler != nil {
+		l.log(LevelInfo, message(str))
+		return
+	}
+
 	fmt.Fprint(l.output, l.Plan(), str)
 }
 
@@ -61,8 +109,16 @@ func (l *Logger) Notice(str string) string {
 	return color.New(color.FgYellow).SprintFunc()(fmt.Sprintf("--- %s", str))
 }
 
-// Error prints an error to the terminal all fancy-like.
+// Error prints an error to the terminal all fancy-like, and annotates it for
+// the CI system, if any.
 func (l *Logger) Error(err interface{}) {
+	if l.handler != nil {
+		l.log(LevelError, fmt.Sprint(err))
+		return
+	}
+
+	l.annotate(err)
+
 	line := l.Plan()
 
 	line += color.New(color.Bold, color.FgRed).SprintFunc()("!!! ")
@@ -71,8 +127,16 @@ func (l *Logger) Error(err interface{}) {
 	color.Unset()
 }
 
-// BuildStep logs a build step.
+// BuildStep logs a build step, and begins its group for the CI system, if
+// any.
 func (l *Logger) BuildStep(step, command string) {
+	if l.handler != nil {
+		l.log(LevelInfo, "Execute", "step", step, "command", command)
+		return
+	}
+
+	l.beginGroup(strings.TrimSpace(step + " " + command))
+
 	line := l.Plan()
 	line += l.Good("")
 
@@ -83,6 +147,11 @@ func (l *Logger) BuildStep(step, command string) {
 
 // CacheHit logs a cache hit.
 func (l *Logger) CacheHit(imageID string) {
+	if l.handler != nil {
+		l.log(LevelInfo, "Cache hit", "image", imageID)
+		return
+	}
+
 	line := l.Plan()
 	line += l.Good("")
 	line += color.New(color.FgWhite, color.Bold, color.BgRed).SprintFunc()("Cache hit:")
@@ -92,6 +161,11 @@ func (l *Logger) CacheHit(imageID string) {
 
 // CopyPath logs a copied path
 func (l *Logger) CopyPath(file1, file2 string) {
+	if l.handler != nil {
+		l.log(LevelInfo, "Copy", "from", file1, "to", file2)
+		return
+	}
+
 	line := l.Plan()
 	line += l.Notice("")
 	line += color.New(color.FgRed).SprintFunc()("COPY: ")
@@ -101,6 +175,11 @@ func (l *Logger) CopyPath(file1, file2 string) {
 
 // Tag logs a tag
 func (l *Logger) Tag(name string) {
+	if l.handler != nil {
+		l.log(LevelInfo, "Tagged", "tag", name)
+		return
+	}
+
 	line := l.Plan()
 	line += l.Good("")
 	line += color.New(color.FgYellow).SprintFunc()("Tagged:")
@@ -109,6 +188,11 @@ func (l *Logger) Tag(name string) {
 
 // EvalResponse logs the eval response
 func (l *Logger) EvalResponse(response string) {
+	if l.handler != nil {
+		l.log(LevelInfo, "Eval response", "response", response)
+		return
+	}
+
 	line := l.Plan()
 	line += l.Good("")
 	line += color.New(color.FgWhite, color.Bold).SprintFunc()("Eval Response:")
@@ -117,6 +201,13 @@ func (l *Logger) EvalResponse(response string) {
 
 // Finish logs the finish.
 func (l *Logger) Finish(response string) {
+	if l.handler != nil {
+		l.log(LevelInfo, "Finish", "result", response)
+		return
+	}
+
+	l.endGroup()
+
 	line := l.Plan()
 	line += l.Good("")
 	line += color.New(color.FgRed, color.Bold).SprintFunc()("Finish: ")
@@ -125,6 +216,10 @@ func (l *Logger) Finish(response string) {
 
 // BeginOutput demarcates an output section
 func (l *Logger) BeginOutput() {
+	if l.handler != nil {
+		return
+	}
+
 	line := l.Plan()
 	line += color.New(color.FgRed, color.Bold, color.BgWhite).SprintFunc()("------ BEGIN OUTPUT ------")
 	l.printLog(line)
@@ -132,6 +227,10 @@ func (l *Logger) BeginOutput() {
 
 // EndOutput ends an output section
 func (l *Logger) EndOutput() {
+	if l.handler != nil {
+		return
+	}
+
 	line := l.Plan()
 	line += color.New(color.FgRed, color.Bold, color.BgWhite).SprintFunc()("------- END OUTPUT -------")
 	l.printLog(line)
@@ -193,6 +292,10 @@ func trimColoredString(original string, cap int, dots bool) string {
 
 // Progress is a representation of a progress meter.
 func (l *Logger) Progress(prefix string, count float64) {
+	if l.handler != nil {
+		return
+	}
+
 	out := fmt.Sprint("\r")
 	wsz, _ := term.GetWinsize(0)
 
@@ -0,0 +1,193 @@
+package logger
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces what is redacted from the output.
+const Redacted = "***"
+
+// minSecretLength is the length below which values are not redacted: shorter
+// ones would mangle the output without hiding much.
+const minSecretLength = 4
+
+// Redactor redacts secret values and credentials from output, and keeps the
+// tail of what it redacted. Loggers made with New share the process's, which
+// AddSecret, Redact and Tail use; those made with NewWriter and NewHandler,
+// such as those of builds, each have their own.
+type Redactor struct {
+	secrets      map[string]bool
+	secretsMutex sync.RWMutex
+	tail         []byte
+	tailMutex    sync.Mutex
+}
+
+// NewRedactor returns a redactor without secrets.
+func NewRedactor() *Redactor {
+	return &Redactor{secrets: map[string]bool{}}
+}
+
+// defaultRedactor is the process's redactor.
+var defaultRedactor = NewRedactor()
+
+// redactions scrub credentials from the output whatever their values are:
+// Authorization headers, passwords in URLs and tokens in their queries.
+var redactions = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(?i)((?:proxy-)?authorization:\s*\[?(?:(?:basic|bearer|token)\s+)?)[^\s"',\]]+`), "${1}" + Redacted},
+	{regexp.MustCompile(`(?i)("(?:proxy-)?authorization":\s*"(?:(?:basic|bearer|token)\s+)?)[^"]+`), "${1}" + Redacted},
+	{regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:)[^/\s@]+@`), "${1}" + Redacted + "@"},
+	{regexp.MustCompile(`(?i)([?&](?:access_token|token|password|secret|sig|signature|x-amz-signature|x-amz-security-token)=)[^&\s"']+`), "${1}" + Redacted},
+}
+
+// AddSecret adds a value which is redacted from everything logged, such as
+// the value of a secret. Each line of a value of several lines is redacted as
+// well, as output is often written a line at a time. Values, and lines,
+// shorter than four characters are not.
+func (r *Redactor) AddSecret(value string) {
+	r.secretsMutex.Lock()
+	defer r.secretsMutex.Unlock()
+
+	for _, v := range append([]string{value}, strings.Split(value, "\n")...) {
+		if v = strings.TrimSpace(v); len(v) >= minSecretLength {
+			r.secrets[v] = true
+		}
+	}
+}
+
+// Secrets returns the values added with AddSecret.
+func (r *Redactor) Secrets() []string {
+	r.secretsMutex.RLock()
+	defer r.secretsMutex.RUnlock()
+
+	values := make([]string, 0, len(r.secrets))
+	for value := range r.secrets {
+		values = append(values, value)
+	}
+
+	return values
+}
+
+// Redact returns the string with the secret values and credentials in it
+// replaced with ***.
+func (r *Redactor) Redact(str string) string {
+	values := r.Secrets()
+
+	// longer values are replaced first, so a value which contains another is
+	// not left partly in the output.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	for _, value := range values {
+		str = strings.Replace(str, value, Redacted, -1)
+	}
+
+	for _, re := range redactions {
+		str = re.pattern.ReplaceAllString(str, re.replace)
+	}
+
+	return str
+}
+
+// Writer returns a writer which redacts what is written to it, as Redact
+// does, before writing it to out. Each write is redacted on its own, so a
+// secret split across writes is not.
+func (r *Redactor) Writer(out io.Writer) io.Writer {
+	if _, ok := out.(*redactWriter); ok {
+		return out
+	}
+
+	return &redactWriter{out: out, redactor: r}
+}
+
+// AddSecret adds a value to the process's redactor, see Redactor.AddSecret.
+func AddSecret(value string) {
+	defaultRedactor.AddSecret(value)
+}
+
+// Secrets returns the values added with AddSecret.
+func Secrets() []string {
+	return defaultRedactor.Secrets()
+}
+
+// Redact redacts the string with the process's redactor, see
+// Redactor.Redact.
+func Redact(str string) string {
+	return defaultRedactor.Redact(str)
+}
+
+// NewRedactWriter returns a writer which redacts what is written to it with
+// the process's redactor, see Redactor.Writer.
+func NewRedactWriter(out io.Writer) io.Writer {
+	return defaultRedactor.Writer(out)
+}
+
+// redactWriter redacts what is written to it before writing it out.
+type redactWriter struct {
+	out      io.Writer
+	redactor *Redactor
+}
+
+// Write redacts the content and writes it out, and keeps it in the tail of
+// the output. It returns the length of the content given, not that written,
+// as the writers copying to it expect.
+func (r *redactWriter) Write(p []byte) (int, error) {
+	redacted := r.redactor.Redact(string(p))
+	r.redactor.keepTail(redacted)
+
+	if _, err := io.WriteString(r.out, redacted); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// tailSize is how much of the output is kept for Tail.
+const tailSize = 64 * 1024
+
+func (r *Redactor) keepTail(s string) {
+	r.tailMutex.Lock()
+	defer r.tailMutex.Unlock()
+
+	r.tail = append(r.tail, s...)
+	if len(r.tail) > tailSize {
+		r.tail = append(r.tail[:0], r.tail[len(r.tail)-tailSize:]...)
+	}
+}
+
+// Tail returns up to the last n lines written through its writers, such as
+// the output of the logger and of run steps, redacted, with their colors
+// stripped.
+func (r *Redactor) Tail(n int) string {
+	r.tailMutex.Lock()
+	s := string(r.tail)
+	r.tailMutex.Unlock()
+
+	lines := strings.Split(strings.TrimRight(colorRegexp.ReplaceAllString(s, ""), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	// progress is drawn over itself: only what was drawn last is kept.
+	for i, line := range lines {
+		if parts := strings.Split(strings.TrimRight(line, "\r"), "\r"); len(parts) > 1 {
+			lines[i] = parts[len(parts)-1]
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Tail returns up to the last n lines written through the process's
+// redactor, see Redactor.Tail.
+func Tail(n int) string {
+	return defaultRedactor.Tail(n)
+}
+
+// colorRegexp matches the escape sequences which color the output.
+var colorRegexp = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
@@ -3,18 +3,26 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/box-builder/box/audit"
 	"github.com/box-builder/box/builder"
-	"github.com/box-builder/box/copy"
 	"github.com/box-builder/box/logger"
-	"github.com/box-builder/box/multi"
-	"github.com/box-builder/box/repl"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/sched"
 	"github.com/box-builder/box/signal"
-	"github.com/box-builder/box/types"
-	"github.com/docker/docker/pkg/term"
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/tlsconfig"
+	"github.com/box-builder/box/tracing"
+	"github.com/box-builder/box/util"
+	cicopy "github.com/containers/image/copy"
+	cidocker "github.com/containers/image/docker"
+	"github.com/docker/go-units"
 	"github.com/urfave/cli"
 )
 
@@ -33,7 +41,20 @@ var (
 	// Copyright is the copyright, generated automatically for each year.
 	Copyright = fmt.Sprintf("(C) %d %s - Licensed under MIT license", time.Now().Year(), Author)
 	// UsageText is the description of how to use the program.
-	UsageText = "box [options] filename"
+	UsageText = "box [options] filename, or box [options] git-url#ref:subdir [filename]"
+)
+
+// scheduler is the scheduler the containers of run steps of all builds share,
+// if --jobs is set.
+var scheduler *sched.Scheduler
+
+// the settings of the global flags builds are given, as configure reads them:
+// the gzip workers and spill threshold of their layers, and the policy of
+// --policy, if it is set.
+var (
+	gzipWorkers    int
+	spillThreshold int64
+	registryPolicy *policy.Policy
 )
 
 func main() {
@@ -52,6 +73,249 @@ func main() {
 			Name:  "no-cache, n",
 			Usage: "Disable the build cache",
 		},
+		cli.StringSliceFlag{
+			Name:  "cache-from",
+			Usage: "Import the build cache from this registry repository or cache backend URL. Repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from-image",
+			Usage: "Re-use the layers of this image for the steps found in its history. Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "cache-to",
+			Usage: "Export the build cache to this registry repository or cache backend URL",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Also write the image built to this location, e.g. oci:/path for an OCI image layout or docker://name to push it to a registry",
+		},
+		cli.StringFlag{
+			Name:  "sbom",
+			Usage: "Write an SBOM of the image built to this location, spdx:file or cyclonedx:file; it is also attached to the image pushed with --output docker://name",
+		},
+		cli.StringFlag{
+			Name:  "scan",
+			Usage: "Scan the image built for vulnerabilities with trivy or grype, or either as name:path, and fail the build if it has any at or above --scan-severity",
+		},
+		cli.StringFlag{
+			Name:  "scan-severity",
+			Value: "high",
+			Usage: "The severity of vulnerabilities which fail the build with --scan: unknown, negligible, low, medium, high or critical",
+		},
+		cli.StringFlag{
+			Name:  "scan-report",
+			Usage: "Write the findings of --scan to this file as JSON, whether the build fails or not",
+		},
+		cli.StringFlag{
+			Name:  "scan-secrets",
+			Usage: "Scan the layers built for private keys, tokens and other secrets which leaked into them, and warn or fail the build if any are found",
+		},
+		cli.StringFlag{
+			Name:  "provenance",
+			Usage: "Sign an SLSA provenance attestation of the image pushed with --output docker://name with this key file, or hashivault://name, and attach it to the image",
+		},
+		cli.StringSliceFlag{
+			Name:  "sensitive-env",
+			Usage: "Redact the value of this environment variable, such as one read with getenv, from the output. One per option, repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "policy",
+			Usage: "Govern the build with this policy file, such as the base images which may be used with from and the registries which may be pulled from and pushed to",
+		},
+		cli.StringFlag{
+			Name:  "signature-policy",
+			Usage: "Only use images with from which this policy.json allows, checking their signatures in the registry",
+		},
+		cli.StringFlag{
+			Name:  "sign-by",
+			Usage: "Sign the image pushed with --output docker://name with this GPG key ID",
+		},
+		cli.StringSliceFlag{
+			Name:  "encrypt-recipient",
+			Usage: "Encrypt the layers of the image written with --output, and of images saved as OCI, for this public key or certificate, a PEM file. One per option, repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "decrypt-key",
+			Usage: "Decrypt the encrypted images used with from with this private key, a PEM file. One per option, repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Build for this platform, e.g. linux/arm64, instead of the docker host's",
+		},
+		cli.StringFlag{
+			Name:  "compression",
+			Value: "gzip",
+			Usage: "Compress the layers written to cache backends and OCI image layouts with gzip or zstd, or write eStargz layers to OCI image layouts",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "Normalize the image built, so building the same inputs gives the same image ID",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Leave the files matching this pattern out of flattened layers. One per option, repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "seccomp-profile",
+			Usage: "Confine the containers of run steps with this seccomp profile, a JSON file, or unconfined",
+		},
+		cli.StringFlag{
+			Name:  "apparmor-profile",
+			Usage: "Confine the containers of run steps with this AppArmor profile, loaded on the docker host, or unconfined",
+		},
+		cli.StringSliceFlag{
+			Name:  "selinux-label",
+			Usage: "Label the containers of run steps with this part of an SELinux label, such as type:container_t, or disable. One per option, repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Usage: "Add this capability, such as NET_ADMIN, or ALL, to the containers of run steps. One per option, repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Usage: "Drop this capability, or ALL, from the containers of run steps. One per option, repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "Run the containers of run steps in this network: none, host, bridge or the name of a docker network",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Value: "1.2",
+			Usage: "Reach registries and cache backends with this version of TLS or later: 1.0, 1.1, 1.2 or 1.3",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher",
+			Usage: "Reach registries and cache backends with this cipher suite, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, or fips for those FIPS 140-2 approves. One per option, repeatable.",
+		},
+		cli.BoolFlag{
+			Name:  "strict-tls",
+			Usage: "Never reach registries over plain http, even with --insecure or on localhost, nor with TLS older than 1.2 or insecure cipher suites",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT",
+			Usage:  "Trace builds, their steps and registry requests, and export the spans to this OpenTelemetry collector over OTLP/HTTP",
+		},
+		cli.StringSliceFlag{
+			Name:  "webhook",
+			Usage: "Notify this URL when a build finishes, with whether it succeeded, its image, how long it took and the tail of its log; may be given more than once",
+		},
+		cli.StringFlag{
+			Name:   "webhook-secret",
+			EnvVar: "BOX_WEBHOOK_SECRET",
+			Usage:  "Sign the payloads of webhooks with HMAC-SHA256 and this secret, in the X-Box-Signature-256 header",
+		},
+		cli.StringFlag{
+			Name:  "webhook-template",
+			Usage: "Render the payloads of webhooks with this Go template, instead of sending the builds as JSON",
+		},
+		cli.StringFlag{
+			Name:  "context",
+			Usage: "Build in this context, and the plan relative to it: a directory, a git repository as URL#ref:subdir, the URL of a tarball, or - for a tarball read from stdin",
+		},
+		cli.StringFlag{
+			Name:  "dockerfile, f",
+			Usage: "Build this Dockerfile, translated into a plan, instead of a plan; the argument, if any, is the context",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-arg",
+			Usage: "Give the ARG of the Dockerfile this value, as NAME=value, or NAME for the value in the environment. One per option, repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "target",
+			Usage: "Build this stage of the Dockerfile, and the stages it needs, instead of the last",
+		},
+		cli.StringFlag{
+			Name:   "git-token",
+			EnvVar: "BOX_GIT_TOKEN",
+			Usage:  "Clone git contexts over http and https with this token",
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "Append a line of JSON to this file for each image pulled, pushed, tagged, deleted, signed or verified",
+		},
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Usage: "Run at most this many jobs, roughly CPUs, in the containers of run steps at once, across the builds of box multi and box matrix; each takes the weight of its build",
+		},
+		cli.StringFlag{
+			Name:  "memory-budget",
+			Usage: "Limit the memory of the containers of run steps running at once to this much, e.g. 8g, each to its share of it by its weight in --jobs",
+		},
+		cli.IntFlag{
+			Name:  "gzip-workers",
+			Value: runtime.NumCPU(),
+			Usage: "Compress this many blocks of each layer with gzip at once; 1 compresses layers whole",
+		},
+		cli.StringFlag{
+			Name:  "spill-threshold",
+			Value: "32m",
+			Usage: "Buffer layers box downloads or compresses in memory up to this size, and in temporary files past it",
+		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "Write a report of the build to this file as JSON: its steps, whether they were cached and how long they took, the image built, where it was pushed, and the warnings",
+		},
+		cli.StringFlag{
+			Name:  "report-junit",
+			Usage: "Write the report of the build to this file as JUnit XML, with a test case for each step",
+		},
+		cli.StringFlag{
+			Name:  "profile-out",
+			Usage: "Write the time, CPU time and bytes written of each step of the build to this file as JSON",
+		},
+		cli.StringFlag{
+			Name:  "disk-budget",
+			Usage: "Remove the oldest cached steps before a build until the build cache and the copy cache fit in this size, e.g. 20GB",
+		},
+		cli.StringFlag{
+			Name:  "min-free",
+			Value: "1GB",
+			Usage: "Fail before a build when less than this is free for docker or in the box directory; with --disk-budget, cached steps are removed first to free it",
+		},
+		cli.BoolFlag{
+			Name:  "eager-pull",
+			Usage: "Pull the images used with from at once, instead of when a step first needs them",
+		},
+		cli.StringFlag{
+			Name:   "executor, backend",
+			Value:  "docker",
+			EnvVar: "BOX_EXECUTOR",
+			Usage:  "Run the steps with docker, podman through its API service, or runc, containerd or in pods of kubernetes, which build without docker, keeping the images in the box directory",
+		},
+		cli.StringFlag{
+			Name:   "runtime",
+			Value:  "runc",
+			EnvVar: "BOX_RUNTIME",
+			Usage:  "The OCI runtime the steps are run with by --executor runc, such as runc or crun",
+		},
+		cli.StringFlag{
+			Name:   "snapshotter",
+			Value:  "auto",
+			EnvVar: "BOX_SNAPSHOTTER",
+			Usage:  "How --executor runc makes the root filesystems of steps: copy unpacks the image, overlayfs, btrfs and zfs make snapshots of its layers, and auto picks the one the box directory is on, or overlayfs when it can",
+		},
+		cli.StringFlag{
+			Name:   "kube-registry",
+			EnvVar: "BOX_KUBE_REGISTRY",
+			Usage:  "The repository --executor kubernetes pushes the images of run steps to, for their pods to pull",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "Use the rootless docker daemon of the user, at $XDG_RUNTIME_DIR/docker.sock; it is used without this when box can't reach the one run by root",
+		},
+		cli.StringFlag{
+			Name:   "ci-output",
+			EnvVar: "BOX_CI_OUTPUT",
+			Usage:  "Fold each step of the log, and annotate failures, for this CI system: github, gitlab, auto or none",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			EnvVar: "BOX_LOG_FORMAT",
+			Value:  "text",
+			Usage:  "Log as text for the terminal, or as a line of key=value pairs (logfmt) or of JSON (json) for each step and line of output",
+		},
 		cli.BoolFlag{
 			Name:  "no-tty",
 			Usage: "Disable TTY features this run",
@@ -68,14 +332,31 @@ func main() {
 			Name:  "tag, t",
 			Usage: "Tag the last image with this name",
 		},
+		cli.StringFlag{
+			Name:  "iidfile",
+			Usage: "Write the ID of the image built to this file",
+		},
 		cli.StringSliceFlag{
 			Name:  "omit, o",
 			Usage: "Omit functions/verbs. One per option, repeatable.",
 		},
+		cli.StringSliceFlag{
+			Name:  "profile, p",
+			Usage: "Select a profile declared in the plan. One per option, repeatable.",
+		},
 		cli.BoolFlag{
 			Name:  "no-trim",
 			Usage: "Do not trim the output to terminal width.",
 		},
+		cli.BoolFlag{
+			Name:  "watch, w",
+			Usage: "Rebuild the plan whenever it or the build context changes",
+		},
+		cli.DurationFlag{
+			Name:  "watch-interval",
+			Value: time.Second,
+			Usage: "How often to check for changes in watch mode",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -85,149 +366,821 @@ func main() {
 			Description: "Run the multi build functionality; supply multiple plans to build",
 			Usage:       "Run the multi build functionality; supply multiple plans to build",
 			ArgsUsage:   "[filename] [filename]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "weight",
+					Usage: "How heavy a plan's build is, as filename=weight: the jobs of --jobs its run steps take, and how long it is to take relative to the others. Repeatable.",
+				},
+			},
+		},
+		{
+			Name:        "matrix",
+			Action:      runMatrix,
+			Description: "Build a plan once for each combination of the matrix variables, which are available to the plan with getvar",
+			Usage:       "Build one plan for every variant of a build matrix",
+			ArgsUsage:   "[filename]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "var",
+					Usage: "A matrix axis, as name=value1,value2. Repeatable.",
+				},
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Tag each variant with this template, e.g. myapp:{{.ruby}}-{{.distro}}",
+				},
+			},
+		},
+		{
+			Name:        "bake",
+			Action:      runBake,
+			Description: "Build the images a bake file declares: each from its plan, in its context, for each of its platforms, after the images it needs. Only the images given, and those they need, are built if any are given. Each build is run by box as another process, with the global flags given before bake.",
+			Usage:       "Build the images of a bake file",
+			ArgsUsage:   "[image] [image]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "box-bake.yml",
+					Usage: "The bake file",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 4,
+					Usage: "The number of builds run at once",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print the builds, in the order they may run, without running them",
+				},
+			},
+		},
+		{
+			Name:        "graph",
+			Action:      runGraph,
+			Description: "Output the steps and stages of a plan as a dependency graph, without building it",
+			Usage:       "Output the dependency graph of a plan",
+			ArgsUsage:   "[filename]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "dot",
+					Usage: "The output format: dot or json",
+				},
+			},
+		},
+		{
+			Name:        "convert",
+			Action:      runConvert,
+			Description: "Convert a plan into a Dockerfile, for the tools which only build those; what a Dockerfile can't do is left in comments",
+			Usage:       "Convert a plan into a Dockerfile",
+			ArgsUsage:   "[filename]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Value: "dockerfile",
+					Usage: "The format to convert to: dockerfile",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Write it to this file instead of stdout",
+				},
+			},
+		},
+		{
+			Name:        "cache",
+			Description: "Show and prune the build cache",
+			Usage:       "Show and prune the build cache",
+			Subcommands: []cli.Command{
+				{
+					Name:        "ls",
+					Action:      runCacheList,
+					Description: "List the steps in the build cache, newest first",
+					Usage:       "List the steps in the build cache",
+				},
+				{
+					Name:        "stats",
+					Action:      runCacheStats,
+					Description: "Show the cache hits and misses of every build on this machine, and the steps rebuilt most often",
+					Usage:       "Show the build cache statistics",
+				},
+				{
+					Name:        "prune",
+					Action:      runCachePrune,
+					Description: "Remove steps from the build cache. Without --older-than or --max-size, every step but the --keep-last newest is removed. Tagged steps, and those still in use, are never removed.",
+					Usage:       "Remove steps from the build cache",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "keep-last",
+							Usage: "Keep the newest n steps",
+						},
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "Remove steps older than this, e.g. 168h",
+						},
+						cli.StringFlag{
+							Name:  "max-size",
+							Usage: "Remove the oldest steps until the cache is no larger than this, e.g. 10GB",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:        "gc",
+			Action:      runGC,
+			Description: "Remove the images docker keeps which no tagged image, build cache step or container refers to, and the files interrupted copies left in the copy cache",
+			Usage:       "Remove unreferenced images and copy cache files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Show what would be removed, without removing it",
+				},
+			},
+		},
+		{
+			Name:        "prune",
+			Action:      runPrune,
+			Description: "Remove the untagged images docker keeps which no container uses, such as the intermediate images of builds and their build cache steps, and the parents only they use",
+			Usage:       "Remove dangling images",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "Also remove tagged images no container uses",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "Only remove images created before a time: until=24h, or until=2017-01-02T15:04:05Z",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Show what would be removed, without removing it",
+				},
+			},
+		},
+		{
+			Name:        "save",
+			Action:      runSave,
+			Description: "Save images to a tarball which docker load and box load can read, so they can be moved to hosts without access to a registry",
+			Usage:       "Save images to a tarball",
+			ArgsUsage:   "image [image...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "The file to write the tarball to",
+				},
+			},
+		},
+		{
+			Name:        "export",
+			Action:      runExport,
+			Description: "Write the filesystem of an image to a tarball, with all of its layers applied, to make a chroot, an LXC template or a base image of it",
+			Usage:       "Export the filesystem of an image",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "The file to write the tarball to, or - for stdout",
+				},
+			},
+		},
+		{
+			Name:        "cat",
+			Action:      runCat,
+			Description: "Write a file of an image to stdout, read from the layer which has it without unpacking the image",
+			Usage:       "Print a file of an image",
+			ArgsUsage:   "image:/path",
+		},
+		{
+			Name:        "extract",
+			Action:      runExtract,
+			Description: "Unpack a file or directory of an image into a directory, read from the layers which have it without unpacking the image. The content of a directory is unpacked into the directory given",
+			Usage:       "Extract files from an image",
+			ArgsUsage:   "image:/path directory",
+		},
+		{
+			Name:        "mount",
+			Action:      runMount,
+			Description: "Mount the filesystem of an image read-only to browse it without starting a container. The layers are stacked with overlayfs, or the filesystem is copied to the directory where it can't be mounted",
+			Usage:       "Mount the filesystem of an image",
+			ArgsUsage:   "image directory",
+		},
+		{
+			Name:        "unmount",
+			Action:      runUnmount,
+			Description: "Unmount an image mounted with box mount",
+			Usage:       "Unmount an image",
+			ArgsUsage:   "directory",
+		},
+		{
+			Name:        "import",
+			Action:      runImport,
+			Description: "Import a filesystem tarball, such as one made by debootstrap or mkosi, as an image with one layer, to use as a base image",
+			Usage:       "Import a filesystem tarball as an image",
+			ArgsUsage:   "file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Tag the image",
+				},
+				cli.StringSliceFlag{
+					Name:  "change, c",
+					Usage: "Apply a Dockerfile instruction to the image configuration, such as 'ENV PATH=/usr/bin:/bin' or 'CMD [\"/bin/sh\"]'",
+				},
+			},
+		},
+		{
+			Name:        "load",
+			Action:      runLoad,
+			Description: "Load the images in a tarball written by box save or docker save, so they can be used without a registry",
+			Usage:       "Load images from a tarball",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "The tarball to load",
+				},
+			},
+		},
+		{
+			Name:        "copy",
+			Action:      runCopy,
+			Description: "Copy an image from one registry to another, streaming its blobs through without a docker daemon. Blobs the destination has are skipped, and blobs in another repository on the same registry are mounted. With --encrypt-recipient or --decrypt-key, the image is encrypted or decrypted as it is copied; a manifest list is copied as its image for --platform.",
+			Usage:       "Copy an image between registries",
+			ArgsUsage:   "source destination",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registries over plain http",
+				},
+				cli.StringSliceFlag{
+					Name:  "encrypt-recipient",
+					Usage: "Encrypt the layers of the image for this public key or certificate, a PEM file. One per option, repeatable.",
+				},
+				cli.StringSliceFlag{
+					Name:  "decrypt-key",
+					Usage: "Decrypt the encrypted layers of the image with this private key, a PEM file. One per option, repeatable.",
+				},
+				cli.StringFlag{
+					Name:  "platform",
+					Usage: "The platform of the image of a manifest list to encrypt or decrypt, instead of this machine's",
+				},
+			},
+		},
+		{
+			Name:        "retag",
+			Action:      runRetag,
+			Description: "Tag an image in a registry with another tag of the same repository, without pulling or pushing any of its blobs",
+			Usage:       "Tag an image in a registry",
+			ArgsUsage:   "image new-image",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registry over plain http",
+				},
+			},
+		},
+		{
+			Name:        "manifest",
+			Description: "Assemble images built separately for each platform into a manifest list, and push it as one tag",
+			Usage:       "Create and push manifest lists",
+			Subcommands: []cli.Command{
+				{
+					Name:        "create",
+					Action:      runManifestCreate,
+					Description: "Create a manifest list of images pushed to a registry. The platform of each image is read from its configuration.",
+					Usage:       "Create a manifest list",
+					ArgsUsage:   "list image [image...]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "amend, a",
+							Usage: "Add the images to the manifest list if it exists, instead of replacing it",
+						},
+						cli.BoolFlag{
+							Name:  "insecure",
+							Usage: "Reach the registries over plain http",
+						},
+					},
+				},
+				{
+					Name:        "annotate",
+					Action:      runManifestAnnotate,
+					Description: "Change the platform of an image in a manifest list",
+					Usage:       "Change the platform of an image in a manifest list",
+					ArgsUsage:   "list image",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "os",
+							Usage: "The operating system",
+						},
+						cli.StringFlag{
+							Name:  "arch",
+							Usage: "The architecture",
+						},
+						cli.StringFlag{
+							Name:  "variant",
+							Usage: "The variant of the architecture, e.g. v7 for arm",
+						},
+						cli.StringFlag{
+							Name:  "os-version",
+							Usage: "The version of the operating system",
+						},
+					},
+				},
+				{
+					Name:        "push",
+					Action:      runManifestPush,
+					Description: "Push a manifest list to the registry under its name. Images from other repositories are copied into its repository first.",
+					Usage:       "Push a manifest list",
+					ArgsUsage:   "list",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "purge, p",
+							Usage: "Remove the manifest list from this machine once it is pushed",
+						},
+						cli.BoolFlag{
+							Name:  "insecure",
+							Usage: "Reach the registries over plain http",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:        "mutate",
+			Action:      runMutate,
+			Description: "Change the configuration of an image in a registry without rebuilding it. Only a new configuration and manifest are pushed; the layers stay the same.",
+			Usage:       "Change the configuration of an image in a registry",
+			ArgsUsage:   "image",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Push the changed image under this name instead of the image's",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registries over plain http",
+				},
+			}, mutationFlags...),
+		},
+		{
+			Name:        "append",
+			Action:      runAppend,
+			Description: "Add a layer from a tarball on top of an image in a registry without rebuilding it, changing its configuration as mutate does. Only the new layer, configuration and manifest are pushed; the layers of the image are reused.",
+			Usage:       "Add a layer to an image in a registry",
+			ArgsUsage:   "image",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "tar",
+					Usage: "The tarball of the layer to add, compressed with gzip or zstd or not at all",
+				},
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Push the new image under this name instead of the image's",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registries over plain http",
+				},
+			}, mutationFlags...),
+		},
+		{
+			Name:        "rebase",
+			Action:      runRebase,
+			Description: "Replace the layers of the base image an image in a registry is built on with those of a newer base, without rebuilding it. Only sound if the layers on top of the base do not depend on what changed in it.",
+			Usage:       "Move an image in a registry onto a new base image",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "old-base",
+					Usage: "The base image the image is built on",
+				},
+				cli.StringFlag{
+					Name:  "new-base",
+					Usage: "The base image to put under the image instead",
+				},
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Push the rebased image under this name instead of the image's",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registries over plain http",
+				},
+			},
+		},
+		{
+			Name:        "sign",
+			Action:      runSign,
+			Description: "Sign an image in a registry with a cosign signature, pushed to its repository where cosign verify finds it",
+			Usage:       "Sign an image in a registry",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key, k",
+					Usage: "The PEM private key file to sign with, or hashivault://name for a key kept in vault",
+				},
+				cli.BoolFlag{
+					Name:  "referrers",
+					Usage: "Push the signature as a referrer of the image instead of under the signature tag",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registry over plain http",
+				},
+			},
+		},
+		{
+			Name:        "verify",
+			Action:      runVerify,
+			Description: "Verify the cosign signatures of an image in a registry, under the signature tag and as referrers of the image",
+			Usage:       "Verify the signatures of an image in a registry",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key, k",
+					Usage: "The PEM public key file to verify with, or hashivault://name for a key kept in vault",
+				},
+				cli.BoolFlag{
+					Name:  "provenance",
+					Usage: "Verify the SLSA provenance attestations of the image instead, and show what it was built from",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registry over plain http",
+				},
+			},
+		},
+		{
+			Name:        "diff",
+			Action:      runDiff,
+			Description: "Compare the layers of two images, and with --files the files in them, to find out why an image changed or grew",
+			Usage:       "Compare two images",
+			ArgsUsage:   "image-a image-b",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "files, f",
+					Usage: "Also compare the files of the images; the images are saved from docker to do so",
+				},
+			},
+		},
+		{
+			Name:        "analyze",
+			Action:      runAnalyze,
+			Description: "Show the size of each layer of an image, its largest files and directories, and the space wasted by files later layers overwrite or delete. The image is saved from docker to do so.",
+			Usage:       "Analyze the layers of an image",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "top",
+					Value: 5,
+					Usage: "The number of largest files and directories, and of wasted files, to show",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the analysis as JSON",
+				},
+			},
+		},
+		{
+			Name:        "sbom",
+			Action:      runSBOM,
+			Description: "List the packages installed in an image, by dpkg and apk and by npm, pip and gem, as an SPDX or CycloneDX SBOM. The image is saved from docker to do so.",
+			Usage:       "Write an SBOM of an image",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "spdx",
+					Usage: "The format of the SBOM: spdx or cyclonedx",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "The file to write the SBOM to, instead of stdout",
+				},
+			},
+		},
+
+		{
+			Name:        "history",
+			Action:      runHistory,
+			Description: "Show the history of an image: the size and command of each layer, and the step of the plan which built it if box did",
+			Usage:       "Show the history of an image",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the history as JSON",
+				},
+			},
+		},
+		{
+			Name:        "inspect",
+			Action:      runInspect,
+			Description: "Show the digest, platforms, layers and configuration of an image in a registry. Only its manifest and configuration are fetched; no layers are pulled.",
+			Usage:       "Inspect an image in a registry without pulling it",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "platform",
+					Usage: "The platform of the image to inspect in a manifest list; this machine's by default",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the inspection as JSON",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registry over plain http",
+				},
+			},
+		},
+		{
+			Name:        "squash",
+			Action:      runSquash,
+			Description: "Merge a range of an image's layers into one. Layers are counted from the base image's first layer, 0. The layers below the range are left as they are, so they are still shared with the images built on them.",
+			Usage:       "Merge a range of an image's layers into one",
+			ArgsUsage:   "image",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "from",
+					Usage: "The first layer to merge",
+				},
+				cli.IntFlag{
+					Name:  "to",
+					Value: -1,
+					Usage: "The last layer to merge; the image's last layer by default",
+				},
+				cli.StringFlag{
+					Name:  "tag, t",
+					Usage: "Tag the squashed image with this name",
+				},
+			},
+		},
+		{
+			Name:        "proxyd",
+			Action:      runProxyd,
+			Description: "Serve a pull-through cache of a registry: manifests and blobs are fetched from the registry once and kept on disk, and pulls are answered from them. Point docker at it as a registry mirror, or pull from it as a registry.",
+			Usage:       "Serve a pull-through cache of a registry",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:5000",
+					Usage: "The address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "upstream",
+					Value: "docker.io",
+					Usage: "The registry to mirror",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "The directory to keep the cache in; proxy in the box directory by default",
+				},
+				cli.DurationFlag{
+					Name:  "tag-ttl",
+					Value: 5 * time.Minute,
+					Usage: "How long the digest of a tag is served before the registry is asked for it again",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registry over plain http",
+				},
+			},
+		},
+		{
+			Name:        "serve",
+			Action:      runServe,
+			Description: "Serve builds over an HTTP API, and a gRPC one: plans are submitted with their contexts as tarballs, and their status, logs and images read back. Each build is run by box as another process, with the global flags given before serve.",
+			Usage:       "Serve builds over HTTP and gRPC APIs",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:8080",
+					Usage: "The address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "The directory to keep the builds in; server in the box directory by default",
+				},
+				cli.IntFlag{
+					Name:  "jobs, j",
+					Value: 2,
+					Usage: "The number of builds run at once; the others are queued",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					EnvVar: "BOX_SERVE_TOKEN",
+					Usage:  "The bearer token requests must have",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "Serve over TLS with this certificate",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "The key of the certificate of --tls-cert",
+				},
+				cli.StringFlag{
+					Name:  "grpc-listen",
+					Usage: "Also listen on this address for gRPC clients, which connect over plaintext HTTP/2; over TLS, they connect to --listen too",
+				},
+			},
+		},
+		{
+			Name:        "bench",
+			Action:      runBench,
+			Description: "Run workloads representative of a build on this host and report their throughput: compressing a layer, pulling an image, committing a layer in docker, and pushing a blob to a throwaway repository. Pass --gzip-workers to compare gzip settings.",
+			Usage:       "Measure the throughput of pulls, layer commits, compression and pushes",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "workload",
+					Usage: "Run only these workloads: compress, pull, commit or push",
+				},
+				cli.StringFlag{
+					Name:  "size",
+					Value: "256MB",
+					Usage: "The amount of data to compress, commit and push",
+				},
+				cli.StringSliceFlag{
+					Name:  "compression",
+					Usage: "The compressions to measure: gzip and zstd by default",
+				},
+				cli.StringFlag{
+					Name:  "image",
+					Value: "debian:stable-slim",
+					Usage: "The image to pull, and to commit a layer on top of",
+				},
+				cli.StringFlag{
+					Name:  "repo",
+					Usage: "The throwaway repository to push to; push is skipped without one",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Reach the registry over plain http",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the results as JSON",
+				},
+			},
 		},
 		{
 			Name:        "repl",
 			Action:      runRepl,
 			Description: "Run the read-eval-print loop to interactively work with box",
 			Usage:       "Run the read-eval-print loop to interactively work with box",
-			ArgsUsage:   " ",
+			ArgsUsage:   "[image]",
+			Flags:       replFlags,
 		},
 		{
 			Name:        "shell",
 			Action:      runRepl,
 			Description: "Run the read-eval-print loop to interactively work with box",
 			Usage:       "Run the read-eval-print loop to interactively work with box",
-			ArgsUsage:   " ",
+			ArgsUsage:   "[image]",
+			Flags:       replFlags,
 		},
 	}
 
-	app.Action = func(ctx *cli.Context) {
-		notrim := ctx.Bool("no-trim")
-		log := logger.New("main", notrim)
+	app.Before = configure
+	app.Action = runBuild
 
-		if ctx.Bool("help") {
-			cli.ShowAppHelp(ctx)
-			os.Exit(0)
+	if err := app.Run(os.Args); err != nil {
+		logger.New("main", false).Error(err)
+		os.Exit(1)
+	}
+}
+
+// configure applies the global flags to the settings every build and command
+// of the process shares, before any of them runs.
+func configure(ctx *cli.Context) error {
+	if ctx.GlobalString("executor") == "podman" {
+		if err := util.UsePodman(); err != nil {
+			return err
 		}
+	} else if _, err := util.UseRootlessDocker(ctx.GlobalBool("rootless")); err != nil {
+		return err
+	}
 
-		args := ctx.Args()
+	if err := configureLog(ctx); err != nil {
+		return err
+	}
 
-		if len(args) < 1 {
-			cli.ShowAppHelp(ctx)
-			log.Error("Please provide a filename to process!")
-			os.Exit(1)
-		}
+	if err := tlsconfig.Set(ctx.GlobalString("tls-min-version"), ctx.GlobalStringSlice("tls-cipher"), ctx.GlobalBool("strict-tls")); err != nil {
+		return err
+	}
 
-		tty := !ctx.Bool("no-tty")
+	if err := tracing.Configure(ctx.GlobalString("otlp-endpoint")); err != nil {
+		return err
+	}
+	cidocker.DefaultTLSConfig = tlsconfig.Config
 
-		if !term.IsTerminal(0) {
-			tty = ctx.Bool("force-tty")
-		}
+	if gzipWorkers = ctx.GlobalInt("gzip-workers"); gzipWorkers < 1 {
+		return fmt.Errorf("--gzip-workers must be at least 1")
+	}
+	cicopy.NewGzipWriter = func(w io.Writer) io.WriteCloser {
+		cw, _ := tar.Compress(w, tar.Gzip, gzipWorkers) // never fails for gzip
+		return cw
+	}
 
-		cancelCtx, cancel := context.WithCancel(context.Background())
-		runChan := make(chan struct{})
-		buildConfig := builder.BuildConfig{
-			Globals: &types.Global{
-				ShowRun:   true,
-				TTY:       tty,
-				OmitFuncs: ctx.GlobalStringSlice("omit"),
-				Cache:     getCache(ctx),
-				Logger:    logger.New(args[0], notrim),
-				Context:   cancelCtx,
-			},
-			Runner:   runChan,
-			FileName: args[0],
-		}
+	var err error
+	if spillThreshold, err = units.RAMInBytes(ctx.GlobalString("spill-threshold")); err != nil {
+		return fmt.Errorf("invalid --spill-threshold: %v", err)
+	}
 
-		b, err := mkBuilder(cancel, buildConfig)
-		if err != nil {
-			log.Error(err)
-			os.Exit(1)
+	if fn := ctx.GlobalString("audit-log"); fn != "" {
+		if err := audit.Open(fn); err != nil {
+			return err
 		}
+	}
 
-		defer b.Close()
+	if scheduler, err = getScheduler(ctx); err != nil {
+		return err
+	}
 
-		result := b.Run()
-		if result.Err != nil {
-			log.Error(result.Err)
-			os.Exit(1)
-		}
+	registryPolicy, err = getPolicy(ctx)
+	return err
+}
 
-		if result.Value != "" {
-			log.EvalResponse(result.Value)
-		}
+// configureLog sets up the log: its format, the CI system it annotates and
+// the secrets it redacts.
+func configureLog(ctx *cli.Context) error {
+	for _, name := range ctx.GlobalStringSlice("sensitive-env") {
+		logger.AddSecret(os.Getenv(name))
+	}
+
+	ci, err := logger.ParseCI(ctx.GlobalString("ci-output"))
+	if err != nil {
+		return err
+	}
+	logger.CI = ci
 
-		tag := ctx.String("tag")
+	logger.DefaultHandler, err = logger.ParseFormat(ctx.GlobalString("log-format"), logger.NewRedactWriter(os.Stdout))
+	return err
+}
 
-		if tag != "" {
-			if err := b.Tag(tag); err != nil {
-				log.Error(fmt.Sprintf("Can't tag with tag %q: %v", tag, err))
-				os.Exit(1)
-			}
-			log.Tag(tag)
-		}
+// getPolicy returns the policy given with --policy, or nil if there is none.
+func getPolicy(ctx *cli.Context) (*policy.Policy, error) {
+	if file := ctx.GlobalString("policy"); file != "" {
+		return policy.Load(file)
+	}
 
-		id := result.Value
+	return nil, nil
+}
+
+// getScheduler returns the scheduler of --jobs and --memory-budget, or nil if
+// --jobs is not set.
+func getScheduler(ctx *cli.Context) (*sched.Scheduler, error) {
+	jobs := ctx.GlobalInt("jobs")
+	budget := ctx.GlobalString("memory-budget")
 
-		if strings.Contains(id, ":") {
-			id = strings.SplitN(id, ":", 2)[1]
+	if jobs == 0 {
+		if budget != "" {
+			return nil, fmt.Errorf("--memory-budget needs --jobs: the memory is shared by the jobs")
 		}
 
-		log.Finish(id)
+		return nil, nil
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		logger.New("main", false).Error(err)
-		os.Exit(1)
+	var memory int64
+	if budget != "" {
+		var err error
+		if memory, err = units.RAMInBytes(budget); err != nil {
+			return nil, fmt.Errorf("invalid --memory-budget: %v", err)
+		}
 	}
-}
 
-func runMulti(ctx *cli.Context) {
-	copy.NoOut = true
-	notrim := ctx.Bool("no-trim")
-	builders := []*builder.Builder{}
-	log := logger.New("main", notrim)
+	return sched.New(jobs, memory)
+}
 
-	args := ctx.Args()
-	if len(args) < 1 {
-		cli.ShowAppHelp(ctx)
-		log.Error("Please provide a filename to process!")
-		os.Exit(1)
+// parseWeights returns the weights of the plans given with --weight as
+// filename=weight, 1 for the plans without one.
+func parseWeights(specs []string, filenames []string) ([]int, error) {
+	index := map[string]int{}
+	weights := make([]int, len(filenames))
+	for i, filename := range filenames {
+		index[filename] = i
+		weights[i] = 1
 	}
 
-	for _, filename := range args {
-		cancelCtx, cancel := context.WithCancel(context.Background())
-		runChan := make(chan struct{})
-		buildConfig := builder.BuildConfig{
-			Globals: &types.Global{
-				ShowRun:   false,
-				TTY:       true,
-				OmitFuncs: append(ctx.StringSlice("omit"), "debug"),
-				Cache:     getCache(ctx),
-				Logger:    logger.New(filename, notrim),
-				Context:   cancelCtx,
-			},
-			Runner:   runChan,
-			FileName: filename,
+	for _, spec := range specs {
+		pos := strings.LastIndex(spec, "=")
+		if pos < 0 {
+			return nil, fmt.Errorf("invalid weight %q: must be filename=weight", spec)
 		}
-		signal.Handler.AddFunc(cancel)
-		signal.Handler.AddRunner(runChan)
 
-		b, err := builder.NewBuilder(buildConfig)
-		if err != nil {
-			log.Error(err)
-			os.Exit(1)
+		i, ok := index[spec[:pos]]
+		if !ok {
+			return nil, fmt.Errorf("invalid weight %q: %s is not one of the plans built", spec, spec[:pos])
+		}
+
+		weight, err := strconv.Atoi(spec[pos+1:])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight %q: must be a whole number of at least 1", spec)
 		}
-		builders = append(builders, b)
-	}
 
-	mb := multi.NewBuilder(builders)
-	mb.Build()
-	if err := mb.Wait(); err != nil {
-		log.Error(err)
-		os.Exit(2)
+		weights[i] = weight
 	}
+
+	return weights, nil
 }
 
 func getCache(ctx *cli.Context) bool {
@@ -239,17 +1192,19 @@ func getCache(ctx *cli.Context) bool {
 	return cache
 }
 
-func runRepl(ctx *cli.Context) {
-	log := logger.New("repl", ctx.Bool("no-trim"))
-	r, err := repl.NewRepl(ctx.GlobalStringSlice("omit"), log)
-	if err != nil {
-		log.Error(fmt.Sprintf("bootstrapping repl: %v\n", err))
-		os.Exit(1)
-	}
+// signalContext returns a context which ^C cancels, and the function to call
+// once what it was given to is done: ^C waits for it before box exits, so
+// what was canceled can clean up, such as uploads left partial.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 
-	if err := r.Loop(); err != nil {
-		log.Error(err)
-		os.Exit(1)
+	signal.Handler.AddFunc(cancel)
+	signal.Handler.AddRunner(done)
+
+	return ctx, func() {
+		cancel()
+		close(done)
 	}
 }
 
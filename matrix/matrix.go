@@ -0,0 +1,97 @@
+// Package matrix expands a build matrix into the set of variants to build.
+// Each variant is a combination of one value from each axis of the matrix;
+// the variant's values are exposed to the plan through the `getvar` function.
+package matrix
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Variant is one combination of the matrix's variables.
+type Variant map[string]string
+
+// Parse parses axis specifications of the form `name=value1,value2` into a
+// map of axis name to values. Repeating an axis appends to its values.
+func Parse(specs []string) (map[string][]string, error) {
+	axes := map[string][]string{}
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid matrix specification %q, must be name=value1,value2", spec)
+		}
+
+		for _, value := range strings.Split(parts[1], ",") {
+			if value == "" {
+				return nil, errors.Errorf("empty value in matrix specification %q", spec)
+			}
+			axes[parts[0]] = append(axes[parts[0]], value)
+		}
+	}
+
+	return axes, nil
+}
+
+// Expand returns every combination of the axes. The order is deterministic:
+// axes are sorted by name and values are kept in the order given.
+func Expand(axes map[string][]string) []Variant {
+	names := []string{}
+	for name := range axes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	variants := []Variant{{}}
+
+	for _, name := range names {
+		expanded := []Variant{}
+		for _, variant := range variants {
+			for _, value := range axes[name] {
+				v := Variant{name: value}
+				for key, val := range variant {
+					v[key] = val
+				}
+				expanded = append(expanded, v)
+			}
+		}
+		variants = expanded
+	}
+
+	if len(variants) == 1 && len(variants[0]) == 0 {
+		return nil
+	}
+
+	return variants
+}
+
+// String returns the variant as `name=value` pairs, sorted by name.
+func (v Variant) String() string {
+	pairs := []string{}
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// Tag renders the tag template for the variant. Variables are referenced as
+// `{{.name}}`, e.g. `myapp:{{.ruby}}-{{.distro}}`.
+func (v Variant) Tag(tmpl string) (string, error) {
+	t, err := template.New("tag").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, map[string]string(v)); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
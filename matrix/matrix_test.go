@@ -0,0 +1,61 @@
+package matrix
+
+import (
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type matrixSuite struct{}
+
+var _ = Suite(&matrixSuite{})
+
+func TestMatrix(t *T) {
+	TestingT(t)
+}
+
+func (ms *matrixSuite) TestParse(c *C) {
+	axes, err := Parse([]string{"ruby=2.3,2.4", "distro=debian", "distro=alpine"})
+	c.Assert(err, IsNil)
+	c.Assert(axes, DeepEquals, map[string][]string{
+		"ruby":   {"2.3", "2.4"},
+		"distro": {"debian", "alpine"},
+	})
+
+	for _, spec := range []string{"ruby", "=2.3", "ruby=", "ruby=2.3,,2.4"} {
+		_, err := Parse([]string{spec})
+		c.Assert(err, NotNil, Commentf("%s", spec))
+	}
+}
+
+func (ms *matrixSuite) TestExpand(c *C) {
+	variants := Expand(map[string][]string{
+		"ruby":   {"2.3", "2.4"},
+		"distro": {"debian", "alpine"},
+	})
+
+	strs := []string{}
+	for _, variant := range variants {
+		strs = append(strs, variant.String())
+	}
+
+	c.Assert(strs, DeepEquals, []string{
+		"distro=debian,ruby=2.3",
+		"distro=debian,ruby=2.4",
+		"distro=alpine,ruby=2.3",
+		"distro=alpine,ruby=2.4",
+	})
+
+	c.Assert(Expand(map[string][]string{}), IsNil)
+}
+
+func (ms *matrixSuite) TestTag(c *C) {
+	v := Variant{"ruby": "2.4", "distro": "alpine"}
+
+	tag, err := v.Tag("myapp:{{.ruby}}-{{.distro}}")
+	c.Assert(err, IsNil)
+	c.Assert(tag, Equals, "myapp:2.4-alpine")
+
+	_, err = v.Tag("myapp:{{.python}}")
+	c.Assert(err, NotNil)
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/box-builder/box/builder"
 	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/sched"
 	"github.com/box-builder/box/types"
 )
 
@@ -12,6 +13,9 @@ import (
 // builders.
 type Builder struct {
 	builders []*builder.Builder
+	needs    [][]int
+	results  []types.BuildResult
+	done     []chan struct{}
 }
 
 // NewBuilder contypes a *Builder.
@@ -19,10 +23,60 @@ func NewBuilder(builders []*builder.Builder) *Builder {
 	return &Builder{builders: builders}
 }
 
-// Build builds all the builders in parallel.
+// Schedule has each build wait for the builds it needs, by index, before it
+// starts, and gives the run steps of each its weight and a priority in the
+// scheduler of the builds, from the longest chain of builds which need it.
+// An error is returned if builds need each other.
+func (b *Builder) Schedule(weights []int, needs [][]int) error {
+	tasks := make([]sched.Task, len(b.builders))
+	for i := range tasks {
+		tasks[i] = sched.Task{Weight: weights[i], Needs: needs[i]}
+	}
+
+	priorities, err := sched.Priorities(tasks)
+	if err != nil {
+		return err
+	}
+
+	for i, br := range b.builders {
+		br.Config().Globals.Weight = weights[i]
+		br.Config().Globals.Priority = priorities[i]
+	}
+
+	b.needs = needs
+	return nil
+}
+
+// Build builds all the builders in parallel, but for those which need others
+// to finish first. Builds whose needs failed are not run.
 func (b *Builder) Build() {
-	for _, br := range b.builders {
-		go br.Run()
+	b.results = make([]types.BuildResult, len(b.builders))
+	b.done = make([]chan struct{}, len(b.builders))
+	for i := range b.done {
+		b.done[i] = make(chan struct{})
+	}
+
+	for i, br := range b.builders {
+		go func(i int, br *builder.Builder) {
+			defer close(b.done[i])
+
+			if b.needs != nil {
+				for _, need := range b.needs[i] {
+					<-b.done[need]
+
+					if b.results[need].Err != nil {
+						close(br.Config().Runner)
+						b.results[i] = types.BuildResult{
+							FileName: br.Config().FileName,
+							Err:      fmt.Errorf("not built, as %s, which it needs, failed", b.results[need].FileName),
+						}
+						return
+					}
+				}
+			}
+
+			b.results[i] = br.Run()
+		}(i, br)
 	}
 }
 
@@ -30,19 +84,12 @@ func (b *Builder) Build() {
 func (b *Builder) Wait() error {
 	log := logger.New("multi", false)
 
-	resChan := make(chan types.BuildResult, len(b.builders))
-
-	for _, br := range b.builders {
-		go func(br *builder.Builder) {
-			resChan <- br.Wait()
-		}(br)
-	}
-
 	var errored bool
 
-	for i := 0; i < len(b.builders); i++ {
-		res := <-resChan
-		if res.Err != nil {
+	for i := range b.builders {
+		<-b.done[i]
+
+		if res := b.results[i]; res.Err != nil {
 			errored = true
 			log.Error(fmt.Sprintf("%s: error occurred during plan execution: %v", res.FileName, res.Err))
 		}
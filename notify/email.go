@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Email sends builds by email, over SMTP.
+type Email struct {
+	Server   string   `json:"server"`             // host:port of the SMTP server, which is used with STARTTLS if it offers it
+	Username string   `json:"username,omitempty"` // if set, the server is authenticated with; environment variables are expanded
+	Password string   `json:"password,omitempty"` // environment variables are expanded
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Events   []string `json:"events,omitempty"` // succeeded, failed or both, if empty
+}
+
+// message returns the message of the build, with its headers.
+func (m Email) message(b build) []byte {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(buf, "Subject: [box] %s\r\n", b.summary())
+	fmt.Fprintf(buf, "Date: %s\r\n", b.Finished.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(buf, "%s.\r\n\r\n", b.summary())
+
+	if b.failed() {
+		fmt.Fprintf(buf, "Error: %s\r\n", b.Error)
+	} else {
+		fmt.Fprintf(buf, "Image: %s\r\n", b.Image)
+		for _, pushed := range b.pushed() {
+			fmt.Fprintf(buf, "Pushed: %s\r\n", pushed)
+		}
+	}
+
+	if b.Build != "" {
+		fmt.Fprintf(buf, "Build: %s\r\n", b.Build)
+	}
+
+	if b.Link != "" {
+		fmt.Fprintf(buf, "Link: %s\r\n", b.Link)
+	}
+
+	if b.failed() && b.Log != "" {
+		fmt.Fprintf(buf, "\r\n%s\r\n", strings.Replace(strings.TrimRight(b.Log, "\n"), "\n", "\r\n", -1))
+	}
+
+	return buf.Bytes()
+}
+
+func (m Email) notify(b build) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Server)
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// the envelope has the addresses alone, without the names of the headers.
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid from: %v", err)
+	}
+
+	to := []string{}
+	for _, addr := range m.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("invalid to: %v", err)
+		}
+		to = append(to, a.Address)
+	}
+
+	return smtp.SendMail(m.Server, auth, from.Address, to, m.message(b))
+}
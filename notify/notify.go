@@ -0,0 +1,195 @@
+// Package notify posts the results of builds to Slack and sends them by
+// email, as the notify section of ~/.box/config configures it: whether the
+// build succeeded, the image built and the digests of the images pushed, a
+// link to the build, and the tail of the log of those which failed.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/box-builder/box/webhook"
+	"github.com/ghodss/yaml"
+)
+
+// Config is the configuration of box, of which notifications are a section.
+type Config struct {
+	Notify Notifiers `json:"notify"`
+}
+
+// Notifiers are notified of the builds as they finish.
+type Notifiers struct {
+	Link  string  `json:"link,omitempty"` // a template of the link to the build, rendered with its webhook.Event
+	Slack []Slack `json:"slack,omitempty"`
+	Email []Email `json:"email,omitempty"`
+
+	link *template.Template
+}
+
+// Load reads the configuration file. A configuration which does not exist
+// notifies nothing.
+func Load(fn string) (*Config, error) {
+	config := &Config{}
+
+	content, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", fn, err)
+	}
+
+	if err := config.Notify.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", fn, err)
+	}
+
+	return config, nil
+}
+
+func (n *Notifiers) validate() error {
+	if n.Link != "" {
+		var err error
+		if n.link, err = template.New("link").Parse(n.Link); err != nil {
+			return fmt.Errorf("invalid link: %v", err)
+		}
+	}
+
+	for i := range n.Slack {
+		s := &n.Slack[i]
+		s.Webhook = os.ExpandEnv(s.Webhook)
+		if s.Webhook == "" {
+			return fmt.Errorf("slack notifier %d has no webhook", i+1)
+		}
+
+		if err := validEvents(s.Events); err != nil {
+			return fmt.Errorf("slack notifier %d: %v", i+1, err)
+		}
+	}
+
+	for i := range n.Email {
+		e := &n.Email[i]
+		e.Username, e.Password = os.ExpandEnv(e.Username), os.ExpandEnv(e.Password)
+		if e.Server == "" || e.From == "" || len(e.To) == 0 {
+			return fmt.Errorf("email notifier %d needs a server, from and to", i+1)
+		}
+
+		if err := validEvents(e.Events); err != nil {
+			return fmt.Errorf("email notifier %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func validEvents(events []string) error {
+	for _, event := range events {
+		if event != "succeeded" && event != "failed" {
+			return fmt.Errorf("invalid event %q: it must be succeeded or failed", event)
+		}
+	}
+
+	return nil
+}
+
+// Empty returns whether there is nothing to notify.
+func (n *Notifiers) Empty() bool {
+	return len(n.Slack) == 0 && len(n.Email) == 0
+}
+
+// Notify notifies each notifier of the event which it is to be notified of,
+// and returns the errors of those which could not be.
+func (n *Notifiers) Notify(ctx context.Context, e webhook.Event) []error {
+	b := build{Event: e}
+
+	if n.link != nil {
+		buf := &bytes.Buffer{}
+		if err := n.link.Execute(buf, e); err != nil {
+			return []error{fmt.Errorf("could not render the link to the build: %v", err)}
+		}
+		b.Link = buf.String()
+	}
+
+	errs := []error{}
+
+	for _, s := range n.Slack {
+		if notified(s.Events, e) {
+			if err := s.notify(ctx, b); err != nil {
+				errs = append(errs, fmt.Errorf("could not notify slack: %v", err))
+			}
+		}
+	}
+
+	for _, m := range n.Email {
+		if notified(m.Events, e) {
+			if err := m.notify(b); err != nil {
+				errs = append(errs, fmt.Errorf("could not email %s: %v", strings.Join(m.To, ", "), err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// notified returns whether a notifier of the events, all if none, is
+// notified of the event.
+func notified(events []string, e webhook.Event) bool {
+	if len(events) == 0 {
+		return true
+	}
+
+	for _, event := range events {
+		if "build."+event == e.Event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// build is a build finished, as it is notified.
+type build struct {
+	webhook.Event
+	Link string
+}
+
+func (b build) failed() bool {
+	return b.Event.Event == webhook.Failed
+}
+
+// summary returns a line saying how the build went.
+func (b build) summary() string {
+	took := time.Duration(b.Duration * float64(time.Second)).Round(time.Second).String()
+
+	if b.failed() {
+		return fmt.Sprintf("%s failed on %s after %s", b.Plan, b.Host, took)
+	}
+
+	if b.Tag != "" {
+		return fmt.Sprintf("%s built %s on %s in %s", b.Plan, b.Tag, b.Host, took)
+	}
+
+	return fmt.Sprintf("%s built on %s in %s", b.Plan, b.Host, took)
+}
+
+// pushed returns the images pushed, with the digests of their manifests.
+func (b build) pushed() []string {
+	pushed := []string{}
+	for _, p := range b.Pushed {
+		if p.Digest != "" {
+			pushed = append(pushed, p.Name+"@"+p.Digest)
+		} else {
+			pushed = append(pushed, p.Name)
+		}
+	}
+
+	return pushed
+}
@@ -0,0 +1,248 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/webhook"
+	. "gopkg.in/check.v1"
+)
+
+type notifySuite struct{}
+
+var _ = Suite(&notifySuite{})
+
+func TestNotify(t *T) {
+	TestingT(t)
+}
+
+var (
+	succeeded = webhook.Event{
+		Event:    webhook.Succeeded,
+		Plan:     "box.rb",
+		Image:    "sha256:5c4b",
+		Tag:      "myapp:1.0",
+		Finished: time.Date(2026, 10, 15, 12, 3, 12, 0, time.UTC),
+		Duration: 192.4,
+		Host:     "builder-1",
+		Build:    "0123456789abcdef",
+		Pushed:   []webhook.Pushed{{Name: "registry.example.com/myapp:1.0", Digest: "sha256:9f86"}},
+	}
+
+	failed = webhook.Event{
+		Event:    webhook.Failed,
+		Plan:     "box.rb",
+		Error:    "exit status 1",
+		Finished: time.Date(2026, 10, 15, 12, 0, 2, 0, time.UTC),
+		Duration: 2,
+		Host:     "builder-1",
+		Log:      "make: *** [all] Error 1\n",
+	}
+)
+
+func writeConfig(c *C, config string) string {
+	fn := filepath.Join(c.MkDir(), "config")
+	c.Assert(ioutil.WriteFile(fn, []byte(config), 0600), IsNil)
+	return fn
+}
+
+func (ns *notifySuite) TestLoad(c *C) {
+	config, err := Load(filepath.Join(c.MkDir(), "config"))
+	c.Assert(err, IsNil)
+	c.Assert(config.Notify.Empty(), Equals, true)
+
+	os.Setenv("BOX_TEST_SLACK", "https://hooks.slack.com/services/T0/B0/X")
+	defer os.Unsetenv("BOX_TEST_SLACK")
+
+	config, err = Load(writeConfig(c, `
+notify:
+  slack:
+    - webhook: $BOX_TEST_SLACK
+      events: [failed]
+  email:
+    - server: smtp.example.com:587
+      from: box@example.com
+      to: [ops@example.com]
+`))
+	c.Assert(err, IsNil)
+	c.Assert(config.Notify.Empty(), Equals, false)
+	c.Assert(config.Notify.Slack[0].Webhook, Equals, "https://hooks.slack.com/services/T0/B0/X")
+
+	for _, invalid := range []string{
+		"notify: [",
+		"notify:\n  slack:\n    - channel: '#builds'",
+		"notify:\n  slack:\n    - webhook: https://example.com\n      events: [started]",
+		"notify:\n  email:\n    - server: smtp.example.com:25\n      from: box@example.com",
+		"notify:\n  link: '{{ .Build'",
+	} {
+		_, err := Load(writeConfig(c, invalid))
+		c.Assert(err, ErrorMatches, "invalid configuration .*", Commentf("%s", invalid))
+	}
+}
+
+func (ns *notifySuite) TestSlack(c *C) {
+	messages := []slackMessage{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := slackMessage{}
+		c.Check(json.NewDecoder(r.Body).Decode(&m), IsNil)
+		messages = append(messages, m)
+	}))
+	defer server.Close()
+
+	config, err := Load(writeConfig(c, fmt.Sprintf(`
+notify:
+  link: https://box.example.com/v1/builds/{{ .Build }}
+  slack:
+    - webhook: %s
+      channel: '#builds'
+    - webhook: %s
+      events: [failed]
+`, server.URL, server.URL)))
+	c.Assert(err, IsNil)
+
+	c.Assert(config.Notify.Notify(context.Background(), succeeded), HasLen, 0)
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0], DeepEquals, slackMessage{
+		Channel: "#builds",
+		Text:    "box.rb built myapp:1.0 on builder-1 in 3m12s",
+		Attachments: []slackAttachment{{
+			Color:     "good",
+			Title:     "box.rb built myapp:1.0 on builder-1 in 3m12s",
+			TitleLink: "https://box.example.com/v1/builds/0123456789abcdef",
+			Fields: []slackField{
+				{Title: "Image", Value: "`sha256:5c4b`"},
+				{Title: "Pushed", Value: "`registry.example.com/myapp:1.0@sha256:9f86`"},
+				{Title: "Build", Value: "0123456789abcdef", Short: true},
+			},
+		}},
+	})
+
+	// both are notified of builds which failed.
+	c.Assert(config.Notify.Notify(context.Background(), failed), HasLen, 0)
+	c.Assert(messages, HasLen, 3)
+	c.Assert(messages[2].Attachments[0].Color, Equals, "danger")
+	c.Assert(messages[2].Attachments[0].Text, Equals, "```make: *** [all] Error 1\n```")
+	c.Assert(messages[2].Attachments[0].Fields, DeepEquals, []slackField{{Title: "Error", Value: "exit status 1"}})
+
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer refusing.Close()
+
+	n := &Notifiers{Slack: []Slack{{Webhook: refusing.URL}}}
+	errs := n.Notify(context.Background(), failed)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, "could not notify slack: 403 Forbidden: invalid_token")
+}
+
+// smtpServer accepts one message, as an SMTP server which offers no
+// extensions, and sends its envelope and content on the channel returned.
+func smtpServer(c *C) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	received := make(chan []string, 1)
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+
+		lines := []string{}
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+
+			if data {
+				if line == "." {
+					data = false
+					fmt.Fprintf(conn, "250 queued\r\n")
+				} else {
+					lines = append(lines, line)
+				}
+				continue
+			}
+
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				fmt.Fprintf(conn, "250 localhost\r\n")
+			case "MAIL", "RCPT":
+				lines = append(lines, line)
+				fmt.Fprintf(conn, "250 ok\r\n")
+			case "DATA":
+				data = true
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "221 bye\r\n")
+				received <- lines
+				return
+			default:
+				fmt.Fprintf(conn, "502 %s not implemented\r\n", verb)
+			}
+		}
+	}()
+
+	return l.Addr().String(), received
+}
+
+func (ns *notifySuite) TestEmail(c *C) {
+	addr, received := smtpServer(c)
+
+	n := &Notifiers{Email: []Email{{
+		Server: addr,
+		From:   "Box <box@example.com>",
+		To:     []string{"ops@example.com"},
+	}}}
+
+	c.Assert(n.Notify(context.Background(), succeeded), HasLen, 0)
+	c.Assert(<-received, DeepEquals, []string{
+		"MAIL FROM:<box@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"From: Box <box@example.com>",
+		"To: ops@example.com",
+		"Subject: [box] box.rb built myapp:1.0 on builder-1 in 3m12s",
+		"Date: Thu, 15 Oct 2026 12:03:12 +0000",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"box.rb built myapp:1.0 on builder-1 in 3m12s.",
+		"",
+		"Image: sha256:5c4b",
+		"Pushed: registry.example.com/myapp:1.0@sha256:9f86",
+		"Build: 0123456789abcdef",
+	})
+
+	addr, received = smtpServer(c)
+	n.Email[0].Server = addr
+
+	c.Assert(n.Notify(context.Background(), failed), HasLen, 0)
+	lines := <-received
+	c.Assert(lines[4], Equals, "Subject: [box] box.rb failed on builder-1 after 2s")
+	c.Assert(lines[len(lines)-3:], DeepEquals, []string{"Error: exit status 1", "", "make: *** [all] Error 1"})
+
+	// builds which succeeded are not sent to those notified of failures.
+	n.Email[0].Events = []string{"failed"}
+	n.Email[0].Server = "127.0.0.1:1"
+	c.Assert(n.Notify(context.Background(), succeeded), HasLen, 0)
+}
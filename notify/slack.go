@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Slack posts builds to an incoming webhook of Slack.
+type Slack struct {
+	Webhook string   `json:"webhook"`           // the URL of the webhook; environment variables are expanded
+	Channel string   `json:"channel,omitempty"` // if set, the channel posted to instead of that of the webhook
+	Events  []string `json:"events,omitempty"`  // succeeded, failed or both, if empty
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color     string       `json:"color"`
+	Title     string       `json:"title"`
+	TitleLink string       `json:"title_link,omitempty"`
+	Text      string       `json:"text,omitempty"`
+	Fields    []slackField `json:"fields,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
+}
+
+// message returns the message of the build.
+func (s Slack) message(b build) slackMessage {
+	a := slackAttachment{Color: "good", Title: b.summary(), TitleLink: b.Link}
+
+	if b.failed() {
+		a.Color = "danger"
+		a.Fields = append(a.Fields, slackField{Title: "Error", Value: b.Error})
+		if b.Log != "" {
+			a.Text = "```" + b.Log + "```"
+		}
+	} else {
+		a.Fields = append(a.Fields, slackField{Title: "Image", Value: "`" + b.Image + "`"})
+		if pushed := b.pushed(); len(pushed) > 0 {
+			a.Fields = append(a.Fields, slackField{Title: "Pushed", Value: "`" + strings.Join(pushed, "`\n`") + "`"})
+		}
+	}
+
+	if b.Build != "" {
+		a.Fields = append(a.Fields, slackField{Title: "Build", Value: b.Build, Short: true})
+	}
+
+	return slackMessage{Channel: s.Channel, Text: b.summary(), Attachments: []slackAttachment{a}}
+}
+
+func (s Slack) notify(ctx context.Context, b build) error {
+	content, err := json.Marshal(s.message(b))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.Webhook, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
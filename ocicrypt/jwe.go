@@ -0,0 +1,432 @@
+package ocicrypt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The algorithms of JWE the keys of layers are wrapped with, as ocicrypt
+// wraps them: RSA keys with RSA-OAEP, EC keys with ECDH-ES+A256KW, and the
+// content with A256GCM.
+const (
+	algRSAOAEP      = "RSA-OAEP"
+	algECDHESA256KW = "ECDH-ES+A256KW"
+	encA256GCM      = "A256GCM"
+)
+
+var b64 = base64.RawURLEncoding
+
+// jwk is the public key of an EC key pair, as JWE headers give it.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jweHeader is the header of a JWE, as much of it as is read.
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	Epk *jwk   `json:"epk,omitempty"`
+}
+
+// merge returns the header with the fields set in other in place of its own.
+func (h jweHeader) merge(other *jweHeader) jweHeader {
+	if other == nil {
+		return h
+	}
+
+	if other.Alg != "" {
+		h.Alg = other.Alg
+	}
+
+	if other.Enc != "" {
+		h.Enc = other.Enc
+	}
+
+	if other.Epk != nil {
+		h.Epk = other.Epk
+	}
+
+	return h
+}
+
+type jweRecipient struct {
+	Header       *jweHeader `json:"header,omitempty"`
+	EncryptedKey string     `json:"encrypted_key,omitempty"`
+}
+
+// jwe is a JWE in the JSON serialization, general or, with one recipient,
+// flattened.
+type jwe struct {
+	Protected   string         `json:"protected,omitempty"`
+	Unprotected *jweHeader     `json:"unprotected,omitempty"`
+	Recipients  []jweRecipient `json:"recipients,omitempty"`
+	Header      *jweHeader     `json:"header,omitempty"`
+	Key         string         `json:"encrypted_key,omitempty"`
+	AAD         string         `json:"aad,omitempty"`
+	IV          string         `json:"iv"`
+	Ciphertext  string         `json:"ciphertext"`
+	Tag         string         `json:"tag"`
+}
+
+// curves are the curves EC keys may be on, by their name in JWKs.
+var curves = map[string]ecdh.Curve{
+	"P-256": ecdh.P256(),
+	"P-384": ecdh.P384(),
+	"P-521": ecdh.P521(),
+}
+
+func curveName(curve ecdh.Curve) string {
+	for name, c := range curves {
+		if c == curve {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// encryptJWE encrypts the payload for each of the recipients, RSA or EC
+// public keys.
+func encryptJWE(payload []byte, recipients []crypto.PublicKey) ([]byte, error) {
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+
+	j := jwe{}
+
+	for _, recipient := range recipients {
+		header, key, err := wrapKey(cek, recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		j.Recipients = append(j.Recipients, jweRecipient{Header: header, EncryptedKey: b64.EncodeToString(key)})
+	}
+
+	protected, err := json.Marshal(jweHeader{Enc: encA256GCM})
+	if err != nil {
+		return nil, err
+	}
+	j.Protected = b64.EncodeToString(protected)
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nil, iv, payload, []byte(j.Protected))
+	j.IV = b64.EncodeToString(iv)
+	j.Ciphertext = b64.EncodeToString(sealed[:len(sealed)-gcm.Overhead()])
+	j.Tag = b64.EncodeToString(sealed[len(sealed)-gcm.Overhead():])
+
+	return json.Marshal(j)
+}
+
+// decryptJWE decrypts the JWE with the first of the private keys it was
+// encrypted for.
+func decryptJWE(content []byte, keys []crypto.PrivateKey) ([]byte, error) {
+	j := jwe{}
+	if err := json.Unmarshal(content, &j); err != nil {
+		return nil, fmt.Errorf("invalid JWE: %v", err)
+	}
+
+	protected := &jweHeader{}
+	if j.Protected != "" {
+		decoded, err := b64.DecodeString(j.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWE: %v", err)
+		}
+
+		if err := json.Unmarshal(decoded, protected); err != nil {
+			return nil, fmt.Errorf("invalid JWE: %v", err)
+		}
+	}
+
+	common := jweHeader{}.merge(protected).merge(j.Unprotected)
+	if common.Enc != encA256GCM {
+		return nil, fmt.Errorf("unsupported JWE encryption %q", common.Enc)
+	}
+
+	recipients := j.Recipients
+	if len(recipients) == 0 {
+		recipients = []jweRecipient{{Header: j.Header, EncryptedKey: j.Key}}
+	}
+
+	for _, recipient := range recipients {
+		header := common.merge(recipient.Header)
+
+		encryptedKey, err := b64.DecodeString(recipient.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWE: %v", err)
+		}
+
+		for _, key := range keys {
+			cek, err := unwrapKey(header, encryptedKey, key)
+			if err != nil {
+				continue
+			}
+
+			return openJWE(j, cek)
+		}
+	}
+
+	return nil, errors.New("none of the keys can decrypt it")
+}
+
+func newGCM(cek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// openJWE decrypts the content of the JWE with the content encryption key.
+func openJWE(j jwe, cek []byte) ([]byte, error) {
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := b64.DecodeString(j.IV)
+	if err != nil || len(iv) != gcm.NonceSize() {
+		return nil, errors.New("invalid JWE: bad iv")
+	}
+
+	ciphertext, err := b64.DecodeString(j.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE: %v", err)
+	}
+
+	tag, err := b64.DecodeString(j.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE: %v", err)
+	}
+
+	aad := j.Protected
+	if j.AAD != "" {
+		aad += "." + j.AAD
+	}
+
+	return gcm.Open(nil, iv, append(ciphertext, tag...), []byte(aad))
+}
+
+// wrapKey wraps the content encryption key for the recipient.
+func wrapKey(cek []byte, recipient crypto.PublicKey) (*jweHeader, []byte, error) {
+	switch pub := recipient.(type) {
+	case *rsa.PublicKey:
+		key, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, cek, nil)
+		return &jweHeader{Alg: algRSAOAEP}, key, err
+	case *ecdsa.PublicKey:
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := curveName(ecdhPub.Curve())
+		if name == "" {
+			return nil, nil, errors.New("unsupported curve")
+		}
+
+		ephemeral, err := ecdhPub.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		kek, err := agreeKey(ephemeral, ecdhPub)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err := keyWrap(kek, cek)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the public key is 0x04, then x and y, each of the same length.
+		point := ephemeral.PublicKey().Bytes()[1:]
+		epk := &jwk{
+			Kty: "EC",
+			Crv: name,
+			X:   b64.EncodeToString(point[:len(point)/2]),
+			Y:   b64.EncodeToString(point[len(point)/2:]),
+		}
+
+		return &jweHeader{Alg: algECDHESA256KW, Epk: epk}, key, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %T: only RSA and EC keys are", recipient)
+	}
+}
+
+// unwrapKey unwraps the content encryption key with the private key.
+func unwrapKey(header jweHeader, encryptedKey []byte, key crypto.PrivateKey) ([]byte, error) {
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		if header.Alg != algRSAOAEP {
+			return nil, errors.New("not for an RSA key")
+		}
+
+		return rsa.DecryptOAEP(sha1.New(), rand.Reader, priv, encryptedKey, nil)
+	case *ecdsa.PrivateKey:
+		if header.Alg != algECDHESA256KW || header.Epk == nil {
+			return nil, errors.New("not for an EC key")
+		}
+
+		ecdhPriv, err := priv.ECDH()
+		if err != nil {
+			return nil, err
+		}
+
+		curve, ok := curves[header.Epk.Crv]
+		if !ok || curve != ecdhPriv.Curve() {
+			return nil, errors.New("not for the curve of the key")
+		}
+
+		x, err := b64.DecodeString(header.Epk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := b64.DecodeString(header.Epk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		epk, err := curve.NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+
+		kek, err := agreeKey(ecdhPriv, epk)
+		if err != nil {
+			return nil, err
+		}
+
+		return keyUnwrap(kek, encryptedKey)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// agreeKey derives the key encryption key of ECDH-ES+A256KW from the key
+// agreed, with the concat KDF of NIST SP 800-56A, as RFC 7518 does without
+// party information.
+func agreeKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) ([]byte, error) {
+	z, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	lengthPrefixed := func(b []byte) []byte {
+		l := make([]byte, 4)
+		binary.BigEndian.PutUint32(l, uint32(len(b)))
+		return append(l, b...)
+	}
+
+	h := sha256.New()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(z)
+	h.Write(lengthPrefixed([]byte(algECDHESA256KW)))
+	h.Write(lengthPrefixed(nil)) // apu
+	h.Write(lengthPrefixed(nil)) // apv
+	h.Write([]byte{0, 0, 1, 0})  // the length of the key, 256 bits
+
+	return h.Sum(nil), nil
+}
+
+// keyWrapIV is the initial value of the AES key wrap of RFC 3394.
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// keyWrap wraps the key with the key encryption key, as RFC 3394 does.
+func keyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 {
+		return nil, errors.New("the key to wrap must be a multiple of 64 bits")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	r := make([]byte, len(key))
+	copy(r, key)
+
+	a := make([]byte, 8)
+	copy(a, keyWrapIV)
+
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(b, a)
+			copy(b[8:], r[i*8:i*8+8])
+			block.Encrypt(b, b)
+
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(r[i*8:], b[8:])
+		}
+	}
+
+	return append(a, r...), nil
+}
+
+// keyUnwrap unwraps the key wrapped by keyWrap.
+func keyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid wrapped key")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r[i*8:i*8+8])
+			block.Decrypt(b, b)
+
+			copy(a, b[:8])
+			copy(r[i*8:], b[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, errors.New("the key can't unwrap it")
+	}
+
+	return r, nil
+}
@@ -0,0 +1,330 @@
+// Package ocicrypt encrypts and decrypts the layers of images as the OCI image
+// encryption spec does, and as the ocicrypt library containerd, podman and
+// skopeo use does, so encrypted images can be kept on registries which are not
+// trusted with their content.
+//
+// Each layer is encrypted with its own key, with AES-256 in CTR mode and an
+// HMAC-SHA256 of the encrypted layer. The key is wrapped for each recipient
+// with JWE, and kept with the layer's descriptor in its annotations; its
+// media type gets +encrypted. The configuration of the image, with the diff
+// IDs of the layers, is not encrypted.
+package ocicrypt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// MediaTypeSuffix is added to the media types of layers which are encrypted.
+const MediaTypeSuffix = "+encrypted"
+
+// The annotations of the descriptors of encrypted layers.
+const (
+	// AnnotationKeysJWE is the key of the layer wrapped for each recipient,
+	// a JWE, base64 encoded.
+	AnnotationKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	// AnnotationPubOpts are the public options of the cipher, with the HMAC
+	// of the encrypted layer, base64 encoded JSON.
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+)
+
+// cipherAES256CTR is the only cipher of the spec.
+const cipherAES256CTR = "AES_256_CTR_HMAC_SHA256"
+
+// privateOptions are the options of the cipher which are encrypted for the
+// recipients.
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// publicOptions are the options of the cipher anyone may read.
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// IsEncrypted is true if layers of the media type are encrypted.
+func IsEncrypted(mediaType string) bool {
+	return strings.HasSuffix(mediaType, MediaTypeSuffix)
+}
+
+// Encrypt encrypts the layer read from r, whose descriptor has the digest,
+// into w for each of the recipients, and returns the annotations to add to its
+// descriptor.
+func Encrypt(w io.Writer, r io.Reader, layerDigest string, recipients []crypto.PublicKey) (map[string]string, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients to encrypt for")
+	}
+
+	private := privateOptions{
+		SymmetricKey:  make([]byte, 32),
+		Digest:        layerDigest,
+		CipherOptions: map[string][]byte{"nonce": make([]byte, aes.BlockSize)},
+	}
+
+	if _, err := rand.Read(private.SymmetricKey); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(private.CipherOptions["nonce"]); err != nil {
+		return nil, err
+	}
+
+	stream, mac, err := newCipher(private)
+	if err != nil {
+		return nil, err
+	}
+
+	// the HMAC is of the encrypted layer.
+	sw := cipher.StreamWriter{S: stream, W: io.MultiWriter(w, mac)}
+	if _, err := io.Copy(sw, r); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(private)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := encryptJWE(payload, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := json.Marshal(publicOptions{
+		Cipher:        cipherAES256CTR,
+		Hmac:          mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		AnnotationKeysJWE: base64.StdEncoding.EncodeToString(keys),
+		AnnotationPubOpts: base64.StdEncoding.EncodeToString(public),
+	}, nil
+}
+
+// Decrypt decrypts the layer read from r, whose descriptor has the
+// annotations, into w with the first of the keys it was encrypted for. It
+// returns the digest of the layer decrypted. If it returns an error, what it
+// wrote must not be used: the layer is only checked once all of it is read.
+func Decrypt(w io.Writer, r io.Reader, annotations map[string]string, keys []crypto.PrivateKey) (string, error) {
+	public := publicOptions{}
+	content, err := base64.StdEncoding.DecodeString(annotations[AnnotationPubOpts])
+	if err != nil || json.Unmarshal(content, &public) != nil {
+		return "", fmt.Errorf("invalid %s annotation", AnnotationPubOpts)
+	}
+
+	if public.Cipher != cipherAES256CTR {
+		return "", fmt.Errorf("unsupported cipher %q", public.Cipher)
+	}
+
+	private, err := unwrapOptions(annotations[AnnotationKeysJWE], keys)
+	if err != nil {
+		return "", err
+	}
+
+	layerDigest, err := digest.Parse(private.Digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest of the layer: %v", err)
+	}
+
+	stream, mac, err := newCipher(*private)
+	if err != nil {
+		return "", err
+	}
+
+	verifier := layerDigest.Verifier()
+
+	sr := cipher.StreamReader{S: stream, R: io.TeeReader(r, mac)}
+	if _, err := io.Copy(io.MultiWriter(w, verifier), sr); err != nil {
+		return "", err
+	}
+
+	if !hmac.Equal(mac.Sum(nil), public.Hmac) {
+		return "", errors.New("the HMAC of the layer does not match: it was tampered with")
+	}
+
+	if !verifier.Verified() {
+		return "", fmt.Errorf("the layer decrypted does not have the digest %s", layerDigest)
+	}
+
+	return layerDigest.String(), nil
+}
+
+// unwrapOptions decrypts the private options of the cipher with the first of
+// the keys one of the JWEs, separated by commas, was encrypted for.
+func unwrapOptions(annotation string, keys []crypto.PrivateKey) (*privateOptions, error) {
+	if annotation == "" {
+		return nil, fmt.Errorf("no %s annotation", AnnotationKeysJWE)
+	}
+
+	var lastErr error
+
+	for _, encoded := range strings.Split(annotation, ",") {
+		content, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation", AnnotationKeysJWE)
+		}
+
+		payload, err := decryptJWE(content, keys)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		private := &privateOptions{}
+		if err := json.Unmarshal(payload, private); err != nil {
+			return nil, fmt.Errorf("invalid options of the cipher: %v", err)
+		}
+
+		return private, nil
+	}
+
+	return nil, fmt.Errorf("can't decrypt the layer: %v", lastErr)
+}
+
+// newCipher returns the stream and HMAC of the cipher.
+func newCipher(private privateOptions) (cipher.Stream, hash.Hash, error) {
+	if len(private.SymmetricKey) != 32 {
+		return nil, nil, fmt.Errorf("invalid key of %d bytes: must be 32", len(private.SymmetricKey))
+	}
+
+	nonce := private.CipherOptions["nonce"]
+	if len(nonce) != aes.BlockSize {
+		return nil, nil, fmt.Errorf("invalid nonce of %d bytes: must be %d", len(nonce), aes.BlockSize)
+	}
+
+	block, err := aes.NewCipher(private.SymmetricKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cipher.NewCTR(block, nonce), hmac.New(sha256.New, private.SymmetricKey), nil
+}
+
+// readPEM returns the PEM blocks of the file.
+func readPEM(file string) ([]*pem.Block, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []*pem.Block{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s has no PEM keys", file)
+	}
+
+	return blocks, nil
+}
+
+// LoadRecipients reads the public keys, RSA or EC, to encrypt for from the
+// PEM files: public keys, or X.509 certificates.
+func LoadRecipients(files []string) ([]crypto.PublicKey, error) {
+	recipients := []crypto.PublicKey{}
+
+	for _, file := range files {
+		blocks, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			var key crypto.PublicKey
+
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "RSA PUBLIC KEY":
+				key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+					key = cert.PublicKey
+				}
+			default:
+				err = fmt.Errorf("%s is not a public key", block.Type)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+
+			recipients = append(recipients, key)
+		}
+	}
+
+	return recipients, nil
+}
+
+// LoadKeys reads the private keys, RSA or EC, to decrypt with from the PEM
+// files. Keys encrypted with a passphrase are not supported.
+func LoadKeys(files []string) ([]crypto.PrivateKey, error) {
+	keys := []crypto.PrivateKey{}
+
+	for _, file := range files {
+		blocks, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			var key crypto.PrivateKey
+
+			switch block.Type {
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			case "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "EC PRIVATE KEY":
+				key, err = x509.ParseECPrivateKey(block.Bytes)
+			case "ENCRYPTED PRIVATE KEY":
+				err = fmt.Errorf("keys encrypted with a passphrase are not supported")
+			default:
+				continue
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no private keys to decrypt with")
+	}
+
+	return keys, nil
+}
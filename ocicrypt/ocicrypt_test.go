@@ -0,0 +1,155 @@
+package ocicrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	. "testing"
+
+	digest "github.com/opencontainers/go-digest"
+	. "gopkg.in/check.v1"
+)
+
+type ocicryptSuite struct{}
+
+var _ = Suite(&ocicryptSuite{})
+
+func TestOCICrypt(t *T) {
+	TestingT(t)
+}
+
+func writeKeys(c *C, dir, name string, key crypto.Signer) (string, string) {
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, IsNil)
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	c.Assert(err, IsNil)
+
+	privFile := filepath.Join(dir, name+".key")
+	pubFile := filepath.Join(dir, name+".pub")
+	c.Assert(ioutil.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600), IsNil)
+
+	return privFile, pubFile
+}
+
+func (ocs *ocicryptSuite) TestEncryptDecrypt(c *C) {
+	dir := c.MkDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	c.Assert(err, IsNil)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	rsaPriv, rsaPub := writeKeys(c, dir, "rsa", rsaKey)
+	ecPriv, ecPub := writeKeys(c, dir, "ec", ecKey)
+	otherPriv, _ := writeKeys(c, dir, "other", otherKey)
+
+	recipients, err := LoadRecipients([]string{rsaPub, ecPub})
+	c.Assert(err, IsNil)
+	c.Assert(recipients, HasLen, 2)
+
+	layer := bytes.Repeat([]byte("a layer of an image "), 10000)
+	layerDigest := digest.FromBytes(layer).String()
+
+	encrypted := new(bytes.Buffer)
+	annotations, err := Encrypt(encrypted, bytes.NewReader(layer), layerDigest, recipients)
+	c.Assert(err, IsNil)
+	c.Assert(encrypted.Len(), Equals, len(layer))
+	c.Assert(bytes.Equal(encrypted.Bytes(), layer), Equals, false)
+	c.Assert(annotations[AnnotationKeysJWE], Not(Equals), "")
+	c.Assert(annotations[AnnotationPubOpts], Not(Equals), "")
+
+	for _, file := range []string{rsaPriv, ecPriv} {
+		keys, err := LoadKeys([]string{file})
+		c.Assert(err, IsNil)
+
+		decrypted := new(bytes.Buffer)
+		d, err := Decrypt(decrypted, bytes.NewReader(encrypted.Bytes()), annotations, keys)
+		c.Assert(err, IsNil, Commentf("%s", file))
+		c.Assert(d, Equals, layerDigest)
+		c.Assert(bytes.Equal(decrypted.Bytes(), layer), Equals, true)
+	}
+
+	keys, err := LoadKeys([]string{otherPriv})
+	c.Assert(err, IsNil)
+	_, err = Decrypt(ioutil.Discard, bytes.NewReader(encrypted.Bytes()), annotations, keys)
+	c.Assert(err, ErrorMatches, "can't decrypt the layer: none of the keys can decrypt it")
+
+	keys, err = LoadKeys([]string{otherPriv, rsaPriv})
+	c.Assert(err, IsNil)
+
+	tampered := append([]byte{}, encrypted.Bytes()...)
+	tampered[100] ^= 1
+	_, err = Decrypt(ioutil.Discard, bytes.NewReader(tampered), annotations, keys)
+	c.Assert(err, ErrorMatches, "the HMAC of the layer does not match.*")
+
+	_, err = Encrypt(ioutil.Discard, bytes.NewReader(layer), layerDigest, nil)
+	c.Assert(err, NotNil)
+
+	_, err = LoadRecipients([]string{rsaPriv})
+	c.Assert(err, ErrorMatches, ".*PRIVATE KEY is not a public key")
+
+	_, err = LoadKeys([]string{rsaPub})
+	c.Assert(err, ErrorMatches, "no private keys to decrypt with")
+}
+
+func (ocs *ocicryptSuite) TestIsEncrypted(c *C) {
+	c.Assert(IsEncrypted("application/vnd.oci.image.layer.v1.tar+gzip+encrypted"), Equals, true)
+	c.Assert(IsEncrypted("application/vnd.oci.image.layer.v1.tar+gzip"), Equals, false)
+}
+
+// TestKeyWrap checks the key wrap against the test vector of RFC 3394 for a
+// 256 bit key wrapped with a 256 bit key.
+func (ocs *ocicryptSuite) TestKeyWrap(c *C) {
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+	expected, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+
+	wrapped, err := keyWrap(kek, key)
+	c.Assert(err, IsNil)
+	c.Assert(wrapped, DeepEquals, expected)
+
+	unwrapped, err := keyUnwrap(kek, wrapped)
+	c.Assert(err, IsNil)
+	c.Assert(unwrapped, DeepEquals, key)
+
+	wrapped[0] ^= 1
+	_, err = keyUnwrap(kek, wrapped)
+	c.Assert(err, NotNil)
+}
+
+// TestFlattenedJWE checks a JWE in the flattened serialization, as encrypters
+// write for a single recipient, can be decrypted.
+func (ocs *ocicryptSuite) TestFlattenedJWE(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+
+	content, err := encryptJWE([]byte(`{"symkey":"a2V5"}`), []crypto.PublicKey{&key.PublicKey})
+	c.Assert(err, IsNil)
+
+	general := jwe{}
+	c.Assert(json.Unmarshal(content, &general), IsNil)
+
+	flattened := general
+	flattened.Header = general.Recipients[0].Header
+	flattened.Key = general.Recipients[0].EncryptedKey
+	flattened.Recipients = nil
+
+	content, err = json.Marshal(flattened)
+	c.Assert(err, IsNil)
+
+	payload, err := decryptJWE(content, []crypto.PrivateKey{key})
+	c.Assert(err, IsNil)
+	c.Assert(string(payload), Equals, `{"symkey":"a2V5"}`)
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/bake"
+	"github.com/box-builder/box/bench"
+	"github.com/box-builder/box/builder"
+	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/dockerfile"
+	"github.com/box-builder/box/graph"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/matrix"
+	"github.com/box-builder/box/multi"
+	"github.com/box-builder/box/registry"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+func runMulti(ctx *cli.Context) {
+	copy.NoOut = true
+	notrim := ctx.Bool("no-trim")
+	builders := []*builder.Builder{}
+	log := logger.New("main", notrim)
+
+	args := ctx.Args()
+	if len(args) < 1 {
+		cli.ShowAppHelp(ctx)
+		log.Error("Please provide a filename to process!")
+		os.Exit(1)
+	}
+
+	if err := checkDisk(ctx, log); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	for _, filename := range args {
+		cancelCtx, cancel := context.WithCancel(context.Background())
+		runChan := make(chan struct{})
+		buildConfig := builder.BuildConfig{
+			Globals: &types.Global{
+				ShowRun:           false,
+				TTY:               true,
+				OmitFuncs:         append(ctx.StringSlice("omit"), "debug"),
+				Profiles:          ctx.GlobalStringSlice("profile"),
+				Platform:          ctx.GlobalString("platform"),
+				Compression:       ctx.GlobalString("compression"),
+				Reproducible:      ctx.GlobalBool("reproducible"),
+				Exclude:           ctx.GlobalStringSlice("exclude"),
+				SignBy:            ctx.GlobalString("sign-by"),
+				EncryptRecipients: ctx.GlobalStringSlice("encrypt-recipient"),
+				DecryptKeys:       ctx.GlobalStringSlice("decrypt-key"),
+				EagerPull:         ctx.GlobalBool("eager-pull"),
+				Executor:          ctx.GlobalString("executor"),
+				Runtime:           ctx.GlobalString("runtime"),
+				Snapshotter:       ctx.GlobalString("snapshotter"),
+				KubeRegistry:      ctx.GlobalString("kube-registry"),
+				SignaturePolicy:   ctx.GlobalString("signature-policy"),
+				ScanSecrets:       ctx.GlobalString("scan-secrets"),
+				Scheduler:         scheduler,
+				Policy:            registryPolicy,
+				GzipWorkers:       gzipWorkers,
+				SpillThreshold:    spillThreshold,
+				Signals:           signal.Handler,
+				Security:          globalSecurity(ctx),
+				Cache:             getCache(ctx),
+				CacheFrom:         ctx.GlobalStringSlice("cache-from"),
+				CacheFromImages:   ctx.GlobalStringSlice("cache-from-image"),
+				CacheTo:           ctx.GlobalString("cache-to"),
+				Logger:            logger.New(filename, notrim),
+				Context:           cancelCtx,
+			},
+			Runner:   runChan,
+			FileName: filename,
+		}
+		signal.Handler.AddFunc(cancel)
+		signal.Handler.AddRunner(runChan)
+
+		b, err := builder.NewBuilder(buildConfig)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		builders = append(builders, b)
+	}
+
+	weights, err := parseWeights(ctx.StringSlice("weight"), args)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// plans which tag the images others start from are built first. Plans
+	// which can't be recorded fail when they are built.
+	graphs := []*graph.Graph{}
+	for _, filename := range args {
+		g, err := planGraph(ctx, filename)
+		if err != nil {
+			g = graph.New()
+		}
+		graphs = append(graphs, g)
+	}
+
+	mb := multi.NewBuilder(builders)
+	if err := mb.Schedule(weights, graph.Needs(graphs)); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	mb.Build()
+	if err := mb.Wait(); err != nil {
+		log.Error(err)
+		os.Exit(2)
+	}
+}
+
+func runMatrix(ctx *cli.Context) {
+	copy.NoOut = true
+	notrim := ctx.GlobalBool("no-trim")
+	log := logger.New("matrix", notrim)
+
+	args := ctx.Args()
+	if len(args) != 1 {
+		cli.ShowCommandHelp(ctx, "matrix")
+		log.Error("Please provide a filename to process!")
+		os.Exit(1)
+	}
+
+	if err := checkDisk(ctx, log); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	axes, err := matrix.Parse(ctx.StringSlice("var"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	variants := matrix.Expand(axes)
+	if len(variants) == 0 {
+		log.Error("Please provide at least one matrix variable with --var")
+		os.Exit(1)
+	}
+
+	tags := []string{}
+	builders := []*builder.Builder{}
+
+	for _, variant := range variants {
+		var tag string
+
+		if ctx.String("tag") != "" {
+			tag, err = variant.Tag(ctx.String("tag"))
+			if err != nil {
+				log.Error(fmt.Sprintf("Invalid tag template for %s: %v", variant, err))
+				os.Exit(1)
+			}
+		}
+
+		cancelCtx, cancel := context.WithCancel(context.Background())
+		buildConfig := builder.BuildConfig{
+			Globals: &types.Global{
+				ShowRun:           false,
+				TTY:               true,
+				OmitFuncs:         append(ctx.GlobalStringSlice("omit"), "debug"),
+				Profiles:          ctx.GlobalStringSlice("profile"),
+				Platform:          ctx.GlobalString("platform"),
+				Compression:       ctx.GlobalString("compression"),
+				Reproducible:      ctx.GlobalBool("reproducible"),
+				Exclude:           ctx.GlobalStringSlice("exclude"),
+				SignBy:            ctx.GlobalString("sign-by"),
+				EncryptRecipients: ctx.GlobalStringSlice("encrypt-recipient"),
+				DecryptKeys:       ctx.GlobalStringSlice("decrypt-key"),
+				EagerPull:         ctx.GlobalBool("eager-pull"),
+				Executor:          ctx.GlobalString("executor"),
+				Runtime:           ctx.GlobalString("runtime"),
+				Snapshotter:       ctx.GlobalString("snapshotter"),
+				KubeRegistry:      ctx.GlobalString("kube-registry"),
+				SignaturePolicy:   ctx.GlobalString("signature-policy"),
+				ScanSecrets:       ctx.GlobalString("scan-secrets"),
+				Scheduler:         scheduler,
+				Policy:            registryPolicy,
+				GzipWorkers:       gzipWorkers,
+				SpillThreshold:    spillThreshold,
+				Signals:           signal.Handler,
+				Security:          globalSecurity(ctx),
+				Cache:             getCache(ctx),
+				CacheFrom:         ctx.GlobalStringSlice("cache-from"),
+				CacheFromImages:   ctx.GlobalStringSlice("cache-from-image"),
+				CacheTo:           ctx.GlobalString("cache-to"),
+				Vars:              variant,
+				Logger:            logger.New(fmt.Sprintf("%s %s", args[0], variant), notrim),
+				Context:           cancelCtx,
+			},
+			Runner:   make(chan struct{}),
+			FileName: args[0],
+		}
+
+		b, err := mkBuilder(cancel, buildConfig)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		tags = append(tags, tag)
+		builders = append(builders, b)
+	}
+
+	multi.NewBuilder(builders).Build()
+
+	var failed bool
+
+	for i, b := range builders {
+		result := b.Wait()
+
+		switch {
+		case result.Err != nil:
+			failed = true
+			log.Error(fmt.Sprintf("%s: %v", variants[i], result.Err))
+		case tags[i] != "":
+			if err := b.Tag(tags[i]); err != nil {
+				failed = true
+				log.Error(fmt.Sprintf("%s: can't tag with tag %q: %v", variants[i], tags[i], err))
+				continue
+			}
+			log.Finish(fmt.Sprintf("%s: %s (%s)", variants[i], result.Value, tags[i]))
+		default:
+			log.Finish(fmt.Sprintf("%s: %s", variants[i], result.Value))
+		}
+	}
+
+	if failed {
+		os.Exit(2)
+	}
+}
+
+func runGraph(ctx *cli.Context) {
+	log := logger.New("graph", ctx.GlobalBool("no-trim"))
+
+	args := ctx.Args()
+	if len(args) != 1 {
+		cli.ShowCommandHelp(ctx, "graph")
+		log.Error("Please provide a filename to process!")
+		os.Exit(1)
+	}
+
+	format := ctx.String("format")
+	if format != "dot" && format != "json" {
+		log.Error(fmt.Sprintf("Invalid format %q, must be dot or json", format))
+		os.Exit(1)
+	}
+
+	g, err := planGraph(ctx, args[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if format == "json" {
+		err = g.WriteJSON(os.Stdout)
+	} else {
+		err = g.WriteDOT(os.Stdout)
+	}
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func runConvert(ctx *cli.Context) {
+	log := logger.New("convert", ctx.GlobalBool("no-trim"))
+
+	args := ctx.Args()
+	if len(args) != 1 {
+		cli.ShowCommandHelp(ctx, "convert")
+		log.Error("Please provide a filename to process!")
+		os.Exit(1)
+	}
+
+	if to := ctx.String("to"); to != "dockerfile" {
+		log.Error(fmt.Sprintf("Invalid format %q, must be dockerfile", to))
+		os.Exit(1)
+	}
+
+	g, err := planGraph(ctx, args[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	content, err := dockerfile.Convert(g, args[0], dockerfile.Commands{
+		Packages: command.PackagesCommand,
+		CreateUser: func(distro, name string, opts map[string]string) (string, error) {
+			return command.CreateUserCommand(distro, name, command.UserOptions{
+				UID:   opts["uid"],
+				GID:   opts["gid"],
+				Home:  opts["home"],
+				Shell: opts["shell"],
+			})
+		},
+	})
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if fn := ctx.String("output"); fn != "" {
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+	} else {
+		_, err = os.Stdout.WriteString(content)
+	}
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// planGraph records the steps of the plan into a graph, without building it.
+func planGraph(ctx *cli.Context, filename string) (*graph.Graph, error) {
+	// the plan's own output would corrupt the graph on stdout.
+	planLog := logger.New(filename, true)
+	planLog.Record()
+
+	g := graph.New()
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	b, err := mkBuilder(cancel, builder.BuildConfig{
+		Globals: &types.Global{
+			OmitFuncs: ctx.GlobalStringSlice("omit"),
+			Profiles:  ctx.GlobalStringSlice("profile"),
+			Logger:    planLog,
+			Context:   cancelCtx,
+			Graph:     g,
+		},
+		Runner:   make(chan struct{}),
+		FileName: filename,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	if result := b.Run(); result.Err != nil {
+		return nil, result.Err
+	}
+
+	return g, nil
+}
+
+func runBake(ctx *cli.Context) {
+	log := logger.New("bake", ctx.GlobalBool("no-trim"))
+
+	file, err := bake.Parse(ctx.String("file"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	builds, err := file.Builds(ctx.Args())
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if ctx.Bool("dry-run") {
+		for _, b := range builds {
+			fmt.Printf("%s: %s in %s", b.Name(), b.Plan, b.Context)
+			if len(b.Tags) > 0 {
+				fmt.Printf(" (%s)", strings.Join(b.Tags, ", "))
+			}
+			fmt.Println()
+		}
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// the builds are run with the global flags given before bake.
+	command := []string{exe}
+	for i, arg := range os.Args[1:] {
+		if arg == "bake" {
+			command = append(command, os.Args[1:i+1]...)
+			break
+		}
+	}
+
+	runner := &bake.Runner{
+		Command:  command,
+		Parallel: ctx.Int("parallel"),
+		Output:   os.Stdout,
+	}
+
+	switch ctx.GlobalString("executor") {
+	case "", "docker", "podman":
+		runner.Tag = func(id, tag string) error {
+			client, err := client.NewEnvClient()
+			if err != nil {
+				return err
+			}
+
+			err = client.ImageTag(context.Background(), id, tag)
+			audit.Record(audit.Tag, tag, id, err)
+			return err
+		}
+	}
+
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signal.Handler.AddFunc(cancel)
+
+	var failed bool
+
+	for i, result := range runner.Run(cancelCtx, builds) {
+		b := builds[i]
+
+		switch {
+		case result.Err != nil:
+			failed = true
+			log.Error(fmt.Sprintf("%s: %v", b.Name(), result.Err))
+		case len(b.Tags) > 0:
+			log.Finish(fmt.Sprintf("%s: %s (%s)", b.Name(), result.Image, strings.Join(b.Tags, ", ")))
+		default:
+			log.Finish(fmt.Sprintf("%s: %s", b.Name(), result.Image))
+		}
+	}
+
+	if failed {
+		os.Exit(2)
+	}
+}
+
+func runBench(ctx *cli.Context) {
+	log := logger.New("bench", ctx.GlobalBool("no-trim"))
+
+	size, err := units.FromHumanSize(ctx.String("size"))
+	if err != nil {
+		log.Error(fmt.Sprintf("Invalid size %q: %v", ctx.String("size"), err))
+		os.Exit(1)
+	}
+
+	workloads := ctx.StringSlice("workload")
+	if len(workloads) == 0 {
+		workloads = defaultWorkloads(ctx)
+	}
+
+	compressions := ctx.StringSlice("compression")
+	if len(compressions) == 0 {
+		compressions = []string{"gzip", "zstd"}
+	}
+
+	reg := registry.NewClient(registryPolicy)
+	reg.Insecure = ctx.Bool("insecure")
+
+	var (
+		measures []bench.Measure
+		failed   bool
+	)
+
+	record := func(workload string, measure bench.Measure, err error) {
+		if err != nil {
+			log.Error(fmt.Sprintf("%s: %v", workload, err))
+			failed = true
+			return
+		}
+		measures = append(measures, measure)
+	}
+
+	for _, workload := range workloads {
+		log.Print(log.Notice(fmt.Sprintf("Running %s\n", workload)))
+
+		// each compression is measured on its own.
+		if workload == "compress" {
+			for _, compression := range compressions {
+				measure, err := bench.Compress(size, compression, gzipWorkers)
+				record(workload, measure, err)
+			}
+			continue
+		}
+
+		measure, err := benchWorkload(ctx, reg, workload, size)
+		record(workload, measure, err)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(measures); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	} else if err := bench.Write(os.Stdout, measures); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// defaultWorkloads returns the workloads benchmarked if none is given: all of
+// them, but push if there is no repository to push to.
+func defaultWorkloads(ctx *cli.Context) []string {
+	workloads := []string{"compress", "pull", "commit"}
+	if ctx.String("repo") != "" {
+		workloads = append(workloads, "push")
+	}
+
+	return workloads
+}
+
+// benchWorkload measures the workload, other than compress, with layers of
+// the size.
+func benchWorkload(ctx *cli.Context, reg *registry.Client, workload string, size int64) (bench.Measure, error) {
+	switch workload {
+	case "pull":
+		return bench.Pull(context.Background(), reg, ctx.String("image"))
+	case "commit":
+		docker, err := client.NewEnvClient()
+		if err != nil {
+			return bench.Measure{}, err
+		}
+		return bench.Commit(context.Background(), docker, ctx.String("image"), size)
+	case "push":
+		if ctx.String("repo") == "" {
+			return bench.Measure{}, fmt.Errorf("--repo is required to push")
+		}
+		return bench.Push(context.Background(), reg, ctx.String("repo"), size, spillThreshold)
+	default:
+		return bench.Measure{}, fmt.Errorf("unknown workload, must be compress, pull, commit or push")
+	}
+}
@@ -0,0 +1,264 @@
+// Package policy reads the policy file builds are governed by, given with
+// --policy. It is JSON:
+//
+//	{
+//	  "bases": [
+//	    {"name": "debian", "digests": ["sha256:..."]},
+//	    {"name": "registry.example.com/golden/*", "signedBy": "golden.gpg"}
+//	  ],
+//	  "registries": {
+//	    "pull": {"allow": ["registry.example.com", "*.mirror.example.com"]},
+//	    "push": {"allow": ["registry.example.com"]}
+//	  },
+//	  "image": {"nonRoot": true}
+//	}
+//
+// bases are the images plans may use with from, by name, with the digests
+// they may have, the key they must be signed with, or both. registries are
+// the registries box may pull from and push to. image are the rules the
+// images built must follow.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/docker/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Base is an image, or images, plans may use with from.
+type Base struct {
+	// Name is the repository of the image, such as debian or
+	// registry.example.com/golden/go, or a pattern of them, such as
+	// registry.example.com/golden/*. Repositories are normalized as docker
+	// does; patterns are matched against the normalized repository.
+	Name string `json:"name"`
+	// Digests are the digests the image may have. Any digest is allowed if
+	// there are none.
+	Digests []string `json:"digests,omitempty"`
+	// SignedBy, if set, is a file of GPG public keys, relative to the policy
+	// file, one of which the image must be signed with.
+	SignedBy string `json:"signedBy,omitempty"`
+}
+
+// Policy is the policy builds are governed by.
+type Policy struct {
+	// File is the file the policy was read from.
+	File string `json:"-"`
+	// Bases are the images plans may use with from. Any image may be used if
+	// there are none.
+	Bases []Base `json:"bases,omitempty"`
+	// Registries are the registries box may pull from and push to.
+	Registries Registries `json:"registries"`
+	// Image are the rules the images built must follow.
+	Image Image `json:"image"`
+}
+
+// AllowRootLabel is the label of an image which may run as root although the
+// policy requires images to run as another user. Its value says why.
+const AllowRootLabel = "org.box-builder.policy.allow-root"
+
+// Image are the rules the images built must follow.
+type Image struct {
+	// NonRoot, if set, requires images to run as a user other than root,
+	// unless they have the AllowRootLabel label.
+	NonRoot bool `json:"nonRoot,omitempty"`
+}
+
+// Registries are the registries box may pull from and push to.
+type Registries struct {
+	Pull Rule `json:"pull"`
+	Push Rule `json:"push"`
+}
+
+// Rule allows or denies registries, by their host, and port if they have one,
+// such as registry.example.com or localhost:5000, or a pattern of them, such
+// as *.example.com. docker.io is Docker Hub.
+type Rule struct {
+	// Allow are the registries allowed. Any registry is allowed if there are
+	// none.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the registries denied, even if they are allowed.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Load reads the policy from the file.
+func Load(file string) (*Policy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{File: file}
+
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", file, err)
+	}
+
+	for i := range p.Bases {
+		if err := p.Bases[i].normalize(filepath.Dir(file)); err != nil {
+			return nil, fmt.Errorf("invalid policy %s: base %d: %v", file, i+1, err)
+		}
+	}
+
+	for _, rule := range []Rule{p.Registries.Pull, p.Registries.Push} {
+		for _, pattern := range append(append([]string{}, rule.Allow...), rule.Deny...) {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, fmt.Errorf("invalid policy %s: invalid registry %q", file, pattern)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// isPattern is true if the name is a pattern of names.
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// normalize checks the base and normalizes its name and the file of its keys,
+// which is relative to dir.
+func (b *Base) normalize(dir string) error {
+	switch {
+	case b.Name == "":
+		return fmt.Errorf("no name")
+	case isPattern(b.Name):
+		if _, err := path.Match(b.Name, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", b.Name, err)
+		}
+	default:
+		named, err := reference.ParseNormalizedNamed(b.Name)
+		if err != nil {
+			return fmt.Errorf("invalid name %q: %v", b.Name, err)
+		}
+
+		if !reference.IsNameOnly(named) {
+			return fmt.Errorf("invalid name %q: must not have a tag or digest; list digests in digests", b.Name)
+		}
+
+		b.Name = named.Name()
+	}
+
+	for _, d := range b.Digests {
+		if _, err := digest.Parse(d); err != nil {
+			return fmt.Errorf("invalid digest %q: %v", d, err)
+		}
+	}
+
+	if b.SignedBy != "" && !filepath.IsAbs(b.SignedBy) {
+		b.SignedBy = filepath.Join(dir, b.SignedBy)
+	}
+
+	return nil
+}
+
+// Base returns the first base the repository, normalized, matches, or an
+// error explaining it is not allowed.
+func (p *Policy) Base(repo string) (*Base, error) {
+	for i, base := range p.Bases {
+		if base.Name == repo {
+			return &p.Bases[i], nil
+		}
+
+		if isPattern(base.Name) {
+			if ok, _ := path.Match(base.Name, repo); ok {
+				return &p.Bases[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not an allowed base image: no base in the policy %s names it", repo, p.File)
+}
+
+// AllowsDigest is true if the image may have the digest.
+func (b *Base) AllowsDigest(d string) bool {
+	if len(b.Digests) == 0 {
+		return true
+	}
+
+	for _, allowed := range b.Digests {
+		if allowed == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckDigest returns an error explaining the image, repo@digest, is not
+// allowed if it may not have the digest.
+func (b *Base) CheckDigest(repo, d string) error {
+	if b.AllowsDigest(d) {
+		return nil
+	}
+
+	return fmt.Errorf("%s@%s is not an allowed base image: the policy allows %s only at %s", repo, d, b.Name, strings.Join(b.Digests, ", "))
+}
+
+// matches returns the first of the patterns the registry matches.
+func matches(patterns []string, registry string) (string, bool) {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, registry); ok {
+			return pattern, true
+		}
+	}
+
+	return "", false
+}
+
+// check returns an error if the rule does not allow the registry. action is
+// what box was to do with it, for the error.
+func (r Rule) check(file, action, registry string) error {
+	if pattern, ok := matches(r.Deny, registry); ok {
+		return fmt.Errorf("may not %s %s: the policy %s denies %s", action, registry, file, pattern)
+	}
+
+	if _, ok := matches(r.Allow, registry); !ok && len(r.Allow) > 0 {
+		return fmt.Errorf("may not %s %s: the policy %s only allows %s", action, registry, file, strings.Join(r.Allow, ", "))
+	}
+
+	return nil
+}
+
+// isRoot is true if the user of an image, user[:group], is root.
+func isRoot(user string) bool {
+	user = strings.SplitN(user, ":", 2)[0]
+	return user == "" || user == "root" || user == "0"
+}
+
+// CheckImage returns an error if the image built, which runs as the user and
+// has the labels, does not follow the rules of the policy.
+func (p *Policy) CheckImage(user string, labels map[string]string) error {
+	if !p.Image.NonRoot || !isRoot(user) {
+		return nil
+	}
+
+	if reason, ok := labels[AllowRootLabel]; ok {
+		if strings.TrimSpace(reason) == "" {
+			return fmt.Errorf("the label %s of the image must say why it may run as root", AllowRootLabel)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("the image runs as root, which the policy %s does not allow: set another user with the user verb, or label the image %s with why it must run as root", p.File, AllowRootLabel)
+}
+
+// CheckPull returns an error if box may not pull from the registry.
+func (p *Policy) CheckPull(registry string) error {
+	return p.Registries.Pull.check(p.File, "pull from", registry)
+}
+
+// CheckPush returns an error if box may not push to the registry.
+func (p *Policy) CheckPush(registry string) error {
+	return p.Registries.Push.check(p.File, "push to", registry)
+}
@@ -0,0 +1,134 @@
+package policy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type policySuite struct{}
+
+var _ = Suite(&policySuite{})
+
+func TestPolicy(t *T) {
+	TestingT(t)
+}
+
+const testDigest = "sha256:b5aa4ebf7c8e7fd1e1df1e67ee39a4cda24e5aebda5d8a2c4b52a8f2e8e2c3d4"
+
+func writePolicy(c *C, content string) string {
+	file := filepath.Join(c.MkDir(), "policy.json")
+	c.Assert(ioutil.WriteFile(file, []byte(content), 0600), IsNil)
+	return file
+}
+
+func (ps *policySuite) TestLoad(c *C) {
+	file := writePolicy(c, `{
+  "bases": [
+    {"name": "debian", "digests": ["`+testDigest+`"]},
+    {"name": "registry.example.com/golden/*", "signedBy": "golden.gpg"},
+    {"name": "quay.io/org/tools", "signedBy": "/etc/keys/tools.gpg"}
+  ]
+}`)
+
+	p, err := Load(file)
+	c.Assert(err, IsNil)
+	c.Assert(p.File, Equals, file)
+	c.Assert(p.Bases, DeepEquals, []Base{
+		{Name: "docker.io/library/debian", Digests: []string{testDigest}},
+		{Name: "registry.example.com/golden/*", SignedBy: filepath.Join(filepath.Dir(file), "golden.gpg")},
+		{Name: "quay.io/org/tools", SignedBy: "/etc/keys/tools.gpg"},
+	})
+
+	for content, msg := range map[string]string{
+		`{"bases": [{"digests": ["` + testDigest + `"]}]}`:           `.*base 1: no name`,
+		`{"bases": [{"name": "debian:stable"}]}`:                     `.*base 1: invalid name "debian:stable": must not have a tag or digest.*`,
+		`{"bases": [{"name": "debian", "digests": ["sha256:abc"]}]}`: `.*base 1: invalid digest "sha256:abc".*`,
+		`{"bases": [{"name": "golden/[a-"}]}`:                        `.*base 1: invalid pattern.*`,
+		`{"bases": [{"name": "debian", "digest": "x"}]}`:             `invalid policy .*: json: unknown field "digest"`,
+	} {
+		_, err := Load(writePolicy(c, content))
+		c.Assert(err, ErrorMatches, msg, Commentf("%s", content))
+	}
+
+	_, err = Load(filepath.Join(c.MkDir(), "missing.json"))
+	c.Assert(err, NotNil)
+}
+
+func (ps *policySuite) TestBase(c *C) {
+	p, err := Load(writePolicy(c, `{
+  "bases": [
+    {"name": "debian", "digests": ["`+testDigest+`"]},
+    {"name": "registry.example.com/golden/*"}
+  ]
+}`))
+	c.Assert(err, IsNil)
+
+	base, err := p.Base("docker.io/library/debian")
+	c.Assert(err, IsNil)
+	c.Assert(base.Name, Equals, "docker.io/library/debian")
+	c.Assert(base.AllowsDigest(testDigest), Equals, true)
+	c.Assert(base.CheckDigest("docker.io/library/debian", testDigest), IsNil)
+	c.Assert(base.AllowsDigest("sha256:0000"), Equals, false)
+	c.Assert(base.CheckDigest("docker.io/library/debian", "sha256:0000"), ErrorMatches, `docker.io/library/debian@sha256:0000 is not an allowed base image: the policy allows docker.io/library/debian only at `+testDigest)
+
+	base, err = p.Base("registry.example.com/golden/go")
+	c.Assert(err, IsNil)
+	c.Assert(base.Name, Equals, "registry.example.com/golden/*")
+	c.Assert(base.AllowsDigest(testDigest), Equals, true)
+
+	for _, repo := range []string{"docker.io/library/ubuntu", "registry.example.com/golden/go/nested", "registry.example.com/other/go"} {
+		_, err := p.Base(repo)
+		c.Assert(err, ErrorMatches, repo+` is not an allowed base image: no base in the policy .* names it`)
+	}
+}
+
+func (ps *policySuite) TestRegistries(c *C) {
+	p, err := Load(writePolicy(c, `{
+  "registries": {
+    "pull": {"allow": ["registry.example.com", "*.mirror.example.com"]},
+    "push": {"allow": ["registry.example.com"], "deny": ["localhost:*"]}
+  }
+}`))
+	c.Assert(err, IsNil)
+
+	c.Assert(p.CheckPull("registry.example.com"), IsNil)
+	c.Assert(p.CheckPull("eu.mirror.example.com"), IsNil)
+	c.Assert(p.CheckPull("docker.io"), ErrorMatches, `may not pull from docker.io: the policy .* only allows registry.example.com, \*.mirror.example.com`)
+	c.Assert(p.CheckPush("registry.example.com"), IsNil)
+	c.Assert(p.CheckPush("localhost:5000"), ErrorMatches, `may not push to localhost:5000: the policy .* denies localhost:\*`)
+
+	p, err = Load(writePolicy(c, `{"registries": {"push": {"deny": ["docker.io"]}}}`))
+	c.Assert(err, IsNil)
+	c.Assert(p.CheckPull("docker.io"), IsNil)
+	c.Assert(p.CheckPush("quay.io"), IsNil)
+	c.Assert(p.CheckPush("docker.io"), NotNil)
+
+	_, err = Load(writePolicy(c, `{"registries": {"pull": {"allow": ["[a-"]}}}`))
+	c.Assert(err, ErrorMatches, `invalid policy .*: invalid registry "\[a-"`)
+}
+
+func (ps *policySuite) TestImage(c *C) {
+	p, err := Load(writePolicy(c, `{"bases": [{"name": "debian"}]}`))
+	c.Assert(err, IsNil)
+	c.Assert(p.CheckImage("root", nil), IsNil)
+
+	p, err = Load(writePolicy(c, `{"image": {"nonRoot": true}}`))
+	c.Assert(err, IsNil)
+
+	for _, user := range []string{"", "root", "0", "root:staff", "0:0"} {
+		c.Assert(p.CheckImage(user, nil), ErrorMatches, "the image runs as root, which the policy .* does not allow.*", Commentf("%q", user))
+	}
+
+	for _, user := range []string{"app", "1000", "1000:1000", "nobody:root"} {
+		c.Assert(p.CheckImage(user, nil), IsNil, Commentf("%q", user))
+	}
+
+	c.Assert(p.CheckImage("root", map[string]string{AllowRootLabel: "binds port 80"}), IsNil)
+	c.Assert(p.CheckImage("root", map[string]string{AllowRootLabel: " "}), ErrorMatches, "the label .* must say why it may run as root")
+
+	_, err = Load(writePolicy(c, `{"image": {"runAsNonRoot": true}}`))
+	c.Assert(err, ErrorMatches, `invalid policy .*unknown field.*`)
+}
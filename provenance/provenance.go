@@ -0,0 +1,232 @@
+// Package provenance records how an image was built, the plan, the images it
+// was built from and the parameters of the build, and makes an SLSA
+// provenance predicate of it for an in-toto attestation of the image.
+package provenance
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PredicateType is the type of the SLSA provenance predicate, v1.
+const PredicateType = "https://slsa.dev/provenance/v1"
+
+// BuildType names the build a predicate describes: a box plan, run with the
+// external parameters.
+const BuildType = "https://box-builder.github.io/provenance/plan/v1"
+
+// BuilderID identifies box as the builder.
+const BuilderID = "https://github.com/box-builder/box"
+
+// Image is an image a plan used with from, named as it was in the plan.
+type Image struct {
+	Name string
+	ID   string // the image ID in docker
+}
+
+// ResourceDescriptor is a resource the build used, such as the plan or an
+// image, or the builder.
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// BuildDefinition is what was built, and how.
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies"`
+}
+
+// Builder is the builder which ran the build.
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// Metadata is when the build ran.
+type Metadata struct {
+	StartedOn  time.Time `json:"startedOn"`
+	FinishedOn time.Time `json:"finishedOn"`
+}
+
+// RunDetails is who ran the build, and when.
+type RunDetails struct {
+	Builder  Builder  `json:"builder"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// Predicate is an SLSA provenance predicate.
+type Predicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// Recorder records the images and files a build uses, and the environment
+// variables its plan reads. Plans built at the same time may share one.
+type Recorder struct {
+	mutex  sync.Mutex
+	images []Image
+	files  []ResourceDescriptor
+	env    map[string]struct{}
+}
+
+// NewRecorder returns a recorder with nothing recorded.
+func NewRecorder() *Recorder {
+	return &Recorder{env: map[string]struct{}{}}
+}
+
+// RecordImage records an image used with from.
+func (r *Recorder) RecordImage(name, id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, image := range r.images {
+		if image == (Image{Name: name, ID: id}) {
+			return
+		}
+	}
+
+	r.images = append(r.images, Image{Name: name, ID: id})
+}
+
+// RecordFile records a file used with from, an image file or a filesystem
+// tarball, with its digest.
+func (r *Recorder) RecordFile(file string) error {
+	digest, err := fileDigest(file)
+	if err != nil {
+		return err
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, recorded := range r.files {
+		if recorded.URI == "file://"+abs {
+			return nil
+		}
+	}
+
+	r.files = append(r.files, ResourceDescriptor{Name: file, URI: "file://" + abs, Digest: map[string]string{"sha256": digest}})
+	return nil
+}
+
+// RecordEnv records the name of an environment variable the plan read with
+// getenv.
+func (r *Recorder) RecordEnv(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.env[name] = struct{}{}
+}
+
+// Images returns the images recorded, in the order they were used.
+func (r *Recorder) Images() []Image {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Image{}, r.images...)
+}
+
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Build is a build of a plan, whose provenance is recorded.
+type Build struct {
+	Plan     string            // the plan file built
+	Vars     map[string]string // the variables exposed with getvar
+	Profiles []string
+	Omit     []string
+	Platform string
+	Version  string // the version of box
+	Started  time.Time
+	Finished time.Time
+	Images   []ResourceDescriptor // the images used with from, resolved to their digests
+	Context  *ResourceDescriptor  // if set, where the context came from: a git repository and its commit, or a tarball
+	Recorder *Recorder
+}
+
+// Predicate returns the provenance predicate of the build. The plan is read
+// for its digest. The values of the environment variables the plan read are
+// left out, as they may be secrets; only their names are in the predicate.
+func (b *Build) Predicate() (*Predicate, error) {
+	digest, err := fileDigest(b.Plan)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{"plan": b.Plan}
+	if len(b.Vars) > 0 {
+		params["vars"] = b.Vars
+	}
+	if len(b.Profiles) > 0 {
+		params["profiles"] = b.Profiles
+	}
+	if len(b.Omit) > 0 {
+		params["omit"] = b.Omit
+	}
+	if b.Platform != "" {
+		params["platform"] = b.Platform
+	}
+
+	dependencies := []ResourceDescriptor{{Name: b.Plan, Digest: map[string]string{"sha256": digest}}}
+	if b.Context != nil {
+		params["context"] = b.Context.URI
+		dependencies = append(dependencies, *b.Context)
+	}
+	dependencies = append(dependencies, b.Images...)
+
+	if b.Recorder != nil {
+		b.Recorder.mutex.Lock()
+		dependencies = append(dependencies, b.Recorder.files...)
+
+		env := []string{}
+		for name := range b.Recorder.env {
+			env = append(env, name)
+		}
+		b.Recorder.mutex.Unlock()
+
+		if len(env) > 0 {
+			sort.Strings(env)
+			params["env"] = env
+		}
+	}
+
+	return &Predicate{
+		BuildDefinition: BuildDefinition{
+			BuildType:            BuildType,
+			ExternalParameters:   params,
+			ResolvedDependencies: dependencies,
+		},
+		RunDetails: RunDetails{
+			Builder:  Builder{ID: BuilderID, Version: map[string]string{"box": b.Version}},
+			Metadata: Metadata{StartedOn: b.Started.UTC(), FinishedOn: b.Finished.UTC()},
+		},
+	}, nil
+}
@@ -0,0 +1,83 @@
+package provenance
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type provenanceSuite struct{}
+
+var _ = Suite(&provenanceSuite{})
+
+func TestProvenance(t *T) {
+	TestingT(t)
+}
+
+func (ps *provenanceSuite) TestPredicate(c *C) {
+	dir := c.MkDir()
+	plan := filepath.Join(dir, "plan.rb")
+	c.Assert(ioutil.WriteFile(plan, []byte(`from "debian"`), 0644), IsNil)
+	archive := filepath.Join(dir, "base.tar")
+	c.Assert(ioutil.WriteFile(archive, []byte("archive"), 0644), IsNil)
+
+	r := NewRecorder()
+	r.RecordImage("debian", "sha256:1234")
+	r.RecordImage("debian", "sha256:1234")
+	c.Assert(r.RecordFile(archive), IsNil)
+	c.Assert(r.RecordFile(archive), IsNil)
+	c.Assert(r.RecordFile(filepath.Join(dir, "missing")), NotNil)
+	r.RecordEnv("VERSION")
+	r.RecordEnv("ARCH")
+	r.RecordEnv("VERSION")
+
+	c.Assert(r.Images(), DeepEquals, []Image{{Name: "debian", ID: "sha256:1234"}})
+
+	started := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	build := &Build{
+		Plan:     plan,
+		Profiles: []string{"release"},
+		Version:  "0.4.2",
+		Started:  started,
+		Finished: started.Add(time.Minute),
+		Images:   []ResourceDescriptor{{Name: "debian", URI: "docker://docker.io/library/debian", Digest: map[string]string{"sha256": "abcd"}}},
+		Recorder: r,
+	}
+
+	predicate, err := build.Predicate()
+	c.Assert(err, IsNil)
+
+	c.Assert(predicate.BuildDefinition.BuildType, Equals, BuildType)
+	c.Assert(predicate.BuildDefinition.ExternalParameters, DeepEquals, map[string]interface{}{
+		"plan":     plan,
+		"profiles": []string{"release"},
+		"env":      []string{"ARCH", "VERSION"},
+	})
+
+	dependencies := predicate.BuildDefinition.ResolvedDependencies
+	c.Assert(dependencies, HasLen, 3)
+	c.Assert(dependencies[0].Digest["sha256"], Equals, fmt.Sprintf("%x", sha256.Sum256([]byte(`from "debian"`))))
+	c.Assert(dependencies[1].Name, Equals, "debian")
+	c.Assert(dependencies[2].URI, Equals, "file://"+archive)
+	c.Assert(dependencies[2].Digest["sha256"], Equals, fmt.Sprintf("%x", sha256.Sum256([]byte("archive"))))
+
+	c.Assert(predicate.RunDetails.Builder, DeepEquals, Builder{ID: BuilderID, Version: map[string]string{"box": "0.4.2"}})
+	c.Assert(predicate.RunDetails.Metadata.FinishedOn.Sub(predicate.RunDetails.Metadata.StartedOn), Equals, time.Minute)
+
+	build.Context = &ResourceDescriptor{URI: "git+https://example.com/app.git", Digest: map[string]string{"gitCommit": "5678"}}
+	predicate, err = build.Predicate()
+	c.Assert(err, IsNil)
+	c.Assert(predicate.BuildDefinition.ExternalParameters["context"], Equals, "git+https://example.com/app.git")
+	dependencies = predicate.BuildDefinition.ResolvedDependencies
+	c.Assert(dependencies, HasLen, 4)
+	c.Assert(dependencies[1].Digest["gitCommit"], Equals, "5678")
+
+	build.Plan = filepath.Join(dir, "missing.rb")
+	_, err = build.Predicate()
+	c.Assert(err, NotNil)
+}
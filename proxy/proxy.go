@@ -0,0 +1,377 @@
+// Package proxy is a pull-through cache of a registry. It answers pulls with
+// the manifests and blobs of the registry it mirrors, and keeps them on disk,
+// so each blob is fetched from the registry once however often a build host
+// pulls it. Docker uses it as a registry mirror; box and other tools pull
+// from it as a registry on localhost.
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/registry"
+	"github.com/containers/image/docker/reference"
+	units "github.com/docker/go-units"
+)
+
+var (
+	pathRegexp   = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/([^/]+)$`)
+	digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	tagRegexp    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// Proxy serves pulls of the registry it mirrors from its cache. Blobs and
+// manifests by digest are kept for good; the digest of a tag is asked for
+// again once TagTTL has passed, and the last one known is served while the
+// registry can't be reached.
+type Proxy struct {
+	Upstream string        // the domain of the registry mirrored
+	Dir      string        // the directory the cache is kept in
+	TagTTL   time.Duration // how long the digest of a tag is served before the registry is asked again
+	Logger   *logger.Logger
+	Client   *registry.Client // reaches the registry mirrored
+
+	tags  map[string]tagDigest
+	mutex sync.Mutex
+}
+
+type tagDigest struct {
+	digest  string
+	fetched time.Time
+}
+
+// cachedManifest is a manifest kept in the cache.
+type cachedManifest struct {
+	MediaType string `json:"mediaType"`
+	Content   []byte `json:"content"`
+}
+
+// New returns a proxy of the upstream registry, caching to dir. It only pulls
+// what the policy allows, if it is set.
+func New(upstream, dir string, ttl time.Duration, policy *policy.Policy, logger *logger.Logger) *Proxy {
+	return &Proxy{
+		Upstream: upstream,
+		Dir:      dir,
+		TagTTL:   ttl,
+		Logger:   logger,
+		Client:   registry.NewClient(policy),
+		tags:     map[string]tagDigest{},
+	}
+}
+
+// ServeHTTP serves the pull side of the registry API: manifests and blobs, by
+// GET and HEAD.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the proxy only serves pulls")
+		return
+	}
+
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+
+	match := pathRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not a path of the registry API")
+		return
+	}
+
+	repo, kind, ref := match[1], match[2], match[3]
+	if _, err := reference.ParseNormalizedNamed(p.Upstream + "/" + repo); err != nil {
+		writeError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return
+	}
+
+	if kind == "manifests" {
+		p.serveManifest(w, r, repo, ref)
+	} else {
+		p.serveBlob(w, r, repo, ref)
+	}
+}
+
+func (p *Proxy) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	var digest string
+
+	switch {
+	case digestRegexp.MatchString(ref):
+		digest = ref
+	case tagRegexp.MatchString(ref):
+		var err error
+		if digest, err = p.resolveTag(r, repo, ref); err == registry.ErrNotFound {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("%s:%s is not in %s", repo, ref, p.Upstream))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("invalid reference %q", ref))
+		return
+	}
+
+	m, err := p.manifest(r, repo, digest)
+	if err == registry.ErrNotFound {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("%s@%s is not in %s", repo, digest, p.Upstream))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", m.MediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.Content)))
+
+	if r.Method == http.MethodGet {
+		w.Write(m.Content)
+	}
+}
+
+// resolveTag returns the digest of the tag: the one fetched last, while it is
+// fresh or the registry can't be reached. Manifests fetched by tag are
+// cached by their digest.
+func (p *Proxy) resolveTag(r *http.Request, repo, tag string) (string, error) {
+	key := repo + ":" + tag
+
+	p.mutex.Lock()
+	known, ok := p.tags[key]
+	p.mutex.Unlock()
+
+	if ok && time.Since(known.fetched) < p.TagTTL {
+		return known.digest, nil
+	}
+
+	m, err := p.Client.GetManifest(r.Context(), registry.Reference{Domain: p.Upstream, Repository: repo, Reference: tag})
+	if err == registry.ErrNotFound {
+		return "", err
+	} else if err != nil {
+		content, readErr := ioutil.ReadFile(p.tagFile(repo, tag))
+		if readErr != nil {
+			return "", err
+		}
+
+		p.Logger.Print(p.Logger.Notice(fmt.Sprintf("Serving the last digest of %s: %v\n", key, err)))
+		return string(content), nil
+	}
+
+	if err := p.saveManifest(m); err != nil {
+		return "", err
+	}
+
+	if err := writeFile(p.tagFile(repo, tag), []byte(m.Digest)); err != nil {
+		return "", err
+	}
+
+	p.mutex.Lock()
+	p.tags[key] = tagDigest{digest: m.Digest, fetched: time.Now()}
+	p.mutex.Unlock()
+
+	return m.Digest, nil
+}
+
+// manifest returns the manifest from the cache, fetching it into the cache
+// if it is not there.
+func (p *Proxy) manifest(r *http.Request, repo, digest string) (*cachedManifest, error) {
+	m := &cachedManifest{}
+
+	content, err := ioutil.ReadFile(p.manifestFile(digest))
+	if err == nil {
+		return m, json.Unmarshal(content, m)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fetched, err := p.Client.GetManifest(r.Context(), registry.Reference{Domain: p.Upstream, Repository: repo, Reference: digest})
+	if err != nil {
+		return nil, err
+	}
+
+	if fetched.Digest != digest {
+		return nil, fmt.Errorf("%s returned %s for %s@%s", p.Upstream, fetched.Digest, repo, digest)
+	}
+
+	if err := p.saveManifest(fetched); err != nil {
+		return nil, err
+	}
+
+	return &cachedManifest{MediaType: fetched.MediaType, Content: fetched.Content}, nil
+}
+
+func (p *Proxy) saveManifest(m *registry.Manifest) error {
+	content, err := json.Marshal(cachedManifest{MediaType: m.MediaType, Content: m.Content})
+	if err != nil {
+		return err
+	}
+
+	return writeFile(p.manifestFile(m.Digest), content)
+}
+
+func (p *Proxy) serveBlob(w http.ResponseWriter, r *http.Request, repo, digest string) {
+	if !digestRegexp.MatchString(digest) {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("invalid digest %q", digest))
+		return
+	}
+
+	fn := p.blobFile(digest)
+
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		if err := p.fetchBlob(w, r, repo, digest); err == registry.ErrNotFound {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", fmt.Sprintf("%s@%s is not in %s", repo, digest, p.Upstream))
+		} else if err != nil {
+			writeError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+		}
+
+		return
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+
+	// blobs never change, so ranges are served of them, as registries do.
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// fetchBlob fetches the blob from the registry into the cache. A GET is
+// answered as the blob arrives; a HEAD once it is in the cache. Nothing is
+// written to w before the registry answers, so errors can still be
+// returned.
+func (p *Proxy) fetchBlob(w http.ResponseWriter, r *http.Request, repo, digest string) error {
+	rc, size, err := p.Client.GetBlob(r.Context(), p.Upstream, repo, digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fn := p.blobFile(digest)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fn), "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	content := io.TeeReader(rc, io.MultiWriter(f, hash))
+
+	// once a GET is answered, errors cut the response short instead.
+	fail := func(err error) error {
+		if r.Method == http.MethodHead {
+			return err
+		}
+
+		p.Logger.Print(p.Logger.Notice(fmt.Sprintf("Could not cache %s@%s: %v\n", repo, digest, err)))
+		return nil
+	}
+
+	out := ioutil.Discard
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", digest)
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		out = w
+	}
+
+	written, err := io.Copy(out, content)
+	if err != nil {
+		return fail(err)
+	}
+
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fail(fmt.Errorf("%s returned %s", p.Upstream, got))
+	}
+
+	if err := f.Close(); err != nil {
+		return fail(err)
+	}
+
+	if err := os.Rename(f.Name(), fn); err != nil {
+		return fail(err)
+	}
+
+	p.Logger.Print(fmt.Sprintf("Cached %s@%s, %s\n", repo, digest, units.HumanSize(float64(written))))
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", strconv.FormatInt(written, 10))
+	}
+
+	return nil
+}
+
+func (p *Proxy) blobFile(digest string) string {
+	return filepath.Join(p.Dir, "blobs", "sha256", digest[len("sha256:"):])
+}
+
+func (p *Proxy) manifestFile(digest string) string {
+	return filepath.Join(p.Dir, "manifests", "sha256", digest[len("sha256:"):])
+}
+
+func (p *Proxy) tagFile(repo, tag string) string {
+	return filepath.Join(p.Dir, "tags", p.Upstream, filepath.FromSlash(repo), tag)
+}
+
+// writeFile writes the file whole or not at all, so concurrent readers never
+// see part of it.
+func writeFile(fn string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fn), "write-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fn)
+}
+
+// writeError writes an error of the registry API.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	. "gopkg.in/check.v1"
+)
+
+type proxySuite struct{}
+
+var _ = Suite(&proxySuite{})
+
+func TestProxy(t *T) {
+	TestingT(t)
+}
+
+func digestOf(content string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+}
+
+func (ps *proxySuite) TestProxy(c *C) {
+	blob := strings.Repeat("layer", 1000)
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"digest":%q}]}`, digestOf(blob))
+
+	requests := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.Method+" "+r.URL.Path]++
+
+		switch r.URL.Path {
+		case "/v2/app/manifests/1.0", "/v2/app/manifests/" + digestOf(manifest):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			fmt.Fprint(w, manifest)
+		case "/v2/app/blobs/" + digestOf(blob):
+			fmt.Fprint(w, blob)
+		case "/v2/app/blobs/" + digestOf("tampered"):
+			fmt.Fprint(w, "not what was asked for")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	p := New(strings.TrimPrefix(upstream.URL, "http://"), c.MkDir(), time.Hour, nil, logger.New("proxyd", false))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	get := func(method, path string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		c.Assert(err, IsNil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		content, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp, string(content)
+	}
+
+	resp, _ := get("GET", "/v2/", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Docker-Distribution-API-Version"), Equals, "registry/2.0")
+
+	for i := 0; i < 2; i++ {
+		resp, content := get("GET", "/v2/app/manifests/1.0", nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(content, Equals, manifest)
+		c.Assert(resp.Header.Get("Docker-Content-Digest"), Equals, digestOf(manifest))
+		c.Assert(resp.Header.Get("Content-Type"), Equals, "application/vnd.oci.image.manifest.v1+json")
+	}
+
+	// the tag is fresh, and the manifest was cached by its digest.
+	resp, content := get("GET", "/v2/app/manifests/"+digestOf(manifest), nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(content, Equals, manifest)
+	c.Assert(requests["GET /v2/app/manifests/1.0"], Equals, 1)
+	c.Assert(requests["GET /v2/app/manifests/"+digestOf(manifest)], Equals, 0)
+
+	for i := 0; i < 2; i++ {
+		resp, content := get("GET", "/v2/app/blobs/"+digestOf(blob), nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(content, Equals, blob)
+	}
+	c.Assert(requests["GET /v2/app/blobs/"+digestOf(blob)], Equals, 1)
+
+	resp, content = get("GET", "/v2/app/blobs/"+digestOf(blob), http.Header{"Range": {"bytes=5-9"}})
+	c.Assert(resp.StatusCode, Equals, http.StatusPartialContent)
+	c.Assert(content, Equals, "layer")
+
+	resp, _ = get("HEAD", "/v2/app/blobs/"+digestOf(blob), nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.ContentLength, Equals, int64(len(blob)))
+
+	resp, _ = get("GET", "/v2/app/blobs/"+digestOf("missing"), nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	// a blob which does not match its digest is not cached.
+	resp, _ = get("HEAD", "/v2/app/blobs/"+digestOf("tampered"), nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+	get("GET", "/v2/app/blobs/"+digestOf("tampered"), nil)
+	c.Assert(requests["GET /v2/app/blobs/"+digestOf("tampered")], Equals, 2)
+
+	resp, _ = get("GET", "/v2/app/manifests/../../etc", nil)
+	c.Assert(resp.StatusCode, Not(Equals), http.StatusOK)
+
+	resp, _ = get("PUT", "/v2/app/manifests/1.0", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	// with the registry gone, the last digest of the tag is served.
+	p.TagTTL = 0
+	upstream.Close()
+
+	resp, content = get("GET", "/v2/app/manifests/1.0", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(content, Equals, manifest)
+
+	resp, _ = get("GET", "/v2/app/manifests/2.0", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/ocicrypt"
+	"github.com/box-builder/box/provenance"
+	"github.com/box-builder/box/registry"
+	"github.com/box-builder/box/signal"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+// mutationFlags are the flags of the commands which change the configuration
+// of an image in a registry.
+var mutationFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "env, e",
+		Usage: "Set an environment variable, as KEY=value",
+	},
+	cli.StringSliceFlag{
+		Name:  "label, l",
+		Usage: "Set a label, as key=value",
+	},
+	cli.StringFlag{
+		Name:  "entrypoint",
+		Usage: "Set the entrypoint, as a JSON array or words; empty removes it",
+	},
+	cli.StringFlag{
+		Name:  "cmd",
+		Usage: "Set the command, as a JSON array or words; empty removes it",
+	},
+	cli.StringFlag{
+		Name:  "user, u",
+		Usage: "Set the user",
+	},
+	cli.StringFlag{
+		Name:  "workdir, w",
+		Usage: "Set the working directory",
+	},
+	cli.StringSliceFlag{
+		Name:  "expose",
+		Usage: "Expose a port, as port or port/proto",
+	},
+}
+
+func runCopy(ctx *cli.Context) {
+	log := logger.New("copy", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 2 {
+		cli.ShowCommandHelp(ctx, "copy")
+		log.Error("Please provide the image to copy and where to copy it to!")
+		os.Exit(1)
+	}
+
+	refs := []registry.Reference{}
+	for _, arg := range ctx.Args() {
+		ref, err := registry.ParseReference(arg)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		refs = append(refs, ref)
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	cancelCtx, done := signalContext()
+	defer done()
+
+	var (
+		digest string
+		err    error
+	)
+
+	if len(ctx.StringSlice("encrypt-recipient")) > 0 || len(ctx.StringSlice("decrypt-key")) > 0 {
+		digest, err = cryptCopy(ctx, cancelCtx, client, refs[0], refs[1], log)
+	} else {
+		digest, err = client.Copy(cancelCtx, refs[0], refs[1], log)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Copied %s to %s (%s)", refs[0], refs[1], digest))
+}
+
+// cryptCopy copies the image with its layers encrypted for the recipients of
+// --encrypt-recipient, or decrypted with the keys of --decrypt-key.
+func cryptCopy(ctx *cli.Context, cancelCtx context.Context, client *registry.Client, src, dst registry.Reference, log *logger.Logger) (string, error) {
+	var (
+		recipients []crypto.PublicKey
+		keys       []crypto.PrivateKey
+		err        error
+	)
+
+	if files := ctx.StringSlice("encrypt-recipient"); len(files) > 0 {
+		if recipients, err = ocicrypt.LoadRecipients(files); err != nil {
+			return "", err
+		}
+	}
+
+	if files := ctx.StringSlice("decrypt-key"); len(files) > 0 {
+		if keys, err = ocicrypt.LoadKeys(files); err != nil {
+			return "", err
+		}
+	}
+
+	platform := registry.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p := ctx.String("platform"); p != "" {
+		if platform, err = registry.ParsePlatform(p); err != nil {
+			return "", err
+		}
+	}
+
+	return layers.CryptImage(cancelCtx, client, src, dst, platform, recipients, keys, log)
+}
+
+func runRetag(ctx *cli.Context) {
+	log := logger.New("retag", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 2 {
+		cli.ShowCommandHelp(ctx, "retag")
+		log.Error("Please provide the image to tag and its new tag!")
+		os.Exit(1)
+	}
+
+	refs := []registry.Reference{}
+	for _, arg := range ctx.Args() {
+		ref, err := registry.ParseReference(arg)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		refs = append(refs, ref)
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	cancelCtx, done := signalContext()
+	defer done()
+
+	digest, err := client.Retag(cancelCtx, refs[0], refs[1])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Tag(refs[1].String())
+	log.Finish(digest)
+}
+
+func runManifestCreate(ctx *cli.Context) {
+	log := logger.New("manifest", ctx.GlobalBool("no-trim"))
+
+	args := ctx.Args()
+	if len(args) < 2 {
+		cli.ShowCommandHelp(ctx, "create")
+		log.Error("Please provide a name for the manifest list and its images!")
+		os.Exit(1)
+	}
+
+	list := &registry.ManifestList{Name: args[0]}
+
+	if ctx.Bool("amend") {
+		existing, err := registry.LoadManifestList(args[0])
+		if err == nil {
+			list = existing
+		}
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	for _, image := range args[1:] {
+		entries, err := client.ListEntries(context.Background(), image)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		list.Add(entries)
+	}
+
+	if err := list.Save(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	for _, entry := range list.Entries {
+		log.Print(fmt.Sprintf("%s\t%s\n", entry.Platform, entry.Image))
+	}
+
+	log.Finish(fmt.Sprintf("Created manifest list %s", list.Name))
+}
+
+func runManifestAnnotate(ctx *cli.Context) {
+	log := logger.New("manifest", ctx.GlobalBool("no-trim"))
+
+	args := ctx.Args()
+	if len(args) != 2 {
+		cli.ShowCommandHelp(ctx, "annotate")
+		log.Error("Please provide the manifest list and the image to annotate!")
+		os.Exit(1)
+	}
+
+	list, err := registry.LoadManifestList(args[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	entry, err := list.Entry(args[1])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	for flag, field := range map[string]*string{
+		"os":         &entry.Platform.OS,
+		"arch":       &entry.Platform.Architecture,
+		"variant":    &entry.Platform.Variant,
+		"os-version": &entry.Platform.OSVersion,
+	} {
+		if ctx.IsSet(flag) {
+			*field = ctx.String(flag)
+		}
+	}
+
+	if err := list.Save(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("%s is for %s", entry.Image, entry.Platform))
+}
+
+func runManifestPush(ctx *cli.Context) {
+	log := logger.New("manifest", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "push")
+		log.Error("Please provide the manifest list to push!")
+		os.Exit(1)
+	}
+
+	list, err := registry.LoadManifestList(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	cancelCtx, done := signalContext()
+	defer done()
+
+	digest, err := client.PushList(cancelCtx, list, log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if ctx.Bool("purge") {
+		if err := list.Remove(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	log.Finish(fmt.Sprintf("Pushed %s (%s)", list.Name, digest))
+}
+
+func runMutate(ctx *cli.Context) {
+	log := logger.New("mutate", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "mutate")
+		log.Error("Please provide the image to change!")
+		os.Exit(1)
+	}
+
+	dst, digest, err := mutateImage(ctx, log, nil)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Tag(dst.String())
+	log.Finish(digest)
+}
+
+func runAppend(ctx *cli.Context) {
+	log := logger.New("append", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 || ctx.String("tar") == "" {
+		cli.ShowCommandHelp(ctx, "append")
+		log.Error("Please provide the image to add to and the tarball of the layer!")
+		os.Exit(1)
+	}
+
+	layer, err := registry.NewLayer(ctx.String("tar"), gzipWorkers)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	signal.Handler.AddFile(layer.File)
+	dst, digest, err := mutateImage(ctx, log, layer)
+	signal.Handler.RemoveFile(layer.File)
+	layer.Close()
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Tag(dst.String())
+	log.Finish(digest)
+}
+
+func runRebase(ctx *cli.Context) {
+	log := logger.New("rebase", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 || ctx.String("old-base") == "" || ctx.String("new-base") == "" {
+		cli.ShowCommandHelp(ctx, "rebase")
+		log.Error("Please provide the image to rebase, and its old and new base images!")
+		os.Exit(1)
+	}
+
+	src, err := registry.ParseReference(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	dst := src
+	if tag := ctx.String("tag"); tag != "" {
+		if dst, err = registry.ParseReference(tag); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	cancelCtx, done := signalContext()
+	defer done()
+
+	digest, err := client.Rebase(cancelCtx, src, dst, ctx.String("old-base"), ctx.String("new-base"), log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Tag(dst.String())
+	log.Finish(digest)
+}
+
+// mutateImage pushes the image given as argument, with its configuration
+// changed by the mutation flags and the layer, if any, added on top. Returns
+// where it was pushed, and the digest of its manifest.
+func mutateImage(ctx *cli.Context, log *logger.Logger, layer *registry.Layer) (registry.Reference, string, error) {
+	src, err := registry.ParseReference(ctx.Args()[0])
+	if err != nil {
+		return src, "", err
+	}
+
+	dst := src
+	if tag := ctx.String("tag"); tag != "" {
+		if dst, err = registry.ParseReference(tag); err != nil {
+			return dst, "", err
+		}
+	}
+
+	mutation := registry.Mutation{
+		Env:          ctx.StringSlice("env"),
+		Labels:       map[string]string{},
+		User:         ctx.String("user"),
+		WorkDir:      ctx.String("workdir"),
+		ExposedPorts: ctx.StringSlice("expose"),
+		CreatedBy:    "box " + strings.Join(os.Args[1:], " "),
+		Layer:        layer,
+	}
+
+	for _, label := range ctx.StringSlice("label") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return dst, "", fmt.Errorf("invalid label %q: must be key=value", label)
+		}
+		mutation.Labels[parts[0]] = parts[1]
+	}
+
+	for flag, field := range map[string]*[]string{"entrypoint": &mutation.Entrypoint, "cmd": &mutation.Cmd} {
+		if !ctx.IsSet(flag) {
+			continue
+		}
+
+		if *field, err = parseCommand(ctx.String(flag)); err != nil {
+			return dst, "", fmt.Errorf("invalid %s: %v", flag, err)
+		}
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	cancelCtx, done := signalContext()
+	defer done()
+
+	digest, err := client.Mutate(cancelCtx, src, dst, mutation, log)
+	return dst, digest, err
+}
+
+// parseCommand parses a command given as a JSON array, or as words separated
+// by spaces.
+func parseCommand(command string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(command), "[") {
+		args := []string{}
+		return args, json.Unmarshal([]byte(command), &args)
+	}
+
+	return strings.Fields(command), nil
+}
+
+func runSign(ctx *cli.Context) {
+	log := logger.New("sign", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 || ctx.String("key") == "" {
+		cli.ShowCommandHelp(ctx, "sign")
+		log.Error("Please provide the image to sign and the key to sign it with!")
+		os.Exit(1)
+	}
+
+	ref, err := registry.ParseReference(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	signer, err := registry.LoadSigner(ctx.String("key"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	cancelCtx, done := signalContext()
+	defer done()
+
+	digest, err := client.Sign(cancelCtx, ref, signer, ctx.Bool("referrers"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	log.Finish(fmt.Sprintf("Signed %s (%s)", ref, digest))
+}
+
+func runVerify(ctx *cli.Context) {
+	log := logger.New("verify", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 || ctx.String("key") == "" {
+		cli.ShowCommandHelp(ctx, "verify")
+		log.Error("Please provide the image to verify and the key to verify it with!")
+		os.Exit(1)
+	}
+
+	ref, err := registry.ParseReference(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	public, err := registry.LoadPublicKey(context.Background(), ctx.String("key"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	if ctx.Bool("provenance") {
+		verifyProvenance(log, client, ref, public)
+		return
+	}
+
+	digest, signatures, err := client.Verify(context.Background(), ref, public)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SIGNATURE\tSIGNED IN\tSTORED AS")
+	for _, signature := range signatures {
+		stored := "tag"
+		if signature.Referrer {
+			stored = "referrer"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", strings.TrimPrefix(signature.Digest, "sha256:")[:12], signature.DockerReference, stored)
+	}
+	w.Flush()
+
+	log.Finish(fmt.Sprintf("Verified %s (%s)", ref, digest))
+}
+
+// verifyProvenance verifies the provenance attestations of the image, and
+// shows the plan and images each says it was built from.
+func verifyProvenance(log *logger.Logger, client *registry.Client, ref registry.Reference, public crypto.PublicKey) {
+	digest, statements, err := client.VerifyAttestations(context.Background(), ref, public, provenance.PredicateType)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BUILT BY\tFINISHED\tDEPENDENCY\tDIGEST")
+	for _, statement := range statements {
+		predicate := provenance.Predicate{}
+		if err := json.Unmarshal(statement.Predicate, &predicate); err != nil {
+			log.Error(fmt.Sprintf("Invalid provenance: %v", err))
+			os.Exit(1)
+		}
+
+		builtBy := predicate.RunDetails.Builder.ID
+		if version := predicate.RunDetails.Builder.Version["box"]; version != "" {
+			builtBy += "@" + version
+		}
+
+		for _, dependency := range predicate.BuildDefinition.ResolvedDependencies {
+			digest := "-"
+			if value, ok := dependency.Digest["sha256"]; ok {
+				digest = "sha256:" + value
+			} else if id, ok := dependency.Annotations["imageID"]; ok {
+				digest = id + " (image ID)"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", builtBy, predicate.RunDetails.Metadata.FinishedOn.Format(time.RFC3339), dependency.Name, digest)
+		}
+	}
+	w.Flush()
+
+	log.Finish(fmt.Sprintf("Verified the provenance of %s (%s)", ref, digest))
+}
+
+func runInspect(ctx *cli.Context) {
+	log := logger.New("inspect", ctx.GlobalBool("no-trim"))
+
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "inspect")
+		log.Error("Please provide the image to inspect!")
+		os.Exit(1)
+	}
+
+	ref, err := registry.ParseReference(ctx.Args()[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	platform := ctx.String("platform")
+	if platform == "" {
+		platform = ctx.GlobalString("platform")
+	}
+	if platform == "" {
+		platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+
+	p, err := registry.ParsePlatform(platform)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	client := registry.NewClient(registryPolicy)
+	client.Insecure = ctx.Bool("insecure")
+
+	inspection, err := client.Inspect(context.Background(), ref, p)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(inspection); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", inspection.Name)
+	fmt.Fprintf(w, "Digest:\t%s\n", inspection.Digest)
+	fmt.Fprintf(w, "Media type:\t%s\n", inspection.MediaType)
+
+	if len(inspection.Manifests) > 0 {
+		fmt.Fprintln(w, "Platforms:")
+		for _, entry := range inspection.Manifests {
+			fmt.Fprintf(w, "  %s\t%s\n", entry.Platform, entry.Digest)
+		}
+	}
+
+	img := inspection.Image
+	if img == nil {
+		w.Flush()
+		fmt.Printf("\nThere is no image for %s.\n", p)
+		return
+	}
+
+	if len(inspection.Manifests) > 0 {
+		fmt.Fprintf(w, "Image:\t%s\n", img.Digest)
+	}
+
+	printImage(w, img)
+	w.Flush()
+}
+
+// printImage prints the image of an inspection, and its configuration.
+func printImage(w io.Writer, img *registry.InspectedImage) {
+	fmt.Fprintf(w, "Platform:\t%s\n", img.Platform)
+	fmt.Fprintf(w, "Created:\t%s\n", img.Created)
+	fmt.Fprintf(w, "Layers:\t%d, %s\n", len(img.Layers), units.HumanSize(float64(img.Size)))
+	for _, layer := range img.Layers {
+		fmt.Fprintf(w, "  %s\t%s\n", layer.Digest, units.HumanSize(float64(layer.Size)))
+	}
+
+	for _, env := range img.Config.Env {
+		fmt.Fprintf(w, "Env:\t%s\n", env)
+	}
+
+	if img.Config.Entrypoint != nil {
+		content, _ := json.Marshal(img.Config.Entrypoint)
+		fmt.Fprintf(w, "Entrypoint:\t%s\n", content)
+	}
+	if img.Config.Cmd != nil {
+		content, _ := json.Marshal(img.Config.Cmd)
+		fmt.Fprintf(w, "Cmd:\t%s\n", content)
+	}
+
+	if img.Config.User != "" {
+		fmt.Fprintf(w, "User:\t%s\n", img.Config.User)
+	}
+	if img.Config.WorkingDir != "" {
+		fmt.Fprintf(w, "Working dir:\t%s\n", img.Config.WorkingDir)
+	}
+
+	for _, field := range []struct {
+		name   string
+		values map[string]struct{}
+	}{{"Exposed port:", img.Config.ExposedPorts}, {"Volume:", img.Config.Volumes}} {
+		names := []string{}
+		for name := range field.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%s\n", field.name, name)
+		}
+	}
+
+	labels := []string{}
+	for key, value := range img.Config.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fmt.Fprintf(w, "Label:\t%s\n", label)
+	}
+}
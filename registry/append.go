@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/logger"
+	bt "github.com/box-builder/box/tar"
+)
+
+// Layer is a layer to append to an image, compressed with gzip.
+type Layer struct {
+	File   string // the compressed layer
+	Digest string // the digest of the compressed layer
+	Size   int64  // the size of the compressed layer
+	DiffID string // the digest of the layer uncompressed
+}
+
+// NewLayer writes the layer tarball in fn, compressed with gzip by workers
+// blocks at once, to a temporary file. The tarball may be compressed with gzip
+// or zstd, or not at all. The layer must be closed to remove the file.
+func NewLayer(fn string, workers int) (*Layer, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec, err := bt.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	tmp, err := ioutil.TempFile("", "box-layer")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	layer := &Layer{File: tmp.Name()}
+
+	cw, err := bt.NewDigester(tmp, bt.Gzip, workers)
+	if err != nil {
+		layer.Close()
+		return nil, err
+	}
+
+	if _, err := io.Copy(cw, dec); err != nil {
+		layer.Close()
+		return nil, err
+	}
+
+	if err := cw.Close(); err != nil {
+		layer.Close()
+		return nil, err
+	}
+
+	layer.Digest = cw.Digest()
+	layer.DiffID = cw.DiffID()
+	layer.Size = cw.Size()
+
+	return layer, nil
+}
+
+// Close removes the compressed layer.
+func (l *Layer) Close() error {
+	return os.Remove(l.File)
+}
+
+// pushLayer uploads the layer to the repository of dst, unless it has it, and
+// returns its descriptor in a manifest of the type given.
+func (c *Client) pushLayer(ctx context.Context, dst Reference, layer *Layer, manifestType string, logger *logger.Logger) (descriptor, error) {
+	desc := descriptor{MediaType: MediaTypeOCILayer, Digest: layer.Digest, Size: layer.Size}
+	if manifestType == MediaTypeDockerManifest {
+		desc.MediaType = MediaTypeDockerLayer
+	}
+
+	ok, err := c.BlobExists(ctx, dst.Domain, dst.Repository, layer.Digest)
+	if err != nil || ok {
+		return desc, err
+	}
+
+	f, err := os.Open(layer.File)
+	if err != nil {
+		return desc, err
+	}
+	defer f.Close()
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(copy.WithProgress(w, f, logger, fmt.Sprintf("Pushing %s", strings.TrimPrefix(layer.Digest, "sha256:")[:12])))
+	}()
+
+	err = c.PutBlob(ctx, dst.Domain, dst.Repository, "", layer.Digest, layer.Size, r)
+	r.CloseWithError(err)
+	return desc, err
+}
@@ -0,0 +1,235 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+)
+
+// Media types and annotations of in-toto attestations, signed in DSSE
+// envelopes.
+const (
+	MediaTypeDSSE           = "application/vnd.dsse.envelope.v1+json"
+	PayloadTypeInToto       = "application/vnd.in-toto+json"
+	PredicateTypeAnnotation = "in-toto.io/predicate-type"
+
+	statementType = "https://in-toto.io/Statement/v1"
+)
+
+// Subject is an artifact an attestation is about.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Statement is an in-toto statement: a predicate about its subjects.
+type Statement struct {
+	Type          string          `json:"_type"`
+	Subject       []Subject       `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// envelope is a DSSE envelope, which signs the payload with its type.
+type envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     string              `json:"payload"`
+	Signatures  []envelopeSignature `json:"signatures"`
+}
+
+type envelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// pae is the pre-authentication encoding of the payload, which DSSE signs.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// Attest signs an in-toto statement of the predicate, whose subject is the
+// manifest of the image, in a DSSE envelope, and pushes it as a referrer of
+// the manifest. Returns the digest of the manifest attested.
+func (c *Client) Attest(ctx context.Context, ref Reference, signer Signer, predicateType string, predicate interface{}) (string, error) {
+	dgst, err := c.attest(ctx, ref, signer, predicateType, predicate)
+	audit.Record(audit.Sign, ref.String(), dgst, err)
+	return dgst, err
+}
+
+func (c *Client) attest(ctx context.Context, ref Reference, signer Signer, predicateType string, predicate interface{}) (string, error) {
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", ref, err)
+	}
+
+	content, err := json.Marshal(predicate)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(m.Digest, ":", 2)
+	statement := Statement{
+		Type:          statementType,
+		Subject:       []Subject{{Name: ref.Domain + "/" + ref.Repository, Digest: map[string]string{parts[0]: parts[1]}}},
+		PredicateType: predicateType,
+		Predicate:     content,
+	}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := signer.Sign(ctx, pae(PayloadTypeInToto, payload))
+	if err != nil {
+		return "", err
+	}
+
+	env := envelope{
+		PayloadType: PayloadTypeInToto,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []envelopeSignature{{Sig: base64.StdEncoding.EncodeToString(signature)}},
+	}
+
+	signed, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := c.putContent(ctx, ref, signed)
+	if err != nil {
+		return "", err
+	}
+
+	layer := artifactDescriptor{
+		MediaType:   MediaTypeDSSE,
+		Digest:      digest,
+		Size:        int64(len(signed)),
+		Annotations: map[string]string{PredicateTypeAnnotation: predicateType},
+	}
+
+	if _, err := c.pushReferrer(ctx, ref, m, MediaTypeDSSE, layer); err != nil {
+		return "", err
+	}
+
+	return m.Digest, nil
+}
+
+// VerifyAttestations returns the statements of the predicate type attached to
+// the manifest of the image which are signed with the public key, and the
+// digest of the manifest. It is an error for there to be none.
+func (c *Client) VerifyAttestations(ctx context.Context, ref Reference, public crypto.PublicKey, predicateType string) (string, []Statement, error) {
+	dgst, statements, err := c.verifyAttestations(ctx, ref, public, predicateType)
+	audit.Record(audit.Verify, ref.String(), dgst, err)
+	return dgst, statements, err
+}
+
+func (c *Client) verifyAttestations(ctx context.Context, ref Reference, public crypto.PublicKey, predicateType string) (string, []Statement, error) {
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", ref, err)
+	}
+
+	referrers, _, err := c.referrers(ctx, ref, m.Digest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	statements := []Statement{}
+
+	for _, desc := range referrers {
+		if desc.ArtifactType != MediaTypeDSSE {
+			continue
+		}
+
+		referrer, err := c.GetManifest(ctx, ref.at(desc.Digest))
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", ref.at(desc.Digest), err)
+		}
+
+		manifest := signatureManifest{}
+		if err := json.Unmarshal(referrer.Content, &manifest); err != nil {
+			return "", nil, fmt.Errorf("attestations of %s: %v", ref, err)
+		}
+
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != MediaTypeDSSE || layer.Annotations[PredicateTypeAnnotation] != predicateType {
+				continue
+			}
+
+			statement, ok, err := c.verifyAttestation(ctx, ref, m.Digest, layer, public)
+			if err != nil {
+				return "", nil, err
+			}
+
+			if ok && statement.PredicateType == predicateType {
+				statements = append(statements, *statement)
+			}
+		}
+	}
+
+	if len(statements) == 0 {
+		return m.Digest, nil, fmt.Errorf("%s has no %s attestation signed with the key", ref, predicateType)
+	}
+
+	return m.Digest, statements, nil
+}
+
+// verifyAttestation returns the statement in the envelope in the layer, and
+// whether it is valid: signed with the key, about the manifest.
+func (c *Client) verifyAttestation(ctx context.Context, ref Reference, digest string, layer artifactDescriptor, public crypto.PublicKey) (*Statement, bool, error) {
+	rc, _, err := c.GetBlob(ctx, ref.Domain, ref.Repository, layer.Digest)
+	if err != nil {
+		return nil, false, fmt.Errorf("attestation %s of %s: %v", layer.Digest, ref, err)
+	}
+	defer rc.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(rc, maxPayloadSize))
+	if err != nil {
+		return nil, false, err
+	}
+
+	env := envelope{}
+	if fmt.Sprintf("sha256:%x", sha256.Sum256(content)) != layer.Digest || json.Unmarshal(content, &env) != nil || env.PayloadType != PayloadTypeInToto {
+		return nil, false, nil
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	valid := false
+	for _, sig := range env.Signatures {
+		signature, err := base64.StdEncoding.DecodeString(sig.Sig)
+		if err == nil && verifySignature(public, pae(env.PayloadType, payload), signature) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, false, nil
+	}
+
+	statement := &Statement{}
+	if err := json.Unmarshal(payload, statement); err != nil || statement.Type != statementType {
+		return nil, false, nil
+	}
+
+	parts := strings.SplitN(digest, ":", 2)
+	for _, subject := range statement.Subject {
+		if subject.Digest[parts[0]] == parts[1] {
+			return statement, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,758 @@
+// Package registry talks to image registries directly, with the docker
+// registry HTTP API, for the commands which work on images without a docker
+// daemon.
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/tlsconfig"
+	"github.com/box-builder/box/tracing"
+	"github.com/containers/image/docker/reference"
+)
+
+// Media types of the manifests the registry package handles.
+const (
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+)
+
+// Media types of layers.
+const (
+	MediaTypeDockerLayer          = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeOCILayer             = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayerZstd         = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeOCILayerUncompressed = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// maxManifestSize is the size of the largest manifest read, and
+// maxConfigSize of the largest image configuration. Blobs larger than these
+// are not what they claim to be, and are not read into memory.
+const (
+	maxManifestSize = 4 << 20
+	maxConfigSize   = 16 << 20
+)
+
+// maxHeadRequests is the number of blobs checked for at once before a push.
+const maxHeadRequests = 8
+
+// uploadCancelTimeout is how long the registry is given to cancel an upload
+// which failed.
+const uploadCancelTimeout = 10 * time.Second
+
+var manifestTypes = []string{MediaTypeDockerManifest, MediaTypeDockerList, MediaTypeOCIManifest, MediaTypeOCIIndex}
+
+// ErrNotFound is returned when the registry does not have a manifest or
+// blob.
+var ErrNotFound = errors.New("not found in the registry")
+
+// Reference is an image in a registry: its repository, and a tag or digest.
+type Reference struct {
+	Domain     string
+	Repository string
+	Reference  string // a tag, or a digest
+}
+
+// ParseReference parses an image name the way docker does; an image without
+// a tag or digest is tagged latest.
+func ParseReference(name string) (Reference, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return Reference{}, err
+	}
+
+	named = reference.TagNameOnly(named)
+
+	ref := Reference{Domain: reference.Domain(named), Repository: reference.Path(named)}
+
+	switch named := named.(type) {
+	case reference.Canonical:
+		ref.Reference = named.Digest().String()
+	case reference.Tagged:
+		ref.Reference = named.Tag()
+	}
+
+	return ref, nil
+}
+
+func (r Reference) String() string {
+	if strings.HasPrefix(r.Reference, "sha256:") {
+		return fmt.Sprintf("%s/%s@%s", r.Domain, r.Repository, r.Reference)
+	}
+
+	return fmt.Sprintf("%s/%s:%s", r.Domain, r.Repository, r.Reference)
+}
+
+// Client makes requests to registries, authenticating with the credentials
+// docker login stored, or anonymously.
+type Client struct {
+	client *http.Client
+	policy *policy.Policy
+	// Insecure is true if registries are reached over plain http. Registries
+	// on localhost always are, as docker reaches them.
+	Insecure bool
+
+	tokens map[string]string
+	mutex  sync.Mutex
+}
+
+// NewClient returns a client for registries, which only makes the requests
+// the policy allows, if it is set.
+func NewClient(p *policy.Policy) *Client {
+	return &Client{client: &http.Client{Transport: countingTransport{}}, policy: p, tokens: map[string]string{}}
+}
+
+func (c *Client) endpoint(domain string) string {
+	if domain == "docker.io" {
+		domain = "registry-1.docker.io"
+	}
+
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+
+	// with strict TLS, even registries on localhost are reached over https.
+	if !tlsconfig.Strict() && (c.Insecure || host == "localhost" || net.ParseIP(host).IsLoopback()) {
+		return "http://" + domain
+	}
+
+	return "https://" + domain
+}
+
+// credentials returns the user and password docker login stored for the
+// registry, if any.
+func credentials(domain string) (string, string) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", ""
+	}
+
+	config := struct {
+		Auths map[string]struct{ Auth string }
+	}{}
+
+	if err := json.Unmarshal(content, &config); err != nil {
+		return "", ""
+	}
+
+	keys := []string{domain, "https://" + domain, "http://" + domain}
+	if domain == "docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/")
+	}
+
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", ""
+		}
+
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) == 2 {
+			return parts[0], parts[1]
+		}
+	}
+
+	return "", ""
+}
+
+// do makes a request to the registry for the repository, if the policy allows
+// it. If the registry asks for authentication, a token for the scope is
+// obtained and the request is made again; body is seeked back to its start for
+// it.
+func (c *Client) do(ctx context.Context, method, domain, path, scope string, header http.Header, body io.ReadSeeker, length int64) (*http.Response, error) {
+	if err := checkDomain(c.policy, domain, isPush(method)); err != nil {
+		return nil, err
+	}
+
+	u := c.endpoint(domain) + path
+	key := domain + " " + scope
+
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			reader = body
+		}
+
+		req, err := http.NewRequest(method, u, reader)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		if body != nil {
+			req.ContentLength = length
+		}
+
+		c.mutex.Lock()
+		auth := c.tokens[key]
+		c.mutex.Unlock()
+
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		auth, err = c.authorize(ctx, domain, scope, challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mutex.Lock()
+		c.tokens[key] = auth
+		c.mutex.Unlock()
+	}
+}
+
+// authorize answers the registry's challenge, returning the Authorization
+// header to send.
+func (c *Client) authorize(ctx context.Context, domain, scope, challenge string) (string, error) {
+	user, password := credentials(domain)
+
+	parts := strings.SplitN(challenge, " ", 2)
+	switch strings.ToLower(parts[0]) {
+	case "basic":
+		if user == "" {
+			return "", fmt.Errorf("%s requires a login", domain)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("%s asked for unsupported authentication %q", domain, challenge)
+	}
+
+	params := map[string]string{}
+	if len(parts) == 2 {
+		params = parseChallenge(parts[1])
+	}
+
+	u, err := tokenURL(domain, scope, params)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("obtaining a token for %s: %s", domain, resp.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+// tokenURL returns the URL of the token for the scope, from the parameters
+// of the challenge of the registry.
+func tokenURL(domain, scope string, params map[string]string) (*url.URL, error) {
+	if params["realm"] == "" {
+		return nil, fmt.Errorf("%s asked for a token without a realm", domain)
+	}
+
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	// a request may need several scopes, such as mounting a blob from another
+	// repository.
+	for _, scope := range strings.Fields(scope) {
+		query.Add("scope", scope)
+	}
+	u.RawQuery = query.Encode()
+
+	return u, nil
+}
+
+// parseChallenge parses the parameters of a WWW-Authenticate challenge:
+// comma separated key="value" pairs.
+func parseChallenge(s string) map[string]string {
+	params := map[string]string{}
+
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma >= 0 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+
+		params[key] = value
+		s = strings.TrimLeft(s, ", ")
+	}
+
+	return params
+}
+
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
+}
+
+func pushScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repo)
+}
+
+func statusError(method, u string, resp *http.Response) error {
+	content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(content)))
+}
+
+// Manifest is a manifest as the registry serves it.
+type Manifest struct {
+	MediaType string
+	Digest    string
+	Content   []byte
+}
+
+// GetManifest gets the manifest of the image, which may be a manifest list.
+func (c *Client) GetManifest(ctx context.Context, ref Reference) (*Manifest, error) {
+	path := fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Reference)
+
+	resp, err := c.do(ctx, "GET", ref.Domain, path, pullScope(ref.Repository), http.Header{"Accept": manifestTypes}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, statusError("GET", ref.String(), resp)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) > maxManifestSize {
+		return nil, fmt.Errorf("manifest of %s is larger than %d bytes", ref, maxManifestSize)
+	}
+
+	m := &Manifest{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Content:   content,
+	}
+
+	if m.MediaType == "" || m.MediaType == "application/json" || m.MediaType == "text/plain" {
+		mt := struct{ MediaType string }{}
+		json.Unmarshal(content, &mt)
+		m.MediaType = mt.MediaType
+	}
+
+	return m, nil
+}
+
+// PutManifest puts the manifest under the image's tag or digest.
+func (c *Client) PutManifest(ctx context.Context, ref Reference, m *Manifest) error {
+	err := c.putManifest(ctx, ref, m)
+	audit.Record(audit.Push, ref.String(), m.Digest, err)
+	return err
+}
+
+func (c *Client) putManifest(ctx context.Context, ref Reference, m *Manifest) error {
+	path := fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Reference)
+
+	resp, err := c.do(ctx, "PUT", ref.Domain, path, pushScope(ref.Repository), http.Header{"Content-Type": {m.MediaType}}, strings.NewReader(string(m.Content)), int64(len(m.Content)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return statusError("PUT", ref.String(), resp)
+	}
+
+	return nil
+}
+
+// BlobExists is true if the repository has the blob.
+func (c *Client) BlobExists(ctx context.Context, domain, repo, digest string) (bool, error) {
+	path := fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)
+
+	resp, err := c.do(ctx, "HEAD", domain, path, pullScope(repo), nil, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, statusError("HEAD", domain+path, resp)
+	}
+}
+
+// BlobsExist checks for the blobs in the repository, maxHeadRequests at once,
+// and returns those it has.
+func (c *Client) BlobsExist(ctx context.Context, domain, repo string, digests []string) (map[string]bool, error) {
+	exists := map[string]bool{}
+
+	var (
+		mutex    sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+
+	check := func(digest string) {
+		ok, err := c.BlobExists(ctx, domain, repo, digest)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		exists[digest] = ok
+	}
+
+	requests := make(chan struct{}, maxHeadRequests)
+	checked := map[string]bool{}
+
+	for _, digest := range digests {
+		if checked[digest] {
+			continue
+		}
+
+		first := len(checked) == 0
+		checked[digest] = true
+
+		// the first blob is checked alone, so the token for the repository
+		// is obtained once.
+		if first {
+			check(digest)
+			continue
+		}
+
+		wg.Add(1)
+		requests <- struct{}{}
+
+		go func(digest string) {
+			defer wg.Done()
+			check(digest)
+			<-requests
+		}(digest)
+	}
+
+	wg.Wait()
+
+	return exists, firstErr
+}
+
+// GetBlob gets the content of the blob, and its size. The transfer is
+// traced until the content is closed.
+func (c *Client) GetBlob(ctx context.Context, domain, repo, digest string) (io.ReadCloser, int64, error) {
+	ctx, span := tracing.Start(ctx, "pull blob", tracing.KindInternal)
+	span.Set("registry.repository", domain+"/"+repo)
+	span.Set("registry.digest", digest)
+
+	rc, size, err := c.getBlob(ctx, domain, repo, digest)
+	if err != nil {
+		span.End(err)
+		return nil, 0, err
+	}
+
+	span.Set("registry.size", size)
+	return tracedBody{ReadCloser: rc, span: span}, size, nil
+}
+
+// tracedBody ends the span of the transfer of a blob as it is closed.
+type tracedBody struct {
+	io.ReadCloser
+	span *tracing.Span
+}
+
+func (tb tracedBody) Close() error {
+	tb.span.End(nil)
+	return tb.ReadCloser.Close()
+}
+
+func (c *Client) getBlob(ctx context.Context, domain, repo, digest string) (io.ReadCloser, int64, error) {
+	path := fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)
+
+	resp, err := c.do(ctx, "GET", domain, path, pullScope(repo), nil, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, 0, statusError("GET", domain+path, resp)
+	}
+}
+
+// MountBlob mounts the blob from another repository on the same registry,
+// so it need not be uploaded. It returns false, with the location to upload
+// the blob to, if the registry could not mount it.
+func (c *Client) MountBlob(ctx context.Context, domain, repo, from, digest string) (bool, string, error) {
+	path := fmt.Sprintf("/v2/%s/blobs/uploads/?mount=%s&from=%s", repo, url.QueryEscape(digest), url.QueryEscape(from))
+	scope := pushScope(repo) + " " + pullScope(from)
+
+	resp, err := c.do(ctx, "POST", domain, path, scope, nil, nil, 0)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, "", nil
+	case http.StatusAccepted:
+		location, err := c.location(domain, resp)
+		return false, location, err
+	default:
+		return false, "", statusError("POST", domain+path, resp)
+	}
+}
+
+func (c *Client) location(domain string, resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("%s did not say where to upload to", domain)
+	}
+
+	base, err := url.Parse(c.endpoint(domain) + "/")
+	if err != nil {
+		return "", err
+	}
+
+	u, err := base.Parse(location)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkScheme(u); err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// checkScheme returns an error if the URL is reached over plain http while
+// TLS is strict, as registries may send token services and uploads elsewhere.
+func checkScheme(u *url.URL) error {
+	if tlsconfig.Strict() && u.Scheme != "https" {
+		return fmt.Errorf("%s is not reached over https, as strict TLS requires", u.Host)
+	}
+
+	return nil
+}
+
+// PutBlob uploads the blob in one request. location is where to upload it,
+// as MountBlob returned; if it is empty, an upload is started.
+func (c *Client) PutBlob(ctx context.Context, domain, repo, location, digest string, size int64, content io.Reader) error {
+	ctx, span := tracing.Start(ctx, "push blob", tracing.KindInternal)
+	span.Set("registry.repository", domain+"/"+repo)
+	span.Set("registry.digest", digest)
+	span.Set("registry.size", size)
+
+	err := c.putBlob(ctx, domain, repo, location, digest, size, content)
+	span.End(err)
+	return err
+}
+
+func (c *Client) putBlob(ctx context.Context, domain, repo, location, digest string, size int64, content io.Reader) error {
+	scope := pushScope(repo)
+
+	if location == "" {
+		path := fmt.Sprintf("/v2/%s/blobs/uploads/", repo)
+
+		resp, err := c.do(ctx, "POST", domain, path, scope, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			return statusError("POST", domain+path, resp)
+		}
+
+		if location, err = c.location(domain, resp); err != nil {
+			return err
+		}
+	}
+
+	if err := c.upload(ctx, domain, scope, location, digest, size, content); err != nil {
+		c.cancelUpload(domain, repo, location)
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) upload(ctx context.Context, domain, scope, location, digest string, size int64, content io.Reader) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	// the content is streamed, so it can only be sent once; the token was
+	// obtained when the upload started.
+	req, err := http.NewRequest("PUT", u.String(), content)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.setUploadAuth(req, domain, scope)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return statusError("PUT", location, resp)
+	}
+
+	return nil
+}
+
+// setUploadAuth authorizes a request of an upload with the token of the
+// request which started it, which may have been for more scopes than the
+// push, as when MountBlob started it.
+func (c *Client) setUploadAuth(req *http.Request, domain, scope string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, auth := range c.tokens {
+		if strings.HasPrefix(key, domain+" "+scope) {
+			req.Header.Set("Authorization", auth)
+			return
+		}
+	}
+}
+
+// cancelUpload cancels the upload started at location, which failed, so the
+// registry drops what was sent of it instead of keeping it until it expires.
+// Uploads fail as their context is canceled, so it has a context of its own.
+// Registries which can't cancel uploads are left to expire them.
+func (c *Client) cancelUpload(domain, repo, location string) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadCancelTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("DELETE", location, nil)
+	if err != nil {
+		return
+	}
+	c.setUploadAuth(req, domain, pushScope(repo))
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/logger"
+)
+
+// descriptor refers to a blob or manifest from a manifest.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type imageManifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+type indexManifest struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+// at returns the reference for the same repository at another tag or digest.
+func (r Reference) at(reference string) Reference {
+	r.Reference = reference
+	return r
+}
+
+// Copy copies the image from src to dst, registry to registry: the blobs are
+// streamed through without being kept, and the blobs dst already has are
+// skipped. Blobs in another repository on the same registry are mounted
+// rather than copied. A manifest list is copied with all of its images.
+// Returns the digest of the manifest copied.
+func (c *Client) Copy(ctx context.Context, src, dst Reference, logger *logger.Logger) (string, error) {
+	m, err := c.GetManifest(ctx, src)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", src, err)
+		audit.Record(audit.Pull, src.String(), "", err)
+		return "", err
+	}
+
+	err = c.copyManifest(ctx, src, dst, m, logger)
+	audit.Record(audit.Pull, src.String(), m.Digest, err)
+	if err != nil {
+		return "", err
+	}
+
+	return m.Digest, c.PutManifest(ctx, dst, m)
+}
+
+// copyManifest copies what the manifest refers to, but not the manifest
+// itself.
+func (c *Client) copyManifest(ctx context.Context, src, dst Reference, m *Manifest, logger *logger.Logger) error {
+	switch m.MediaType {
+	case MediaTypeDockerList, MediaTypeOCIIndex:
+		list := indexManifest{}
+		if err := json.Unmarshal(m.Content, &list); err != nil {
+			return err
+		}
+
+		for _, desc := range list.Manifests {
+			child, err := c.GetManifest(ctx, src.at(desc.Digest))
+			if err != nil {
+				return fmt.Errorf("%s: %v", src.at(desc.Digest), err)
+			}
+
+			if err := c.copyManifest(ctx, src, dst, child, logger); err != nil {
+				return err
+			}
+
+			if err := c.PutManifest(ctx, dst.at(desc.Digest), child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		img := imageManifest{}
+		if err := json.Unmarshal(m.Content, &img); err != nil {
+			return err
+		}
+
+		return c.copyBlobs(ctx, src, dst, append([]descriptor{img.Config}, img.Layers...), logger)
+	default:
+		return fmt.Errorf("%s: manifests of type %q can't be copied", src, m.MediaType)
+	}
+}
+
+// copyBlobs copies the blobs from src to dst, but for foreign layers, which
+// are not kept in registries. dst is asked for all of them at once first, so
+// only the blobs it does not have are copied.
+func (c *Client) copyBlobs(ctx context.Context, src, dst Reference, descs []descriptor, logger *logger.Logger) error {
+	digests := []string{}
+	for _, desc := range descs {
+		if !strings.Contains(desc.MediaType, "foreign") {
+			digests = append(digests, desc.Digest)
+		}
+	}
+
+	exists, err := c.BlobsExist(ctx, dst.Domain, dst.Repository, digests)
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range descs {
+		if strings.Contains(desc.MediaType, "foreign") || exists[desc.Digest] {
+			continue
+		}
+
+		if err := c.copyBlob(ctx, src, dst, desc, logger); err != nil {
+			return err
+		}
+
+		// blobs found twice are copied once.
+		exists[desc.Digest] = true
+	}
+
+	return nil
+}
+
+// copyBlob copies the blob, which dst does not have, from src.
+func (c *Client) copyBlob(ctx context.Context, src, dst Reference, desc descriptor, logger *logger.Logger) error {
+	var (
+		location string
+		err      error
+	)
+
+	if src.Domain == dst.Domain && src.Repository != dst.Repository {
+		var mounted bool
+		mounted, location, err = c.MountBlob(ctx, dst.Domain, dst.Repository, src.Repository, desc.Digest)
+		if err != nil || mounted {
+			return err
+		}
+	}
+
+	rc, size, err := c.GetBlob(ctx, src.Domain, src.Repository, desc.Digest)
+	if err != nil {
+		if location != "" {
+			c.cancelUpload(dst.Domain, dst.Repository, location)
+		}
+		return fmt.Errorf("blob %s of %s: %v", desc.Digest, src, err)
+	}
+	defer rc.Close()
+
+	if size < 0 {
+		size = desc.Size
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(copy.WithProgress(w, rc, logger, fmt.Sprintf("Copying %s", strings.TrimPrefix(desc.Digest, "sha256:")[:12])))
+	}()
+
+	err = c.PutBlob(ctx, dst.Domain, dst.Repository, location, desc.Digest, size, r)
+	r.CloseWithError(err)
+	return err
+}
+
+// Retag puts the manifest of src under the tag of dst, in the same
+// repository. No blobs are transferred. Returns the digest of the manifest.
+func (c *Client) Retag(ctx context.Context, src, dst Reference) (string, error) {
+	if src.Domain != dst.Domain || src.Repository != dst.Repository {
+		return "", fmt.Errorf("%s and %s are not in the same repository; use copy instead", src, dst)
+	}
+
+	m, err := c.GetManifest(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", src, err)
+	}
+
+	return m.Digest, c.PutManifest(ctx, dst, m)
+}
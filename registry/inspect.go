@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Inspection is what a registry tells about an image from its manifest and
+// configuration, without its layers.
+type Inspection struct {
+	Name      string
+	Digest    string
+	MediaType string
+	Manifests []ListEntry     // the images of a manifest list
+	Image     *InspectedImage // the image, or the image of a manifest list for the platform
+}
+
+// InspectedImage is an image, as its manifest and configuration describe it.
+type InspectedImage struct {
+	Digest   string
+	ID       string // the digest of the configuration, which docker gives the image as its ID
+	Platform Platform
+	Created  string
+	Layers   []InspectedLayer
+	Size     int64    // the size of the layers, as pulled
+	DiffIDs  []string // the digests of the layers, uncompressed
+	Config   ImageConfig
+}
+
+// ImageConfig is the configuration containers of an image are run with.
+type ImageConfig struct {
+	Env          []string
+	Entrypoint   []string
+	Cmd          []string
+	User         string
+	WorkingDir   string
+	ExposedPorts map[string]struct{}
+	Volumes      map[string]struct{}
+	Labels       map[string]string
+}
+
+// InspectedLayer is a layer of an image.
+type InspectedLayer struct {
+	Digest    string
+	MediaType string
+	Size      int64
+}
+
+// Inspect fetches the manifest of an image, and the configuration of the
+// image, without its layers. For a manifest list, the image inspected is the
+// one for the platform; Image is nil if there is none.
+func (c *Client) Inspect(ctx context.Context, ref Reference, platform Platform) (*Inspection, error) {
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref, err)
+	}
+
+	inspection := &Inspection{Name: ref.String(), Digest: m.Digest, MediaType: m.MediaType}
+
+	switch m.MediaType {
+	case MediaTypeDockerList, MediaTypeOCIIndex:
+		if inspection.Manifests, err = listEntries(ref, m); err != nil {
+			return nil, err
+		}
+
+		for _, entry := range inspection.Manifests {
+			if platform.Matches(entry.Platform) {
+				child, err := c.GetManifest(ctx, ref.at(entry.Digest))
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", ref.at(entry.Digest), err)
+				}
+
+				inspection.Image, err = c.inspectImage(ctx, ref, child)
+				return inspection, err
+			}
+		}
+
+		return inspection, nil
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		inspection.Image, err = c.inspectImage(ctx, ref, m)
+		return inspection, err
+	default:
+		return nil, fmt.Errorf("%s: manifests of type %q can't be inspected", ref, m.MediaType)
+	}
+}
+
+func (c *Client) inspectImage(ctx context.Context, ref Reference, m *Manifest) (*InspectedImage, error) {
+	img := imageManifest{}
+	if err := json.Unmarshal(m.Content, &img); err != nil {
+		return nil, err
+	}
+
+	rc, _, err := c.GetBlob(ctx, ref.Domain, ref.Repository, img.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("configuration of %s: %v", ref, err)
+	}
+	defer rc.Close()
+
+	inspected := &InspectedImage{Digest: m.Digest, ID: img.Config.Digest}
+
+	config := struct {
+		Platform
+		Created string       `json:"created"`
+		Config  *ImageConfig `json:"config"`
+		RootFS  struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{Config: &inspected.Config}
+
+	if err := json.NewDecoder(io.LimitReader(rc, maxConfigSize)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("configuration of %s: %v", ref, err)
+	}
+
+	inspected.Platform = config.Platform
+	inspected.Created = config.Created
+	inspected.DiffIDs = config.RootFS.DiffIDs
+
+	for _, desc := range img.Layers {
+		inspected.Layers = append(inspected.Layers, InspectedLayer{Digest: desc.Digest, MediaType: desc.MediaType, Size: desc.Size})
+		inspected.Size += desc.Size
+	}
+
+	return inspected, nil
+}
@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/box-builder/box/vault"
+)
+
+// VaultKeyPrefix is the prefix of keys kept in the transit secrets engine of
+// HashiCorp Vault, as cosign names them.
+const VaultKeyPrefix = "hashivault://"
+
+// Signer signs the payloads of signatures.
+type Signer interface {
+	// Sign returns the signature of the payload: ASN.1 for ECDSA keys, and
+	// PKCS #1 v1.5 for RSA keys, over its SHA-256 digest.
+	Sign(ctx context.Context, payload []byte) ([]byte, error)
+}
+
+// keySigner signs with a private key read from a file.
+type keySigner struct {
+	key crypto.Signer
+}
+
+func (k *keySigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	digest := sha256.Sum256(payload)
+	return k.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// vaultKey is a key of the transit secrets engine of Vault, see package
+// vault. The engine is mounted at transit unless $TRANSIT_SECRET_ENGINE_PATH
+// says otherwise.
+type vaultKey struct {
+	name string
+}
+
+func (v *vaultKey) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	mount := os.Getenv("TRANSIT_SECRET_ENGINE_PATH")
+	if mount == "" {
+		mount = "transit"
+	}
+
+	return vault.Request(ctx, method, fmt.Sprintf("%s/%s/%s", mount, path, v.name), body, result)
+}
+
+func (v *vaultKey) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	result := struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}{}
+
+	// the algorithm only applies to RSA keys; ECDSA signatures are ASN.1.
+	body := map[string]string{
+		"input":               base64.StdEncoding.EncodeToString(payload),
+		"hash_algorithm":      "sha2-256",
+		"signature_algorithm": "pkcs1v15",
+	}
+	if err := v.request(ctx, "POST", "sign", body, &result); err != nil {
+		return nil, err
+	}
+
+	// signatures are vault:v<version>:<base64>.
+	parts := strings.SplitN(result.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("vault key %s: invalid signature %q", v.name, result.Data.Signature)
+	}
+
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+func (v *vaultKey) publicKey(ctx context.Context) (crypto.PublicKey, error) {
+	result := struct {
+		Data struct {
+			LatestVersion int `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}{}
+
+	if err := v.request(ctx, "GET", "keys", nil, &result); err != nil {
+		return nil, err
+	}
+
+	key, ok := result.Data.Keys[strconv.Itoa(result.Data.LatestVersion)]
+	if !ok {
+		return nil, fmt.Errorf("vault key %s has no public key", v.name)
+	}
+
+	return parsePublicKey([]byte(key.PublicKey))
+}
+
+// LoadSigner returns the signer for key: a PEM private key file, ECDSA or
+// RSA and not encrypted, or a key kept in vault, named hashivault://name.
+func LoadSigner(key string) (Signer, error) {
+	if strings.HasPrefix(key, VaultKeyPrefix) {
+		return &vaultKey{name: strings.TrimPrefix(key, VaultKeyPrefix)}, nil
+	}
+
+	content, err := ioutil.ReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", key)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("%s is encrypted: box signs with keys which are not", key)
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %q", key, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+
+	switch private := private.(type) {
+	case *ecdsa.PrivateKey:
+		return &keySigner{key: private}, nil
+	case *rsa.PrivateKey:
+		return &keySigner{key: private}, nil
+	default:
+		return nil, fmt.Errorf("%s: only ECDSA and RSA keys are supported", key)
+	}
+}
+
+// LoadPublicKey returns the public key of key: a PEM public key file, or a
+// key kept in vault, named hashivault://name.
+func LoadPublicKey(ctx context.Context, key string) (crypto.PublicKey, error) {
+	if strings.HasPrefix(key, VaultKeyPrefix) {
+		return (&vaultKey{name: strings.TrimPrefix(key, VaultKeyPrefix)}).publicKey(ctx)
+	}
+
+	content, err := ioutil.ReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := parsePublicKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+
+	return public, nil
+}
+
+func parsePublicKey(content []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("not a PEM public key")
+	}
+
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch public.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return public, nil
+	default:
+		return nil, errors.New("only ECDSA and RSA keys are supported")
+	}
+}
+
+// verifySignature checks the signature of the payload with the public key.
+func verifySignature(public crypto.PublicKey, payload, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+
+	switch public := public.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(public, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,230 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/util"
+)
+
+// ListEntry is an image of a manifest list.
+type ListEntry struct {
+	Image     string // the image the entry was created from
+	MediaType string
+	Digest    string
+	Size      int64
+	Platform  Platform
+}
+
+// ManifestList is a manifest list being assembled on this machine, to be
+// pushed once it has an image for each platform.
+type ManifestList struct {
+	Name    string
+	Entries []ListEntry
+}
+
+// ManifestListDir is where manifest lists are kept until they are pushed.
+func ManifestListDir() string {
+	return util.BoxDir("manifests")
+}
+
+func listFile(name string) string {
+	return filepath.Join(ManifestListDir(), strings.NewReplacer("/", "_", ":", "-", "@", "-").Replace(name)+".json")
+}
+
+// LoadManifestList loads the manifest list created with the name.
+func LoadManifestList(name string) (*ManifestList, error) {
+	content, err := ioutil.ReadFile(listFile(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("there is no manifest list %q; create it first", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	list := &ManifestList{}
+	return list, json.Unmarshal(content, list)
+}
+
+// Save keeps the manifest list on this machine.
+func (l *ManifestList) Save() error {
+	if err := os.MkdirAll(ManifestListDir(), 0700); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fn := listFile(l.Name)
+	if err := ioutil.WriteFile(fn+".tmp", content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(fn+".tmp", fn)
+}
+
+// Remove removes the manifest list from this machine.
+func (l *ManifestList) Remove() error {
+	return os.Remove(listFile(l.Name))
+}
+
+// Entry returns the entry for the image.
+func (l *ManifestList) Entry(image string) (*ListEntry, error) {
+	for i := range l.Entries {
+		if l.Entries[i].Image == image {
+			return &l.Entries[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("manifest list %q has no image %q", l.Name, image)
+}
+
+// Add adds the entries to the list, replacing those of the same images.
+func (l *ManifestList) Add(entries []ListEntry) {
+	for _, entry := range entries {
+		if existing, err := l.Entry(entry.Image); err == nil {
+			*existing = entry
+		} else {
+			l.Entries = append(l.Entries, entry)
+		}
+	}
+}
+
+// ListEntries returns the entries for an image pushed to a registry, with
+// their platforms read from the image configuration. An image which is itself
+// a manifest list gives an entry for each of its images.
+func (c *Client) ListEntries(ctx context.Context, image string) ([]ListEntry, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref, err)
+	}
+
+	switch m.MediaType {
+	case MediaTypeDockerList, MediaTypeOCIIndex:
+		return listEntries(ref, m)
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		img := imageManifest{}
+		if err := json.Unmarshal(m.Content, &img); err != nil {
+			return nil, err
+		}
+
+		rc, _, err := c.GetBlob(ctx, ref.Domain, ref.Repository, img.Config.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("configuration of %s: %v", ref, err)
+		}
+		defer rc.Close()
+
+		platform := Platform{}
+		if err := json.NewDecoder(io.LimitReader(rc, maxConfigSize)).Decode(&platform); err != nil {
+			return nil, err
+		}
+
+		return []ListEntry{{
+			Image:     image,
+			MediaType: m.MediaType,
+			Digest:    m.Digest,
+			Size:      int64(len(m.Content)),
+			Platform:  platform,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("%s: manifests of type %q can't be put in a manifest list", ref, m.MediaType)
+	}
+}
+
+// listEntries returns the entries of a manifest list.
+func listEntries(ref Reference, m *Manifest) ([]ListEntry, error) {
+	list := struct {
+		Manifests []struct {
+			descriptor
+			Platform Platform `json:"platform"`
+		} `json:"manifests"`
+	}{}
+
+	if err := json.Unmarshal(m.Content, &list); err != nil {
+		return nil, err
+	}
+
+	entries := []ListEntry{}
+	for _, desc := range list.Manifests {
+		entries = append(entries, ListEntry{
+			Image:     ref.at(desc.Digest).String(),
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+			Platform:  desc.Platform,
+		})
+	}
+
+	return entries, nil
+}
+
+// PushList pushes the manifest list under its name. The images of the list
+// are copied into its repository first if they are elsewhere. Returns the
+// digest of the list.
+func (c *Client) PushList(ctx context.Context, list *ManifestList, logger *logger.Logger) (string, error) {
+	dst, err := ParseReference(list.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(list.Entries) == 0 {
+		return "", fmt.Errorf("manifest list %q has no images", list.Name)
+	}
+
+	mediaType := MediaTypeOCIIndex
+	manifests := []interface{}{}
+
+	for _, entry := range list.Entries {
+		if entry.MediaType != MediaTypeOCIManifest {
+			mediaType = MediaTypeDockerList
+		}
+
+		src, err := ParseReference(entry.Image)
+		if err != nil {
+			return "", err
+		}
+
+		if src.Domain != dst.Domain || src.Repository != dst.Repository {
+			if _, err := c.Copy(ctx, src.at(entry.Digest), dst.at(entry.Digest), logger); err != nil {
+				return "", err
+			}
+		}
+
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": entry.MediaType,
+			"digest":    entry.Digest,
+			"size":      entry.Size,
+			"platform":  entry.Platform,
+		})
+	}
+
+	content, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaType,
+		"manifests":     manifests,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	m := &Manifest{MediaType: mediaType, Content: content}
+	if err := c.PutManifest(ctx, dst, m); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content)), nil
+}
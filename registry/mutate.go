@@ -0,0 +1,310 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/util"
+)
+
+// the media types of image configurations; manifests with other
+// configurations, such as attestations, are not images and are not mutated.
+var imageConfigTypes = map[string]bool{
+	"application/vnd.docker.container.image.v1+json": true,
+	"application/vnd.oci.image.config.v1+json":       true,
+}
+
+// Mutation is a change to the configuration of an image, and optionally a
+// layer to add on top of it.
+type Mutation struct {
+	Env          []string          // variables, as KEY=value, replacing those of the same name
+	Labels       map[string]string // labels, replacing those of the same name
+	Entrypoint   []string          // if not nil, replaces the entrypoint; empty removes it
+	Cmd          []string          // if not nil, replaces the command; empty removes it
+	User         string            // if set, replaces the user
+	WorkDir      string            // if set, replaces the working directory
+	ExposedPorts []string          // ports to expose, as port or port/proto
+	CreatedBy    string            // the history entry of the mutation
+	Layer        *Layer            // if set, appended to the image
+}
+
+// Apply applies the mutation to an image configuration, and records it in its
+// history. Fields of the configuration the mutation does not change are kept
+// as they are. The diff ID of the layer appended, if any, is added to the
+// root filesystem of the image.
+func (m Mutation) Apply(image map[string]interface{}) error {
+	config, ok := image["config"].(map[string]interface{})
+	if !ok {
+		config = map[string]interface{}{}
+		image["config"] = config
+	}
+
+	if len(m.Env) > 0 {
+		env, err := replaceEnv(config["Env"], m.Env)
+		if err != nil {
+			return err
+		}
+
+		config["Env"] = env
+	}
+
+	if len(m.Labels) > 0 {
+		labels, ok := config["Labels"].(map[string]interface{})
+		if !ok {
+			labels = map[string]interface{}{}
+		}
+
+		for key, value := range m.Labels {
+			labels[key] = value
+		}
+
+		config["Labels"] = labels
+	}
+
+	for key, value := range map[string][]string{"Entrypoint": m.Entrypoint, "Cmd": m.Cmd} {
+		switch {
+		case value == nil:
+		case len(value) == 0:
+			config[key] = nil
+		default:
+			config[key] = value
+		}
+	}
+
+	if m.User != "" {
+		config["User"] = m.User
+	}
+
+	if m.WorkDir != "" {
+		config["WorkingDir"] = m.WorkDir
+	}
+
+	if len(m.ExposedPorts) > 0 {
+		config["ExposedPorts"] = exposePorts(config["ExposedPorts"], m.ExposedPorts)
+	}
+
+	entry := map[string]interface{}{
+		"created":    util.BuildTime().UTC().Format(time.RFC3339Nano),
+		"created_by": m.CreatedBy,
+	}
+
+	if m.Layer != nil {
+		rootfs, ok := image["rootfs"].(map[string]interface{})
+		if !ok {
+			rootfs = map[string]interface{}{"type": "layers"}
+			image["rootfs"] = rootfs
+		}
+
+		diffIDs, _ := rootfs["diff_ids"].([]interface{})
+		rootfs["diff_ids"] = append(diffIDs, m.Layer.DiffID)
+	} else {
+		entry["empty_layer"] = true
+	}
+
+	history, _ := image["history"].([]interface{})
+	image["history"] = append(history, entry)
+
+	return nil
+}
+
+// replaceEnv returns the variables of the configuration, env, with the
+// variables set, replacing those of the same name.
+func replaceEnv(value interface{}, variables []string) ([]interface{}, error) {
+	env, _ := value.([]interface{})
+
+	for _, variable := range variables {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid environment variable %q: must be KEY=value", variable)
+		}
+
+		replaced := false
+		for i, existing := range env {
+			if s, ok := existing.(string); ok && strings.SplitN(s, "=", 2)[0] == parts[0] {
+				env[i] = variable
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			env = append(env, variable)
+		}
+	}
+
+	return env, nil
+}
+
+// exposePorts returns the exposed ports of the configuration, value, with the
+// ports added; those without a protocol are TCP.
+func exposePorts(value interface{}, exposed []string) map[string]interface{} {
+	ports, ok := value.(map[string]interface{})
+	if !ok {
+		ports = map[string]interface{}{}
+	}
+
+	for _, port := range exposed {
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		ports[port] = map[string]interface{}{}
+	}
+
+	return ports
+}
+
+// Mutate puts the image src, with its configuration changed by the mutation,
+// under dst. Only a new configuration and manifest, and the layer the mutation
+// appends if any, are pushed; the layers of src are the same, copied as Copy
+// does if dst is in another repository. Each image of a manifest list is
+// mutated. Returns the digest of the new manifest.
+func (c *Client) Mutate(ctx context.Context, src, dst Reference, mutation Mutation, logger *logger.Logger) (string, error) {
+	m, err := c.GetManifest(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", src, err)
+	}
+
+	m, err = c.mutateManifest(ctx, src, dst, m, mutation, logger)
+	if err != nil {
+		return "", err
+	}
+
+	return m.Digest, c.PutManifest(ctx, dst, m)
+}
+
+// mutateManifest pushes what the mutated manifest refers to, and returns it.
+func (c *Client) mutateManifest(ctx context.Context, src, dst Reference, m *Manifest, mutation Mutation, logger *logger.Logger) (*Manifest, error) {
+	manifest := map[string]interface{}{}
+	if err := json.Unmarshal(m.Content, &manifest); err != nil {
+		return nil, err
+	}
+
+	switch m.MediaType {
+	case MediaTypeDockerList, MediaTypeOCIIndex:
+		if err := c.mutateList(ctx, src, dst, m, manifest, mutation, logger); err != nil {
+			return nil, err
+		}
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		img := imageManifest{}
+		if err := json.Unmarshal(m.Content, &img); err != nil {
+			return nil, err
+		}
+
+		if !imageConfigTypes[img.Config.MediaType] {
+			return m, c.copyManifest(ctx, src, dst, m, logger)
+		}
+
+		if err := c.mutateImage(ctx, src, dst, m.MediaType, img, manifest, mutation, logger); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: manifests of type %q can't be mutated", src, m.MediaType)
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manifest{
+		MediaType: m.MediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Content:   content,
+	}, nil
+}
+
+// mutateList mutates and pushes each image of the manifest list m, and
+// points its entry in manifest, the content of m, to the new one.
+func (c *Client) mutateList(ctx context.Context, src, dst Reference, m *Manifest, manifest map[string]interface{}, mutation Mutation, logger *logger.Logger) error {
+	list := indexManifest{}
+	if err := json.Unmarshal(m.Content, &list); err != nil {
+		return err
+	}
+
+	entries, _ := manifest["manifests"].([]interface{})
+	if len(entries) != len(list.Manifests) {
+		return fmt.Errorf("%s: invalid manifest list", src)
+	}
+
+	for i, desc := range list.Manifests {
+		child, err := c.GetManifest(ctx, src.at(desc.Digest))
+		if err != nil {
+			return fmt.Errorf("%s: %v", src.at(desc.Digest), err)
+		}
+
+		child, err = c.mutateManifest(ctx, src, dst, child, mutation, logger)
+		if err != nil {
+			return err
+		}
+
+		if err := c.PutManifest(ctx, dst.at(child.Digest), child); err != nil {
+			return err
+		}
+
+		entry := entries[i].(map[string]interface{})
+		entry["digest"] = child.Digest
+		entry["size"] = len(child.Content)
+	}
+
+	return nil
+}
+
+// mutateImage pushes the layers of the image, the layer the mutation appends
+// and the mutated configuration, and points manifest, the content of the
+// image manifest, to them.
+func (c *Client) mutateImage(ctx context.Context, src, dst Reference, mediaType string, img imageManifest, manifest map[string]interface{}, mutation Mutation, logger *logger.Logger) error {
+	if err := c.copyBlobs(ctx, src, dst, img.Layers, logger); err != nil {
+		return err
+	}
+
+	if mutation.Layer != nil {
+		desc, err := c.pushLayer(ctx, dst, mutation.Layer, mediaType, logger)
+		if err != nil {
+			return err
+		}
+
+		layers, _ := manifest["layers"].([]interface{})
+		manifest["layers"] = append(layers, desc)
+	}
+
+	desc, err := c.mutateConfig(ctx, src, dst, img.Config, mutation)
+	if err != nil {
+		return err
+	}
+
+	config, _ := manifest["config"].(map[string]interface{})
+	if config == nil {
+		return fmt.Errorf("%s: invalid manifest", src)
+	}
+	config["digest"] = desc.Digest
+	config["size"] = desc.Size
+
+	return nil
+}
+
+// mutateConfig pushes the mutated configuration, and returns its descriptor.
+func (c *Client) mutateConfig(ctx context.Context, src, dst Reference, desc descriptor, mutation Mutation) (descriptor, error) {
+	image, err := c.getConfig(ctx, src, desc.Digest)
+	if err != nil {
+		return desc, err
+	}
+
+	if err := mutation.Apply(image); err != nil {
+		return desc, err
+	}
+
+	content, err := json.Marshal(image)
+	if err != nil {
+		return desc, err
+	}
+
+	desc.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	desc.Size = int64(len(content))
+
+	return desc, c.PutBlob(ctx, dst.Domain, dst.Repository, "", desc.Digest, desc.Size, bytes.NewReader(content))
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Platform is the platform an image of a manifest list runs on.
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+	Features     []string `json:"features,omitempty"`
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// the names uname and others use for the architectures, and the variant
+// assumed when an image of the architecture does not give one.
+var (
+	archAliases = map[string]string{
+		"x86_64":  "amd64",
+		"x86-64":  "amd64",
+		"aarch64": "arm64",
+		"armhf":   "arm",
+		"armel":   "arm",
+		"i386":    "386",
+		"i686":    "386",
+	}
+
+	defaultVariants = map[string]string{
+		"arm64": "v8",
+		"arm":   "v7",
+	}
+)
+
+// NormalizeArch returns the name images use for the architecture.
+func NormalizeArch(arch string) string {
+	arch = strings.ToLower(arch)
+	if alias, ok := archAliases[arch]; ok {
+		return alias
+	}
+	return arch
+}
+
+// ParsePlatform parses a platform given as os/arch or os/arch/variant, such
+// as linux/arm64 or linux/arm/v6.
+func ParsePlatform(platform string) (Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid platform %q: must be os/arch or os/arch/variant", platform)
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("invalid platform %q: must be os/arch or os/arch/variant", platform)
+		}
+	}
+
+	p := Platform{OS: strings.ToLower(parts[0]), Architecture: NormalizeArch(parts[1])}
+	if len(parts) == 3 {
+		p.Variant = strings.ToLower(parts[2])
+	}
+
+	return p, nil
+}
+
+// Matches is true if an image for the platform other runs on p. A variant
+// left out is the default one of the architecture.
+func (p Platform) Matches(other Platform) bool {
+	if p.OS != other.OS || NormalizeArch(p.Architecture) != NormalizeArch(other.Architecture) {
+		return false
+	}
+
+	variant, otherVariant := p.Variant, other.Variant
+	if variant == "" {
+		variant = defaultVariants[NormalizeArch(p.Architecture)]
+	}
+	if otherVariant == "" {
+		otherVariant = defaultVariants[NormalizeArch(other.Architecture)]
+	}
+
+	return variant == otherVariant
+}
+
+// Resolve returns the image for the platform, by digest: the image of a
+// manifest list for the platform, or the image itself if it is for it.
+func (c *Client) Resolve(ctx context.Context, image string, platform Platform) (string, error) {
+	entries, err := c.ListEntries(ctx, image)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if platform.Matches(entry.Platform) {
+			return ref.at(entry.Digest).String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s is not available for %s", image, platform)
+}
@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"net/http"
+
+	"github.com/box-builder/box/policy"
+	"github.com/containers/image/docker/reference"
+)
+
+// CheckPull returns an error if the policy, if it is set, does not allow
+// pulling the image named, or from the repository named, from its registry.
+// Images pulled by docker are checked with it, as the requests of clients
+// made with the policy are.
+func CheckPull(p *policy.Policy, name string) error {
+	return checkName(p, name, false)
+}
+
+// CheckPush returns an error if the policy, if it is set, does not allow
+// pushing the image named, or to the repository named, to its registry.
+// Images pushed by other means than clients are checked with it.
+func CheckPush(p *policy.Policy, name string) error {
+	return checkName(p, name, true)
+}
+
+func checkName(p *policy.Policy, name string, push bool) error {
+	if p == nil {
+		return nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return err
+	}
+
+	return checkDomain(p, reference.Domain(named), push)
+}
+
+func checkDomain(p *policy.Policy, domain string, push bool) error {
+	switch {
+	case p == nil:
+		return nil
+	case push:
+		return p.CheckPush(domain)
+	default:
+		return p.CheckPull(domain)
+	}
+}
+
+// isPush is true if requests with the method write to the registry.
+func isPush(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead
+}
@@ -0,0 +1,278 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/box-builder/box/logger"
+)
+
+// The annotations of OCI manifests naming the base image.
+const (
+	BaseNameAnnotation   = "org.opencontainers.image.base.name"
+	BaseDigestAnnotation = "org.opencontainers.image.base.digest"
+)
+
+// baseImage is an image others are built on, for the platform of the image
+// being rebased.
+type baseImage struct {
+	ref     Reference
+	layers  []descriptor
+	raw     []interface{} // the layers as they are in the manifest
+	diffIDs []interface{}
+	history []interface{}
+}
+
+// Rebase puts the image src under dst with the layers of oldBase, the image
+// it is built on, replaced by those of newBase. The layers src has on top of
+// oldBase are kept as they are, so the image is not rebuilt; this is only
+// sound if they do not depend on what changed between the bases. Each image
+// of a manifest list is rebased onto the bases for its platform. Returns the
+// digest of the new manifest.
+func (c *Client) Rebase(ctx context.Context, src, dst Reference, oldBase, newBase string, logger *logger.Logger) (string, error) {
+	m, err := c.GetManifest(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", src, err)
+	}
+
+	m, err = c.rebaseManifest(ctx, src, dst, m, oldBase, newBase, logger)
+	if err != nil {
+		return "", err
+	}
+
+	return m.Digest, c.PutManifest(ctx, dst, m)
+}
+
+// rebaseManifest pushes what the rebased manifest refers to, and returns it.
+func (c *Client) rebaseManifest(ctx context.Context, src, dst Reference, m *Manifest, oldBase, newBase string, logger *logger.Logger) (*Manifest, error) {
+	manifest := map[string]interface{}{}
+	if err := json.Unmarshal(m.Content, &manifest); err != nil {
+		return nil, err
+	}
+
+	switch m.MediaType {
+	case MediaTypeDockerList, MediaTypeOCIIndex:
+		list := indexManifest{}
+		if err := json.Unmarshal(m.Content, &list); err != nil {
+			return nil, err
+		}
+
+		entries, _ := manifest["manifests"].([]interface{})
+		if len(entries) != len(list.Manifests) {
+			return nil, fmt.Errorf("%s: invalid manifest list", src)
+		}
+
+		for i, desc := range list.Manifests {
+			child, err := c.GetManifest(ctx, src.at(desc.Digest))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", src.at(desc.Digest), err)
+			}
+
+			child, err = c.rebaseManifest(ctx, src, dst, child, oldBase, newBase, logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := c.PutManifest(ctx, dst.at(child.Digest), child); err != nil {
+				return nil, err
+			}
+
+			entry := entries[i].(map[string]interface{})
+			entry["digest"] = child.Digest
+			entry["size"] = len(child.Content)
+		}
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		if err := c.rebaseImage(ctx, src, dst, manifest, m.MediaType, oldBase, newBase, logger); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: manifests of type %q can't be rebased", src, m.MediaType)
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manifest{
+		MediaType: m.MediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Content:   content,
+	}, nil
+}
+
+// rebaseImage rebases the image manifest, pushing its layers and its new
+// configuration.
+func (c *Client) rebaseImage(ctx context.Context, src, dst Reference, manifest map[string]interface{}, mediaType, oldBase, newBase string, logger *logger.Logger) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	img := imageManifest{}
+	if err := json.Unmarshal(content, &img); err != nil {
+		return err
+	}
+
+	image, err := c.getConfig(ctx, src, img.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	platform := Platform{}
+	platform.OS, _ = image["os"].(string)
+	platform.Architecture, _ = image["architecture"].(string)
+	platform.Variant, _ = image["variant"].(string)
+
+	from, err := c.getBaseImage(ctx, oldBase, platform)
+	if err != nil {
+		return err
+	}
+
+	onto, err := c.getBaseImage(ctx, newBase, platform)
+	if err != nil {
+		return err
+	}
+
+	if !builtOn(img.Layers, from.layers) {
+		return fmt.Errorf("%s is not built on %s", src, oldBase)
+	}
+
+	rootfs, _ := image["rootfs"].(map[string]interface{})
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	history, _ := image["history"].([]interface{})
+
+	if len(diffIDs) != len(img.Layers) || len(history) < len(from.history) {
+		return fmt.Errorf("configuration of %s does not match its layers", src)
+	}
+
+	if err := c.copyBlobs(ctx, onto.ref, dst, onto.layers, logger); err != nil {
+		return err
+	}
+
+	if err := c.copyBlobs(ctx, src, dst, img.Layers[len(from.layers):], logger); err != nil {
+		return err
+	}
+
+	raw, _ := manifest["layers"].([]interface{})
+	manifest["layers"] = append(append([]interface{}{}, onto.raw...), raw[len(from.layers):]...)
+
+	rootfs["diff_ids"] = append(append([]interface{}{}, onto.diffIDs...), diffIDs[len(from.layers):]...)
+	image["history"] = append(append([]interface{}{}, onto.history...), history[len(from.history):]...)
+
+	if err := c.pushConfig(ctx, src, dst, manifest, image); err != nil {
+		return err
+	}
+
+	if mediaType == MediaTypeOCIManifest {
+		annotations, _ := manifest["annotations"].(map[string]interface{})
+		if annotations == nil {
+			annotations = map[string]interface{}{}
+		}
+
+		annotations[BaseNameAnnotation] = newBase
+		annotations[BaseDigestAnnotation] = onto.ref.Reference
+		manifest["annotations"] = annotations
+	}
+
+	return nil
+}
+
+// builtOn is true if the layers start with those of the base.
+func builtOn(layers, base []descriptor) bool {
+	if len(layers) < len(base) {
+		return false
+	}
+
+	for i, desc := range base {
+		if layers[i].Digest != desc.Digest {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pushConfig pushes the configuration of the image, and points the manifest
+// to it.
+func (c *Client) pushConfig(ctx context.Context, src, dst Reference, manifest, image map[string]interface{}) error {
+	content, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+
+	config, _ := manifest["config"].(map[string]interface{})
+	if config == nil {
+		return fmt.Errorf("%s: invalid manifest", src)
+	}
+	config["digest"] = fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	config["size"] = len(content)
+
+	return c.PutBlob(ctx, dst.Domain, dst.Repository, "", config["digest"].(string), int64(len(content)), bytes.NewReader(content))
+}
+
+// getBaseImage returns the base image for the platform.
+func (c *Client) getBaseImage(ctx context.Context, name string, platform Platform) (*baseImage, error) {
+	resolved, err := c.Resolve(ctx, name, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := ParseReference(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	img := imageManifest{}
+	if err := json.Unmarshal(m.Content, &img); err != nil {
+		return nil, err
+	}
+
+	raw := struct {
+		Layers []interface{} `json:"layers"`
+	}{}
+	if err := json.Unmarshal(m.Content, &raw); err != nil {
+		return nil, err
+	}
+
+	image, err := c.getConfig(ctx, ref, img.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfs, _ := image["rootfs"].(map[string]interface{})
+	base := &baseImage{ref: ref, layers: img.Layers, raw: raw.Layers}
+	base.diffIDs, _ = rootfs["diff_ids"].([]interface{})
+	base.history, _ = image["history"].([]interface{})
+
+	if len(base.diffIDs) != len(base.layers) {
+		return nil, fmt.Errorf("configuration of %s does not match its layers", name)
+	}
+
+	return base, nil
+}
+
+// getConfig returns the image configuration in the blob.
+func (c *Client) getConfig(ctx context.Context, ref Reference, digest string) (map[string]interface{}, error) {
+	rc, _, err := c.GetBlob(ctx, ref.Domain, ref.Repository, digest)
+	if err != nil {
+		return nil, fmt.Errorf("configuration of %s: %v", ref, err)
+	}
+	defer rc.Close()
+
+	image := map[string]interface{}{}
+	if err := json.NewDecoder(io.LimitReader(rc, maxConfigSize)).Decode(&image); err != nil {
+		return nil, fmt.Errorf("configuration of %s: %v", ref, err)
+	}
+
+	return image, nil
+}
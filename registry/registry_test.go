@@ -0,0 +1,902 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/tlsconfig"
+
+	. "gopkg.in/check.v1"
+)
+
+type registrySuite struct{}
+
+var _ = Suite(&registrySuite{})
+
+func TestRegistry(t *T) {
+	TestingT(t)
+}
+
+// testRegistry is a registry which keeps manifests and blobs in memory, and
+// requires a token for every request.
+type testRegistry struct {
+	server    *httptest.Server
+	manifests map[string]*Manifest // repository:reference
+	blobs     map[string][]byte    // repository@digest
+	uploads   int
+	requests  map[string]int // method and kind of each request made
+	scopes    []string
+	mutex     sync.Mutex
+}
+
+func newTestRegistry() *testRegistry {
+	r := &testRegistry{
+		manifests: map[string]*Manifest{},
+		blobs:     map[string][]byte{},
+		requests:  map[string]int{},
+	}
+
+	r.server = httptest.NewServer(r)
+	return r
+}
+
+func (r *testRegistry) domain() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) addBlob(repo string, content []byte) descriptor {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	r.blobs[repo+"@"+digest] = content
+	return descriptor{Digest: digest, Size: int64(len(content)), MediaType: "application/octet-stream"}
+}
+
+func (r *testRegistry) addManifest(repo, tag, mediaType string, v interface{}) *Manifest {
+	content, _ := json.Marshal(v)
+	m := &Manifest{MediaType: mediaType, Content: content, Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(content))}
+	r.manifests[repo+":"+m.Digest] = m
+	if tag != "" {
+		r.manifests[repo+":"+tag] = m
+	}
+	return m
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.URL.Path == "/token" {
+		r.scopes = append(r.scopes, req.URL.Query()["scope"]...)
+		fmt.Fprintf(w, `{"token": "secret"}`)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		r.serveManifest(w, req, path)
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req, path)
+	case strings.Contains(path, "/blobs/"):
+		r.requests[req.Method+" blob"]++
+		i := strings.LastIndex(path, "/blobs/")
+		content, ok := r.blobs[path[:i]+"@"+path[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+		if req.Method == "GET" {
+			w.Write(content)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, path string) {
+	r.requests[req.Method+" manifest"]++
+	i := strings.LastIndex(path, "/manifests/")
+	key := path[:i] + ":" + path[i+len("/manifests/"):]
+
+	switch req.Method {
+	case "GET":
+		m, ok := r.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.MediaType)
+		w.Write(m.Content)
+	case "PUT":
+		content, _ := ioutil.ReadAll(req.Body)
+		m := &Manifest{MediaType: req.Header.Get("Content-Type"), Content: content, Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(content))}
+		r.manifests[key] = m
+		r.manifests[path[:i]+":"+m.Digest] = m
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, path string) {
+	i := strings.LastIndex(path, "/blobs/uploads/")
+	repo := path[:i]
+
+	switch req.Method {
+	case "POST":
+		if mount := req.URL.Query().Get("mount"); mount != "" {
+			if content, ok := r.blobs[req.URL.Query().Get("from")+"@"+mount]; ok {
+				r.requests["mount"]++
+				r.blobs[repo+"@"+mount] = content
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repo, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		r.requests["PUT blob"]++
+		content, _ := ioutil.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if digest != fmt.Sprintf("sha256:%x", sha256.Sum256(content)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[repo+"@"+digest] = content
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		r.requests["DELETE upload"]++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (rs *registrySuite) TestParseReference(c *C) {
+	for name, expected := range map[string]Reference{
+		"debian":                          {"docker.io", "library/debian", "latest"},
+		"localhost:5000/app:1.0":          {"localhost:5000", "app", "1.0"},
+		"quay.io/org/app@sha256:" + hex64: {"quay.io", "org/app", "sha256:" + hex64},
+	} {
+		ref, err := ParseReference(name)
+		c.Assert(err, IsNil)
+		c.Assert(ref, Equals, expected)
+	}
+
+	_, err := ParseReference("Not A Reference")
+	c.Assert(err, NotNil)
+}
+
+const hex64 = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func (rs *registrySuite) TestParseChallenge(c *C) {
+	c.Assert(parseChallenge(`realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/debian:pull"`), DeepEquals, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/debian:pull",
+	})
+}
+
+func (rs *registrySuite) TestCopy(c *C) {
+	src := newTestRegistry()
+	defer src.server.Close()
+	dst := newTestRegistry()
+	defer dst.server.Close()
+
+	img := imageManifest{
+		Config: src.addBlob("src/app", []byte(`{"os":"linux"}`)),
+		Layers: []descriptor{src.addBlob("src/app", []byte("layer one")), src.addBlob("src/app", []byte("layer two"))},
+	}
+
+	m := src.addManifest("src/app", "", MediaTypeDockerManifest, img)
+	list := src.addManifest("src/app", "1.0", MediaTypeDockerList, indexManifest{
+		Manifests: []descriptor{{MediaType: MediaTypeDockerManifest, Digest: m.Digest, Size: int64(len(m.Content))}},
+	})
+
+	client := NewClient(nil)
+	log := logger.New("copy", false)
+	transfer := &Transfer{}
+	ctx := WithTransfer(context.Background(), transfer)
+
+	srcRef, err := ParseReference(src.domain() + "/src/app:1.0")
+	c.Assert(err, IsNil)
+
+	// to another registry, the blobs are streamed through.
+	dstRef, err := ParseReference(dst.domain() + "/dst/app:1.0")
+	c.Assert(err, IsNil)
+
+	digest, err := client.Copy(ctx, srcRef, dstRef, log)
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, list.Digest)
+
+	// the blobs streamed through are counted as received and sent.
+	received, sent := transfer.Bytes()
+	c.Assert(received >= int64(len("layer onelayer two")), Equals, true)
+	c.Assert(sent >= int64(len("layer onelayer two")), Equals, true)
+	c.Assert(dst.manifests["dst/app:1.0"].Content, DeepEquals, list.Content)
+	c.Assert(dst.manifests["dst/app:"+m.Digest].Content, DeepEquals, m.Content)
+	c.Assert(dst.requests["PUT blob"], Equals, 3)
+	c.Assert(src.requests["GET blob"], Equals, 3)
+	c.Assert(dst.scopes, DeepEquals, []string{"repository:dst/app:pull", "repository:dst/app:pull,push"})
+
+	// the blobs are there now, so they are skipped.
+	_, err = client.Copy(ctx, srcRef, dstRef, log)
+	c.Assert(err, IsNil)
+	c.Assert(dst.requests["PUT blob"], Equals, 3)
+	c.Assert(src.requests["GET blob"], Equals, 3)
+
+	// within the registry, the blobs are mounted.
+	other, err := ParseReference(src.domain() + "/other/app:2.0")
+	c.Assert(err, IsNil)
+
+	_, err = client.Copy(ctx, srcRef, other, log)
+	c.Assert(err, IsNil)
+	c.Assert(src.requests["mount"], Equals, 3)
+	c.Assert(src.requests["GET blob"], Equals, 3)
+	c.Assert(src.manifests["other/app:2.0"].Content, DeepEquals, list.Content)
+
+	missing, err := ParseReference(src.domain() + "/src/app:missing")
+	c.Assert(err, IsNil)
+
+	_, err = client.Copy(ctx, missing, other, log)
+	c.Assert(err, NotNil)
+}
+
+func (rs *registrySuite) TestBlobsExist(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	digests := []string{}
+	for i := 0; i < 20; i++ {
+		digests = append(digests, r.addBlob("app", []byte(fmt.Sprintf("layer %d", i))).Digest)
+	}
+
+	missing := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))
+
+	client := NewClient(nil)
+	exists, err := client.BlobsExist(context.Background(), r.domain(), "app", append(append(digests, missing), digests[0]))
+	c.Assert(err, IsNil)
+	c.Assert(exists, HasLen, 21)
+	c.Assert(exists[missing], Equals, false)
+	for _, digest := range digests {
+		c.Assert(exists[digest], Equals, true, Commentf("%s", digest))
+	}
+
+	// each blob is checked for once, with a single token.
+	c.Assert(r.requests["HEAD blob"], Equals, 21)
+	c.Assert(r.scopes, DeepEquals, []string{"repository:app:pull"})
+}
+
+// cancelingReader cancels its context as it is read, as ^C does during an
+// upload.
+type cancelingReader struct {
+	cancel context.CancelFunc
+}
+
+func (r cancelingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	time.Sleep(10 * time.Millisecond)
+	return copy(p, "partial"), nil
+}
+
+func (rs *registrySuite) TestCancelUpload(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	client := NewClient(nil)
+	content := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+	c.Assert(client.PutBlob(context.Background(), r.domain(), "app", "", digest, int64(len(content)), bytes.NewReader(content)), IsNil)
+	c.Assert(r.requests["DELETE upload"], Equals, 0)
+
+	// uploads the registry refuses are canceled.
+	err := client.PutBlob(context.Background(), r.domain(), "app", "", digest, int64(len(content)), bytes.NewReader([]byte("other")))
+	c.Assert(err, ErrorMatches, ".*400 Bad Request.*")
+	c.Assert(r.requests["DELETE upload"], Equals, 1)
+
+	// and so are uploads interrupted, though their context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	err = client.PutBlob(ctx, r.domain(), "app", "", digest, 1<<20, cancelingReader{cancel})
+	c.Assert(err, NotNil)
+	c.Assert(r.requests["DELETE upload"], Equals, 2)
+}
+
+func (rs *registrySuite) TestRetag(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	m := r.addManifest("app", "", MediaTypeOCIManifest, imageManifest{Config: r.addBlob("app", []byte("{}"))})
+
+	src, err := ParseReference(r.domain() + "/app@" + m.Digest)
+	c.Assert(err, IsNil)
+	dst, err := ParseReference(r.domain() + "/app:stable")
+	c.Assert(err, IsNil)
+
+	digest, err := NewClient(nil).Retag(context.Background(), src, dst)
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, m.Digest)
+	c.Assert(r.manifests["app:stable"].Content, DeepEquals, m.Content)
+	c.Assert(r.manifests["app:stable"].MediaType, Equals, MediaTypeOCIManifest)
+	c.Assert(r.requests["GET blob"]+r.requests["HEAD blob"]+r.requests["PUT blob"], Equals, 0)
+
+	other, err := ParseReference(r.domain() + "/other:stable")
+	c.Assert(err, IsNil)
+
+	_, err = NewClient(nil).Retag(context.Background(), src, other)
+	c.Assert(err, NotNil)
+}
+
+func (rs *registrySuite) TestPolicy(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	m := r.addManifest("app", "", MediaTypeOCIManifest, imageManifest{Config: r.addBlob("app", []byte("{}"))})
+
+	src, err := ParseReference(r.domain() + "/app@" + m.Digest)
+	c.Assert(err, IsNil)
+	dst, err := ParseReference(r.domain() + "/app:stable")
+	c.Assert(err, IsNil)
+
+	p := &policy.Policy{
+		File: "policy.json",
+		Registries: policy.Registries{
+			Pull: policy.Rule{Deny: []string{"docker.io"}},
+			Push: policy.Rule{Allow: []string{"registry.example.com", "*.example.com"}},
+		},
+	}
+
+	_, err = NewClient(p).Retag(context.Background(), src, dst)
+	c.Assert(err, ErrorMatches, "may not push to "+r.domain()+": the policy policy.json only allows registry.example.com, \\*.example.com")
+	c.Assert(r.requests["PUT manifest"], Equals, 0)
+
+	_, err = NewClient(p).GetManifest(context.Background(), src)
+	c.Assert(err, IsNil)
+
+	c.Assert(CheckPull(p, "debian"), ErrorMatches, "may not pull from docker.io: the policy policy.json denies docker.io")
+	c.Assert(CheckPull(p, "quay.io/org/app:1.0"), IsNil)
+	c.Assert(CheckPush(p, "registry.example.com/app"), IsNil)
+	c.Assert(CheckPush(p, "mirror.example.com/app:1.0"), IsNil)
+	c.Assert(CheckPush(p, "app"), NotNil)
+
+	// clients without the policy, as other builds', are not restricted by it.
+	c.Assert(CheckPull(nil, "debian"), IsNil)
+	_, err = NewClient(nil).Retag(context.Background(), src, dst)
+	c.Assert(err, IsNil)
+}
+
+func (rs *registrySuite) TestStrictTLS(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	ref, err := ParseReference(r.domain() + "/app:latest")
+	c.Assert(err, IsNil)
+
+	client := NewClient(nil)
+	c.Assert(client.endpoint(r.domain()), Equals, "http://"+r.domain())
+	c.Assert(client.endpoint("registry.example.com"), Equals, "https://registry.example.com")
+
+	c.Assert(tlsconfig.Set("1.2", nil, true), IsNil)
+	defer tlsconfig.Set("1.2", nil, false)
+
+	client.Insecure = true
+	c.Assert(client.endpoint(r.domain()), Equals, "https://"+r.domain())
+	c.Assert(client.endpoint("registry.example.com"), Equals, "https://registry.example.com")
+
+	// the test registry only serves plain http.
+	_, err = client.GetManifest(context.Background(), ref)
+	c.Assert(err, NotNil)
+	c.Assert(r.requests["GET manifest"], Equals, 0)
+
+	u, err := url.Parse("http://auth.example.com/token")
+	c.Assert(err, IsNil)
+	c.Assert(checkScheme(u), ErrorMatches, "auth.example.com is not reached over https, as strict TLS requires")
+}
+
+func (rs *registrySuite) TestPushList(c *C) {
+	os.Setenv("BOX_HOME", c.MkDir())
+	defer os.Unsetenv("BOX_HOME")
+
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := r.addBlob("app-"+arch, []byte(fmt.Sprintf(`{"os":"linux","architecture":%q}`, arch)))
+		r.addManifest("app-"+arch, "1.0", MediaTypeDockerManifest, imageManifest{Config: config})
+	}
+
+	client := NewClient(nil)
+	ctx := context.Background()
+
+	list := &ManifestList{Name: r.domain() + "/app:1.0"}
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		entries, err := client.ListEntries(ctx, r.domain()+"/app-"+arch+":1.0")
+		c.Assert(err, IsNil)
+		c.Assert(len(entries), Equals, 1)
+		c.Assert(entries[0].Platform, DeepEquals, Platform{OS: "linux", Architecture: arch})
+		list.Add(entries)
+	}
+
+	entry, err := list.Entry(r.domain() + "/app-arm64:1.0")
+	c.Assert(err, IsNil)
+	entry.Platform.Variant = "v8"
+
+	c.Assert(list.Save(), IsNil)
+	list, err = LoadManifestList(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries[1].Platform.Variant, Equals, "v8")
+
+	digest, err := client.PushList(ctx, list, logger.New("manifest", false))
+	c.Assert(err, IsNil)
+
+	m := r.manifests["app:1.0"]
+	c.Assert(m, NotNil)
+	c.Assert(m.Digest, Equals, digest)
+	c.Assert(m.MediaType, Equals, MediaTypeDockerList)
+
+	// the images were copied into the list's repository.
+	for _, entry := range list.Entries {
+		c.Assert(r.manifests["app:"+entry.Digest], NotNil)
+	}
+
+	// the list can be read back as entries.
+	entries, err := client.ListEntries(ctx, r.domain()+"/app:1.0")
+	c.Assert(err, IsNil)
+	c.Assert(len(entries), Equals, 2)
+	c.Assert(entries[1].Platform.String(), Equals, "linux/arm64/v8")
+
+	_, err = LoadManifestList("missing")
+	c.Assert(err, NotNil)
+}
+
+func (rs *registrySuite) TestPlatform(c *C) {
+	p, err := ParsePlatform("linux/aarch64")
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, Platform{OS: "linux", Architecture: "arm64"})
+	c.Assert(p.Matches(Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}), Equals, true)
+	c.Assert(p.Matches(Platform{OS: "linux", Architecture: "amd64"}), Equals, false)
+
+	p, err = ParsePlatform("linux/arm/v6")
+	c.Assert(err, IsNil)
+	c.Assert(p.Matches(Platform{OS: "linux", Architecture: "arm"}), Equals, false)
+	c.Assert(p.Matches(Platform{OS: "linux", Architecture: "arm", Variant: "v6"}), Equals, true)
+
+	for _, invalid := range []string{"linux", "linux/", "linux/arm/v7/extra"} {
+		_, err := ParsePlatform(invalid)
+		c.Assert(err, NotNil)
+	}
+
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	manifests := []interface{}{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		m := r.addManifest("app", "", MediaTypeOCIManifest, imageManifest{Config: r.addBlob("app", []byte(arch))})
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": m.MediaType,
+			"digest":    m.Digest,
+			"size":      len(m.Content),
+			"platform":  Platform{OS: "linux", Architecture: arch},
+		})
+	}
+	r.addManifest("app", "1.0", MediaTypeOCIIndex, map[string]interface{}{"manifests": manifests})
+
+	_, err = NewClient(nil).Resolve(context.Background(), r.domain()+"/app:1.0", p)
+	c.Assert(err, NotNil)
+
+	p, err = ParsePlatform("linux/arm64")
+	c.Assert(err, IsNil)
+	image, err := NewClient(nil).Resolve(context.Background(), r.domain()+"/app:1.0", p)
+	c.Assert(err, IsNil)
+	c.Assert(image, Equals, r.domain()+"/app@"+manifests[1].(map[string]interface{})["digest"].(string))
+}
+
+func (rs *registrySuite) TestMutate(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	layer := r.addBlob("app", []byte("layer"))
+	config := r.addBlob("app", []byte(`{"architecture":"amd64","config":{"Env":["PATH=/bin","FOO=foo"],"Labels":{"a":"1"}},"rootfs":{"type":"layers"}}`))
+	config.MediaType = "application/vnd.docker.container.image.v1+json"
+	m := r.addManifest("app", "1.0", MediaTypeDockerManifest, imageManifest{Config: config, Layers: []descriptor{layer}})
+
+	src, err := ParseReference(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+	dst, err := ParseReference(r.domain() + "/app:1.0-mutated")
+	c.Assert(err, IsNil)
+
+	digest, err := NewClient(nil).Mutate(context.Background(), src, dst, Mutation{
+		Env:        []string{"FOO=bar", "BAZ=quux"},
+		Labels:     map[string]string{"b": "2"},
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{},
+		User:       "1001",
+		CreatedBy:  "box mutate",
+	}, logger.New("mutate", false))
+	c.Assert(err, IsNil)
+	c.Assert(digest, Not(Equals), m.Digest)
+
+	mutated := r.manifests["app:1.0-mutated"]
+	c.Assert(mutated.Digest, Equals, digest)
+
+	img := imageManifest{}
+	c.Assert(json.Unmarshal(mutated.Content, &img), IsNil)
+	c.Assert(img.Layers, DeepEquals, []descriptor{layer})
+	c.Assert(img.Config.Digest, Not(Equals), config.Digest)
+	c.Assert(img.Config.MediaType, Equals, config.MediaType)
+
+	image := struct {
+		Architecture string
+		Config       struct {
+			Env        []string
+			Labels     map[string]string
+			Entrypoint []string
+			Cmd        []string
+			User       string
+		}
+		History []map[string]interface{}
+	}{}
+	c.Assert(json.Unmarshal(r.blobs["app@"+img.Config.Digest], &image), IsNil)
+	c.Assert(image.Architecture, Equals, "amd64")
+	c.Assert(image.Config.Env, DeepEquals, []string{"PATH=/bin", "FOO=bar", "BAZ=quux"})
+	c.Assert(image.Config.Labels, DeepEquals, map[string]string{"a": "1", "b": "2"})
+	c.Assert(image.Config.Entrypoint, DeepEquals, []string{"/bin/app"})
+	c.Assert(image.Config.Cmd, IsNil)
+	c.Assert(image.Config.User, Equals, "1001")
+	c.Assert(len(image.History), Equals, 1)
+	c.Assert(image.History[0]["created_by"], Equals, "box mutate")
+	c.Assert(image.History[0]["empty_layer"], Equals, true)
+
+	// the layers were not transferred.
+	c.Assert(r.requests["GET blob"], Equals, 1)
+	c.Assert(r.requests["PUT blob"], Equals, 1)
+
+	_, err = NewClient(nil).Mutate(context.Background(), src, dst, Mutation{Env: []string{"FOO"}}, logger.New("mutate", false))
+	c.Assert(err, NotNil)
+}
+
+func (rs *registrySuite) TestAppend(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	base := r.addBlob("app", []byte("layer"))
+	config := r.addBlob("app", []byte(`{"architecture":"amd64","config":{"Env":["PATH=/bin"]},"rootfs":{"type":"layers","diff_ids":["sha256:base"]}}`))
+	config.MediaType = "application/vnd.oci.image.config.v1+json"
+	r.addManifest("app", "1.0", MediaTypeOCIManifest, imageManifest{Config: config, Layers: []descriptor{base}})
+
+	content := []byte("not really a tarball")
+	fn := filepath.Join(c.MkDir(), "extra.tar")
+	c.Assert(ioutil.WriteFile(fn, content, 0644), IsNil)
+
+	layer, err := NewLayer(fn, 0)
+	c.Assert(err, IsNil)
+	defer layer.Close()
+
+	c.Assert(layer.DiffID, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(content)))
+
+	src, err := ParseReference(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+	dst, err := ParseReference(r.domain() + "/app:1.1")
+	c.Assert(err, IsNil)
+
+	_, err = NewClient(nil).Mutate(context.Background(), src, dst, Mutation{
+		Env:       []string{"MODE=production"},
+		CreatedBy: "box append",
+		Layer:     layer,
+	}, logger.New("append", false))
+	c.Assert(err, IsNil)
+
+	img := imageManifest{}
+	c.Assert(json.Unmarshal(r.manifests["app:1.1"].Content, &img), IsNil)
+	c.Assert(img.Layers, DeepEquals, []descriptor{base, {MediaType: MediaTypeOCILayer, Digest: layer.Digest, Size: layer.Size}})
+
+	compressed, err := ioutil.ReadFile(layer.File)
+	c.Assert(err, IsNil)
+	c.Assert(r.blobs["app@"+layer.Digest], DeepEquals, compressed)
+
+	image := struct {
+		Config struct{ Env []string }
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+		History []map[string]interface{}
+	}{}
+	c.Assert(json.Unmarshal(r.blobs["app@"+img.Config.Digest], &image), IsNil)
+	c.Assert(image.Config.Env, DeepEquals, []string{"PATH=/bin", "MODE=production"})
+	c.Assert(image.RootFS.DiffIDs, DeepEquals, []string{"sha256:base", layer.DiffID})
+	c.Assert(image.History, HasLen, 1)
+	_, empty := image.History[0]["empty_layer"]
+	c.Assert(empty, Equals, false)
+}
+
+func (rs *registrySuite) TestRebase(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	image := func(repo, tag string, layers []descriptor, diffIDs, history []string) *Manifest {
+		entries := []map[string]string{}
+		for _, step := range history {
+			entries = append(entries, map[string]string{"created_by": step})
+		}
+
+		content, _ := json.Marshal(map[string]interface{}{
+			"os":           "linux",
+			"architecture": "amd64",
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+			"history":      entries,
+		})
+
+		config := r.addBlob(repo, content)
+		config.MediaType = "application/vnd.oci.image.config.v1+json"
+		return r.addManifest(repo, tag, MediaTypeOCIManifest, imageManifest{Config: config, Layers: layers})
+	}
+
+	oldLayer := r.addBlob("base", []byte("old base"))
+	newLayer := r.addBlob("base", []byte("new base"))
+	appLayer := r.addBlob("app", []byte("app"))
+	r.addBlob("app", []byte("old base"))
+
+	oldBase := image("base", "1", []descriptor{oldLayer}, []string{"sha256:old"}, []string{"old base"})
+	image("base", "2", []descriptor{newLayer}, []string{"sha256:new"}, []string{"new base"})
+	image("app", "1.0", []descriptor{oldLayer, appLayer}, []string{"sha256:old", "sha256:app"}, []string{"old base", "app"})
+
+	src, err := ParseReference(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+	dst, err := ParseReference(r.domain() + "/app:1.0-rebased")
+	c.Assert(err, IsNil)
+
+	digest, err := NewClient(nil).Rebase(context.Background(), src, dst, r.domain()+"/base@"+oldBase.Digest, r.domain()+"/base:2", logger.New("rebase", false))
+	c.Assert(err, IsNil)
+
+	rebased := r.manifests["app:1.0-rebased"]
+	c.Assert(rebased.Digest, Equals, digest)
+
+	img := struct {
+		imageManifest
+		Annotations map[string]string `json:"annotations"`
+	}{}
+	c.Assert(json.Unmarshal(rebased.Content, &img), IsNil)
+	c.Assert(img.Layers, DeepEquals, []descriptor{newLayer, appLayer})
+	c.Assert(img.Annotations[BaseNameAnnotation], Equals, r.domain()+"/base:2")
+
+	// the new base layer was mounted from the base repository.
+	c.Assert(r.blobs["app@"+newLayer.Digest], DeepEquals, []byte("new base"))
+
+	config := struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+		History []map[string]string
+	}{}
+	c.Assert(json.Unmarshal(r.blobs["app@"+img.Config.Digest], &config), IsNil)
+	c.Assert(config.RootFS.DiffIDs, DeepEquals, []string{"sha256:new", "sha256:app"})
+	c.Assert(config.History, DeepEquals, []map[string]string{{"created_by": "new base"}, {"created_by": "app"}})
+
+	// the app is not built on the new base.
+	_, err = NewClient(nil).Rebase(context.Background(), src, dst, r.domain()+"/base:2", r.domain()+"/base:1", logger.New("rebase", false))
+	c.Assert(err, NotNil)
+}
+
+func (rs *registrySuite) TestInspect(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	manifests := []interface{}{}
+	configs := []string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := r.addBlob("app", []byte(fmt.Sprintf(`{"os":"linux","architecture":%q,"created":"2020-01-01T00:00:00Z","config":{"Env":["PATH=/bin"],"Entrypoint":["/app"],"Labels":{"arch":%q}},"rootfs":{"type":"layers","diff_ids":["sha256:base","sha256:%s"]}}`, arch, arch, arch)))
+		configs = append(configs, config.Digest)
+		m := r.addManifest("app", "", MediaTypeOCIManifest, imageManifest{
+			Config: config,
+			Layers: []descriptor{r.addBlob("app", []byte("base layer")), r.addBlob("app", []byte(arch))},
+		})
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": m.MediaType,
+			"digest":    m.Digest,
+			"size":      len(m.Content),
+			"platform":  Platform{OS: "linux", Architecture: arch},
+		})
+	}
+	list := r.addManifest("app", "1.0", MediaTypeOCIIndex, map[string]interface{}{"manifests": manifests})
+
+	ref, err := ParseReference(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+
+	inspection, err := NewClient(nil).Inspect(context.Background(), ref, Platform{OS: "linux", Architecture: "arm64"})
+	c.Assert(err, IsNil)
+	c.Assert(inspection.Digest, Equals, list.Digest)
+	c.Assert(len(inspection.Manifests), Equals, 2)
+	c.Assert(inspection.Manifests[0].Platform.String(), Equals, "linux/amd64")
+
+	img := inspection.Image
+	c.Assert(img, NotNil)
+	c.Assert(img.Digest, Equals, manifests[1].(map[string]interface{})["digest"])
+	c.Assert(img.Platform.Architecture, Equals, "arm64")
+	c.Assert(img.Created, Equals, "2020-01-01T00:00:00Z")
+	c.Assert(img.ID, Equals, configs[1])
+	c.Assert(img.DiffIDs, DeepEquals, []string{"sha256:base", "sha256:arm64"})
+	c.Assert(len(img.Layers), Equals, 2)
+	c.Assert(img.Size, Equals, int64(len("base layer")+len("arm64")))
+	c.Assert(img.Config.Env, DeepEquals, []string{"PATH=/bin"})
+	c.Assert(img.Config.Entrypoint, DeepEquals, []string{"/app"})
+	c.Assert(img.Config.Labels, DeepEquals, map[string]string{"arch": "arm64"})
+
+	// only the manifests and the configuration were fetched.
+	c.Assert(r.requests["GET blob"], Equals, 1)
+
+	inspection, err = NewClient(nil).Inspect(context.Background(), ref, Platform{OS: "windows", Architecture: "amd64"})
+	c.Assert(err, IsNil)
+	c.Assert(inspection.Image, IsNil)
+}
+
+func (rs *registrySuite) TestSignVerify(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	dir := c.MkDir()
+	keys := []string{}
+	for i := 0; i < 2; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		c.Assert(err, IsNil)
+		private, err := x509.MarshalPKCS8PrivateKey(key)
+		c.Assert(err, IsNil)
+		public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		c.Assert(err, IsNil)
+
+		fn := filepath.Join(dir, fmt.Sprintf("key%d", i))
+		c.Assert(ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600), IsNil)
+		c.Assert(ioutil.WriteFile(fn+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644), IsNil)
+		keys = append(keys, fn)
+	}
+
+	m := r.addManifest("app", "1.0", MediaTypeDockerManifest, imageManifest{
+		Config: r.addBlob("app", []byte(`{"os":"linux"}`)),
+		Layers: []descriptor{r.addBlob("app", []byte("layer"))},
+	})
+
+	ctx := context.Background()
+	ref, err := ParseReference(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+
+	signer, err := LoadSigner(keys[0])
+	c.Assert(err, IsNil)
+	public, err := LoadPublicKey(ctx, keys[0]+".pub")
+	c.Assert(err, IsNil)
+	other, err := LoadPublicKey(ctx, keys[1]+".pub")
+	c.Assert(err, IsNil)
+
+	client := NewClient(nil)
+
+	_, _, err = client.Verify(ctx, ref, public)
+	c.Assert(err, NotNil)
+
+	digest, err := client.Sign(ctx, ref, signer, false)
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, m.Digest)
+
+	// the signature is where cosign looks for it.
+	sm, ok := r.manifests["app:"+SignatureTag(m.Digest)]
+	c.Assert(ok, Equals, true)
+	manifest := signatureManifest{}
+	c.Assert(json.Unmarshal(sm.Content, &manifest), IsNil)
+	c.Assert(manifest.Layers, HasLen, 1)
+	c.Assert(manifest.Layers[0].MediaType, Equals, MediaTypeSimpleSigning)
+
+	payload := simpleSigning{}
+	c.Assert(json.Unmarshal(r.blobs["app@"+manifest.Layers[0].Digest], &payload), IsNil)
+	c.Assert(payload.Critical.Image.DockerManifestDigest, Equals, m.Digest)
+	c.Assert(payload.Critical.Identity.DockerReference, Equals, r.domain()+"/app")
+
+	_, err = client.Sign(ctx, ref, signer, true)
+	c.Assert(err, IsNil)
+
+	// registries without the referrers API list referrers under a tag.
+	_, ok = r.manifests["app:"+referrersTag(m.Digest)]
+	c.Assert(ok, Equals, true)
+
+	digest, signatures, err := client.Verify(ctx, ref, public)
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, m.Digest)
+	c.Assert(signatures, HasLen, 2)
+	c.Assert(signatures[0].Referrer, Equals, false)
+	c.Assert(signatures[1].Referrer, Equals, true)
+
+	_, _, err = client.Verify(ctx, ref, other)
+	c.Assert(err, NotNil)
+
+	// a signature of another manifest does not verify this one.
+	r.addManifest("app", "1.1", MediaTypeDockerManifest, imageManifest{Config: r.addBlob("app", []byte(`{"os":"windows"}`))})
+	moved, err := ParseReference(r.domain() + "/app:1.1")
+	c.Assert(err, IsNil)
+	m2, err := client.GetManifest(ctx, moved)
+	c.Assert(err, IsNil)
+	r.manifests["app:"+SignatureTag(m2.Digest)] = sm
+
+	_, _, err = client.Verify(ctx, moved, public)
+	c.Assert(err, NotNil)
+}
+
+func (rs *registrySuite) TestAttest(c *C) {
+	r := newTestRegistry()
+	defer r.server.Close()
+
+	dir := c.MkDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, IsNil)
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	c.Assert(err, IsNil)
+
+	fn := filepath.Join(dir, "key")
+	c.Assert(ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(fn+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644), IsNil)
+
+	m := r.addManifest("app", "1.0", MediaTypeDockerManifest, imageManifest{
+		Config: r.addBlob("app", []byte(`{"os":"linux"}`)),
+		Layers: []descriptor{r.addBlob("app", []byte("layer"))},
+	})
+
+	ctx := context.Background()
+	ref, err := ParseReference(r.domain() + "/app:1.0")
+	c.Assert(err, IsNil)
+
+	signer, err := LoadSigner(fn)
+	c.Assert(err, IsNil)
+	verifier, err := LoadPublicKey(ctx, fn+".pub")
+	c.Assert(err, IsNil)
+
+	client := NewClient(nil)
+
+	_, _, err = client.VerifyAttestations(ctx, ref, verifier, "https://example.com/predicate")
+	c.Assert(err, NotNil)
+
+	digest, err := client.Attest(ctx, ref, signer, "https://example.com/predicate", map[string]string{"built": "yes"})
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, m.Digest)
+
+	digest, statements, err := client.VerifyAttestations(ctx, ref, verifier, "https://example.com/predicate")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, m.Digest)
+	c.Assert(statements, HasLen, 1)
+	c.Assert(statements[0].Subject[0].Name, Equals, r.domain()+"/app")
+	c.Assert(statements[0].Subject[0].Digest["sha256"], Equals, strings.TrimPrefix(m.Digest, "sha256:"))
+	c.Assert(string(statements[0].Predicate), Equals, `{"built":"yes"}`)
+
+	// statements of other predicates are not returned.
+	_, _, err = client.VerifyAttestations(ctx, ref, verifier, "https://example.com/other")
+	c.Assert(err, NotNil)
+
+	// signatures are not attestations.
+	_, err = client.Sign(ctx, ref, signer, true)
+	c.Assert(err, IsNil)
+	_, statements, err = client.VerifyAttestations(ctx, ref, verifier, "https://example.com/predicate")
+	c.Assert(err, IsNil)
+	c.Assert(statements, HasLen, 1)
+}
@@ -0,0 +1,455 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/box-builder/box/audit"
+)
+
+// Media types and annotations of cosign signatures.
+const (
+	MediaTypeSimpleSigning      = "application/vnd.dev.cosign.simplesigning.v1+json"
+	ArtifactTypeCosignSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	SignatureAnnotation         = "dev.cosignproject.cosign/signature"
+
+	mediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCIEmpty  = "application/vnd.oci.empty.v1+json"
+)
+
+// signatureType is the type of the payloads cosign signs.
+const signatureType = "cosign container image signature"
+
+// maxPayloadSize is the size of the largest signature payload read.
+const maxPayloadSize = 1 << 20
+
+// simpleSigning is the payload of a cosign signature: the digest of the
+// manifest signed, and the repository it was signed in.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// artifactDescriptor refers to a blob or manifest of an OCI artifact.
+type artifactDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// signatureManifest is the manifest signatures are pushed in.
+type signatureManifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	ArtifactType  string               `json:"artifactType,omitempty"`
+	Config        artifactDescriptor   `json:"config"`
+	Layers        []artifactDescriptor `json:"layers"`
+	Subject       *artifactDescriptor  `json:"subject,omitempty"`
+}
+
+// referrersIndex lists the manifests which refer to another.
+type referrersIndex struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []artifactDescriptor `json:"manifests"`
+}
+
+// Signature is a signature of an image which was verified.
+type Signature struct {
+	Digest          string // the digest of the payload
+	DockerReference string // the repository the image was signed in
+	Referrer        bool   // true if the signature is a referrer of the image, not under its tag
+}
+
+// SignatureTag returns the tag cosign pushes the signatures of the manifest
+// under.
+func SignatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// referrersTag returns the tag registries without the referrers API list the
+// referrers of the manifest under.
+func referrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// dockerReference returns the repository of ref as cosign names it.
+func dockerReference(ref Reference) string {
+	domain := ref.Domain
+	if domain == "docker.io" {
+		domain = "index.docker.io"
+	}
+
+	return domain + "/" + ref.Repository
+}
+
+// putContent uploads the content as a blob to the repository of ref, unless it
+// has it, and returns its digest.
+func (c *Client) putContent(ctx context.Context, ref Reference, content []byte) (string, error) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+	ok, err := c.BlobExists(ctx, ref.Domain, ref.Repository, digest)
+	if err != nil || ok {
+		return digest, err
+	}
+
+	return digest, c.PutBlob(ctx, ref.Domain, ref.Repository, "", digest, int64(len(content)), bytes.NewReader(content))
+}
+
+// Sign signs the manifest of the image with a cosign signature, and pushes
+// it to the repository of the image: under the tag cosign uses, with the
+// other signatures of the image, or as a referrer of the manifest if
+// referrers is set. A manifest list is signed as a whole. Returns the digest
+// of the manifest signed.
+func (c *Client) Sign(ctx context.Context, ref Reference, signer Signer, referrers bool) (string, error) {
+	dgst, err := c.sign(ctx, ref, signer, referrers)
+	audit.Record(audit.Sign, ref.String(), dgst, err)
+	return dgst, err
+}
+
+func (c *Client) sign(ctx context.Context, ref Reference, signer Signer, referrers bool) (string, error) {
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", ref, err)
+	}
+
+	payload := simpleSigning{}
+	payload.Critical.Identity.DockerReference = dockerReference(ref)
+	payload.Critical.Image.DockerManifestDigest = m.Digest
+	payload.Critical.Type = signatureType
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := signer.Sign(ctx, content)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := c.putContent(ctx, ref, content)
+	if err != nil {
+		return "", err
+	}
+
+	layer := artifactDescriptor{
+		MediaType:   MediaTypeSimpleSigning,
+		Digest:      digest,
+		Size:        int64(len(content)),
+		Annotations: map[string]string{SignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+	}
+
+	if referrers {
+		_, err := c.pushReferrer(ctx, ref, m, ArtifactTypeCosignSignature, layer)
+		return m.Digest, err
+	}
+
+	return m.Digest, c.pushSignatureTag(ctx, ref, m.Digest, layer)
+}
+
+// pushSignatureTag adds the signature to those under the signature tag of the
+// manifest.
+func (c *Client) pushSignatureTag(ctx context.Context, ref Reference, digest string, layer artifactDescriptor) error {
+	manifest := signatureManifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest}
+
+	existing, err := c.GetManifest(ctx, ref.at(SignatureTag(digest)))
+	switch err {
+	case nil:
+		if err := json.Unmarshal(existing.Content, &manifest); err != nil {
+			return fmt.Errorf("signatures of %s: %v", ref, err)
+		}
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	manifest.Layers = append(manifest.Layers, layer)
+
+	// cosign writes a configuration with the layers as diff IDs, which
+	// verification ignores.
+	diffIDs := []string{}
+	for _, layer := range manifest.Layers {
+		diffIDs = append(diffIDs, layer.Digest)
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "",
+		"os":           "",
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest.Config = artifactDescriptor{MediaType: mediaTypeOCIConfig, Size: int64(len(config))}
+	if manifest.Config.Digest, err = c.putContent(ctx, ref, config); err != nil {
+		return err
+	}
+
+	return c.putJSON(ctx, ref.at(SignatureTag(digest)), MediaTypeOCIManifest, manifest)
+}
+
+// Attach pushes the content, of the media type given, as an artifact of that
+// type whose subject is the manifest of the image, such as an SBOM of the
+// image. Returns the digest of the manifest of the artifact.
+func (c *Client) Attach(ctx context.Context, ref Reference, mediaType string, content []byte) (string, error) {
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", ref, err)
+	}
+
+	digest, err := c.putContent(ctx, ref, content)
+	if err != nil {
+		return "", err
+	}
+
+	layer := artifactDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}
+	return c.pushReferrer(ctx, ref, m, mediaType, layer)
+}
+
+// pushReferrer pushes the layer in an artifact of its own, whose subject is
+// the manifest, and returns the digest of its manifest. The fallback tag of the
+// referrers of the manifest is updated for registries without the referrers
+// API.
+func (c *Client) pushReferrer(ctx context.Context, ref Reference, m *Manifest, artifactType string, layer artifactDescriptor) (string, error) {
+	empty := []byte("{}")
+	emptyDigest, err := c.putContent(ctx, ref, empty)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := signatureManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        artifactDescriptor{MediaType: mediaTypeOCIEmpty, Digest: emptyDigest, Size: int64(len(empty))},
+		Layers:        []artifactDescriptor{layer},
+		Subject:       &artifactDescriptor{MediaType: m.MediaType, Digest: m.Digest, Size: int64(len(m.Content))},
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	pushed := &Manifest{MediaType: MediaTypeOCIManifest, Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(content)), Content: content}
+	if err := c.PutManifest(ctx, ref.at(pushed.Digest), pushed); err != nil {
+		return "", err
+	}
+
+	_, supported, err := c.referrers(ctx, ref, m.Digest)
+	if err != nil || supported {
+		return pushed.Digest, err
+	}
+
+	index := referrersIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+
+	existing, err := c.GetManifest(ctx, ref.at(referrersTag(m.Digest)))
+	switch err {
+	case nil:
+		if err := json.Unmarshal(existing.Content, &index); err != nil {
+			return "", fmt.Errorf("referrers of %s: %v", ref, err)
+		}
+	case ErrNotFound:
+	default:
+		return "", err
+	}
+
+	index.Manifests = append(index.Manifests, artifactDescriptor{
+		MediaType:    MediaTypeOCIManifest,
+		ArtifactType: artifactType,
+		Digest:       pushed.Digest,
+		Size:         int64(len(content)),
+	})
+
+	return pushed.Digest, c.putJSON(ctx, ref.at(referrersTag(m.Digest)), MediaTypeOCIIndex, index)
+}
+
+// putJSON puts the manifest, marshaled, under ref.
+func (c *Client) putJSON(ctx context.Context, ref Reference, mediaType string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.PutManifest(ctx, ref, &Manifest{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Content:   content,
+	})
+}
+
+// referrers returns the manifests whose subject is the manifest, from the
+// referrers API, or from the fallback tag if the registry does not have it.
+// The bool is true if the registry has the API.
+func (c *Client) referrers(ctx context.Context, ref Reference, digest string) ([]artifactDescriptor, bool, error) {
+	path := fmt.Sprintf("/v2/%s/referrers/%s", ref.Repository, digest)
+
+	resp, err := c.do(ctx, "GET", ref.Domain, path, pullScope(ref.Repository), http.Header{"Accept": {MediaTypeOCIIndex}}, nil, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	index := referrersIndex{}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			return nil, true, fmt.Errorf("referrers of %s: %v", ref, err)
+		}
+
+		return index.Manifests, true, nil
+	case http.StatusNotFound:
+	default:
+		return nil, false, statusError("GET", ref.Domain+path, resp)
+	}
+
+	m, err := c.GetManifest(ctx, ref.at(referrersTag(digest)))
+	if err == ErrNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if err := json.Unmarshal(m.Content, &index); err != nil {
+		return nil, false, fmt.Errorf("referrers of %s: %v", ref, err)
+	}
+
+	return index.Manifests, false, nil
+}
+
+// Verify checks the cosign signatures of the manifest of the image, under the
+// signature tag and as referrers of the manifest, with the public key.
+// Returns the digest of the manifest and the signatures which are valid; it
+// is an error for there to be none.
+func (c *Client) Verify(ctx context.Context, ref Reference, public crypto.PublicKey) (string, []Signature, error) {
+	dgst, signatures, err := c.verify(ctx, ref, public)
+	audit.Record(audit.Verify, ref.String(), dgst, err)
+	return dgst, signatures, err
+}
+
+func (c *Client) verify(ctx context.Context, ref Reference, public crypto.PublicKey) (string, []Signature, error) {
+	m, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", ref, err)
+	}
+
+	manifests := []*Manifest{}
+
+	tagged, err := c.GetManifest(ctx, ref.at(SignatureTag(m.Digest)))
+	if err == nil {
+		manifests = append(manifests, tagged)
+	} else if err != ErrNotFound {
+		return "", nil, err
+	}
+
+	referrers, _, err := c.referrers(ctx, ref, m.Digest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, desc := range referrers {
+		if desc.ArtifactType != ArtifactTypeCosignSignature {
+			continue
+		}
+
+		referrer, err := c.GetManifest(ctx, ref.at(desc.Digest))
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", ref.at(desc.Digest), err)
+		}
+
+		manifests = append(manifests, referrer)
+	}
+
+	signatures := []Signature{}
+
+	for i, sm := range manifests {
+		manifest := signatureManifest{}
+		if err := json.Unmarshal(sm.Content, &manifest); err != nil {
+			return "", nil, fmt.Errorf("signatures of %s: %v", ref, err)
+		}
+
+		for _, layer := range manifest.Layers {
+			payload, ok, err := c.verifyLayer(ctx, ref, m.Digest, layer, public)
+			if err != nil {
+				return "", nil, err
+			}
+
+			if ok {
+				signatures = append(signatures, Signature{
+					Digest:          layer.Digest,
+					DockerReference: payload.Critical.Identity.DockerReference,
+					Referrer:        tagged == nil || i > 0,
+				})
+			}
+		}
+	}
+
+	if len(signatures) == 0 {
+		return m.Digest, nil, fmt.Errorf("%s has no signature made with the key", ref)
+	}
+
+	return m.Digest, signatures, nil
+}
+
+// verifyLayer returns the payload of the signature in the layer, and whether
+// it is valid: signed with the key, for the manifest.
+func (c *Client) verifyLayer(ctx context.Context, ref Reference, digest string, layer artifactDescriptor, public crypto.PublicKey) (*simpleSigning, bool, error) {
+	encoded, ok := layer.Annotations[SignatureAnnotation]
+	if layer.MediaType != MediaTypeSimpleSigning || !ok {
+		return nil, false, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	rc, _, err := c.GetBlob(ctx, ref.Domain, ref.Repository, layer.Digest)
+	if err != nil {
+		return nil, false, fmt.Errorf("signature %s of %s: %v", layer.Digest, ref, err)
+	}
+	defer rc.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(rc, maxPayloadSize))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if fmt.Sprintf("sha256:%x", sha256.Sum256(content)) != layer.Digest || !verifySignature(public, content, signature) {
+		return nil, false, nil
+	}
+
+	payload := &simpleSigning{}
+	if err := json.Unmarshal(content, payload); err != nil {
+		return nil, false, nil
+	}
+
+	if payload.Critical.Type != signatureType || payload.Critical.Image.DockerManifestDigest != digest {
+		return nil, false, nil
+	}
+
+	return payload, true, nil
+}
@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/box-builder/box/tracing"
+)
+
+// Transfer counts the bytes of the bodies of requests clients send to
+// registries, and of the responses they receive, with the contexts given it
+// by WithTransfer. It may count the requests of several builds at once.
+type Transfer struct {
+	received, sent int64
+}
+
+// Bytes returns the bytes received from registries and sent to them.
+func (t *Transfer) Bytes() (int64, int64) {
+	return atomic.LoadInt64(&t.received), atomic.LoadInt64(&t.sent)
+}
+
+type transferKey struct{}
+
+// WithTransfer returns a context whose requests to registries are counted
+// into the transfer.
+func WithTransfer(ctx context.Context, t *Transfer) context.Context {
+	return context.WithValue(ctx, transferKey{}, t)
+}
+
+// countingTransport counts the bytes of the bodies of the requests and
+// responses of the transport of http.DefaultClient into the transfer of
+// their context, if it has one, and traces each request until its response
+// is read. The transport is looked up for each request, as tlsconfig
+// configures it.
+type countingTransport struct{}
+
+func (countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, _ := req.Context().Value(transferKey{}).(*Transfer)
+
+	_, span := tracing.Start(req.Context(), "registry "+req.Method, tracing.KindClient)
+	span.Set("http.method", req.Method)
+	span.Set("http.url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+
+	// requests are not changed by transports, so they are changed on a
+	// copy.
+	r := *req
+	if req.Body != nil && t != nil {
+		r.Body = &countingBody{ReadCloser: req.Body, count: &t.sent}
+	}
+
+	if span != nil {
+		r.Header = http.Header{}
+		for key, values := range req.Header {
+			r.Header[key] = values
+		}
+		r.Header.Set("traceparent", span.Traceparent())
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(&r)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+
+	span.Set("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		err = fmt.Errorf("%s", resp.Status)
+	}
+
+	body := &countingBody{ReadCloser: resp.Body, span: span, err: err}
+	if t != nil {
+		body.count = &t.received
+	}
+
+	resp.Body = body
+	return resp, nil
+}
+
+// countingBody counts the bytes read of the body, and ends the span of its
+// request as it is closed.
+type countingBody struct {
+	io.ReadCloser
+	count *int64
+	span  *tracing.Span
+	err   error
+	read  int64
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if cb.count != nil {
+		atomic.AddInt64(cb.count, int64(n))
+	}
+	cb.read += int64(n)
+	return n, err
+}
+
+func (cb *countingBody) Close() error {
+	cb.span.Set("http.response_body_bytes", cb.read)
+	cb.span.End(cb.err)
+	return cb.ReadCloser.Close()
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/box-builder/box/builder/command"
 	"github.com/box-builder/box/builder/evaluator"
 	"github.com/box-builder/box/builder/evaluator/mruby"
+	"github.com/box-builder/box/builder/executor"
 	"github.com/box-builder/box/builder/executor/docker"
 	"github.com/box-builder/box/logger"
 	"github.com/box-builder/box/signal"
@@ -27,7 +28,9 @@ const (
 type Repl struct {
 	readline  *readline.Instance
 	evaluator evaluator.Evaluator
+	exec      executor.Executor
 	globals   *types.Global
+	stackKeep int
 }
 
 // NewRepl contypes a new Repl.
@@ -45,6 +48,7 @@ func NewRepl(omit []string, log *logger.Logger) (*Repl, error) {
 		TTY:       true,
 		Cache:     false,
 		ShowRun:   true,
+		Signals:   signal.Handler,
 		Logger:    log,
 		Context:   ctx,
 	}
@@ -70,10 +74,33 @@ func NewRepl(omit []string, log *logger.Logger) (*Repl, error) {
 
 	signal.Handler.AddFunc(cancel)
 
-	return &Repl{readline: rl, evaluator: e, globals: globals}, nil
+	return &Repl{readline: rl, evaluator: e, exec: exec, globals: globals}, nil
 }
 
-// Loop runs the loop. Returns nil on io.EOF, otherwise errors are forwarded.
+// From starts the session from the image, as if `from` was typed at the
+// prompt.
+func (r *Repl) From(image string) error {
+	keep, err := r.evaluator.RunCode(fmt.Sprintf("from %q", image), r.stackKeep)
+	if err != nil {
+		return err
+	}
+
+	r.stackKeep = keep
+	return nil
+}
+
+// Tag tags the image the session has built so far.
+func (r *Repl) Tag(tag string) error {
+	return r.exec.Image().Tag(tag)
+}
+
+// ImageID returns the image the session has built so far.
+func (r *Repl) ImageID() string {
+	return r.exec.Image().ImageID()
+}
+
+// Loop runs the loop. Returns nil on io.EOF or when the user quits, otherwise
+// errors are forwarded.
 func (r *Repl) Loop() error {
 	defer func() {
 		if err := recover(); err != nil {
@@ -83,7 +110,6 @@ func (r *Repl) Loop() error {
 	}()
 
 	var line string
-	var stackKeep int
 
 	for {
 		tmp, err := r.readline.Readline()
@@ -110,23 +136,21 @@ func (r *Repl) Loop() error {
 		line += tmp + "\n"
 
 		switch strings.TrimSpace(line) {
-		case "quit":
-			fallthrough
-		case "exit":
-			os.Exit(0)
+		case "quit", "exit":
+			return nil
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		r.globals.Context = ctx
 		signal.Handler.AddFunc(cancel)
 
-		newKeep, err := r.evaluator.RunCode(line, stackKeep)
-		if err != nil && newKeep == stackKeep {
+		newKeep, err := r.evaluator.RunCode(line, r.stackKeep)
+		if err != nil && newKeep == r.stackKeep {
 			r.readline.SetPrompt(multilinePrompt)
 			continue
 		}
 
-		stackKeep = newKeep
+		r.stackKeep = newKeep
 
 		line = ""
 		r.readline.SetPrompt(normalPrompt)
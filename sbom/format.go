@@ -0,0 +1,174 @@
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Formats an SBOM is written in.
+const (
+	SPDX      = "spdx"
+	CycloneDX = "cyclonedx"
+)
+
+// The media types of the formats, which are the artifact types of SBOMs
+// attached to images.
+var mediaTypes = map[string]string{
+	SPDX:      "application/spdx+json",
+	CycloneDX: "application/vnd.cyclonedx+json",
+}
+
+// spdxLicense matches licenses which are SPDX license expressions, such as
+// MIT or GPL-2.0-only OR Apache-2.0.
+var spdxLicense = regexp.MustCompile(`^[A-Za-z0-9.+-]+( (AND|OR|WITH) [A-Za-z0-9.+-]+)*$`)
+
+// ParseOutput parses an SBOM location, format:file, returning the format and
+// the file.
+func ParseOutput(output string) (string, string, error) {
+	parts := strings.SplitN(output, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid sbom %q: must be format:file", output)
+	}
+
+	if _, ok := mediaTypes[parts[0]]; !ok {
+		return "", "", fmt.Errorf("invalid sbom %q: the format must be %s or %s", output, SPDX, CycloneDX)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// MediaType returns the media type of the format.
+func MediaType(format string) string {
+	return mediaTypes[format]
+}
+
+// Write writes the SBOM to w in the format, SPDX 2.3 or CycloneDX 1.5 JSON,
+// as made at the time given.
+func (s *SBOM) Write(w io.Writer, format string, created time.Time) error {
+	var doc interface{}
+
+	switch format {
+	case SPDX:
+		doc = s.spdx(created)
+	case CycloneDX:
+		doc = s.cycloneDX(created)
+	default:
+		return fmt.Errorf("unknown sbom format %q", format)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// digest is the digest of the packages of the SBOM, which identifies the
+// document.
+func (s *SBOM) digest() [sha256.Size]byte {
+	content, _ := json.Marshal(s)
+	return sha256.Sum256(content)
+}
+
+func (s *SBOM) spdx(created time.Time) map[string]interface{} {
+	packages := []interface{}{}
+	relationships := []interface{}{}
+
+	for i, pkg := range s.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", pkg.Type, i)
+
+		p := map[string]interface{}{
+			"name":             pkg.Name,
+			"SPDXID":           id,
+			"versionInfo":      pkg.Version,
+			"downloadLocation": "NOASSERTION",
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  "NOASSERTION",
+			"filesAnalyzed":    false,
+			"sourceInfo":       "found in " + pkg.Path,
+			"externalRefs": []interface{}{
+				map[string]interface{}{
+					"referenceCategory": "PACKAGE-MANAGER",
+					"referenceType":     "purl",
+					"referenceLocator":  s.PURL(pkg),
+				},
+			},
+		}
+
+		if spdxLicense.MatchString(pkg.License) {
+			p["licenseDeclared"] = pkg.License
+		} else if pkg.License != "" {
+			p["licenseComments"] = pkg.License
+		}
+
+		packages = append(packages, p)
+		relationships = append(relationships, map[string]interface{}{
+			"spdxElementId":      "SPDXRef-DOCUMENT",
+			"relationshipType":   "DESCRIBES",
+			"relatedSpdxElement": id,
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              s.Image,
+		"documentNamespace": fmt.Sprintf("https://box-builder.github.io/spdx/%x", s.digest()),
+		"creationInfo": map[string]interface{}{
+			"created":  created.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: box"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+func (s *SBOM) cycloneDX(created time.Time) map[string]interface{} {
+	components := []interface{}{}
+
+	for i, pkg := range s.Packages {
+		purl := s.PURL(pkg)
+
+		c := map[string]interface{}{
+			"type":     "library",
+			"bom-ref":  fmt.Sprintf("%s-%d", pkg.Type, i),
+			"name":     pkg.Name,
+			"version":  pkg.Version,
+			"purl":     purl,
+			"evidence": map[string]interface{}{"occurrences": []interface{}{map[string]string{"location": pkg.Path}}},
+		}
+
+		if spdxLicense.MatchString(pkg.License) {
+			c["licenses"] = []interface{}{map[string]interface{}{"expression": pkg.License}}
+		} else if pkg.License != "" {
+			c["licenses"] = []interface{}{map[string]interface{}{"license": map[string]string{"name": pkg.License}}}
+		}
+
+		components = append(components, c)
+	}
+
+	metadata := map[string]interface{}{
+		"timestamp": created.UTC().Format(time.RFC3339),
+		"tools":     map[string]interface{}{"components": []interface{}{map[string]string{"type": "application", "name": "box"}}},
+		"component": map[string]string{"type": "container", "name": s.Image},
+	}
+
+	// the serial number is a UUID; it is made of the digest of the packages,
+	// so the same image has the same one.
+	d := s.digest()
+	d[6] = d[6]&0x0f | 0x50
+	d[8] = d[8]&0x3f | 0x80
+
+	return map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", d[0:4], d[4:6], d[6:8], d[8:10], d[10:16]),
+		"version":      1,
+		"metadata":     metadata,
+		"components":   components,
+	}
+}
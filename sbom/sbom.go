@@ -0,0 +1,356 @@
+// Package sbom finds the packages installed in the filesystem of an image, by
+// the operating system's package manager and by those of languages, and
+// writes them as a software bill of materials in the SPDX or CycloneDX
+// format.
+package sbom
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Types of packages.
+const (
+	Deb  = "deb"
+	Apk  = "apk"
+	Npm  = "npm"
+	PyPI = "pypi"
+	Gem  = "gem"
+)
+
+// maxFileSize is the size of the largest file read from the filesystem.
+const maxFileSize = 64 << 20
+
+// Distro is the distribution of the image, as /etc/os-release names it.
+type Distro struct {
+	ID        string `json:"id"`
+	VersionID string `json:"version_id"`
+	Name      string `json:"name"`
+}
+
+// Package is a package installed in the filesystem.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Type    string `json:"type"`
+	Arch    string `json:"arch,omitempty"`
+	License string `json:"license,omitempty"`
+	Path    string `json:"path"` // the file the package was found in
+}
+
+// SBOM is the packages installed in the filesystem of an image.
+type SBOM struct {
+	Image    string    `json:"image"`
+	Distro   Distro    `json:"distro"`
+	Packages []Package `json:"packages"`
+}
+
+// Scan reads the filesystem of an image, as a tarball such as the one
+// image.Export writes, and returns the packages installed in it: by dpkg and
+// apk, and npm, pip and gem packages. Packages are sorted by type, name and
+// version.
+func Scan(r io.Reader, name string) (*SBOM, error) {
+	s := &SBOM{Image: name, Packages: []Package{}}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		p := path.Clean("/" + header.Name)
+		release := p == "/etc/os-release" || p == "/usr/lib/os-release"
+
+		parse := parserFor(p)
+		if parse == nil && !release {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(tr, maxFileSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if release {
+			s.readDistro(p, content)
+			continue
+		}
+
+		for _, pkg := range parse(content) {
+			pkg.Path = p
+			s.Packages = append(s.Packages, pkg)
+		}
+	}
+
+	sort.Slice(s.Packages, func(i, j int) bool {
+		a, b := s.Packages[i], s.Packages[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+
+		return a.Path < b.Path
+	})
+
+	return s, nil
+}
+
+// parserFor returns the parser of the file at the path, or nil if it lists no
+// packages.
+func parserFor(p string) func([]byte) []Package {
+	dir, base := path.Dir(p), path.Base(p)
+
+	switch {
+	case p == "/var/lib/dpkg/status":
+		return parseDpkg(true)
+	case dir == "/var/lib/dpkg/status.d" && !strings.HasSuffix(base, ".md5sums"):
+		// distroless images have a status file for each package, without the
+		// status field.
+		return parseDpkg(false)
+	case p == "/lib/apk/db/installed":
+		return parseApk
+	case base == "package.json" && isNodeModule(dir):
+		return parseNpm
+	case (base == "METADATA" && strings.HasSuffix(dir, ".dist-info")) || (base == "PKG-INFO" && strings.HasSuffix(dir, ".egg-info")):
+		return parsePython
+	case strings.HasSuffix(base, ".gemspec") && path.Base(dir) == "specifications":
+		return parseGemspec(strings.TrimSuffix(base, ".gemspec"))
+	}
+
+	return nil
+}
+
+// isNodeModule is true if the directory is a package in node_modules, scoped
+// or not.
+func isNodeModule(dir string) bool {
+	parent := path.Dir(dir)
+	if strings.HasPrefix(path.Base(parent), "@") {
+		parent = path.Dir(parent)
+	}
+
+	return path.Base(parent) == "node_modules"
+}
+
+func (s *SBOM) readDistro(p string, content []byte) {
+	// /etc/os-release is the one to read if there are both.
+	if p == "/usr/lib/os-release" && s.Distro.ID != "" {
+		return
+	}
+
+	distro := Distro{}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.Trim(parts[1], `"'`)
+		switch parts[0] {
+		case "ID":
+			distro.ID = value
+		case "VERSION_ID":
+			distro.VersionID = value
+		case "PRETTY_NAME":
+			distro.Name = value
+		}
+	}
+
+	s.Distro = distro
+}
+
+// paragraphs splits the content into paragraphs of fields, as dpkg and apk
+// write their databases. Lines which start with a space continue the field
+// above them.
+func paragraphs(content []byte, sep string) []map[string]string {
+	result := []map[string]string{}
+	fields := map[string]string{}
+	last := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxFileSize)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(fields) > 0 {
+				result = append(result, fields)
+			}
+			fields = map[string]string{}
+			last = ""
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+			if last != "" {
+				fields[last] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			parts := strings.SplitN(line, sep, 2)
+			if len(parts) == 2 {
+				last = parts[0]
+				fields[last] = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		result = append(result, fields)
+	}
+
+	return result
+}
+
+func parseDpkg(status bool) func([]byte) []Package {
+	return func(content []byte) []Package {
+		packages := []Package{}
+
+		for _, fields := range paragraphs(content, ":") {
+			if status && !strings.HasSuffix(fields["Status"], " installed") {
+				continue
+			}
+
+			if fields["Package"] == "" || fields["Version"] == "" {
+				continue
+			}
+
+			packages = append(packages, Package{Name: fields["Package"], Version: fields["Version"], Arch: fields["Architecture"], Type: Deb})
+		}
+
+		return packages
+	}
+}
+
+func parseApk(content []byte) []Package {
+	packages := []Package{}
+
+	for _, fields := range paragraphs(content, ":") {
+		if fields["P"] == "" || fields["V"] == "" {
+			continue
+		}
+
+		packages = append(packages, Package{Name: fields["P"], Version: fields["V"], Arch: fields["A"], License: fields["L"], Type: Apk})
+	}
+
+	return packages
+}
+
+func parseNpm(content []byte) []Package {
+	manifest := struct {
+		Name    string          `json:"name"`
+		Version string          `json:"version"`
+		License json.RawMessage `json:"license"`
+	}{}
+
+	if err := json.Unmarshal(content, &manifest); err != nil || manifest.Name == "" || manifest.Version == "" {
+		return nil
+	}
+
+	// the license is a string, or an object with a type in old packages.
+	var license string
+	if err := json.Unmarshal(manifest.License, &license); err != nil {
+		object := struct{ Type string }{}
+		json.Unmarshal(manifest.License, &object)
+		license = object.Type
+	}
+
+	return []Package{{Name: manifest.Name, Version: manifest.Version, License: license, Type: Npm}}
+}
+
+func parsePython(content []byte) []Package {
+	// the metadata is headers, then the description after a blank line.
+	i := bytes.Index(content, []byte("\n\n"))
+	if i >= 0 {
+		content = content[:i]
+	}
+
+	fields := paragraphs(content, ":")
+	if len(fields) == 0 || fields[0]["Name"] == "" || fields[0]["Version"] == "" {
+		return nil
+	}
+
+	license := fields[0]["License-Expression"]
+	if license == "" && !strings.Contains(fields[0]["License"], "\n") {
+		license = fields[0]["License"]
+	}
+
+	return []Package{{Name: fields[0]["Name"], Version: fields[0]["Version"], License: license, Type: PyPI}}
+}
+
+// parseGemspec returns the gem whose specification is named name-version.
+func parseGemspec(name string) func([]byte) []Package {
+	return func([]byte) []Package {
+		for i := len(name) - 1; i > 0; i-- {
+			if name[i] == '-' && i+1 < len(name) && name[i+1] >= '0' && name[i+1] <= '9' {
+				return []Package{{Name: name[:i], Version: name[i+1:], Type: Gem}}
+			}
+		}
+
+		return nil
+	}
+}
+
+// PURL returns the package URL of the package, which identifies it in
+// vulnerability databases.
+func (s *SBOM) PURL(pkg Package) string {
+	version := url.PathEscape(pkg.Version)
+
+	switch pkg.Type {
+	case Deb, Apk:
+		namespace := s.Distro.ID
+		if namespace == "" {
+			namespace = map[string]string{Deb: "debian", Apk: "alpine"}[pkg.Type]
+		}
+
+		qualifiers := url.Values{}
+		if pkg.Arch != "" {
+			qualifiers.Set("arch", pkg.Arch)
+		}
+		if s.Distro.ID != "" && s.Distro.VersionID != "" {
+			qualifiers.Set("distro", s.Distro.ID+"-"+s.Distro.VersionID)
+		}
+
+		purl := "pkg:" + pkg.Type + "/" + namespace + "/" + url.PathEscape(pkg.Name) + "@" + version
+		if len(qualifiers) > 0 {
+			purl += "?" + qualifiers.Encode()
+		}
+
+		return purl
+	case Npm:
+		name := url.PathEscape(pkg.Name)
+		if strings.HasPrefix(pkg.Name, "@") {
+			parts := strings.SplitN(pkg.Name[1:], "/", 2)
+			name = "%40" + url.PathEscape(parts[0])
+			if len(parts) == 2 {
+				name += "/" + url.PathEscape(parts[1])
+			}
+		}
+
+		return "pkg:npm/" + name + "@" + version
+	case PyPI:
+		// pypi names are case insensitive, with - and _ the same.
+		name := strings.ToLower(strings.Replace(pkg.Name, "_", "-", -1))
+		return "pkg:pypi/" + url.PathEscape(name) + "@" + version
+	default:
+		return "pkg:" + pkg.Type + "/" + url.PathEscape(pkg.Name) + "@" + version
+	}
+}
@@ -0,0 +1,124 @@
+package sbom
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type sbomSuite struct{}
+
+var _ = Suite(&sbomSuite{})
+
+func TestSBOM(t *T) {
+	TestingT(t)
+}
+
+func makeTar(c *C, files map[string]string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for name, content := range files {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}), IsNil)
+		_, err := tw.Write([]byte(content))
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(tw.Close(), IsNil)
+	return buf
+}
+
+var files = map[string]string{
+	"etc/os-release": "ID=debian\nVERSION_ID=\"12\"\nPRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\n",
+	"var/lib/dpkg/status": `Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.2.15-2+b2
+Description: GNU Bourne Again SHell
+ Bash is an sh-compatible command language interpreter.
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+`,
+	"lib/apk/db/installed":                                           "P:musl\nV:1.2.4-r2\nA:x86_64\nL:MIT\n\n",
+	"app/node_modules/@scope/pkg/package.json":                       `{"name": "@scope/pkg", "version": "1.2.3", "license": "MIT"}`,
+	"app/node_modules/old/package.json":                              `{"name": "old", "version": "0.1.0", "license": {"type": "BSD"}}`,
+	"app/package.json":                                               `{"name": "app", "version": "1.0.0"}`,
+	"usr/lib/python3/site-packages/Foo_Bar-2.0.dist-info/METADATA":   "Metadata-Version: 2.1\nName: Foo_Bar\nVersion: 2.0\nLicense: Apache-2.0\n\nLicense: not a header\n",
+	"usr/lib/ruby/gems/3.1.0/specifications/rack-test-2.1.0.gemspec": "# generated\n",
+}
+
+func (ss *sbomSuite) TestScan(c *C) {
+	s, err := Scan(makeTar(c, files), "test")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Distro, DeepEquals, Distro{ID: "debian", VersionID: "12", Name: "Debian GNU/Linux 12 (bookworm)"})
+
+	purls := []string{}
+	for _, pkg := range s.Packages {
+		purls = append(purls, s.PURL(pkg))
+	}
+
+	c.Assert(purls, DeepEquals, []string{
+		"pkg:apk/debian/musl@1.2.4-r2?arch=x86_64&distro=debian-12",
+		"pkg:deb/debian/bash@5.2.15-2+b2?arch=amd64&distro=debian-12",
+		"pkg:gem/rack-test@2.1.0",
+		"pkg:npm/%40scope/pkg@1.2.3",
+		"pkg:npm/old@0.1.0",
+		"pkg:pypi/foo-bar@2.0",
+	})
+
+	c.Assert(s.Packages[0].License, Equals, "MIT")
+	c.Assert(s.Packages[1].Path, Equals, "/var/lib/dpkg/status")
+	c.Assert(s.Packages[4].License, Equals, "BSD")
+	c.Assert(s.Packages[5].License, Equals, "Apache-2.0")
+}
+
+func (ss *sbomSuite) TestWrite(c *C) {
+	s, err := Scan(makeTar(c, files), "test")
+	c.Assert(err, IsNil)
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{SPDX, CycloneDX} {
+		buf := new(bytes.Buffer)
+		c.Assert(s.Write(buf, format, created), IsNil)
+
+		doc := map[string]interface{}{}
+		c.Assert(json.Unmarshal(buf.Bytes(), &doc), IsNil, Commentf("%s", format))
+
+		// the same packages make the same document.
+		again := new(bytes.Buffer)
+		c.Assert(s.Write(again, format, created), IsNil)
+		c.Assert(again.String(), Equals, buf.String())
+
+		switch format {
+		case SPDX:
+			c.Assert(doc["spdxVersion"], Equals, "SPDX-2.3")
+			c.Assert(doc["packages"], HasLen, len(s.Packages))
+		case CycloneDX:
+			c.Assert(doc["bomFormat"], Equals, "CycloneDX")
+			c.Assert(doc["components"], HasLen, len(s.Packages))
+		}
+	}
+
+	c.Assert(s.Write(new(bytes.Buffer), "xml", created), NotNil)
+}
+
+func (ss *sbomSuite) TestParseOutput(c *C) {
+	format, file, err := ParseOutput("cyclonedx:out/sbom.json")
+	c.Assert(err, IsNil)
+	c.Assert(format, Equals, CycloneDX)
+	c.Assert(file, Equals, "out/sbom.json")
+	c.Assert(MediaType(format), Equals, "application/vnd.cyclonedx+json")
+
+	for _, output := range []string{"spdx", "spdx:", "xml:sbom.xml"} {
+		_, _, err := ParseOutput(output)
+		c.Assert(err, NotNil, Commentf("%s", output))
+	}
+}
@@ -0,0 +1,231 @@
+// Package scan runs a vulnerability scanner, trivy or grype, against an image
+// docker has, and gates builds on the severity of what it finds.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Scanners box can run.
+const (
+	Trivy = "trivy"
+	Grype = "grype"
+)
+
+// Severities of vulnerabilities, from the least severe.
+var severities = []string{"UNKNOWN", "NEGLIGIBLE", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// Finding is a vulnerability found in a package of the image.
+type Finding struct {
+	ID       string `json:"id"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	FixedIn  string `json:"fixedIn,omitempty"`
+	Severity string `json:"severity"`
+}
+
+// Report is what a scan of an image found, and whether it passes the gate.
+type Report struct {
+	Image     string         `json:"image"`
+	Scanner   string         `json:"scanner"`
+	Threshold string         `json:"threshold"`
+	Counts    map[string]int `json:"counts"`
+	Findings  []Finding      `json:"findings"`
+	Failed    []Finding      `json:"failed"` // the findings at or above the threshold
+}
+
+// ParseScanner parses a scanner, given as name or name:path to run the
+// scanner from path instead of $PATH. Returns the name and the command.
+func ParseScanner(scanner string) (string, string, error) {
+	parts := strings.SplitN(scanner, ":", 2)
+	if parts[0] != Trivy && parts[0] != Grype {
+		return "", "", fmt.Errorf("invalid scanner %q: must be %s or %s, or either as name:path", scanner, Trivy, Grype)
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		return parts[0], parts[1], nil
+	}
+
+	return parts[0], parts[0], nil
+}
+
+// ValidSeverity returns an error if the severity is not one of those of
+// vulnerabilities.
+func ValidSeverity(severity string) error {
+	if rank(severity) < 0 {
+		return fmt.Errorf("invalid severity %q: must be one of %s", severity, strings.ToLower(strings.Join(severities, ", ")))
+	}
+
+	return nil
+}
+
+// rank returns the rank of the severity, or -1 if it is not one.
+func rank(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Image scans the image, which docker has, with the scanner. Findings at or
+// above the threshold severity fail the gate, see Report.Failed. The output of
+// the scanner other than its report goes to log.
+func Image(ctx context.Context, scanner, image, threshold string, log io.Writer) (*Report, error) {
+	name, command, err := ParseScanner(scanner)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	switch name {
+	case Trivy:
+		// trivy reads the image from docker; $TRIVY_SERVER makes it a client
+		// of a trivy server, which has the vulnerability database.
+		args = []string{"image", "--format", "json", "--quiet", image}
+	case Grype:
+		args = []string{"docker:" + image, "--output", "json", "--quiet"}
+	}
+
+	stdout := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = log
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v", name, err)
+	}
+
+	var findings []Finding
+	switch name {
+	case Trivy:
+		findings, err = parseTrivy(stdout.Bytes())
+	case Grype:
+		findings, err = parseGrype(stdout.Bytes())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s report: %v", name, err)
+	}
+
+	return NewReport(image, name, threshold, findings), nil
+}
+
+// NewReport returns the report of the findings, sorted from the most severe,
+// and those of them at or above the threshold.
+func NewReport(image, scanner, threshold string, findings []Finding) *Report {
+	report := &Report{
+		Image:     image,
+		Scanner:   scanner,
+		Threshold: strings.ToUpper(threshold),
+		Counts:    map[string]int{},
+		Findings:  []Finding{},
+		Failed:    []Finding{},
+	}
+
+	for _, finding := range findings {
+		finding.Severity = strings.ToUpper(finding.Severity)
+		if rank(finding.Severity) < 0 {
+			finding.Severity = "UNKNOWN"
+		}
+
+		report.Findings = append(report.Findings, finding)
+		report.Counts[finding.Severity]++
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Severity != b.Severity {
+			return rank(a.Severity) > rank(b.Severity)
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+
+		return a.ID < b.ID
+	})
+
+	for _, finding := range report.Findings {
+		if rank(finding.Severity) >= rank(threshold) {
+			report.Failed = append(report.Failed, finding)
+		}
+	}
+
+	return report
+}
+
+func parseTrivy(content []byte) ([]Finding, error) {
+	result := struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				FixedVersion     string
+				Severity         string
+			}
+		}
+	}{}
+
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, err
+	}
+
+	findings := []Finding{}
+	for _, target := range result.Results {
+		for _, v := range target.Vulnerabilities {
+			findings = append(findings, Finding{
+				ID:       v.VulnerabilityID,
+				Package:  v.PkgName,
+				Version:  v.InstalledVersion,
+				FixedIn:  v.FixedVersion,
+				Severity: v.Severity,
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+func parseGrype(content []byte) ([]Finding, error) {
+	result := struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+				Fix      struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}{}
+
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, err
+	}
+
+	findings := []Finding{}
+	for _, match := range result.Matches {
+		findings = append(findings, Finding{
+			ID:       match.Vulnerability.ID,
+			Package:  match.Artifact.Name,
+			Version:  match.Artifact.Version,
+			FixedIn:  strings.Join(match.Vulnerability.Fix.Versions, ", "),
+			Severity: match.Vulnerability.Severity,
+		})
+	}
+
+	return findings, nil
+}
@@ -0,0 +1,107 @@
+package scan
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type scanSuite struct{}
+
+var _ = Suite(&scanSuite{})
+
+func TestScan(t *T) {
+	TestingT(t)
+}
+
+const trivyReport = `{
+  "Results": [
+    {"Target": "debian", "Vulnerabilities": [
+      {"VulnerabilityID": "CVE-1", "PkgName": "openssl", "InstalledVersion": "3.0.1", "FixedVersion": "3.0.2", "Severity": "HIGH"},
+      {"VulnerabilityID": "CVE-2", "PkgName": "bash", "InstalledVersion": "5.2", "Severity": "LOW"}
+    ]},
+    {"Target": "app/package-lock.json", "Vulnerabilities": [
+      {"VulnerabilityID": "GHSA-3", "PkgName": "lodash", "InstalledVersion": "4.17.0", "FixedVersion": "4.17.21", "Severity": "CRITICAL"}
+    ]},
+    {"Target": "python"}
+  ]
+}`
+
+const grypeReport = `{
+  "matches": [
+    {"vulnerability": {"id": "CVE-4", "severity": "Negligible", "fix": {"versions": []}}, "artifact": {"name": "zlib", "version": "1.2"}},
+    {"vulnerability": {"id": "CVE-5", "severity": "Medium", "fix": {"versions": ["2.0", "1.9.1"]}}, "artifact": {"name": "curl", "version": "1.9"}},
+    {"vulnerability": {"id": "CVE-6", "severity": "Whatever"}, "artifact": {"name": "odd", "version": "1"}}
+  ]
+}`
+
+func (ss *scanSuite) TestParseScanner(c *C) {
+	for scanner, expected := range map[string][2]string{
+		"trivy":                      {Trivy, "trivy"},
+		"grype:/opt/grype/bin/grype": {Grype, "/opt/grype/bin/grype"},
+		"trivy:":                     {Trivy, "trivy"},
+	} {
+		name, command, err := ParseScanner(scanner)
+		c.Assert(err, IsNil)
+		c.Assert([2]string{name, command}, Equals, expected)
+	}
+
+	_, _, err := ParseScanner("clair")
+	c.Assert(err, NotNil)
+
+	c.Assert(ValidSeverity("High"), IsNil)
+	c.Assert(ValidSeverity("severe"), NotNil)
+}
+
+func (ss *scanSuite) TestReport(c *C) {
+	findings, err := parseTrivy([]byte(trivyReport))
+	c.Assert(err, IsNil)
+
+	report := NewReport("app", Trivy, "high", findings)
+	c.Assert(report.Threshold, Equals, "HIGH")
+	c.Assert(report.Counts, DeepEquals, map[string]int{"CRITICAL": 1, "HIGH": 1, "LOW": 1})
+	c.Assert(report.Findings, HasLen, 3)
+	c.Assert(report.Findings[0].ID, Equals, "GHSA-3")
+	c.Assert(report.Findings[2].ID, Equals, "CVE-2")
+	c.Assert(report.Failed, DeepEquals, report.Findings[:2])
+
+	findings, err = parseGrype([]byte(grypeReport))
+	c.Assert(err, IsNil)
+
+	report = NewReport("app", Grype, "medium", findings)
+	c.Assert(report.Findings, DeepEquals, []Finding{
+		{ID: "CVE-5", Package: "curl", Version: "1.9", FixedIn: "2.0, 1.9.1", Severity: "MEDIUM"},
+		{ID: "CVE-4", Package: "zlib", Version: "1.2", Severity: "NEGLIGIBLE"},
+		{ID: "CVE-6", Package: "odd", Version: "1", Severity: "UNKNOWN"},
+	})
+	c.Assert(report.Failed, HasLen, 1)
+
+	report = NewReport("app", Grype, "critical", nil)
+	c.Assert(report.Findings, HasLen, 0)
+	c.Assert(report.Failed, HasLen, 0)
+
+	_, err = parseTrivy([]byte("not json"))
+	c.Assert(err, NotNil)
+}
+
+func (ss *scanSuite) TestImage(c *C) {
+	dir := c.MkDir()
+	report := filepath.Join(dir, "report.json")
+	c.Assert(ioutil.WriteFile(report, []byte(trivyReport), 0644), IsNil)
+
+	// the scanner is run with the image, and its report read from stdout.
+	script := filepath.Join(dir, "trivy")
+	c.Assert(ioutil.WriteFile(script, []byte("#!/bin/sh\n[ \"$1 $5\" = \"image sha256:1234\" ] || exit 1\ncat "+report+"\n"), 0755), IsNil)
+
+	result, err := Image(context.Background(), "trivy:"+script, "sha256:1234", "critical", ioutil.Discard)
+	c.Assert(err, IsNil)
+	c.Assert(result.Image, Equals, "sha256:1234")
+	c.Assert(result.Findings, HasLen, 3)
+	c.Assert(result.Failed, HasLen, 1)
+
+	_, err = Image(context.Background(), "trivy:"+script, "other", "critical", ioutil.Discard)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,75 @@
+package sched
+
+import "fmt"
+
+// Task is a build to schedule: how heavy it is, and the builds, by index, it
+// needs to finish before it starts.
+type Task struct {
+	Weight int
+	Needs  []int
+}
+
+// Priorities returns the priority of each task: its weight, with the greatest
+// priority of the tasks which need it, so the tasks at the start of the
+// longest chains are first. An error is returned if tasks need each other.
+func Priorities(tasks []Task) ([]int, error) {
+	needed := make([][]int, len(tasks))
+	for i, task := range tasks {
+		for _, need := range task.Needs {
+			if need < 0 || need >= len(tasks) {
+				return nil, fmt.Errorf("task %d needs task %d, which does not exist", i, need)
+			}
+
+			needed[need] = append(needed[need], i)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(tasks))
+	priorities := make([]int, len(tasks))
+
+	var visit func(int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("task %d needs itself through the tasks it needs", i)
+		}
+
+		state[i] = visiting
+
+		longest := 0
+		for _, next := range needed[i] {
+			if err := visit(next); err != nil {
+				return err
+			}
+
+			if priorities[next] > longest {
+				longest = priorities[next]
+			}
+		}
+
+		weight := tasks[i].Weight
+		if weight < 1 {
+			weight = 1
+		}
+
+		priorities[i] = weight + longest
+		state[i] = visited
+		return nil
+	}
+
+	for i := range tasks {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return priorities, nil
+}
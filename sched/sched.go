@@ -0,0 +1,149 @@
+// Package sched schedules the containers of run steps across the builds box
+// runs at once. The containers share a budget of jobs, roughly CPUs, and of
+// memory: each takes the weight of its build in jobs, and waits until they are
+// free. Waiting containers are started by the priority of their build, the
+// longest chain of builds left behind it, so the builds finish soonest.
+package sched
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Scheduler is a budget of jobs and memory the containers of run steps
+// share.
+type Scheduler struct {
+	jobs   int
+	memory int64
+
+	mutex   sync.Mutex
+	used    int
+	seq     uint64
+	waiters []*waiter
+}
+
+type waiter struct {
+	weight   int
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+// New constructs a *Scheduler with a budget of jobs, at least 1, and of
+// memory in bytes, which is not limited if it is 0.
+func New(jobs int, memory int64) (*Scheduler, error) {
+	if jobs < 1 {
+		return nil, fmt.Errorf("invalid number of jobs %d: must be at least 1", jobs)
+	}
+
+	if memory < 0 {
+		return nil, fmt.Errorf("invalid memory budget %d", memory)
+	}
+
+	return &Scheduler{jobs: jobs, memory: memory}, nil
+}
+
+// Jobs returns the number of jobs in the budget.
+func (s *Scheduler) Jobs() int {
+	return s.jobs
+}
+
+// weight returns the jobs a container of the weight takes: at least one, and
+// at most all of them, so heavier ones still run, alone.
+func (s *Scheduler) weight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+
+	if weight > s.jobs {
+		return s.jobs
+	}
+
+	return weight
+}
+
+// Memory returns the memory a container of the weight may use: its share of
+// the memory budget, or 0 if memory is not limited.
+func (s *Scheduler) Memory(weight int) int64 {
+	return s.memory * int64(s.weight(weight)) / int64(s.jobs)
+}
+
+// Acquire waits until the jobs for a container of the weight are free and
+// takes them, returning the function which frees them again. Containers of
+// higher priority are started first; those of the same priority in the order
+// they asked. A container which does not fit holds back those after it, so
+// heavy ones are not starved by light ones.
+func (s *Scheduler) Acquire(ctx context.Context, weight, priority int) (func(), error) {
+	w := &waiter{
+		weight:   s.weight(weight),
+		priority: priority,
+		ready:    make(chan struct{}),
+	}
+
+	s.mutex.Lock()
+	s.seq++
+	w.seq = s.seq
+	s.waiters = append(s.waiters, w)
+	sort.SliceStable(s.waiters, func(i, j int) bool {
+		if s.waiters[i].priority != s.waiters[j].priority {
+			return s.waiters[i].priority > s.waiters[j].priority
+		}
+
+		return s.waiters[i].seq < s.waiters[j].seq
+	})
+	s.grant()
+	s.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		select {
+		case <-w.ready:
+			// it was granted as it was canceled.
+			s.used -= w.weight
+		default:
+			s.remove(w)
+		}
+
+		s.grant()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+
+			s.used -= w.weight
+			s.grant()
+		})
+	}, nil
+}
+
+// grant starts the waiters at the front of the queue which fit in the jobs
+// left. The mutex must be held.
+func (s *Scheduler) grant() {
+	for len(s.waiters) > 0 && s.used+s.waiters[0].weight <= s.jobs {
+		w := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		s.used += w.weight
+		close(w.ready)
+	}
+}
+
+// remove removes a waiter from the queue. The mutex must be held.
+func (s *Scheduler) remove(w *waiter) {
+	for i, waiting := range s.waiters {
+		if waiting == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package sched
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type schedSuite struct{}
+
+var _ = Suite(&schedSuite{})
+
+func TestSched(t *T) {
+	TestingT(t)
+}
+
+// acquired returns whether the channel of a waiting Acquire was sent to
+// within a short time.
+func acquired(ch chan func()) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func acquire(c *C, s *Scheduler, weight, priority int) chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := s.Acquire(context.Background(), weight, priority)
+		c.Check(err, IsNil)
+		ch <- release
+	}()
+
+	return ch
+}
+
+func (ss *schedSuite) TestNew(c *C) {
+	_, err := New(0, 0)
+	c.Assert(err, ErrorMatches, "invalid number of jobs 0.*")
+
+	s, err := New(4, 8<<30)
+	c.Assert(err, IsNil)
+	c.Assert(s.Jobs(), Equals, 4)
+	c.Assert(s.Memory(1), Equals, int64(2<<30))
+	c.Assert(s.Memory(2), Equals, int64(4<<30))
+	c.Assert(s.Memory(10), Equals, int64(8<<30))
+
+	s, err = New(4, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.Memory(2), Equals, int64(0))
+}
+
+func (ss *schedSuite) TestAcquire(c *C) {
+	s, err := New(3, 0)
+	c.Assert(err, IsNil)
+
+	release, err := s.Acquire(context.Background(), 2, 0)
+	c.Assert(err, IsNil)
+
+	// 2 of 3 jobs are taken, so one of weight 2 waits, and holds back the one
+	// of weight 1 behind it.
+	heavy := acquire(c, s, 2, 0)
+	c.Assert(acquired(heavy), Equals, false)
+	light := acquire(c, s, 1, 0)
+	c.Assert(acquired(light), Equals, false)
+
+	release()
+	release() // releasing twice frees the jobs once.
+	c.Assert(acquired(heavy), Equals, true)
+	c.Assert(acquired(light), Equals, true)
+
+	// heavier than the budget runs alone.
+	s, err = New(2, 0)
+	c.Assert(err, IsNil)
+	release, err = s.Acquire(context.Background(), 5, 0)
+	c.Assert(err, IsNil)
+	release()
+}
+
+func (ss *schedSuite) TestPriority(c *C) {
+	s, err := New(1, 0)
+	c.Assert(err, IsNil)
+
+	release, err := s.Acquire(context.Background(), 1, 0)
+	c.Assert(err, IsNil)
+
+	low := acquire(c, s, 1, 1)
+	c.Assert(acquired(low), Equals, false)
+	high := acquire(c, s, 1, 5)
+	c.Assert(acquired(high), Equals, false)
+
+	release()
+	c.Assert(acquired(low), Equals, false)
+
+	var next func()
+	select {
+	case next = <-high:
+	case <-time.After(time.Second):
+		c.Fatal("the waiter of higher priority was not started first")
+	}
+
+	next()
+	c.Assert(acquired(low), Equals, true)
+}
+
+func (ss *schedSuite) TestCancel(c *C) {
+	s, err := New(1, 0)
+	c.Assert(err, IsNil)
+
+	release, err := s.Acquire(context.Background(), 1, 0)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = s.Acquire(ctx, 1, 0)
+	c.Assert(err, Equals, context.Canceled)
+
+	// the canceled waiter does not hold the jobs.
+	release()
+	release, err = s.Acquire(context.Background(), 1, 0)
+	c.Assert(err, IsNil)
+	release()
+}
+
+func (ss *schedSuite) TestPriorities(c *C) {
+	// 0 and 1 are needed by 2, which is needed by 3; 4 is alone.
+	priorities, err := Priorities([]Task{
+		{Weight: 1},
+		{Weight: 4},
+		{Weight: 2, Needs: []int{0, 1}},
+		{Needs: []int{2}},
+		{Weight: 3},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(priorities, DeepEquals, []int{4, 7, 3, 1, 3})
+
+	_, err = Priorities([]Task{{Needs: []int{1}}, {Needs: []int{0}}})
+	c.Assert(err, ErrorMatches, ".*needs itself.*")
+
+	_, err = Priorities([]Task{{Needs: []int{3}}})
+	c.Assert(err, ErrorMatches, "task 0 needs task 3, which does not exist")
+}
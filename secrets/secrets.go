@@ -0,0 +1,97 @@
+// Package secrets resolves the secrets given to builds with the secret verb
+// from where they are kept: vault, the environment or a file. The values are
+// only kept in memory.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/box-builder/box/vault"
+)
+
+// Provider resolves secrets from where they are kept.
+type Provider interface {
+	// Resolve returns the value of the secret the reference names, in the
+	// form of the provider.
+	Resolve(ctx context.Context, ref string) ([]byte, error)
+}
+
+// ProviderFunc is a function which is a provider.
+type ProviderFunc func(ctx context.Context, ref string) ([]byte, error)
+
+// Resolve calls the function.
+func (f ProviderFunc) Resolve(ctx context.Context, ref string) ([]byte, error) {
+	return f(ctx, ref)
+}
+
+// providers are the providers by the option of the secret verb which names
+// them.
+var providers = map[string]Provider{
+	"vault": ProviderFunc(vault.Read),
+	"env":   ProviderFunc(resolveEnv),
+	"file":  ProviderFunc(resolveFile),
+}
+
+// Register registers a provider under the name given, the option of the
+// secret verb which names it.
+func Register(name string, provider Provider) {
+	providers[name] = provider
+}
+
+// validID matches the IDs of secrets, which name their files in
+// /run/secrets.
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidID returns an error if the ID can't name a secret.
+func ValidID(id string) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("invalid secret id %q: only letters, digits, ., _ and - are allowed", id)
+	}
+
+	return nil
+}
+
+// Resolve returns the value of the secret from the provider named.
+func Resolve(ctx context.Context, provider, ref string) ([]byte, error) {
+	p, ok := providers[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret provider %q: must be one of %s", provider, strings.Join(Providers(), ", "))
+	}
+
+	value, err := p.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s secret %s: %v", provider, ref, err)
+	}
+
+	return value, nil
+}
+
+// Providers returns the names of the providers, sorted.
+func Providers() []string {
+	names := []string{}
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func resolveEnv(ctx context.Context, name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("$%s is not set", name)
+	}
+
+	return []byte(value), nil
+}
+
+func resolveFile(ctx context.Context, file string) ([]byte, error) {
+	return ioutil.ReadFile(file)
+}
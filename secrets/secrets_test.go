@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type secretsSuite struct{}
+
+var _ = Suite(&secretsSuite{})
+
+func TestSecrets(t *T) {
+	TestingT(t)
+}
+
+func (ss *secretsSuite) TestResolve(c *C) {
+	ctx := context.Background()
+
+	os.Setenv("BOX_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("BOX_TEST_SECRET")
+
+	value, err := Resolve(ctx, "env", "BOX_TEST_SECRET")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "hunter2")
+
+	_, err = Resolve(ctx, "env", "BOX_TEST_UNSET")
+	c.Assert(err, ErrorMatches, `env secret BOX_TEST_UNSET: \$BOX_TEST_UNSET is not set`)
+
+	file := filepath.Join(c.MkDir(), "secret")
+	c.Assert(ioutil.WriteFile(file, []byte("swordfish"), 0600), IsNil)
+
+	value, err = Resolve(ctx, "file", file)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "swordfish")
+
+	_, err = Resolve(ctx, "keychain", "ci")
+	c.Assert(err, ErrorMatches, `unknown secret provider "keychain": must be one of env, file, vault`)
+
+	Register("keychain", ProviderFunc(func(ctx context.Context, ref string) ([]byte, error) {
+		return []byte("from " + ref), nil
+	}))
+	defer delete(providers, "keychain")
+
+	value, err = Resolve(ctx, "keychain", "ci")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "from ci")
+}
+
+func (ss *secretsSuite) TestValidID(c *C) {
+	for _, id := range []string{"db-pass", "npm_token", "id.rsa", "A1"} {
+		c.Assert(ValidID(id), IsNil, Commentf("%s", id))
+	}
+
+	for _, id := range []string{"", "../passwd", "a/b", "-rf", "has space", "a;b"} {
+		c.Assert(ValidID(id), NotNil, Commentf("%s", id))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/proxy"
+	"github.com/box-builder/box/repl"
+	"github.com/box-builder/box/server"
+	"github.com/box-builder/box/util"
+	"github.com/urfave/cli"
+)
+
+var replFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "tag, t",
+		Usage: "Tag the image built in the session with this name on exit",
+	},
+}
+
+func runProxyd(ctx *cli.Context) {
+	log := logger.New("proxyd", ctx.GlobalBool("no-trim"))
+
+	dir := ctx.String("dir")
+	if dir == "" {
+		dir = util.BoxDir("proxy")
+	}
+
+	p := proxy.New(ctx.String("upstream"), dir, ctx.Duration("tag-ttl"), registryPolicy, log)
+	p.Client.Insecure = ctx.Bool("insecure")
+
+	log.Print(log.Notice(fmt.Sprintf("Serving a cache of %s on %s, kept in %s\n", p.Upstream, ctx.String("listen"), dir)))
+
+	if err := http.ListenAndServe(ctx.String("listen"), p); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func runServe(ctx *cli.Context) {
+	log := logger.New("serve", ctx.GlobalBool("no-trim"))
+
+	dir := ctx.String("dir")
+	if dir == "" {
+		dir = util.BoxDir("server")
+	}
+
+	if (ctx.String("tls-cert") == "") != (ctx.String("tls-key") == "") {
+		log.Error("--tls-cert and --tls-key must be given together")
+		os.Exit(1)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// the builds are run with the global flags given before serve.
+	command := []string{exe}
+	for i, arg := range os.Args[1:] {
+		if arg == "serve" {
+			command = append(command, os.Args[1:i+1]...)
+			break
+		}
+	}
+
+	s, err := server.New(dir, command, ctx.Int("jobs"), log)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	s.Token = ctx.String("token")
+
+	log.Print(log.Notice(fmt.Sprintf("Serving builds on %s, kept in %s\n", ctx.String("listen"), dir)))
+
+	if addr := ctx.String("grpc-listen"); addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		log.Print(log.Notice(fmt.Sprintf("Serving gRPC on %s\n", addr)))
+
+		go func() {
+			var err error
+			if ctx.String("tls-cert") != "" {
+				err = (&http.Server{Handler: s}).ServeTLS(l, ctx.String("tls-cert"), ctx.String("tls-key"))
+			} else {
+				err = server.ServeH2C(l, s)
+			}
+
+			log.Error(err)
+			os.Exit(1)
+		}()
+	}
+
+	if ctx.String("tls-cert") != "" {
+		err = http.ListenAndServeTLS(ctx.String("listen"), ctx.String("tls-cert"), ctx.String("tls-key"), s)
+	} else {
+		err = http.ListenAndServe(ctx.String("listen"), s)
+	}
+
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func runRepl(ctx *cli.Context) {
+	log := logger.New("repl", ctx.Bool("no-trim"))
+	r, err := repl.NewRepl(ctx.GlobalStringSlice("omit"), log)
+	if err != nil {
+		log.Error(fmt.Sprintf("bootstrapping repl: %v\n", err))
+		os.Exit(1)
+	}
+
+	if image := ctx.Args().First(); image != "" {
+		if err := r.From(image); err != nil {
+			log.Error(fmt.Sprintf("starting from %q: %v", image, err))
+			os.Exit(1)
+		}
+	}
+
+	if err := r.Loop(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if tag := ctx.String("tag"); tag != "" && r.ImageID() != "" {
+		if err := r.Tag(tag); err != nil {
+			log.Error(fmt.Sprintf("Can't tag with tag %q: %v", tag, err))
+			os.Exit(1)
+		}
+		log.Tag(tag)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// The gRPC API of the builds is the service of box.proto, served as gRPC is
+// over HTTP/2: its messages are framed in the bodies of requests and
+// responses, and the status of each call is in the trailers.
+
+// grpcService is the name of the service, which prefixes the paths of its
+// methods.
+const grpcService = "/box.v1.Builds/"
+
+// maxMessage is the size of the largest message read, as gRPC limits it by
+// default. Contexts are submitted over many.
+const maxMessage = 4 << 20
+
+// The codes of the statuses of gRPC calls.
+const (
+	codeOK                 = 0
+	codeInvalidArgument    = 3
+	codeNotFound           = 5
+	codeResourceExhausted  = 8
+	codeFailedPrecondition = 9
+	codeUnimplemented      = 12
+	codeInternal           = 13
+	codeUnauthenticated    = 16
+)
+
+// grpcError is an error with the code of the status of a gRPC call.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e grpcError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", e.code, e.message)
+}
+
+// grpcStatus returns the gRPC status of the error.
+func grpcStatus(err error) grpcError {
+	if e, ok := err.(grpcError); ok {
+		return e
+	}
+
+	code := codeInternal
+
+	switch err.(type) {
+	case InvalidError:
+		code = codeInvalidArgument
+	}
+
+	switch err {
+	case ErrNotFound, ErrNotKept:
+		code = codeNotFound
+	case ErrQueueFull:
+		code = codeResourceExhausted
+	case ErrNotFinished, ErrNoResult:
+		code = codeFailedPrecondition
+	}
+
+	return grpcError{code, err.Error()}
+}
+
+// serveGRPC serves a call of the gRPC API.
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	var err error
+
+	if !s.authorized(r) {
+		err = grpcError{codeUnauthenticated, "the request needs the token of the server"}
+	} else if r.Method != http.MethodPost {
+		err = grpcError{codeUnimplemented, "gRPC calls are posted"}
+	} else {
+		err = s.callGRPC(w, r, strings.TrimPrefix(r.URL.Path, grpcService))
+	}
+
+	status := grpcError{code: codeOK}
+	if err != nil {
+		status = grpcStatus(err)
+	}
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(status.code))
+	if status.message != "" {
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(status.message))
+	}
+}
+
+// callGRPC calls the method of the service.
+func (s *Server) callGRPC(w http.ResponseWriter, r *http.Request, method string) error {
+	body := bufio.NewReader(r.Body)
+
+	flush := func() {}
+	if flusher, ok := w.(http.Flusher); ok {
+		flush = flusher.Flush
+	}
+
+	chunks := &chunkWriter{w: w, flush: flush}
+
+	if method == "SubmitBuild" {
+		b, err := s.submitGRPC(body)
+		if err != nil {
+			return err
+		}
+
+		return writeMessage(w, encodeBuild(b))
+	}
+
+	msg, err := readMessage(body)
+	if err != nil {
+		return err
+	}
+
+	id, follow, err := decodeID(msg)
+	if err != nil {
+		return grpcError{codeInvalidArgument, err.Error()}
+	}
+
+	switch method {
+	case "GetBuild":
+		b, err := s.Get(id)
+		if err != nil {
+			return err
+		}
+
+		return writeMessage(w, encodeBuild(b))
+	case "CancelBuild":
+		b, err := s.Cancel(id)
+		if err != nil {
+			return err
+		}
+
+		return writeMessage(w, encodeBuild(b))
+	case "StreamLogs":
+		return s.Log(r.Context(), id, follow, chunks, flush)
+	case "GetArtifacts":
+		return s.Result(id, chunks)
+	default:
+		return grpcError{codeUnimplemented, fmt.Sprintf("no method %s of the service", r.URL.Path)}
+	}
+}
+
+// submitGRPC submits the build of a stream of SubmitBuildRequest messages:
+// the options of the build are in the first, and its context is the bytes
+// of all of them.
+func (s *Server) submitGRPC(body *bufio.Reader) (Build, error) {
+	opts := Options{}
+	context := [][]byte{}
+
+	msg, err := readMessage(body)
+	if err != nil {
+		return Build{}, err
+	}
+
+	decodeRequest := func(msg []byte, first bool) error {
+		return decode(msg, func(field int, v uint64, b []byte) error {
+			switch {
+			case field == 1 && first:
+				return decodeOptions(b, &opts)
+			case field == 2:
+				context = append(context, b)
+			}
+			return nil
+		})
+	}
+
+	if err := decodeRequest(msg, true); err != nil {
+		return Build{}, grpcError{codeInvalidArgument, err.Error()}
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		for {
+			for _, b := range context {
+				if _, err := pw.Write(b); err != nil {
+					return
+				}
+			}
+			context = context[:0]
+
+			msg, err := readMessage(body)
+			if err == io.EOF {
+				pw.Close()
+				return
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			if err := decodeRequest(msg, false); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	b, err := s.Submit(opts, pr)
+	pr.Close()
+	return b, err
+}
+
+// readMessage reads a message framed in the body of a request: its
+// compression flag, length and bytes. io.EOF is returned once the body has
+// no more.
+func readMessage(body *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, grpcError{codeInvalidArgument, "truncated gRPC message"}
+		}
+		return nil, err
+	}
+
+	if header[0] != 0 {
+		return nil, grpcError{codeUnimplemented, "compressed messages are not supported"}
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxMessage {
+		return nil, grpcError{codeResourceExhausted, fmt.Sprintf("a message is larger than %d bytes", maxMessage)}
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcError{codeInvalidArgument, "truncated gRPC message"}
+	}
+
+	return msg, nil
+}
+
+// writeMessage writes a message framed, uncompressed.
+func writeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// chunkWriter writes what is written to it as Chunk messages, and flushes
+// each.
+type chunkWriter struct {
+	w     io.Writer
+	flush func()
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if err := writeMessage(cw.w, encodeChunk(p)); err != nil {
+		return 0, err
+	}
+
+	cw.flush()
+	return len(p), nil
+}
+
+// encodeGRPCMessage percent-encodes the message of a status, as gRPC
+// encodes it in the grpc-message trailer.
+func encodeGRPCMessage(message string) string {
+	encoded := []byte{}
+	for _, c := range []byte(message) {
+		if c < ' ' || c > '~' || c == '%' {
+			encoded = append(encoded, fmt.Sprintf("%%%02X", c)...)
+		} else {
+			encoded = append(encoded, c)
+		}
+	}
+
+	return string(encoded)
+}
+
+// ServeH2C serves the handler over HTTP/2 without TLS, with prior
+// knowledge, as gRPC clients connect to plaintext servers, to the
+// connections the listener accepts.
+func ServeH2C(l net.Listener, h http.Handler) error {
+	server := &http2.Server{}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go server.ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+	}
+}
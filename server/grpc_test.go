@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	"golang.org/x/net/http2"
+	. "gopkg.in/check.v1"
+)
+
+func (ss *serverSuite) TestGRPC(c *C) {
+	s, err := New(c.MkDir(), []string{"sh", "-c", script, "box"}, 1, logger.New("serve", false))
+	c.Assert(err, IsNil)
+	s.Token = "secret"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go ServeH2C(l, s)
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	call := func(method, token string, msgs ...[]byte) ([][]byte, string) {
+		body := bytes.NewBuffer(nil)
+		for _, msg := range msgs {
+			c.Assert(writeMessage(body, msg), IsNil)
+		}
+
+		req, err := http.NewRequest("POST", "http://"+l.Addr().String()+grpcService+method, body)
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		replies := [][]byte{}
+		rdr := bufio.NewReader(resp.Body)
+		for {
+			msg, err := readMessage(rdr)
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			replies = append(replies, msg)
+		}
+
+		return replies, resp.Trailer.Get("Grpc-Status")
+	}
+
+	build := func(replies [][]byte) *Build {
+		c.Assert(replies, HasLen, 1)
+		b := &Build{}
+		c.Assert(decodeBuild(replies[0], b), IsNil)
+		return b
+	}
+
+	// the context is submitted over two messages.
+	tar := tarball(c, `from "debian"`).Bytes()
+	first, second := encoder{}, encoder{}
+	first.bytes(1, encodeOptions(Options{Tag: "app", Profiles: []string{"test"}}))
+	first.bytes(2, tar[:100])
+	second.bytes(2, tar[100:])
+
+	replies, status := call("SubmitBuild", "secret", first, second)
+	c.Assert(status, Equals, "0")
+	b := build(replies)
+	c.Assert(b.Status, Equals, Queued)
+	c.Assert(b.Tag, Equals, "app")
+	c.Assert(b.Profiles, DeepEquals, []string{"test"})
+
+	replies, status = call("StreamLogs", "secret", encodeID(b.ID, true))
+	c.Assert(status, Equals, "0")
+	log := []byte{}
+	for _, reply := range replies {
+		chunk, err := decodeChunk(reply)
+		c.Assert(err, IsNil)
+		log = append(log, chunk...)
+	}
+	c.Assert(string(log), Matches, `--no-tty --iidfile .*/iid --profile-out .*/profile.json --tag app --profile test box.rb\nfrom "debian"`)
+
+	for i := 0; i < 100 && b.Finished == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+		replies, status = call("GetBuild", "secret", encodeID(b.ID, false))
+		c.Assert(status, Equals, "0")
+		b = build(replies)
+	}
+	c.Assert(b.Status, Equals, Succeeded)
+	c.Assert(b.Image, Equals, "sha256:1234")
+	c.Assert(b.Started, NotNil)
+
+	// the image is not kept without oci.
+	_, status = call("GetArtifacts", "secret", encodeID(b.ID, false))
+	c.Assert(status, Equals, "5")
+
+	_, status = call("CancelBuild", "secret", encodeID("0123456789abcdef", false))
+	c.Assert(status, Equals, "5")
+
+	invalid := encoder{}
+	invalid.bytes(1, encodeOptions(Options{Plan: "../box.rb"}))
+	_, status = call("SubmitBuild", "secret", invalid)
+	c.Assert(status, Equals, "3")
+
+	_, status = call("ListBuilds", "secret", encodeID("", false))
+	c.Assert(status, Equals, "12")
+
+	_, status = call("GetBuild", "wrong", encodeID(b.ID, false))
+	c.Assert(status, Equals, "16")
+}
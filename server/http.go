@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var pathRegexp = regexp.MustCompile(`^/v1/builds(?:/([a-f0-9]{16})(?:/(log|result))?)?/?$`)
+
+// ServeHTTP serves the APIs of the builds: the REST API, and the gRPC one
+// to requests of gRPC, which are served over HTTP/2. Their metrics are
+// served at /metrics.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		s.serveGRPC(w, r)
+		return
+	}
+
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "the request needs the token of the server")
+		return
+	}
+
+	if r.URL.Path == "/metrics" && r.Method == http.MethodGet {
+		s.serveMetrics(w)
+		return
+	}
+
+	match := pathRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		writeError(w, http.StatusNotFound, "not a path of the API")
+		return
+	}
+
+	id, what := match[1], match[2]
+
+	if id == "" {
+		s.serveBuilds(w, r)
+		return
+	}
+
+	s.serveBuild(w, r, id, what)
+}
+
+// serveBuilds lists the builds, or submits one.
+func (s *Server) serveBuilds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.List())
+	case http.MethodPost:
+		s.submit(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "builds are listed or submitted")
+	}
+}
+
+// serveBuild serves the build of the ID, or what of it: its log or its
+// result.
+func (s *Server) serveBuild(w http.ResponseWriter, r *http.Request, id, what string) {
+	switch {
+	case what == "" && r.Method == http.MethodGet:
+		b, err := s.Get(id)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+	case what == "" && r.Method == http.MethodDelete:
+		s.delete(w, id)
+	case what == "log" && r.Method == http.MethodGet:
+		s.log(w, r, id)
+	case what == "result" && r.Method == http.MethodGet:
+		s.result(w, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "not a method of the path")
+	}
+}
+
+// authorized returns whether the request has the token of the server, if
+// it has one.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeErr writes the error with the status of its kind.
+func writeErr(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch err.(type) {
+	case InvalidError:
+		status = http.StatusBadRequest
+	}
+
+	switch err {
+	case ErrNotFound, ErrNotKept:
+		status = http.StatusNotFound
+	case ErrQueueFull:
+		status = http.StatusServiceUnavailable
+	case ErrNotFinished, ErrNoResult:
+		status = http.StatusConflict
+	}
+
+	writeError(w, status, err.Error())
+}
+
+// submit queues the build of the plan in the context of the body: a
+// tarball, compressed or not. The plan, box.rb by default, and the tag,
+// profiles and functions omitted of the build are in the query; with oci
+// set, the image is written as an OCI layout.
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	b, err := s.Submit(Options{
+		Plan:     query.Get("plan"),
+		Tag:      query.Get("tag"),
+		Profiles: query["profile"],
+		Omit:     query["omit"],
+		OCI:      query.Get("oci") == "true",
+	}, r.Body)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/builds/"+b.ID)
+	writeJSON(w, http.StatusCreated, b)
+}
+
+// delete cancels the build if it did not finish, or removes it if it did.
+func (s *Server) delete(w http.ResponseWriter, id string) {
+	b, err := s.Get(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	if b.Status == Queued || b.Status == Running {
+		if b, err = s.Cancel(id); err != nil {
+			writeErr(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, b)
+		return
+	}
+
+	if err := s.Remove(id); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// log writes the log of the build. With follow set, what the build writes
+// is written until it finishes.
+func (s *Server) log(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := s.Get(id); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	flush := func() {}
+	if flusher, ok := w.(http.Flusher); ok {
+		flush = flusher.Flush
+	}
+
+	s.Log(r.Context(), id, r.URL.Query().Get("follow") == "true", w, flush)
+}
+
+// result writes the OCI layout of the image built as a tarball.
+func (s *Server) result(w http.ResponseWriter, id string) {
+	b, err := s.Get(id)
+	if err == nil && (!b.OCI || b.Status != Succeeded) {
+		err = ErrNoResult
+		if !b.OCI {
+			err = ErrNotKept
+		}
+	}
+
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	s.Result(id, w)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// histogram of how long builds took.
+var durationBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// metrics are the counts of the builds the server finished since it started,
+// which it exports for Prometheus.
+type metrics struct {
+	finished map[string]int64 // the builds finished, by status
+	buckets  []int64          // the builds which took up to each bound of durationBuckets
+	count    int64
+	sum      float64 // the seconds the builds took
+
+	hits     int64
+	misses   int64
+	received int64
+	sent     int64
+}
+
+// record counts the build finished, with the cache hits and registry
+// transfers of the profile box wrote for it, if it succeeded.
+func (m *metrics) record(b *Build) {
+	if m.finished == nil {
+		m.finished = map[string]int64{}
+		m.buckets = make([]int64, len(durationBuckets))
+	}
+
+	m.finished[b.Status]++
+
+	if b.Started != nil && b.Finished != nil {
+		seconds := b.Finished.Sub(*b.Started).Seconds()
+		for i, bound := range durationBuckets {
+			if seconds <= bound {
+				m.buckets[i]++
+			}
+		}
+
+		m.count++
+		m.sum += seconds
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(b.dir, "profile.json"))
+	if err != nil {
+		return
+	}
+
+	profile := struct {
+		Steps []struct {
+			Cached bool `json:"cached"`
+		} `json:"steps"`
+		Received int64 `json:"received"`
+		Sent     int64 `json:"sent"`
+	}{}
+
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return
+	}
+
+	for _, step := range profile.Steps {
+		if step.Cached {
+			m.hits++
+		} else {
+			m.misses++
+		}
+	}
+
+	m.received += profile.Received
+	m.sent += profile.Sent
+}
+
+// serveMetrics writes the metrics in the text format of Prometheus.
+func (s *Server) serveMetrics(w http.ResponseWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, &s.metrics, s.builds)
+}
+
+func writeMetrics(w io.Writer, m *metrics, builds map[string]*Build) {
+	current := map[string]int{}
+	for _, b := range builds {
+		current[b.Status]++
+	}
+
+	fmt.Fprintln(w, "# HELP box_builds The builds queued and running.")
+	fmt.Fprintln(w, "# TYPE box_builds gauge")
+	for _, status := range []string{Queued, Running} {
+		fmt.Fprintf(w, "box_builds{status=%q} %d\n", status, current[status])
+	}
+
+	fmt.Fprintln(w, "# HELP box_builds_finished_total The builds finished, by how they finished.")
+	fmt.Fprintln(w, "# TYPE box_builds_finished_total counter")
+	for _, status := range []string{Succeeded, Failed, Canceled} {
+		fmt.Fprintf(w, "box_builds_finished_total{status=%q} %d\n", status, m.finished[status])
+	}
+
+	fmt.Fprintln(w, "# HELP box_build_duration_seconds How long the builds finished ran.")
+	fmt.Fprintln(w, "# TYPE box_build_duration_seconds histogram")
+	for i, bound := range durationBuckets {
+		n := int64(0)
+		if m.buckets != nil {
+			n = m.buckets[i]
+		}
+		fmt.Fprintf(w, "box_build_duration_seconds_bucket{le=\"%g\"} %d\n", bound, n)
+	}
+	fmt.Fprintf(w, "box_build_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "box_build_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "box_build_duration_seconds_count %d\n", m.count)
+
+	fmt.Fprintln(w, "# HELP box_cache_steps_total The steps of the builds which succeeded, by whether they were found in the cache.")
+	fmt.Fprintln(w, "# TYPE box_cache_steps_total counter")
+	fmt.Fprintf(w, "box_cache_steps_total{result=\"hit\"} %d\n", m.hits)
+	fmt.Fprintf(w, "box_cache_steps_total{result=\"miss\"} %d\n", m.misses)
+
+	fmt.Fprintln(w, "# HELP box_registry_bytes_total The bytes the builds which succeeded received from registries and sent to them.")
+	fmt.Fprintln(w, "# TYPE box_registry_bytes_total counter")
+	fmt.Fprintf(w, "box_registry_bytes_total{direction=\"received\"} %d\n", m.received)
+	fmt.Fprintf(w, "box_registry_bytes_total{direction=\"sent\"} %d\n", m.sent)
+}
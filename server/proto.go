@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The messages of the gRPC API, as box.proto defines them, are encoded and
+// decoded here in the protobuf wire format: only their fields are, which
+// are varints or length-delimited.
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// The statuses of builds, as the enum of box.proto numbers them.
+var statusNumbers = map[string]uint64{
+	Queued:    1,
+	Running:   2,
+	Succeeded: 3,
+	Failed:    4,
+	Canceled:  5,
+}
+
+type encoder []byte
+
+func (e *encoder) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	*e = append(*e, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func (e *encoder) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+
+	e.uvarint(uint64(field<<3 | wireVarint))
+	e.uvarint(v)
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.uvarint(uint64(field<<3 | wireBytes))
+	e.uvarint(uint64(len(b)))
+	*e = append(*e, b...)
+}
+
+func (e *encoder) string(field int, s string) {
+	if s != "" {
+		e.bytes(field, []byte(s))
+	}
+}
+
+func (e *encoder) time(field int, t *time.Time) {
+	if t != nil {
+		e.varint(field, uint64(t.UnixNano()))
+	}
+}
+
+// decode calls fn with each field of the message: its number, and its
+// value, a varint or the bytes of a length-delimited field.
+func decode(msg []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errTruncated
+		}
+		msg = msg[n:]
+
+		var (
+			v uint64
+			b []byte
+		)
+
+		switch key & 7 {
+		case wireVarint:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errTruncated
+			}
+			msg = msg[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return errTruncated
+			}
+			b, msg = msg[n:n+int(l)], msg[n+int(l):]
+		case 1:
+			if len(msg) < 8 {
+				return errTruncated
+			}
+			msg = msg[8:]
+			continue
+		case 5:
+			if len(msg) < 4 {
+				return errTruncated
+			}
+			msg = msg[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+
+		if err := fn(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeOptions decodes a BuildOptions message.
+func decodeOptions(msg []byte, opts *Options) error {
+	return decode(msg, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			opts.Plan = string(b)
+		case 2:
+			opts.Tag = string(b)
+		case 3:
+			opts.Profiles = append(opts.Profiles, string(b))
+		case 4:
+			opts.Omit = append(opts.Omit, string(b))
+		case 5:
+			opts.OCI = v != 0
+		}
+		return nil
+	})
+}
+
+// encodeOptions encodes a BuildOptions message.
+func encodeOptions(opts Options) []byte {
+	e := encoder{}
+	e.string(1, opts.Plan)
+	e.string(2, opts.Tag)
+	for _, profile := range opts.Profiles {
+		e.bytes(3, []byte(profile))
+	}
+	for _, omit := range opts.Omit {
+		e.bytes(4, []byte(omit))
+	}
+	if opts.OCI {
+		e.varint(5, 1)
+	}
+	return e
+}
+
+// encodeBuild encodes a Build message.
+func encodeBuild(b Build) []byte {
+	e := encoder{}
+	e.string(1, b.ID)
+	e.string(2, b.Plan)
+	e.string(3, b.Tag)
+	for _, profile := range b.Profiles {
+		e.bytes(4, []byte(profile))
+	}
+	for _, omit := range b.Omit {
+		e.bytes(5, []byte(omit))
+	}
+	if b.OCI {
+		e.varint(6, 1)
+	}
+	e.varint(7, statusNumbers[b.Status])
+	e.string(8, b.Image)
+	e.string(9, b.Error)
+	e.time(10, &b.Created)
+	e.time(11, b.Started)
+	e.time(12, b.Finished)
+	return e
+}
+
+// decodeBuild decodes a Build message.
+func decodeBuild(msg []byte, b *Build) error {
+	times := map[int]*time.Time{}
+
+	err := decode(msg, func(field int, v uint64, p []byte) error {
+		switch field {
+		case 1:
+			b.ID = string(p)
+		case 2:
+			b.Plan = string(p)
+		case 3:
+			b.Tag = string(p)
+		case 4:
+			b.Profiles = append(b.Profiles, string(p))
+		case 5:
+			b.Omit = append(b.Omit, string(p))
+		case 6:
+			b.OCI = v != 0
+		case 7:
+			for status, n := range statusNumbers {
+				if n == v {
+					b.Status = status
+				}
+			}
+		case 8:
+			b.Image = string(p)
+		case 9:
+			b.Error = string(p)
+		case 10, 11, 12:
+			t := time.Unix(0, int64(v)).UTC()
+			times[field] = &t
+		}
+		return nil
+	})
+
+	if t, ok := times[10]; ok {
+		b.Created = *t
+	}
+	b.Started, b.Finished = times[11], times[12]
+
+	return err
+}
+
+// decodeID decodes the id, field 1, of a BuildRequest or StreamLogsRequest
+// message, and the follow flag, field 2, of the latter.
+func decodeID(msg []byte) (id string, follow bool, err error) {
+	err = decode(msg, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			id = string(b)
+		case 2:
+			follow = v != 0
+		}
+		return nil
+	})
+
+	return id, follow, err
+}
+
+// encodeID encodes a BuildRequest or StreamLogsRequest message.
+func encodeID(id string, follow bool) []byte {
+	e := encoder{}
+	e.string(1, id)
+	if follow {
+		e.varint(2, 1)
+	}
+	return e
+}
+
+// encodeChunk encodes a Chunk message, and decodeChunk decodes one.
+func encodeChunk(data []byte) []byte {
+	e := encoder{}
+	e.bytes(1, data)
+	return e
+}
+
+func decodeChunk(msg []byte) ([]byte, error) {
+	var data []byte
+
+	err := decode(msg, func(field int, v uint64, b []byte) error {
+		if field == 1 {
+			data = append(data, b...)
+		}
+		return nil
+	})
+
+	return data, err
+}
@@ -0,0 +1,549 @@
+// Package server serves builds over HTTP, so CI systems can call box as a
+// build service instead of running it. Plans are submitted with their
+// contexts as tarballs, and built by box run as another process for each;
+// their status, logs and images are read back as they build. The builds are
+// served over a REST API, and a gRPC one.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// The statuses of builds.
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Canceled  = "canceled"
+)
+
+// followInterval is how often a log followed is read again for what the
+// build wrote since.
+const followInterval = 250 * time.Millisecond
+
+var (
+	// ErrNotFound is returned for builds the server does not have.
+	ErrNotFound = errors.New("no such build")
+	// ErrQueueFull is returned for builds submitted while too many are
+	// queued.
+	ErrQueueFull = errors.New("too many builds are queued")
+	// ErrNotFinished is returned removing builds which did not finish.
+	ErrNotFinished = errors.New("the build did not finish: cancel it first")
+	// ErrNotKept is returned for the results of builds not submitted with
+	// oci, whose images are not kept.
+	ErrNotKept = errors.New("the build was not submitted with oci: its image is not kept")
+	// ErrNoResult is returned for the results of builds which did not
+	// succeed.
+	ErrNoResult = errors.New("the build did not succeed: it has no result")
+)
+
+// InvalidError is the error of a build submitted with invalid options or
+// context.
+type InvalidError struct {
+	Err error
+}
+
+func (e InvalidError) Error() string {
+	return e.Err.Error()
+}
+
+// Options are what a build is submitted with.
+type Options struct {
+	Plan     string   `json:"plan"` // the path of the plan in the context; box.rb if empty
+	Tag      string   `json:"tag,omitempty"`
+	Profiles []string `json:"profiles,omitempty"`
+	Omit     []string `json:"omit,omitempty"`
+	OCI      bool     `json:"oci,omitempty"` // if set, the image is written as an OCI layout, which is its result
+}
+
+// Build is a build submitted, as the APIs return it.
+type Build struct {
+	ID string `json:"id"`
+	Options
+	Status   string     `json:"status"`
+	Image    string     `json:"image,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	dir    string
+	cancel chan struct{} // closed to cancel the build
+	done   chan struct{} // closed once the build finished
+}
+
+// Server runs the builds submitted, Jobs at a time, with Command: box and
+// the global flags of the builds. Each build is kept in a directory of Dir
+// until it is removed: its context, log and result, and its status, so the
+// builds finished are served again once the server is restarted.
+type Server struct {
+	Dir     string   // the directory the builds are kept in
+	Command []string // box, and the global flags the builds are run with
+	Token   string   // if set, the bearer token requests must have
+	Logger  *logger.Logger
+
+	builds  map[string]*Build
+	queue   chan *Build
+	metrics metrics
+	mutex   sync.Mutex
+}
+
+// New returns a server of the builds kept in dir, which runs jobs of them at
+// once. The builds which were queued or running when the server stopped
+// failed.
+func New(dir string, command []string, jobs int, log *logger.Logger) (*Server, error) {
+	if jobs < 1 {
+		return nil, fmt.Errorf("invalid number of jobs %d: at least one build must run at once", jobs)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Dir:     dir,
+		Command: command,
+		Logger:  log,
+		builds:  map[string]*Build{},
+		queue:   make(chan *Build, 1024),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < jobs; i++ {
+		go s.work()
+	}
+
+	return s, nil
+}
+
+// load reads the builds kept in the directory of the server.
+func (s *Server) load() error {
+	fis, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		b := &Build{}
+
+		content, err := ioutil.ReadFile(filepath.Join(s.Dir, fi.Name(), "build.json"))
+		if err != nil {
+			continue
+		}
+
+		if err := json.Unmarshal(content, b); err != nil || b.ID != fi.Name() {
+			continue
+		}
+
+		b.dir = filepath.Join(s.Dir, b.ID)
+		b.done = make(chan struct{})
+		close(b.done)
+
+		if b.Status == Queued || b.Status == Running {
+			b.Status = Failed
+			b.Error = "the server stopped before the build finished"
+			if err := s.save(b); err != nil {
+				return err
+			}
+		}
+
+		s.builds[b.ID] = b
+	}
+
+	return nil
+}
+
+// save writes the status of the build to its directory. It is called with
+// the mutex held, or before the build is served.
+func (s *Server) save(b *Build) error {
+	content, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(b.dir, "build.json.tmp")
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(b.dir, "build.json"))
+}
+
+// Submit queues the build of the plan in the context, a tarball, compressed
+// or not, and returns it.
+func (s *Server) Submit(opts Options, rdr io.Reader) (Build, error) {
+	if opts.Plan == "" {
+		opts.Plan = "box.rb"
+	}
+
+	if filepath.IsAbs(opts.Plan) || strings.Contains("/"+filepath.ToSlash(opts.Plan)+"/", "/../") {
+		return Build{}, InvalidError{fmt.Errorf("invalid plan %q: it must be a path in the context", opts.Plan)}
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return Build{}, err
+	}
+
+	b := &Build{
+		ID:      id,
+		Options: opts,
+		Status:  Queued,
+		Created: time.Now().UTC(),
+		dir:     filepath.Join(s.Dir, id),
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := s.unpack(b, rdr); err != nil {
+		os.RemoveAll(b.dir)
+		return Build{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.save(b); err != nil {
+		os.RemoveAll(b.dir)
+		return Build{}, err
+	}
+
+	select {
+	case s.queue <- b:
+	default:
+		os.RemoveAll(b.dir)
+		return Build{}, ErrQueueFull
+	}
+
+	s.builds[id] = b
+	s.Logger.Print(s.Logger.Notice(fmt.Sprintf("Queued build %s of %s\n", id, b.Plan)))
+
+	return *b, nil
+}
+
+func randomID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// unpack unpacks the context of the build from the tarball, which must have
+// the plan.
+func (s *Server) unpack(b *Build, rdr io.Reader) error {
+	dir := filepath.Join(b.dir, "context")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// the files are the user's running the server, as they would be if
+	// they were checked out.
+	if err := archive.Untar(rdr, dir, &archive.TarOptions{NoLchown: true}); err != nil {
+		return InvalidError{fmt.Errorf("invalid context: %v", err)}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, b.Plan)); err != nil {
+		return InvalidError{fmt.Errorf("the context has no plan %s", b.Plan)}
+	}
+
+	// the log is followed from when the build is queued.
+	return ioutil.WriteFile(filepath.Join(b.dir, "log"), nil, 0600)
+}
+
+// build returns the build of the ID.
+func (s *Server) build(id string) (*Build, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, ok := s.builds[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return b, nil
+}
+
+// Get returns the build of the ID.
+func (s *Server) Get(id string) (Build, error) {
+	b, err := s.build(id)
+	if err != nil {
+		return Build{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return *b, nil
+}
+
+// List returns the builds, the latest first.
+func (s *Server) List() []Build {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	builds := []Build{}
+	for _, b := range s.builds {
+		builds = append(builds, *b)
+	}
+
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Created.After(builds[j].Created) })
+	return builds
+}
+
+// Cancel cancels the build if it did not finish, and returns it. A build
+// running is interrupted, as box is by ^C, and is canceled once it exits.
+func (s *Server) Cancel(id string) (Build, error) {
+	b, err := s.build(id)
+	if err != nil {
+		return Build{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch b.Status {
+	case Queued:
+		b.Status = Canceled
+		close(b.cancel)
+		s.save(b)
+	case Running:
+		select {
+		case <-b.cancel:
+		default:
+			close(b.cancel)
+		}
+	}
+
+	return *b, nil
+}
+
+// Remove removes the build, which must have finished.
+func (s *Server) Remove(id string) error {
+	b, err := s.build(id)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if b.Status == Queued || b.Status == Running {
+		return ErrNotFinished
+	}
+
+	if err := os.RemoveAll(b.dir); err != nil {
+		return err
+	}
+
+	delete(s.builds, b.ID)
+	return nil
+}
+
+// Log writes the log of the build to w. With follow set, what the build
+// writes is written until it finishes, or ctx is done, and flush is called
+// after each write.
+func (s *Server) Log(ctx context.Context, id string, follow bool, w io.Writer, flush func()) error {
+	b, err := s.build(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, "log"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !follow {
+		_, err := io.Copy(w, f)
+		return err
+	}
+
+	for {
+		// the log is read to its end once more after the build finished.
+		finished := false
+		select {
+		case <-b.done:
+			finished = true
+		default:
+		}
+
+		if _, err := io.Copy(w, f); err != nil || finished {
+			return err
+		}
+
+		flush()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.done:
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+// Result writes the OCI layout of the image of the build to w as a tarball.
+func (s *Server) Result(id string, w io.Writer) error {
+	b, err := s.build(id)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	status, oci := b.Status, b.OCI
+	s.mutex.Unlock()
+
+	switch {
+	case !oci:
+		return ErrNotKept
+	case status != Succeeded:
+		return ErrNoResult
+	}
+
+	rc, err := archive.Tar(filepath.Join(b.dir, "result"), archive.Uncompressed)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// work runs the builds queued, one at a time.
+func (s *Server) work() {
+	for b := range s.queue {
+		s.run(b)
+	}
+}
+
+// run runs the build with the command of the server, in its context, and
+// writes its output to its log.
+func (s *Server) run(b *Build) {
+	defer close(b.done)
+
+	s.mutex.Lock()
+	if b.Status != Queued {
+		s.mutex.Unlock()
+		return
+	}
+
+	started := time.Now().UTC()
+	b.Status, b.Started = Running, &started
+	s.save(b)
+	s.mutex.Unlock()
+
+	err := s.runBox(b)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	finished := time.Now().UTC()
+	b.Finished = &finished
+
+	select {
+	case <-b.cancel:
+		b.Status = Canceled
+	default:
+		if err != nil {
+			b.Status, b.Error = Failed, err.Error()
+		} else {
+			b.Status = Succeeded
+		}
+	}
+
+	s.metrics.record(b)
+
+	if err := s.save(b); err != nil {
+		s.Logger.Error(fmt.Sprintf("Could not save build %s: %v", b.ID, err))
+	}
+
+	s.Logger.Print(s.Logger.Notice(fmt.Sprintf("Build %s of %s %s\n", b.ID, b.Plan, b.Status)))
+}
+
+// runBox runs box for the build, and reads the ID of its image. The build is
+// interrupted as it is canceled, as box is by ^C.
+func (s *Server) runBox(b *Build) error {
+	log, err := os.OpenFile(filepath.Join(b.dir, "log"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	iidfile := filepath.Join(b.dir, "iid")
+
+	args := append(append([]string{}, s.Command[1:]...), "--no-tty", "--iidfile", iidfile, "--profile-out", filepath.Join(b.dir, "profile.json"))
+	if b.Tag != "" {
+		args = append(args, "--tag", b.Tag)
+	}
+
+	if b.OCI {
+		args = append(args, "--output", "oci:"+filepath.Join(b.dir, "result"))
+	}
+
+	for _, profile := range b.Profiles {
+		args = append(args, "--profile", profile)
+	}
+
+	for _, omit := range b.Omit {
+		args = append(args, "--omit", omit)
+	}
+
+	cmd := exec.Command(s.Command[0], append(args, b.Plan)...)
+	cmd.Dir = filepath.Join(b.dir, "context")
+	cmd.Env = append(os.Environ(), "BOX_BUILD_ID="+b.ID) // so notifications link to the build
+	cmd.Stdout = log
+	cmd.Stderr = log
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err = <-exited:
+	case <-b.cancel:
+		cmd.Process.Signal(os.Interrupt)
+		err = <-exited
+	}
+
+	if err != nil {
+		return fmt.Errorf("the build failed: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(iidfile)
+	if err != nil {
+		return fmt.Errorf("could not read the image built: %v", err)
+	}
+
+	s.mutex.Lock()
+	b.Image = strings.TrimSpace(string(content))
+	s.mutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/box-builder/box/logger"
+	. "gopkg.in/check.v1"
+)
+
+type serverSuite struct{}
+
+var _ = Suite(&serverSuite{})
+
+func TestServer(t *T) {
+	TestingT(t)
+}
+
+// script stands in for box: it writes its arguments and the plan, and the
+// image ID to the --iidfile and a profile to the --profile-out, or fails for
+// plans which say so.
+const script = `echo "$@"; for plan; do :; done; cat "$plan"; grep -q fail "$plan" && exit 3; echo sha256:1234 > "$3"; ` +
+	`echo '{"steps": [{"cached": true}, {"cached": false}, {"cached": true}], "received": 2048, "sent": 1024}' > "$5"`
+
+func tarball(c *C, plan string) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "box.rb", Mode: 0644, Size: int64(len(plan)), Typeflag: tar.TypeReg}), IsNil)
+	_, err := tw.Write([]byte(plan))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	return buf
+}
+
+func (ss *serverSuite) TestBuilds(c *C) {
+	s, err := New(c.MkDir(), []string{"sh", "-c", script, "box"}, 1, logger.New("serve", false))
+	c.Assert(err, IsNil)
+	s.Token = "secret"
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	request := func(method, path string, body *bytes.Buffer, v interface{}) int {
+		var req *http.Request
+		if body != nil {
+			req, err = http.NewRequest(method, server.URL+path, body)
+		} else {
+			req, err = http.NewRequest(method, server.URL+path, nil)
+		}
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		content, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+
+		if s, ok := v.(*string); ok {
+			*s = string(content)
+		} else if v != nil {
+			c.Assert(json.Unmarshal(content, v), IsNil)
+		}
+
+		return resp.StatusCode
+	}
+
+	wait := func(id string) *Build {
+		for i := 0; i < 100; i++ {
+			b := &Build{}
+			c.Assert(request("GET", "/v1/builds/"+id, nil, b), Equals, http.StatusOK)
+			if b.Finished != nil {
+				return b
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		c.Fatal("the build did not finish")
+		return nil
+	}
+
+	b := &Build{}
+	c.Assert(request("POST", "/v1/builds?tag=app", tarball(c, `from "debian"`), b), Equals, http.StatusCreated)
+	c.Assert(b.Status, Equals, Queued)
+
+	// the log followed is written until the build finishes.
+	log := ""
+	c.Assert(request("GET", "/v1/builds/"+b.ID+"/log?follow=true", nil, &log), Equals, http.StatusOK)
+	c.Assert(log, Matches, `--no-tty --iidfile .*/iid --profile-out .*/profile.json --tag app box.rb\nfrom "debian"`)
+
+	b = wait(b.ID)
+	c.Assert(b.Status, Equals, Succeeded)
+	c.Assert(b.Image, Equals, "sha256:1234")
+
+	// the image is not kept without oci.
+	c.Assert(request("GET", "/v1/builds/"+b.ID+"/result", nil, nil), Equals, http.StatusNotFound)
+
+	failed := &Build{}
+	c.Assert(request("POST", "/v1/builds", tarball(c, `fail`), failed), Equals, http.StatusCreated)
+	failed = wait(failed.ID)
+	c.Assert(failed.Status, Equals, Failed)
+	c.Assert(failed.Error, Matches, ".*exit status 3")
+
+	c.Assert(request("POST", "/v1/builds?plan=other.rb", tarball(c, ""), nil), Equals, http.StatusBadRequest)
+	c.Assert(request("POST", "/v1/builds?plan=../box.rb", tarball(c, ""), nil), Equals, http.StatusBadRequest)
+
+	metrics := ""
+	c.Assert(request("GET", "/metrics", nil, &metrics), Equals, http.StatusOK)
+	for _, line := range []string{
+		`box_builds{status="queued"} 0`,
+		`box_builds_finished_total{status="succeeded"} 1`,
+		`box_builds_finished_total{status="failed"} 1`,
+		`box_build_duration_seconds_count 2`,
+		`box_cache_steps_total{result="hit"} 2`,
+		`box_cache_steps_total{result="miss"} 1`,
+		`box_registry_bytes_total{direction="received"} 2048`,
+		`box_registry_bytes_total{direction="sent"} 1024`,
+	} {
+		c.Assert(strings.Contains(metrics, line+"\n"), Equals, true, Commentf("%s", line))
+	}
+
+	builds := []*Build{}
+	c.Assert(request("GET", "/v1/builds", nil, &builds), Equals, http.StatusOK)
+	c.Assert(builds, HasLen, 2)
+	c.Assert(builds[0].ID, Equals, failed.ID)
+
+	// the builds finished are served again by a new server.
+	s2, err := New(s.Dir, s.Command, 1, s.Logger)
+	c.Assert(err, IsNil)
+	c.Assert(s2.builds, HasLen, 2)
+	c.Assert(s2.builds[b.ID].Image, Equals, "sha256:1234")
+
+	c.Assert(request("DELETE", "/v1/builds/"+b.ID, nil, nil), Equals, http.StatusNoContent)
+	c.Assert(request("GET", "/v1/builds/"+b.ID, nil, nil), Equals, http.StatusNotFound)
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/builds", nil)
+	c.Assert(err, IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+}
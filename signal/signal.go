@@ -45,7 +45,12 @@ func NewCancellable() *Cancellable {
 }
 
 // AddFile adds a temporary filename to be reaped if the action is canceled.
+// Files added to a nil Cancellable are not reaped.
 func (c *Cancellable) AddFile(filename string) {
+	if c == nil {
+		return
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.files[filename] = struct{}{}
@@ -53,6 +58,10 @@ func (c *Cancellable) AddFile(filename string) {
 
 // RemoveFile removes a file from the temporary file list.
 func (c *Cancellable) RemoveFile(filename string) {
+	if c == nil {
+		return
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	delete(c.files, filename)
@@ -94,9 +103,7 @@ func (c *Cancellable) SignalHandler(signals chan os.Signal) {
 		}
 
 		if !c.IgnoreRunners {
-			for _, runner := range runners {
-				<-runner
-			}
+			c.wait(runners, signals)
 		}
 
 		for fn := range files {
@@ -114,3 +121,19 @@ func (c *Cancellable) SignalHandler(signals chan os.Signal) {
 		}
 	}
 }
+
+// wait waits for the runners to finish, unless another signal is received:
+// then it exits at once, or stops waiting if it is not to exit.
+func (c *Cancellable) wait(runners []chan struct{}, signals chan os.Signal) {
+	for _, runner := range runners {
+		select {
+		case <-runner:
+		case <-signals:
+			fmt.Fprintln(os.Stderr, "\n!!! Signal received again, exiting without waiting")
+			if c.Exit {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package spill buffers blobs whose size is not known until they are read:
+// in memory while they are small, and in a temporary file once they grow past
+// a threshold. Small blobs never touch the disk, and large layers never fill
+// the memory of small machines.
+package spill
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/box-builder/box/signal"
+)
+
+// DefaultThreshold is the size past which buffers spill to a temporary file,
+// unless they are given another.
+const DefaultThreshold int64 = 32 << 20
+
+// Buffer is written to whole, then read back, any number of times, by seeking
+// to its start. It must be closed to remove the file it spilled to.
+type Buffer struct {
+	prefix    string
+	threshold int64
+	signals   *signal.Cancellable
+	mem       []byte
+	file      *os.File
+	size      int64
+	offset    int64
+}
+
+// New returns a buffer which spills to a temporary file named with the prefix
+// once it grows past threshold, or DefaultThreshold if it is not above 0. The
+// file is removed by signals, if it is set, when box is interrupted.
+func New(prefix string, threshold int64, signals *signal.Cancellable) *Buffer {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+
+	return &Buffer{prefix: prefix, threshold: threshold, signals: signals}
+}
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.size+int64(len(p)) > b.threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.file == nil {
+		b.mem = append(b.mem, p...)
+		b.size += int64(len(p))
+		return len(p), nil
+	}
+
+	n, err := b.file.WriteAt(p, b.size)
+	b.size += int64(n)
+	return n, err
+}
+
+// spill moves what was written so far to the temporary file.
+func (b *Buffer) spill() error {
+	f, err := ioutil.TempFile("", b.prefix)
+	if err != nil {
+		return err
+	}
+
+	b.signals.AddFile(f.Name())
+	b.file = f
+
+	if _, err := f.Write(b.mem); err != nil {
+		return err
+	}
+
+	b.mem = nil
+	return nil
+}
+
+func (b *Buffer) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+
+	if b.file == nil {
+		n := copy(p, b.mem[b.offset:])
+		b.offset += int64(n)
+		return n, nil
+	}
+
+	if int64(len(p)) > b.size-b.offset {
+		p = p[:b.size-b.offset]
+	}
+
+	n, err := b.file.ReadAt(p, b.offset)
+	b.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek sets where the buffer is read from next.
+func (b *Buffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("spill: negative position")
+	}
+
+	b.offset = offset
+	return offset, nil
+}
+
+// Size returns the size of what was written.
+func (b *Buffer) Size() int64 {
+	return b.size
+}
+
+// Spilled is true if the buffer spilled to a temporary file.
+func (b *Buffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Close frees the buffer, and removes the file it spilled to.
+func (b *Buffer) Close() error {
+	b.mem = nil
+
+	if b.file == nil {
+		return nil
+	}
+
+	f := b.file
+	b.file = nil
+
+	err := f.Close()
+	os.Remove(f.Name())
+	b.signals.RemoveFile(f.Name())
+	return err
+}
@@ -0,0 +1,88 @@
+package spill
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type spillSuite struct{}
+
+var _ = Suite(&spillSuite{})
+
+func TestSpill(t *T) {
+	TestingT(t)
+}
+
+func (ss *spillSuite) TestBuffer(c *C) {
+	content := strings.Repeat("0123456789", 300)
+
+	for _, size := range []int{0, 100, 1024, len(content)} {
+		b := New("spill-test", 1024, nil)
+
+		// written in pieces, so it spills part of the way through.
+		for i := 0; i < size; i += 70 {
+			end := i + 70
+			if end > size {
+				end = size
+			}
+			_, err := io.WriteString(b, content[i:end])
+			c.Assert(err, IsNil)
+		}
+
+		c.Assert(b.Size(), Equals, int64(size))
+		c.Assert(b.Spilled(), Equals, size > 1024, Commentf("%d bytes", size))
+
+		var fn string
+		if b.Spilled() {
+			fn = b.file.Name()
+		}
+
+		// read back, twice.
+		for i := 0; i < 2; i++ {
+			_, err := b.Seek(0, io.SeekStart)
+			c.Assert(err, IsNil)
+			data, err := ioutil.ReadAll(b)
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, content[:size], Commentf("%d bytes", size))
+		}
+
+		if size > 10 {
+			_, err := b.Seek(-10, io.SeekEnd)
+			c.Assert(err, IsNil)
+			data, err := ioutil.ReadAll(b)
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, content[size-10:size])
+		}
+
+		c.Assert(b.Close(), IsNil)
+
+		if fn != "" {
+			_, err := os.Stat(fn)
+			c.Assert(os.IsNotExist(err), Equals, true)
+		}
+	}
+
+	b := New("spill-test", 1024, nil)
+	defer b.Close()
+	_, err := b.Seek(-1, io.SeekStart)
+	c.Assert(err, NotNil)
+
+	// a buffer is a ReadSeeker, as cache backends are given.
+	var _ io.ReadSeeker = b
+	_, err = io.Copy(b, bytes.NewReader([]byte(content)))
+	c.Assert(err, IsNil)
+	c.Assert(b.Spilled(), Equals, true)
+
+	// without a threshold of its own, a buffer keeps the content in memory.
+	b = New("spill-test", 0, nil)
+	defer b.Close()
+	_, err = io.Copy(b, bytes.NewReader([]byte(content)))
+	c.Assert(err, IsNil)
+	c.Assert(b.Spilled(), Equals, false)
+}
@@ -0,0 +1,201 @@
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PathSize is the size of a file, or of the files beneath a directory.
+type PathSize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// WastedFile is a file of a layer which a later layer overwrites or deletes,
+// so it takes space in the image but is not in its filesystem.
+type WastedFile struct {
+	Path  string `json:"path"`
+	Layer int    `json:"layer"` // the layer the file is in, counting from 0
+	Size  int64  `json:"size"`
+}
+
+// LayerAnalysis is what a layer holds.
+type LayerAnalysis struct {
+	Size         int64      `json:"size"`   // the size of the files of the layer
+	Files        int        `json:"files"`  // the number of regular files of the layer
+	Wasted       int64      `json:"wasted"` // the size of the files later layers overwrite or delete
+	LargestFiles []PathSize `json:"largest_files"`
+	LargestDirs  []PathSize `json:"largest_dirs"`
+}
+
+// Analysis is what the layers of an image hold, and the space wasted in them.
+type Analysis struct {
+	Layers      []LayerAnalysis `json:"layers"`
+	Size        int64           `json:"size"`
+	Wasted      int64           `json:"wasted"`
+	WastedFiles []WastedFile    `json:"wasted_files"` // largest first
+}
+
+// analyzedFile is a file of the filesystem being analyzed, and the layer it
+// is in.
+type analyzedFile struct {
+	layer int
+	size  int64
+}
+
+// Analyze returns the sizes of the layer tarballs, given oldest first, with
+// the top largest files and directories of each, and the files which take
+// space in a layer but are overwritten or deleted by a later one.
+func Analyze(layers []string, top int) (*Analysis, error) {
+	analysis := &Analysis{Layers: []LayerAnalysis{}, WastedFiles: []WastedFile{}}
+	files := map[string]analyzedFile{}
+
+	for i, fn := range layers {
+		layer, err := analyzeLayer(analysis, files, i, fn, top)
+		if err != nil {
+			return nil, err
+		}
+
+		analysis.Layers = append(analysis.Layers, layer)
+		analysis.Size += layer.Size
+	}
+
+	for _, file := range analysis.WastedFiles {
+		analysis.Layers[file.Layer].Wasted += file.Size
+		analysis.Wasted += file.Size
+	}
+
+	sort.Slice(analysis.WastedFiles, func(i, j int) bool {
+		a, b := analysis.WastedFiles[i], analysis.WastedFiles[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		if a.Layer != b.Layer {
+			return a.Layer < b.Layer
+		}
+
+		return a.Path < b.Path
+	})
+
+	return analysis, nil
+}
+
+// wasteTree records the files of older layers at the path, and beneath it,
+// as wasted, and removes them from the filesystem. If self is false, only
+// those beneath it are.
+func (a *Analysis) wasteTree(files map[string]analyzedFile, name string, self bool) {
+	if file, ok := files[name]; ok && self {
+		a.WastedFiles = append(a.WastedFiles, WastedFile{Path: name, Layer: file.layer, Size: file.size})
+		delete(files, name)
+	}
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p, file := range files {
+		if strings.HasPrefix(p, prefix) {
+			a.WastedFiles = append(a.WastedFiles, WastedFile{Path: p, Layer: file.layer, Size: file.size})
+			delete(files, p)
+		}
+	}
+}
+
+func analyzeLayer(analysis *Analysis, files map[string]analyzedFile, layer int, fn string, top int) (LayerAnalysis, error) {
+	result := LayerAnalysis{}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	added := map[string]analyzedFile{}
+	dirs := map[string]int64{}
+	largest := []PathSize{}
+	removed := []string{}
+	opaque := []string{}
+
+	tr := tar.NewReader(f)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, err
+		}
+
+		name := entryPath(header.Name)
+		base := path.Base(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			opaque = append(opaque, path.Dir(name))
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removed = append(removed, path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		var size int64
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			size = header.Size
+			result.Files++
+			largest = append(largest, PathSize{Path: name, Size: size})
+
+			for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+				dirs[dir] += size
+			}
+		}
+
+		result.Size += size
+
+		if header.Typeflag != tar.TypeDir {
+			added[name] = analyzedFile{layer: layer, size: size}
+		}
+	}
+
+	// whiteouts only remove the files of older layers, so they are applied
+	// before the files of the layer are added.
+	for _, name := range removed {
+		analysis.wasteTree(files, name, true)
+	}
+
+	for _, dir := range opaque {
+		analysis.wasteTree(files, dir, false)
+	}
+
+	for name, file := range added {
+		analysis.wasteTree(files, name, true)
+		files[name] = file
+	}
+
+	largestDirs := []PathSize{}
+	for dir, size := range dirs {
+		largestDirs = append(largestDirs, PathSize{Path: dir, Size: size})
+	}
+
+	result.LargestFiles = largestPaths(largest, top)
+	result.LargestDirs = largestPaths(largestDirs, top)
+
+	return result, nil
+}
+
+// largestPaths returns the top largest of the paths, largest first.
+func largestPaths(paths []PathSize, top int) []PathSize {
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Size != paths[j].Size {
+			return paths[i].Size > paths[j].Size
+		}
+
+		return paths[i].Path < paths[j].Path
+	})
+
+	if len(paths) > top {
+		paths = paths[:top]
+	}
+
+	return paths
+}
@@ -3,69 +3,21 @@ package tar
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 
-	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/cache"
 	"github.com/box-builder/box/logger"
 	"github.com/box-builder/box/signal"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+	units "github.com/docker/go-units"
 )
 
-// rewriteTar rewrites the tar's paths to copy the source to the target.
-func rewriteTar(source, target string, logger *logger.Logger, tr *tar.Reader, tw *tar.Writer) error {
-	fi, err := os.Stat(source)
-	if err != nil {
-		return err
-	}
-
-	dir := fi.IsDir()
-
-	for {
-		header, err := tr.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-
-			return err
-		}
-
-		var name string
-		if header.Name[0] == '/' {
-			name = header.Name[1:]
-		} else {
-			name = header.Name
-		}
-
-		abs := filepath.Join(source, name)
-
-		if (dir || target[len(target)-1] == '/') && header.Name[0] != '/' {
-			// not a single file
-			header.Linkname = path.Join(target, header.Linkname)
-			header.Name = path.Join(target, header.Name)
-		} else {
-			header.Linkname = target
-			header.Name = target
-		}
-
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-
-		if err := copy.WithProgress(tw, tr, logger, fmt.Sprintf("%s -> %s", abs, header.Name)); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func expandIncludeList(source string) (string, []string, error) {
 	files, err := filepath.Glob(source)
 	if err != nil {
@@ -97,8 +49,16 @@ func expandIncludeList(source string) (string, []string, error) {
 }
 
 // Archive archives the source into target, ignoring the list of patterns
-// supplied in the string array.
-func Archive(ctx context.Context, source, target string, ignoreList []string, logger *logger.Logger) (string, string, error) {
+// supplied in the string array. It returns the name of the archive, and the
+// sum of its content (see SumContent).
+//
+// The archive is kept in the copy cache with a manifest of the files in it.
+// When the same source is archived into the same target again, files which
+// have not changed since are neither read nor summed again; their part of the
+// last archive is re-used instead. If no file changed, the last archive is
+// returned as it is. The archive being written is removed by signals, if it is
+// set, when box is interrupted.
+func Archive(ctx context.Context, source, target string, ignoreList []string, signals *signal.Cancellable, logger *logger.Logger) (string, string, error) {
 	var relFiles []string
 	var err error
 
@@ -107,39 +67,237 @@ func Archive(ctx context.Context, source, target string, ignoreList []string, lo
 		return "", "", err
 	}
 
-	reader, err := archive.TarWithOptions(source, &archive.TarOptions{IncludeFiles: relFiles, ExcludePatterns: ignoreList})
+	fi, err := os.Stat(source)
 	if err != nil {
 		return "", "", err
 	}
 
-	f, err := ioutil.TempFile("", "box-archive")
+	a := &archiver{
+		source:  source,
+		target:  target,
+		dir:     fi.IsDir(),
+		signals: signals,
+		logger:  logger,
+		seen:    map[uint64]string{},
+	}
+
+	id, err := a.id(relFiles, ignoreList)
 	if err != nil {
 		return "", "", err
 	}
-	defer f.Close()
 
-	signal.Handler.AddFile(f.Name())
-	defer signal.Handler.RemoveFile(f.Name())
+	dir := CopyCacheDir(id)
 
-	tr := tar.NewReader(reader)
-	tw := tar.NewWriter(f)
+	lock, err := cache.Acquire(ctx, "copy:"+id)
+	if err != nil {
+		return "", "", err
+	}
+	defer lock.Release()
 
-	if err := rewriteTar(source, target, logger, tr, tw); err != nil {
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return "", "", err
 	}
 
-	reader.Close()
-	tw.Close()
+	a.last, a.lastArchive = loadManifest(dir)
+	if a.lastArchive != nil {
+		defer a.lastArchive.Close()
+	}
 
-	if _, err := f.Seek(0, 0); err != nil {
+	if fn, ok, err := a.reuseLast(dir, relFiles, ignoreList); err != nil {
 		return "", "", err
+	} else if ok {
+		logger.Print(logger.Notice(fmt.Sprintf("Re-used all %d files from the copy cache\n", len(a.last.Order))))
+		return fn, a.last.sum(), nil
 	}
 
-	var sum string
-
-	if sum, err = SumReader(f); err != nil {
+	fn, err := a.write(ctx, dir, relFiles, ignoreList)
+	if err != nil {
 		return "", "", err
 	}
 
-	return f.Name(), sum, nil
+	return fn, a.manifest.sum(), nil
+}
+
+// write writes a new archive of the source to dir, re-using the files of the
+// last one which have not changed, and saves its manifest.
+func (a *archiver) write(ctx context.Context, dir string, includes, excludes []string) (string, error) {
+	f, err := ioutil.TempFile(dir, "box-archive")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	a.signals.AddFile(f.Name())
+	defer a.signals.RemoveFile(f.Name())
+
+	a.out = &countingWriter{w: f}
+	a.manifest = &manifest{Entries: map[string]manifestEntry{}}
+
+	err = walk(a.source, includes, excludes, func(path, rel string, fi os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return a.add(path, rel, fi)
+	})
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	// the end of the archive.
+	if err := tar.NewWriter(a.out).Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if a.cloned > 0 {
+		a.logger.Print(a.logger.Notice(fmt.Sprintf("Re-used %d of %d files from the copy cache, cloning %s of them\n", a.reused, len(a.manifest.Order), units.HumanSize(float64(a.cloned)))))
+	} else if a.reused > 0 {
+		a.logger.Print(a.logger.Notice(fmt.Sprintf("Re-used %d of %d files from the copy cache\n", a.reused, len(a.manifest.Order))))
+	}
+
+	if err := a.manifest.save(dir, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// errChanged stops the walk of reuseLast at the first file which changed.
+var errChanged = errors.New("the source changed")
+
+// reuseLast returns a link to the last archive in dir if none of the files it
+// has changed since, and none were added or removed. The files are only
+// looked at, not read, so archiving a large source which has not changed is
+// near-instant.
+func (a *archiver) reuseLast(dir string, includes, excludes []string) (string, bool, error) {
+	if a.lastArchive == nil {
+		return "", false, nil
+	}
+
+	i := 0
+	err := walk(a.source, includes, excludes, func(path, rel string, fi os.FileInfo) error {
+		if i >= len(a.last.Order) || a.last.Order[i] != rel {
+			return errChanged
+		}
+
+		if fp := fingerprint(fi); fp == "" || fp != a.last.Entries[rel].Fingerprint {
+			return errChanged
+		}
+
+		i++
+		return nil
+	})
+	if err == errChanged || (err == nil && i < len(a.last.Order)) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	f, err := ioutil.TempFile(dir, "box-archive")
+	if err != nil {
+		return "", false, err
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	// the caller removes the archive when it is done, as with a new one.
+	if err := os.Link(filepath.Join(dir, a.last.Archive), f.Name()); err != nil {
+		return "", false, err
+	}
+
+	return f.Name(), true, nil
+}
+
+// walk calls fun for each file to archive from the source, in the same way
+// docker selects the files of a build context.
+func walk(source string, includes, excludes []string, fun func(path, rel string, fi os.FileInfo) error) error {
+	patterns, patDirs, exceptions, err := fileutils.CleanPatterns(excludes)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		var base string
+		source, base = archive.SplitPathDirEntry(source)
+		includes = []string{base}
+	}
+
+	if len(includes) == 0 {
+		includes = []string{"."}
+	}
+
+	seen := map[string]bool{}
+
+	for _, include := range includes {
+		err := filepath.Walk(source+string(filepath.Separator)+include, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(source, path)
+			if err != nil {
+				return err
+			}
+
+			if rel == "." && fi.IsDir() {
+				return nil
+			}
+
+			// an explicit include is never excluded.
+			if include != rel {
+				if skip, err := excluded(rel, fi, patterns, patDirs, exceptions); skip || err != nil {
+					return err
+				}
+			}
+
+			if seen[rel] {
+				return nil
+			}
+			seen[rel] = true
+
+			return fun(path, rel, fi)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// excluded is true if the path is excluded by the patterns, cleaned by
+// fileutils.CleanPatterns. The error is filepath.SkipDir for a directory
+// none of the exceptions may include a file beneath.
+func excluded(rel string, fi os.FileInfo, patterns []string, patDirs [][]string, exceptions bool) (bool, error) {
+	skip, err := fileutils.OptimizedMatches(rel, patterns, patDirs)
+	if err != nil || !skip {
+		return false, err
+	}
+
+	if !fi.IsDir() {
+		return true, nil
+	}
+
+	if !exceptions {
+		return true, filepath.SkipDir
+	}
+
+	// an exception (!dir/file) may include a file beneath the directory.
+	dirSlash := rel + string(filepath.Separator)
+	for _, pat := range patterns {
+		if pat[0] == '!' && strings.HasPrefix(pat[1:]+string(filepath.Separator), dirSlash) {
+			return true, nil
+		}
+	}
+
+	return true, filepath.SkipDir
 }
@@ -0,0 +1,280 @@
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxSymlinks is how many symlinks are followed resolving a path, as linux
+// does.
+const maxSymlinks = 40
+
+// visibleEntry is an entry of the filesystem layers make up, the layer it is
+// in and its index in the layer.
+type visibleEntry struct {
+	header *tar.Header
+	layer  int
+	index  int
+}
+
+// visibleEntries returns the entries of the filesystem the layer tarballs,
+// given oldest first, make up, by path. Only the headers are read.
+func visibleEntries(layers []string) (map[string]visibleEntry, error) {
+	files := map[string]visibleEntry{}
+
+	s := &squasher{
+		seen:    map[string]bool{},
+		removed: map[string]bool{},
+		opaque:  map[string]bool{},
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		s.visit = func(header *tar.Header, index int) {
+			if !strings.HasPrefix(path.Base(header.Name), whiteoutPrefix) {
+				files[entryPath(header.Name)] = visibleEntry{header: header, layer: i, index: index}
+			}
+		}
+
+		if _, err := s.layer(layers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// resolvePath returns the path name is at in the filesystem once the symlinks
+// of its parent directories are followed, and the symlink it is itself if
+// follow is set. Symlinks can't lead out of the filesystem.
+func resolvePath(files map[string]visibleEntry, name string, follow bool) (string, error) {
+	resolved := "/"
+	rest := strings.Split(entryPath(name), "/")
+	links := 0
+
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		if part == "" {
+			continue
+		}
+
+		p := path.Join(resolved, part)
+		entry, ok := files[p]
+		if !ok {
+			return "", fmt.Errorf("%s: no such file or directory", name)
+		}
+
+		if entry.header.Typeflag == tar.TypeSymlink && (len(rest) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+			}
+
+			target := entry.header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+
+			rest = append(strings.Split(entryPath(target), "/"), rest...)
+			resolved = "/"
+			continue
+		}
+
+		resolved = p
+	}
+
+	return resolved, nil
+}
+
+// linkTarget returns the entry a hard link is to, or the entry itself if it is
+// not a hard link.
+func linkTarget(files map[string]visibleEntry, entry visibleEntry) (visibleEntry, error) {
+	if entry.header.Typeflag != tar.TypeLink {
+		return entry, nil
+	}
+
+	target, ok := files[entryPath(entry.header.Linkname)]
+	if !ok {
+		return entry, fmt.Errorf("%s: hard link to missing file %s", entryPath(entry.header.Name), entryPath(entry.header.Linkname))
+	}
+
+	return target, nil
+}
+
+// copyContent writes the content of the entry of the layer tarball to w.
+func copyContent(w io.Writer, fn string, index int) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+
+	for i := 0; ; i++ {
+		if _, err := tr.Next(); err != nil {
+			return err
+		}
+
+		if i == index {
+			_, err := io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+// Cat writes the content of the file at name in the filesystem the layer
+// tarballs, given oldest first, make up to w. Symlinks are followed. Only the
+// entry of the file is read from the layer which has it.
+func Cat(w io.Writer, layers []string, name string) error {
+	files, err := visibleEntries(layers)
+	if err != nil {
+		return err
+	}
+
+	p, err := resolvePath(files, name, true)
+	if err != nil {
+		return err
+	}
+
+	entry, ok := files[p]
+	if !ok {
+		return fmt.Errorf("%s is a directory", name)
+	}
+
+	entry, err = linkTarget(files, entry)
+	if err != nil {
+		return err
+	}
+
+	switch entry.header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return copyContent(w, layers[entry.layer], entry.index)
+	case tar.TypeDir:
+		return fmt.Errorf("%s is a directory", name)
+	default:
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+}
+
+// ExtractPath writes the file or directory at name in the filesystem the
+// layer tarballs, given oldest first, make up to w as a tarball, with no
+// whiteouts. The content of a directory is at the root of the tarball, and a
+// file is at the root by its name. Symlinks to name are followed, but not
+// those beneath it. A hard link to a file which is not extracted is written
+// as a copy of it.
+func ExtractPath(w io.Writer, layers []string, name string) error {
+	files, err := visibleEntries(layers)
+	if err != nil {
+		return err
+	}
+
+	root, err := resolvePath(files, name, true)
+	if err != nil {
+		return err
+	}
+
+	prefix := root
+	if entry, ok := files[root]; ok && entry.header.Typeflag != tar.TypeDir {
+		prefix = path.Dir(root)
+	}
+
+	// the path of an entry in the tarball, if it is extracted.
+	extracted := func(p string) (string, bool) {
+		if p != root && !strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+			return "", false
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, prefix), "/")
+		return rel, rel != ""
+	}
+
+	tw := tar.NewWriter(w)
+
+	for i, fn := range layers {
+		if err := extractEntries(tw, files, layers, i, fn, extracted); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func extractEntries(tw *tar.Writer, files map[string]visibleEntry, layers []string, layer int, fn string, extracted func(string) (string, bool)) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+
+	for i := 0; ; i++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := entryPath(header.Name)
+		if entry, ok := files[name]; !ok || entry.layer != layer || entry.index != i {
+			continue
+		}
+
+		rel, ok := extracted(name)
+		if !ok {
+			continue
+		}
+		header.Name = rel
+
+		if header.Typeflag == tar.TypeLink {
+			written, err := extractLink(tw, header, files, files[name], layers, extracted)
+			if err != nil {
+				return err
+			}
+
+			if written {
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractLink points the hard link of the entry to where its target is
+// extracted, or writes a copy of the target in its place. It returns true if
+// it wrote the entry.
+func extractLink(tw *tar.Writer, header *tar.Header, files map[string]visibleEntry, entry visibleEntry, layers []string, extracted func(string) (string, bool)) (bool, error) {
+	target, err := linkTarget(files, entry)
+	if err != nil {
+		return false, err
+	}
+
+	// the target is written first if it is extracted from this layer or an
+	// older one; otherwise the link becomes a copy of it.
+	if link, ok := extracted(entryPath(target.header.Name)); ok && target.layer <= entry.layer {
+		header.Linkname = link
+		return false, nil
+	}
+
+	header.Typeflag = tar.TypeReg
+	header.Linkname = ""
+	header.Size = target.header.Size
+
+	if err := tw.WriteHeader(header); err != nil {
+		return false, err
+	}
+
+	return true, copyContent(tw, layers[target.layer], target.index)
+}
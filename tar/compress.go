@@ -0,0 +1,156 @@
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compressions layers may be written with.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ValidCompression returns an error if layers can't be written with the
+// compression.
+func ValidCompression(compression string) error {
+	switch compression {
+	case Gzip, Zstd, Estargz:
+		return nil
+	default:
+		return fmt.Errorf("invalid compression %q: must be %s, %s or %s", compression, Gzip, Zstd, Estargz)
+	}
+}
+
+// Compress returns a writer which compresses what is written to it into w.
+// It must be closed to write the end of the stream. Streams are compressed
+// with gzip by workers blocks at once, or a block for each CPU if it is not
+// above 0; with 1, they are compressed whole, with compress/gzip. eStargz
+// layers are not streamed; see Stargz.
+func Compress(w io.Writer, compression string, workers int) (io.WriteCloser, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	switch compression {
+	case Gzip:
+		if workers > 1 {
+			return newGzipWriter(w, workers), nil
+		}
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Estargz:
+		return nil, fmt.Errorf("%s layers can only be written whole", Estargz)
+	default:
+		return nil, ValidCompression(compression)
+	}
+}
+
+// Digester compresses what is written to it into a writer, as Compress does,
+// and digests both what is written and what it is compressed into as it goes:
+// the diff ID and the digest of a layer, with no pass over either of its own.
+type Digester struct {
+	cw     io.WriteCloser
+	out    *countingWriter
+	diffID hash.Hash
+	digest hash.Hash
+}
+
+// NewDigester returns a digester compressing into w with the compression, by
+// workers blocks at once for gzip. It must be closed to write the end of the
+// stream before it is digested.
+func NewDigester(w io.Writer, compression string, workers int) (*Digester, error) {
+	d := &Digester{diffID: sha256.New(), digest: sha256.New()}
+	d.out = &countingWriter{w: io.MultiWriter(w, d.digest)}
+
+	cw, err := Compress(d.out, compression, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	d.cw = cw
+	return d, nil
+}
+
+func (d *Digester) Write(p []byte) (int, error) {
+	d.diffID.Write(p)
+	return d.cw.Write(p)
+}
+
+// Close writes the end of the compressed stream.
+func (d *Digester) Close() error {
+	return d.cw.Close()
+}
+
+// DiffID returns the digest of what was written, uncompressed.
+func (d *Digester) DiffID() string {
+	return fmt.Sprintf("sha256:%x", d.diffID.Sum(nil))
+}
+
+// Digest returns the digest of the compressed stream.
+func (d *Digester) Digest() string {
+	return fmt.Sprintf("sha256:%x", d.digest.Sum(nil))
+}
+
+// Size returns the size of the compressed stream.
+func (d *Digester) Size() int64 {
+	return d.out.n
+}
+
+// Compression returns the compression of the stream in r, from its first
+// bytes, or "" if it is neither gzip nor zstd. The bytes read are put back in
+// the reader returned.
+func Compression(r io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", br, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return Gzip, br, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return Zstd, br, nil
+	default:
+		return "", br, nil
+	}
+}
+
+// Decompress returns a reader of the stream in r decompressed, if it is
+// compressed with gzip or zstd. Other streams are read as they are.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	compression, r, err := Compression(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
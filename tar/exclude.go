@@ -0,0 +1,164 @@
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// excludedFile is a regular file left out of a layer, and where its content
+// is in the layer.
+type excludedFile struct {
+	size   int64
+	offset int64
+}
+
+// excludePatterns returns the patterns cleaned as fileutils expects them, with
+// paths relative to the root of the layer.
+func excludePatterns(patterns []string) ([]string, [][]string, error) {
+	relative := []string{}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			relative = append(relative, "!"+strings.TrimLeft(pattern[1:], "/"))
+		} else {
+			relative = append(relative, strings.TrimLeft(pattern, "/"))
+		}
+	}
+
+	cleaned, dirs, _, err := fileutils.CleanPatterns(relative)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, pattern := range cleaned {
+		if _, err := filepath.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+	}
+
+	return cleaned, dirs, nil
+}
+
+// ValidExclude returns an error if the patterns can't be given to Exclude.
+func ValidExclude(patterns []string) error {
+	_, _, err := excludePatterns(patterns)
+	return err
+}
+
+// Exclude writes the layer tarball in fn to w without the files matching the
+// patterns, in .dockerignore syntax, from the root of the layer. Everything
+// beneath a directory which matches is excluded with it. Whiteouts are kept.
+// A file excluded which is still hard linked to is written in place of the
+// first link to it.
+func Exclude(w io.Writer, fn string, patterns []string) error {
+	patterns, dirs, err := excludePatterns(patterns)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// see Normalize: the count is where the content of an entry starts.
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	tw := tar.NewWriter(w)
+
+	excluded := map[string]excludedFile{}
+	replaced := map[string]string{} // the links written in place of excluded files
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := entryPath(header.Name)
+
+		skip, err := excludeEntry(name, patterns, dirs)
+		if err != nil {
+			return err
+		}
+
+		if skip {
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+				excluded[name] = excludedFile{size: header.Size, offset: cr.n}
+			}
+			continue
+		}
+
+		if header.Typeflag == tar.TypeLink {
+			written, err := relink(tw, f, header, excluded, replaced)
+			if err != nil {
+				return err
+			}
+
+			if written {
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// excludeEntry is true if the entry of the name matches the patterns. The
+// root and whiteouts are never excluded.
+func excludeEntry(name string, patterns []string, dirs [][]string) (bool, error) {
+	if name == "/" || strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+		return false, nil
+	}
+
+	return fileutils.OptimizedMatches(strings.TrimPrefix(name, "/"), patterns, dirs)
+}
+
+// relink points the hard link to the file written in place of its target if
+// it was excluded, or writes the file of the first link to it, from the
+// layer tarball in f. It returns true if it wrote the entry.
+func relink(tw *tar.Writer, f io.ReaderAt, header *tar.Header, excluded map[string]excludedFile, replaced map[string]string) (bool, error) {
+	target := entryPath(header.Linkname)
+
+	if link, ok := replaced[target]; ok {
+		header.Linkname = link
+		return false, nil
+	}
+
+	file, ok := excluded[target]
+	if !ok {
+		return false, nil
+	}
+
+	header.Typeflag = tar.TypeReg
+	header.Linkname = ""
+	header.Size = file.size
+
+	if err := tw.WriteHeader(header); err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(tw, io.NewSectionReader(f, file.offset, file.size)); err != nil {
+		return false, err
+	}
+
+	replaced[target] = header.Name
+	return true, nil
+}
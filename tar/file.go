@@ -0,0 +1,39 @@
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// File produces a tarball containing a single file with the provided content
+// and mode, owned by root. The name is taken relative to the root of the
+// container. The modification time is zeroed so that identical content
+// always yields an identical tarball.
+func File(name string, mode int64, content []byte) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	err := tw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(name, "/"),
+		Mode:     mode,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+		Uname:    "root",
+		Gname:    "root",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tw.Write(content); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,115 @@
+package tar
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/box-builder/box/cache"
+)
+
+// staleAfter is how old an unreferenced file in the copy cache must be to be
+// removed. The archive a copy returns is in the copy cache, and is used by the
+// build for a while after the copy is done.
+const staleAfter = time.Hour
+
+// CollectCopyCache removes the files in the copy cache which are not the
+// archive or manifest of a copy, left behind by interrupted copies, and
+// returns them with their total size. With dryRun, nothing is removed.
+func CollectCopyCache(dryRun bool) ([]string, int64, error) {
+	dirs, err := ioutil.ReadDir(CopyCacheDir(""))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	removed := []string{}
+	var size int64
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		lock, err := cache.TryLock("copy:" + dir.Name())
+		if err != nil {
+			return removed, size, err
+		}
+
+		// a copy of the source is in progress.
+		if lock == nil {
+			continue
+		}
+
+		files, fileSize, err := collectCopyDir(CopyCacheDir(dir.Name()), dryRun)
+		lock.Release()
+
+		removed = append(removed, files...)
+		size += fileSize
+
+		if err != nil {
+			return removed, size, err
+		}
+	}
+
+	return removed, size, nil
+}
+
+// CopyCacheSize returns the size of the files in the copy cache.
+func CopyCacheSize() (int64, error) {
+	var size int64
+
+	err := filepath.Walk(CopyCacheDir(""), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func collectCopyDir(dir string, dryRun bool) ([]string, int64, error) {
+	keep := map[string]bool{"manifest.json": true}
+
+	m := &manifest{}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json")); err == nil && json.Unmarshal(content, m) == nil {
+		keep[m.Archive] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	removed := []string{}
+	var size int64
+
+	for _, fi := range files {
+		if keep[fi.Name()] || time.Since(fi.ModTime()) < staleAfter {
+			continue
+		}
+
+		fn := filepath.Join(dir, fi.Name())
+		if !dryRun {
+			if err := os.RemoveAll(fn); err != nil {
+				return removed, size, err
+			}
+		}
+
+		removed = append(removed, fn)
+		size += fi.Size()
+	}
+
+	return removed, size, nil
+}
@@ -0,0 +1,287 @@
+package tar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/pkg/system"
+)
+
+// CopyCacheDir returns the directory the archive and manifest for a copy are
+// kept in. The copy cache may be removed at any time; the next copy of each
+// source reads all of its files again.
+func CopyCacheDir(id string) string {
+	return util.BoxDir("copy-cache", id)
+}
+
+// manifest records the files in an archive: where each is in the archive,
+// and the fingerprint of the file it was read from.
+type manifest struct {
+	Archive string
+	Order   []string
+	Entries map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	// Fingerprint identifies the state of the file: its inode, size, and
+	// modification and change times. It is empty for files which can't be
+	// re-used, like hard links, whose entry depends on the other files.
+	Fingerprint string
+	Offset      int64
+	Length      int64
+	Sum         string // the entry's line of the archive's sum, see SumContent
+}
+
+// loadManifest loads the manifest of the last archive in dir, and opens the
+// archive. If there is no usable last archive, the manifest is empty.
+func loadManifest(dir string) (*manifest, *os.File) {
+	m := &manifest{Entries: map[string]manifestEntry{}}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return m, nil
+	}
+
+	last := &manifest{}
+	if err := json.Unmarshal(content, last); err != nil || last.Entries == nil {
+		return m, nil
+	}
+
+	f, err := os.Open(filepath.Join(dir, last.Archive))
+	if err != nil {
+		return m, nil
+	}
+
+	return last, f
+}
+
+// save saves the manifest of the archive, and keeps the archive in the copy
+// cache for the next copy.
+func (m *manifest) save(dir, archive string) error {
+	m.Archive = "archive.tar"
+
+	// the archive is returned to the caller, who removes it when it is done, so
+	// the copy cache keeps a link to it.
+	tmp := filepath.Join(dir, "archive.tar.tmp")
+	os.Remove(tmp)
+	if err := os.Link(archive, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, m.Archive)); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json.tmp"), content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(dir, "manifest.json.tmp"), filepath.Join(dir, "manifest.json"))
+}
+
+// sum returns the sum of the archive's content.
+func (m *manifest) sum() string {
+	hash := sha256.New()
+	for _, rel := range m.Order {
+		io.WriteString(hash, m.Entries[rel].Sum)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// countingWriter counts the bytes written through it, so the manifest knows
+// where each entry is in the archive.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// archiver writes the archive of a copy, one entry at a time.
+type archiver struct {
+	source  string
+	target  string
+	dir     bool                // whether the source is a directory, or a single file
+	signals *signal.Cancellable // if set, the archive being written is removed by it on interrupt
+	logger  *logger.Logger
+
+	out         *countingWriter
+	manifest    *manifest
+	last        *manifest
+	lastArchive *os.File
+	reused      int
+	cloned      int64             // the bytes of the last archive cloned into this one
+	noReflink   bool              // whether cloning failed, so the rest is copied
+	seen        map[uint64]string // the first name of each hard linked inode
+}
+
+// id identifies the copy: its source, target and the files selected from the
+// source. Each copy is kept separately in the copy cache.
+func (a *archiver) id(includes, excludes []string) (string, error) {
+	abs, err := filepath.Abs(a.source)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal([]interface{}{abs, a.target, a.dir, includes, excludes})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fingerprint(fi os.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || (!fi.IsDir() && st.Nlink > 1) {
+		return ""
+	}
+
+	return fmt.Sprintf("%d:%d %d %d.%d %d.%d %o", st.Dev, st.Ino, st.Size, st.Mtim.Sec, st.Mtim.Nsec, st.Ctim.Sec, st.Ctim.Nsec, st.Mode)
+}
+
+// sumLine returns the line of an entry in the sum of an archive.
+func sumLine(header *tar.Header, dataSum string) string {
+	return fmt.Sprintf("%q %q %c %o %d %d %d %s\n", header.Name, header.Linkname, header.Typeflag, header.Mode, header.Uid, header.Gid, header.Size, dataSum)
+}
+
+// add adds the file at path to the archive, as rel beneath the target. If the
+// file has not changed since the last archive, its entry there is copied.
+func (a *archiver) add(filePath, rel string, fi os.FileInfo) error {
+	entry := manifestEntry{Fingerprint: fingerprint(fi), Offset: a.out.n}
+
+	if last, ok := a.last.Entries[rel]; ok && a.lastArchive != nil && entry.Fingerprint != "" && last.Fingerprint == entry.Fingerprint {
+		if err := a.copyRange(last.Offset, last.Length); err != nil {
+			return err
+		}
+
+		entry.Length = last.Length
+		entry.Sum = last.Sum
+		a.reused++
+		a.record(rel, entry)
+		return nil
+	}
+
+	header, err := a.header(filePath, rel, fi)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(a.out)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+
+	if header.Typeflag == tar.TypeReg && header.Size > 0 {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+
+		err = copy.WithProgress(tw, io.TeeReader(f, hash), a.logger, fmt.Sprintf("%s -> %s", filePath, header.Name))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// pads the entry to the tar block size, so the next entry starts on its
+	// own.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	entry.Length = a.out.n - entry.Offset
+	entry.Sum = sumLine(header, hex.EncodeToString(hash.Sum(nil)))
+	a.record(rel, entry)
+
+	return nil
+}
+
+func (a *archiver) record(rel string, entry manifestEntry) {
+	a.manifest.Order = append(a.manifest.Order, rel)
+	a.manifest.Entries[rel] = entry
+}
+
+// header returns the tar header of the file, named for the target. It is
+// built the way docker builds headers for a build context.
+func (a *archiver) header(filePath, rel string, fi os.FileInfo) (*tar.Header, error) {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(filePath); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Name = filepath.ToSlash(rel)
+	if fi.IsDir() && !strings.HasSuffix(header.Name, "/") {
+		header.Name += "/"
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if fi.Mode()&os.ModeDevice != 0 {
+			rdev := uint64(st.Rdev)
+			header.Devmajor = int64((rdev >> 8) & 0xfff)
+			header.Devminor = int64((rdev & 0xff) | ((rdev >> 12) & 0xfff00))
+		}
+
+		// the first name of a hard linked file holds its content; the others
+		// link to it.
+		if !fi.IsDir() && st.Nlink > 1 {
+			if first, ok := a.seen[st.Ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				a.seen[st.Ino] = header.Name
+			}
+		}
+	}
+
+	if capability, _ := system.Lgetxattr(filePath, "security.capability"); capability != nil {
+		header.Xattrs = map[string]string{"security.capability": string(capability)}
+	}
+
+	if a.dir || strings.HasSuffix(a.target, "/") {
+		header.Linkname = path.Join(a.target, header.Linkname)
+		header.Name = path.Join(a.target, header.Name)
+	} else {
+		header.Linkname = a.target
+		header.Name = a.target
+	}
+
+	return header, nil
+}
@@ -0,0 +1,167 @@
+package tar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Entry is a file of the filesystem layers make up.
+type Entry struct {
+	Path     string
+	Typeflag byte
+	Mode     int64
+	Uid      int
+	Gid      int
+	Size     int64
+	Linkname string
+	Sum      string // the sha256 of the content of a regular file
+}
+
+func (e *Entry) changed(other *Entry) bool {
+	return e.Typeflag != other.Typeflag || e.Mode != other.Mode || e.Uid != other.Uid || e.Gid != other.Gid ||
+		e.Linkname != other.Linkname || e.Sum != other.Sum
+}
+
+// Index returns the files of the filesystem the layer tarballs, given oldest
+// first, make up when they are applied, by path.
+func Index(layers []string) (map[string]*Entry, error) {
+	files := map[string]*Entry{}
+
+	for _, fn := range layers {
+		if err := indexLayer(files, fn); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// removeTree removes the path and everything beneath it, or only what is
+// beneath it.
+func removeTree(files map[string]*Entry, name string, self bool) {
+	if self {
+		delete(files, name)
+	}
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range files {
+		if strings.HasPrefix(p, prefix) {
+			delete(files, p)
+		}
+	}
+}
+
+func indexLayer(files map[string]*Entry, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	added := []*Entry{}
+	removed := []string{}
+	opaque := []string{}
+
+	tr := tar.NewReader(f)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := entryPath(header.Name)
+		base := path.Base(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			opaque = append(opaque, path.Dir(name))
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removed = append(removed, path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		file := &Entry{
+			Path:     name,
+			Typeflag: header.Typeflag,
+			Mode:     header.Mode,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			Size:     header.Size,
+			Linkname: header.Linkname,
+		}
+
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			file.Typeflag = tar.TypeReg
+
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tr); err != nil {
+				return err
+			}
+			file.Sum = hex.EncodeToString(hash.Sum(nil))
+		}
+
+		added = append(added, file)
+	}
+
+	// whiteouts only remove the files of older layers, so they are applied
+	// before the files of the layer are added.
+	for _, name := range removed {
+		removeTree(files, name, true)
+	}
+
+	for _, dir := range opaque {
+		removeTree(files, dir, false)
+	}
+
+	for _, file := range added {
+		if file.Typeflag != tar.TypeDir {
+			removeTree(files, file.Path, false)
+		}
+		files[file.Path] = file
+	}
+
+	return nil
+}
+
+// Change is a difference between two filesystems.
+type Change struct {
+	Kind string // A if the file was added, D if deleted, M if modified
+	Path string
+	Old  *Entry // nil if the file was added
+	New  *Entry // nil if the file was deleted
+}
+
+// Diff returns the changes from the filesystem old to the filesystem new, as
+// returned by Index, sorted by path. Modification times are not compared, so
+// only files whose content, type, mode or owner changed are modified.
+func Diff(old, new map[string]*Entry) []Change {
+	changes := []Change{}
+
+	for p, file := range old {
+		if other, ok := new[p]; !ok {
+			changes = append(changes, Change{Kind: "D", Path: p, Old: file})
+		} else if file.changed(other) {
+			changes = append(changes, Change{Kind: "M", Path: p, Old: file, New: other})
+		}
+	}
+
+	for p, file := range new {
+		if _, ok := old[p]; !ok {
+			changes = append(changes, Change{Kind: "A", Path: p, New: file})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	return changes
+}
@@ -0,0 +1,165 @@
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// normalEntry is an entry of a layer being normalized, and where its content
+// is in the layer.
+type normalEntry struct {
+	header *tar.Header
+	name   string
+	offset int64
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Normalize writes the layer tarball in fn to w with what differs between two
+// builds of the same files removed: every time is modTime, user and group
+// names are dropped in favor of their IDs, and PAX records other than extended
+// attributes are dropped. Entries are sorted by path, with hard links last so
+// their targets come before them.
+func Normalize(w io.Writer, fn string, modTime time.Time) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the tar reader reads no further than the headers of an entry, so the
+	// count is where its content starts.
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	entries := []normalEntry{}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		entries = append(entries, normalEntry{header: header, name: path.Clean("/" + header.Name), offset: cr.n})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		iLink, jLink := entries[i].header.Typeflag == tar.TypeLink, entries[j].header.Typeflag == tar.TypeLink
+		if iLink != jLink {
+			return jLink
+		}
+
+		return entries[i].name < entries[j].name
+	})
+
+	tw := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		header := entry.header
+
+		normal := &tar.Header{
+			Typeflag: header.Typeflag,
+			Name:     header.Name,
+			Linkname: header.Linkname,
+			Size:     header.Size,
+			Mode:     header.Mode,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			ModTime:  modTime,
+			Devmajor: header.Devmajor,
+			Devminor: header.Devminor,
+			Format:   tar.FormatPAX,
+		}
+
+		if normal.Typeflag == tar.TypeRegA {
+			normal.Typeflag = tar.TypeReg
+		}
+
+		// only regular files have content.
+		if normal.Typeflag != tar.TypeReg {
+			normal.Size = 0
+		}
+
+		for key, value := range header.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.") {
+				if normal.PAXRecords == nil {
+					normal.PAXRecords = map[string]string{}
+				}
+				normal.PAXRecords[key] = value
+			}
+		}
+
+		if err := tw.WriteHeader(normal); err != nil {
+			return err
+		}
+
+		if normal.Size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(f, entry.offset, normal.Size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// ClampTimes writes the layer tarball in fn to w with no time later than max:
+// the modification, access and change times of its entries which are later
+// are max. It is otherwise written as it is.
+func ClampTimes(w io.Writer, fn string, max time.Time) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	tw := tar.NewWriter(w)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		header.ModTime = clampTime(header.ModTime, max)
+		header.AccessTime = clampTime(header.AccessTime, max)
+		header.ChangeTime = clampTime(header.ChangeTime, max)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func clampTime(t, max time.Time) time.Time {
+	if t.After(max) {
+		return max
+	}
+
+	return t
+}
@@ -0,0 +1,170 @@
+package tar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// gzipBlockSize is the size of the blocks streams are split into to be
+// compressed with gzip in parallel.
+const gzipBlockSize = 1 << 20
+
+// gzipDictSize is the size of the window of deflate. Each block is compressed
+// with the end of the block before it as its dictionary, so streams compressed
+// in parallel are about as small as those compressed whole.
+const gzipDictSize = 32 << 10
+
+// gzipHeader is the header of the gzip streams written: no name, time or
+// comment, from an unknown OS, as compress/gzip writes it.
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+
+// gzipBlock is a block being compressed.
+type gzipBlock struct {
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// gzipWriter compresses what is written to it with gzip, in blocks which are
+// compressed in parallel and written out in order. Each block but the last
+// ends with a sync flush, so they form a single deflate stream which any gzip
+// reader reads.
+type gzipWriter struct {
+	w       io.Writer
+	workers int
+	buf     []byte
+	dict    []byte
+	crc     uint32
+	size    uint32 // the size of what was written, modulo 2^32 as gzip has it
+	pending []*gzipBlock
+	header  bool
+	closed  bool
+	err     error
+}
+
+func newGzipWriter(w io.Writer, workers int) *gzipWriter {
+	return &gzipWriter{w: w, workers: workers, buf: make([]byte, 0, gzipBlockSize)}
+}
+
+func (z *gzipWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+
+	for n := 0; n < len(p); {
+		take := gzipBlockSize - len(z.buf)
+		if take > len(p)-n {
+			take = len(p) - n
+		}
+
+		z.buf = append(z.buf, p[n:n+take]...)
+		n += take
+
+		if len(z.buf) == gzipBlockSize {
+			if err := z.compress(false); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+// compress starts compressing the block buffered, and writes the blocks done
+// until fewer than workers are being compressed, or all of them if it is the
+// last.
+func (z *gzipWriter) compress(last bool) error {
+	input, dict := z.buf, z.dict
+
+	next := append(append([]byte{}, dict...), input...)
+	if len(next) > gzipDictSize {
+		next = next[len(next)-gzipDictSize:]
+	}
+	z.dict = next
+	z.buf = make([]byte, 0, gzipBlockSize)
+
+	block := &gzipBlock{done: make(chan struct{})}
+	z.pending = append(z.pending, block)
+
+	go func() {
+		defer close(block.done)
+
+		fw, err := flate.NewWriterDict(&block.out, flate.DefaultCompression, dict)
+		if err != nil {
+			block.err = err
+			return
+		}
+
+		if _, err := fw.Write(input); err != nil {
+			block.err = err
+			return
+		}
+
+		if last {
+			block.err = fw.Close()
+		} else {
+			block.err = fw.Flush()
+		}
+	}()
+
+	for len(z.pending) >= z.workers || (last && len(z.pending) > 0) {
+		if err := z.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBlock waits for the oldest block being compressed and writes it out,
+// after the header if it is the first.
+func (z *gzipWriter) writeBlock() error {
+	block := z.pending[0]
+	z.pending = z.pending[1:]
+	<-block.done
+
+	if block.err != nil {
+		z.err = block.err
+		return z.err
+	}
+
+	if !z.header {
+		z.header = true
+		if _, z.err = z.w.Write(gzipHeader); z.err != nil {
+			return z.err
+		}
+	}
+
+	_, z.err = z.w.Write(block.out.Bytes())
+	return z.err
+}
+
+// Close compresses what is left and writes the end of the stream. It does not
+// close the writer underneath.
+func (z *gzipWriter) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+
+	if z.err != nil {
+		return z.err
+	}
+
+	if err := z.compress(true); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+
+	_, z.err = z.w.Write(trailer)
+	return z.err
+}
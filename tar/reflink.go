@@ -0,0 +1,58 @@
+package tar
+
+import (
+	"io"
+	"os"
+)
+
+// reflinkBlockSize is the size of the blocks ranges of files are cloned in.
+// Clones must start and end on blocks of the filesystem; filesystems with
+// larger blocks refuse them, and the ranges are copied instead.
+const reflinkBlockSize = 4096
+
+// cloneRange clones the range of src into dst at dstOffset, so both share its
+// blocks until one of them is written, on filesystems with reflinks such as
+// btrfs and XFS. The offsets and length must be multiples of
+// reflinkBlockSize.
+var cloneRange = cloneFileRange
+
+// copyRange appends the range of the last archive to the archive. The blocks
+// of the range which line up with those of the archive are cloned where the
+// filesystem allows it, so the files the copy has not changed take no more
+// room on disk in the new archive; the rest is copied.
+func (a *archiver) copyRange(offset, length int64) error {
+	f, ok := a.out.w.(*os.File)
+	if !ok || a.noReflink {
+		return a.copySection(offset, length)
+	}
+
+	// the range up to the first block of the archive is copied.
+	head := (reflinkBlockSize - a.out.n%reflinkBlockSize) % reflinkBlockSize
+	if (offset+head)%reflinkBlockSize != 0 || length-head < reflinkBlockSize {
+		return a.copySection(offset, length)
+	}
+
+	if err := a.copySection(offset, head); err != nil {
+		return err
+	}
+
+	body := (length - head) / reflinkBlockSize * reflinkBlockSize
+	if err := cloneRange(f, a.out.n, a.lastArchive, offset+head, body); err != nil {
+		// the filesystem has no reflinks, or not across these files.
+		a.noReflink = true
+		return a.copySection(offset+head, length-head)
+	}
+
+	a.out.n += body
+	a.cloned += body
+	if _, err := f.Seek(a.out.n, io.SeekStart); err != nil {
+		return err
+	}
+
+	return a.copySection(offset+head+body, length-head-body)
+}
+
+func (a *archiver) copySection(offset, length int64) error {
+	_, err := io.Copy(a.out, io.NewSectionReader(a.lastArchive, offset, length))
+	return err
+}
@@ -0,0 +1,34 @@
+package tar
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ficloneRange is the FICLONERANGE ioctl.
+const ficloneRange = 0x4020940d
+
+// fileCloneRange is the argument of FICLONERANGE.
+type fileCloneRange struct {
+	srcFd      int64
+	srcOffset  uint64
+	srcLength  uint64
+	destOffset uint64
+}
+
+func cloneFileRange(dst *os.File, dstOffset int64, src *os.File, srcOffset, length int64) error {
+	arg := fileCloneRange{
+		srcFd:      int64(src.Fd()),
+		srcOffset:  uint64(srcOffset),
+		srcLength:  uint64(length),
+		destOffset: uint64(dstOffset),
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), ficloneRange, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package tar
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoReflink = errors.New("reflinks are only supported on linux")
+
+func cloneFileRange(dst *os.File, dstOffset int64, src *os.File, srcOffset, length int64) error {
+	return errNoReflink
+}
@@ -0,0 +1,179 @@
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// squasher decides which entries of a range of layers are kept when they are
+// merged into one. Layers are visited newest first; an entry is dropped when a
+// newer layer replaced or removed it.
+type squasher struct {
+	seen    map[string]bool // paths a newer layer has an entry for
+	removed map[string]bool // paths, and everything beneath them, a newer layer removed or replaced with a file
+	opaque  map[string]bool // directories a newer layer made opaque
+
+	visit func(header *tar.Header, i int) // if set, called with the entries kept and their index
+}
+
+func entryPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (s *squasher) hidden(name string) bool {
+	if s.seen[name] {
+		return true
+	}
+
+	for dir := name; dir != "/"; dir = path.Dir(dir) {
+		if s.removed[dir] || (dir != name && s.opaque[dir]) {
+			return true
+		}
+	}
+
+	return s.opaque["/"] && name != "/"
+}
+
+// layer returns which entries of the layer to keep, in order.
+func (s *squasher) layer(fn string) ([]bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keep := []bool{}
+	removed := []string{}
+	opaque := []string{}
+
+	tr := tar.NewReader(f)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := entryPath(header.Name)
+		if s.hidden(name) {
+			keep = append(keep, false)
+			continue
+		}
+
+		if s.visit != nil {
+			s.visit(header, len(keep))
+		}
+
+		keep = append(keep, true)
+		s.seen[name] = true
+
+		// whiteouts and replaced files only hide the entries of older layers, so
+		// they take effect once the whole layer is read.
+		base := path.Base(name)
+		switch {
+		case base == whiteoutOpaque:
+			opaque = append(opaque, path.Dir(name))
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removed = append(removed, path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+		case header.Typeflag != tar.TypeDir:
+			removed = append(removed, name)
+		}
+	}
+
+	for _, name := range removed {
+		s.removed[name] = true
+	}
+
+	for _, name := range opaque {
+		s.opaque[name] = true
+	}
+
+	return keep, nil
+}
+
+// Squash merges layer tarballs, given oldest first, into one layer written to
+// w. Files replaced or removed by a later layer are left out. Whiteouts are
+// kept, so the merged layer still removes the files of the layers beneath
+// it. Entries are written in the order of the layers, so a file removed and
+// then added again is removed first when the merged layer is applied.
+func Squash(w io.Writer, layers []string) error {
+	return squash(w, layers, true)
+}
+
+// Export writes the filesystem the layer tarballs, given oldest first, make up
+// to w as one tarball, with no whiteouts: only the files left once every
+// layer is applied.
+func Export(w io.Writer, layers []string) error {
+	return squash(w, layers, false)
+}
+
+func squash(w io.Writer, layers []string, whiteouts bool) error {
+	s := &squasher{
+		seen:    map[string]bool{},
+		removed: map[string]bool{},
+		opaque:  map[string]bool{},
+	}
+
+	keep := make([][]bool, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		var err error
+		if keep[i], err = s.layer(layers[i]); err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+
+	for i, fn := range layers {
+		if err := copyEntries(tw, fn, keep[i], whiteouts); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func copyEntries(tw *tar.Writer, fn string, keep []bool, whiteouts bool) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+
+	for i := 0; ; i++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if i >= len(keep) || !keep[i] {
+			continue
+		}
+
+		if !whiteouts && strings.HasPrefix(path.Base(header.Name), whiteoutPrefix) {
+			continue
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
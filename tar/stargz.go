@@ -0,0 +1,263 @@
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Estargz is the compression of eStargz layers: gzip, with each file in a
+// gzip stream of its own and a table of contents at the end, so snapshotters
+// which pull lazily can fetch single files before the layer is downloaded.
+const Estargz = "estargz"
+
+// The annotations of eStargz layer descriptors.
+const (
+	StargzTOCDigestAnnotation        = "containerd.io/snapshot/stargz/toc.digest"
+	StargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+)
+
+const (
+	stargzTOCName            = "stargz.index.json"
+	stargzNoPrefetchLandmark = ".no.prefetch.landmark"
+	stargzLandmarkContent    = 0xf
+	stargzFooterSize         = 51
+)
+
+// StargzLayer describes a layer written by Stargz.
+type StargzLayer struct {
+	TOCDigest string // the digest of the table of contents
+	DiffID    string // the digest of the uncompressed layer
+	Size      int64  // the size of the uncompressed layer
+}
+
+type stargzTOC struct {
+	Version int            `json:"version"`
+	Entries []*stargzEntry `json:"entries"`
+}
+
+type stargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+var stargzTypes = map[byte]string{
+	tar.TypeDir:     "dir",
+	tar.TypeReg:     "reg",
+	tar.TypeRegA:    "reg",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// stargzWriter writes the tarball to the current gzip stream, starting a new
+// one when there is none, and hashes and counts it uncompressed.
+type stargzWriter struct {
+	cw   *countingWriter
+	gz   *gzip.Writer
+	diff hash.Hash
+	n    int64
+}
+
+func (s *stargzWriter) Write(p []byte) (int, error) {
+	if s.gz == nil {
+		s.gz = gzip.NewWriter(s.cw)
+	}
+
+	s.diff.Write(p)
+	s.n += int64(len(p))
+	return s.gz.Write(p)
+}
+
+func (s *stargzWriter) closeGz() error {
+	if s.gz == nil {
+		return nil
+	}
+
+	err := s.gz.Close()
+	s.gz = nil
+	return err
+}
+
+// Stargz writes the layer tarball read from r to w as an eStargz layer. The
+// layer has the same files, but its uncompressed content, and so its diff ID,
+// is not the same as the tarball's.
+func Stargz(w io.Writer, r io.Reader) (StargzLayer, error) {
+	sw := &stargzWriter{cw: &countingWriter{w: w}, diff: sha256.New()}
+	tw := tar.NewWriter(sw)
+	toc := &stargzTOC{Version: 1}
+
+	// without files to prefetch, the landmark tells snapshotters not to.
+	landmark := &tar.Header{Name: stargzNoPrefetchLandmark, Typeflag: tar.TypeReg, Mode: 0644, Size: 1}
+	if err := addStargzEntry(tw, sw, toc, landmark, bytes.NewReader([]byte{stargzLandmarkContent})); err != nil {
+		return StargzLayer{}, err
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return StargzLayer{}, err
+		}
+
+		if err := addStargzEntry(tw, sw, toc, header, tr); err != nil {
+			return StargzLayer{}, err
+		}
+	}
+
+	// the tarball is not closed; the table of contents ends it.
+	if err := tw.Flush(); err != nil {
+		return StargzLayer{}, err
+	}
+
+	if err := sw.closeGz(); err != nil {
+		return StargzLayer{}, err
+	}
+
+	tocOffset := sw.cw.n
+
+	content, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return StargzLayer{}, err
+	}
+
+	tw = tar.NewWriter(sw)
+	if err := tw.WriteHeader(&tar.Header{Name: stargzTOCName, Typeflag: tar.TypeReg, Size: int64(len(content))}); err != nil {
+		return StargzLayer{}, err
+	}
+
+	if _, err := tw.Write(content); err != nil {
+		return StargzLayer{}, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return StargzLayer{}, err
+	}
+
+	if err := sw.closeGz(); err != nil {
+		return StargzLayer{}, err
+	}
+
+	uncompressed := sw.diff.Sum(nil)
+
+	if _, err := sw.cw.Write(stargzFooter(tocOffset)); err != nil {
+		return StargzLayer{}, err
+	}
+
+	return StargzLayer{
+		TOCDigest: fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		DiffID:    fmt.Sprintf("sha256:%x", uncompressed),
+		Size:      sw.n,
+	}, nil
+}
+
+// addStargzEntry writes the entry, with the content of a regular file in a
+// gzip stream of its own, and adds it to the table of contents.
+func addStargzEntry(tw *tar.Writer, sw *stargzWriter, toc *stargzTOC, header *tar.Header, content io.Reader) error {
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	typ, ok := stargzTypes[header.Typeflag]
+	name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+
+	if !ok || name == "" {
+		_, err := io.Copy(tw, content)
+		return err
+	}
+
+	entry := &stargzEntry{
+		Name:     name,
+		Type:     typ,
+		Mode:     header.Mode,
+		UID:      header.Uid,
+		GID:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		LinkName: header.Linkname,
+		DevMajor: header.Devmajor,
+		DevMinor: header.Devminor,
+	}
+
+	if !header.ModTime.IsZero() {
+		entry.ModTime = header.ModTime.UTC().Format(time.RFC3339)
+	}
+
+	if header.Typeflag == tar.TypeLink {
+		entry.LinkName = strings.TrimPrefix(path.Clean("/"+header.Linkname), "/")
+	}
+
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			if entry.Xattrs == nil {
+				entry.Xattrs = map[string][]byte{}
+			}
+			entry.Xattrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = []byte(value)
+		}
+	}
+
+	if typ == "reg" && header.Size > 0 {
+		entry.Size = header.Size
+
+		if err := sw.closeGz(); err != nil {
+			return err
+		}
+		entry.Offset = sw.cw.n
+
+		hash := sha256.New()
+		if _, err := io.Copy(tw, io.TeeReader(content, hash)); err != nil {
+			return err
+		}
+
+		entry.Digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+		entry.ChunkDigest = entry.Digest
+	}
+
+	toc.Entries = append(toc.Entries, entry)
+
+	return nil
+}
+
+// stargzFooter returns the footer of an eStargz layer: an empty gzip stream
+// whose extra field holds the offset of the table of contents. It is written
+// by hand, as readers expect it to be exactly stargzFooterSize bytes: the
+// empty stream is a stored deflate block, which compress/gzip does not write.
+func stargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+
+	footer := make([]byte, 0, stargzFooterSize)
+	footer = append(footer, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff) // magic, deflate, FEXTRA, no mtime, unknown OS
+	footer = append(footer, byte(4+len(subfield)), 0, 'S', 'G', byte(len(subfield)), 0)
+	footer = append(footer, subfield...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)    // an empty, final, stored block
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0) // the crc32 and size of nothing
+
+	return footer
+}
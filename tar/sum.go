@@ -1,6 +1,7 @@
 package tar
 
 import (
+	"archive/tar"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
@@ -51,3 +52,33 @@ func SumWithCopy(writer io.WriteCloser, reader io.Reader, logger *logger.Logger,
 
 	return sum, nil
 }
+
+// SumContent sums the content of a tar stream: the name, link target, type,
+// mode, ownership and data of each entry. Unlike SumReader, the timestamps of
+// the entries do not affect the sum, so re-creating or touching a file without
+// changing it yields the same sum.
+//
+// Each entry is summed on its own, and the sum is of the entries' sums, so an
+// archive can be summed from the sums of the entries it re-uses from another.
+func SumContent(reader io.Reader) (string, error) {
+	hash := sha256.New()
+	tr := tar.NewReader(reader)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		dataSum, err := SumReader(tr)
+		if err != nil {
+			return "", err
+		}
+
+		io.WriteString(hash, sumLine(header, dataSum))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
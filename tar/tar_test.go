@@ -2,14 +2,22 @@ package tar
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	. "testing"
+	"time"
 
 	"github.com/box-builder/box/logger"
 
@@ -18,7 +26,9 @@ import (
 	. "gopkg.in/check.v1"
 )
 
-type tarSuite struct{}
+type tarSuite struct {
+	home string
+}
 
 var log = logger.New("", false)
 
@@ -28,8 +38,18 @@ func TestTar(t *T) {
 	TestingT(t)
 }
 
+func (ts *tarSuite) SetUpSuite(c *C) {
+	// the copy cache is kept beneath BOX_HOME.
+	ts.home = c.MkDir()
+	os.Setenv("BOX_HOME", ts.home)
+}
+
+func (ts *tarSuite) TearDownSuite(c *C) {
+	os.Unsetenv("BOX_HOME")
+}
+
 func (ts *tarSuite) TestArchive(c *C) {
-	tarball, sum, err := Archive(context.Background(), ".", "/", []string{}, log)
+	tarball, sum, err := Archive(context.Background(), ".", "/", []string{}, nil, log)
 	c.Assert(err, IsNil)
 	c.Assert(sum, Not(Equals), "")
 	c.Assert(tarball, Not(Equals), "")
@@ -51,6 +71,222 @@ func (ts *tarSuite) TestArchive(c *C) {
 	}
 }
 
+func (ts *tarSuite) TestArchiveSum(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test")
+	c.Assert(ioutil.WriteFile(fn, []byte("one"), 0644), IsNil)
+
+	sum := func() string {
+		tarball, sum, err := Archive(context.Background(), dir, "/test", []string{}, nil, log)
+		c.Assert(err, IsNil)
+		os.Remove(tarball)
+		return sum
+	}
+
+	first := sum()
+
+	// touching the file does not change the sum
+	past := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(fn, past, past), IsNil)
+	c.Assert(sum(), Equals, first)
+
+	c.Assert(ioutil.WriteFile(fn, []byte("two"), 0644), IsNil)
+	c.Assert(sum(), Not(Equals), first)
+
+	c.Assert(ioutil.WriteFile(fn, []byte("one"), 0600), IsNil)
+	c.Assert(os.Chmod(fn, 0600), IsNil)
+	c.Assert(sum(), Not(Equals), first)
+}
+
+func (ts *tarSuite) TestArchiveIncremental(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.Mkdir(filepath.Join(dir, "sub"), 0755), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "sub", fmt.Sprintf("file%d", i)), []byte(strings.Repeat("x", i*1000)), 0644), IsNil)
+	}
+
+	archive := func() (string, map[string]string) {
+		tarball, sum, err := Archive(context.Background(), dir, "/target", []string{}, nil, log)
+		c.Assert(err, IsNil)
+		defer os.Remove(tarball)
+
+		f, err := os.Open(tarball)
+		c.Assert(err, IsNil)
+		defer f.Close()
+
+		// the sum of a re-used archive is the sum of its content.
+		content, err := SumContent(f)
+		c.Assert(err, IsNil)
+		c.Assert(content, Equals, sum)
+
+		_, err = f.Seek(0, io.SeekStart)
+		c.Assert(err, IsNil)
+
+		files := map[string]string{}
+		tr := tar.NewReader(f)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+
+			data, err := ioutil.ReadAll(tr)
+			c.Assert(err, IsNil)
+			files[header.Name] = string(data)
+		}
+
+		return sum, files
+	}
+
+	first, files := archive()
+	c.Assert(files, HasLen, 11)
+	c.Assert(files["/target/sub/file3"], Equals, strings.Repeat("x", 3000))
+
+	second, files := archive()
+	c.Assert(second, Equals, first)
+	c.Assert(files, HasLen, 11)
+
+	// with no file changed, the last archive itself is returned.
+	tarball, sum, err := Archive(context.Background(), dir, "/target", []string{}, nil, log)
+	c.Assert(err, IsNil)
+	c.Assert(sum, Equals, first)
+	fi, err := os.Stat(tarball)
+	c.Assert(err, IsNil)
+	cached, err := os.Stat(filepath.Join(filepath.Dir(tarball), "archive.tar"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(fi, cached), Equals, true)
+	c.Assert(os.Remove(tarball), IsNil)
+	_, err = os.Stat(filepath.Join(filepath.Dir(tarball), "archive.tar"))
+	c.Assert(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "sub", "file3"), []byte("changed"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "sub", "new"), []byte("new"), 0644), IsNil)
+	c.Assert(os.Remove(filepath.Join(dir, "sub", "file5")), IsNil)
+
+	third, files := archive()
+	c.Assert(third, Not(Equals), first)
+	c.Assert(files, HasLen, 11)
+	c.Assert(files["/target/sub/file3"], Equals, "changed")
+	c.Assert(files["/target/sub/new"], Equals, "new")
+	c.Assert(files["/target/sub/file4"], Equals, strings.Repeat("x", 4000))
+	_, ok := files["/target/sub/file5"]
+	c.Assert(ok, Equals, false)
+
+	// without the copy cache, the archive is the same.
+	c.Assert(os.RemoveAll(filepath.Join(ts.home, "copy-cache")), IsNil)
+	fourth, _ := archive()
+	c.Assert(fourth, Equals, third)
+}
+
+func (ts *tarSuite) TestArchiveReflink(c *C) {
+	defer func(clone func(*os.File, int64, *os.File, int64, int64) error) { cloneRange = clone }(cloneRange)
+
+	dir := c.MkDir()
+	for i := 0; i < 4; i++ {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), bytes.Repeat([]byte{byte('a' + i)}, 10000+i*3000), 0644), IsNil)
+	}
+
+	archive := func() (string, []byte) {
+		tarball, sum, err := Archive(context.Background(), dir, "/target", []string{}, nil, log)
+		c.Assert(err, IsNil)
+		defer os.Remove(tarball)
+
+		content, err := ioutil.ReadFile(tarball)
+		c.Assert(err, IsNil)
+		return sum, content
+	}
+
+	var cloned int64
+	cloneRange = func(dst *os.File, dstOffset int64, src *os.File, srcOffset, length int64) error {
+		c.Assert(dstOffset%reflinkBlockSize, Equals, int64(0))
+		c.Assert(srcOffset%reflinkBlockSize, Equals, int64(0))
+		c.Assert(length%reflinkBlockSize, Equals, int64(0))
+
+		buf := make([]byte, length)
+		if _, err := src.ReadAt(buf, srcOffset); err != nil {
+			return err
+		}
+		_, err := dst.WriteAt(buf, dstOffset)
+		cloned += length
+		return err
+	}
+
+	archive()
+
+	// the files before the one changed are where they were, so they are cloned.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "file3"), []byte("changed"), 0644), IsNil)
+	sum, content := archive()
+	c.Assert(cloned > 0, Equals, true)
+
+	// the same archive is written without the copy cache.
+	c.Assert(os.RemoveAll(filepath.Join(ts.home, "copy-cache")), IsNil)
+	uncached, uncachedContent := archive()
+	c.Assert(sum, Equals, uncached)
+	c.Assert(bytes.Equal(content, uncachedContent), Equals, true)
+
+	// where ranges can't be cloned, they are copied.
+	cloneRange = func(*os.File, int64, *os.File, int64, int64) error { return unix.EOPNOTSUPP }
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "file3"), []byte("changed again"), 0644), IsNil)
+	sum, content = archive()
+	c.Assert(os.RemoveAll(filepath.Join(ts.home, "copy-cache")), IsNil)
+	uncached, uncachedContent = archive()
+	c.Assert(sum, Equals, uncached)
+	c.Assert(bytes.Equal(content, uncachedContent), Equals, true)
+}
+
+func (ts *tarSuite) TestCollectCopyCache(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644), IsNil)
+
+	tarball, _, err := Archive(context.Background(), dir, "/target", []string{}, nil, log)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(tarball), IsNil)
+
+	cacheDir := filepath.Dir(tarball)
+	old := time.Now().Add(-2 * staleAfter)
+
+	stale := filepath.Join(cacheDir, "box-archive-stale")
+	c.Assert(ioutil.WriteFile(stale, []byte("stale"), 0600), IsNil)
+	c.Assert(os.Chtimes(stale, old, old), IsNil)
+
+	// files in use by a build are recent, and are kept.
+	recent := filepath.Join(cacheDir, "box-archive-recent")
+	c.Assert(ioutil.WriteFile(recent, []byte("recent"), 0600), IsNil)
+
+	// the archive and manifest of the copy are kept however old they are.
+	for _, name := range []string{"archive.tar", "manifest.json"} {
+		c.Assert(os.Chtimes(filepath.Join(cacheDir, name), old, old), IsNil)
+	}
+
+	files, size, err := CollectCopyCache(true)
+	c.Assert(err, IsNil)
+	c.Assert(files, DeepEquals, []string{stale})
+	c.Assert(size, Equals, int64(5))
+
+	_, err = os.Stat(stale)
+	c.Assert(err, IsNil)
+
+	files, size, err = CollectCopyCache(false)
+	c.Assert(err, IsNil)
+	c.Assert(files, DeepEquals, []string{stale})
+	c.Assert(size, Equals, int64(5))
+
+	_, err = os.Stat(stale)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	for _, name := range []string{"archive.tar", "manifest.json", "box-archive-recent"} {
+		_, err := os.Stat(filepath.Join(cacheDir, name))
+		c.Assert(err, IsNil)
+	}
+}
+
 func (ts *tarSuite) TestArchiveSpecialFile(c *C) {
 	dir, err := ioutil.TempDir("", "tar-test")
 	c.Assert(err, IsNil)
@@ -62,7 +298,7 @@ func (ts *tarSuite) TestArchiveSpecialFile(c *C) {
 	c.Assert(os.Symlink(tmp.Name(), filepath.Join(dir, "testsym")), IsNil)
 	c.Assert(unix.Mkfifo(filepath.Join(dir, "test.fifo"), 0666), IsNil)
 
-	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, log)
+	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, nil, log)
 	c.Assert(err, IsNil)
 	c.Assert(tarball, Not(Equals), "")
 	defer os.Remove(tarball)
@@ -105,7 +341,7 @@ func (ts *tarSuite) TestArchiveRelativeSymlink(c *C) {
 	os.Mkdir(filepath.Join(dir, "testdir"), 0777)
 	c.Assert(os.Symlink(filepath.Join("..", "test"), filepath.Join(dir, "testdir", "testsym")), IsNil)
 
-	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, log)
+	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, nil, log)
 	c.Assert(err, IsNil)
 	c.Assert(tarball, Not(Equals), "")
 	defer os.Remove(tarball)
@@ -151,7 +387,7 @@ func (ts *tarSuite) TestArchiveGlob(c *C) {
 	}
 
 	for _, prefix := range prefixes {
-		tarball, _, err := Archive(context.Background(), fmt.Sprintf("%s/%s*", dir, prefix), "/", []string{}, log)
+		tarball, _, err := Archive(context.Background(), fmt.Sprintf("%s/%s*", dir, prefix), "/", []string{}, nil, log)
 		c.Assert(err, IsNil)
 		defer os.Remove(tarball)
 
@@ -190,7 +426,7 @@ func (ts *tarSuite) TestArchiveIgnore(c *C) {
 	}
 
 	for _, prefix := range prefixes {
-		tarball, _, err := Archive(context.Background(), dir, "/", []string{fmt.Sprintf("%s*", prefix)}, log)
+		tarball, _, err := Archive(context.Background(), dir, "/", []string{fmt.Sprintf("%s*", prefix)}, nil, log)
 		c.Assert(err, IsNil)
 		defer os.Remove(tarball)
 
@@ -232,7 +468,7 @@ func (ts *tarSuite) TestUnarchive(c *C) {
 	c.Assert(err, IsNil)
 	defer os.RemoveAll(target)
 
-	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, log)
+	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, nil, log)
 	c.Assert(err, IsNil)
 
 	f, err := os.Open(tarball)
@@ -250,3 +486,637 @@ func (ts *tarSuite) TestUnarchive(c *C) {
 		}
 	}
 }
+
+func (ts *tarSuite) TestFile(c *C) {
+	r, err := File("/usr/local/bin/entrypoint.sh", 0755, []byte("#!/bin/sh\nexec \"$@\"\n"))
+	c.Assert(err, IsNil)
+
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "usr/local/bin/entrypoint.sh")
+	c.Assert(header.Mode, Equals, int64(0755))
+
+	content, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "#!/bin/sh\nexec \"$@\"\n")
+
+	_, err = tr.Next()
+	c.Assert(err, Equals, io.EOF)
+}
+
+// writeLayers writes layer tarballs of entries, each a name and its content;
+// directories end in /.
+func writeLayers(c *C, dir string, layers [][][2]string) []string {
+	files := []string{}
+
+	for i, layer := range layers {
+		fn := filepath.Join(dir, fmt.Sprintf("layer%d.tar", i))
+		f, err := os.Create(fn)
+		c.Assert(err, IsNil)
+
+		tw := tar.NewWriter(f)
+		for _, entry := range layer {
+			header := &tar.Header{Name: entry[0], Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry[1]))}
+			if strings.HasSuffix(entry[0], "/") {
+				header.Mode = 0755
+				header.Typeflag = tar.TypeDir
+			}
+
+			c.Assert(tw.WriteHeader(header), IsNil)
+			_, err := tw.Write([]byte(entry[1]))
+			c.Assert(err, IsNil)
+		}
+		c.Assert(tw.Close(), IsNil)
+		f.Close()
+
+		files = append(files, fn)
+	}
+
+	return files
+}
+
+func (ts *tarSuite) TestSquash(c *C) {
+	dir := c.MkDir()
+
+	// each entry is a name and its content; directories end in /.
+	layers := [][][2]string{
+		{{"etc/", ""}, {"etc/passwd", "root"}, {"etc/group", "root"}, {"var/", ""}, {"var/cache/", ""}, {"var/cache/old", "old"}, {"tmp", "file"}},
+		{{"etc/passwd", "root\nuser"}, {"var/.wh.cache", ""}, {"opt/", ""}, {"opt/app", "v1"}, {".wh.tmp", ""}},
+		{{"etc/.wh.group", ""}, {"opt/", ""}, {"opt/.wh..wh..opq", ""}, {"opt/app", "v2"}, {"tmp/", ""}, {"tmp/new", "new"}},
+	}
+
+	files := writeLayers(c, dir, layers)
+
+	out := filepath.Join(dir, "squashed.tar")
+	f, err := os.Create(out)
+	c.Assert(err, IsNil)
+	c.Assert(Squash(f, files), IsNil)
+	f.Close()
+
+	f, err = os.Open(out)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	names := []string{}
+	contents := map[string]string{}
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+
+		names = append(names, header.Name)
+		contents[header.Name] = string(content)
+	}
+
+	c.Assert(names, DeepEquals, []string{
+		"etc/", "var/",
+		"etc/passwd", "var/.wh.cache", ".wh.tmp",
+		"etc/.wh.group", "opt/", "opt/.wh..wh..opq", "opt/app", "tmp/", "tmp/new",
+	}, Commentf("%v", names))
+	c.Assert(contents["etc/passwd"], Equals, "root\nuser")
+	c.Assert(contents["opt/app"], Equals, "v2")
+}
+
+func (ts *tarSuite) TestExport(c *C) {
+	dir := c.MkDir()
+
+	files := writeLayers(c, dir, [][][2]string{
+		{{"etc/", ""}, {"etc/passwd", "root"}, {"etc/group", "root"}, {"var/", ""}, {"var/cache/", ""}, {"var/cache/old", "old"}, {"tmp", "file"}},
+		{{"etc/passwd", "root\nuser"}, {"var/.wh.cache", ""}, {"opt/", ""}, {"opt/app", "v1"}, {".wh.tmp", ""}},
+		{{"etc/.wh.group", ""}, {"opt/", ""}, {"opt/.wh..wh..opq", ""}, {"opt/app", "v2"}, {"tmp/", ""}, {"tmp/new", "new"}},
+	})
+
+	out := filepath.Join(dir, "rootfs.tar")
+	f, err := os.Create(out)
+	c.Assert(err, IsNil)
+	c.Assert(Export(f, files), IsNil)
+	f.Close()
+
+	f, err = os.Open(out)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	names := []string{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, header.Name)
+	}
+
+	c.Assert(names, DeepEquals, []string{"etc/", "var/", "etc/passwd", "opt/", "opt/app", "tmp/", "tmp/new"})
+
+	// the export is the filesystem the layers make up.
+	exported, err := Index([]string{out})
+	c.Assert(err, IsNil)
+	index, err := Index(files)
+	c.Assert(err, IsNil)
+	c.Assert(Diff(index, exported), DeepEquals, []Change{})
+}
+
+func (ts *tarSuite) TestIndexDiff(c *C) {
+	dir := c.MkDir()
+
+	files := writeLayers(c, dir, [][][2]string{
+		{{"etc/", ""}, {"etc/passwd", "root"}, {"etc/group", "root"}, {"var/", ""}, {"var/cache/", ""}, {"var/cache/old", "old"}, {"tmp", "file"}},
+		{{"etc/passwd", "root\nuser"}, {"var/.wh.cache", ""}, {"opt/", ""}, {"opt/app", "v1"}, {".wh.tmp", ""}},
+		{{"etc/.wh.group", ""}, {"opt/", ""}, {"opt/.wh..wh..opq", ""}, {"opt/app", "v2"}, {"tmp/", ""}, {"tmp/new", "new"}},
+	})
+
+	base, err := Index(files[:1])
+	c.Assert(err, IsNil)
+
+	index, err := Index(files)
+	c.Assert(err, IsNil)
+
+	paths := []string{}
+	for p := range index {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	c.Assert(paths, DeepEquals, []string{"/etc", "/etc/passwd", "/opt", "/opt/app", "/tmp", "/tmp/new", "/var"})
+	c.Assert(index["/opt/app"].Size, Equals, int64(2))
+
+	changes := []string{}
+	for _, change := range Diff(base, index) {
+		changes = append(changes, change.Kind+" "+change.Path)
+	}
+
+	c.Assert(changes, DeepEquals, []string{
+		"D /etc/group", "M /etc/passwd", "A /opt", "A /opt/app", "M /tmp", "A /tmp/new", "D /var/cache", "D /var/cache/old",
+	})
+	c.Assert(Diff(index, index), DeepEquals, []Change{})
+}
+
+func (ts *tarSuite) TestAnalyze(c *C) {
+	dir := c.MkDir()
+
+	files := writeLayers(c, dir, [][][2]string{
+		{{"etc/", ""}, {"etc/passwd", "root"}, {"etc/group", "root"}, {"var/", ""}, {"var/cache/", ""}, {"var/cache/old", "old"}, {"tmp", "file"}},
+		{{"etc/passwd", "root\nuser"}, {"var/.wh.cache", ""}, {"opt/", ""}, {"opt/app", "v1"}, {".wh.tmp", ""}},
+		{{"etc/.wh.group", ""}, {"opt/", ""}, {"opt/.wh..wh..opq", ""}, {"opt/app", "v2"}, {"tmp/", ""}, {"tmp/new", "new"}},
+	})
+
+	analysis, err := Analyze(files, 2)
+	c.Assert(err, IsNil)
+
+	c.Assert(analysis.Size, Equals, int64(31))
+	c.Assert(analysis.Wasted, Equals, int64(17))
+	c.Assert(analysis.Layers, HasLen, 3)
+
+	c.Assert(analysis.Layers[0].Size, Equals, int64(15))
+	c.Assert(analysis.Layers[0].Files, Equals, 4)
+	c.Assert(analysis.Layers[0].Wasted, Equals, int64(15))
+	c.Assert(analysis.Layers[0].LargestFiles, DeepEquals, []PathSize{{"/etc/group", 4}, {"/etc/passwd", 4}})
+	c.Assert(analysis.Layers[0].LargestDirs, DeepEquals, []PathSize{{"/etc", 8}, {"/var", 3}})
+	c.Assert(analysis.Layers[1].Wasted, Equals, int64(2))
+	c.Assert(analysis.Layers[2].Wasted, Equals, int64(0))
+
+	c.Assert(analysis.WastedFiles, DeepEquals, []WastedFile{
+		{"/etc/group", 0, 4}, {"/etc/passwd", 0, 4}, {"/tmp", 0, 4}, {"/var/cache/old", 0, 3}, {"/opt/app", 1, 2},
+	})
+}
+
+func (ts *tarSuite) TestExclude(c *C) {
+	dir := c.MkDir()
+	fn := filepath.Join(dir, "layer.tar")
+
+	f, err := os.Create(fn)
+	c.Assert(err, IsNil)
+
+	tw := tar.NewWriter(f)
+	for _, entry := range []struct {
+		header  *tar.Header
+		content string
+	}{
+		{&tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "usr/share/doc/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "usr/share/doc/README", Typeflag: tar.TypeReg, Mode: 0644, Size: 6}, "readme"},
+		{&tar.Header{Name: "usr/share/doc/keep", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "keep"},
+		{&tar.Header{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 3}, "app"},
+		{&tar.Header{Name: "usr/bin/app.test", Typeflag: tar.TypeReg, Mode: 0755, Size: 4}, "test"},
+		{&tar.Header{Name: "usr/bin/readme", Typeflag: tar.TypeLink, Linkname: "usr/share/doc/README"}, ""},
+		{&tar.Header{Name: "usr/bin/readme2", Typeflag: tar.TypeLink, Linkname: "usr/share/doc/README"}, ""},
+		{&tar.Header{Name: "var/lib/apt/lists/.wh.old", Typeflag: tar.TypeReg}, ""},
+	} {
+		c.Assert(tw.WriteHeader(entry.header), IsNil)
+		_, err := tw.Write([]byte(entry.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(ValidExclude([]string{"usr/[share"}), NotNil)
+
+	buf := &bytes.Buffer{}
+	c.Assert(Exclude(buf, fn, []string{"/usr/share/doc", "!usr/share/doc/keep", "**/*.test", "var/lib/apt/lists"}), IsNil)
+
+	entries := []string{}
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+
+		entries = append(entries, fmt.Sprintf("%s %c %s%s", header.Name, header.Typeflag, header.Linkname, content))
+	}
+
+	c.Assert(entries, DeepEquals, []string{
+		"usr/ 5 ",
+		"usr/share/doc/keep 0 keep",
+		"usr/bin/app 0 app",
+		"usr/bin/readme 0 readme",
+		"usr/bin/readme2 1 usr/bin/readme",
+		"var/lib/apt/lists/.wh.old 0 ",
+	})
+}
+
+func (ts *tarSuite) TestCompress(c *C) {
+	content := strings.Repeat("layer content\n", 1000)
+
+	for _, compression := range []string{Gzip, Zstd} {
+		c.Assert(ValidCompression(compression), IsNil)
+
+		f, err := ioutil.TempFile("", "tar-test")
+		c.Assert(err, IsNil)
+		defer os.Remove(f.Name())
+
+		w, err := Compress(f, compression, 0)
+		c.Assert(err, IsNil)
+		_, err = io.WriteString(w, content)
+		c.Assert(err, IsNil)
+		c.Assert(w.Close(), IsNil)
+
+		fi, err := f.Stat()
+		c.Assert(err, IsNil)
+		c.Assert(fi.Size() < int64(len(content)), Equals, true)
+
+		_, err = f.Seek(0, io.SeekStart)
+		c.Assert(err, IsNil)
+
+		detected, r, err := Compression(f)
+		c.Assert(err, IsNil)
+		c.Assert(detected, Equals, compression)
+
+		rc, err := Decompress(r)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(rc)
+		c.Assert(err, IsNil)
+		c.Assert(rc.Close(), IsNil)
+		c.Assert(string(data), Equals, content)
+	}
+
+	// streams which are not compressed are read as they are.
+	rc, err := Decompress(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, content)
+
+	c.Assert(ValidCompression("lz4"), NotNil)
+	_, err = Compress(ioutil.Discard, "lz4", 0)
+	c.Assert(err, NotNil)
+}
+
+func (ts *tarSuite) TestParallelGzip(c *C) {
+	// blocks repeating what came before them are compressed with it as
+	// their dictionary.
+	content := []byte(strings.Repeat("layer content\n", 3*gzipBlockSize/14))
+	for i := 0; i < len(content); i += 4096 {
+		content[i] = byte(i / 4096)
+	}
+
+	for _, workers := range []int{0, 1, 2, 4} {
+		buf := &bytes.Buffer{}
+		d, err := NewDigester(buf, Gzip, workers)
+		c.Assert(err, IsNil)
+
+		// written in pieces which do not line up with the blocks.
+		for i := 0; i < len(content); i += 100000 {
+			end := i + 100000
+			if end > len(content) {
+				end = len(content)
+			}
+			_, err = d.Write(content[i:end])
+			c.Assert(err, IsNil)
+		}
+		c.Assert(d.Close(), IsNil)
+
+		c.Assert(d.Size(), Equals, int64(buf.Len()), Commentf("%d workers", workers))
+		c.Assert(buf.Len() < len(content)/10, Equals, true, Commentf("%d workers", workers))
+		c.Assert(d.Digest(), Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(buf.Bytes())), Commentf("%d workers", workers))
+		c.Assert(d.DiffID(), Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(content)), Commentf("%d workers", workers))
+
+		gz, err := gzip.NewReader(buf)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(gz)
+		c.Assert(err, IsNil, Commentf("%d workers", workers))
+		c.Assert(bytes.Equal(data, content), Equals, true, Commentf("%d workers", workers))
+	}
+
+	// empty streams are still gzip streams.
+	buf := &bytes.Buffer{}
+	w, err := Compress(buf, Gzip, 4)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	gz, err := gzip.NewReader(buf)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 0)
+}
+
+func (ts *tarSuite) TestStargz(c *C) {
+	dir := c.MkDir()
+	layers := writeLayers(c, dir, [][][2]string{{
+		{"etc/", ""},
+		{"etc/hostname", "box\n"},
+		{"etc/empty", ""},
+		{"usr/bin/tool", strings.Repeat("binary", 1000)},
+	}})
+
+	in, err := os.Open(layers[0])
+	c.Assert(err, IsNil)
+	defer in.Close()
+
+	buf := &bytes.Buffer{}
+	layer, err := Stargz(buf, in)
+	c.Assert(err, IsNil)
+	blob := buf.Bytes()
+
+	// the layer is a gzipped tarball like any other.
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	c.Assert(err, IsNil)
+	uncompressed, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Assert(layer.DiffID, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(uncompressed)))
+	c.Assert(layer.Size, Equals, int64(len(uncompressed)))
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, header.Name)
+	}
+	c.Assert(names, DeepEquals, []string{".no.prefetch.landmark", "etc/", "etc/hostname", "etc/empty", "usr/bin/tool", "stargz.index.json"})
+
+	// the footer holds the offset of the table of contents.
+	footer := blob[len(blob)-stargzFooterSize:]
+	gz, err = gzip.NewReader(bytes.NewReader(footer))
+	c.Assert(err, IsNil)
+	c.Assert(string(gz.Header.Extra[4:]), Matches, "[0-9a-f]{16}STARGZ")
+
+	offset, err := strconv.ParseInt(string(gz.Header.Extra[4:20]), 16, 64)
+	c.Assert(err, IsNil)
+
+	gz, err = gzip.NewReader(bytes.NewReader(blob[offset:]))
+	c.Assert(err, IsNil)
+	gz.Multistream(false)
+	tr = tar.NewReader(gz)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "stargz.index.json")
+	content, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	c.Assert(layer.TOCDigest, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(content)))
+
+	toc := stargzTOC{}
+	c.Assert(json.Unmarshal(content, &toc), IsNil)
+	c.Assert(toc.Entries, HasLen, 5)
+
+	// each file can be read from its offset alone.
+	for _, entry := range toc.Entries {
+		if entry.Type != "reg" || entry.Size == 0 {
+			continue
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(blob[entry.Offset:]))
+		c.Assert(err, IsNil)
+		gz.Multistream(false)
+
+		data := make([]byte, entry.Size)
+		_, err = io.ReadFull(gz, data)
+		c.Assert(err, IsNil)
+		c.Assert(entry.Digest, Equals, fmt.Sprintf("sha256:%x", sha256.Sum256(data)), Commentf("%s", entry.Name))
+	}
+}
+
+func (ts *tarSuite) TestNormalize(c *C) {
+	dir := c.MkDir()
+
+	write := func(fn string, now time.Time, headers []*tar.Header) {
+		f, err := os.Create(fn)
+		c.Assert(err, IsNil)
+		defer f.Close()
+
+		tw := tar.NewWriter(f)
+		for _, header := range headers {
+			header.ModTime, header.AccessTime, header.ChangeTime = now, now, now
+			header.Uname, header.Gname = now.String(), now.String()
+			header.Format = tar.FormatPAX
+			c.Assert(tw.WriteHeader(header), IsNil)
+			_, err := tw.Write([]byte(strings.Repeat("x", int(header.Size))))
+			c.Assert(err, IsNil)
+		}
+		c.Assert(tw.Close(), IsNil)
+	}
+
+	entries := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10, Uid: 1000, Gid: 1000},
+			{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 20, PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "cap", "comment": "built"}},
+		}
+	}
+
+	// a layer of the same files, in another order, at other times, with a hard
+	// link before its target.
+	first := entries()
+	second := entries()
+	second[0], second[1], second[2], second[3] = second[2], second[3], second[0], second[1]
+	second = append([]*tar.Header{{Name: "bin/link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}}, second...)
+	first = append(first, &tar.Header{Name: "bin/link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"})
+
+	write(filepath.Join(dir, "first.tar"), time.Now(), first)
+	write(filepath.Join(dir, "second.tar"), time.Now().Add(time.Hour), second)
+
+	epoch := time.Unix(0, 0)
+	normalize := func(fn string) []byte {
+		buf := &bytes.Buffer{}
+		c.Assert(Normalize(buf, filepath.Join(dir, fn), epoch), IsNil)
+		return buf.Bytes()
+	}
+
+	normalized := normalize("first.tar")
+	c.Assert(normalize("second.tar"), DeepEquals, normalized)
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(normalized))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		names = append(names, header.Name)
+		c.Assert(header.ModTime.Equal(epoch), Equals, true)
+		c.Assert(header.Uname, Equals, "")
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		c.Assert(int64(len(content)), Equals, header.Size)
+
+		switch header.Name {
+		case "etc/passwd":
+			c.Assert(header.Uid, Equals, 1000)
+		case "bin/sh":
+			c.Assert(header.PAXRecords["SCHILY.xattr.security.capability"], Equals, "cap")
+			_, ok := header.PAXRecords["comment"]
+			c.Assert(ok, Equals, false)
+		}
+	}
+
+	c.Assert(names, DeepEquals, []string{"bin/", "bin/sh", "etc/", "etc/passwd", "bin/link"})
+}
+
+func (ts *tarSuite) TestClampTimes(c *C) {
+	dir := c.MkDir()
+	fn := filepath.Join(dir, "layer.tar")
+
+	epoch := time.Unix(1000000000, 0)
+	before := epoch.Add(-time.Hour)
+
+	f, err := os.Create(fn)
+	c.Assert(err, IsNil)
+
+	tw := tar.NewWriter(f)
+	for _, header := range []*tar.Header{
+		{Name: "old", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, ModTime: before, Uname: "root"},
+		{Name: "new", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, ModTime: time.Now(), Uname: "root"},
+	} {
+		c.Assert(tw.WriteHeader(header), IsNil)
+		_, err := tw.Write([]byte(header.Name))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	buf := &bytes.Buffer{}
+	c.Assert(ClampTimes(buf, fn, epoch), IsNil)
+
+	times := map[string]time.Time{}
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		c.Assert(string(content), Equals, header.Name)
+		c.Assert(header.Uname, Equals, "root")
+
+		times[header.Name] = header.ModTime
+	}
+
+	c.Assert(times["old"].Equal(before), Equals, true)
+	c.Assert(times["new"].Equal(epoch), Equals, true)
+}
+
+func (ts *tarSuite) TestCatExtract(c *C) {
+	dir := c.MkDir()
+
+	files := writeLayers(c, dir, [][][2]string{
+		{{"usr/", ""}, {"usr/lib/", ""}, {"usr/lib/os-release", "v1"}, {"app/", ""}, {"app/dist/", ""}, {"app/dist/old.js", "old"}, {"app/dist/index.js", "v1"}},
+		{{"usr/lib/os-release", "v2"}, {"app/dist/.wh.old.js", ""}, {"app/dist/main.css", "css"}, {"app/src/", ""}, {"app/src/main.go", "go"}},
+	})
+
+	// the last layer has symlinks and a hard link, which writeLayers can't make.
+	fn := filepath.Join(dir, "links.tar")
+	f, err := os.Create(fn)
+	c.Assert(err, IsNil)
+	tw := tar.NewWriter(f)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "dist", Typeflag: tar.TypeSymlink, Linkname: "/app/dist"}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "app/dist/app.js", Typeflag: tar.TypeLink, Linkname: "app/dist/index.js"}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "app/main.go", Typeflag: tar.TypeLink, Linkname: "app/src/main.go"}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+	f.Close()
+	files = append(files, fn)
+
+	buf := &bytes.Buffer{}
+	c.Assert(Cat(buf, files, "/etc/os-release"), IsNil)
+	c.Assert(buf.String(), Equals, "v2")
+
+	buf.Reset()
+	c.Assert(Cat(buf, files, "app/main.go"), IsNil)
+	c.Assert(buf.String(), Equals, "go")
+
+	c.Assert(Cat(ioutil.Discard, files, "/app/dist/old.js"), NotNil)
+	c.Assert(Cat(ioutil.Discard, files, "/app/dist"), NotNil)
+
+	buf.Reset()
+	c.Assert(ExtractPath(buf, files, "/dist"), IsNil)
+
+	contents := map[string]string{}
+	links := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		contents[header.Name] = string(content)
+		if header.Typeflag == tar.TypeLink {
+			links[header.Name] = header.Linkname
+		}
+	}
+
+	c.Assert(contents, DeepEquals, map[string]string{"index.js": "v1", "main.css": "css", "app.js": ""})
+	c.Assert(links, DeepEquals, map[string]string{"app.js": "index.js"})
+
+	// a file is extracted by its name; a hard link to a file left out is a copy.
+	buf.Reset()
+	c.Assert(ExtractPath(buf, files, "/app/main.go"), IsNil)
+	tr = tar.NewReader(buf)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "main.go")
+	c.Assert(header.Typeflag, Equals, byte(tar.TypeReg))
+	content, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "go")
+	_, err = tr.Next()
+	c.Assert(err, Equals, io.EOF)
+}
@@ -12,3 +12,10 @@ func Unarchive(reader io.Reader, dest string) error {
 	options := &archive.TarOptions{WhiteoutFormat: archive.OverlayWhiteoutFormat}
 	return archive.Unpack(reader, dest, options)
 }
+
+// Extract unpacks the reader into the destination directory as the user
+// running box: files are not chowned, and whiteouts are not converted.
+func Extract(reader io.Reader, dest string) error {
+	options := &archive.TarOptions{NoLchown: true}
+	return archive.Unpack(reader, dest, options)
+}
@@ -0,0 +1,88 @@
+// Package tarcontext builds from tarballs: fetched over http and https, or
+// read from a stream such as stdin, and extracted to use as the context of a
+// build.
+package tarcontext
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/box-builder/box/tar"
+)
+
+// IsURL reports whether the context is the URL of a tarball, over http or
+// https.
+func IsURL(context string) bool {
+	return strings.HasPrefix(context, "http://") || strings.HasPrefix(context, "https://")
+}
+
+// Redact returns the URL without the password and query it may have, which
+// may be credentials, such as those of a presigned URL, so it can be logged.
+func Redact(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.User(u.User.Username())
+		}
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u.String()
+}
+
+// Extract extracts the tarball read from r, compressed with gzip or zstd or
+// not at all, into dir, as the user running box. It returns the sha256
+// digest of the tarball, as it was read.
+func Extract(r io.Reader, dir string) (string, error) {
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+
+	rc, err := tar.Decompress(tee)
+	if err != nil {
+		return "", fmt.Errorf("could not read the context: %v", err)
+	}
+	defer rc.Close()
+
+	if err := tar.Extract(rc, dir); err != nil {
+		return "", fmt.Errorf("could not extract the context: %v", err)
+	}
+
+	// whatever follows the end of the archive is part of the tarball read.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return "", fmt.Errorf("could not read the context: %v", err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Fetch fetches the tarball at the URL and extracts it into dir, as Extract
+// does.
+func Fetch(ctx context.Context, rawurl, dir string) (string, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("could not fetch %s: %v", Redact(rawurl), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not fetch %s: %s", Redact(rawurl), resp.Status)
+	}
+
+	return Extract(resp.Body, dir)
+}
@@ -0,0 +1,144 @@
+// Package timing records the wall time, CPU time and bytes written of each
+// step of a build, and reports the slowest steps first, so the steps worth
+// speeding up are found.
+package timing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// Step is the timing of a step.
+type Step struct {
+	Step    string        `json:"step"`    // the verb and its arguments
+	Cached  bool          `json:"cached"`  // whether the step was found in the cache
+	Wall    time.Duration `json:"wall"`    // how long the step took, in nanoseconds
+	CPU     time.Duration `json:"cpu"`     // the CPU time box and the containers of its run steps used, in nanoseconds
+	Written int64         `json:"written"` // the bytes the step wrote to its layer
+}
+
+// Report is the timing of the steps of a build.
+type Report struct {
+	Steps []Step
+
+	// Received and Sent are the bytes the build received from registries
+	// and sent to them.
+	Received int64
+	Sent     int64
+
+	mutex sync.Mutex
+}
+
+// Add adds a step to the report.
+func (r *Report) Add(step Step) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Steps = append(r.Steps, step)
+}
+
+// Total returns the wall time of all the steps.
+func (r *Report) Total() time.Duration {
+	var total time.Duration
+	for _, step := range r.Steps {
+		total += step.Wall
+	}
+
+	return total
+}
+
+// Slowest returns the steps, the slowest first. Steps which took as long are
+// in the order they ran.
+func (r *Report) Slowest() []Step {
+	steps := append([]Step{}, r.Steps...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Wall > steps[j].Wall })
+
+	return steps
+}
+
+// Write writes the slowest steps of the report as a table, at most max of
+// them, with their share of the time of all the steps.
+func (r *Report) Write(w io.Writer, max int) error {
+	steps := r.Slowest()
+	if len(steps) > max {
+		steps = steps[:max]
+	}
+
+	total := r.Total()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tTIME\tSHARE\tCPU\tWRITTEN")
+
+	var shown time.Duration
+	for _, step := range steps {
+		shown += step.Wall
+
+		var written string
+		if step.Written > 0 {
+			written = units.HumanSize(float64(step.Written))
+		}
+
+		step.Wall = step.Wall.Round(time.Millisecond)
+		step.CPU = step.CPU.Round(time.Millisecond)
+
+		if step.Cached {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t(cached)\n", step.Step, step.Wall, share(step.Wall, total), step.CPU)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", step.Step, step.Wall, share(step.Wall, total), step.CPU, written)
+		}
+	}
+
+	fmt.Fprintf(tw, "%d steps took %s; the %d slowest took %s\n", len(r.Steps), total.Round(time.Millisecond), len(steps), share(shown, total))
+
+	return tw.Flush()
+}
+
+func share(d, total time.Duration) string {
+	if total <= 0 {
+		return "0%"
+	}
+
+	return fmt.Sprintf("%.0f%%", 100*float64(d)/float64(total))
+}
+
+// WriteFile writes the report to the file as JSON, with the steps in the
+// order they ran.
+func (r *Report) WriteFile(fn string) error {
+	content, err := json.MarshalIndent(struct {
+		Total    time.Duration `json:"total"`
+		Steps    []Step        `json:"steps"`
+		Received int64         `json:"received"`
+		Sent     int64         `json:"sent"`
+	}{r.Total(), r.Steps, r.Received, r.Sent}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, append(content, '\n'), 0644)
+}
+
+// CPUTime returns the CPU time box and the processes it ran and waited for
+// have used, in user and system mode.
+func CPUTime() time.Duration {
+	var total time.Duration
+
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		usage := syscall.Rusage{}
+		if err := syscall.Getrusage(who, &usage); err != nil {
+			continue
+		}
+
+		total += time.Duration(usage.Utime.Nano()) + time.Duration(usage.Stime.Nano())
+	}
+
+	return total
+}
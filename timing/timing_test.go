@@ -0,0 +1,72 @@
+package timing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type timingSuite struct{}
+
+var _ = Suite(&timingSuite{})
+
+func TestTiming(t *T) {
+	TestingT(t)
+}
+
+func (ts *timingSuite) TestReport(c *C) {
+	r := &Report{}
+	r.Add(Step{Step: "from debian", Wall: time.Second, Cached: true})
+	r.Add(Step{Step: "run make", Wall: 6 * time.Second, CPU: 20 * time.Second, Written: 50 << 20})
+	r.Add(Step{Step: "copy ., /src", Wall: 2 * time.Second, Written: 1 << 20})
+	r.Add(Step{Step: "env A=1", Wall: time.Second})
+
+	c.Assert(r.Total(), Equals, 10*time.Second)
+
+	slowest := r.Slowest()
+	c.Assert(slowest, HasLen, 4)
+	c.Assert(slowest[0].Step, Equals, "run make")
+	c.Assert(slowest[1].Step, Equals, "copy ., /src")
+	// steps which took as long stay in the order they ran.
+	c.Assert(slowest[2].Step, Equals, "from debian")
+	c.Assert(slowest[3].Step, Equals, "env A=1")
+
+	// the order of the report itself is unchanged.
+	c.Assert(r.Steps[0].Step, Equals, "from debian")
+
+	buf := &bytes.Buffer{}
+	c.Assert(r.Write(buf, 3), IsNil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 5)
+	c.Assert(lines[1], Matches, `run make\s+6s\s+60%\s+20s\s+52.43 MB`)
+	c.Assert(lines[3], Matches, `from debian\s+1s\s+10%\s+0s\s+\(cached\)`)
+	c.Assert(lines[4], Equals, "4 steps took 10s; the 3 slowest took 90%")
+
+	fn := filepath.Join(c.MkDir(), "profile.json")
+	r.Received, r.Sent = 1024, 512
+	c.Assert(r.WriteFile(fn), IsNil)
+
+	content, err := ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+
+	profile := struct {
+		Total    time.Duration
+		Steps    []Step
+		Received int64
+		Sent     int64
+	}{}
+	c.Assert(json.Unmarshal(content, &profile), IsNil)
+	c.Assert(profile.Total, Equals, 10*time.Second)
+	c.Assert(profile.Steps, DeepEquals, r.Steps)
+	c.Assert(profile.Received, Equals, int64(1024))
+	c.Assert(profile.Sent, Equals, int64(512))
+
+	c.Assert(CPUTime() > 0, Equals, true)
+}
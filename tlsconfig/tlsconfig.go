@@ -0,0 +1,149 @@
+// Package tlsconfig holds the TLS configuration box reaches registries, cache
+// backends and other servers with: the least version of TLS, the cipher
+// suites, and whether it is strict.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// FIPS is the name of the cipher suites approved by FIPS 140-2: ECDHE key
+// exchange with AES-GCM.
+const FIPS = "fips"
+
+var (
+	versions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	fipsCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+)
+
+var (
+	minVersion   uint16 = tls.VersionTLS12
+	cipherSuites []uint16
+	strict       bool
+	mutex        sync.RWMutex
+)
+
+// ParseVersion returns the version of TLS given as 1.0, 1.1, 1.2 or 1.3.
+func ParseVersion(version string) (uint16, error) {
+	v, ok := versions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q: must be 1.0, 1.1, 1.2 or 1.3", version)
+	}
+
+	return v, nil
+}
+
+// ParseCipherSuites returns the cipher suites given by their names, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, or fips for those FIPS 140-2
+// approves. Insecure cipher suites are only returned if insecure is set.
+func ParseCipherSuites(names []string, insecure bool) ([]uint16, error) {
+	ids := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+
+	weak := map[string]uint16{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		weak[suite.Name] = suite.ID
+	}
+
+	suites := []uint16{}
+
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+
+		if name == strings.ToUpper(FIPS) {
+			suites = append(suites, fipsCipherSuites...)
+			continue
+		}
+
+		if id, ok := ids[name]; ok {
+			suites = append(suites, id)
+			continue
+		}
+
+		if id, ok := weak[name]; ok {
+			if !insecure {
+				return nil, fmt.Errorf("cipher suite %s is insecure", name)
+			}
+
+			suites = append(suites, id)
+			continue
+		}
+
+		return nil, fmt.Errorf("invalid cipher suite %q", name)
+	}
+
+	return suites, nil
+}
+
+// Set sets the least version of TLS and the cipher suites servers are
+// reached with, and whether TLS is strict: if it is, the version must be 1.2
+// or later, and servers are never reached over plain http. With no cipher
+// suites, Go's defaults are used. The transport of http.DefaultClient is
+// configured with them as well.
+func Set(version string, ciphers []string, isStrict bool) error {
+	v, err := ParseVersion(version)
+	if err != nil {
+		return err
+	}
+
+	if isStrict && v < tls.VersionTLS12 {
+		return fmt.Errorf("TLS %s is too weak for strict TLS: must be 1.2 or later", version)
+	}
+
+	suites, err := ParseCipherSuites(ciphers, !isStrict)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	minVersion = v
+	cipherSuites = suites
+	strict = isStrict
+	mutex.Unlock()
+
+	if tr, ok := http.DefaultTransport.(*http.Transport); ok {
+		tr.TLSClientConfig = Config()
+	}
+
+	return nil
+}
+
+// Config returns a TLS configuration with the least version and cipher suites
+// set. Each call returns a new one, which may be changed.
+func Config() *tls.Config {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	config := &tls.Config{MinVersion: minVersion}
+	if len(cipherSuites) > 0 {
+		config.CipherSuites = append([]uint16{}, cipherSuites...)
+	}
+
+	return config
+}
+
+// Strict is true if servers must never be reached over plain http, or with
+// weak TLS.
+func Strict() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return strict
+}
@@ -0,0 +1,74 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"net/http"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type tlsSuite struct{}
+
+var _ = Suite(&tlsSuite{})
+
+func TestTLSConfig(t *T) {
+	TestingT(t)
+}
+
+func (ts *tlsSuite) TearDownTest(c *C) {
+	c.Assert(Set("1.2", nil, false), IsNil)
+}
+
+func (ts *tlsSuite) TestParseVersion(c *C) {
+	for version, expected := range map[string]uint16{
+		"1.0":    tls.VersionTLS10,
+		"1.2":    tls.VersionTLS12,
+		"TLS1.3": tls.VersionTLS13,
+	} {
+		v, err := ParseVersion(version)
+		c.Assert(err, IsNil, Commentf("%s", version))
+		c.Assert(v, Equals, expected, Commentf("%s", version))
+	}
+
+	_, err := ParseVersion("1.4")
+	c.Assert(err, ErrorMatches, `invalid TLS version "1.4".*`)
+}
+
+func (ts *tlsSuite) TestParseCipherSuites(c *C) {
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, false)
+	c.Assert(err, IsNil)
+	c.Assert(suites, DeepEquals, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+
+	suites, err = ParseCipherSuites([]string{"fips"}, false)
+	c.Assert(err, IsNil)
+	c.Assert(suites, DeepEquals, fipsCipherSuites)
+
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}, false)
+	c.Assert(err, ErrorMatches, "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure")
+
+	suites, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}, true)
+	c.Assert(err, IsNil)
+	c.Assert(suites, DeepEquals, []uint16{tls.TLS_RSA_WITH_RC4_128_SHA})
+
+	_, err = ParseCipherSuites([]string{"TLS_NOPE"}, true)
+	c.Assert(err, ErrorMatches, `invalid cipher suite "TLS_NOPE"`)
+}
+
+func (ts *tlsSuite) TestSet(c *C) {
+	c.Assert(Config().MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(Config().CipherSuites, IsNil)
+	c.Assert(Strict(), Equals, false)
+
+	c.Assert(Set("1.3", []string{"fips"}, true), IsNil)
+	c.Assert(Config().MinVersion, Equals, uint16(tls.VersionTLS13))
+	c.Assert(Config().CipherSuites, DeepEquals, fipsCipherSuites)
+	c.Assert(Strict(), Equals, true)
+	c.Assert(http.DefaultTransport.(*http.Transport).TLSClientConfig.MinVersion, Equals, uint16(tls.VersionTLS13))
+
+	c.Assert(Set("1.1", nil, true), ErrorMatches, "TLS 1.1 is too weak for strict TLS.*")
+	c.Assert(Set("1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}, true), ErrorMatches, ".* is insecure")
+
+	c.Assert(Set("1.0", []string{"TLS_RSA_WITH_RC4_128_SHA"}, false), IsNil)
+	c.Assert(Config().MinVersion, Equals, uint16(tls.VersionTLS10))
+}
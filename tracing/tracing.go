@@ -0,0 +1,350 @@
+// Package tracing records the spans of builds: the build, each of its
+// steps, and the requests and layer transfers to registries. They are
+// exported to an OpenTelemetry collector over OTLP, as JSON over HTTP, so
+// slow builds are traced end to end in the observability stacks they run
+// in. Nothing is recorded unless an endpoint is configured.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of spans, as OTLP numbers them.
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// batchSize is how many spans are exported at once, as they end.
+const batchSize = 512
+
+var traceparentRegexp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+var (
+	endpoint string
+	headers  http.Header
+	service  string
+	remote   *Span // the parent of the spans without one, from $TRACEPARENT
+	ended    []*Span
+	exports  sync.WaitGroup
+	mutex    sync.Mutex
+
+	client = &http.Client{Timeout: 10 * time.Second}
+)
+
+type spanKey struct{}
+
+// Span is an operation traced. The methods of a nil span, as Start returns
+// when tracing is not configured, do nothing.
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]interface{}
+	err     error
+	mutex   sync.Mutex
+}
+
+// Configure exports the spans to the OTLP endpoint: the base URL of a
+// collector, to which /v1/traces is added, as $OTEL_EXPORTER_OTLP_ENDPOINT
+// is. $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, the full URL, overrides it, and
+// $OTEL_EXPORTER_OTLP_HEADERS and $OTEL_SERVICE_NAME are read as
+// OpenTelemetry reads them. The spans without a parent are children of
+// $TRACEPARENT, if it is set, so builds join the traces of what ran them.
+// Without an endpoint, nothing is traced.
+func Configure(base string) error {
+	url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if url == "" && base != "" {
+		url = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	h := http.Header{}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %q is not key=value", pair)
+		}
+
+		h.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	endpoint, headers = url, h
+	if url == "" {
+		return nil
+	}
+
+	if service = os.Getenv("OTEL_SERVICE_NAME"); service == "" {
+		service = "box"
+	}
+
+	remote = nil
+	if tp := os.Getenv("TRACEPARENT"); tp != "" {
+		match := traceparentRegexp.FindStringSubmatch(tp)
+		if match == nil {
+			return fmt.Errorf("invalid TRACEPARENT %q", tp)
+		}
+
+		remote = &Span{}
+		hex.Decode(remote.traceID[:], []byte(match[1]))
+		hex.Decode(remote.spanID[:], []byte(match[2]))
+	}
+
+	return nil
+}
+
+// Start starts a span, the child of the span of ctx if it has one, and
+// returns the context of the span.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	mutex.Lock()
+	configured, parent := endpoint != "", remote
+	mutex.Unlock()
+
+	if !configured {
+		return ctx, nil
+	}
+
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		parent = s
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	rand.Read(s.spanID[:])
+
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span of the context, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Set sets an attribute of the span: a string, bool, int or int64.
+func (s *Span) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.attrs[key] = value
+	s.mutex.Unlock()
+}
+
+// Traceparent returns the span as a W3C traceparent header, so the
+// servers it calls are traced in it.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// End ends the span, as failed if err is not nil. Spans are exported as
+// they end, batchSize at a time; Flush exports the rest.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end, s.err = time.Now(), err
+	s.mutex.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	ended = append(ended, s)
+	if len(ended) >= batchSize {
+		batch := ended
+		ended = nil
+
+		exports.Add(1)
+		go func() {
+			defer exports.Done()
+			export(batch)
+		}()
+	}
+}
+
+// Flush exports the spans which ended, and waits for the exports in
+// progress. Errors exporting are returned: they never fail builds.
+func Flush() error {
+	mutex.Lock()
+	batch := ended
+	ended = nil
+	mutex.Unlock()
+
+	exports.Wait()
+	return export(batch)
+}
+
+// otlpValue is an attribute value in OTLP JSON.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	v := otlpValue{}
+
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+
+	return otlpAttribute{Key: key, Value: v}
+}
+
+// encode encodes the spans as an OTLP export request.
+func encode(spans []*Span, service string) ([]byte, error) {
+	encoded := []otlpSpan{}
+
+	for _, s := range spans {
+		s.mutex.Lock()
+
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+
+		for key, value := range s.attrs {
+			span.Attributes = append(span.Attributes, attribute(key, value))
+		}
+
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+
+		s.mutex.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{attribute("service.name", service)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/box-builder/box"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	})
+}
+
+// export posts the spans to the endpoint.
+func export(spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	mutex.Lock()
+	url, h, name := endpoint, headers, service
+	mutex.Unlock()
+
+	content, err := encode(spans, name)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	for key, values := range h {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not export traces to %s: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("could not export traces to %s: %s", url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type tracingSuite struct{}
+
+var _ = Suite(&tracingSuite{})
+
+func TestTracing(t *T) {
+	TestingT(t)
+}
+
+type exported struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute
+		}
+		ScopeSpans []struct {
+			Spans []otlpSpan
+		}
+	}
+}
+
+func (ts *tracingSuite) TestSpans(c *C) {
+	requests := []exported{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+
+		c.Check(r.Header.Get("X-Token"), Equals, "secret")
+
+		content, err := ioutil.ReadAll(r.Body)
+		c.Check(err, IsNil)
+
+		e := exported{}
+		c.Check(json.Unmarshal(content, &e), IsNil)
+		requests = append(requests, e)
+	}))
+	defer collector.Close()
+
+	c.Assert(Configure(""), IsNil)
+	_, span := Start(context.Background(), "build", KindInternal)
+	c.Assert(span, IsNil)
+	span.Set("box.plan", "box.rb")
+	span.End(nil)
+
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "X-Token=secret")
+	os.Setenv("TRACEPARENT", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+	defer os.Unsetenv("TRACEPARENT")
+	defer Configure("")
+
+	c.Assert(Configure(collector.URL+"/"), IsNil)
+
+	ctx, build := Start(context.Background(), "build", KindInternal)
+	build.Set("box.plan", "box.rb")
+	_, step := Start(ctx, "step run", KindInternal)
+	step.Set("box.cached", true)
+	step.End(errors.New("exit status 1"))
+	build.End(nil)
+	build.End(errors.New("ended twice"))
+
+	c.Assert(FromContext(ctx), Equals, build)
+	c.Assert(Flush(), IsNil)
+	c.Assert(requests, HasLen, 1)
+	c.Assert(requests[0].ResourceSpans[0].Resource.Attributes[0].Key, Equals, "service.name")
+	c.Assert(*requests[0].ResourceSpans[0].Resource.Attributes[0].Value.StringValue, Equals, "box")
+
+	spans := requests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	c.Assert(spans, HasLen, 2)
+
+	// the build joins the trace of $TRACEPARENT.
+	c.Assert(spans[1].Name, Equals, "build")
+	c.Assert(spans[1].TraceID, Equals, "0af7651916cd43dd8448eb211c80319c")
+	c.Assert(spans[1].ParentSpanID, Equals, "b7ad6b7169203331")
+	c.Assert(spans[1].Status.Code, Equals, 1)
+	c.Assert(build.Traceparent(), Equals, "00-0af7651916cd43dd8448eb211c80319c-"+spans[1].SpanID+"-01")
+
+	c.Assert(spans[0].Name, Equals, "step run")
+	c.Assert(spans[0].TraceID, Equals, spans[1].TraceID)
+	c.Assert(spans[0].ParentSpanID, Equals, spans[1].SpanID)
+	c.Assert(spans[0].Status, DeepEquals, otlpStatus{Code: 2, Message: "exit status 1"})
+	c.Assert(spans[0].Attributes, HasLen, 1)
+	c.Assert(*spans[0].Attributes[0].Value.BoolValue, Equals, true)
+
+	// nothing is left to export.
+	c.Assert(Flush(), IsNil)
+	c.Assert(requests, HasLen, 1)
+
+	c.Assert(Configure(collector.URL+"/wrong"), IsNil)
+	_, span = Start(context.Background(), "build", KindInternal)
+	span.End(nil)
+	c.Assert(Flush(), NotNil)
+}
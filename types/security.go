@@ -0,0 +1,228 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Unconfined, as the seccomp or AppArmor profile, runs containers without
+// one.
+const Unconfined = "unconfined"
+
+// DefaultCapabilities are the capabilities containers of run steps have
+// unless they add or drop some: those docker gives containers by default.
+var DefaultCapabilities = []string{
+	"AUDIT_WRITE",
+	"CHOWN",
+	"DAC_OVERRIDE",
+	"FOWNER",
+	"FSETID",
+	"KILL",
+	"MKNOD",
+	"NET_BIND_SERVICE",
+	"NET_RAW",
+	"SETFCAP",
+	"SETGID",
+	"SETPCAP",
+	"SETUID",
+	"SYS_CHROOT",
+}
+
+// capabilities are the capabilities of linux, without CAP_.
+var capabilities = map[string]bool{
+	"AUDIT_CONTROL": true, "AUDIT_READ": true, "AUDIT_WRITE": true,
+	"BLOCK_SUSPEND": true, "BPF": true, "CHECKPOINT_RESTORE": true,
+	"CHOWN": true, "DAC_OVERRIDE": true, "DAC_READ_SEARCH": true,
+	"FOWNER": true, "FSETID": true, "IPC_LOCK": true, "IPC_OWNER": true,
+	"KILL": true, "LEASE": true, "LINUX_IMMUTABLE": true, "MAC_ADMIN": true,
+	"MAC_OVERRIDE": true, "MKNOD": true, "NET_ADMIN": true,
+	"NET_BIND_SERVICE": true, "NET_BROADCAST": true, "NET_RAW": true,
+	"PERFMON": true, "SETFCAP": true, "SETGID": true, "SETPCAP": true,
+	"SETUID": true, "SYSLOG": true, "SYS_ADMIN": true, "SYS_BOOT": true,
+	"SYS_CHROOT": true, "SYS_MODULE": true, "SYS_NICE": true,
+	"SYS_PACCT": true, "SYS_PTRACE": true, "SYS_RAWIO": true,
+	"SYS_RESOURCE": true, "SYS_TIME": true, "SYS_TTY_CONFIG": true,
+	"WAKE_ALARM": true,
+}
+
+// Security is how the containers of run steps are confined. Empty fields are
+// left to the docker daemon's defaults, but for capabilities, which are
+// DefaultCapabilities with CapDrop dropped and CapAdd added.
+type Security struct {
+	Seccomp  string   // a seccomp profile file, or unconfined
+	AppArmor string   // the name of an AppArmor profile loaded on the host, or unconfined
+	SELinux  []string // the parts of an SELinux label, such as type:container_t, or disable
+	CapAdd   []string // capabilities to add, such as NET_ADMIN, or ALL
+	CapDrop  []string // capabilities to drop, or ALL
+	Network  string   // none, host, bridge, or the name of a docker network
+}
+
+// DefaultCapabilities is true if the containers have the capabilities they
+// have by default, as no capability is added or dropped.
+func (s Security) DefaultCapabilities() bool {
+	return len(s.CapAdd) == 0 && len(s.CapDrop) == 0
+}
+
+// Empty is true if the security leaves the containers as they are by
+// default.
+func (s Security) Empty() bool {
+	return s.Seccomp == "" && s.AppArmor == "" && len(s.SELinux) == 0 && s.DefaultCapabilities() && s.Network == ""
+}
+
+// Key returns how the security confines the containers, for the cache keys
+// of the steps run in them: their options, capabilities and network. Seccomp
+// profiles are keyed on their content.
+func (s Security) Key() string {
+	opts, _ := s.Options()
+	caps, _ := s.Capabilities()
+
+	return strings.Join([]string{strings.Join(opts, "\n"), strings.Join(caps, ","), s.Network}, "\n")
+}
+
+// validNetwork matches the names of docker networks.
+var validNetwork = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Merge returns the security with the fields set in step in place of its
+// own. The capabilities step drops are dropped from those it adds, then the
+// capabilities step adds and drops are added to its own.
+func (s Security) Merge(step Security) Security {
+	if step.Seccomp != "" {
+		s.Seccomp = step.Seccomp
+	}
+
+	if step.AppArmor != "" {
+		s.AppArmor = step.AppArmor
+	}
+
+	if len(step.SELinux) > 0 {
+		s.SELinux = step.SELinux
+	}
+
+	if step.Network != "" {
+		s.Network = step.Network
+	}
+
+	dropped := map[string]bool{}
+	for _, name := range step.CapDrop {
+		dropped[capName(name)] = true
+	}
+
+	capAdd := []string{}
+	for _, name := range s.CapAdd {
+		if !dropped["ALL"] && !dropped[capName(name)] {
+			capAdd = append(capAdd, name)
+		}
+	}
+
+	s.CapAdd = append(capAdd, step.CapAdd...)
+	s.CapDrop = append(append([]string{}, s.CapDrop...), step.CapDrop...)
+
+	return s
+}
+
+// Validate returns an error if the containers can't be confined as the
+// security says.
+func (s Security) Validate() error {
+	if _, err := s.Options(); err != nil {
+		return err
+	}
+
+	if s.Network != "" && !validNetwork.MatchString(s.Network) {
+		return fmt.Errorf("invalid network %q: must be none, host, bridge or the name of a docker network", s.Network)
+	}
+
+	_, err := s.Capabilities()
+	return err
+}
+
+// capName returns the name of a capability as docker takes it: upper case,
+// without CAP_.
+func capName(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+}
+
+// Capabilities returns the capabilities the containers have, sorted: the
+// default ones without those dropped, then with those added, as docker does
+// with --cap-drop and --cap-add. ALL adds or drops every capability. Names
+// are case-insensitive, with or without CAP_.
+func (s Security) Capabilities() ([]string, error) {
+	caps := map[string]bool{}
+	for _, name := range DefaultCapabilities {
+		caps[name] = true
+	}
+
+	for _, list := range []struct {
+		names []string
+		keep  bool
+	}{{s.CapDrop, false}, {s.CapAdd, true}} {
+		for _, name := range list.names {
+			name = capName(name)
+
+			switch {
+			case name == "ALL":
+				for cap := range capabilities {
+					caps[cap] = list.keep
+				}
+			case capabilities[name]:
+				caps[name] = list.keep
+			default:
+				return nil, fmt.Errorf("unknown capability %q", name)
+			}
+		}
+	}
+
+	names := []string{}
+	for name, keep := range caps {
+		if keep {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Options returns the security options of docker containers, reading the
+// seccomp profile, which docker is given the content of.
+func (s Security) Options() ([]string, error) {
+	opts := []string{}
+
+	switch s.Seccomp {
+	case "":
+	case Unconfined:
+		opts = append(opts, "seccomp="+Unconfined)
+	default:
+		content, err := ioutil.ReadFile(s.Seccomp)
+		if err != nil {
+			return nil, fmt.Errorf("seccomp profile: %v", err)
+		}
+
+		if !json.Valid(content) {
+			return nil, fmt.Errorf("seccomp profile %s is not JSON", s.Seccomp)
+		}
+
+		opts = append(opts, "seccomp="+string(content))
+	}
+
+	if s.AppArmor != "" {
+		opts = append(opts, "apparmor="+s.AppArmor)
+	}
+
+	for _, label := range s.SELinux {
+		parts := strings.SplitN(label, ":", 2)
+		switch {
+		case label == "disable":
+		case len(parts) == 2 && parts[1] != "" && (parts[0] == "user" || parts[0] == "role" || parts[0] == "type" || parts[0] == "level"):
+		default:
+			return nil, fmt.Errorf("invalid SELinux label %q: must be user:, role:, type: or level: and a value, or disable", label)
+		}
+
+		opts = append(opts, "label="+label)
+	}
+
+	return opts, nil
+}
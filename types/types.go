@@ -3,7 +3,15 @@ package types
 import (
 	"context"
 
+	"github.com/box-builder/box/buildreport"
+	"github.com/box-builder/box/cache"
+	"github.com/box-builder/box/graph"
 	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/provenance"
+	"github.com/box-builder/box/sched"
+	"github.com/box-builder/box/signal"
+	"github.com/box-builder/box/timing"
 )
 
 // BuildResult is an bunch of stuff that communicates a build result.
@@ -15,10 +23,43 @@ type BuildResult struct {
 
 // Global represents global variables for the processing of an entire box run.
 type Global struct {
-	Cache     bool
-	TTY       bool
-	ShowRun   bool
-	OmitFuncs []string
-	Logger    *logger.Logger
-	Context   context.Context
+	Cache             bool
+	CacheFrom         []string              // registry repositories or cache backends to import the build cache from
+	CacheFromImages   []string              // images whose layers are re-used for the steps found in their history
+	CacheTo           string                // registry repository or cache backend to export the build cache to
+	Report            *cache.Report         // if set, the cache hits and misses are recorded into the report
+	Timing            *timing.Report        // if set, the time, CPU and bytes written of each step are recorded into it
+	Warnings          *buildreport.Warnings // if set, the warnings of the build are recorded into it
+	TTY               bool
+	ShowRun           bool
+	OmitFuncs         []string
+	Vars              map[string]string    // variables exposed to the plan with getvar
+	Labels            map[string]string    // if set, the image built is labeled with these as its last step
+	Profiles          []string             // profiles selected for the build
+	Platform          string               // if set, the os/arch[/variant] to build for instead of the docker host's
+	Compression       string               // the compression of the layers box writes: gzip, zstd or estargz
+	Reproducible      bool                 // if set, the image built is normalized so the same inputs give the same image ID
+	Exclude           []string             // patterns of the files left out of flattened layers
+	SignBy            string               // if set, the ID of the GPG key images pushed are signed with
+	EncryptRecipients []string             // if set, the public key files the layers of images written out are encrypted for
+	DecryptKeys       []string             // if set, the private key files encrypted images used with from are decrypted with
+	EagerPull         bool                 // if set, images used with from are pulled at once, not when a step first needs them
+	SignaturePolicy   string               // if set, the policy.json images used with from must be allowed by
+	Policy            *policy.Policy       // if set, the policy the images used with from must be allowed by
+	Provenance        *provenance.Recorder // if set, the images and files used with from are recorded into it
+	Security          Security             // how the containers of run steps are confined
+	ScanSecrets       string               // if set, warn or fail: what to do when secrets are found in the layers built
+	Scheduler         *sched.Scheduler     // if set, the containers of run steps wait for their jobs from it
+	Weight            int                  // the jobs the containers of run steps take from the scheduler
+	Priority          int                  // the priority of the containers of run steps in the scheduler
+	Executor          string               // what runs the steps: docker if empty, or runc to run them without docker
+	Runtime           string               // the OCI runtime the runc executor runs steps with; runc if empty
+	Snapshotter       string               // how the runc executor makes the root filesystems of steps; auto if empty
+	KubeRegistry      string               // the repository the kubernetes executor pushes the images of its steps to, for the pods to pull
+	GzipWorkers       int                  // the goroutines layers are gzipped with; one for each CPU if zero
+	SpillThreshold    int64                // the size above which layers are buffered on disk; spill.DefaultThreshold if zero
+	Signals           *signal.Cancellable  // if set, the temporary files of the build are removed by it on interrupt
+	Logger            *logger.Logger
+	Context           context.Context
+	Graph             *graph.Graph // if set, steps are recorded into the graph instead of run
 }
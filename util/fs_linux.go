@@ -0,0 +1,27 @@
+package util
+
+import "golang.org/x/sys/unix"
+
+// the magic numbers statfs gives the filesystems which make snapshots.
+const (
+	btrfsMagic = 0x9123683e
+	zfsMagic   = 0x2fc12fc1
+)
+
+// Filesystem returns btrfs or zfs if the directory is on one of them, which
+// make copy-on-write snapshots of their directories, and nothing otherwise.
+func Filesystem(dir string) string {
+	stat := unix.Statfs_t{}
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return ""
+	}
+
+	switch uint32(stat.Type) {
+	case btrfsMagic:
+		return "btrfs"
+	case zfsMagic:
+		return "zfs"
+	}
+
+	return ""
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+// Filesystem returns btrfs or zfs if the directory is on one of them, which
+// make copy-on-write snapshots of their directories; it is only known on
+// linux.
+func Filesystem(dir string) string {
+	return ""
+}
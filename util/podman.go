@@ -0,0 +1,35 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PodmanSocket returns the socket of the podman API service: that run by root,
+// at /run/podman/podman.sock, when box runs as root, and otherwise the user's,
+// podman/podman.sock in $XDG_RUNTIME_DIR. They are started with systemctl
+// start podman.socket, and systemctl --user start podman.socket.
+func PodmanSocket() string {
+	if os.Geteuid() == 0 {
+		return "/run/podman/podman.sock"
+	}
+
+	return filepath.Join(runtimeDir(), "podman", "podman.sock")
+}
+
+// UsePodman points the docker client at the podman API service, which serves
+// the API of docker, by setting $DOCKER_HOST. $DOCKER_HOST is left alone if it
+// is set. It is an error for the service not to run.
+func UsePodman() error {
+	if os.Getenv("DOCKER_HOST") != "" {
+		return nil
+	}
+
+	socket := PodmanSocket()
+	if _, err := os.Stat(socket); err != nil {
+		return fmt.Errorf("no podman API service runs at %s: start it with systemctl start podman.socket, or systemctl --user start podman.socket: %v", socket, err)
+	}
+
+	return os.Setenv("DOCKER_HOST", "unix://"+socket)
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// systemSocket is the socket of the docker daemon run by root.
+const systemSocket = "/var/run/docker.sock"
+
+// RootlessSocket returns the socket of the rootless docker daemon of the user,
+// docker.sock in $XDG_RUNTIME_DIR, which is /run/user/<uid> if it is not set.
+// The daemon runs in a user namespace, mapping root in its containers to the
+// user; see dockerd-rootless-setuptool.sh.
+func RootlessSocket() string {
+	return filepath.Join(runtimeDir(), "docker.sock")
+}
+
+// runtimeDir returns $XDG_RUNTIME_DIR, or /run/user/<uid> if it is not set.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+
+	return filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+}
+
+// UseRootlessDocker points the docker client at the rootless docker daemon of
+// the user, by setting $DOCKER_HOST, and returns whether it did. $DOCKER_HOST
+// is left alone if it is set. Otherwise the rootless daemon is used if force
+// is set, when it is an error for it not to run, or when box does not run as
+// root, cannot reach the daemon run by root, and the rootless daemon runs.
+func UseRootlessDocker(force bool) (bool, error) {
+	if os.Getenv("DOCKER_HOST") != "" {
+		return false, nil
+	}
+
+	socket := RootlessSocket()
+	_, err := os.Stat(socket)
+
+	if force {
+		if err != nil {
+			return false, fmt.Errorf("no rootless docker daemon runs at %s: %v", socket, err)
+		}
+	} else if err != nil || os.Geteuid() == 0 || syscall.Access(systemSocket, 2) == nil {
+		return false, nil
+	}
+
+	return true, os.Setenv("DOCKER_HOST", "unix://"+socket)
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type rootlessSuite struct {
+	env map[string]string
+}
+
+var _ = Suite(&rootlessSuite{})
+
+func TestUtil(t *T) {
+	TestingT(t)
+}
+
+func (rs *rootlessSuite) SetUpTest(c *C) {
+	rs.env = map[string]string{}
+	for _, name := range []string{"DOCKER_HOST", "XDG_RUNTIME_DIR"} {
+		rs.env[name] = os.Getenv(name)
+		os.Unsetenv(name)
+	}
+}
+
+func (rs *rootlessSuite) TearDownTest(c *C) {
+	for name, value := range rs.env {
+		os.Setenv(name, value)
+	}
+}
+
+func (rs *rootlessSuite) TestRootlessSocket(c *C) {
+	c.Assert(RootlessSocket(), Equals, filepath.Join("/run/user", strconv.Itoa(os.Getuid()), "docker.sock"))
+
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/test")
+	c.Assert(RootlessSocket(), Equals, "/run/user/test/docker.sock")
+}
+
+func (rs *rootlessSuite) TestUseRootlessDocker(c *C) {
+	dir := c.MkDir()
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+
+	used, err := UseRootlessDocker(true)
+	c.Assert(err, NotNil)
+	c.Assert(used, Equals, false)
+
+	used, err = UseRootlessDocker(false)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, false)
+
+	socket := filepath.Join(dir, "docker.sock")
+	c.Assert(ioutil.WriteFile(socket, []byte{}, 0600), IsNil)
+
+	used, err = UseRootlessDocker(true)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, true)
+	c.Assert(os.Getenv("DOCKER_HOST"), Equals, "unix://"+socket)
+
+	// $DOCKER_HOST, once set, is left alone.
+	os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375")
+	used, err = UseRootlessDocker(true)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, false)
+	c.Assert(os.Getenv("DOCKER_HOST"), Equals, "tcp://127.0.0.1:2375")
+}
@@ -3,8 +3,15 @@ package util
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"k8s.io/client-go/util/homedir"
 )
 
 // CheckContext validates that a context, if done, returns the appropriate
@@ -49,3 +56,41 @@ func InterfaceListToString(list interface{}) ([]string, error) {
 
 	return strList, nil
 }
+
+// BoxDir returns the path to box's state directory, joined with any
+// additional path elements. It is $BOX_HOME if set, otherwise ~/.box.
+func BoxDir(elems ...string) string {
+	dir := os.Getenv("BOX_HOME")
+	if dir == "" {
+		dir = filepath.Join(homedir.HomeDir(), ".box")
+	}
+
+	return filepath.Join(append([]string{dir}, elems...)...)
+}
+
+// SourceDateEpoch returns the time $SOURCE_DATE_EPOCH, in seconds since the
+// Unix epoch, gives, and whether it is set. Builds which set it embed no time
+// later than it, so they can be reproduced.
+func SourceDateEpoch() (time.Time, bool, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: must be a number of seconds since the Unix epoch", value)
+	}
+
+	return time.Unix(seconds, 0).UTC(), true, nil
+}
+
+// BuildTime returns the time images and history entries made now are created
+// at: the time SOURCE_DATE_EPOCH gives if it is set, otherwise now.
+func BuildTime() time.Time {
+	if epoch, ok, err := SourceDateEpoch(); ok && err == nil {
+		return epoch
+	}
+
+	return time.Now()
+}
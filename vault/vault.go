@@ -0,0 +1,122 @@
+// Package vault talks to the HTTP API of HashiCorp Vault, for the keys kept in
+// its transit secrets engine and the secrets kept in its KV secrets engines.
+//
+// Vault is reached at $VAULT_ADDR, with the token in $VAULT_TOKEN or, as the
+// vault CLI keeps it after vault login, in ~/.vault-token. $VAULT_NAMESPACE
+// selects a namespace of Vault Enterprise.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/client-go/util/homedir"
+)
+
+// token returns the token to reach vault with.
+func token() string {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(homedir.HomeDir(), ".vault-token"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// Request makes a request of the API at the path, beneath /v1, with the body,
+// if it is not nil, as JSON. The response is decoded into result.
+func Request(ctx context.Context, method, path string, body, result interface{}) error {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return errors.New("VAULT_ADDR must be set to use vault")
+	}
+
+	u := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(addr, "/"), strings.TrimPrefix(path, "/"))
+
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Vault-Token", token())
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// vault explains what went wrong in a list of errors.
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		explained := struct{ Errors []string }{}
+		if json.Unmarshal(content, &explained) == nil && len(explained.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.Join(explained.Errors, "; "))
+		}
+
+		return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(content)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Read reads the field of the secret at path, path#field, in a KV secrets
+// engine, version 1 or 2. For version 2 the path is the one the API reads the
+// secret at, with data/ after the mount, such as kv/data/ci#password.
+func Read(ctx context.Context, ref string) ([]byte, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid vault secret %q: must be path#field", ref)
+	}
+
+	result := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	if err := Request(ctx, "GET", parts[0], nil, &result); err != nil {
+		return nil, err
+	}
+
+	// version 2 keeps the fields of the secret in data, beside its metadata.
+	fields := result.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		if _, ok := fields["metadata"]; ok {
+			fields = nested
+		}
+	}
+
+	value, ok := fields[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no field %s", parts[0], parts[1])
+	}
+
+	if str, ok := value.(string); ok {
+		return []byte(str), nil
+	}
+
+	return json.Marshal(value)
+}
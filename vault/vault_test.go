@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type vaultSuite struct{}
+
+var _ = Suite(&vaultSuite{})
+
+func TestVault(t *T) {
+	TestingT(t)
+}
+
+// newTestVault serves the secrets by path, as the KV engines do, to clients
+// with the token.
+func newTestVault(token string, secrets map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+
+		secret, ok := secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": secret})
+	}))
+}
+
+func (vs *vaultSuite) TestRead(c *C) {
+	server := newTestVault("s.token", map[string]interface{}{
+		"/v1/kv/data/ci": map[string]interface{}{
+			"data":     map[string]interface{}{"password": "hunter2", "port": 5432},
+			"metadata": map[string]interface{}{"version": 3},
+		},
+		"/v1/secret/ci": map[string]interface{}{"password": "swordfish"},
+	})
+	defer server.Close()
+
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	ctx := context.Background()
+
+	os.Unsetenv("VAULT_ADDR")
+	_, err := Read(ctx, "kv/data/ci#password")
+	c.Assert(err, NotNil)
+
+	os.Setenv("VAULT_ADDR", server.URL+"/")
+	os.Setenv("VAULT_TOKEN", "s.token")
+
+	value, err := Read(ctx, "kv/data/ci#password")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "hunter2")
+
+	value, err = Read(ctx, "kv/data/ci#port")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "5432")
+
+	value, err = Read(ctx, "secret/ci#password")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "swordfish")
+
+	for _, ref := range []string{"kv/data/ci", "kv/data/ci#", "#password", "kv/data/ci#user", "kv/data/missing#password"} {
+		_, err := Read(ctx, ref)
+		c.Assert(err, NotNil, Commentf("%s", ref))
+	}
+
+	os.Setenv("VAULT_TOKEN", "s.other")
+	_, err = Read(ctx, "kv/data/ci#password")
+	c.Assert(err, ErrorMatches, ".*permission denied")
+
+	// without $VAULT_TOKEN, the token vault login keeps is used.
+	home := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(home, ".vault-token"), []byte("s.token\n"), 0600), IsNil)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	os.Unsetenv("VAULT_TOKEN")
+
+	value, err = Read(ctx, "kv/data/ci#password")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "hunter2")
+}
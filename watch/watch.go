@@ -0,0 +1,136 @@
+// Package watch polls a build context for changes so plans can be rebuilt
+// when their inputs change.
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+type fileState struct {
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// Watcher polls a set of paths at an interval. Directories are walked
+// recursively. Files matching the ignore patterns (in .dockerignore syntax)
+// are not considered.
+type Watcher struct {
+	paths    []string
+	ignore   []string
+	interval time.Duration
+	state    map[string]fileState
+}
+
+// New constructs a *Watcher. The state of the paths is recorded
+// immediately, so only changes after this call are reported.
+func New(interval time.Duration, ignore []string, paths ...string) (*Watcher, error) {
+	w := &Watcher{
+		paths:    paths,
+		ignore:   ignore,
+		interval: interval,
+	}
+
+	var err error
+	w.state, err = w.snapshot()
+	return w, err
+}
+
+func (w *Watcher) snapshot() (map[string]fileState, error) {
+	state := map[string]fileState{}
+
+	for _, p := range w.paths {
+		err := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// files may disappear while we walk; that is a change we will see
+				// on the next pass.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if fi.IsDir() && fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			rel, err := filepath.Rel(p, path)
+			if err != nil {
+				return err
+			}
+
+			if rel != "." {
+				ignored, err := fileutils.Matches(rel, w.ignore)
+				if err != nil {
+					return err
+				}
+
+				if ignored {
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+
+			// directories change whenever their contents do, which we already see.
+			if !fi.IsDir() {
+				state[path] = fileState{size: fi.Size(), mode: fi.Mode(), modTime: fi.ModTime()}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+func changed(a, b map[string]fileState) []string {
+	paths := []string{}
+
+	for path, state := range a {
+		if other, ok := b[path]; !ok || other != state {
+			paths = append(paths, path)
+		}
+	}
+
+	for path := range b {
+		if _, ok := a[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// Wait blocks until something changes, returning the changed paths. It
+// returns the context's error if it is canceled first.
+func (w *Watcher) Wait(ctx context.Context) ([]string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(w.interval):
+		}
+
+		state, err := w.snapshot()
+		if err != nil {
+			return nil, err
+		}
+
+		if paths := changed(w.state, state); len(paths) > 0 {
+			w.state = state
+			return paths, nil
+		}
+	}
+}
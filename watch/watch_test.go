@@ -0,0 +1,48 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type watchSuite struct{}
+
+var _ = Suite(&watchSuite{})
+
+func TestWatch(t *T) {
+	TestingT(t)
+}
+
+func (ws *watchSuite) TestWait(c *C) {
+	dir, err := ioutil.TempDir("", "box-watch-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.Mkdir(filepath.Join(dir, "ignored"), 0755), IsNil)
+
+	w, err := New(10*time.Millisecond, []string{"ignored"}, dir)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "ignored", "file"), []byte("hi"), 0644), IsNil)
+	_, err = w.Wait(ctx)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hi"), 0644), IsNil)
+	paths, err := w.Wait(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{filepath.Join(dir, "file")})
+
+	c.Assert(os.Remove(filepath.Join(dir, "file")), IsNil)
+	paths, err = w.Wait(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{filepath.Join(dir, "file")})
+}
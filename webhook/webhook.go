@@ -0,0 +1,171 @@
+// Package webhook notifies URLs of builds as they finish: whether they
+// succeeded, their image and how long they took, and the tail of their log,
+// so chatops and deployment pipelines can act on them. Payloads are signed
+// with HMAC-SHA256 when a secret is given, and may be templated.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// The events notified.
+const (
+	Succeeded = "build.succeeded"
+	Failed    = "build.failed"
+)
+
+// SignatureHeader is the header the signature of the payload is sent in:
+// sha256= and the hex HMAC-SHA256 of the payload with the secret.
+const SignatureHeader = "X-Box-Signature-256"
+
+// attempts is how many times a payload is sent before giving up on the URL,
+// as long as the URL fails on its end.
+const attempts = 3
+
+var (
+	client = &http.Client{Timeout: 10 * time.Second}
+
+	// retryDelay is how long to wait before sending a payload again; it
+	// doubles each time.
+	retryDelay = time.Second
+)
+
+// Event is a build finished, as webhooks are notified of it.
+type Event struct {
+	Event    string    `json:"event"`
+	Plan     string    `json:"plan"`
+	Image    string    `json:"image,omitempty"` // the ID of the image built
+	Tag      string    `json:"tag,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Duration float64   `json:"duration"` // in seconds
+	Host     string    `json:"host"`
+	Build    string    `json:"build,omitempty"`  // the ID of the build, for builds run by box serve
+	Pushed   []Pushed  `json:"pushed,omitempty"` // the images pushed with --output
+	Log      string    `json:"log"`              // the last lines of the log of the build
+}
+
+// Pushed is an image pushed, and the digest of its manifest if it is known.
+type Pushed struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Hook sends events to URLs.
+type Hook struct {
+	URLs     []string
+	Secret   string             // if set, payloads are signed with it
+	Template *template.Template // if set, payloads are rendered with it; they are the events as JSON otherwise
+}
+
+// ParseTemplate parses the template of payloads. Templates are rendered
+// with an Event, and may escape strings into JSON with the json function.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			content, err := json.Marshal(v)
+			return string(content), err
+		},
+	}).Parse(text)
+}
+
+// Payload returns the payload of the event.
+func (h *Hook) Payload(e Event) ([]byte, error) {
+	if h.Template == nil {
+		return json.Marshal(e)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := h.Template.Execute(buf, e); err != nil {
+		return nil, fmt.Errorf("could not render the webhook payload: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Sign returns the signature of the payload with the secret.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify sends the event to each URL, and returns the errors of those it
+// could not be sent to.
+func (h *Hook) Notify(ctx context.Context, e Event) []error {
+	payload, err := h.Payload(e)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+	for _, url := range h.URLs {
+		if err := h.send(ctx, url, e.Event, payload); err != nil {
+			errs = append(errs, fmt.Errorf("could not notify %s: %v", url, err))
+		}
+	}
+
+	return errs
+}
+
+// send posts the payload to the URL, again after a while if the URL could
+// not be reached or failed on its end.
+func (h *Hook) send(ctx context.Context, url, event string, payload []byte) error {
+	delay := retryDelay
+
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(ctx, url, event, payload)
+		if err == nil || !retry || attempt == attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// post posts the payload once, and returns whether to post it again if it
+// failed.
+func (h *Hook) post(ctx context.Context, url, event string, payload []byte) (bool, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "box-webhook")
+	req.Header.Set("X-Box-Event", event)
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("%s", resp.Status)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type webhookSuite struct{}
+
+var _ = Suite(&webhookSuite{})
+
+func TestWebhook(t *T) {
+	TestingT(t)
+}
+
+func (ws *webhookSuite) TestNotify(c *C) {
+	retryDelay = time.Millisecond
+
+	payloads := [][]byte{}
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, err := ioutil.ReadAll(r.Body)
+		c.Check(err, IsNil)
+
+		// the first request fails, and is sent again.
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		c.Check(r.Header.Get("X-Box-Event"), Equals, Failed)
+		if r.Header.Get(SignatureHeader) != "" {
+			c.Check(r.Header.Get(SignatureHeader), Equals, Sign("secret", content))
+		}
+
+		payloads = append(payloads, content)
+	}))
+	defer server.Close()
+
+	e := Event{
+		Event:    Failed,
+		Plan:     "box.rb",
+		Error:    `exit status "1"`,
+		Duration: 1.5,
+		Log:      "make: *** [all] Error 1",
+	}
+
+	h := &Hook{URLs: []string{server.URL}, Secret: "secret"}
+	c.Assert(h.Notify(context.Background(), e), HasLen, 0)
+	c.Assert(payloads, HasLen, 1)
+
+	sent := Event{}
+	c.Assert(json.Unmarshal(payloads[0], &sent), IsNil)
+	c.Assert(sent, DeepEquals, e)
+
+	tmpl, err := ParseTemplate("slack", `{"text": {{ json (printf "%s failed: %s" .Plan .Error) }}}`)
+	c.Assert(err, IsNil)
+
+	h = &Hook{URLs: []string{server.URL}, Template: tmpl}
+	c.Assert(h.Notify(context.Background(), e), HasLen, 0)
+	c.Assert(string(payloads[1]), Equals, `{"text": "box.rb failed: exit status \"1\""}`)
+
+	// URLs which refuse the payload are not sent it again.
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer refusing.Close()
+
+	h = &Hook{URLs: []string{refusing.URL, server.URL}}
+	errs := h.Notify(context.Background(), e)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*400 Bad Request")
+	c.Assert(payloads, HasLen, 3)
+}